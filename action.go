@@ -243,6 +243,9 @@ func (a Action) Validate() (err error) {
 	if a.Target == "" {
 		return errors.New("Action.Target is empty. Expecting string.")
 	}
+	if _, err := ParseTarget(a.Target); err != nil {
+		return fmt.Errorf("Action.Target is invalid: %v", err)
+	}
 	if a.SyntaxVersion != ActionVersion {
 		return fmt.Errorf("Wrong Syntax Version integer. Expection version %d", ActionVersion)
 	}
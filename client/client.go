@@ -812,6 +812,43 @@ func (cli Client) PostAction(a mig.Action) (a2 mig.Action, err error) {
 	return
 }
 
+// CancelAction asks the API to cancel an action that has not finished yet
+func (cli Client) CancelAction(aid float64) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("CancelAction() -> %v", e)
+		}
+	}()
+	data := url.Values{"actionid": {fmt.Sprintf("%.0f", aid)}}
+	r, err := http.NewRequest("POST", cli.Conf.API.URL+"action/cancel/", strings.NewReader(data.Encode()))
+	if err != nil {
+		panic(err)
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := cli.Do(r)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		panic(err)
+	}
+	var resource *cljs.Resource
+	if len(body) > 1 {
+		err = json.Unmarshal(body, &resource)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		err = fmt.Errorf("error: HTTP %d. Action cancellation failed with error '%v' (code %s).",
+			resp.StatusCode, resource.Collection.Error.Message, resource.Collection.Error.Code)
+		panic(err)
+	}
+	return
+}
+
 func ValueToAction(v interface{}) (a mig.Action, err error) {
 	defer func() {
 		if e := recover(); e != nil {
@@ -829,6 +866,128 @@ func ValueToAction(v interface{}) (a mig.Action, err error) {
 	return
 }
 
+// PostHunt submits a signed action to the API as a hunt, which runs the action
+// on the agents that match its target until it expires, including the agents
+// that come online after it was launched
+func (cli Client) PostHunt(a mig.Action) (h mig.Hunt, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("PostHunt() -> %v", e)
+		}
+	}()
+	a.SyntaxVersion = mig.ActionVersion
+	ajson, err := json.Marshal(a)
+	if err != nil {
+		panic(err)
+	}
+	data := url.Values{"action": {string(ajson)}}
+	r, err := http.NewRequest("POST", cli.Conf.API.URL+"hunt/create/", strings.NewReader(data.Encode()))
+	if err != nil {
+		panic(err)
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := cli.Do(r)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		panic(err)
+	}
+	var resource *cljs.Resource
+	err = json.Unmarshal(body, &resource)
+	if err != nil {
+		panic(err)
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		err = fmt.Errorf("error: HTTP %d. hunt creation failed with error '%v' (code %s).",
+			resp.StatusCode, resource.Collection.Error.Message, resource.Collection.Error.Code)
+		panic(err)
+	}
+	h, err = ValueToHunt(resource.Collection.Items[0].Data[0].Value)
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+// GetHunt retrieves a hunt, its action and its coverage from the API using its ID
+func (cli Client) GetHunt(hid float64) (h mig.Hunt, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("GetHunt() -> %v", e)
+		}
+	}()
+	target := fmt.Sprintf("hunt?huntid=%.0f", hid)
+	resource, err := cli.GetAPIResource(target)
+	if err != nil {
+		panic(err)
+	}
+	if resource.Collection.Items[0].Data[0].Name != "hunt" {
+		panic("API returned something that is not a hunt... something's wrong.")
+	}
+	h, err = ValueToHunt(resource.Collection.Items[0].Data[0].Value)
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+// CancelHunt asks the API to stop a hunt from running its action on new agents
+func (cli Client) CancelHunt(hid float64) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("CancelHunt() -> %v", e)
+		}
+	}()
+	data := url.Values{"huntid": {fmt.Sprintf("%.0f", hid)}}
+	r, err := http.NewRequest("POST", cli.Conf.API.URL+"hunt/cancel/", strings.NewReader(data.Encode()))
+	if err != nil {
+		panic(err)
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := cli.Do(r)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		panic(err)
+	}
+	var resource *cljs.Resource
+	if len(body) > 1 {
+		err = json.Unmarshal(body, &resource)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		err = fmt.Errorf("error: HTTP %d. Hunt cancellation failed with error '%v' (code %s).",
+			resp.StatusCode, resource.Collection.Error.Message, resource.Collection.Error.Code)
+		panic(err)
+	}
+	return
+}
+
+func ValueToHunt(v interface{}) (h mig.Hunt, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("ValueToHunt() -> %v", e)
+		}
+	}()
+	bData, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	err = json.Unmarshal(bData, &h)
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
 func ValueToLoaderEntry(v interface{}) (l mig.LoaderEntry, err error) {
 	defer func() {
 		if e := recover(); e != nil {
@@ -884,6 +1043,44 @@ func (cli Client) GetCommand(cmdid float64) (cmd mig.Command, err error) {
 	return
 }
 
+// GetCommandPage retrieves a command with only the elements of its results between
+// offset and offset+limit, and returns the total number of elements of the command
+func (cli Client) GetCommandPage(cmdid float64, offset, limit int) (cmd mig.Command, total int, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("GetCommandPage() -> %v", e)
+		}
+	}()
+	target := fmt.Sprintf("command?commandid=%.0f&offset=%d&limit=%d", cmdid, offset, limit)
+	resource, err := cli.GetAPIResource(target)
+	if err != nil {
+		panic(err)
+	}
+	for _, data := range resource.Collection.Items[0].Data {
+		switch data.Name {
+		case "command":
+			cmd, err = ValueToCommand(data.Value)
+			if err != nil {
+				panic(err)
+			}
+		case "elements":
+			page, ok := data.Value.(map[string]interface{})
+			if !ok {
+				panic("API returned invalid elements counters")
+			}
+			t, ok := page["total"].(float64)
+			if !ok {
+				panic("API returned invalid elements counters")
+			}
+			total = int(t)
+		}
+	}
+	if cmd.ID == 0 {
+		panic("API returned something that is not a command... something's wrong.")
+	}
+	return
+}
+
 func ValueToCommand(v interface{}) (cmd mig.Command, err error) {
 	defer func() {
 		if e := recover(); e != nil {
@@ -1227,13 +1424,18 @@ func (cli Client) ResolveTargetMacro(target string) string {
 	return v
 }
 
-// EvaluateAgentTarget runs a search against the api to find all agents that match an action target string
+// EvaluateAgentTarget checks the syntax of a target expression and runs a search
+// against the api to find all agents that match it
 func (cli Client) EvaluateAgentTarget(target string) (agents []mig.Agent, err error) {
 	defer func() {
 		if e := recover(); e != nil {
 			err = fmt.Errorf("EvaluateAgentTarget() -> %v", e)
 		}
 	}()
+	_, err = mig.ParseTarget(target)
+	if err != nil {
+		panic(err)
+	}
 	query := "search?type=agent&limit=1000000&target=" + url.QueryEscape(target)
 	resource, err := cli.GetAPIResource(query)
 	if err != nil {
@@ -1254,6 +1456,79 @@ func (cli Client) EvaluateAgentTarget(target string) (agents []mig.Agent, err er
 	return
 }
 
+// GetActionProgress retrieves the progress reports of the running commands of an
+// action received after a point in time, in the order they were received
+func (cli Client) GetActionProgress(aid float64, since time.Time) (reports []mig.CommandProgress, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("GetActionProgress() -> %v", e)
+		}
+	}()
+	target := fmt.Sprintf("action/progress?actionid=%.0f", aid)
+	if !since.IsZero() {
+		target += "&since=" + url.QueryEscape(since.Format(time.RFC3339Nano))
+	}
+	resource, err := cli.GetAPIResource(target)
+	if err != nil {
+		panic(err)
+	}
+	for _, item := range resource.Collection.Items {
+		for _, data := range item.Data {
+			if data.Name != "progress" {
+				continue
+			}
+			bData, err := json.Marshal(data.Value)
+			if err != nil {
+				panic(err)
+			}
+			var cp mig.CommandProgress
+			err = json.Unmarshal(bData, &cp)
+			if err != nil {
+				panic(err)
+			}
+			reports = append(reports, cp)
+		}
+	}
+	return
+}
+
+// PrintProgress returns the lines describing a progress report, using the
+// progress printer of the module if it has one
+func PrintProgress(cp mig.CommandProgress) (prints []string, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("PrintProgress() -> %v", e)
+		}
+	}()
+	if mod, ok := modules.Available[cp.Module]; ok {
+		if printer, ok := mod.NewRun().(modules.HasProgressPrinter); ok {
+			prints, err = printer.PrintProgress(cp.Progress)
+			if err != nil {
+				panic(err)
+			}
+			if cp.Progress.Percent > 0 {
+				prints = append(prints, fmt.Sprintf("%.1f%% done", cp.Progress.Percent))
+			}
+			return
+		}
+	}
+	// without a printer, show the progress as json
+	for _, v := range []interface{}{cp.Progress.Statistics, cp.Progress.Elements} {
+		if v == nil {
+			continue
+		}
+		buf, err := json.Marshal(v)
+		if err != nil {
+			panic(err)
+		}
+		prints = append(prints, string(buf))
+	}
+	if cp.Progress.Percent > 0 {
+		prints = append(prints, fmt.Sprintf("%.1f%% done", cp.Progress.Percent))
+	}
+	return
+}
+
 // FollowAction continuously loops over an action and prints its completion status in os.Stderr.
 // when the action reaches its expiration date, FollowAction prints its final status and returns.
 func (cli Client) FollowAction(a mig.Action, total int) (err error) {
@@ -1272,7 +1547,23 @@ func (cli Client) FollowAction(a mig.Action, total int) (err error) {
 	bar.SetMaxWidth(80)
 	bar.Output = os.Stderr
 	bar.Start()
+	var lastProgress time.Time
 	for {
+		// print the progress reported by the agents and the early hits
+		// of the modules since the last loop
+		reports, perr := cli.GetActionProgress(a.ID, lastProgress)
+		if perr == nil {
+			for _, cp := range reports {
+				lastProgress = cp.ReceivedAt
+				lines, err := PrintProgress(cp)
+				if err != nil {
+					continue
+				}
+				for _, line := range lines {
+					fmt.Fprintf(os.Stderr, "\r\x1b[K%s %s\n", cp.Agent.Name, line)
+				}
+			}
+		}
 		a, _, err = cli.GetAction(a.ID)
 		if err != nil {
 			attempts++
@@ -9,6 +9,8 @@ package client /* import "mig.ninja/mig/client" */
 import (
 	"fmt"
 	"strings"
+
+	"mig.ninja/mig"
 )
 
 // Parse macros specified in the client configuration for use in the client
@@ -27,6 +29,10 @@ func addTargetMacros(conf *Configuration) (err error) {
 		}
 		name := x[:iv]
 		tgt := x[iv+1:]
+		_, err = mig.ParseTarget(tgt)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid target in macro %q: %v", name, err))
+		}
 		conf.Targets.addMacro(name, tgt)
 	}
 
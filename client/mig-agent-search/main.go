@@ -60,66 +60,40 @@ The target mode query allows specification of an agent targeting string as would
 be passed to the -t flag using MIG command line. This evaluates agents using the
 targeting string as the command line would, returning matching agents.
 
-A search query is a SQL WHERE condition. It can filter on any field present in
-the MIG Agents table.
-	     Column      |           Type
-	-----------------+-------------------------
-	 id              | numeric
-	 name            | character varying(2048)
-	 queueloc        | character varying(2048)
-	 mode            | character varying(2048)
-	 version         | character varying(2048)
-	 pid             | integer
-	 starttime       | timestamp with time zone
-	 destructiontime | timestamp with time zone
-	 heartbeattime   | timestamp with time zone
-	 status          | character varying(255)
-	 environment     | json
-	 tags            | json
-
-The "environment" and "tags" fields are free JSON fields and can be queried using
-Postgresql's JSON querying syntax.
-
-Below is an example of environment document:
-	{
-	    "addresses": [
-		"172.21.0.3/20",
-		"fe80::3602:86ff:fe2b:6fdd/64"
-	    ],
-	    "arch": "amd64",
-	    "ident": "Debian testing-updates sid",
-	    "init": "upstart",
-	    "isproxied": false,
-	    "os": "linux",
-	    "publicip": "172.21.0.3"
-	}
-
-Below is an example of tags document:
-	{"operator":"linuxwall"}
+A target query is a target expression. It is made of predicates on the fields
+of the agents, combined with AND, OR, NOT and parenthesis. A predicate is a
+field, an operator and a value: ':' tests equality, and '~' matches a case
+insensitive glob pattern where '*' is any string and '?' any character. Values
+that contain spaces, parenthesis, quotes or operators must be double quoted.
+
+The available fields are:
+	name, queueloc, mode, status, version	fields of the agent
+	os, arch, ident, init, publicip		fields of the agent environment
+	address					addresses of the endpoint, with netmask
+	tag:<key>				tags of the agent, followed by '=' or '~'
+	found, notfound				agents that have or haven't found something
+						in the action with the given ID
 
 EXAMPLE TARGET MODE QUERIES
 ---------------------------
 
 Agent name "myserver.example.net"
-  $ mig-agent-search -t "name='myserver.example.net'"
+  $ mig-agent-search -t "name:myserver.example.net"
 
 All Linux agents:
-  $ mig-agent-search -t "environment->>'os'='linux'"
+  $ mig-agent-search -t "os:linux"
 
 Ubuntu agents running 32 bits
-  $ mig-agent-search -t "environment->>'ident' LIKE 'Ubuntu%%' AND environment->>'arch'='386'"
+  $ mig-agent-search -t "ident~ubuntu* AND arch:386"
 
 MacOS agents in datacenter SCL3
-  $ mig-agent-search -t "environment->>'os'='darwin' AND name LIKE '%%\.scl3\.%%'"
-
-Agents with uptime greater than 30 days
-  $ mig-agent-search -t "starttime < NOW() - INTERVAL '30 days'"
+  $ mig-agent-search -t "os:darwin AND name~*.scl3.*"
 
-Linux agents in checkin mode that are currently idle but woke up in the last hour
-  $ mig-agent-search -t "mode='checkin' AND environment->>'os'='linux' AND status='idle' AND starttime > NOW() - INTERVAL '1 hour'"
+Linux agents in checkin mode that are currently idle
+  $ mig-agent-search -t "mode:checkin AND os:linux AND status:idle"
 
-Agents operated by team "opsec"
-  $ mig-agent-search -t "tags->>'operator'='opsec'"
+Agents operated by team "opsec" that found something in action 123456
+  $ mig-agent-search -t "tag:operator=opsec AND found:123456"
 
 Command line flags:
 `,
@@ -178,9 +178,11 @@ exit			exit this mode
 help			show this help
 json <pack>		show the json of the action
 launch <nofollow>	launch the action. to return before completion, add "nofollow"
+launch hunt		launch the action as a hunt, that also runs on the agents matching
+			the target that come online later, until the action expires
 load <path>		load an action from a file at <path>
 setname <name>		set the name of the action
-settarget <target>	set the target
+settarget <target>	set the target, ex: settarget os:linux AND tag:team=web
 settimes <start> <stop>	set the validity and expiration dates
 sign			PGP sign the action
 times			show the various timestamps of the action
@@ -209,12 +211,15 @@ times			show the various timestamps of the action
 			}
 			fmt.Printf("%s\n", ajson)
 		case "launch":
-			follow := true
-			if len(orders) > 1 {
-				if orders[1] == "nofollow" {
+			follow, hunt := true, false
+			for _, opt := range orders[1:] {
+				switch opt {
+				case "nofollow":
 					follow = false
-				} else {
-					fmt.Printf("Unknown option '%s'\n", orders[1])
+				case "hunt":
+					hunt = true
+				default:
+					fmt.Printf("Unknown option '%s'\n", opt)
 				}
 			}
 			if a.Name == "" {
@@ -231,11 +236,14 @@ times			show the various timestamps of the action
 					panic(err)
 				}
 				tcount = len(agents)
-				if tcount == 0 {
+				if tcount == 0 && !hunt {
 					fmt.Println("0 agents match this target. launch aborted")
 					break
 				}
 				fmt.Printf("%d agents will be targeted by search \"%s\"\n", tcount, a.Target)
+				if hunt {
+					fmt.Println("agents matching the target that come online later will be targeted until the action expires")
+				}
 				input, err = readline.String("continue? (y/n)> ")
 				if err != nil {
 					panic(err)
@@ -269,6 +277,16 @@ times			show the various timestamps of the action
 				a = asig
 				hasSignatures = true
 			}
+			if hunt {
+				h, err := cli.PostHunt(a)
+				if err != nil {
+					panic(err)
+				}
+				fmt.Printf("Hunt '%s' successfully launched with ID '%.0f' on target '%s' until '%s'\n",
+					h.Name, h.ID, h.Target, h.ExpireAfter)
+				_ = huntReader(fmt.Sprintf("hunt %.0f", h.ID), cli)
+				goto exit
+			}
 			a, err = cli.PostAction(a)
 			if err != nil {
 				panic(err)
@@ -330,17 +348,22 @@ times			show the various timestamps of the action
 				fmt.Println("Wrong arguments. Must be 'settarget <some_target_string>'")
 				break
 			}
-			a.Target = strings.Join(orders[1:], " ")
 			// Convert the target string to the desired value if the input was a
-			// target macro
-			a.Target = cli.ResolveTargetMacro(a.Target)
+			// target macro, and check its syntax before evaluating it
+			target := cli.ResolveTargetMacro(strings.Join(orders[1:], " "))
+			t, err := mig.ParseTarget(target)
+			if err != nil {
+				fmt.Println(err)
+				break
+			}
+			a.Target = target
 			agents, err := cli.EvaluateAgentTarget(a.Target)
 			if err != nil {
 				fmt.Println(err)
 				break
 			}
 			tcount = len(agents)
-			fmt.Printf("%d agents will be targetted. To get the list, use 'listagents'\n", tcount)
+			fmt.Printf("target '%s'\n%d agents will be targetted. To get the list, use 'listagents'\n", t, tcount)
 			hasEvaluatedTarget = true
 		case "settimes":
 			// set the dates
@@ -47,8 +47,8 @@ func actionReader(input string, cli client.Client) (err error) {
 	prompt := fmt.Sprintf("\x1b[31;1maction %d>\x1b[0m ", uint64(aid)%1000)
 	for {
 		// completion
-		var symbols = []string{"command", "copy", "counters", "details", "exit", "grep", "help", "investigators",
-			"json", "list", "all", "found", "notfound", "pretty", "r", "results", "times"}
+		var symbols = []string{"cancel", "command", "copy", "counters", "details", "exit", "grep", "help", "investigators",
+			"json", "list", "all", "found", "notfound", "pretty", "progress", "r", "results", "times"}
 		readline.Completer = func(query, ctx string) []string {
 			var res []string
 			for _, sym := range symbols {
@@ -69,6 +69,20 @@ func actionReader(input string, cli client.Client) (err error) {
 		}
 		orders := strings.Split(strings.TrimSpace(input), " ")
 		switch orders[0] {
+		case "cancel":
+			input, err = readline.String("cancel action? (y/n)> ")
+			if err != nil {
+				panic(err)
+			}
+			if input != "y" {
+				fmt.Println("abort")
+				break
+			}
+			err = cli.CancelAction(aid)
+			if err != nil {
+				panic(err)
+			}
+			fmt.Println("Action cancelled. Agents running it will stop and return partial results.")
 		case "command":
 			err = commandReader(input, cli)
 			if err != nil {
@@ -93,6 +107,8 @@ func actionReader(input string, cli client.Client) (err error) {
 			goto exit
 		case "help":
 			fmt.Printf(`The following orders are available:
+cancel		cancel the action and stop the agents that are running it
+
 command <id>	jump to command reader mode for command <id>
 
 copy		enter action launcher mode using current action as template
@@ -116,6 +132,9 @@ list <show>	returns the list of commands with their status
 		list can be followed by a 'filter' pipe:
 		ex: ls | grep server1.(dom1|dom2) | grep -v example.net
 
+progress	show the progress and early hits reported by the commands
+		that are still running
+
 r		refresh the action (get latest version from upstream)
 
 results <show> <render>	display results of all commands
@@ -147,6 +166,23 @@ times		show the various timestamps of the action
 			if err != nil {
 				panic(err)
 			}
+		case "progress":
+			reports, err := cli.GetActionProgress(aid, time.Time{})
+			if err != nil {
+				panic(err)
+			}
+			if len(reports) == 0 {
+				fmt.Println("no progress reported by running commands")
+			}
+			for _, cp := range reports {
+				lines, err := client.PrintProgress(cp)
+				if err != nil {
+					panic(err)
+				}
+				for _, line := range lines {
+					fmt.Printf("%s %s %s\n", cp.ReceivedAt.Format(time.RFC3339), cp.Agent.Name, line)
+				}
+			}
 		case "r":
 			a, _, err = cli.GetAction(aid)
 			if err != nil {
@@ -87,7 +87,7 @@ func main() {
 	for {
 		// completion
 		var symbols = []string{"action", "agent", "create", "command", "help", "history",
-			"exit", "manifest", "showcfg", "status", "investigator", "search", "query",
+			"exit", "hunt", "manifest", "showcfg", "status", "investigator", "search", "query",
 			"where", "and", "loader"}
 		readline.Completer = func(query, ctx string) []string {
 			var res []string
@@ -152,6 +152,15 @@ func main() {
 		case "exit":
 			fmt.Printf("exit\n")
 			goto exit
+		case "hunt":
+			if len(orders) == 2 {
+				err = huntReader(input, cli)
+				if err != nil {
+					log.Println(err)
+				}
+			} else {
+				fmt.Println("error: missing hunt id in 'hunt <id>'")
+			}
 		case "help":
 			fmt.Printf(`The following orders are available:
 action <id>		enter interactive action reader mode for action <id>
@@ -164,6 +173,7 @@ command <id>		enter command reader mode for command <id>
 exit			leave
 help			show this help
 history <count>		print last <count> entries in history. count=10 by default.
+hunt <id>		enter interactive hunt reader mode for hunt <id>
 investigator <id>	enter interactive investigator management mode for investigator <id>
 manifest <id>           enter manifest management mode for manifest <id>
 query <uri>		send a raw query string, without the base url, to the api
@@ -0,0 +1,127 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Julien Vehent jvehent@mozilla.com [:ulfr]
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/bobappleyard/readline"
+	"mig.ninja/mig/client"
+)
+
+// huntReader retrieves a hunt from the API using its numerical ID
+// and enters prompt mode to follow its coverage
+func huntReader(input string, cli client.Client) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("huntReader() -> %v", e)
+		}
+	}()
+	inputArr := strings.Split(input, " ")
+	if len(inputArr) < 2 {
+		panic("wrong order format. must be 'hunt <huntid>'")
+	}
+	hid, err := strconv.ParseFloat(inputArr[1], 64)
+	if err != nil {
+		panic(err)
+	}
+	h, err := cli.GetHunt(hid)
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println("Entering hunt reader mode. Type \x1b[32;1mexit\x1b[0m or press \x1b[32;1mctrl+d\x1b[0m to leave. \x1b[32;1mhelp\x1b[0m may help.")
+	fmt.Printf("Hunt: '%s' on target '%s'.\nRunning action %.0f until '%s'.\nStatus '%s'.\n",
+		h.Name, h.Target, h.Action.ID, h.ExpireAfter, h.Status)
+	fmt.Println(h.PrintCounters())
+	prompt := fmt.Sprintf("\x1b[31;1mhunt %d>\x1b[0m ", uint64(hid)%1000)
+	for {
+		// completion
+		var symbols = []string{"action", "cancel", "coverage", "details", "exit", "help", "r"}
+		readline.Completer = func(query, ctx string) []string {
+			var res []string
+			for _, sym := range symbols {
+				if strings.HasPrefix(sym, query) {
+					res = append(res, sym)
+				}
+			}
+			return res
+		}
+
+		input, err := readline.String(prompt)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Println("error: ", err)
+			break
+		}
+		orders := strings.Split(strings.TrimSpace(input), " ")
+		switch orders[0] {
+		case "action":
+			err = actionReader(fmt.Sprintf("action %.0f", h.Action.ID), cli)
+			if err != nil {
+				panic(err)
+			}
+		case "cancel":
+			input, err = readline.String("stop running the hunt on new agents? (y/n)> ")
+			if err != nil {
+				panic(err)
+			}
+			if input != "y" {
+				fmt.Println("abort")
+				break
+			}
+			err = cli.CancelHunt(hid)
+			if err != nil {
+				panic(err)
+			}
+			fmt.Println("hunt cancelled, cancel its action to stop the commands already sent")
+		case "coverage":
+			h, err = cli.GetHunt(hid)
+			if err != nil {
+				panic(err)
+			}
+			fmt.Printf("%d online endpoints match the target\n", h.Counters.Online)
+			fmt.Println(h.PrintCounters())
+		case "details":
+			fmt.Printf("ID           %.0f\nName         %s\nTarget       %s\nAction       %.0f\n"+
+				"Status       %s\nCreated      %s\nValid from   %s\nExpire after %s\n",
+				h.ID, h.Name, h.Target, h.Action.ID, h.Status, h.CreatedAt, h.ValidFrom, h.ExpireAfter)
+			fmt.Printf("Investigators '%s'\n", investigatorsStringFromAction(h.Action.Investigators, 80))
+		case "exit":
+			fmt.Printf("exit\n")
+			goto exit
+		case "help":
+			fmt.Printf(`The following orders are available:
+action			enter action reader mode for the action of the hunt
+cancel			stop running the hunt on the agents that come online
+coverage		show the endpoints covered and missing, and the status of the commands
+details			display the details of the hunt
+exit			exit this mode
+help			show this help
+r			refresh the hunt (get latest version from upstream)
+`)
+		case "r":
+			h, err = cli.GetHunt(hid)
+			if err != nil {
+				panic(err)
+			}
+			fmt.Println("reloaded")
+		case "":
+			break
+		default:
+			fmt.Printf("Unknown order '%s'. You are in hunt reader mode. Try `help`.\n", orders[0])
+		}
+		readline.AddHistory(input)
+	}
+exit:
+	fmt.Printf("\n")
+	return
+}
@@ -45,12 +45,13 @@ usage: %s <module> <global options> <module parameters>
 
 -t <target>	target to launch the action on. A target must be specified.
 		examples:
-		* linux agents:          -t "queueloc LIKE 'linux.%%'"
-		* agents named *mysql*:  -t "name like '%%mysql%%'"
-		* proxied linux agents:  -t "queueloc LIKE 'linux.%%' AND environment->>'isproxied' = 'true'"
-		* agents operated by IT: -t "tags#>>'{operator}'='IT'"
+		* linux agents:          -t "os:linux"
+		* agents named *mysql*:  -t "name~*mysql*"
+		* linux agents in 10/8:  -t "os:linux AND address~10.*"
+		* agents operated by IT: -t "tag:operator=IT"
 		* run on local system:	 -t local
 		* use a migrc macro:     -t mymacroname
+		the syntax of targets is described in doc/concepts.rst.
 
 -target-found    <action ID>
 -target-notfound <action ID>
@@ -223,7 +224,7 @@ func main() {
 		fmt.Fprintf(os.Stderr, "[error] No target was specified with -t after the module name\n\n"+
 			"See MIG documentation on target strings and creating target macros\n"+
 			"for help. If you are sure you want to target everything online, you\n"+
-			"can use \"status='online'\" as the argument to -t. See the usage\n"+
+			"can use \"status:online\" as the argument to -t. See the usage\n"+
 			"output for the mig command for more examples.\n")
 		os.Exit(2)
 	}
@@ -270,14 +271,14 @@ func main() {
 		panic("Both -target-found and -target-foundnothing cannot be used simultaneously")
 	}
 	if targetfound != "" {
-		targetQuery := fmt.Sprintf(`id IN (select agentid from commands, json_array_elements(commands.results) as `+
-			`r where actionid=%s and r#>>'{foundanything}' = 'true')`, targetfound)
-		target = targetQuery + " AND " + target
+		target = fmt.Sprintf("found:%s AND (%s)", mig.QuoteTargetValue(targetfound), target)
 	}
 	if targetnotfound != "" {
-		targetQuery := fmt.Sprintf(`id IN (select agentid from commands, json_array_elements(commands.results) as `+
-			`r where actionid=%s and r#>>'{foundanything}' = 'false')`, targetnotfound)
-		target = targetQuery + " AND " + target
+		target = fmt.Sprintf("notfound:%s AND (%s)", mig.QuoteTargetValue(targetnotfound), target)
+	}
+	_, err = mig.ParseTarget(target)
+	if err != nil {
+		panic(err)
 	}
 	a.Target = target
 
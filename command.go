@@ -7,11 +7,14 @@
 package mig /* import "mig.ninja/mig" */
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"mig.ninja/mig/modules"
+	"sort"
 	"time"
 )
 
@@ -81,3 +84,94 @@ func checkCmd(cmd Command) error {
 	}
 	return nil
 }
+
+// CommandProgress reports on an operation of a command while the module runs it.
+// Agents relay the progress messages of modules to the scheduler, which stores
+// them until the command finishes.
+type CommandProgress struct {
+	CommandID  float64          `json:"commandid"`
+	ActionID   float64          `json:"actionid"`
+	Agent      Agent            `json:"agent"`
+	Operation  int              `json:"operation"`
+	Module     string           `json:"module"`
+	ReceivedAt time.Time        `json:"receivedat"`
+	Progress   modules.Progress `json:"progress"`
+}
+
+// CommandChunk is a part of the JSON of a command returned by an agent. Agents
+// split the commands larger than ResultChunkSize into ordered chunks, and the
+// scheduler reassembles them once it has received all of them.
+type CommandChunk struct {
+	CommandID float64 `json:"commandid"`
+	Sequence  int     `json:"sequence"` // position of the chunk, from 0 to Total-1
+	Total     int     `json:"total"`
+	Checksum  string  `json:"checksum"` // hex encoded sha256 of the data
+	Data      []byte  `json:"data"`
+}
+
+// Chunks splits the JSON of a command into chunks of at most size bytes
+func (cmd Command) Chunks(size int) (chunks []CommandChunk, err error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return
+	}
+	total := (len(data) + size - 1) / size
+	for i := 0; i < total; i++ {
+		part := data[i*size : min((i+1)*size, len(data))]
+		sum := sha256.Sum256(part)
+		chunks = append(chunks, CommandChunk{
+			CommandID: cmd.ID,
+			Sequence:  i,
+			Total:     total,
+			Checksum:  hex.EncodeToString(sum[:]),
+			Data:      part,
+		})
+	}
+	return
+}
+
+// Validate verifies the sequence number and the checksum of a chunk
+func (c CommandChunk) Validate() error {
+	if c.Total < 1 || c.Sequence < 0 || c.Sequence >= c.Total {
+		return fmt.Errorf("invalid sequence %d of %d in chunk of command %.0f", c.Sequence, c.Total, c.CommandID)
+	}
+	sum := sha256.Sum256(c.Data)
+	if hex.EncodeToString(sum[:]) != c.Checksum {
+		return fmt.Errorf("invalid checksum in chunk %d of command %.0f", c.Sequence, c.CommandID)
+	}
+	return nil
+}
+
+// CmdFromChunks reassembles a command from all of its chunks, in any order
+func CmdFromChunks(chunks []CommandChunk) (cmd Command, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("mig.CmdFromChunks()-> %v", e)
+		}
+	}()
+	if len(chunks) == 0 {
+		panic("no chunk to reassemble")
+	}
+	sorted := make([]CommandChunk, len(chunks))
+	copy(sorted, chunks)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Sequence < sorted[j].Sequence })
+	var data []byte
+	for i, c := range sorted {
+		err = c.Validate()
+		if err != nil {
+			panic(err)
+		}
+		if c.CommandID != sorted[0].CommandID || c.Total != len(sorted) || c.Sequence != i {
+			panic(fmt.Sprintf("missing or duplicate chunks of command %.0f", sorted[0].CommandID))
+		}
+		data = append(data, c.Data...)
+	}
+	err = json.Unmarshal(data, &cmd)
+	if err != nil {
+		panic(err)
+	}
+	if cmd.ID != sorted[0].CommandID {
+		panic(fmt.Sprintf("chunks of command %.0f contain command %.0f", sorted[0].CommandID, cmd.ID))
+	}
+	return
+}
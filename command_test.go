@@ -0,0 +1,219 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mig /* import "mig.ninja/mig" */
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"mig.ninja/mig/modules"
+)
+
+func testCommand() Command {
+	return Command{
+		ID:     4242,
+		Action: Action{ID: 42, Name: "find the files", Target: "os:linux"},
+		Agent:  Agent{ID: 7, Name: "host1.example.net", QueueLoc: "linux.host1.abc"},
+		Status: StatusSuccess,
+		Results: []modules.Result{{
+			FoundAnything: true,
+			Success:       true,
+			Elements:      map[string]interface{}{"/etc/passwd": []interface{}{"root", "daemon", "nobody"}},
+			Errors:        []string{"some soft error"},
+		}},
+		StartTime:  time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC),
+		FinishTime: time.Date(2017, 3, 1, 10, 0, 5, 0, time.UTC),
+	}
+}
+
+func TestCommandChunks(t *testing.T) {
+	cmd := testCommand()
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		size, total int
+	}{
+		{1, len(data)},
+		{7, (len(data) + 6) / 7},
+		{64, (len(data) + 63) / 64},
+		{len(data) - 1, 2},
+		{len(data), 1},
+		{len(data) + 1, 1},
+	} {
+		chunks, err := cmd.Chunks(tc.size)
+		if err != nil {
+			t.Fatalf("size %d: %v", tc.size, err)
+		}
+		if len(chunks) != tc.total {
+			t.Fatalf("size %d: expected %d chunks, got %d", tc.size, tc.total, len(chunks))
+		}
+		var joined []byte
+		for i, c := range chunks {
+			if c.CommandID != cmd.ID || c.Sequence != i || c.Total != tc.total {
+				t.Fatalf("size %d: unexpected chunk %d: id %.0f, sequence %d of %d", tc.size, i, c.CommandID, c.Sequence, c.Total)
+			}
+			if len(c.Data) == 0 || len(c.Data) > tc.size {
+				t.Fatalf("size %d: chunk %d has %d bytes", tc.size, i, len(c.Data))
+			}
+			if err := c.Validate(); err != nil {
+				t.Fatalf("size %d: chunk %d does not validate: %v", tc.size, i, err)
+			}
+			joined = append(joined, c.Data...)
+		}
+		if !bytes.Equal(joined, data) {
+			t.Fatalf("size %d: chunks do not contain the json of the command", tc.size)
+		}
+	}
+}
+
+func TestCommandChunkValidate(t *testing.T) {
+	chunks, err := testCommand().Chunks(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := chunks[1]
+	for _, tc := range []struct {
+		desc   string
+		change func(c *CommandChunk)
+		valid  bool
+	}{
+		{"valid chunk", func(c *CommandChunk) {}, true},
+		{"last chunk", func(c *CommandChunk) { *c = chunks[len(chunks)-1] }, true},
+		{"no chunk in total", func(c *CommandChunk) { c.Total = 0 }, false},
+		{"negative sequence", func(c *CommandChunk) { c.Sequence = -1 }, false},
+		{"sequence equal to total", func(c *CommandChunk) { c.Sequence = c.Total }, false},
+		{"sequence above total", func(c *CommandChunk) { c.Sequence = c.Total + 3 }, false},
+		{"modified data", func(c *CommandChunk) { c.Data = append([]byte("x"), c.Data[1:]...) }, false},
+		{"truncated data", func(c *CommandChunk) { c.Data = c.Data[:len(c.Data)-1] }, false},
+		{"checksum of another chunk", func(c *CommandChunk) { c.Checksum = chunks[0].Checksum }, false},
+		{"checksum not in hex", func(c *CommandChunk) { c.Checksum = strings.ToUpper(c.Checksum) }, false},
+		{"empty checksum", func(c *CommandChunk) { c.Checksum = "" }, false},
+	} {
+		c := good
+		c.Data = append([]byte(nil), good.Data...)
+		tc.change(&c)
+		err := c.Validate()
+		if tc.valid && err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.desc, err)
+		}
+		if !tc.valid && err == nil {
+			t.Fatalf("%s: expected an error", tc.desc)
+		}
+	}
+}
+
+func TestCmdFromChunks(t *testing.T) {
+	cmd := testCommand()
+	want, err := json.Marshal(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(1))
+	// split, shuffle and reassemble
+	for _, size := range []int{1, 10, 100, len(want)} {
+		chunks, err := cmd.Chunks(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			r.Shuffle(len(chunks), func(i, j int) { chunks[i], chunks[j] = chunks[j], chunks[i] })
+			got, err := CmdFromChunks(chunks)
+			if err != nil {
+				t.Fatalf("size %d: %v", size, err)
+			}
+			buf, err := json.Marshal(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf, want) {
+				t.Fatalf("size %d: reassembled command differs:\n%s\nexpected:\n%s", size, buf, want)
+			}
+		}
+	}
+
+	// reassembling the chunks does not modify them
+	chunks, err := cmd.Chunks(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Shuffle(len(chunks), func(i, j int) { chunks[i], chunks[j] = chunks[j], chunks[i] })
+	shuffled := append([]CommandChunk(nil), chunks...)
+	_, err = CmdFromChunks(chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range chunks {
+		if chunks[i].Sequence != shuffled[i].Sequence {
+			t.Fatalf("the order of the chunks was modified")
+		}
+	}
+}
+
+func TestCmdFromChunksErrors(t *testing.T) {
+	cmd := testCommand()
+	other := testCommand()
+	other.ID = 4343
+	for _, tc := range []struct {
+		desc   string
+		change func(chunks []CommandChunk) []CommandChunk
+	}{
+		{"no chunk", func(chunks []CommandChunk) []CommandChunk {
+			return nil
+		}},
+		{"missing first chunk", func(chunks []CommandChunk) []CommandChunk {
+			return chunks[1:]
+		}},
+		{"missing middle chunk", func(chunks []CommandChunk) []CommandChunk {
+			return append(chunks[:2], chunks[3:]...)
+		}},
+		{"missing last chunk", func(chunks []CommandChunk) []CommandChunk {
+			return chunks[:len(chunks)-1]
+		}},
+		{"duplicate sequence", func(chunks []CommandChunk) []CommandChunk {
+			chunks[3] = chunks[2]
+			return chunks
+		}},
+		{"extra duplicate chunk", func(chunks []CommandChunk) []CommandChunk {
+			return append(chunks, chunks[1])
+		}},
+		{"bad checksum", func(chunks []CommandChunk) []CommandChunk {
+			chunks[1].Checksum = chunks[2].Checksum
+			return chunks
+		}},
+		{"corrupted data", func(chunks []CommandChunk) []CommandChunk {
+			chunks[2].Data = bytes.ToUpper(chunks[2].Data)
+			return chunks
+		}},
+		{"wrong total", func(chunks []CommandChunk) []CommandChunk {
+			chunks[0].Total++
+			return chunks
+		}},
+		{"chunk of another command", func(chunks []CommandChunk) []CommandChunk {
+			chunks[1].CommandID = other.ID
+			return chunks
+		}},
+		{"command id mismatch", func(chunks []CommandChunk) []CommandChunk {
+			for i := range chunks {
+				chunks[i].CommandID = other.ID
+			}
+			return chunks
+		}},
+	} {
+		chunks, err := cmd.Chunks(16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = CmdFromChunks(tc.change(chunks))
+		if err == nil {
+			t.Fatalf("%s: expected an error", tc.desc)
+		}
+	}
+}
@@ -7,9 +7,15 @@ package main
 
 import (
 	_ "mig.ninja/mig/modules/agentdestroy"
+	_ "mig.ninja/mig/modules/amcache"
+	_ "mig.ninja/mig/modules/evtx"
+	_ "mig.ninja/mig/modules/execution"
 	_ "mig.ninja/mig/modules/file"
+	_ "mig.ninja/mig/modules/lnk"
 	_ "mig.ninja/mig/modules/memory"
 	_ "mig.ninja/mig/modules/netstat"
+	_ "mig.ninja/mig/modules/ntfs"
+	_ "mig.ninja/mig/modules/persistence"
 	_ "mig.ninja/mig/modules/ping"
 	_ "mig.ninja/mig/modules/pkg"
 	_ "mig.ninja/mig/modules/scribe"
@@ -13,11 +13,18 @@ const (
 	Mq_Ex_ToWorkers    = "toworkers"
 	Mq_Q_Heartbeat     = "mig.agt.heartbeats"
 	Mq_Q_Results       = "mig.agt.results"
+	Mq_Q_ResultChunks  = "mig.agt.results.chunks"
+	Mq_Q_Progress      = "mig.agt.results.progress"
+
+	// maximum size of the results of a command sent in a single message,
+	// larger results are sent in chunks of that size
+	ResultChunkSize = 512 * 1024
 
 	// event queues
 	Ev_Q_Agt_Auth_Fail = "agent.authentication.failure"
 	Ev_Q_Agt_New       = "agent.new"
 	Ev_Q_Cmd_Res       = "command.results"
+	Ev_Q_Cmd_Progress  = "command.progress"
 
 	// dummy queue for scheduler heartbeats to the relays
 	Ev_Q_Sched_Hb = "scheduler.heartbeat"
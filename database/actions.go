@@ -131,6 +131,11 @@ func (db *DB) ActionMetaByID(id float64) (a mig.Action, err error) {
 
 // InsertAction writes an action into the database.
 func (db *DB) InsertAction(a mig.Action) (err error) {
+	return insertAction(db.c.Exec, a)
+}
+
+// insertAction writes an action with an Exec function of the database or of a transaction
+func insertAction(exec func(string, ...interface{}) (sql.Result, error), a mig.Action) (err error) {
 	jDesc, err := json.Marshal(a.Description)
 	if err != nil {
 		return fmt.Errorf("Failed to marshal description: '%v'", err)
@@ -147,7 +152,7 @@ func (db *DB) InsertAction(a mig.Action) (err error) {
 	if err != nil {
 		return fmt.Errorf("Failed to marshal pgp signatures: '%v'", err)
 	}
-	_, err = db.c.Exec(`INSERT INTO actions
+	_, err = exec(`INSERT INTO actions
 		(id, name, target, description, threat, operations,
 		validfrom, expireafter, starttime, finishtime, lastupdatetime,
 		status, pgpsignatures, syntaxversion)
@@ -161,9 +166,11 @@ func (db *DB) InsertAction(a mig.Action) (err error) {
 	return
 }
 
-// UpdateAction stores updated action fields into the database.
+// UpdateAction stores updated action fields into the database. The status of
+// an action that is being cancelled is not changed.
 func (db *DB) UpdateAction(a mig.Action) (err error) {
-	_, err = db.c.Exec(`UPDATE actions SET (starttime, lastupdatetime, status) = ($2, $3, $4) WHERE id=$1`,
+	_, err = db.c.Exec(`UPDATE actions SET (starttime, lastupdatetime, status) = ($2, $3, $4)
+		WHERE id=$1 AND status NOT IN ('cancelling', 'cancelled')`,
 		a.ID, a.StartTime, a.LastUpdateTime, a.Status)
 	if err != nil {
 		return fmt.Errorf("Failed to update action: '%v'", err)
@@ -187,9 +194,11 @@ func (db *DB) InsertOrUpdateAction(a mig.Action) (inserted bool, err error) {
 	}
 }
 
-// UpdateActionStatus updates the status of an action
+// UpdateActionStatus updates the status of an action, unless the action is
+// being cancelled
 func (db *DB) UpdateActionStatus(a mig.Action) (err error) {
-	_, err = db.c.Exec(`UPDATE actions SET (status) = ($2) WHERE id=$1`,
+	_, err = db.c.Exec(`UPDATE actions SET (status) = ($2)
+		WHERE id=$1 AND status NOT IN ('cancelling', 'cancelled')`,
 		a.ID, a.Status)
 	if err != nil {
 		return fmt.Errorf("Failed to update action status: '%v'", err)
@@ -207,11 +216,13 @@ func (db *DB) UpdateRunningAction(a mig.Action) (err error) {
 	return
 }
 
-// FinishAction updates the action fields to mark it as done
+// FinishAction updates the action fields to mark it as done, unless the action
+// is being cancelled
 func (db *DB) FinishAction(a mig.Action) (err error) {
 	a.FinishTime = time.Now()
 	a.Status = "completed"
-	_, err = db.c.Exec(`UPDATE actions SET (finishtime, lastupdatetime, status) = ($1, $2, $3) WHERE id=$4`,
+	_, err = db.c.Exec(`UPDATE actions SET (finishtime, lastupdatetime, status) = ($1, $2, $3)
+		WHERE id=$4 AND status NOT IN ('cancelling', 'cancelled')`,
 		a.FinishTime, a.LastUpdateTime, a.Status, a.ID)
 	if err != nil {
 		return fmt.Errorf("Failed to update action: '%v'", err)
@@ -219,6 +230,51 @@ func (db *DB) FinishAction(a mig.Action) (err error) {
 	return
 }
 
+// CancelAction marks an action that has not finished yet for cancellation. The
+// scheduler picks up the cancelling actions and stops their commands.
+func (db *DB) CancelAction(aid float64) (err error) {
+	res, err := db.c.Exec(`UPDATE actions SET status='cancelling'
+		WHERE id=$1 AND status IN ('pending', 'scheduled', 'preparing', 'inflight')`, aid)
+	if err != nil {
+		return fmt.Errorf("Failed to cancel action: '%v'", err)
+	}
+	ctr, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("Error while evaluating query results: '%v'", err)
+	}
+	if ctr != 1 {
+		return fmt.Errorf("Action ID '%.0f' has already finished and cannot be cancelled", aid)
+	}
+	return
+}
+
+// SetupCancelledActions marks the actions waiting for cancellation as cancelled,
+// and returns their IDs
+func (db *DB) SetupCancelledActions() (ids []float64, err error) {
+	rows, err := db.c.Query(`UPDATE actions SET (status, finishtime, lastupdatetime) = ('cancelled', NOW(), NOW())
+		WHERE status='cancelling' RETURNING id`)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil && err != sql.ErrNoRows {
+		err = fmt.Errorf("Error while setting up cancelled actions: '%v'", err)
+		return
+	}
+	for rows.Next() {
+		var id float64
+		err = rows.Scan(&id)
+		if err != nil {
+			err = fmt.Errorf("Error while retrieving action: '%v'", err)
+			return
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		err = fmt.Errorf("Failed to complete database query: '%v'", err)
+	}
+	return
+}
+
 // InsertSignature create an entry in the signatures tables that map an investigator
 // to an action and a signature
 func (db *DB) InsertSignature(aid, iid float64, sig string) (err error) {
@@ -227,10 +227,15 @@ func (db *DB) ActiveAgentsByQueue(queueloc string, pointInTime time.Time) (agent
 	return
 }
 
-// ActiveAgentsByTarget runs a search for all agents that match a given target string.
-// For safety, it does so in a transaction that runs as a readonly user.
+// ActiveAgentsByTarget runs a search for all agents that match a given target expression.
+// The target is compiled into a parameterised condition and, for safety, the search
+// runs in a transaction as a readonly user.
 func (db *DB) ActiveAgentsByTarget(target string) (agents []mig.Agent, err error) {
 	var jTags, jEnv []byte
+	cond, args, err := compileTarget(target, 1)
+	if err != nil {
+		return
+	}
 	// save current user
 	var dbuser string
 	err = db.c.QueryRow("SELECT CURRENT_USER").Scan(&dbuser)
@@ -249,8 +254,8 @@ func (db *DB) ActiveAgentsByTarget(target string) (agents []mig.Agent, err error
 	rows, err := txn.Query(fmt.Sprintf(`SELECT DISTINCT ON (queueloc) id, name, queueloc,
 		version, pid, starttime, destructiontime, heartbeattime, refreshtime, status,
 		mode, environment, tags
-		FROM agents WHERE agents.status IN ('%s', '%s') AND (%s)
-		ORDER BY agents.queueloc ASC`, mig.AgtStatusOnline, mig.AgtStatusIdle, target))
+		FROM agents WHERE agents.status IN ('%s', '%s') AND %s
+		ORDER BY agents.queueloc ASC`, mig.AgtStatusOnline, mig.AgtStatusIdle, cond), args...)
 	if rows != nil {
 		defer rows.Close()
 	}
@@ -296,6 +301,83 @@ func (db *DB) ActiveAgentsByTarget(target string) (agents []mig.Agent, err error
 	return
 }
 
+// AgentMatchesTarget returns true if an active agent identified by its ID matches
+// a target expression
+func (db *DB) AgentMatchesTarget(agentid float64, target string) (match bool, err error) {
+	cond, args, err := compileTarget(target, 2)
+	if err != nil {
+		return
+	}
+	count, err := db.countAgentsAsReadonly(fmt.Sprintf(`SELECT COUNT(id) FROM agents
+		WHERE agents.id=$1 AND agents.status IN ('%s', '%s') AND %s`,
+		mig.AgtStatusOnline, mig.AgtStatusIdle, cond), append([]interface{}{agentid}, args...)...)
+	if err != nil {
+		return
+	}
+	match = count > 0
+	return
+}
+
+// CountActiveEndpointsByTarget returns the number of endpoints running active agents
+// that match a target expression
+func (db *DB) CountActiveEndpointsByTarget(target string) (count int, err error) {
+	cond, args, err := compileTarget(target, 1)
+	if err != nil {
+		return
+	}
+	return db.countAgentsAsReadonly(fmt.Sprintf(`SELECT COUNT(DISTINCT queueloc) FROM agents
+		WHERE agents.status IN ('%s', '%s') AND %s`,
+		mig.AgtStatusOnline, mig.AgtStatusIdle, cond), args...)
+}
+
+// compileTarget parses a target expression and compiles it into a condition on the
+// agents table whose placeholders start at $first
+func compileTarget(target string, first int) (cond string, args []interface{}, err error) {
+	t, err := mig.ParseTarget(target)
+	if err != nil {
+		err = fmt.Errorf("Invalid target '%s': %v", target, err)
+		return
+	}
+	cond, args = t.SQL(first)
+	return
+}
+
+// countAgentsAsReadonly runs a counting query that contains a compiled target in a
+// transaction that runs as a readonly user, like ActiveAgentsByTarget
+func (db *DB) countAgentsAsReadonly(query string, args ...interface{}) (count int, err error) {
+	var dbuser string
+	err = db.c.QueryRow("SELECT CURRENT_USER").Scan(&dbuser)
+	if err != nil {
+		return
+	}
+	txn, err := db.c.Begin()
+	if err != nil {
+		return
+	}
+	_, err = txn.Exec(`SET ROLE migreadonly`)
+	if err != nil {
+		_ = txn.Rollback()
+		return
+	}
+	err = txn.QueryRow(query, args...).Scan(&count)
+	if err != nil {
+		_ = txn.Rollback()
+		err = fmt.Errorf("Error while counting agents: '%v'", err)
+		return
+	}
+	_, err = txn.Exec(`SET ROLE ` + dbuser)
+	if err != nil {
+		_ = txn.Rollback()
+		return
+	}
+	err = txn.Commit()
+	if err != nil {
+		_ = txn.Rollback()
+		return
+	}
+	return
+}
+
 // MarkAgentUpgraded updated the status of an agent in the database
 func (db *DB) MarkAgentUpgraded(agent mig.Agent) (err error) {
 	_, err = db.c.Exec(`UPDATE agents SET status=$1 WHERE id=$2`,
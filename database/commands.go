@@ -11,6 +11,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"time"
 
 	"mig.ninja/mig"
@@ -21,6 +22,21 @@ import (
 
 // CommandByID retrieves a command from the database using its ID
 func (db *DB) CommandByID(id float64) (cmd mig.Command, err error) {
+	cmd, err = db.commandByID(id)
+	if err != nil {
+		return
+	}
+	cmds := []mig.Command{cmd}
+	err = db.loadCommandsElements(cmds)
+	if err != nil {
+		return
+	}
+	return cmds[0], nil
+}
+
+// commandByID retrieves a command without the elements of its results stored
+// in the commandelements table
+func (db *DB) commandByID(id float64) (cmd mig.Command, err error) {
 	var jRes, jDesc, jThreat, jOps, jSig []byte
 	err = db.c.QueryRow(`SELECT commands.id, commands.status, commands.results, commands.starttime, commands.finishtime,
 		actions.id, actions.name, actions.target, actions.description, actions.threat,
@@ -122,9 +138,11 @@ func (db *DB) CommandsByActionID(actionid float64) (commands []mig.Command, err
 		}
 		commands = append(commands, cmd)
 	}
-	if err := rows.Err(); err != nil {
+	if err = rows.Err(); err != nil {
 		err = fmt.Errorf("Failed to complete database query: '%v'", err)
+		return
 	}
+	err = db.loadCommandsElements(commands)
 	return
 }
 
@@ -144,15 +162,48 @@ func (db *DB) InsertCommand(cmd mig.Command, agt mig.Agent) (err error) {
 	return
 }
 
-// InsertCommands writes an array of commands into the database
+// InsertCommands writes an array of commands into the database. The rows of
+// their actions are locked until the commands are inserted, and the commands of
+// the actions being cancelled are inserted as cancelled, with their status set
+// in cmds, so a cancellation either sees the commands in the database or
+// happens before their insertion. The cancelled commands must not be sent.
 func (db *DB) InsertCommands(cmds []mig.Command) (insertCount int64, err error) {
 	futureDate := time.Date(9998, time.January, 11, 11, 11, 11, 11, time.UTC)
+	txn, err := db.c.Begin()
+	if err != nil {
+		return
+	}
+	// lock the actions in the same order in all schedulers
+	var aids []float64
+	cancelled := make(map[float64]bool)
+	for _, cmd := range cmds {
+		if _, ok := cancelled[cmd.Action.ID]; !ok {
+			cancelled[cmd.Action.ID] = false
+			aids = append(aids, cmd.Action.ID)
+		}
+	}
+	sort.Float64s(aids)
+	for _, aid := range aids {
+		var status string
+		err = txn.QueryRow(`SELECT status FROM actions WHERE id=$1 FOR SHARE`, aid).Scan(&status)
+		if err != nil && err != sql.ErrNoRows {
+			_ = txn.Rollback()
+			return 0, fmt.Errorf("Error while locking action: '%v'", err)
+		}
+		cancelled[aid] = status == "cancelling" || status == "cancelled"
+	}
 	sql := "INSERT INTO commands (id, actionid, agentid, status, starttime, finishtime, results) VALUES "
 	vals := []interface{}{}
 	step := 0
-	for i, cmd := range cmds {
-		jRes, err := json.Marshal(cmd.Results)
+	for i := range cmds {
+		finishTime := futureDate
+		if cancelled[cmds[i].Action.ID] {
+			cmds[i].Status = mig.StatusCancelled
+			finishTime = time.Now().UTC()
+		}
+		jRes, err := json.Marshal(cmds[i].Results)
 		if err != nil {
+			_ = txn.Rollback()
 			return int64(i), err
 		}
 		if i > 0 {
@@ -160,25 +211,27 @@ func (db *DB) InsertCommands(cmds []mig.Command) (insertCount int64, err error)
 		}
 		sql += fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d)",
 			i+1+step, i+2+step, i+3+step, i+4+step, i+5+step, i+6+step, i+7+step)
-		vals = append(vals, cmd.ID, cmd.Action.ID, cmd.Agent.ID, cmd.Status, cmd.StartTime, futureDate, jRes)
+		vals = append(vals, cmds[i].ID, cmds[i].Action.ID, cmds[i].Agent.ID, cmds[i].Status,
+			cmds[i].StartTime, finishTime, jRes)
 		step += 6
 	}
-	stmt, err := db.c.Prepare(sql)
-	defer stmt.Close()
-	if err != nil {
-		err = fmt.Errorf("Error while preparing insertion statement: '%v' in '%s'", err, sql)
-		return
-	}
-	res, err := stmt.Exec(vals...)
+	res, err := txn.Exec(sql, vals...)
 	if err != nil {
+		_ = txn.Rollback()
 		err = fmt.Errorf("Error while inserting commands: '%v'", err)
 		return
 	}
 	insertCount, err = res.RowsAffected()
 	if err != nil {
+		_ = txn.Rollback()
 		err = fmt.Errorf("Error while counting inserted commands: '%v'", err)
 		return
 	}
+	err = txn.Commit()
+	if err != nil {
+		_ = txn.Rollback()
+		err = fmt.Errorf("Error while committing commands: '%v'", err)
+	}
 	return
 }
 
@@ -200,14 +253,48 @@ func (db *DB) UpdateSentCommand(cmd mig.Command) (err error) {
 	return
 }
 
+// CancelCommands marks the commands of an action that are still running as
+// cancelled, and returns them with the agents they were sent to. The commands
+// inserted after the action was marked for cancellation are already cancelled,
+// see InsertCommands.
+func (db *DB) CancelCommands(aid float64) (cmds []mig.Command, err error) {
+	rows, err := db.c.Query(`UPDATE commands SET (status, finishtime) = ($2, NOW())
+		FROM agents WHERE commands.agentid=agents.id AND commands.actionid=$1 AND commands.status=$3
+		RETURNING commands.id, agents.id, agents.name, agents.queueloc, agents.pid`,
+		aid, mig.StatusCancelled, mig.StatusSent)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil && err != sql.ErrNoRows {
+		err = fmt.Errorf("Error while cancelling commands: '%v'", err)
+		return
+	}
+	for rows.Next() {
+		var cmd mig.Command
+		err = rows.Scan(&cmd.ID, &cmd.Agent.ID, &cmd.Agent.Name, &cmd.Agent.QueueLoc, &cmd.Agent.PID)
+		if err != nil {
+			err = fmt.Errorf("Failed to retrieve command: '%v'", err)
+			return
+		}
+		cmd.Status = mig.StatusCancelled
+		cmds = append(cmds, cmd)
+	}
+	if err = rows.Err(); err != nil {
+		err = fmt.Errorf("Failed to complete database query: '%v'", err)
+	}
+	return
+}
+
 // FinishCommand updates a command into the database unless its status is already set
 // to 'success'. If the status has already been set to "success" (maybe by a concurrent
 // scheduler), do not update further. this prevents scheduler A from expiring a command
 // that has already succeeded and been returned to scheduler B.
+// The elements of the results are stored separately in the commandelements table,
+// so large results can be retrieved in pages.
 func (db *DB) FinishCommand(cmd mig.Command) (err error) {
-	jResults, err := json.Marshal(cmd.Results)
+	jResults, els, err := splitCommandResults(cmd)
 	if err != nil {
-		return fmt.Errorf("Failed to marshal results: '%v'", err)
+		return
 	}
 
 	// XXX Filter any unicode NULL escape sequences present in the command
@@ -225,21 +312,40 @@ func (db *DB) FinishCommand(cmd mig.Command) (err error) {
 		return err
 	}
 
-	res, err := db.c.Exec(`UPDATE commands SET status=$1, results=$2, finishtime=$3
+	// update the command and its elements in a transaction, so readers never
+	// see results without their elements
+	tx, err := db.c.Begin()
+	if err != nil {
+		return
+	}
+	res, err := tx.Exec(`UPDATE commands SET status=$1, results=$2, finishtime=$3
 		WHERE id=$4 AND status!=$5 AND agentid IN (
 			SELECT id FROM agents
 			WHERE agents.queueloc=$6 AND agents.pid=$7 AND status IN ('online','idle')
 		)`, cmd.Status, jResults, cmd.FinishTime, cmd.ID, mig.StatusSuccess,
 		cmd.Agent.QueueLoc, cmd.Agent.PID)
 	if err != nil {
+		_ = tx.Rollback()
 		return fmt.Errorf("Error while updating command: '%v'", err)
 	}
 	ctr, err := res.RowsAffected()
 	if err != nil {
+		_ = tx.Rollback()
 		return fmt.Errorf("Error while evaluating query results: '%v'", err)
 	}
 	if ctr != 1 {
+		_ = tx.Rollback()
 		return fmt.Errorf("Failed to finish command status correctly, %d rows affected", ctr)
 	}
+	err = insertCommandElements(tx, cmd.ID, els)
+	if err != nil {
+		_ = tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("Error while committing command: '%v'", err)
+	}
 	return
 }
@@ -0,0 +1,245 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Julien Vehent jvehent@mozilla.com [:ulfr]
+
+package database /* import "mig.ninja/mig/database" */
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"mig.ninja/mig"
+)
+
+// InsertHunt writes a hunt and its action into the database in a single transaction,
+// so the scheduler never picks up the action without its hunt
+func (db *DB) InsertHunt(h mig.Hunt) (err error) {
+	txn, err := db.c.Begin()
+	if err != nil {
+		return
+	}
+	err = insertAction(txn.Exec, h.Action)
+	if err != nil {
+		_ = txn.Rollback()
+		return
+	}
+	_, err = txn.Exec(`INSERT INTO hunts
+		(id, actionid, name, target, validfrom, expireafter, status, createdat)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		h.ID, h.Action.ID, h.Name, h.Target, h.ValidFrom, h.ExpireAfter, h.Status, h.CreatedAt)
+	if err != nil {
+		_ = txn.Rollback()
+		return fmt.Errorf("Failed to store hunt: '%v'", err)
+	}
+	err = txn.Commit()
+	if err != nil {
+		_ = txn.Rollback()
+		return
+	}
+	return
+}
+
+// HuntByID retrieves a hunt from the database using its ID, along with its action
+// and coverage counters. If the query fails, the returned hunt will have ID -1
+func (db *DB) HuntByID(id float64) (h mig.Hunt, err error) {
+	h.ID = -1
+	err = db.c.QueryRow(`SELECT id, actionid, name, target, validfrom, expireafter, status, createdat
+		FROM hunts WHERE id=$1`, id).Scan(&h.ID, &h.Action.ID, &h.Name, &h.Target,
+		&h.ValidFrom, &h.ExpireAfter, &h.Status, &h.CreatedAt)
+	if err != nil {
+		h.ID = -1
+		err = fmt.Errorf("Error while retrieving hunt: '%v'", err)
+		return
+	}
+	h.Action, err = db.ActionByID(h.Action.ID)
+	if err != nil {
+		return
+	}
+	h.Counters, err = db.GetHuntCounters(h)
+	return
+}
+
+// HuntByActionID retrieves the hunt that runs an action. The action of the returned
+// hunt only contains its ID.
+func (db *DB) HuntByActionID(aid float64) (h mig.Hunt, err error) {
+	err = db.c.QueryRow(`SELECT id, actionid, name, target, validfrom, expireafter, status, createdat
+		FROM hunts WHERE actionid=$1`, aid).Scan(&h.ID, &h.Action.ID, &h.Name, &h.Target,
+		&h.ValidFrom, &h.ExpireAfter, &h.Status, &h.CreatedAt)
+	if err != nil {
+		err = fmt.Errorf("Error while retrieving hunt: '%v'", err)
+		return
+	}
+	return
+}
+
+// CancelHunt stops an active hunt from running its action on new agents
+func (db *DB) CancelHunt(id float64) (err error) {
+	res, err := db.c.Exec(`UPDATE hunts SET status=$1 WHERE id=$2 AND status=$3`,
+		mig.HuntStatusCancelled, id, mig.HuntStatusActive)
+	if err != nil {
+		return fmt.Errorf("Failed to cancel hunt: '%v'", err)
+	}
+	ctr, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("Error while evaluating query results: '%v'", err)
+	}
+	if ctr != 1 {
+		return fmt.Errorf("Hunt ID '%.0f' is not active and cannot be cancelled", id)
+	}
+	return
+}
+
+// ExpireHunts marks the active hunts that have passed their expiration date as
+// expired, and returns the number of hunts expired
+func (db *DB) ExpireHunts() (count int64, err error) {
+	res, err := db.c.Exec(`UPDATE hunts SET status=$1 WHERE status=$2 AND expireafter < NOW()`,
+		mig.HuntStatusExpired, mig.HuntStatusActive)
+	if err != nil {
+		err = fmt.Errorf("Error while expiring hunts: '%v'", err)
+		return
+	}
+	count, err = res.RowsAffected()
+	if err != nil {
+		err = fmt.Errorf("Error while counting expired hunts: '%v'", err)
+	}
+	return
+}
+
+// InFlightActionsOfStoppedHunts returns the IDs of the actions still in flight
+// that belong to hunts that have expired or have been cancelled
+func (db *DB) InFlightActionsOfStoppedHunts() (ids []float64, err error) {
+	rows, err := db.c.Query(`SELECT actions.id FROM actions, hunts
+		WHERE hunts.actionid=actions.id AND hunts.status!=$1 AND actions.status='inflight'`,
+		mig.HuntStatusActive)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil && err != sql.ErrNoRows {
+		err = fmt.Errorf("Error while listing actions of stopped hunts: '%v'", err)
+		return
+	}
+	for rows.Next() {
+		var id float64
+		err = rows.Scan(&id)
+		if err != nil {
+			err = fmt.Errorf("Error while retrieving action: '%v'", err)
+			return
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		err = fmt.Errorf("Failed to complete database query: '%v'", err)
+	}
+	return
+}
+
+// HuntsNotRunOnEndpoint returns the active hunts whose action started flying
+// before a point in time and hasn't been sent to any agent of an endpoint yet.
+// The hunts are not matched against the agents of the endpoint, and their action
+// only contains its ID.
+func (db *DB) HuntsNotRunOnEndpoint(queueloc string, startedBefore time.Time) (hunts []mig.Hunt, err error) {
+	rows, err := db.c.Query(`SELECT hunts.id, hunts.actionid, hunts.name, hunts.target,
+		hunts.validfrom, hunts.expireafter, hunts.status, hunts.createdat
+		FROM hunts, actions
+		WHERE hunts.actionid=actions.id AND hunts.status=$1 AND actions.status='inflight'
+		AND hunts.validfrom < NOW() AND hunts.expireafter > NOW() AND actions.starttime < $3
+		AND NOT EXISTS (SELECT 1 FROM commands, agents WHERE commands.actionid=hunts.actionid
+			AND commands.agentid=agents.id AND agents.queueloc=$2)
+		AND NOT EXISTS (SELECT 1 FROM huntendpoints WHERE huntendpoints.huntid=hunts.id
+			AND huntendpoints.queueloc=$2)`,
+		mig.HuntStatusActive, queueloc, startedBefore)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil && err != sql.ErrNoRows {
+		err = fmt.Errorf("Error while listing hunts: '%v'", err)
+		return
+	}
+	for rows.Next() {
+		var h mig.Hunt
+		err = rows.Scan(&h.ID, &h.Action.ID, &h.Name, &h.Target,
+			&h.ValidFrom, &h.ExpireAfter, &h.Status, &h.CreatedAt)
+		if err != nil {
+			err = fmt.Errorf("Error while retrieving hunt: '%v'", err)
+			return
+		}
+		hunts = append(hunts, h)
+	}
+	if err = rows.Err(); err != nil {
+		err = fmt.Errorf("Failed to complete database query: '%v'", err)
+	}
+	return
+}
+
+// ClaimHuntEndpoint records that a hunt runs on an endpoint, and returns false if
+// the hunt is no longer active or has already been claimed for the endpoint. The
+// row of the hunt is locked until the claim is recorded, so the heartbeats of the
+// agents of an endpoint received concurrently, by one or several schedulers, only
+// create a single command.
+func (db *DB) ClaimHuntEndpoint(huntid float64, queueloc string) (claimed bool, err error) {
+	txn, err := db.c.Begin()
+	if err != nil {
+		return
+	}
+	var id float64
+	err = txn.QueryRow(`SELECT id FROM hunts WHERE id=$1 AND status=$2 FOR UPDATE`,
+		huntid, mig.HuntStatusActive).Scan(&id)
+	if err == sql.ErrNoRows {
+		// the hunt has stopped
+		return false, txn.Rollback()
+	}
+	if err != nil {
+		_ = txn.Rollback()
+		return false, fmt.Errorf("Error while locking hunt: '%v'", err)
+	}
+	res, err := txn.Exec(`INSERT INTO huntendpoints (huntid, queueloc, claimedat)
+		SELECT $1::numeric, $2::varchar, NOW()
+		WHERE NOT EXISTS (SELECT 1 FROM huntendpoints WHERE huntid=$1 AND queueloc=$2)`,
+		huntid, queueloc)
+	if err != nil {
+		_ = txn.Rollback()
+		return false, fmt.Errorf("Failed to claim hunt endpoint: '%v'", err)
+	}
+	ctr, err := res.RowsAffected()
+	if err != nil {
+		_ = txn.Rollback()
+		return false, fmt.Errorf("Error while evaluating query results: '%v'", err)
+	}
+	err = txn.Commit()
+	if err != nil {
+		_ = txn.Rollback()
+		return
+	}
+	return ctr == 1, nil
+}
+
+// GetHuntCounters computes the coverage of a hunt and the status of its commands
+func (db *DB) GetHuntCounters(h mig.Hunt) (counters mig.HuntCounters, err error) {
+	counters.Commands, err = db.GetActionCounters(h.Action.ID)
+	if err != nil {
+		return
+	}
+	err = db.c.QueryRow(`SELECT COUNT(DISTINCT agents.queueloc) FROM commands, agents
+		WHERE commands.actionid=$1 AND commands.agentid=agents.id`, h.Action.ID).Scan(&counters.Covered)
+	if err != nil {
+		err = fmt.Errorf("Error while counting covered endpoints: '%v'", err)
+		return
+	}
+	counters.Online, err = db.CountActiveEndpointsByTarget(h.Target)
+	if err != nil {
+		return
+	}
+	cond, args, err := compileTarget(h.Target, 2)
+	if err != nil {
+		return
+	}
+	counters.Missing, err = db.countAgentsAsReadonly(fmt.Sprintf(`SELECT COUNT(DISTINCT queueloc) FROM agents
+		WHERE agents.status IN ('%s', '%s') AND %s
+		AND queueloc NOT IN (SELECT agents.queueloc FROM commands, agents
+			WHERE commands.actionid=$1 AND commands.agentid=agents.id)`,
+		mig.AgtStatusOnline, mig.AgtStatusIdle, cond), append([]interface{}{h.Action.ID}, args...)...)
+	return
+}
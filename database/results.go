@@ -0,0 +1,355 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Julien Vehent jvehent@mozilla.com [:ulfr]
+
+package database /* import "mig.ninja/mig/database" */
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"mig.ninja/mig"
+	"mig.ninja/mig/modules"
+
+	_ "github.com/lib/pq"
+)
+
+// number of rows written or read at once by the queries on result elements
+const elementsBatchSize = 1000
+
+// commandElement is an element of the results of a command, as stored in the
+// commandelements table
+type commandElement struct {
+	operation int
+	modules.ResultElement
+}
+
+// InsertCommandChunk stores a chunk of the results of a command, and returns the
+// number of distinct chunks of that command received so far
+func (db *DB) InsertCommandChunk(c mig.CommandChunk) (count int, err error) {
+	_, err = db.c.Exec(`INSERT INTO commandchunks (commandid, sequence, total, checksum, data, receivedat)
+		SELECT $1, $2, $3, $4, $5, NOW()
+		WHERE NOT EXISTS (SELECT 1 FROM commandchunks WHERE commandid=$1 AND sequence=$2)`,
+		c.CommandID, c.Sequence, c.Total, c.Checksum, c.Data)
+	if err != nil {
+		err = fmt.Errorf("Error while inserting command chunk: '%v'", err)
+		return
+	}
+	err = db.c.QueryRow(`SELECT COUNT(*) FROM commandchunks WHERE commandid=$1`, c.CommandID).Scan(&count)
+	if err != nil {
+		err = fmt.Errorf("Error while counting command chunks: '%v'", err)
+		return
+	}
+	return
+}
+
+// TakeCommandChunks removes the chunks of a command from the database and returns
+// them. The chunks are only returned once, if several schedulers try to take them,
+// all but one receive an empty list.
+func (db *DB) TakeCommandChunks(cmdid float64) (chunks []mig.CommandChunk, err error) {
+	rows, err := db.c.Query(`DELETE FROM commandchunks WHERE commandid=$1
+		RETURNING commandid, sequence, total, checksum, data`, cmdid)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil && err != sql.ErrNoRows {
+		err = fmt.Errorf("Error while taking command chunks: '%v'", err)
+		return
+	}
+	for rows.Next() {
+		var c mig.CommandChunk
+		err = rows.Scan(&c.CommandID, &c.Sequence, &c.Total, &c.Checksum, &c.Data)
+		if err != nil {
+			err = fmt.Errorf("Failed to retrieve command chunk: '%v'", err)
+			return
+		}
+		chunks = append(chunks, c)
+	}
+	if err = rows.Err(); err != nil {
+		err = fmt.Errorf("Failed to complete database query: '%v'", err)
+	}
+	return
+}
+
+// DeleteStaleCommandChunks removes the chunks received before a point in time, that
+// belong to results that were never completed
+func (db *DB) DeleteStaleCommandChunks(pointInTime time.Time) (count int64, err error) {
+	res, err := db.c.Exec(`DELETE FROM commandchunks WHERE receivedat < $1`, pointInTime)
+	if err != nil {
+		err = fmt.Errorf("Error while deleting stale command chunks: '%v'", err)
+		return
+	}
+	count, err = res.RowsAffected()
+	if err != nil {
+		err = fmt.Errorf("Error while counting deleted command chunks: '%v'", err)
+	}
+	return
+}
+
+// splitCommandResults removes the elements from the results of a command, and
+// returns the results without elements and the list of elements
+func splitCommandResults(cmd mig.Command) (jResults []byte, els []commandElement, err error) {
+	results := make([]modules.Result, len(cmd.Results))
+	copy(results, cmd.Results)
+	for i := range results {
+		var split []modules.ResultElement
+		split, err = results[i].SplitElements()
+		if err != nil {
+			err = fmt.Errorf("Failed to split results elements: '%v'", err)
+			return
+		}
+		for _, el := range split {
+			// XXX Postgres disallows unicode NULL escape sequences in json
+			// values, see FinishCommand
+			el.Data = bytes.Replace(el.Data, []byte("\\u0000"), []byte("NULL"), -1)
+			if !json.Valid(el.Data) {
+				err = fmt.Errorf("Invalid JSON in element %d of operation %d", el.Position, i)
+				return
+			}
+			els = append(els, commandElement{operation: i, ResultElement: el})
+		}
+	}
+	jResults, err = json.Marshal(results)
+	if err != nil {
+		err = fmt.Errorf("Failed to marshal results: '%v'", err)
+	}
+	return
+}
+
+// insertCommandElements replaces the elements of a command in the database with
+// a new list, in the order of the list
+func insertCommandElements(tx *sql.Tx, cmdid float64, els []commandElement) (err error) {
+	_, err = tx.Exec(`DELETE FROM commandelements WHERE commandid=$1`, cmdid)
+	if err != nil {
+		return fmt.Errorf("Error while deleting command elements: '%v'", err)
+	}
+	for start := 0; start < len(els); start += elementsBatchSize {
+		batch := els[start:min(start+elementsBatchSize, len(els))]
+		query := "INSERT INTO commandelements (commandid, seq, operation, path, position, element) VALUES "
+		vals := []interface{}{}
+		for i, el := range batch {
+			jPath, err := json.Marshal(el.Path)
+			if err != nil {
+				return fmt.Errorf("Failed to marshal element path: '%v'", err)
+			}
+			if i > 0 {
+				query += ", "
+			}
+			query += fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d)",
+				6*i+1, 6*i+2, 6*i+3, 6*i+4, 6*i+5, 6*i+6)
+			vals = append(vals, cmdid, start+i, el.operation, jPath, el.Position, []byte(el.Data))
+		}
+		_, err = tx.Exec(query, vals...)
+		if err != nil {
+			return fmt.Errorf("Error while inserting command elements: '%v'", err)
+		}
+	}
+	return
+}
+
+// scanCommandElements reads rows of commandid, operation, path, position and
+// element, and returns the elements indexed by command ID
+func scanCommandElements(rows *sql.Rows) (els map[float64][]commandElement, err error) {
+	els = make(map[float64][]commandElement)
+	for rows.Next() {
+		var (
+			cmdid        float64
+			el           commandElement
+			jPath, jData []byte
+		)
+		err = rows.Scan(&cmdid, &el.operation, &jPath, &el.Position, &jData)
+		if err != nil {
+			err = fmt.Errorf("Failed to retrieve command element: '%v'", err)
+			return
+		}
+		err = json.Unmarshal(jPath, &el.Path)
+		if err != nil {
+			err = fmt.Errorf("Failed to unmarshal element path: '%v'", err)
+			return
+		}
+		el.Data = jData
+		els[cmdid] = append(els[cmdid], el)
+	}
+	if err = rows.Err(); err != nil {
+		err = fmt.Errorf("Failed to complete database query: '%v'", err)
+	}
+	return
+}
+
+// joinCommandElements adds the elements of a command back into its results
+func joinCommandElements(cmd *mig.Command, els []commandElement) (err error) {
+	byOperation := make(map[int][]modules.ResultElement)
+	for _, el := range els {
+		if el.operation < 0 || el.operation >= len(cmd.Results) {
+			return fmt.Errorf("Element of command %.0f refers to unknown operation %d", cmd.ID, el.operation)
+		}
+		byOperation[el.operation] = append(byOperation[el.operation], el.ResultElement)
+	}
+	for op, opEls := range byOperation {
+		err = cmd.Results[op].JoinElements(opEls)
+		if err != nil {
+			return fmt.Errorf("Failed to join results elements: '%v'", err)
+		}
+	}
+	return
+}
+
+// loadCommandsElements retrieves the elements of a list of commands and adds them
+// back into their results. Commands stored without separate elements are left
+// unchanged.
+func (db *DB) loadCommandsElements(cmds []mig.Command) (err error) {
+	for start := 0; start < len(cmds); start += elementsBatchSize {
+		batch := cmds[start:min(start+elementsBatchSize, len(cmds))]
+		var (
+			placeholders []string
+			vals         []interface{}
+		)
+		for i, cmd := range batch {
+			placeholders = append(placeholders, fmt.Sprintf("$%d", i+1))
+			vals = append(vals, cmd.ID)
+		}
+		rows, err := db.c.Query(fmt.Sprintf(`SELECT commandid, operation, path, position, element
+			FROM commandelements WHERE commandid IN (%s)
+			ORDER BY commandid, seq`, strings.Join(placeholders, ", ")), vals...)
+		if err != nil {
+			if rows != nil {
+				rows.Close()
+			}
+			return fmt.Errorf("Error while retrieving command elements: '%v'", err)
+		}
+		els, err := scanCommandElements(rows)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		for i := range batch {
+			err = joinCommandElements(&batch[i], els[batch[i].ID])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return
+}
+
+// CommandPageByID retrieves a command from the database using its ID, with only
+// the elements of its results between offset and offset+limit, in the order they
+// were returned by the agent. It also returns the total number of elements of the
+// command.
+func (db *DB) CommandPageByID(id float64, offset, limit int) (cmd mig.Command, total int, err error) {
+	cmd, err = db.commandByID(id)
+	if err != nil {
+		return
+	}
+	err = db.c.QueryRow(`SELECT COUNT(*) FROM commandelements WHERE commandid=$1`, id).Scan(&total)
+	if err != nil {
+		err = fmt.Errorf("Error while counting command elements: '%v'", err)
+		return
+	}
+	rows, err := db.c.Query(`SELECT commandid, operation, path, position, element
+		FROM commandelements WHERE commandid=$1
+		ORDER BY seq OFFSET $2 LIMIT $3`, id, offset, limit)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		err = fmt.Errorf("Error while retrieving command elements: '%v'", err)
+		return
+	}
+	els, err := scanCommandElements(rows)
+	if err != nil {
+		return
+	}
+	err = joinCommandElements(&cmd, els[id])
+	return
+}
+
+// InsertCommandProgress stores a progress report of a command. Reports are only
+// accepted for commands that are still running on the agent that sent them.
+func (db *DB) InsertCommandProgress(cp mig.CommandProgress) (err error) {
+	jProgress, err := json.Marshal(cp.Progress)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal progress: '%v'", err)
+	}
+	jProgress = bytes.Replace(jProgress, []byte("\\u0000"), []byte("NULL"), -1)
+	res, err := db.c.Exec(`INSERT INTO commandprogress (commandid, operation, module, progress, receivedat)
+		SELECT commands.id, $2, $3, $4, NOW() FROM commands, agents
+		WHERE commands.id=$1 AND commands.status=$5 AND commands.agentid=agents.id
+		AND agents.queueloc=$6 AND agents.pid=$7`,
+		cp.CommandID, cp.Operation, cp.Module, jProgress, mig.StatusSent,
+		cp.Agent.QueueLoc, cp.Agent.PID)
+	if err != nil {
+		return fmt.Errorf("Error while inserting command progress: '%v'", err)
+	}
+	ctr, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("Error while evaluating query results: '%v'", err)
+	}
+	if ctr != 1 {
+		return fmt.Errorf("Command %.0f is not running on agent %s", cp.CommandID, cp.Agent.QueueLoc)
+	}
+	return
+}
+
+// ProgressByActionID retrieves at most limit progress reports of the commands of
+// an action received after a point in time, in the order they were received
+func (db *DB) ProgressByActionID(aid float64, since time.Time, limit int) (reports []mig.CommandProgress, err error) {
+	rows, err := db.c.Query(`SELECT commandprogress.commandid, commandprogress.operation,
+		commandprogress.module, commandprogress.progress, commandprogress.receivedat,
+		commands.actionid, agents.id, agents.name, agents.queueloc
+		FROM commandprogress, commands, agents
+		WHERE commandprogress.commandid=commands.id AND commands.agentid=agents.id
+		AND commands.actionid=$1 AND commandprogress.receivedat > $2
+		ORDER BY commandprogress.receivedat ASC LIMIT $3`, aid, since, limit)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		err = fmt.Errorf("Error while retrieving command progress: '%v'", err)
+		return
+	}
+	for rows.Next() {
+		var (
+			cp        mig.CommandProgress
+			jProgress []byte
+		)
+		err = rows.Scan(&cp.CommandID, &cp.Operation, &cp.Module, &jProgress, &cp.ReceivedAt,
+			&cp.ActionID, &cp.Agent.ID, &cp.Agent.Name, &cp.Agent.QueueLoc)
+		if err != nil {
+			err = fmt.Errorf("Failed to retrieve command progress: '%v'", err)
+			return
+		}
+		err = json.Unmarshal(jProgress, &cp.Progress)
+		if err != nil {
+			err = fmt.Errorf("Failed to unmarshal command progress: '%v'", err)
+			return
+		}
+		reports = append(reports, cp)
+	}
+	if err = rows.Err(); err != nil {
+		err = fmt.Errorf("Failed to complete database query: '%v'", err)
+	}
+	return
+}
+
+// DeleteFinishedCommandsProgress removes the progress reports of the commands that
+// are no longer running
+func (db *DB) DeleteFinishedCommandsProgress() (count int64, err error) {
+	res, err := db.c.Exec(`DELETE FROM commandprogress WHERE commandid IN (
+		SELECT id FROM commands WHERE status != $1)`, mig.StatusSent)
+	if err != nil {
+		err = fmt.Errorf("Error while deleting command progress: '%v'", err)
+		return
+	}
+	count, err = res.RowsAffected()
+	if err != nil {
+		err = fmt.Errorf("Error while counting deleted command progress: '%v'", err)
+	}
+	return
+}
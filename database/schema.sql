@@ -80,6 +80,67 @@ ALTER TABLE ONLY commands
 CREATE INDEX commands_agentid ON commands(agentid DESC);
 CREATE INDEX commands_actionid ON commands(actionid DESC);
 
+CREATE TABLE commandelements (
+    commandid   numeric NOT NULL,
+    seq         integer NOT NULL,
+    operation   integer NOT NULL,
+    path        json NOT NULL,
+    position    integer NOT NULL,
+    element     json NOT NULL
+);
+ALTER TABLE public.commandelements OWNER TO migadmin;
+ALTER TABLE ONLY commandelements
+    ADD CONSTRAINT commandelements_pkey PRIMARY KEY (commandid, seq);
+
+CREATE TABLE commandchunks (
+    commandid   numeric NOT NULL,
+    sequence    integer NOT NULL,
+    total       integer NOT NULL,
+    checksum    character varying(64) NOT NULL,
+    data        bytea NOT NULL,
+    receivedat  timestamp with time zone NOT NULL
+);
+ALTER TABLE public.commandchunks OWNER TO migadmin;
+ALTER TABLE ONLY commandchunks
+    ADD CONSTRAINT commandchunks_pkey PRIMARY KEY (commandid, sequence);
+CREATE INDEX commandchunks_receivedat ON commandchunks(receivedat);
+
+CREATE TABLE commandprogress (
+    commandid   numeric NOT NULL,
+    operation   integer NOT NULL,
+    module      character varying(256) NOT NULL,
+    progress    json NOT NULL,
+    receivedat  timestamp with time zone NOT NULL
+);
+ALTER TABLE public.commandprogress OWNER TO migadmin;
+CREATE INDEX commandprogress_commandid ON commandprogress(commandid);
+CREATE INDEX commandprogress_receivedat ON commandprogress(receivedat);
+
+CREATE TABLE hunts (
+    id          numeric NOT NULL,
+    actionid    numeric NOT NULL,
+    name        character varying(2048) NOT NULL,
+    target      character varying(2048) NOT NULL,
+    validfrom   timestamp with time zone NOT NULL,
+    expireafter timestamp with time zone NOT NULL,
+    status      character varying(256) NOT NULL,
+    createdat   timestamp with time zone NOT NULL
+);
+ALTER TABLE public.hunts OWNER TO migadmin;
+ALTER TABLE ONLY hunts
+    ADD CONSTRAINT hunts_pkey PRIMARY KEY (id);
+CREATE UNIQUE INDEX hunts_actionid_idx ON hunts(actionid);
+CREATE INDEX hunts_status_idx ON hunts(status);
+
+CREATE TABLE huntendpoints (
+    huntid      numeric NOT NULL,
+    queueloc    character varying(2048) NOT NULL,
+    claimedat   timestamp with time zone NOT NULL
+);
+ALTER TABLE public.huntendpoints OWNER TO migadmin;
+ALTER TABLE ONLY huntendpoints
+    ADD CONSTRAINT huntendpoints_pkey PRIMARY KEY (huntid, queueloc);
+
 CREATE TABLE invagtmodperm (
     investigatorid  numeric NOT NULL,
     agentid         numeric NOT NULL,
@@ -177,6 +238,18 @@ ALTER TABLE ONLY commands
 ALTER TABLE ONLY commands
     ADD CONSTRAINT commands_agentid_fkey FOREIGN KEY (agentid) REFERENCES agents(id);
 
+ALTER TABLE ONLY commandelements
+    ADD CONSTRAINT commandelements_commandid_fkey FOREIGN KEY (commandid) REFERENCES commands(id);
+
+ALTER TABLE ONLY commandprogress
+    ADD CONSTRAINT commandprogress_commandid_fkey FOREIGN KEY (commandid) REFERENCES commands(id);
+
+ALTER TABLE ONLY hunts
+    ADD CONSTRAINT hunts_actionid_fkey FOREIGN KEY (actionid) REFERENCES actions(id);
+
+ALTER TABLE ONLY huntendpoints
+    ADD CONSTRAINT huntendpoints_huntid_fkey FOREIGN KEY (huntid) REFERENCES hunts(id);
+
 ALTER TABLE ONLY manifestsig
     ADD CONSTRAINT manifestsig_manifestid_fkey FOREIGN KEY (manifestid) REFERENCES manifests(id);
 
@@ -198,17 +271,22 @@ ALTER TABLE ONLY signatures
 -- Scheduler can read all tables, insert and select private keys in the investigators table, but cannot update investigators
 GRANT SELECT ON ALL TABLES IN SCHEMA public TO migscheduler;
 GRANT INSERT, UPDATE ON actions, commands, agents, agents_stats, signatures TO migscheduler;
+GRANT UPDATE (status) ON hunts TO migscheduler;
+GRANT INSERT ON huntendpoints TO migscheduler;
+GRANT INSERT, DELETE ON commandelements, commandchunks, commandprogress TO migscheduler;
 GRANT INSERT ON investigators TO migscheduler;
 GRANT USAGE ON SEQUENCE investigators_id_seq TO migscheduler;
 
 -- API has limited permissions, and cannot list scheduler private keys in the investigators table, but can update their statuses
-GRANT SELECT ON actions, agents, agents_stats, agtmodreq, commands, invagtmodperm, loaders, manifests, manifestsig, modules, signatures TO migapi;
+GRANT SELECT ON actions, agents, agents_stats, agtmodreq, commandelements, commandprogress, commands, hunts, invagtmodperm, loaders, manifests, manifestsig, modules, signatures TO migapi;
 GRANT SELECT (id, name, pgpfingerprint, publickey, status, createdat, lastmodified, permissions) ON investigators TO migapi;
-GRANT INSERT ON actions, signatures, manifests, manifestsig, loaders TO migapi;
+GRANT INSERT ON actions, hunts, signatures, manifests, manifestsig, loaders TO migapi;
 GRANT DELETE ON manifestsig TO migapi;
 GRANT INSERT (name, pgpfingerprint, publickey, status, createdat, lastmodified, permissions) ON investigators TO migapi;
 GRANT UPDATE (permissions, status, lastmodified) ON investigators TO migapi;
 GRANT UPDATE (name, env, tags, loaderkey, salt, lastseen, enabled, expectenv) ON loaders TO migapi;
+GRANT UPDATE (status) ON actions TO migapi;
+GRANT UPDATE (status) ON hunts TO migapi;
 GRANT UPDATE (status) ON manifests TO migapi;
 GRANT USAGE ON SEQUENCE investigators_id_seq TO migapi;
 GRANT USAGE ON SEQUENCE loaders_id_seq TO migapi;
@@ -217,7 +295,7 @@ GRANT USAGE ON SEQUENCE manifests_id_seq TO migapi;
 -- readonly user is used for things like expanding targets
 CREATE ROLE migreadonly;
 ALTER ROLE migreadonly WITH NOSUPERUSER INHERIT NOCREATEROLE NOCREATEDB NOLOGIN;
-GRANT SELECT ON actions, agents, agtmodreq, commands, invagtmodperm, modules, signatures TO migreadonly;
+GRANT SELECT ON actions, agents, agtmodreq, commandelements, commandprogress, commands, hunts, invagtmodperm, modules, signatures TO migreadonly;
 GRANT SELECT (id, env, tags, expectenv) ON loaders TO migreadonly;
 GRANT SELECT (id, name, pgpfingerprint, publickey, status, createdat, lastmodified) ON investigators TO migreadonly;
 GRANT migreadonly TO migapi;
@@ -296,9 +296,11 @@ func (db *DB) SearchCommands(p search.Parameters, doFoundAnything bool) (command
 		}
 		commands = append(commands, cmd)
 	}
-	if err := rows.Err(); err != nil {
+	if err = rows.Err(); err != nil {
 		err = fmt.Errorf("Failed to complete database query: '%v'", err)
+		return
 	}
+	err = db.loadCommandsElements(commands)
 	return
 }
 
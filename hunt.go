@@ -0,0 +1,100 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Julien Vehent jvehent@mozilla.com [:ulfr]
+
+package mig /* import "mig.ninja/mig" */
+
+import (
+	"fmt"
+	"time"
+)
+
+// A Hunt is a standing action. The scheduler runs the action of the hunt on the
+// agents that match its target when it is launched, like any other action, and
+// then on each agent matching the target that comes online later, until the hunt
+// expires or is cancelled. The target and validity window of a hunt are those of
+// its action, which is signed by the investigators like any other action.
+type Hunt struct {
+	ID          float64      `json:"id"`
+	Name        string       `json:"name"`
+	Target      string       `json:"target"`
+	Action      Action       `json:"action"`
+	ValidFrom   time.Time    `json:"validfrom"`
+	ExpireAfter time.Time    `json:"expireafter"`
+	Status      string       `json:"status"`
+	CreatedAt   time.Time    `json:"createdat"`
+	Counters    HuntCounters `json:"counters,omitempty"`
+}
+
+const (
+	HuntStatusActive    string = "active"
+	HuntStatusExpired   string = "expired"
+	HuntStatusCancelled string = "cancelled"
+)
+
+// HuntCounters track the coverage of a hunt. Endpoints are counted once even if
+// they ran several agents. Online is the number of online endpoints that match the
+// target of the hunt, Covered the number of endpoints that received the hunt and
+// Missing the number of online endpoints that match but haven't received it yet.
+type HuntCounters struct {
+	Online   int            `json:"online"`
+	Covered  int            `json:"covered"`
+	Missing  int            `json:"missing"`
+	Commands ActionCounters `json:"commands"`
+}
+
+// NewHunt returns a hunt that runs an action until it expires
+func NewHunt(a Action) (h Hunt) {
+	h.ID = GenID()
+	h.Name = a.Name
+	h.Target = a.Target
+	h.Action = a
+	h.ValidFrom = a.ValidFrom
+	h.ExpireAfter = a.ExpireAfter
+	h.Status = HuntStatusActive
+	h.CreatedAt = time.Now().UTC()
+	return
+}
+
+// IsActive returns true if the hunt runs its action on new agents
+func (h Hunt) IsActive() bool {
+	return h.Status == HuntStatusActive && time.Now().Before(h.ExpireAfter)
+}
+
+// Coverage returns the percentage of the online endpoints matching the target of
+// the hunt that received it
+func (h Hunt) Coverage() float64 {
+	total := h.Counters.Covered + h.Counters.Missing
+	if total == 0 {
+		return 0
+	}
+	return float64(h.Counters.Covered) * 100 / float64(total)
+}
+
+// PrintCounters returns the coverage of a hunt and the status of its commands
+func (h Hunt) PrintCounters() string {
+	out := fmt.Sprintf("%d endpoints covered, %d online endpoints missing (%.1f%% coverage)",
+		h.Counters.Covered, h.Counters.Missing, h.Coverage())
+	out += fmt.Sprintf("; commands: %d sent, %d done", h.Counters.Commands.Sent, h.Counters.Commands.Done)
+	if h.Counters.Commands.InFlight > 0 {
+		out += fmt.Sprintf(", %d inflight", h.Counters.Commands.InFlight)
+	}
+	if h.Counters.Commands.Success > 0 {
+		out += fmt.Sprintf(", %d succeeded", h.Counters.Commands.Success)
+	}
+	if h.Counters.Commands.Failed > 0 {
+		out += fmt.Sprintf(", %d failed", h.Counters.Commands.Failed)
+	}
+	if h.Counters.Commands.Expired > 0 {
+		out += fmt.Sprintf(", %d expired", h.Counters.Commands.Expired)
+	}
+	if h.Counters.Commands.TimeOut > 0 {
+		out += fmt.Sprintf(", %d timed out", h.Counters.Commands.TimeOut)
+	}
+	if h.Counters.Commands.Cancelled > 0 {
+		out += fmt.Sprintf(", %d cancelled", h.Counters.Commands.Cancelled)
+	}
+	return out
+}
@@ -0,0 +1,88 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mig /* import "mig.ninja/mig" */
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewHunt(t *testing.T) {
+	a := Action{
+		ID:          42,
+		Name:        "find the backdoor",
+		Target:      "os:linux AND tag:team=web",
+		ValidFrom:   time.Now().Add(-time.Minute).UTC(),
+		ExpireAfter: time.Now().Add(24 * time.Hour).UTC(),
+	}
+	before := time.Now().UTC()
+	h := NewHunt(a)
+	if h.ID <= 0 {
+		t.Fatalf("hunt has no ID")
+	}
+	if h.Name != a.Name || h.Target != a.Target || h.Action.ID != a.ID {
+		t.Fatalf("hunt does not run its action: %+v", h)
+	}
+	if !h.ValidFrom.Equal(a.ValidFrom) || !h.ExpireAfter.Equal(a.ExpireAfter) {
+		t.Fatalf("hunt runs from %s to %s, expected the validity of its action", h.ValidFrom, h.ExpireAfter)
+	}
+	if h.Status != HuntStatusActive {
+		t.Fatalf("new hunt has status %q", h.Status)
+	}
+	if h.CreatedAt.Before(before) || h.CreatedAt.Location() != time.UTC {
+		t.Fatalf("unexpected creation time %s", h.CreatedAt)
+	}
+	if NewHunt(a).ID == h.ID {
+		t.Fatalf("hunts of the same action have the same ID")
+	}
+}
+
+func TestHuntIsActive(t *testing.T) {
+	for _, tc := range []struct {
+		status      string
+		expireafter time.Duration
+		active      bool
+	}{
+		{HuntStatusActive, time.Hour, true},
+		{HuntStatusActive, -time.Second, false},
+		{HuntStatusExpired, time.Hour, false},
+		{HuntStatusExpired, -time.Hour, false},
+		{HuntStatusCancelled, time.Hour, false},
+		{"", time.Hour, false},
+	} {
+		h := Hunt{Status: tc.status, ExpireAfter: time.Now().Add(tc.expireafter)}
+		if h.IsActive() != tc.active {
+			t.Fatalf("hunt %q expiring in %s: expected active %t", tc.status, tc.expireafter, tc.active)
+		}
+	}
+}
+
+func TestHuntCoverage(t *testing.T) {
+	for _, tc := range []struct {
+		covered, missing int
+		coverage         float64
+	}{
+		{0, 0, 0},
+		{0, 12, 0},
+		{1, 3, 25},
+		{2, 1, 200.0 / 3},
+		{7, 0, 100},
+	} {
+		h := Hunt{Counters: HuntCounters{Covered: tc.covered, Missing: tc.missing, Online: tc.covered + tc.missing}}
+		if h.Coverage() != tc.coverage {
+			t.Fatalf("%d covered and %d missing: expected coverage %f, got %f", tc.covered, tc.missing, tc.coverage, h.Coverage())
+		}
+	}
+}
+
+func TestHuntPrintCounters(t *testing.T) {
+	h := Hunt{Counters: HuntCounters{Covered: 3, Missing: 1,
+		Commands: ActionCounters{Sent: 4, Done: 3, InFlight: 1, Success: 2, Failed: 1}}}
+	expected := "3 endpoints covered, 1 online endpoints missing (75.0% coverage); " +
+		"commands: 4 sent, 3 done, 1 inflight, 2 succeeded, 1 failed"
+	if h.PrintCounters() != expected {
+		t.Fatalf("expected %q, got %q", expected, h.PrintCounters())
+	}
+}
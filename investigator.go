@@ -33,6 +33,8 @@ func (i *Investigator) CheckPermission(pv int64) bool {
 		return i.Permissions.Action
 	case PermActionCreate:
 		return i.Permissions.ActionCreate
+	case PermActionCancel:
+		return i.Permissions.ActionCancel
 	case PermCommand:
 		return i.Permissions.Command
 	case PermAgent:
@@ -72,6 +74,7 @@ type InvestigatorPerms struct {
 	Search             bool `json:"search"`
 	Action             bool `json:"action"`
 	ActionCreate       bool `json:"action_create"`
+	ActionCancel       bool `json:"action_cancel"`
 	Command            bool `json:"command"`
 	Agent              bool `json:"agent"`
 	Dashboard          bool `json:"dashboard"`
@@ -101,6 +104,9 @@ func (ip *InvestigatorPerms) FromMask(mask int64) {
 	if (mask & PermActionCreate) != 0 {
 		ip.ActionCreate = true
 	}
+	if (mask & PermActionCancel) != 0 {
+		ip.ActionCancel = true
+	}
 	if (mask & PermCommand) != 0 {
 		ip.Command = true
 	}
@@ -162,6 +168,9 @@ func (ip *InvestigatorPerms) ToMask() (ret int64) {
 	if ip.ActionCreate {
 		ret |= PermActionCreate
 	}
+	if ip.ActionCancel {
+		ret |= PermActionCancel
+	}
 	if ip.Command {
 		ret |= PermCommand
 	}
@@ -314,6 +323,7 @@ func (ip *InvestigatorPerms) DefaultSet() {
 	ip.Search = true
 	ip.Action = true
 	ip.ActionCreate = true
+	ip.ActionCancel = true
 	ip.Command = true
 	ip.Agent = true
 	ip.Dashboard = true
@@ -365,6 +375,7 @@ const (
 	PermInvestigator
 	PermInvestigatorCreate
 	PermInvestigatorUpdate
+	PermActionCancel
 )
 
 const (
@@ -40,6 +40,7 @@ type runtimeOptions struct {
 	foreground  bool
 	upgrading   bool
 	pretty      bool
+	progress    bool
 	showversion bool
 }
 
@@ -54,15 +55,25 @@ type moduleResult struct {
 type moduleOp struct {
 	err          error
 	id           float64
+	cmdid        float64
+	actionid     float64
 	mode         string
 	isCompressed bool
 	params       interface{}
 	resultChan   chan moduleResult
 	position     int
 	expireafter  time.Time
+	cancel       chan bool
 }
 
+// runningOps is accessed by the goroutines that parse commands, run modules
+// and receive their results, and is protected by runningOpsLock
 var runningOps = make(map[float64]moduleOp)
+var runningOpsLock sync.Mutex
+
+// MODULESTOPTIMEOUT is the time a module has to return its results after it
+// has been asked to stop, before it is killed
+const MODULESTOPTIMEOUT time.Duration = 30 * time.Second
 
 func main() {
 	var (
@@ -86,6 +97,7 @@ func main() {
 	flag.BoolVar(&runOpt.foreground, "f", false, "Agent will fork into background by default. Except if this flag is set.")
 	flag.BoolVar(&runOpt.upgrading, "u", false, "Used while upgrading an agent, means that this agent is started by another agent.")
 	flag.BoolVar(&runOpt.pretty, "p", false, "When running a module, pretty print the results instead of returning JSON.")
+	flag.BoolVar(&runOpt.progress, "s", false, "When running a module, write its progress messages on stdout before the results.")
 	flag.BoolVar(&runOpt.showversion, "V", false, "Print Agent version to stdout and exit.")
 
 	flag.Parse()
@@ -161,6 +173,9 @@ func main() {
 			}
 		}
 	default:
+		if runOpt.progress {
+			modules.ProgressWriter = os.Stdout
+		}
 		fmt.Printf("%s", runModuleDirectly(runOpt.mode, nil, runOpt.pretty))
 	}
 exit:
@@ -307,7 +322,10 @@ done:
 	// wait until all running operations are done
 	for {
 		time.Sleep(1 * time.Second)
-		if len(runningOps) == 0 {
+		runningOpsLock.Lock()
+		remaining := len(runningOps)
+		runningOpsLock.Unlock()
+		if remaining == 0 {
 			break
 		}
 	}
@@ -494,8 +512,9 @@ func parseCommands(ctx *Context, msg []byte) (err error) {
 		if e := recover(); e != nil {
 			err = fmt.Errorf("parseCommands() -> %v", e)
 
-			// if we have a command to return, update status and send back
-			if cmd.ID > 0 {
+			// if we have a command to return, update status and send back,
+			// unless it was only a request to cancel the command
+			if cmd.ID > 0 && cmd.Status != mig.StatusCancelled {
 				results := make([]modules.Result, len(cmd.Action.Operations))
 				for i, _ := range cmd.Action.Operations {
 					var mr modules.Result
@@ -524,6 +543,13 @@ func parseCommands(ctx *Context, msg []byte) (err error) {
 		panic(err)
 	}
 
+	// the scheduler sends a command back with a cancelled status when an
+	// investigator cancels its action
+	if cmd.Status == mig.StatusCancelled {
+		cancelCommand(ctx, cmd)
+		return
+	}
+
 	// Each operation is ran separately by a module, a channel is created to receive the results from each module
 	// a goroutine is created to read from the result channel, and when all modules are done, build the response
 	resultChan := make(chan moduleResult)
@@ -532,12 +558,15 @@ func parseCommands(ctx *Context, msg []byte) (err error) {
 		// create an module operation object
 		currentOp := moduleOp{
 			id:           mig.GenID(),
+			cmdid:        cmd.ID,
+			actionid:     cmd.Action.ID,
 			mode:         operation.Module,
 			isCompressed: operation.IsCompressed,
 			params:       operation.Parameters,
 			resultChan:   resultChan,
 			position:     counter,
 			expireafter:  cmd.Action.ExpireAfter,
+			cancel:       make(chan bool, 1),
 		}
 
 		desc := fmt.Sprintf("sending operation %d to module %s", counter, operation.Module)
@@ -546,12 +575,16 @@ func parseCommands(ctx *Context, msg []byte) (err error) {
 		// check that the module is available and pass the command to the execution channel
 		if _, ok := modules.Available[operation.Module]; ok {
 			ctx.Channels.Log <- mig.Log{CommandID: cmd.ID, ActionID: cmd.Action.ID, Desc: fmt.Sprintf("calling module '%s'", operation.Module)}.Debug()
+			runningOpsLock.Lock()
 			runningOps[currentOp.id] = currentOp
+			runningOpsLock.Unlock()
 			ctx.Channels.RunAgentCommand <- currentOp
 		} else {
 			// no module is available, return an error
 			currentOp.err = fmt.Errorf("module '%s' is not available", operation.Module)
+			runningOpsLock.Lock()
 			runningOps[currentOp.id] = currentOp
+			runningOpsLock.Unlock()
 			ctx.Channels.Log <- mig.Log{CommandID: cmd.ID, ActionID: cmd.Action.ID, Desc: fmt.Sprintf("module '%s' not available", operation.Module)}
 		}
 		opsCounter++
@@ -563,6 +596,28 @@ func parseCommands(ctx *Context, msg []byte) (err error) {
 	return
 }
 
+// cancelCommand asks the operations of a cancelled command to stop. The
+// operations that are running stop their modules and return partial results,
+// the ones that are still queued do not run at all.
+func cancelCommand(ctx *Context, cmd mig.Command) {
+	runningOpsLock.Lock()
+	defer runningOpsLock.Unlock()
+	cancelled := 0
+	for _, op := range runningOps {
+		if op.cmdid != cmd.ID || op.err != nil {
+			continue
+		}
+		select {
+		case op.cancel <- true:
+			cancelled++
+		default:
+			// already cancelled
+		}
+	}
+	desc := fmt.Sprintf("command cancelled, stopping %d operations", cancelled)
+	ctx.Channels.Log <- mig.Log{CommandID: cmd.ID, ActionID: cmd.Action.ID, Desc: desc}
+}
+
 // runModule is a generic module launcher that takes an operation and calls
 // the mig-agent binary with the proper module parameters. It sets a timeout on
 // execution and kills the module if needed. On success, it stores the output from
@@ -581,16 +636,28 @@ func runModule(ctx *Context, op moduleOp) (err error) {
 			result.status = mig.StatusFailed
 		}
 		// upon exit, remove the op from the running Ops
+		runningOpsLock.Lock()
 		delete(runningOps, op.id)
+		runningOpsLock.Unlock()
 		// whatever happens, always send the results
 		op.resultChan <- result
 		ctx.Channels.Log <- mig.Log{OpID: op.id, Desc: "leaving runModule()"}.Debug()
 	}()
 
+	// the command may have been cancelled while the operation was queued
+	select {
+	case <-op.cancel:
+		ctx.Channels.Log <- mig.Log{OpID: op.id, Desc: "command cancelled before the module started."}
+		result.status = mig.StatusCancelled
+		result.err = fmt.Errorf("command was cancelled before module %q started", op.mode)
+		return
+	default:
+	}
+
 	ctx.Channels.Log <- mig.Log{OpID: op.id, Desc: fmt.Sprintf("executing module %q", op.mode)}.Debug()
 	// waiter is a channel that receives a message when the timeout expires
 	waiter := make(chan error, 1)
-	var out bytes.Buffer
+	out := moduleOutput{ctx: ctx, op: op}
 
 	// calculate the max exec time by taking the smallest duration between the expiration date
 	// sent with the command, and the default MODULETIMEOUT value from the agent configuration
@@ -604,9 +671,10 @@ func runModule(ctx *Context, op moduleOp) (err error) {
 	if err != nil {
 		panic(err)
 	}
+	modParams = append(modParams, '\n')
 
 	// build the command line and execute
-	cmd := exec.Command(ctx.Agent.BinPath, "-m", strings.ToLower(op.mode))
+	cmd := exec.Command(ctx.Agent.BinPath, "-m", strings.ToLower(op.mode), "-s")
 	stdinpipe, err := cmd.StdinPipe()
 	if err != nil {
 		panic(err)
@@ -620,7 +688,11 @@ func runModule(ctx *Context, op moduleOp) (err error) {
 	// if required. Doing this in a goroutine ensures the timeout logic
 	// later in this function will fire if for some reason the module does
 	// not drain the pipe, and the agent ends up blocking on Write().
+	// Stdin is left open to send a stop message to the module if the
+	// command gets cancelled, and closed when the module exits.
+	paramsSent := make(chan bool)
 	go func() {
+		defer close(paramsSent)
 		left := len(modParams)
 		for left > 0 {
 			nb, err := stdinpipe.Write(modParams)
@@ -631,7 +703,6 @@ func runModule(ctx *Context, op moduleOp) (err error) {
 			left -= nb
 			modParams = modParams[nb:]
 		}
-		stdinpipe.Close()
 	}()
 
 	// launch the waiter in a separate goroutine
@@ -655,6 +726,38 @@ func runModule(ctx *Context, op moduleOp) (err error) {
 		}
 		<-waiter // allow goroutine to exit
 
+	// Cancel case: the command was cancelled, ask the module to stop and
+	// keep the partial results it returns
+	case <-op.cancel:
+		ctx.Channels.Log <- mig.Log{OpID: op.id, Desc: "command cancelled. Stopping module."}
+		result.status = mig.StatusCancelled
+		go func() {
+			<-paramsSent
+			stopMsg, err := modules.MakeMessage(modules.MsgClassStop, nil, false)
+			if err != nil {
+				return
+			}
+			stdinpipe.Write(append(stopMsg, '\n'))
+		}()
+		select {
+		case err := <-waiter:
+			if err == nil {
+				err = json.Unmarshal(out.Bytes(), &result.output)
+			}
+			if err != nil {
+				result.err = fmt.Errorf("module %q failed to return results after it was stopped: %v", op.mode, err)
+			}
+		case <-time.After(MODULESTOPTIMEOUT):
+			// the module does not watch for stop messages, kill it
+			ctx.Channels.Log <- mig.Log{OpID: op.id, Desc: "module did not stop. Killing it."}.Err()
+			err := cmd.Process.Kill()
+			if err != nil {
+				panic(err)
+			}
+			<-waiter // allow goroutine to exit
+			result.err = fmt.Errorf("module %q was killed after the command was cancelled", op.mode)
+		}
+
 	// Normal exit case: command has run successfully
 	case err := <-waiter:
 		if err != nil {
@@ -676,6 +779,103 @@ func runModule(ctx *Context, op moduleOp) (err error) {
 	return
 }
 
+// MINPROGRESSINTERVAL is the minimum time between two progress messages of an
+// operation relayed to the scheduler. More frequent messages that only contain
+// statistics are dropped, the ones that contain elements are always relayed.
+const MINPROGRESSINTERVAL time.Duration = time.Second
+
+// publishProgress publishes the progress messages relayed to the scheduler
+var publishProgress = publish
+
+// moduleOutput receives the stdout of a module. Progress messages are written
+// one per line before the results, they are relayed to the scheduler as they
+// arrive and everything else is kept as the results of the module.
+type moduleOutput struct {
+	ctx       *Context
+	op        moduleOp
+	line      []byte // beginning of a line that may be a progress message
+	results   bytes.Buffer
+	lastRelay time.Time
+}
+
+func (mo *moduleOutput) Write(p []byte) (n int, err error) {
+	n = len(p)
+	for len(p) > 0 {
+		// once the results have started, the rest of the output is results
+		if mo.results.Len() > 0 {
+			mo.results.Write(p)
+			return
+		}
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			mo.line = append(mo.line, p...)
+			p = nil
+		} else {
+			mo.line = append(mo.line, p[:i+1]...)
+			p = p[i+1:]
+		}
+		if !modules.IsProgress(mo.line) {
+			mo.results.Write(mo.line)
+			mo.line = nil
+			continue
+		}
+		if i >= 0 {
+			mo.relayProgress(mo.line)
+			mo.line = nil
+		}
+	}
+	return
+}
+
+// Bytes returns the results written by the module
+func (mo *moduleOutput) Bytes() []byte {
+	if len(mo.line) > 0 {
+		mo.results.Write(mo.line)
+		mo.line = nil
+	}
+	return mo.results.Bytes()
+}
+
+// relayProgress publishes a progress message of a module to the scheduler
+func (mo *moduleOutput) relayProgress(line []byte) {
+	progress, err := modules.ReadProgress(line)
+	if err != nil {
+		mo.ctx.Channels.Log <- mig.Log{OpID: mo.op.id, Desc: fmt.Sprintf("invalid progress message: %v", err)}.Err()
+		return
+	}
+	if progress.Elements == nil && time.Since(mo.lastRelay) < MINPROGRESSINTERVAL {
+		mo.ctx.Channels.Log <- mig.Log{OpID: mo.op.id, Desc: "dropping progress message sent too soon after the previous one"}.Debug()
+		return
+	}
+	mo.lastRelay = time.Now()
+	mo.ctx.Agent.Lock()
+	cp := mig.CommandProgress{
+		CommandID: mo.op.cmdid,
+		ActionID:  mo.op.actionid,
+		Agent: mig.Agent{
+			Name:     mo.ctx.Agent.Hostname,
+			QueueLoc: mo.ctx.Agent.QueueLoc,
+			PID:      os.Getpid(),
+		},
+		Operation: mo.op.position,
+		Module:    mo.op.mode,
+		Progress:  progress,
+	}
+	mo.ctx.Agent.Unlock()
+	body, err := json.Marshal(cp)
+	if err != nil {
+		mo.ctx.Channels.Log <- mig.Log{OpID: mo.op.id, Desc: fmt.Sprintf("failed to marshal progress: %v", err)}.Err()
+		return
+	}
+	// publish in a separate goroutine to not block the output of the module
+	go func() {
+		err := publishProgress(mo.ctx, mig.Mq_Ex_ToSchedulers, mig.Mq_Q_Progress, body)
+		if err != nil {
+			mo.ctx.Channels.Log <- mig.Log{OpID: mo.op.id, Desc: fmt.Sprintf("failed to relay progress: %v", err)}.Err()
+		}
+	}()
+}
+
 // receiveResult listens on a temporary channels for results coming from modules. It aggregates them, and
 // when all are received, it builds a response that is passed to the Result channel
 func receiveModuleResults(ctx *Context, cmd mig.Command, resultChan chan moduleResult, opsCounter int) (err error) {
@@ -697,18 +897,24 @@ func receiveModuleResults(ctx *Context, cmd mig.Command, resultChan chan moduleR
 	cmd.Status = mig.StatusSuccess
 
 	// process failed operations first
+	var failedOps []moduleOp
+	runningOpsLock.Lock()
 	for _, op := range runningOps {
 		if op.err != nil {
-			ctx.Channels.Log <- mig.Log{OpID: op.id, CommandID: cmd.ID, ActionID: cmd.Action.ID, Desc: "process error for module"}.Debug()
-			cmd.Status = "failed"
-			err = json.Unmarshal([]byte(fmt.Sprintf(`{"errors": ["%v"]}`, op.err)), &cmd.Results[op.position])
-			if err != nil {
-				panic(err)
-			}
-			resultReceived++
-			if resultReceived >= opsCounter {
-				goto finish
-			}
+			failedOps = append(failedOps, op)
+		}
+	}
+	runningOpsLock.Unlock()
+	for _, op := range failedOps {
+		ctx.Channels.Log <- mig.Log{OpID: op.id, CommandID: cmd.ID, ActionID: cmd.Action.ID, Desc: "process error for module"}.Debug()
+		cmd.Status = "failed"
+		err = json.Unmarshal([]byte(fmt.Sprintf(`{"errors": ["%v"]}`, op.err)), &cmd.Results[op.position])
+		if err != nil {
+			panic(err)
+		}
+		resultReceived++
+		if resultReceived >= opsCounter {
+			goto finish
 		}
 	}
 
@@ -754,12 +960,31 @@ func sendResults(ctx *Context, result mig.Command) (err error) {
 	if err != nil {
 		panic(err)
 	}
+	if len(body) <= mig.ResultChunkSize {
+		err = publish(ctx, mig.Mq_Ex_ToSchedulers, mig.Mq_Q_Results, body)
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
 
-	err = publish(ctx, mig.Mq_Ex_ToSchedulers, mig.Mq_Q_Results, body)
+	// large results are sent in ordered chunks the scheduler reassembles
+	chunks, err := result.Chunks(mig.ResultChunkSize)
 	if err != nil {
 		panic(err)
 	}
-
+	ctx.Channels.Log <- mig.Log{CommandID: result.ID, ActionID: result.Action.ID,
+		Desc: fmt.Sprintf("sending %d bytes of results in %d chunks", len(body), len(chunks))}.Debug()
+	for _, chunk := range chunks {
+		body, err = json.Marshal(chunk)
+		if err != nil {
+			panic(err)
+		}
+		err = publish(ctx, mig.Mq_Ex_ToSchedulers, mig.Mq_Q_ResultChunks, body)
+		if err != nil {
+			panic(err)
+		}
+	}
 	return
 }
 
@@ -0,0 +1,290 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"mig.ninja/mig"
+	"mig.ninja/mig/modules"
+)
+
+// the agent runs modules in a child process of its own binary, the tests
+// run them in a child process of the test binary, selected by this variable
+const testChildEnv = "MIG_AGENT_TEST_CHILD"
+
+// testReadyEnv names the file the child creates once its module is running
+const testReadyEnv = "MIG_AGENT_TEST_READY"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(testChildEnv) == "1" {
+		// invoked as `<bin> -m <module> -s` by runModule
+		modules.ProgressWriter = os.Stdout
+		fmt.Printf("%s", runModuleDirectly(os.Args[2], nil, false))
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// stopModule finds one element right away, then waits for a stop message and
+// returns the element it found
+type stopModule struct{}
+
+func (m *stopModule) NewRun() modules.Runner {
+	return new(stopRun)
+}
+
+type stopRun struct {
+	Results modules.Result
+}
+
+func (r *stopRun) ValidateParameters() error {
+	return nil
+}
+
+func (r *stopRun) Run(in io.Reader) string {
+	var params interface{}
+	err := modules.ReadInputParameters(in, &params)
+	if err != nil {
+		r.Results.Errors = append(r.Results.Errors, err.Error())
+	}
+	stop := make(chan bool, 1)
+	go modules.WatchForStop(in, &stop)
+	r.Results.Elements = []string{"found before the stop"}
+	ioutil.WriteFile(os.Getenv(testReadyEnv), nil, 0600)
+	select {
+	case <-stop:
+		r.Results.Errors = append(r.Results.Errors, modules.StoppedEarly)
+	case <-time.After(time.Minute):
+	}
+	buf, _ := json.Marshal(r.Results)
+	return string(buf)
+}
+
+func init() {
+	modules.Register("teststop", new(stopModule))
+}
+
+func TestRunModuleCancelled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mig-agent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ready := filepath.Join(dir, "ready")
+	os.Setenv(testChildEnv, "1")
+	defer os.Unsetenv(testChildEnv)
+	os.Setenv(testReadyEnv, ready)
+	defer os.Unsetenv(testReadyEnv)
+
+	var ctx Context
+	ctx.Agent.BinPath = os.Args[0]
+	ctx.Channels.Log = make(chan mig.Log)
+	go func() {
+		for range ctx.Channels.Log {
+		}
+	}()
+	op := moduleOp{
+		id:          mig.GenID(),
+		cmdid:       mig.GenID(),
+		mode:        "teststop",
+		resultChan:  make(chan moduleResult, 1),
+		expireafter: time.Now().Add(time.Minute),
+		cancel:      make(chan bool, 1),
+	}
+	go runModule(&ctx, op)
+
+	// cancel the command once the module is running
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := os.Stat(ready); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("module did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	op.cancel <- true
+
+	var result moduleResult
+	select {
+	case result = <-op.resultChan:
+	case <-time.After(MODULESTOPTIMEOUT + 10*time.Second):
+		t.Fatal("module did not return results after it was cancelled")
+	}
+	if result.status != mig.StatusCancelled {
+		t.Errorf("status is %q, expected %q", result.status, mig.StatusCancelled)
+	}
+	if result.err != nil {
+		t.Fatalf("unexpected error: %v", result.err)
+	}
+	var elements []string
+	buf, err := json.Marshal(result.output.Elements)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(buf, &elements)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(elements) != 1 || elements[0] != "found before the stop" {
+		t.Errorf("elements are %v, expected the one found before the stop", elements)
+	}
+	if len(result.output.Errors) != 1 || result.output.Errors[0] != modules.StoppedEarly {
+		t.Errorf("errors are %v, expected %q", result.output.Errors, modules.StoppedEarly)
+	}
+}
+
+// captureProgress replaces the publication of progress messages with a
+// channel that receives the messages relayed by the agent
+func captureProgress() (relayed chan mig.CommandProgress, restore func()) {
+	relayed = make(chan mig.CommandProgress, 100)
+	publishProgress = func(ctx *Context, exchange, routingKey string, body []byte) error {
+		var cp mig.CommandProgress
+		err := json.Unmarshal(body, &cp)
+		if err != nil {
+			return err
+		}
+		relayed <- cp
+		return nil
+	}
+	return relayed, func() { publishProgress = publish }
+}
+
+func testOutputContext() *Context {
+	ctx := new(Context)
+	ctx.Channels.Log = make(chan mig.Log)
+	go func() {
+		for range ctx.Channels.Log {
+		}
+	}()
+	return ctx
+}
+
+// receiveProgress returns the progress messages relayed so far
+func receiveProgress(relayed chan mig.CommandProgress, expected int) (progress []modules.Progress) {
+	for len(progress) < expected {
+		select {
+		case cp := <-relayed:
+			progress = append(progress, cp.Progress)
+		case <-time.After(5 * time.Second):
+			return
+		}
+	}
+	// nothing more than expected is relayed
+	select {
+	case cp := <-relayed:
+		progress = append(progress, cp.Progress)
+	case <-time.After(50 * time.Millisecond):
+	}
+	return
+}
+
+func progressLine(t *testing.T, p modules.Progress) string {
+	msg, err := modules.MakeMessage(modules.MsgClassProgress, p, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(msg) + "\n"
+}
+
+func TestModuleOutputWrite(t *testing.T) {
+	relayed, restore := captureProgress()
+	defer restore()
+	results := `{"foundanything":true,"success":true,"elements":{"a":["b"]},"statistics":null,"errors":null}`
+	p1 := progressLine(t, modules.Progress{Percent: 10, Elements: []interface{}{"first"}})
+	p2 := progressLine(t, modules.Progress{Percent: 20, Elements: []interface{}{"second"}})
+	prefix := `{"class":"progress",`
+	for _, tc := range []struct {
+		desc     string
+		writes   []string
+		results  string
+		progress int
+	}{
+		{"results only", []string{results}, results, 0},
+		{"results split", []string{results[:5], results[5:30], results[30:]}, results, 0},
+		{"results split after a progress-like beginning", []string{`{"`, results[2:]}, results, 0},
+		{"progress and results in one write", []string{p1 + p2 + results}, results, 2},
+		{"progress split across writes", []string{p1[:30], p1[30:] + p2[:1], p2[1:], results}, results, 2},
+		{"progress prefix split across writes", []string{p1[:5], p1[5 : len(prefix)-1], p1[len(prefix)-1:], results}, results, 1},
+		{"progress newline in its own write", []string{p1[:len(p1)-1], "\n", results}, results, 1},
+		{"results in the same write as the end of progress", []string{p1[:40], p1[40:] + results[:10], results[10:]}, results, 1},
+		{"byte by byte", strings.Split(p1+p2+results, ""), results, 2},
+		{"no results", []string{p1}, "", 1},
+	} {
+		mo := moduleOutput{ctx: testOutputContext()}
+		for _, w := range tc.writes {
+			n, err := mo.Write([]byte(w))
+			if err != nil || n != len(w) {
+				t.Fatalf("%s: write returned %d, %v", tc.desc, n, err)
+			}
+		}
+		if string(mo.Bytes()) != tc.results {
+			t.Fatalf("%s: expected results %q, got %q", tc.desc, tc.results, mo.Bytes())
+		}
+		progress := receiveProgress(relayed, tc.progress)
+		if len(progress) != tc.progress {
+			t.Fatalf("%s: expected %d progress messages, got %d", tc.desc, tc.progress, len(progress))
+		}
+		// progress messages are published concurrently, in any order
+		var percents []float64
+		for _, p := range progress {
+			percents = append(percents, p.Percent)
+		}
+		sort.Float64s(percents)
+		for i, percent := range percents {
+			if percent != float64(10*(i+1)) {
+				t.Fatalf("%s: unexpected progress %v", tc.desc, percents)
+			}
+		}
+	}
+}
+
+func TestModuleOutputIncompleteProgress(t *testing.T) {
+	relayed, restore := captureProgress()
+	defer restore()
+	// a line that starts like a progress message but never ends is results
+	line := `{"class":"progress","parameters":{"percent":5}`
+	mo := moduleOutput{ctx: testOutputContext()}
+	mo.Write([]byte(line[:10]))
+	mo.Write([]byte(line[10:]))
+	if string(mo.Bytes()) != line {
+		t.Fatalf("expected results %q, got %q", line, mo.Bytes())
+	}
+	if progress := receiveProgress(relayed, 0); len(progress) != 0 {
+		t.Fatalf("unexpected progress messages %v", progress)
+	}
+}
+
+func TestRelayProgressThrottle(t *testing.T) {
+	relayed, restore := captureProgress()
+	defer restore()
+	mo := moduleOutput{ctx: testOutputContext()}
+	// statistics sent too often are dropped, elements are always relayed
+	mo.Write([]byte(progressLine(t, modules.Progress{Percent: 1, Statistics: "stats"})))
+	mo.Write([]byte(progressLine(t, modules.Progress{Percent: 2, Statistics: "stats"})))
+	mo.Write([]byte(progressLine(t, modules.Progress{Percent: 3, Elements: []interface{}{"found"}})))
+	mo.Write([]byte(progressLine(t, modules.Progress{Percent: 4, Statistics: "stats"})))
+	mo.Write([]byte(progressLine(t, modules.Progress{Percent: 5, Statistics: "stats", Elements: []interface{}{"found"}})))
+	progress := receiveProgress(relayed, 3)
+	var percents []float64
+	for _, p := range progress {
+		percents = append(percents, p.Percent)
+	}
+	sort.Float64s(percents)
+	if len(percents) != 3 || percents[0] != 1 || percents[1] != 3 || percents[2] != 5 {
+		t.Fatalf("expected progress 1, 3 and 5 to be relayed, got %v", percents)
+	}
+}
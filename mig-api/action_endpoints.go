@@ -41,12 +41,46 @@ func createAction(respWriter http.ResponseWriter, request *http.Request) {
 	if err != nil {
 		panic(err)
 	}
-	postAction := request.FormValue("action")
+	ctx.Channels.Log <- mig.Log{OpID: opid, Desc: fmt.Sprintf("Received action for creation '%s'", request.FormValue("action"))}.Debug()
+	action, err = newActionFromPost(request.FormValue("action"))
+	if err != nil {
+		panic(err)
+	}
+	ctx.Channels.Log <- mig.Log{OpID: opid, ActionID: action.ID, Desc: "Received new action with valid signature"}
+
+	// write action and signatures to database
+	err = ctx.DB.InsertAction(action)
+	if err != nil {
+		panic(err)
+	}
+	err = insertSignatures(action)
+	if err != nil {
+		panic(err)
+	}
+	ctx.Channels.Log <- mig.Log{OpID: opid, ActionID: action.ID, Desc: "Action written to database"}
+	err = resource.AddItem(cljs.Item{
+		Href: fmt.Sprintf("%s/action?actionid=%.0f", ctx.Server.BaseURL, action.ID),
+		Data: []cljs.Data{{Name: "action ID " + fmt.Sprintf("%.0f", action.ID), Value: action}},
+	})
+	if err != nil {
+		panic(err)
+	}
+	// return a 202 Accepted. the action will be processed asynchronously, and may fail later.
+	respond(http.StatusAccepted, resource, respWriter, request)
+}
+
+// newActionFromPost parses a signed action received from an investigator, initializes
+// its fields, validates it and verifies its signatures
+func newActionFromPost(postAction string) (action mig.Action, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("newActionFromPost() -> %v", e)
+		}
+	}()
 	err = json.Unmarshal([]byte(postAction), &action)
 	if err != nil {
 		panic(err)
 	}
-	ctx.Channels.Log <- mig.Log{OpID: opid, Desc: fmt.Sprintf("Received action for creation '%s'", action)}.Debug()
 
 	// Init action fields
 	action.ID = mig.GenID()
@@ -71,14 +105,17 @@ func createAction(respWriter http.ResponseWriter, request *http.Request) {
 	if err != nil {
 		panic(err)
 	}
-	ctx.Channels.Log <- mig.Log{OpID: opid, ActionID: action.ID, Desc: "Received new action with valid signature"}
+	return
+}
 
-	// write action to database
-	err = ctx.DB.InsertAction(action)
-	if err != nil {
-		panic(err)
-	}
-	// write signatures to database
+// insertSignatures maps the signatures of a new action to their investigators
+// in the database
+func insertSignatures(action mig.Action) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("insertSignatures() -> %v", e)
+		}
+	}()
 	astr, err := action.String()
 	if err != nil {
 		panic(err)
@@ -101,15 +138,69 @@ func createAction(respWriter http.ResponseWriter, request *http.Request) {
 			panic(err)
 		}
 	}
-	ctx.Channels.Log <- mig.Log{OpID: opid, ActionID: action.ID, Desc: "Action written to database"}
+	return
+}
+
+// cancelAction receives the ID of an action in a POST request and marks the
+// action for cancellation. The scheduler cancels the commands of the action
+// and asks the agents to stop running them.
+func cancelAction(respWriter http.ResponseWriter, request *http.Request) {
+	var (
+		err      error
+		actionID float64
+	)
+	opid := getOpID(request)
+	loc := fmt.Sprintf("%s%s", ctx.Server.Host, request.URL.String())
+	resource := cljs.New(loc)
+	defer func() {
+		if e := recover(); e != nil {
+			ctx.Channels.Log <- mig.Log{OpID: opid, ActionID: actionID, Desc: fmt.Sprintf("%v", e)}.Err()
+			resource.SetError(cljs.Error{Code: fmt.Sprintf("%.0f", opid), Message: fmt.Sprintf("%v", e)})
+			respond(http.StatusInternalServerError, resource, respWriter, request)
+		}
+		ctx.Channels.Log <- mig.Log{OpID: opid, ActionID: actionID, Desc: "leaving cancelAction()"}.Debug()
+	}()
+	err = request.ParseForm()
+	if err != nil {
+		panic(err)
+	}
+	actionID, err = strconv.ParseFloat(request.FormValue("actionid"), 64)
+	if err != nil || actionID <= 0 {
+		// bad request, return 400
+		resource.SetError(cljs.Error{
+			Code:    fmt.Sprintf("%.0f", opid),
+			Message: fmt.Sprintf("Invalid Action ID '%s'", request.FormValue("actionid"))})
+		respond(http.StatusBadRequest, resource, respWriter, request)
+		return
+	}
+	a, err := ctx.DB.ActionMetaByID(actionID)
+	if err != nil {
+		// not found, return 404
+		resource.SetError(cljs.Error{
+			Code:    fmt.Sprintf("%.0f", opid),
+			Message: fmt.Sprintf("Action ID '%.0f' not found", actionID)})
+		respond(http.StatusNotFound, resource, respWriter, request)
+		return
+	}
+	err = ctx.DB.CancelAction(a.ID)
+	if err != nil {
+		// the action has already finished, return 409
+		resource.SetError(cljs.Error{
+			Code:    fmt.Sprintf("%.0f", opid),
+			Message: fmt.Sprintf("%v", err)})
+		respond(http.StatusConflict, resource, respWriter, request)
+		return
+	}
+	desc := fmt.Sprintf("Action '%s' cancelled by investigator '%s'", a.Name, getInvName(request))
+	ctx.Channels.Log <- mig.Log{OpID: opid, ActionID: a.ID, Desc: desc}
 	err = resource.AddItem(cljs.Item{
-		Href: fmt.Sprintf("%s/action?actionid=%.0f", ctx.Server.BaseURL, action.ID),
-		Data: []cljs.Data{{Name: "action ID " + fmt.Sprintf("%.0f", action.ID), Value: action}},
+		Href: fmt.Sprintf("%s/action?actionid=%.0f", ctx.Server.BaseURL, a.ID),
+		Data: []cljs.Data{{Name: "action ID " + fmt.Sprintf("%.0f", a.ID), Value: a.ID}},
 	})
 	if err != nil {
 		panic(err)
 	}
-	// return a 202 Accepted. the action will be processed asynchronously, and may fail later.
+	// return a 202 Accepted. the action is cancelled asynchronously by the scheduler.
 	respond(http.StatusAccepted, resource, respWriter, request)
 }
 
@@ -173,6 +264,65 @@ func getAction(respWriter http.ResponseWriter, request *http.Request) {
 	respond(http.StatusOK, resource, respWriter, request)
 }
 
+// getActionProgress returns the progress reports of the running commands of an
+// action, received after the time given in the `since` parameter
+func getActionProgress(respWriter http.ResponseWriter, request *http.Request) {
+	var err error
+	opid := getOpID(request)
+	loc := fmt.Sprintf("%s%s", ctx.Server.Host, request.URL.String())
+	resource := cljs.New(loc)
+	defer func() {
+		if e := recover(); e != nil {
+			emsg := fmt.Sprintf("%v", e)
+			ctx.Channels.Log <- mig.Log{OpID: opid, Desc: emsg}.Err()
+			resource.SetError(cljs.Error{Code: fmt.Sprintf("%.0f", opid), Message: emsg})
+			respond(http.StatusInternalServerError, resource, respWriter, request)
+		}
+		ctx.Channels.Log <- mig.Log{OpID: opid, Desc: "leaving getActionProgress()"}.Debug()
+	}()
+	actionID, err := strconv.ParseFloat(request.URL.Query().Get("actionid"), 64)
+	if err != nil || actionID <= 0 {
+		resource.SetError(cljs.Error{
+			Code:    fmt.Sprintf("%.0f", opid),
+			Message: fmt.Sprintf("Invalid Action ID '%s'", request.URL.Query().Get("actionid"))})
+		respond(http.StatusBadRequest, resource, respWriter, request)
+		return
+	}
+	var since time.Time
+	if request.URL.Query().Get("since") != "" {
+		since, err = time.Parse(time.RFC3339Nano, request.URL.Query().Get("since"))
+		if err != nil {
+			resource.SetError(cljs.Error{
+				Code:    fmt.Sprintf("%.0f", opid),
+				Message: fmt.Sprintf("Invalid parameter 'since': %v", err)})
+			respond(http.StatusBadRequest, resource, respWriter, request)
+			return
+		}
+	}
+	limit := 1000
+	if request.URL.Query().Get("limit") != "" {
+		limit, err = strconv.Atoi(request.URL.Query().Get("limit"))
+		if err != nil || limit < 1 {
+			resource.SetError(cljs.Error{
+				Code:    fmt.Sprintf("%.0f", opid),
+				Message: "Invalid parameter 'limit'"})
+			respond(http.StatusBadRequest, resource, respWriter, request)
+			return
+		}
+	}
+	reports, err := ctx.DB.ProgressByActionID(actionID, since, limit)
+	if err != nil {
+		panic(err)
+	}
+	for _, cp := range reports {
+		resource.AddItem(cljs.Item{
+			Href: fmt.Sprintf("%s/command?commandid=%.0f", ctx.Server.BaseURL, cp.CommandID),
+			Data: []cljs.Data{{Name: "progress", Value: cp}},
+		})
+	}
+	respond(http.StatusOK, resource, respWriter, request)
+}
+
 // actionToItem receives an Action and returns an Item
 // in the Collection+JSON format
 func actionToItem(a mig.Action, addCommands bool, ctx Context) (item cljs.Item, err error) {
@@ -87,6 +87,16 @@ func main() {
 		authenticate(getAction, mig.PermAction)).Methods("GET")
 	s.HandleFunc("/action/create/",
 		authenticate(createAction, mig.PermActionCreate)).Methods("POST")
+	s.HandleFunc("/action/cancel/",
+		authenticate(cancelAction, mig.PermActionCancel)).Methods("POST")
+	s.HandleFunc("/action/progress",
+		authenticate(getActionProgress, mig.PermAction)).Methods("GET")
+	s.HandleFunc("/hunt",
+		authenticate(getHunt, mig.PermAction)).Methods("GET")
+	s.HandleFunc("/hunt/create/",
+		authenticate(createHunt, mig.PermActionCreate)).Methods("POST")
+	s.HandleFunc("/hunt/cancel/",
+		authenticate(cancelHunt, mig.PermActionCancel)).Methods("POST")
 	s.HandleFunc("/command",
 		authenticate(getCommand, mig.PermCommand)).Methods("GET")
 	s.HandleFunc("/agent",
@@ -36,10 +36,41 @@ func getCommand(respWriter http.ResponseWriter, request *http.Request) {
 		panic(err)
 	}
 
+	// the elements of the results can be retrieved in pages, using a limit and
+	// an offset
+	paged := false
+	offset, limit, total := 0, 1000, 0
+	if request.URL.Query().Get("limit") != "" {
+		paged = true
+		limit, err = strconv.Atoi(request.URL.Query().Get("limit"))
+		if err != nil || limit < 1 {
+			resource.SetError(cljs.Error{
+				Code:    fmt.Sprintf("%.0f", opid),
+				Message: "Invalid parameter 'limit'"})
+			respond(http.StatusBadRequest, resource, respWriter, request)
+			return
+		}
+	}
+	if request.URL.Query().Get("offset") != "" {
+		paged = true
+		offset, err = strconv.Atoi(request.URL.Query().Get("offset"))
+		if err != nil || offset < 0 {
+			resource.SetError(cljs.Error{
+				Code:    fmt.Sprintf("%.0f", opid),
+				Message: "Invalid parameter 'offset'"})
+			respond(http.StatusBadRequest, resource, respWriter, request)
+			return
+		}
+	}
+
 	// retrieve the command
 	var cmd mig.Command
 	if commandID > 0 {
-		cmd, err = ctx.DB.CommandByID(commandID)
+		if paged {
+			cmd, total, err = ctx.DB.CommandPageByID(commandID, offset, limit)
+		} else {
+			cmd, err = ctx.DB.CommandByID(commandID)
+		}
 		if err != nil {
 			if fmt.Sprintf("%v", err) == "Error while retrieving command: 'sql: no rows in result set'" {
 				// not found, return 404
@@ -65,6 +96,17 @@ func getCommand(respWriter http.ResponseWriter, request *http.Request) {
 	if err != nil {
 		panic(err)
 	}
+	if paged {
+		commandItem.Data = append(commandItem.Data, cljs.Data{Name: "elements", Value: map[string]int{
+			"offset": offset, "limit": limit, "total": total}})
+		if offset+limit < total {
+			commandItem.Links = append(commandItem.Links, cljs.Link{
+				Rel: "next",
+				Href: fmt.Sprintf("%s/command?commandid=%.0f&offset=%d&limit=%d",
+					ctx.Server.BaseURL, cmd.ID, offset+limit, limit),
+			})
+		}
+	}
 	resource.AddItem(commandItem)
 	respond(http.StatusOK, resource, respWriter, request)
 }
@@ -0,0 +1,175 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Julien Vehent jvehent@mozilla.com [:ulfr]
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jvehent/cljs"
+	"mig.ninja/mig"
+)
+
+// createHunt receives a signed action in a POST request, validates it, and
+// writes it into the database along with a hunt that runs it on the agents
+// that come online until it expires
+func createHunt(respWriter http.ResponseWriter, request *http.Request) {
+	var (
+		err  error
+		hunt mig.Hunt
+	)
+	opid := getOpID(request)
+	loc := fmt.Sprintf("%s%s", ctx.Server.Host, request.URL.String())
+	resource := cljs.New(loc)
+	defer func() {
+		if e := recover(); e != nil {
+			ctx.Channels.Log <- mig.Log{OpID: opid, ActionID: hunt.Action.ID, Desc: fmt.Sprintf("%v", e)}.Err()
+			resource.SetError(cljs.Error{Code: fmt.Sprintf("%.0f", opid), Message: fmt.Sprintf("%v", e)})
+			respond(http.StatusInternalServerError, resource, respWriter, request)
+		}
+		ctx.Channels.Log <- mig.Log{OpID: opid, ActionID: hunt.Action.ID, Desc: "leaving createHunt()"}.Debug()
+	}()
+	err = request.ParseForm()
+	if err != nil {
+		panic(err)
+	}
+	ctx.Channels.Log <- mig.Log{OpID: opid, Desc: fmt.Sprintf("Received hunt for creation '%s'", request.FormValue("action"))}.Debug()
+	action, err := newActionFromPost(request.FormValue("action"))
+	if err != nil {
+		panic(err)
+	}
+	hunt = mig.NewHunt(action)
+	ctx.Channels.Log <- mig.Log{OpID: opid, ActionID: action.ID, Desc: "Received new hunt with valid signature"}
+
+	// write the hunt, its action and signatures to database
+	err = ctx.DB.InsertHunt(hunt)
+	if err != nil {
+		panic(err)
+	}
+	err = insertSignatures(action)
+	if err != nil {
+		panic(err)
+	}
+	desc := fmt.Sprintf("Hunt %.0f created by investigator '%s' until %s", hunt.ID, getInvName(request), hunt.ExpireAfter)
+	ctx.Channels.Log <- mig.Log{OpID: opid, ActionID: action.ID, Desc: desc}
+	err = resource.AddItem(huntToItem(hunt))
+	if err != nil {
+		panic(err)
+	}
+	// return a 202 Accepted. the action of the hunt will be processed asynchronously, and may fail later.
+	respond(http.StatusAccepted, resource, respWriter, request)
+}
+
+// getHunt queries the database and retrieves a hunt, its action and its coverage
+func getHunt(respWriter http.ResponseWriter, request *http.Request) {
+	var err error
+	opid := getOpID(request)
+	loc := fmt.Sprintf("%s%s", ctx.Server.Host, request.URL.String())
+	resource := cljs.New(loc)
+	defer func() {
+		if e := recover(); e != nil {
+			emsg := fmt.Sprintf("%v", e)
+			ctx.Channels.Log <- mig.Log{OpID: opid, Desc: emsg}.Err()
+			resource.SetError(cljs.Error{Code: fmt.Sprintf("%.0f", opid), Message: emsg})
+			respond(http.StatusInternalServerError, resource, respWriter, request)
+		}
+		ctx.Channels.Log <- mig.Log{OpID: opid, Desc: "leaving getHunt()"}.Debug()
+	}()
+	huntID, err := strconv.ParseFloat(request.URL.Query().Get("huntid"), 64)
+	if err != nil || huntID <= 0 {
+		// bad request, return 400
+		resource.SetError(cljs.Error{
+			Code:    fmt.Sprintf("%.0f", opid),
+			Message: fmt.Sprintf("Invalid Hunt ID '%s'", request.URL.Query().Get("huntid"))})
+		respond(http.StatusBadRequest, resource, respWriter, request)
+		return
+	}
+	h, err := ctx.DB.HuntByID(huntID)
+	if err != nil {
+		if h.ID == -1 {
+			// not found, return 404
+			resource.SetError(cljs.Error{
+				Code:    fmt.Sprintf("%.0f", opid),
+				Message: fmt.Sprintf("Hunt ID '%.0f' not found", huntID)})
+			respond(http.StatusNotFound, resource, respWriter, request)
+			return
+		}
+		panic(err)
+	}
+	h.Action.Investigators, err = ctx.DB.InvestigatorByActionID(h.Action.ID)
+	if err != nil {
+		panic(err)
+	}
+	resource.AddItem(huntToItem(h))
+	respond(http.StatusOK, resource, respWriter, request)
+}
+
+// cancelHunt receives the ID of a hunt in a POST request and stops the hunt from
+// running its action on new agents. The commands already sent are not cancelled,
+// cancel the action of the hunt to stop them as well.
+func cancelHunt(respWriter http.ResponseWriter, request *http.Request) {
+	var (
+		err    error
+		huntID float64
+	)
+	opid := getOpID(request)
+	loc := fmt.Sprintf("%s%s", ctx.Server.Host, request.URL.String())
+	resource := cljs.New(loc)
+	defer func() {
+		if e := recover(); e != nil {
+			ctx.Channels.Log <- mig.Log{OpID: opid, Desc: fmt.Sprintf("%v", e)}.Err()
+			resource.SetError(cljs.Error{Code: fmt.Sprintf("%.0f", opid), Message: fmt.Sprintf("%v", e)})
+			respond(http.StatusInternalServerError, resource, respWriter, request)
+		}
+		ctx.Channels.Log <- mig.Log{OpID: opid, Desc: "leaving cancelHunt()"}.Debug()
+	}()
+	err = request.ParseForm()
+	if err != nil {
+		panic(err)
+	}
+	huntID, err = strconv.ParseFloat(request.FormValue("huntid"), 64)
+	if err != nil || huntID <= 0 {
+		// bad request, return 400
+		resource.SetError(cljs.Error{
+			Code:    fmt.Sprintf("%.0f", opid),
+			Message: fmt.Sprintf("Invalid Hunt ID '%s'", request.FormValue("huntid"))})
+		respond(http.StatusBadRequest, resource, respWriter, request)
+		return
+	}
+	err = ctx.DB.CancelHunt(huntID)
+	if err != nil {
+		// the hunt does not exist or has already stopped, return 409
+		resource.SetError(cljs.Error{
+			Code:    fmt.Sprintf("%.0f", opid),
+			Message: fmt.Sprintf("%v", err)})
+		respond(http.StatusConflict, resource, respWriter, request)
+		return
+	}
+	desc := fmt.Sprintf("Hunt %.0f cancelled by investigator '%s'", huntID, getInvName(request))
+	ctx.Channels.Log <- mig.Log{OpID: opid, Desc: desc}
+	err = resource.AddItem(cljs.Item{
+		Href: fmt.Sprintf("%s/hunt?huntid=%.0f", ctx.Server.BaseURL, huntID),
+		Data: []cljs.Data{{Name: "hunt ID " + fmt.Sprintf("%.0f", huntID), Value: huntID}},
+	})
+	if err != nil {
+		panic(err)
+	}
+	// return a 202 Accepted. the action of the hunt lands once its commands have returned.
+	respond(http.StatusAccepted, resource, respWriter, request)
+}
+
+// huntToItem receives a Hunt and returns an Item in the Collection+JSON format
+func huntToItem(h mig.Hunt) (item cljs.Item) {
+	item.Href = fmt.Sprintf("%s/hunt?huntid=%.0f", ctx.Server.BaseURL, h.ID)
+	item.Data = []cljs.Data{
+		{Name: "hunt", Value: h},
+	}
+	item.Links = []cljs.Link{
+		{Rel: "action", Href: fmt.Sprintf("%s/action?actionid=%.0f", ctx.Server.BaseURL, h.Action.ID)},
+	}
+	return
+}
@@ -0,0 +1,139 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mig.ninja/mig"
+	"mig.ninja/mig/testutil"
+)
+
+var setupAPIOnce sync.Once
+
+// setupAPITest initializes the parts of the context used by the handlers
+func setupAPITest() {
+	setupAPIOnce.Do(func() {
+		ctx.Channels.Log = make(chan mig.Log)
+		go func() {
+			for range ctx.Channels.Log {
+			}
+		}()
+		ctx.Server.Host = "http://api.mig.example.net"
+		ctx.Server.BaseURL = ctx.Server.Host + "/api/v1"
+		ctx.Server.ClientPublicIPOffset = -1
+	})
+}
+
+func serveHunt(handler http.HandlerFunc, method, target string, form url.Values) *httptest.ResponseRecorder {
+	var request *http.Request
+	if method == "POST" {
+		request = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		request = httptest.NewRequest(method, target, nil)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, request)
+	return rec
+}
+
+func TestHuntEndpointsBadRequests(t *testing.T) {
+	setupAPITest()
+	for _, tc := range []struct {
+		desc    string
+		handler http.HandlerFunc
+		method  string
+		target  string
+		form    url.Values
+		code    int
+	}{
+		{"get without id", getHunt, "GET", "/api/v1/hunt", nil, http.StatusBadRequest},
+		{"get with invalid id", getHunt, "GET", "/api/v1/hunt?huntid=abc", nil, http.StatusBadRequest},
+		{"get with negative id", getHunt, "GET", "/api/v1/hunt?huntid=-4", nil, http.StatusBadRequest},
+		{"cancel without id", cancelHunt, "POST", "/api/v1/hunt/cancel/", url.Values{}, http.StatusBadRequest},
+		{"cancel with invalid id", cancelHunt, "POST", "/api/v1/hunt/cancel/",
+			url.Values{"huntid": {"12ab"}}, http.StatusBadRequest},
+		{"cancel with zero id", cancelHunt, "POST", "/api/v1/hunt/cancel/",
+			url.Values{"huntid": {"0"}}, http.StatusBadRequest},
+		{"create with invalid action", createHunt, "POST", "/api/v1/hunt/create/",
+			url.Values{"action": {"{not an action"}}, http.StatusInternalServerError},
+	} {
+		rec := serveHunt(tc.handler, tc.method, tc.target, tc.form)
+		if rec.Code != tc.code {
+			t.Fatalf("%s: expected code %d, got %d: %s", tc.desc, tc.code, rec.Code, rec.Body.String())
+		}
+		if !strings.Contains(rec.Body.String(), `"error"`) {
+			t.Fatalf("%s: response contains no error: %s", tc.desc, rec.Body.String())
+		}
+	}
+}
+
+func TestHuntEndpoints(t *testing.T) {
+	setupAPITest()
+	ctx.DB = testutil.OpenTestDB(t)
+	tag := fmt.Sprintf("%.0f", mig.GenID())
+	defer testutil.DeleteTestRows(t, tag)
+	a := mig.Action{
+		ID:             mig.GenID(),
+		Name:           "hunt endpoints test",
+		Target:         "tag:hunttest=" + tag,
+		ValidFrom:      time.Now().UTC(),
+		ExpireAfter:    time.Now().Add(time.Hour).UTC(),
+		StartTime:      time.Now().UTC(),
+		FinishTime:     time.Now().Add(time.Hour).UTC(),
+		LastUpdateTime: time.Now().UTC(),
+		Status:         "inflight",
+		SyntaxVersion:  mig.ActionVersion,
+		Operations:     []mig.Operation{{Module: "file", Parameters: map[string]interface{}{}}},
+	}
+	h := mig.NewHunt(a)
+	err := ctx.DB.InsertHunt(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := fmt.Sprintf("%.0f", h.ID)
+
+	rec := serveHunt(getHunt, "GET", "/api/v1/hunt?huntid="+id, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("get: expected code 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	for _, expected := range []string{
+		fmt.Sprintf(`"href":"http://api.mig.example.net/api/v1/hunt?huntid=%s"`, id),
+		fmt.Sprintf(`"href":"http://api.mig.example.net/api/v1/action?actionid=%.0f"`, a.ID),
+		`"status":"active"`,
+		`"counters":`,
+	} {
+		if !strings.Contains(rec.Body.String(), expected) {
+			t.Fatalf("get: response does not contain %s: %s", expected, rec.Body.String())
+		}
+	}
+
+	rec = serveHunt(getHunt, "GET", fmt.Sprintf("/api/v1/hunt?huntid=%.0f", mig.GenID()), nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("get unknown hunt: expected code 404, got %d", rec.Code)
+	}
+
+	// a hunt is only cancelled once
+	rec = serveHunt(cancelHunt, "POST", "/api/v1/hunt/cancel/", url.Values{"huntid": {id}})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("cancel: expected code 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = serveHunt(cancelHunt, "POST", "/api/v1/hunt/cancel/", url.Values{"huntid": {id}})
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("cancel again: expected code 409, got %d", rec.Code)
+	}
+	rec = serveHunt(getHunt, "GET", "/api/v1/hunt?huntid="+id, nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"status":"cancelled"`) {
+		t.Fatalf("get cancelled hunt: unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -350,6 +350,10 @@ func parseSearchParameters(qp url.Values) (p migdbsearch.Parameters, filterFound
 		case "status":
 			p.Status = qp["status"][0]
 		case "target":
+			_, err = mig.ParseTarget(qp["target"][0])
+			if err != nil {
+				panic(fmt.Sprintf("invalid target: %v", err))
+			}
 			p.Target = qp["target"][0]
 		case "threatfamily":
 			p.ThreatFamily = qp["threatfamily"][0]
@@ -113,7 +113,7 @@ func issueKillAction(agent mig.Agent, ctx Context) (err error) {
 	killAction := mig.Action{
 		ID:            mig.GenID(),
 		Name:          fmt.Sprintf("Kill agent %s", agent.Name),
-		Target:        fmt.Sprintf("queueloc='%s'", agent.QueueLoc),
+		Target:        "queueloc:" + mig.QuoteTargetValue(agent.QueueLoc),
 		ValidFrom:     time.Now().Add(-60 * time.Second).UTC(),
 		ExpireAfter:   time.Now().Add(30 * time.Minute).UTC(),
 		SyntaxVersion: 2,
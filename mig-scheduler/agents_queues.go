@@ -172,6 +172,11 @@ func getHeartbeats(msg amqp.Delivery, ctx Context) (err error) {
 				ctx.Channels.DetectDupAgents <- agent.QueueLoc
 			}
 		}
+		// send the hunts that haven't run on the endpoint of the agent yet
+		err = matchHunts(agt, ctx)
+		if err != nil {
+			ctx.Channels.Log <- mig.Log{Desc: fmt.Sprintf("Hunt matching failed with error '%v' for agent '%s'", err, agt.Name)}.Err()
+		}
 	}()
 
 	return
@@ -209,3 +214,160 @@ func startResultsListener(ctx Context) (resultsChan <-chan amqp.Delivery, err er
 
 	return
 }
+
+// startResultChunksListener initializes the routine that receives the chunks of
+// large results from agents
+func startResultChunksListener(ctx Context) (chunksChan <-chan amqp.Delivery, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("startResultChunksListener() -> %v", e)
+		}
+		ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, Desc: "leaving startResultChunksListener()"}.Debug()
+	}()
+
+	_, err = ctx.MQ.Chan.QueueDeclare(mig.Mq_Q_ResultChunks, true, false, false, false, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	err = ctx.MQ.Chan.QueueBind(mig.Mq_Q_ResultChunks, mig.Mq_Q_ResultChunks, mig.Mq_Ex_ToSchedulers, false, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	chunksChan, err = ctx.MQ.Chan.Consume(mig.Mq_Q_ResultChunks, "", true, false, false, false, nil)
+	if err != nil {
+		panic(err)
+	}
+	ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, Desc: "agents result chunks listener initialized"}
+
+	return
+}
+
+// getResultChunk stores a chunk of results received from an agent in the database.
+// When all the chunks of a command have been received, they are reassembled and the
+// JSON of the command is returned, otherwise body is nil.
+func getResultChunk(msg amqp.Delivery, ctx Context) (body []byte, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("getResultChunk() -> %v", e)
+		}
+		ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, Desc: "leaving getResultChunk()"}.Debug()
+	}()
+	var chunk mig.CommandChunk
+	err = json.Unmarshal(msg.Body, &chunk)
+	if err != nil {
+		panic(err)
+	}
+	err = chunk.Validate()
+	if err != nil {
+		panic(err)
+	}
+	count, err := ctx.DB.InsertCommandChunk(chunk)
+	if err != nil {
+		panic(err)
+	}
+	ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, CommandID: chunk.CommandID,
+		Desc: fmt.Sprintf("received results chunk %d, %d of %d chunks stored", chunk.Sequence, count, chunk.Total)}.Debug()
+	if count < chunk.Total {
+		return
+	}
+	chunks, err := ctx.DB.TakeCommandChunks(chunk.CommandID)
+	if err != nil {
+		panic(err)
+	}
+	if len(chunks) == 0 {
+		// the chunks were taken by another scheduler
+		return
+	}
+	cmd, err := mig.CmdFromChunks(chunks)
+	if err != nil {
+		panic(err)
+	}
+	body, err = json.Marshal(cmd)
+	if err != nil {
+		panic(err)
+	}
+	ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, CommandID: cmd.ID, ActionID: cmd.Action.ID,
+		Desc: fmt.Sprintf("reassembled %d bytes of results from %d chunks", len(body), len(chunks))}
+	return
+}
+
+// returnResults writes the results of a command received from an agent in the
+// Returned directory, and publishes them as an event
+func returnResults(body []byte, ctx Context) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("returnResults() -> %v", e)
+		}
+		ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, Desc: "leaving returnResults()"}.Debug()
+	}()
+	// write to disk in Returned directory
+	dest := fmt.Sprintf("%s/%.0f", ctx.Directories.Command.Returned, ctx.OpID)
+	err = safeWrite(ctx, dest, body)
+	if err != nil {
+		panic(fmt.Sprintf("failed to write agent results to disk: %v", err))
+	}
+	// publish an event in the command results queue
+	err = sendEvent(mig.Ev_Q_Cmd_Res, body, ctx)
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+// startProgressListener initializes the routine that receives the progress of
+// running commands from agents
+func startProgressListener(ctx Context) (progressChan <-chan amqp.Delivery, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("startProgressListener() -> %v", e)
+		}
+		ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, Desc: "leaving startProgressListener()"}.Debug()
+	}()
+
+	_, err = ctx.MQ.Chan.QueueDeclare(mig.Mq_Q_Progress, true, false, false, false, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	err = ctx.MQ.Chan.QueueBind(mig.Mq_Q_Progress, mig.Mq_Q_Progress, mig.Mq_Ex_ToSchedulers, false, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	progressChan, err = ctx.MQ.Chan.Consume(mig.Mq_Q_Progress, "", true, false, false, false, nil)
+	if err != nil {
+		panic(err)
+	}
+	ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, Desc: "agents progress listener initialized"}
+
+	return
+}
+
+// getProgress stores the progress of a command received from an agent in the
+// database, and publishes it as an event
+func getProgress(msg amqp.Delivery, ctx Context) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("getProgress() -> %v", e)
+		}
+		ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, Desc: "leaving getProgress()"}.Debug()
+	}()
+	var cp mig.CommandProgress
+	err = json.Unmarshal(msg.Body, &cp)
+	if err != nil {
+		panic(err)
+	}
+	err = ctx.DB.InsertCommandProgress(cp)
+	if err != nil {
+		panic(err)
+	}
+	ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, ActionID: cp.ActionID, CommandID: cp.CommandID,
+		Desc: fmt.Sprintf("received progress of operation %d from agent %s", cp.Operation, cp.Agent.QueueLoc)}.Debug()
+	err = sendEvent(mig.Ev_Q_Cmd_Progress, msg.Body, ctx)
+	if err != nil {
+		panic(err)
+	}
+	return
+}
@@ -31,6 +31,10 @@ func collector(ctx Context) (err error) {
 	if err != nil {
 		panic(err)
 	}
+	err = cancelActions(ctx)
+	if err != nil {
+		panic(err)
+	}
 	err = loadNewActionsFromSpool(ctx)
 	if err != nil {
 		panic(err)
@@ -68,6 +72,55 @@ func loadNewActionsFromDB(ctx Context) (err error) {
 	return
 }
 
+// cancelActions retrieves the actions cancelled by investigators from the database,
+// cancels the commands that are still running and moves the actions to the done spool
+func cancelActions(ctx Context) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("cancelActions() -> %v", e)
+		}
+		ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, Desc: "leaving cancelActions()"}.Debug()
+	}()
+	ids, err := ctx.DB.SetupCancelledActions()
+	if err != nil {
+		panic(err)
+	}
+	for _, id := range ids {
+		a, err := ctx.DB.ActionByID(id)
+		if err != nil {
+			panic(err)
+		}
+		cmds, err := ctx.DB.CancelCommands(a.ID)
+		if err != nil {
+			panic(err)
+		}
+		ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, ActionID: a.ID, Desc: fmt.Sprintf("cancelling %d running commands of action '%s'", len(cmds), a.Name)}
+		if len(cmds) > 0 {
+			for i := range cmds {
+				cmds[i].Action = a
+			}
+			err = cancelCommands(cmds, ctx)
+			if err != nil {
+				panic(err)
+			}
+		}
+		err = cancelAction(ctx, a)
+		if err != nil {
+			panic(err)
+		}
+		// a cancelled action no longer runs on the agents that come online
+		h, err := ctx.DB.HuntByActionID(a.ID)
+		if err == nil && h.IsActive() {
+			err = ctx.DB.CancelHunt(h.ID)
+			if err != nil {
+				panic(err)
+			}
+			ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, ActionID: a.ID, Desc: fmt.Sprintf("hunt %.0f cancelled with its action", h.ID)}
+		}
+	}
+	return
+}
+
 // loadNewActionsFromSpool walks through the new actions spool and loads the actions
 // that are passed their scheduled date. It also deletes expired actions.
 func loadNewActionsFromSpool(ctx Context) (err error) {
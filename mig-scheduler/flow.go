@@ -188,6 +188,34 @@ func landAction(ctx Context, a mig.Action) (err error) {
 	return
 }
 
+// cancelAction moves a cancelled action file to the Done directory, from the
+// directory it was in when it got cancelled
+func cancelAction(ctx Context, a mig.Action) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("cancelAction() -> %v", e)
+		}
+		ctx.Channels.Log <- mig.Log{ActionID: a.ID, Desc: "leaving cancelAction()"}.Debug()
+	}()
+	// move action to done dir
+	jsonA, err := json.Marshal(a)
+	if err != nil {
+		panic(err)
+	}
+	dest := fmt.Sprintf("%s/%.0f.json", ctx.Directories.Action.Done, a.ID)
+	err = safeWrite(ctx, dest, jsonA)
+	if err != nil {
+		panic(err)
+	}
+	// remove the action from its origin
+	for _, dir := range []string{ctx.Directories.Action.New, ctx.Directories.Action.InFlight} {
+		os.Remove(fmt.Sprintf("%s/%.0f.json", dir, a.ID))
+	}
+	desc := fmt.Sprintf("cancelAction(): Action '%s' has been cancelled", a.Name)
+	ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, ActionID: a.ID, Desc: desc}
+	return
+}
+
 // safeWrite performs a two steps write:
 // 1) a temp file is written
 // 2) the temp file is moved into the target folder
@@ -0,0 +1,129 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Julien Vehent jvehent@mozilla.com [:ulfr]
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"mig.ninja/mig"
+	"mig.ninja/mig/modules"
+)
+
+// the commands of an action that was just launched may still be waiting to be
+// inserted in database, so the hunt matcher leaves recent actions alone to avoid
+// sending them twice to the same agent
+const huntSettleTime = 2 * time.Minute
+
+// matchHunts is called with the agent of a heartbeat once it is stored in database.
+// It creates a command for each active hunt that matches the agent and that hasn't
+// run on its endpoint yet, and claims the endpoint so the hunt only runs once on it.
+func matchHunts(agt mig.Agent, ctx Context) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("matchHunts() -> %v", e)
+		}
+		if ctx.Debug.Heartbeats {
+			ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, Desc: "leaving matchHunts()"}.Debug()
+		}
+	}()
+	hunts, err := ctx.DB.HuntsNotRunOnEndpoint(agt.QueueLoc, time.Now().Add(-huntSettleTime))
+	if err != nil {
+		panic(err)
+	}
+	if len(hunts) == 0 {
+		return
+	}
+	// heartbeats don't carry the ID of the agent, retrieve it from the database
+	agent, err := ctx.DB.AgentByQueueAndPID(agt.QueueLoc, agt.PID)
+	if err != nil {
+		panic(err)
+	}
+	for _, h := range hunts {
+		match, err := ctx.DB.AgentMatchesTarget(agent.ID, h.Target)
+		if err != nil {
+			ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, ActionID: h.Action.ID,
+				Desc: fmt.Sprintf("failed to match hunt %.0f against agent '%s': %v", h.ID, agent.Name, err)}.Err()
+			continue
+		}
+		if !match {
+			continue
+		}
+		// the agents of an endpoint may send heartbeats concurrently, only the
+		// first one to claim the endpoint gets a command
+		claimed, err := ctx.DB.ClaimHuntEndpoint(h.ID, agent.QueueLoc)
+		if err != nil {
+			ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, ActionID: h.Action.ID,
+				Desc: fmt.Sprintf("failed to claim hunt %.0f for agent '%s': %v", h.ID, agent.Name, err)}.Err()
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		a, err := ctx.DB.ActionByID(h.Action.ID)
+		if err != nil {
+			panic(err)
+		}
+		emptyResults := make([]modules.Result, len(a.Operations))
+		err = createCommand(ctx, a, agent, emptyResults)
+		if err != nil {
+			ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, ActionID: a.ID,
+				Desc: fmt.Sprintf("failed to create command of hunt %.0f on agent '%s': %v", h.ID, agent.Name, err)}.Err()
+			continue
+		}
+		ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, ActionID: a.ID,
+			Desc: fmt.Sprintf("hunt %.0f matched agent '%s' that came online", h.ID, agent.Name)}
+	}
+	return
+}
+
+// isHunting returns true if an action belongs to a hunt that still runs it on new agents
+func isHunting(ctx Context, aid float64) bool {
+	h, err := ctx.DB.HuntByActionID(aid)
+	return err == nil && h.IsActive()
+}
+
+// stopHunts marks the hunts that have passed their expiration date as expired, and
+// lands the actions of the stopped hunts that have no command left in flight. The
+// other actions land when their last command returns.
+func stopHunts(ctx Context) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("stopHunts() -> %v", e)
+		}
+		ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, Desc: "leaving stopHunts()"}.Debug()
+	}()
+	count, err := ctx.DB.ExpireHunts()
+	if err != nil {
+		panic(err)
+	}
+	if count > 0 {
+		ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, Desc: fmt.Sprintf("%d hunts have expired", count)}
+	}
+	ids, err := ctx.DB.InFlightActionsOfStoppedHunts()
+	if err != nil {
+		panic(err)
+	}
+	for _, id := range ids {
+		a, err := ctx.DB.ActionMetaByID(id)
+		if err != nil {
+			panic(err)
+		}
+		a.Counters, err = ctx.DB.GetActionCounters(a.ID)
+		if err != nil {
+			panic(err)
+		}
+		if a.Counters.Done < a.Counters.Sent {
+			continue
+		}
+		a.LastUpdateTime = time.Now().UTC()
+		err = landAction(ctx, a)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return
+}
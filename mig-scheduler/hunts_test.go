@@ -0,0 +1,184 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"mig.ninja/mig"
+	"mig.ninja/mig/testutil"
+)
+
+// setupHuntTest connects the context to the test database. The agents and hunts
+// of a test carry a tag of their own, so they never match the rows of the tests
+// running concurrently, and the test deletes them by their tag when it ends.
+func setupHuntTest(t *testing.T, ctx *Context) (tag string) {
+	ctx.DB = testutil.OpenTestDB(t)
+	ctx.OpID = mig.GenID()
+	logs := make(chan mig.Log)
+	go func() {
+		for range logs {
+		}
+	}()
+	ctx.Channels.Log = logs
+	ctx.Channels.CommandReady = make(chan mig.Command, 100)
+	return fmt.Sprintf("%.0f", mig.GenID())
+}
+
+// testAgentPID gives each agent of an endpoint its own PID
+var testAgentPID = 1000
+
+// insertTestAgent stores an online agent in the database
+func insertTestAgent(t *testing.T, ctx *Context, queueloc, tag string) mig.Agent {
+	testAgentPID++
+	agt := mig.Agent{
+		Name:        queueloc,
+		QueueLoc:    queueloc,
+		Mode:        "daemon",
+		Version:     "test",
+		PID:         testAgentPID,
+		StartTime:   time.Now().UTC(),
+		HeartBeatTS: time.Now().UTC(),
+		RefreshTS:   time.Now().UTC(),
+		Status:      mig.AgtStatusOnline,
+		Env:         mig.AgentEnv{OS: "linux"},
+		Tags:        map[string]string{"hunttest": tag},
+	}
+	err := ctx.DB.InsertAgent(agt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return agt
+}
+
+// insertTestHunt stores an active hunt whose action started flying before the
+// hunts settle time
+func insertTestHunt(t *testing.T, ctx *Context, target string, started time.Time) mig.Hunt {
+	a := mig.Action{
+		ID:             mig.GenID(),
+		Name:           "hunt test",
+		Target:         target,
+		ValidFrom:      started,
+		ExpireAfter:    time.Now().Add(time.Hour).UTC(),
+		StartTime:      started,
+		FinishTime:     time.Now().Add(time.Hour).UTC(),
+		LastUpdateTime: started,
+		Status:         "inflight",
+		SyntaxVersion:  mig.ActionVersion,
+		Operations:     []mig.Operation{{Module: "file", Parameters: map[string]interface{}{}}},
+	}
+	h := mig.NewHunt(a)
+	err := ctx.DB.InsertHunt(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// readyCommands returns the commands created so far
+func readyCommands(ctx *Context) (cmds []mig.Command) {
+	for {
+		select {
+		case cmd := <-ctx.Channels.CommandReady:
+			cmds = append(cmds, cmd)
+		default:
+			return
+		}
+	}
+}
+
+func TestMatchHunts(t *testing.T) {
+	var ctx Context
+	tag := setupHuntTest(t, &ctx)
+	defer testutil.DeleteTestRows(t, tag)
+	started := time.Now().Add(-2 * huntSettleTime).UTC()
+	h := insertTestHunt(t, &ctx, "os:linux AND tag:hunttest="+tag, started)
+	insertTestHunt(t, &ctx, "os:darwin AND tag:hunttest="+tag, started)
+	recent := insertTestHunt(t, &ctx, "tag:hunttest="+tag, time.Now().UTC())
+
+	queueloc := "linux.hunttest." + tag
+	agt := insertTestAgent(t, &ctx, queueloc, tag)
+	err := matchHunts(agt, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds := readyCommands(&ctx)
+	if len(cmds) != 1 {
+		t.Fatalf("expected a single command, got %d", len(cmds))
+	}
+	if cmds[0].Action.ID != h.Action.ID || cmds[0].Agent.QueueLoc != queueloc {
+		t.Fatalf("unexpected command of action %.0f for agent %s", cmds[0].Action.ID, cmds[0].Agent.QueueLoc)
+	}
+	if recent.Action.ID == cmds[0].Action.ID {
+		t.Fatalf("hunt matched before its action settled")
+	}
+
+	// the hunt runs once per endpoint, whichever agent of the endpoint comes online
+	err = matchHunts(agt, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := insertTestAgent(t, &ctx, queueloc, tag)
+	err = matchHunts(other, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmds = readyCommands(&ctx); len(cmds) != 0 {
+		t.Fatalf("hunt ran %d more times on the same endpoint", len(cmds))
+	}
+
+	// a cancelled hunt does not run on new endpoints
+	err = ctx.DB.CancelHunt(h.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = matchHunts(insertTestAgent(t, &ctx, "linux.hunttest.other."+tag, tag), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmds = readyCommands(&ctx); len(cmds) != 0 {
+		t.Fatalf("cancelled hunt created %d commands", len(cmds))
+	}
+}
+
+func TestMatchHuntsConcurrent(t *testing.T) {
+	var ctx Context
+	tag := setupHuntTest(t, &ctx)
+	defer testutil.DeleteTestRows(t, tag)
+	h := insertTestHunt(t, &ctx, "tag:hunttest="+tag, time.Now().Add(-2*huntSettleTime).UTC())
+
+	// the agents of an endpoint send their heartbeats at the same time
+	queueloc := "linux.hunttest." + tag
+	var agents []mig.Agent
+	for i := 0; i < 10; i++ {
+		agents = append(agents, insertTestAgent(t, &ctx, queueloc, tag))
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, len(agents))
+	for _, agt := range agents {
+		wg.Add(1)
+		go func(agt mig.Agent) {
+			defer wg.Done()
+			errs <- matchHunts(agt, ctx)
+		}(agt)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmds := readyCommands(&ctx)
+	if len(cmds) != 1 {
+		t.Fatalf("expected a single command for the endpoint, got %d", len(cmds))
+	}
+	if cmds[0].Action.ID != h.Action.ID {
+		t.Fatalf("unexpected command of action %.0f", cmds[0].Action.ID)
+	}
+}
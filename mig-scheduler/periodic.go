@@ -49,6 +49,18 @@ func periodic(ctx Context) (err error) {
 	if err != nil {
 		panic(err)
 	}
+	err = cleanResultChunks(ctx)
+	if err != nil {
+		panic(err)
+	}
+	err = cleanCommandsProgress(ctx)
+	if err != nil {
+		panic(err)
+	}
+	err = stopHunts(ctx)
+	if err != nil {
+		panic(err)
+	}
 	return
 }
 
@@ -131,6 +143,48 @@ func markIdleAgents(ctx Context) (err error) {
 	return
 }
 
+// cleanResultChunks deletes the chunks of results that were not completed before
+// the agent timeout
+func cleanResultChunks(ctx Context) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("cleanResultChunks() -> %v", e)
+		}
+		ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, Desc: "leaving cleanResultChunks()"}.Debug()
+	}()
+	timeOutPeriod, err := time.ParseDuration(ctx.Agent.TimeOut)
+	if err != nil {
+		panic(err)
+	}
+	count, err := ctx.DB.DeleteStaleCommandChunks(time.Now().Add(-timeOutPeriod))
+	if err != nil {
+		panic(err)
+	}
+	if count > 0 {
+		ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, Desc: fmt.Sprintf("deleted %d stale results chunks", count)}.Info()
+	}
+	return
+}
+
+// cleanCommandsProgress deletes the progress of the commands that are no longer
+// running
+func cleanCommandsProgress(ctx Context) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("cleanCommandsProgress() -> %v", e)
+		}
+		ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, Desc: "leaving cleanCommandsProgress()"}.Debug()
+	}()
+	count, err := ctx.DB.DeleteFinishedCommandsProgress()
+	if err != nil {
+		panic(err)
+	}
+	if count > 0 {
+		ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, Desc: fmt.Sprintf("deleted %d progress reports of finished commands", count)}.Debug()
+	}
+	return
+}
+
 // save time of last hourly run
 var countNewEndpointsHourly time.Time
 
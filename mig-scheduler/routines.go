@@ -197,23 +197,54 @@ func startRoutines(ctx Context) {
 				continue
 			}
 			// write to disk in Returned directory, discard and continue on failure
-			dest := fmt.Sprintf("%s/%.0f", ctx.Directories.Command.Returned, ctx.OpID)
-			err = safeWrite(ctx, dest, delivery.Body)
+			err = returnResults(delivery.Body, ctx)
 			if err != nil {
-				ctx.Channels.Log <- mig.Log{
-					OpID: ctx.OpID,
-					Desc: fmt.Sprintf("failed to write agent results to disk: %v", err),
-				}.Err()
+				ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, Desc: fmt.Sprintf("%v", err)}.Err()
+			}
+		}
+	}()
+	ctx.Channels.Log <- mig.Log{Desc: "agents results listener routine started"}
+
+	// start a listening channel to receive the chunks of large results from agents
+	agtResultChunksChan, err := startResultChunksListener(ctx)
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		for delivery := range agtResultChunksChan {
+			ctx.OpID = mig.GenID()
+			body, err := getResultChunk(delivery, ctx)
+			if err != nil {
+				ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, Desc: fmt.Sprintf("discarding invalid results chunk: %v", err)}.Err()
 				continue
 			}
-			// publish an event in the command results queue
-			err = sendEvent(mig.Ev_Q_Cmd_Res, delivery.Body, ctx)
+			if body == nil {
+				// more chunks are needed to reassemble the results
+				continue
+			}
+			err = returnResults(body, ctx)
 			if err != nil {
-				panic(err)
+				ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, Desc: fmt.Sprintf("%v", err)}.Err()
 			}
 		}
 	}()
-	ctx.Channels.Log <- mig.Log{Desc: "agents results listener routine started"}
+	ctx.Channels.Log <- mig.Log{Desc: "agents result chunks listener routine started"}
+
+	// start a listening channel to receive the progress of commands from agents
+	progressChan, err := startProgressListener(ctx)
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		for delivery := range progressChan {
+			ctx.OpID = mig.GenID()
+			err := getProgress(delivery, ctx)
+			if err != nil {
+				ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, Desc: fmt.Sprintf("discarding progress message: %v", err)}.Warning()
+			}
+		}
+	}()
+	ctx.Channels.Log <- mig.Log{Desc: "agents progress listener routine started"}
 
 	// launch the routine that regularly walks through the local directories
 	go func() {
@@ -72,6 +72,13 @@ func processNewAction(actionPath string, ctx Context) (err error) {
 	desc := fmt.Sprintf("new action received: Name='%s' Target='%s' ValidFrom='%s' ExpireAfter='%s'",
 		action.Name, action.Target, action.ValidFrom, action.ExpireAfter)
 	ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, ActionID: action.ID, Desc: desc}
+	// the action may have been cancelled while it was waiting in the spool,
+	// the collector moves it to the done spool
+	dba, err := ctx.DB.ActionMetaByID(action.ID)
+	if err == nil && (dba.Status == "cancelling" || dba.Status == "cancelled") {
+		ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, ActionID: action.ID, Desc: fmt.Sprintf("action '%s' is cancelled, not scheduling it", action.Name)}
+		return nil
+	}
 	// TODO: replace with action.Validate(), to include signature verification
 	if time.Now().Before(action.ValidFrom) {
 		// queue new action
@@ -92,8 +99,11 @@ func processNewAction(actionPath string, ctx Context) (err error) {
 	if err != nil {
 		panic(err)
 	}
+	// the action of a hunt keeps flying without target agents, it runs on the
+	// agents that match its target when they come online
+	hunting := isHunting(ctx, action.ID)
 	action.Counters.Sent = len(agents)
-	if action.Counters.Sent == 0 {
+	if action.Counters.Sent == 0 && !hunting {
 		err = fmt.Errorf("No agents found for target '%s'. invalidating action.", action.Target)
 		err = invalidAction(ctx, action, actionPath)
 		if err != nil {
@@ -147,7 +157,7 @@ func processNewAction(actionPath string, ctx Context) (err error) {
 		created++
 	}
 
-	if created == 0 {
+	if created == 0 && !hunting {
 		// no command created found
 		ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, ActionID: action.ID, Desc: "No command created. Invalidating action."}.Err()
 		err = invalidAction(ctx, action, actionPath)
@@ -193,7 +203,8 @@ func sendCommands(cmds []mig.Command, ctx Context) (err error) {
 		}
 		ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, ActionID: aid, Desc: "leaving sendCommands()"}.Debug()
 	}()
-	// store all the commands into the database at once
+	// store all the commands into the database at once, the commands of the
+	// actions cancelled since they were created are stored as cancelled
 	insertCount, err := ctx.DB.InsertCommands(cmds)
 	if err != nil {
 		panic(err)
@@ -201,6 +212,10 @@ func sendCommands(cmds []mig.Command, ctx Context) (err error) {
 	ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, ActionID: aid, Desc: fmt.Sprintf("%d commands inserted into database", insertCount)}
 
 	for _, cmd := range cmds {
+		if cmd.Status == mig.StatusCancelled {
+			ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, ActionID: cmd.Action.ID, CommandID: cmd.ID, Desc: "action was cancelled, not sending command"}
+			continue
+		}
 		data, err := json.Marshal(cmd)
 		if err != nil {
 			panic(err)
@@ -234,6 +249,52 @@ func sendCommands(cmds []mig.Command, ctx Context) (err error) {
 	return
 }
 
+// cancelCommands is called with the commands of a cancelled action that were
+// still running. It removes them from the inflight spool, so they do not expire,
+// and sends them back to their agents with a cancelled status, so the agents
+// stop the modules that run them.
+func cancelCommands(cmds []mig.Command, ctx Context) (err error) {
+	aid := cmds[0].Action.ID
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("cancelCommands() -> %v", e)
+		}
+		ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, ActionID: aid, Desc: "leaving cancelCommands()"}.Debug()
+	}()
+	for _, cmd := range cmds {
+		inflightPath := fmt.Sprintf("%s/%.0f-%.0f.json", ctx.Directories.Command.InFlight, cmd.Action.ID, cmd.ID)
+		os.Remove(inflightPath)
+
+		// the agent has nothing left to stop once the action has expired
+		expire := cmd.Action.ExpireAfter.Sub(time.Now())
+		if expire <= 0 {
+			continue
+		}
+		data, err := json.Marshal(cmd)
+		if err != nil {
+			panic(err)
+		}
+		msg := amqp.Publishing{
+			DeliveryMode: amqp.Persistent,
+			Timestamp:    time.Now(),
+			ContentType:  "text/plain",
+			Expiration:   fmt.Sprintf("%d", int64(expire/time.Millisecond)),
+			Body:         []byte(data),
+		}
+		agtQueue := fmt.Sprintf("mig.agt.%s", cmd.Agent.QueueLoc)
+		go func(cmd mig.Command) {
+			err := ctx.MQ.Chan.Publish(mig.Mq_Ex_ToAgents, agtQueue, true, false, msg)
+			if err != nil {
+				ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, ActionID: cmd.Action.ID, CommandID: cmd.ID, Desc: "publishing cancellation failed to queue" + agtQueue}.Err()
+			} else {
+				desc := fmt.Sprintf("cancellation published to queue %s", agtQueue)
+				ctx.Channels.Log <- mig.Log{OpID: ctx.OpID, ActionID: cmd.Action.ID, CommandID: cmd.ID, Desc: desc}
+			}
+		}(cmd)
+	}
+	return
+}
+
 // returnCommands is called when commands have returned
 // it stores the result of a command and mark it as completed/failed and then
 // send a message to the Action completion routine to update the action status
@@ -312,8 +373,10 @@ func updateAction(cmds []mig.Command, ctx Context) (err error) {
 		if err != nil {
 			panic(err)
 		}
-		// Has the action completed?
-		if a.Counters.Done == a.Counters.Sent {
+		// Has the action completed? a cancelled action has already landed, but
+		// its commands may still return partial results, and the action of an
+		// active hunt waits for more agents to come online
+		if a.Counters.Done == a.Counters.Sent && a.Status != "cancelled" && !isHunting(ctx, a.ID) {
 			err = landAction(ctx, a)
 			if err != nil {
 				panic(err)
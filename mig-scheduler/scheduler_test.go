@@ -0,0 +1,71 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"mig.ninja/mig"
+	"mig.ninja/mig/testutil"
+)
+
+// TestSendCommandsOfCancelledAction sends the commands created for an action
+// before it was cancelled, which are stored as cancelled and not sent
+func TestSendCommandsOfCancelledAction(t *testing.T) {
+	var ctx Context
+	tag := setupHuntTest(t, &ctx)
+	defer testutil.DeleteTestRows(t, tag)
+	a := mig.Action{
+		ID:             mig.GenID(),
+		Name:           "cancel test",
+		Target:         "tag:hunttest=" + tag,
+		ValidFrom:      time.Now().UTC(),
+		ExpireAfter:    time.Now().Add(time.Hour).UTC(),
+		StartTime:      time.Now().UTC(),
+		FinishTime:     time.Now().Add(time.Hour).UTC(),
+		LastUpdateTime: time.Now().UTC(),
+		Status:         "inflight",
+		SyntaxVersion:  mig.ActionVersion,
+		Operations:     []mig.Operation{{Module: "file", Parameters: map[string]interface{}{}}},
+	}
+	_, err := ctx.DB.InsertOrUpdateAction(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cmds []mig.Command
+	for _, queueloc := range []string{"linux.canceltest.1." + tag, "linux.canceltest.2." + tag} {
+		cmds = append(cmds, mig.Command{
+			ID:        mig.GenID(),
+			Action:    a,
+			Agent:     insertTestAgent(t, &ctx, queueloc, tag),
+			Status:    mig.StatusSent,
+			StartTime: time.Now().UTC(),
+		})
+	}
+	err = ctx.DB.CancelAction(a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the context has no spool nor relay, sending a command would fail
+	err = sendCommands(cmds, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counters, err := ctx.DB.GetActionCounters(a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counters.Cancelled != len(cmds) || counters.InFlight != 0 {
+		t.Fatalf("expected %d cancelled commands, got %+v", len(cmds), counters)
+	}
+	running, err := ctx.DB.CancelCommands(a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(running) != 0 {
+		t.Fatalf("expected no running command to cancel, got %d", len(running))
+	}
+}
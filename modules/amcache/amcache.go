@@ -0,0 +1,425 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+/*
+
+If you run it, it will return a JSON struct with array of execution records
+found in the Amcache.hve hive and in the AppCompatCache (ShimCache) value of
+the SYSTEM hive. If you add flag `-p`, it will pretty print the results.
+
+Both hives are parsed offline. On a live system they are locked by the
+kernel, and are read from the raw NTFS volume instead, as last flushed to
+disk. `amcachepath` and `systempath` can also be pointed to a volume shadow
+copy or to copies extracted from an image.
+
+Example JSON
+-------------
+
+{
+    "module": "amcache",
+    "parameters": {
+        "searchexe": [
+            "explerer.exe"
+        ],
+        "searchsha1": [
+            "7c4a8d09ca3762af61e59520943dc26494f8941b"
+        ],
+        "sources": [
+            "amcache",
+            "shimcache"
+        ]
+    }
+}
+*/
+package amcache /* import "mig.ninja/mig/modules/amcache" */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mig.ninja/mig/modules"
+	"mig.ninja/mig/modules/ntfs"
+	"mig.ninja/mig/modules/registry"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+/*
+	An instance of this type will represent this module; it's possible to add additional data fields here,
+	although that is rarely needed.
+*/
+type module struct {
+}
+
+func (m *module) NewRun() modules.Runner {
+	return new(run)
+}
+
+/*
+	init is called by the Go runtime at startup. We use this function to register the module in a
+	global array of available modules, so the agent knows we exist
+*/
+func init() {
+	modules.Register("amcache", new(module))
+}
+
+type run struct {
+	Parameters params
+	Results    modules.Result
+	stop       chan bool      // closed when the module is asked to stop early
+	raw        *ntfs.RawFiles // reads the locked hives from their volume
+}
+
+// sources of execution records
+const (
+	SourceAmcache   = "amcache"
+	SourceShimCache = "shimcache"
+)
+
+/*
+	- SearchExe: Array of executable file names or paths to search for
+	- SearchSHA1: Array of SHA1 hashes to search for, only known by the Amcache
+	- Sources: Sources of execution records to search, amcache and shimcache.
+			   Defaults to both.
+	- AmcachePath: Alternate Amcache.hve, e.g. extracted from a disk image.
+				   Defaults to %SYSTEMROOT%\AppCompat\Programs\Amcache.hve
+	- SystemPath: Alternate SYSTEM hive holding the AppCompatCache.
+				  Defaults to %SYSTEMROOT%\System32\config\SYSTEM
+	- Debug: Enable debug print statements
+*/
+type params struct {
+	SearchExe   []string `json:"searchexe,omitempty"`
+	SearchSHA1  []string `json:"searchsha1,omitempty"`
+	Sources     []string `json:"sources,omitempty"`
+	AmcachePath string   `json:"amcachepath,omitempty"`
+	SystemPath  string   `json:"systempath,omitempty"`
+	Debug       bool     `json:"debug,omitempty"`
+}
+
+/*
+	ExecRecord is a file known to have been present, and usually executed,
+	on the system:
+	- Source: amcache or shimcache
+	- Path, Name: full path and file name of the executable
+	- SHA1: hash of the file, without the zeros prefixed by the Amcache
+	- LastWrite: last write time of the Amcache key, when the file was first seen
+	- Installed: install date of the program the file belongs to
+	- Created, Modified: times of the file as recorded by the Amcache or ShimCache
+	- LinkDate: compilation time of the executable
+	- Executed: execution flag of the ShimCache, only known on Windows 7 and 8
+	- Position: position in the ShimCache, 1 being the most recent entry
+*/
+type ExecRecord struct {
+	Source    string                 `json:"source"`
+	Path      string                 `json:"path,omitempty"`
+	Name      string                 `json:"name,omitempty"`
+	SHA1      string                 `json:"sha1,omitempty"`
+	Size      int64                  `json:"size,omitempty"`
+	Publisher string                 `json:"publisher,omitempty"`
+	Product   string                 `json:"product,omitempty"`
+	Version   string                 `json:"version,omitempty"`
+	ProgramID string                 `json:"programid,omitempty"`
+	LastWrite time.Time              `json:"lastwrite,omitempty"`
+	Installed time.Time              `json:"installed,omitempty"`
+	Created   time.Time              `json:"created,omitempty"`
+	Modified  time.Time              `json:"modified,omitempty"`
+	LinkDate  time.Time              `json:"linkdate,omitempty"`
+	Executed  *bool                  `json:"executed,omitempty"`
+	Position  int                    `json:"position,omitempty"`
+	Times     []modules.ArtefactTime `json:"times,omitempty"`
+}
+
+type elements struct {
+	Records []ExecRecord `json:"amcacheresults,omitempty"`
+}
+
+/* Statistic counters:
+- AmcacheEntries is the number of files listed in the Amcache
+- ShimCacheEntries is the number of entries of the ShimCache
+- TotalHits is the total number of records matching the search
+- Exectime is the total runtime of all the searches
+*/
+type statistics struct {
+	AmcacheEntries   int           `json:"amcacheentries"`
+	ShimCacheEntries int           `json:"shimcacheentries"`
+	TotalHits        int           `json:"totalhits"`
+	Exectime         time.Duration `json:"exectime"`
+}
+
+var sha1Regexp = regexp.MustCompile(`^[0-9a-fA-F]{40}$`)
+
+/*
+	ValidateParameters *must* be implemented by a module. It provides a method to verify that the parameters
+	passed to the module conform the expected format. It must return an error if the parameters do not validate.
+*/
+func (r *run) ValidateParameters() (err error) {
+	if len(nonEmpty(r.Parameters.SearchExe)) == 0 && len(nonEmpty(r.Parameters.SearchSHA1)) == 0 {
+		return fmt.Errorf("ValidateParameters: At least one of SearchExe or SearchSHA1 must be set.")
+	}
+	for _, h := range r.Parameters.SearchSHA1 {
+		if !sha1Regexp.MatchString(h) {
+			return fmt.Errorf("ValidateParameters: %q is not a SHA1 hash.", h)
+		}
+	}
+	for _, s := range r.Parameters.Sources {
+		if s != SourceAmcache && s != SourceShimCache {
+			return fmt.Errorf("ValidateParameters: Unknown source %q, use amcache or shimcache.", s)
+		}
+	}
+	return
+}
+
+/*
+	Run *must* be implemented by a module. Its the function that executes the module. It must return a string of
+	marshalled json that contains the results from the module. The code below provides a base module skeleton that
+	can be reused in all modules.
+*/
+func (r *run) Run(in io.Reader) (out string) {
+	// a good way to handle execution failures is to catch panics and store
+	// the panicked error into modules.Results.Errors, marshal that, and output
+	// the JSON string back to the caller
+	defer func() {
+		if e := recover(); e != nil {
+			r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%v", e))
+			r.Results.Success = false
+			buf, _ := json.Marshal(r.Results)
+			out = string(buf[:])
+		}
+	}()
+
+	// read module parameters from stdin
+	err := modules.ReadInputParameters(in, &r.Parameters)
+	if err != nil {
+		panic(err)
+	}
+	// verify that the parameters we received are valid
+	err = r.ValidateParameters()
+	if err != nil {
+		panic(err)
+	}
+
+	// start a goroutine that does some work and another one that looks
+	// for an early stop signal
+	moduleDone := make(chan bool)
+	stop := make(chan bool)
+	r.stop = make(chan bool)
+	go r.doModuleStuff(&out, &moduleDone)
+	go modules.WatchForStop(in, &stop)
+
+	select {
+	case <-moduleDone:
+		return out
+	case <-stop:
+		// the module builds its results from what it collected so far
+		close(r.stop)
+		<-moduleDone
+		return out
+	}
+}
+
+/* doModuleStuff is an internal module function that does things specific to the module. There is no implementation requirement.
+   It's good practice to have it return the JSON string Run() expects to return. We also make it return a boolean in the `moduleDone`
+   channel to do flow control in Run().
+*/
+func (r *run) doModuleStuff(out *string, moduleDone *chan bool) error {
+	var (
+		el    elements
+		stats statistics
+		all   []ExecRecord
+	)
+	t0 := time.Now()
+
+	if r.raw == nil {
+		r.raw = new(ntfs.RawFiles)
+	}
+	defer r.raw.Close()
+	sources := r.Parameters.Sources
+	if len(sources) == 0 {
+		sources = []string{SourceAmcache, SourceShimCache}
+	}
+	for _, source := range sources {
+		if modules.IsStopped(r.stop) {
+			r.Results.Errors = append(r.Results.Errors, modules.StoppedEarly)
+			break
+		}
+		path, err := r.hivePath(source)
+		if err != nil {
+			r.Results.Errors = append(r.Results.Errors, err.Error())
+			continue
+		}
+		if r.Parameters.Debug {
+			fmt.Println("Processing ", path, "....")
+		}
+		// hives of the running system are locked, and read from their
+		// volume, so failing to read one is not fatal
+		hive, err := registry.OpenHive(path, strings.ToUpper(filepath.Base(path)), r.raw)
+		if err != nil {
+			r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%s: %v", path, err))
+			continue
+		}
+		var recs []ExecRecord
+		if source == SourceAmcache {
+			recs, err = parseAmcache(hive)
+			stats.AmcacheEntries += len(recs)
+		} else {
+			recs, err = parseShimCache(hive)
+			stats.ShimCacheEntries += len(recs)
+		}
+		if err != nil {
+			r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%s: %v", path, err))
+		}
+		all = append(all, recs...)
+	}
+
+	m := newMatcher(r.Parameters)
+	for _, rec := range all {
+		if m.match(rec) {
+			el.Records = append(el.Records, rec)
+			stats.TotalHits++
+		}
+	}
+	stats.Exectime = time.Now().Sub(t0)
+
+	// marshal the results into a json string
+	*out = r.buildResults(el, stats)
+	*moduleDone <- true
+	return nil
+}
+
+// hivePath returns the path of the hive holding a source of records
+func (r *run) hivePath(source string) (string, error) {
+	path := r.Parameters.AmcachePath
+	loc := []string{"AppCompat", "Programs", "Amcache.hve"}
+	if source == SourceShimCache {
+		path = r.Parameters.SystemPath
+		loc = []string{"System32", "config", "SYSTEM"}
+	}
+	if path != "" {
+		return path, nil
+	}
+	if runtime.GOOS != "windows" {
+		return "", fmt.Errorf("%s can only be searched on Windows, unless the path of its hive is set.", source)
+	}
+	sysRoot := os.Getenv("SYSTEMROOT")
+	if sysRoot == "" {
+		sysRoot = "C:\\Windows"
+	}
+	return filepath.Join(append([]string{sysRoot}, loc...)...), nil
+}
+
+// matcher holds the normalized search parameters
+type matcher struct {
+	exes   []string
+	hashes []string
+}
+
+func newMatcher(p params) (m matcher) {
+	m.exes = lowerAll(nonEmpty(p.SearchExe))
+	m.hashes = lowerAll(nonEmpty(p.SearchSHA1))
+	return
+}
+
+// match returns true if the name or path of the record contains one of
+// the executables searched for, or if its hash is one of the hashes
+func (m matcher) match(rec ExecRecord) bool {
+	path := strings.ToLower(rec.Path)
+	name := strings.ToLower(rec.Name)
+	for _, exe := range m.exes {
+		if strings.Contains(name, exe) || strings.Contains(path, exe) {
+			return true
+		}
+	}
+	for _, h := range m.hashes {
+		if rec.SHA1 == h {
+			return true
+		}
+	}
+	return false
+}
+
+func nonEmpty(list []string) (out []string) {
+	for _, s := range list {
+		if s != "" {
+			out = append(out, s)
+		}
+	}
+	return
+}
+
+func lowerAll(list []string) []string {
+	out := make([]string, len(list))
+	for i, s := range list {
+		out[i] = strings.ToLower(s)
+	}
+	return out
+}
+
+// buildResults takes the results found by the module, as well as statistics,
+// and puts all that into a JSON string. It also takes care of setting the
+// success and foundanything flags.
+func (r *run) buildResults(el elements, stats statistics) string {
+	if len(r.Results.Errors) == 0 {
+		r.Results.Success = true
+	}
+	r.Results.Elements = el
+	r.Results.Statistics = stats
+	if stats.TotalHits > 0 {
+		r.Results.FoundAnything = true
+	}
+	jsonOutput, err := json.Marshal(r.Results)
+	if err != nil {
+		panic(err)
+	}
+	return string(jsonOutput[:])
+}
+
+// PrintResults() is an *optional* method that returns results in a human-readable format.
+// if matchOnly is set, only results that have at least one match are returned.
+// If matchOnly is not set, all results are returned, along with errors and statistics.
+func (r *run) PrintResults(result modules.Result, matchOnly bool) (prints []string, err error) {
+	var (
+		el    elements
+		stats statistics
+	)
+	err = result.GetElements(&el)
+	if err != nil {
+		panic(err)
+	}
+	prints = append(prints, fmt.Sprintf("\n-----------------\n     Amcache Results           \n------------------"))
+	for _, rec := range el.Records {
+		switch rec.Source {
+		case SourceShimCache:
+			executed := "unknown"
+			if rec.Executed != nil {
+				executed = fmt.Sprintf("%t", *rec.Executed)
+			}
+			prints = append(prints, fmt.Sprintf("ShimCache: %s, Position: %d, Modified: %s, Executed: %s",
+				rec.Path, rec.Position, rec.Modified.Format(time.RFC3339), executed))
+		default:
+			prints = append(prints, fmt.Sprintf("Amcache: %s, SHA1: %s, First Seen: %s", rec.Path, rec.SHA1,
+				rec.LastWrite.Format(time.RFC3339)))
+			if !rec.Installed.IsZero() {
+				prints = append(prints, fmt.Sprintf("    Installed: %s, Program: %s", rec.Installed.Format(time.RFC3339), rec.ProgramID))
+			}
+		}
+	}
+
+	for _, e := range result.Errors {
+		prints = append(prints, fmt.Sprintf("error: %v", e))
+	}
+	err = result.GetStatistics(&stats)
+	if err != nil {
+		panic(err)
+	}
+	prints = append(prints, fmt.Sprintf("Amcache Entries  : %d", stats.AmcacheEntries))
+	prints = append(prints, fmt.Sprintf("ShimCache Entries: %d", stats.ShimCacheEntries))
+	prints = append(prints, fmt.Sprintf("Total Hits       : %d", stats.TotalHits))
+	return
+}
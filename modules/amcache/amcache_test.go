@@ -0,0 +1,446 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package amcache /* import "mig.ninja/mig/modules/amcache" */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"mig.ninja/mig/modules"
+	"mig.ninja/mig/modules/ntfs"
+	"mig.ninja/mig/modules/registry"
+	"mig.ninja/mig/testutil"
+)
+
+func TestRegistration(t *testing.T) {
+	testutil.CheckModuleRegistration(t, "amcache")
+}
+
+var (
+	testSeenTime     = time.Date(2016, 9, 1, 10, 20, 30, 0, time.UTC)
+	testInstallTime  = time.Date(2016, 8, 30, 8, 0, 0, 0, time.UTC)
+	testModifiedTime = time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)
+	testSHA1         = "7c4a8d09ca3762af61e59520943dc26494f8941b"
+)
+
+func sz(name, s string) testutil.HiveValue {
+	return testutil.HiveValue{Name: name, Type: registry.RegSz, Data: testutil.EncodeUTF16z(s)}
+}
+
+func qword(name string, v uint64) testutil.HiveValue {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return testutil.HiveValue{Name: name, Type: registry.RegQword, Data: b}
+}
+
+// testAmcacheHive returns the description of a Windows 10 Amcache hive,
+// with an installed program and a file dropped in a user profile
+func testAmcacheHive() *testutil.HiveKey {
+	return &testutil.HiveKey{Name: "{11517B7C-E79D-4E20-961B-75A811715ADD}", LastWrite: testSeenTime, Subkeys: []*testutil.HiveKey{
+		{Name: "Root", LastWrite: testSeenTime, Subkeys: []*testutil.HiveKey{
+			{Name: "InventoryApplication", LastWrite: testSeenTime, Subkeys: []*testutil.HiveKey{
+				{Name: "0000f519feec486de87ed73cb92d3cac802400000000", LastWrite: testInstallTime, Values: []testutil.HiveValue{
+					sz("Name", "Explerer"),
+					sz("InstallDate", testInstallTime.Format(inventoryDate)),
+				}},
+			}},
+			{Name: "InventoryApplicationFile", LastWrite: testSeenTime, Subkeys: []*testutil.HiveKey{
+				{Name: "explerer.exe|2d2b4dc9e5e1a8f5", LastWrite: testSeenTime, Values: []testutil.HiveValue{
+					sz("LowerCaseLongPath", `c:\users\public\explerer.exe`),
+					sz("Name", "explerer.exe"),
+					sz("FileId", "0000"+testSHA1),
+					sz("Publisher", "explerer corp"),
+					qword("Size", 73728),
+					sz("LinkDate", "07/14/2016 01:02:03"),
+					sz("ProgramId", "0000f519feec486de87ed73cb92d3cac802400000000"),
+				}},
+				{Name: "notepad.exe|8d3ea6b8e1d4f4a2", LastWrite: testInstallTime, Values: []testutil.HiveValue{
+					sz("LowerCaseLongPath", `c:\windows\system32\notepad.exe`),
+					sz("FileId", "0000f1d2d2f924e986ac86fdf7b36c94bcdf32beec15"),
+				}},
+			}},
+		}},
+	}}
+}
+
+// testLegacyAmcacheHive returns the description of a Windows 7 Amcache hive
+func testLegacyAmcacheHive() *testutil.HiveKey {
+	return &testutil.HiveKey{Name: "{11517B7C-E79D-4E20-961B-75A811715ADD}", LastWrite: testSeenTime, Subkeys: []*testutil.HiveKey{
+		{Name: "Root", LastWrite: testSeenTime, Subkeys: []*testutil.HiveKey{
+			{Name: "File", LastWrite: testSeenTime, Subkeys: []*testutil.HiveKey{
+				{Name: "{4c7ea5a5-8e2a-11e6-9bdd-806e6f6e6963}", LastWrite: testSeenTime, Subkeys: []*testutil.HiveKey{
+					{Name: "10000002a1b", LastWrite: testSeenTime, Values: []testutil.HiveValue{
+						sz(filePath, `C:\Users\Public\explerer.exe`),
+						sz(fileSHA1, "0000"+testSHA1),
+						qword(fileSize, 73728),
+						qword(fileModified, testutil.Filetime(testModifiedTime)),
+						qword(fileCreated, testutil.Filetime(testModifiedTime.Add(-time.Hour))),
+					}},
+				}},
+			}},
+		}},
+	}}
+}
+
+// testSystemHive returns the description of a SYSTEM hive whose current
+// control set holds an AppCompatCache value
+func testSystemHive(cache []byte) *testutil.HiveKey {
+	current := []byte{2, 0, 0, 0}
+	return &testutil.HiveKey{Name: "ROOT", LastWrite: testSeenTime, Subkeys: []*testutil.HiveKey{
+		{Name: "ControlSet001", LastWrite: testSeenTime},
+		{Name: "ControlSet002", LastWrite: testSeenTime, Subkeys: []*testutil.HiveKey{
+			{Name: "Control", LastWrite: testSeenTime, Subkeys: []*testutil.HiveKey{
+				{Name: "Session Manager", LastWrite: testSeenTime, Subkeys: []*testutil.HiveKey{
+					{Name: "AppCompatCache", LastWrite: testSeenTime, Values: []testutil.HiveValue{
+						{Name: "AppCompatCache", Type: registry.RegBinary, Data: cache},
+					}},
+				}},
+			}},
+		}},
+		{Name: "Select", LastWrite: testSeenTime, Values: []testutil.HiveValue{
+			{Name: "Current", Type: registry.RegDword, Data: current},
+		}},
+	}}
+}
+
+func TestParseAmcache(t *testing.T) {
+	hive, err := registry.ParseHive(testutil.BuildHive(testAmcacheHive()), "AMCACHE.HVE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs, err := parseAmcache(hive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(recs))
+	}
+	rec := recs[0]
+	if rec.Source != SourceAmcache || rec.Path != `c:\users\public\explerer.exe` || rec.Name != "explerer.exe" ||
+		rec.SHA1 != testSHA1 || rec.Size != 73728 || rec.Publisher != "explerer corp" ||
+		!rec.LastWrite.Equal(testSeenTime) || !rec.Installed.Equal(testInstallTime) ||
+		!rec.LinkDate.Equal(time.Date(2016, 7, 14, 1, 2, 3, 0, time.UTC)) {
+		t.Fatalf("unexpected record %+v", rec)
+	}
+	if len(rec.Times) != 2 || rec.Times[1].Kind != modules.ArtefactTimeInstalled {
+		t.Fatalf("unexpected times %+v", rec.Times)
+	}
+	// files without a name are named after their path
+	if recs[1].Name != "notepad.exe" || !recs[1].Installed.IsZero() {
+		t.Fatalf("unexpected record %+v", recs[1])
+	}
+
+	hive, err = registry.ParseHive(testutil.BuildHive(testLegacyAmcacheHive()), "AMCACHE.HVE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs, err = parseAmcache(hive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].Name != "explerer.exe" || recs[0].SHA1 != testSHA1 ||
+		!recs[0].Modified.Equal(testModifiedTime) || !recs[0].Created.Equal(testModifiedTime.Add(-time.Hour)) ||
+		len(recs[0].Times) != 3 {
+		t.Fatalf("unexpected legacy records %+v", recs)
+	}
+
+	hive, err = registry.ParseHive(testutil.BuildHive(testSystemHive(nil)), "SYSTEM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = parseAmcache(hive); err == nil {
+		t.Fatal("expected error on hive without inventory")
+	}
+}
+
+// testShimPaths are the paths of the test ShimCache, most recent first
+var testShimPaths = []string{`C:\Users\Public\explerer.exe`, `C:\Windows\System32\svchost.exe`}
+
+// buildShimCache generates an AppCompatCache value in the format of a
+// version of Windows: "7", "7x86", "8.0", "8.1" or "10"
+func buildShimCache(version string) []byte {
+	var buf []byte
+	switch version {
+	case "7", "7x86":
+		entrySize := shimWin7EntrySize
+		if version == "7x86" {
+			entrySize = shimWin7x86Entry
+		}
+		buf = make([]byte, shimWin8HeaderSize+len(testShimPaths)*entrySize)
+		binary.LittleEndian.PutUint32(buf, shimWin7Magic)
+		binary.LittleEndian.PutUint32(buf[4:], uint32(len(testShimPaths)))
+		for i, p := range testShimPaths {
+			e := buf[shimWin8HeaderSize+i*entrySize:]
+			path := testutil.EncodeUTF16(p)
+			binary.LittleEndian.PutUint16(e, uint16(len(path)))
+			binary.LittleEndian.PutUint16(e[2:], uint16(len(path)+2))
+			flags := uint32(0)
+			if i == 0 {
+				flags = shimExecutedFlag
+			}
+			if entrySize == shimWin7EntrySize {
+				binary.LittleEndian.PutUint64(e[8:], uint64(len(buf)))
+				binary.LittleEndian.PutUint64(e[16:], testutil.Filetime(testModifiedTime))
+				binary.LittleEndian.PutUint32(e[24:], flags)
+			} else {
+				binary.LittleEndian.PutUint32(e[4:], uint32(len(buf)))
+				binary.LittleEndian.PutUint64(e[8:], testutil.Filetime(testModifiedTime))
+				binary.LittleEndian.PutUint32(e[16:], flags)
+			}
+			buf = append(buf, append(path, 0, 0)...)
+		}
+	default:
+		header, sig := 0x34, "10ts"
+		if version == "8.0" || version == "8.1" {
+			header = shimWin8HeaderSize
+			if version == "8.0" {
+				sig = "00ts"
+			}
+		}
+		buf = make([]byte, header)
+		binary.LittleEndian.PutUint32(buf, uint32(header))
+		for i, p := range testShimPaths {
+			path := testutil.EncodeUTF16(p)
+			var entry []byte
+			entry = testutil.AppendUint16(entry, uint16(len(path)))
+			entry = append(entry, path...)
+			if header == shimWin8HeaderSize {
+				// entries of 8.0 have an empty package name
+				var pkg []byte
+				if version == "8.1" {
+					pkg = testutil.EncodeUTF16("Microsoft.Explerer")
+				}
+				entry = testutil.AppendUint16(entry, uint16(len(pkg)))
+				entry = append(entry, pkg...)
+				flags := uint32(0)
+				if i == 0 {
+					flags = shimExecutedFlag
+				}
+				entry = testutil.AppendUint32(entry, flags)
+				entry = testutil.AppendUint32(entry, 0)
+			}
+			entry = testutil.AppendUint64(entry, testutil.Filetime(testModifiedTime))
+			entry = testutil.AppendUint32(entry, 4)
+			entry = append(entry, "data"...)
+			buf = append(buf, sig...)
+			buf = testutil.AppendUint32(buf, 0)
+			buf = testutil.AppendUint32(buf, uint32(len(entry)))
+			buf = append(buf, entry...)
+		}
+	}
+	return buf
+}
+
+func TestParseAppCompatCache(t *testing.T) {
+	for _, version := range []string{"7", "7x86", "8.0", "8.1", "10"} {
+		recs, err := parseAppCompatCache(buildShimCache(version))
+		if err != nil {
+			t.Fatalf("version %s: %v", version, err)
+		}
+		if len(recs) != len(testShimPaths) {
+			t.Fatalf("version %s: expected %d records, got %d", version, len(testShimPaths), len(recs))
+		}
+		for i, rec := range recs {
+			if rec.Source != SourceShimCache || rec.Path != testShimPaths[i] || rec.Position != i+1 ||
+				!rec.Modified.Equal(testModifiedTime) || len(rec.Times) != 1 {
+				t.Fatalf("version %s: unexpected record %+v", version, rec)
+			}
+			if version == "10" {
+				if rec.Executed != nil {
+					t.Fatalf("version %s: unexpected execution flag", version)
+				}
+				continue
+			}
+			if rec.Executed == nil || *rec.Executed != (i == 0) {
+				t.Fatalf("version %s: unexpected execution flag of %s", version, rec.Path)
+			}
+		}
+		if recs[0].Name != "explerer.exe" {
+			t.Fatalf("version %s: unexpected name %q", version, recs[0].Name)
+		}
+	}
+
+	buf := buildShimCache("10")
+	if _, err := parseAppCompatCache(buf[:len(buf)-10]); err == nil {
+		t.Fatal("expected error on truncated cache")
+	}
+	if _, err := parseAppCompatCache([]byte{0xef, 0xbe, 0xad, 0xde}); err == nil {
+		t.Fatal("expected error on unknown cache format")
+	}
+}
+
+// TestParseRealAppCompatCache decodes the caches of real systems, and checks
+// the first entries of Windows 8 and 10 against the output of regparser
+func TestParseRealAppCompatCache(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		count    int
+		executed bool
+	}{
+		{"win7x86", 91, true},
+		{"win7x64", 304, true},
+		{"Win80", 104, true},
+		{"Win81", 1024, true},
+		{"Win10", 350, false},
+		{"Win10Creators", 506, false},
+	} {
+		buf, err := ioutil.ReadFile(filepath.Join("testdata", tc.name+".bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs, err := parseAppCompatCache(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if len(recs) != tc.count {
+			t.Fatalf("%s: expected %d records, got %d", tc.name, tc.count, len(recs))
+		}
+		if (recs[0].Executed != nil) != tc.executed {
+			t.Fatalf("%s: unexpected execution flag %v", tc.name, recs[0].Executed)
+		}
+		golden, err := ioutil.ReadFile(filepath.Join("testdata", tc.name+".golden.json"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected []struct {
+			Name  string `json:"name"`
+			Epoch int64  `json:"epoch"`
+		}
+		err = json.Unmarshal(golden, &expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, e := range expected {
+			if recs[i].Path != e.Name || recs[i].Modified.Unix() != e.Epoch {
+				t.Fatalf("%s: expected entry %d to be %s at %d, got %s at %d",
+					tc.name, i+1, e.Name, e.Epoch, recs[i].Path, recs[i].Modified.Unix())
+			}
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migamcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	amcache := filepath.Join(dir, "Amcache.hve")
+	system := filepath.Join(dir, "SYSTEM")
+	err = ioutil.WriteFile(amcache, testutil.BuildHive(testAmcacheHive()), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(system, testutil.BuildHive(testSystemHive(buildShimCache("7"))), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		p        params
+		expected []string
+	}{
+		{params{SearchExe: []string{"EXPLERER"}}, []string{SourceAmcache, SourceShimCache}},
+		{params{SearchExe: []string{`system32\`}}, []string{SourceAmcache, SourceShimCache}},
+		{params{SearchSHA1: []string{"7C4A8D09CA3762AF61E59520943DC26494F8941B"}}, []string{SourceAmcache}},
+		{params{SearchExe: []string{"explerer"}, Sources: []string{SourceShimCache}}, []string{SourceShimCache}},
+		{params{SearchExe: []string{"notthere.exe"}}, nil},
+	} {
+		var r run
+		r.Parameters = tc.p
+		r.Parameters.AmcachePath = amcache
+		r.Parameters.SystemPath = system
+		msg, err := modules.MakeMessage(modules.MsgClassParameters, r.Parameters, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res modules.Result
+		err = json.Unmarshal([]byte(r.Run(bytes.NewBuffer(msg))), &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Errors) > 0 {
+			t.Fatalf("%+v: unexpected errors %v", tc.p, res.Errors)
+		}
+		var el elements
+		err = res.GetElements(&el)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(el.Records) != len(tc.expected) || res.FoundAnything != (len(tc.expected) > 0) {
+			t.Fatalf("%+v: expected %d records, got %+v", tc.p, len(tc.expected), el.Records)
+		}
+		for i, rec := range el.Records {
+			if rec.Source != tc.expected[i] {
+				t.Fatalf("%+v: unexpected record %+v", tc.p, rec)
+			}
+		}
+	}
+
+	var r run
+	r.Parameters.SearchSHA1 = []string{"explerer.exe"}
+	if r.ValidateParameters() == nil {
+		t.Fatal("expected error on invalid hash")
+	}
+}
+
+// TestLockedHives searches the hives of a live system, which are locked and
+// read from the raw volume
+func TestLockedHives(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migamcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	volume := testutil.LockFiles(t, dir, map[string][]byte{
+		"Windows/AppCompat/Programs/Amcache.hve": testutil.BuildHive(testAmcacheHive()),
+		"Windows/System32/config/SYSTEM":         testutil.BuildHive(testSystemHive(buildShimCache("7"))),
+	})
+	for _, raw := range []*ntfs.RawFiles{{Volume: volume}, new(ntfs.RawFiles)} {
+		r := run{raw: raw}
+		r.Parameters.SearchExe = []string{"explerer"}
+		r.Parameters.AmcachePath = filepath.Join(dir, "Windows", "AppCompat", "Programs", "Amcache.hve")
+		r.Parameters.SystemPath = filepath.Join(dir, "Windows", "System32", "config", "SYSTEM")
+		msg, err := modules.MakeMessage(modules.MsgClassParameters, r.Parameters, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res modules.Result
+		err = json.Unmarshal([]byte(r.Run(bytes.NewBuffer(msg))), &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var el elements
+		err = res.GetElements(&el)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raw.Volume == nil {
+			// without the raw volume, both locked hives are reported
+			if len(el.Records) != 0 || len(res.Errors) != 2 || !strings.Contains(res.Errors[0], "raw volume") {
+				t.Fatalf("expected errors reading the locked hives, got %v", res.Errors)
+			}
+			continue
+		}
+		if len(res.Errors) > 0 {
+			t.Fatalf("unexpected errors %v", res.Errors)
+		}
+		if len(el.Records) != 2 || el.Records[0].Source != SourceAmcache || el.Records[1].Source != SourceShimCache {
+			t.Fatalf("unexpected records %+v", el.Records)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package amcache /* import "mig.ninja/mig/modules/amcache" */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"mig.ninja/mig/modules"
+	"mig.ninja/mig/modules/registry"
+	"mig.ninja/mig/modules/winbin"
+)
+
+/*
+	Amcache.hve is a registry hive written by the application experience
+	service. Two layouts exist:
+
+	- Windows 10 and later: Root\InventoryApplicationFile holds one key per
+	  file, with named values (LowerCaseLongPath, FileId, Publisher, ...).
+	  Files installed by a program point to Root\InventoryApplication through
+	  their ProgramId, which holds the install date of the program.
+	- Windows 7 and 8: Root\File holds one key per volume, and one key per
+	  file below it, with values named by numbers (15 is the path, 101 the
+	  SHA1, 11 and 12 the modification and creation times).
+
+	In both layouts, the SHA1 of the file is prefixed with four zeros, and
+	the last write time of the file key is the time the entry was created,
+	usually the first execution or installation of the file.
+*/
+
+// names of the values of the Windows 7 and 8 File entries
+const (
+	fileProduct   = "0"
+	filePublisher = "1"
+	fileVersion   = "5"
+	fileSize      = "6"
+	fileModified  = "11"
+	fileCreated   = "12"
+	filePath      = "15"
+	fileSHA1      = "101"
+)
+
+// inventoryDate is the format of the dates stored as strings in the
+// inventory keys of Windows 10
+const inventoryDate = "01/02/2006 15:04:05"
+
+// parseAmcache returns the file entries of an Amcache.hve hive, in either
+// of its layouts
+func parseAmcache(hive *registry.Hive) (records []ExecRecord, err error) {
+	root, err := hive.Root()
+	if err != nil {
+		return nil, err
+	}
+	// the Amcache hive has a single Root key below the root cell
+	if k, err := subkey(root, "Root"); err == nil {
+		root = k
+	}
+	found := false
+	if files, err := subkey(root, "InventoryApplicationFile"); err == nil {
+		found = true
+		installs := programInstalls(root)
+		recs, err := inventoryFiles(files, installs)
+		records = append(records, recs...)
+		if err != nil {
+			return records, err
+		}
+	}
+	if volumes, err := subkey(root, "File"); err == nil {
+		found = true
+		recs, err := legacyFiles(volumes)
+		records = append(records, recs...)
+		if err != nil {
+			return records, err
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("parseAmcache: no InventoryApplicationFile or File key in hive")
+	}
+	for i := range records {
+		records[i].Source = SourceAmcache
+		records[i].setTimes()
+	}
+	return
+}
+
+// inventoryFiles reads the InventoryApplicationFile entries of Windows 10
+func inventoryFiles(files *registry.Key, installs map[string]time.Time) (records []ExecRecord, err error) {
+	keys, err := files.Subkeys()
+	for _, k := range keys {
+		values, verr := k.Values()
+		if verr != nil && err == nil {
+			err = verr
+		}
+		rec := ExecRecord{LastWrite: k.LastWrite}
+		for _, v := range values {
+			switch strings.ToLower(v.Name) {
+			case "lowercaselongpath":
+				rec.Path = v.String()
+			case "name":
+				rec.Name = v.String()
+			case "fileid":
+				rec.SHA1 = normalizeSHA1(v.String())
+			case "publisher":
+				rec.Publisher = v.String()
+			case "productname":
+				rec.Product = v.String()
+			case "version":
+				rec.Version = v.String()
+			case "size":
+				rec.Size = integer(v)
+			case "linkdate":
+				rec.LinkDate, _ = time.Parse(inventoryDate, v.String())
+			case "programid":
+				rec.ProgramID = v.String()
+			}
+		}
+		rec.Installed = installs[rec.ProgramID]
+		if rec.Name == "" {
+			rec.Name = baseName(rec.Path)
+		}
+		records = append(records, rec)
+	}
+	return
+}
+
+// programInstalls returns the install date of the programs listed in
+// InventoryApplication, by program id
+func programInstalls(root *registry.Key) map[string]time.Time {
+	installs := make(map[string]time.Time)
+	apps, err := subkey(root, "InventoryApplication")
+	if err != nil {
+		return installs
+	}
+	keys, _ := apps.Subkeys()
+	for _, k := range keys {
+		if v, ok := value(k, "InstallDate"); ok {
+			if t, err := time.Parse(inventoryDate, v.String()); err == nil {
+				installs[k.Name] = t
+			}
+		}
+	}
+	return installs
+}
+
+// legacyFiles reads the File entries of Windows 7 and 8, grouped by volume
+func legacyFiles(volumes *registry.Key) (records []ExecRecord, err error) {
+	vkeys, err := volumes.Subkeys()
+	for _, vk := range vkeys {
+		keys, kerr := vk.Subkeys()
+		if kerr != nil && err == nil {
+			err = kerr
+		}
+		for _, k := range keys {
+			values, verr := k.Values()
+			if verr != nil && err == nil {
+				err = verr
+			}
+			rec := ExecRecord{LastWrite: k.LastWrite}
+			for _, v := range values {
+				switch v.Name {
+				case filePath:
+					rec.Path = v.String()
+				case fileSHA1:
+					rec.SHA1 = normalizeSHA1(v.String())
+				case filePublisher:
+					rec.Publisher = v.String()
+				case fileProduct:
+					rec.Product = v.String()
+				case fileVersion:
+					rec.Version = v.String()
+				case fileSize:
+					rec.Size = integer(v)
+				case fileModified:
+					rec.Modified = winbin.Filetime(uint64(integer(v)))
+				case fileCreated:
+					rec.Created = winbin.Filetime(uint64(integer(v)))
+				}
+			}
+			rec.Name = baseName(rec.Path)
+			records = append(records, rec)
+		}
+	}
+	return
+}
+
+// setTimes fills the artefact times of an Amcache record
+func (rec *ExecRecord) setTimes() {
+	for _, t := range []struct {
+		kind string
+		time time.Time
+	}{
+		{modules.ArtefactTimeLastWrite, rec.LastWrite},
+		{modules.ArtefactTimeInstalled, rec.Installed},
+		{modules.ArtefactTimeCreated, rec.Created},
+		{modules.ArtefactTimeModified, rec.Modified},
+	} {
+		if !t.time.IsZero() {
+			rec.Times = append(rec.Times, modules.NewArtefactTime(t.kind, t.time, "amcache"))
+		}
+	}
+}
+
+// normalizeSHA1 removes the four zeros prefixed to the SHA1 of files in
+// the Amcache, and lower cases it
+func normalizeSHA1(id string) string {
+	id = strings.ToLower(strings.TrimSpace(id))
+	if len(id) == 44 && strings.HasPrefix(id, "0000") {
+		id = id[4:]
+	}
+	return id
+}
+
+// integer returns the value of a numeric registry value, stored either as
+// a DWORD, a QWORD or a decimal string
+func integer(v registry.Value) int64 {
+	switch {
+	case v.Type == registry.RegQword && len(v.Data) >= 8:
+		return int64(binary.LittleEndian.Uint64(v.Data))
+	case v.Type == registry.RegDword && len(v.Data) >= 4:
+		return int64(binary.LittleEndian.Uint32(v.Data))
+	}
+	n, _ := strconv.ParseInt(v.String(), 0, 64)
+	return n
+}
+
+// subkey follows a path of subkey names from a key, ignoring case
+func subkey(k *registry.Key, path ...string) (*registry.Key, error) {
+	for _, name := range path {
+		keys, err := k.Subkeys()
+		if err != nil {
+			return nil, err
+		}
+		var next *registry.Key
+		for _, sk := range keys {
+			if strings.EqualFold(sk.Name, name) {
+				next = sk
+				break
+			}
+		}
+		if next == nil {
+			return nil, fmt.Errorf("subkey: no key %s in %q", name, k.Path)
+		}
+		k = next
+	}
+	return k, nil
+}
+
+// value returns the value of a key with the given name, ignoring case
+func value(k *registry.Key, name string) (registry.Value, bool) {
+	values, _ := k.Values()
+	for _, v := range values {
+		if strings.EqualFold(v.Name, name) {
+			return v, true
+		}
+	}
+	return registry.Value{}, false
+}
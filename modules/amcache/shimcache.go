@@ -0,0 +1,203 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package amcache /* import "mig.ninja/mig/modules/amcache" */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"mig.ninja/mig/modules"
+	"mig.ninja/mig/modules/registry"
+	"mig.ninja/mig/modules/winbin"
+)
+
+/*
+	The AppCompatCache value of the SYSTEM hive, also known as the ShimCache,
+	lists the executables checked by the application compatibility layer,
+	most recent first. The layout of the value depends on the version of
+	Windows:
+
+	- Windows 7 / 2008 R2: a 128 bytes header starting with 0xbadc0fee and
+	  the number of entries, then fixed size entries pointing to their path
+	  (32 bytes entries on 32 bit systems, 48 bytes on 64 bit systems)
+	- Windows 8.x / 2012: a 128 bytes header, then entries starting with
+	  "00ts" (8.0) or "10ts" (8.1), holding the path and the name of the
+	  package of the application inline. The header usually starts with
+	  its size, but is zero on some 8.0 systems.
+	- Windows 10 / 2016 and later: a 48 or 52 bytes header, then entries
+	  starting with "10ts"
+
+	The entries of Windows 8 and 10 can be followed by zero padding.
+
+	The cache only records the modification time of the file, not the time
+	it was executed. Windows 7 and 8 also record whether the file was
+	executed, in the insertion flags of the entry.
+*/
+
+const (
+	shimWin7Magic      = 0xbadc0fee
+	shimWin8HeaderSize = 128
+	shimWin7EntrySize  = 48
+	shimWin7x86Entry   = 32
+
+	// insertion flag set when the file was executed
+	shimExecutedFlag = 0x2
+
+)
+
+// parseShimCache reads the AppCompatCache value of the current control set
+// of a SYSTEM hive
+func parseShimCache(hive *registry.Hive) (records []ExecRecord, err error) {
+	root, err := hive.Root()
+	if err != nil {
+		return nil, err
+	}
+	controlSet := "ControlSet001"
+	if sel, err := subkey(root, "Select"); err == nil {
+		if v, ok := value(sel, "Current"); ok && len(v.Data) >= 4 {
+			controlSet = fmt.Sprintf("ControlSet%03d", binary.LittleEndian.Uint32(v.Data))
+		}
+	}
+	key, err := subkey(root, controlSet, "Control", "Session Manager", "AppCompatCache")
+	if err != nil {
+		return nil, err
+	}
+	v, ok := value(key, "AppCompatCache")
+	if !ok {
+		return nil, fmt.Errorf("parseShimCache: no AppCompatCache value in %s", key.Path)
+	}
+	return parseAppCompatCache(v.Data)
+}
+
+// parseAppCompatCache decodes the entries of an AppCompatCache value
+func parseAppCompatCache(buf []byte) (records []ExecRecord, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("parseAppCompatCache() -> %v", e)
+		}
+	}()
+	if len(buf) < 4 {
+		return nil, fmt.Errorf("parseAppCompatCache: value is too small (%d bytes)", len(buf))
+	}
+	header := winbin.Le32(buf, 0)
+	switch {
+	case header == shimWin7Magic:
+		records = parseShimWin7(buf)
+	case header == shimWin8HeaderSize || isShimTS(buf, shimWin8HeaderSize):
+		records = parseShimTS(buf, shimWin8HeaderSize, true)
+	case header == 0x30 || header == 0x34:
+		records = parseShimTS(buf, int(header), false)
+	default:
+		return nil, fmt.Errorf("parseAppCompatCache: unsupported cache header 0x%x", header)
+	}
+	for i := range records {
+		records[i].Source = SourceShimCache
+		records[i].Position = i + 1
+		records[i].Name = baseName(records[i].Path)
+		if !records[i].Modified.IsZero() {
+			records[i].Times = append(records[i].Times,
+				modules.NewArtefactTime(modules.ArtefactTimeModified, records[i].Modified, "amcache"))
+		}
+	}
+	return
+}
+
+// parseShimWin7 decodes the fixed size entries of Windows 7, which point to
+// their path in the data following the entries
+func parseShimWin7(buf []byte) (records []ExecRecord) {
+	count := int(winbin.Le32(buf, 4))
+	// the entries of 64 bit systems have a 4 bytes padding after the
+	// lengths of the path, which is zero
+	entrySize := shimWin7EntrySize
+	if count > 0 && winbin.Le32(buf, shimWin8HeaderSize+4) != 0 {
+		entrySize = shimWin7x86Entry
+	}
+	for i := 0; i < count; i++ {
+		e := shimWin8HeaderSize + i*entrySize
+		var (
+			pathLen = uint32(winbin.Le16(buf, e))
+			pathOff uint32
+			rec     ExecRecord
+			flags   uint32
+		)
+		if entrySize == shimWin7EntrySize {
+			pathOff = uint32(winbin.Le64(buf, e+8))
+			rec.Modified = winbin.Filetime(winbin.Le64(buf, e+16))
+			flags = winbin.Le32(buf, e+24)
+		} else {
+			pathOff = winbin.Le32(buf, e+4)
+			rec.Modified = winbin.Filetime(winbin.Le64(buf, e+8))
+			flags = winbin.Le32(buf, e+16)
+		}
+		rec.Path = winbin.UTF16String(winbin.Slice(buf, int(pathOff), int(pathLen)))
+		executed := flags&shimExecutedFlag != 0
+		rec.Executed = &executed
+		records = append(records, rec)
+	}
+	return
+}
+
+// parseShimTS decodes the entries of Windows 8 and 10, which start with a
+// "00ts" or "10ts" signature and hold their path inline
+func parseShimTS(buf []byte, offset int, win8 bool) (records []ExecRecord) {
+	for offset+12 <= len(buf) {
+		if isZero(buf[offset:]) {
+			break
+		}
+		sig := string(winbin.Slice(buf, offset, 4))
+		if !isShimTS(buf, offset) {
+			panic(fmt.Sprintf("invalid entry signature %q at offset %d", sig, offset))
+		}
+		size := int(winbin.Le32(buf, offset+8))
+		entry := winbin.Slice(buf, offset+12, size)
+		offset += 12 + size
+
+		var rec ExecRecord
+		pathLen := int(winbin.Le16(entry, 0))
+		rec.Path = winbin.UTF16String(winbin.Slice(entry, 2, pathLen))
+		pos := 2 + pathLen
+		if win8 {
+			// skip the name of the package of the application
+			pos += 2 + int(winbin.Le16(entry, pos))
+			executed := winbin.Le32(entry, pos)&shimExecutedFlag != 0
+			rec.Executed = &executed
+			pos += 8
+		}
+		rec.Modified = winbin.Filetime(winbin.Le64(entry, pos))
+		records = append(records, rec)
+	}
+	return
+}
+
+// isShimTS returns true if an entry of Windows 8 or 10 starts at offset
+func isShimTS(buf []byte, offset int) bool {
+	if offset+4 > len(buf) {
+		return false
+	}
+	sig := string(buf[offset : offset+4])
+	return sig == "00ts" || sig == "10ts"
+}
+
+// isZero returns true if the buffer only contains zeroes
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// baseName returns the file name of a Windows path
+func baseName(path string) string {
+	if i := strings.LastIndexAny(path, `\/`); i >= 0 {
+		return path[i+1:]
+	}
+	return path
+}
+
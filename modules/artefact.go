@@ -0,0 +1,47 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package modules /* import "mig.ninja/mig/modules" */
+
+import (
+	"time"
+)
+
+// ArtefactTime is a timestamp attached to an artefact found by a module,
+// such as the last execution of a program or the last write of a registry
+// key. Modules that report artefact times return them in this format, so
+// consumers of the results can process them without knowing the module.
+//
+// - Kind: what the timestamp represents, one of the ArtefactTime* constants
+//
+// - Time: the timestamp itself, always in UTC and marshalled in RFC3339
+//
+// - Source: the name of the module that found the artefact
+type ArtefactTime struct {
+	Kind   string    `json:"kind"`
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+}
+
+const (
+	ArtefactTimeModified    = "modified"
+	ArtefactTimeCreated     = "created"
+	ArtefactTimeExecuted    = "executed"
+	ArtefactTimeLastWrite   = "lastwrite"
+	ArtefactTimeInstalled   = "installed"
+	ArtefactTimeDeleted     = "deleted"
+	ArtefactTimeRenamed     = "renamed"
+	ArtefactTimeAccessed    = "accessed"
+	ArtefactTimeLogin       = "login"
+	ArtefactTimeLogout      = "logout"
+	ArtefactTimeFailedLogin = "failedlogin"
+	ArtefactTimeBoot        = "boot"
+)
+
+// NewArtefactTime returns an ArtefactTime with its time converted to UTC
+func NewArtefactTime(kind string, t time.Time, source string) ArtefactTime {
+	return ArtefactTime{Kind: kind, Time: t.UTC(), Source: source}
+}
@@ -0,0 +1,123 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Julien Vehent jvehent@mozilla.com [:ulfr]
+
+package modules /* import "mig.ninja/mig/modules" */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// ResultElement is one item of the results of a module, stored and returned
+// separately so large results can be paged. The elements of a result are the
+// items of the arrays found in Result.Elements, outside of other arrays: the
+// packages of the pkg module, the matches of each search of the file module.
+// Path is the list of keys that lead to the array of the item, and Position
+// is the index of the item in that array.
+type ResultElement struct {
+	Path     []string        `json:"path"`
+	Position int             `json:"position"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// SplitElements removes the items of the arrays of the elements of a result
+// and returns them, leaving the arrays empty in the result.
+func (r *Result) SplitElements() (els []ResultElement, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("SplitElements() -> %v", e)
+		}
+	}()
+	tree, err := decodeElements(r.Elements)
+	if err != nil {
+		panic(err)
+	}
+	r.Elements = splitElements(tree, nil, &els)
+	return
+}
+
+func splitElements(node interface{}, path []string, els *[]ResultElement) interface{} {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		// walk the keys in order, so the elements are always split the same way
+		var keys []string
+		for key := range n {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			n[key] = splitElements(n[key], append(path[:len(path):len(path)], key), els)
+		}
+		return n
+	case []interface{}:
+		for i, item := range n {
+			data, err := json.Marshal(item)
+			if err != nil {
+				panic(err)
+			}
+			*els = append(*els, ResultElement{Path: path, Position: i, Data: data})
+		}
+		return []interface{}{}
+	}
+	return node
+}
+
+// JoinElements adds elements back into the arrays of the elements of a result,
+// in the order they are given
+func (r *Result) JoinElements(els []ResultElement) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("JoinElements() -> %v", e)
+		}
+	}()
+	if len(els) == 0 {
+		return
+	}
+	tree, err := decodeElements(r.Elements)
+	if err != nil {
+		panic(err)
+	}
+	for _, el := range els {
+		item, err := decodeElements(el.Data)
+		if err != nil {
+			panic(err)
+		}
+		tree = joinElement(tree, el.Path, item)
+	}
+	r.Elements = tree
+	return
+}
+
+func joinElement(node interface{}, path []string, item interface{}) interface{} {
+	if len(path) == 0 {
+		arr, _ := node.([]interface{})
+		return append(arr, item)
+	}
+	n, ok := node.(map[string]interface{})
+	if !ok {
+		n = make(map[string]interface{})
+	}
+	n[path[0]] = joinElement(n[path[0]], path[1:], item)
+	return n
+}
+
+// decodeElements converts elements into generic JSON values, keeping numbers
+// as they were written
+func decodeElements(el interface{}) (tree interface{}, err error) {
+	buf, ok := el.(json.RawMessage)
+	if !ok {
+		buf, err = json.Marshal(el)
+		if err != nil {
+			return
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	err = dec.Decode(&tree)
+	return
+}
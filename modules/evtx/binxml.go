@@ -0,0 +1,549 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package evtx /* import "mig.ninja/mig/modules/evtx" */
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"mig.ninja/mig/modules/winbin"
+)
+
+/*
+	Event records are stored as binary XML (BinXML), a stream of tokens
+	describing elements, attributes and values. Names are stored once per
+	chunk, and referenced by their offset in the chunk. Most records are a
+	template instance: a reference to a template, an XML fragment holding
+	substitution tokens, and the array of values that replace them.
+	Templates are defined inline the first time they are used in a chunk,
+	and referenced by offset afterwards.
+*/
+
+// BinXML tokens, the 0x40 bit flags elements with attributes, and
+// attributes or values followed by more of them
+const (
+	tokEOF               = 0x00
+	tokOpenStartElement  = 0x01
+	tokCloseStartElement = 0x02
+	tokCloseEmptyElement = 0x03
+	tokEndElement        = 0x04
+	tokValue             = 0x05
+	tokAttribute         = 0x06
+	tokCDATA             = 0x07
+	tokCharRef           = 0x08
+	tokEntityRef         = 0x09
+	tokPITarget          = 0x0a
+	tokPIData            = 0x0b
+	tokTemplateInstance  = 0x0c
+	tokNormalSubst       = 0x0d
+	tokOptionalSubst     = 0x0e
+	tokFragmentHeader    = 0x0f
+
+	tokMoreBit = 0x40
+)
+
+// BinXML value types, the 0x80 bit flags arrays
+const (
+	valNull       = 0x00
+	valString     = 0x01
+	valAnsiString = 0x02
+	valInt8       = 0x03
+	valUint8      = 0x04
+	valInt16      = 0x05
+	valUint16     = 0x06
+	valInt32      = 0x07
+	valUint32     = 0x08
+	valInt64      = 0x09
+	valUint64     = 0x0a
+	valFloat      = 0x0b
+	valDouble     = 0x0c
+	valBool       = 0x0d
+	valBinary     = 0x0e
+	valGUID       = 0x0f
+	valSizeT      = 0x10
+	valFiletime   = 0x11
+	valSystemtime = 0x12
+	valSID        = 0x13
+	valHex32      = 0x14
+	valHex64      = 0x15
+	valBinXML     = 0x21
+
+	valArrayBit = 0x80
+)
+
+// maxNesting limits the depth of elements and embedded fragments, which
+// protects against cycles in corrupted chunks
+const maxNesting = 64
+
+// node is an item of the content of an element: an *element, a text, a
+// substitution or a template instance
+type node interface{}
+
+// element is an XML element of a template or of a record
+type element struct {
+	Name     string
+	Attrs    []attribute
+	Children []node
+}
+
+type attribute struct {
+	Name  string
+	Value []node
+}
+
+// substitution is replaced by a value of the template instance
+type substitution struct {
+	Index    int
+	Optional bool
+}
+
+// instance is a template with the values of its substitutions
+type instance struct {
+	Template []node
+	Values   []subValue
+}
+
+// subValue is a value of a template instance, with its offset in the chunk
+// so embedded BinXML can be parsed
+type subValue struct {
+	Type   byte
+	Data   []byte
+	Offset int
+}
+
+// binxmlParser parses the BinXML of the records of a chunk
+type binxmlParser struct {
+	chunk     []byte
+	templates map[uint32][]node // parsed templates, by offset of their definition
+	depth     int
+}
+
+func newParser(chunk []byte) *binxmlParser {
+	return &binxmlParser{chunk: chunk, templates: make(map[uint32][]node)}
+}
+
+// parseFragment parses the tokens starting at pos until the end of the
+// fragment, and returns them with the position following the fragment
+func (p *binxmlParser) parseFragment(pos int) (nodes []node, next int) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxNesting {
+		panic("maximum BinXML nesting reached")
+	}
+	for {
+		tok := p.byteAt(pos)
+		switch tok &^ tokMoreBit {
+		case tokEOF:
+			return nodes, pos + 1
+		case tokEndElement:
+			// end of the content of the parent element
+			return nodes, pos + 1
+		case tokFragmentHeader:
+			pos += 4
+		case tokOpenStartElement:
+			var e *element
+			e, pos = p.parseElement(pos)
+			nodes = append(nodes, e)
+		case tokValue:
+			var n node
+			n, pos = p.parseValue(pos)
+			nodes = append(nodes, n)
+		case tokNormalSubst, tokOptionalSubst:
+			nodes = append(nodes, substitution{Index: int(p.le16(pos + 1)), Optional: tok == tokOptionalSubst})
+			pos += 4
+		case tokCDATA:
+			n := int(p.le16(pos + 1))
+			nodes = append(nodes, winbin.UTF16String(p.slice(pos+3, n*2)))
+			pos += 3 + n*2
+		case tokCharRef:
+			nodes = append(nodes, string(rune(p.le16(pos+1))))
+			pos += 3
+		case tokEntityRef:
+			name, next := p.nameAt(pos+1, pos+5)
+			nodes = append(nodes, entity(name))
+			pos = next
+		case tokPITarget:
+			_, pos = p.nameAt(pos+1, pos+5)
+		case tokPIData:
+			pos += 3 + int(p.le16(pos+1))*2
+		case tokTemplateInstance:
+			var in *instance
+			in, pos = p.parseInstance(pos)
+			nodes = append(nodes, in)
+		default:
+			panic(fmt.Sprintf("unexpected BinXML token 0x%02x at offset %d", tok, pos))
+		}
+	}
+}
+
+// parseElement parses an element and its content, starting at its
+// OpenStartElement token
+func (p *binxmlParser) parseElement(pos int) (e *element, next int) {
+	tok := p.byteAt(pos)
+	// the token is followed by a dependency identifier and the size of the
+	// element, which are not needed to parse it
+	name, pos := p.nameAt(pos+7, pos+11)
+	e = &element{Name: name}
+	if tok&tokMoreBit != 0 {
+		// size of the attributes list
+		pos += 4
+		for {
+			atok := p.byteAt(pos)
+			if atok&^tokMoreBit != tokAttribute {
+				break
+			}
+			var a attribute
+			a.Name, pos = p.nameAt(pos+1, pos+5)
+			a.Value, pos = p.parseAttributeValue(pos)
+			e.Attrs = append(e.Attrs, a)
+			if atok&tokMoreBit == 0 {
+				break
+			}
+		}
+	}
+	switch p.byteAt(pos) {
+	case tokCloseEmptyElement:
+		return e, pos + 1
+	case tokCloseStartElement:
+		e.Children, pos = p.parseFragment(pos + 1)
+		return e, pos
+	}
+	panic(fmt.Sprintf("unexpected BinXML token 0x%02x closing element %s at offset %d", p.byteAt(pos), name, pos))
+}
+
+// parseAttributeValue parses the value of an attribute, which is a single
+// value, substitution or reference token
+func (p *binxmlParser) parseAttributeValue(pos int) (value []node, next int) {
+	tok := p.byteAt(pos)
+	switch tok &^ tokMoreBit {
+	case tokValue:
+		n, next := p.parseValue(pos)
+		return []node{n}, next
+	case tokNormalSubst, tokOptionalSubst:
+		return []node{substitution{Index: int(p.le16(pos + 1)), Optional: tok == tokOptionalSubst}}, pos + 4
+	case tokCharRef:
+		return []node{string(rune(p.le16(pos + 1)))}, pos + 3
+	case tokEntityRef:
+		name, next := p.nameAt(pos+1, pos+5)
+		return []node{entity(name)}, next
+	}
+	panic(fmt.Sprintf("unexpected BinXML token 0x%02x in attribute at offset %d", tok, pos))
+}
+
+// parseValue parses a value token, which always holds a string
+func (p *binxmlParser) parseValue(pos int) (n node, next int) {
+	vtype := p.byteAt(pos + 1)
+	if vtype != valString {
+		panic(fmt.Sprintf("unsupported value type 0x%02x at offset %d", vtype, pos))
+	}
+	size := int(p.le16(pos + 2))
+	return winbin.UTF16String(p.slice(pos+4, size*2)), pos + 4 + size*2
+}
+
+// parseInstance parses a template instance, and the template it refers to
+func (p *binxmlParser) parseInstance(pos int) (in *instance, next int) {
+	defOffset := p.le32(pos + 6)
+	pos += 10
+	in = new(instance)
+	if int(defOffset) == pos {
+		// the template is defined inline, and followed by the values
+		size := int(p.le32(pos + 20))
+		in.Template = p.template(defOffset)
+		pos += 24 + size
+	} else {
+		in.Template = p.template(defOffset)
+	}
+	count := int(p.le32(pos))
+	pos += 4
+	valuesPos := pos + count*4
+	for i := 0; i < count; i++ {
+		size := int(p.le16(pos + i*4))
+		v := subValue{Type: p.byteAt(pos + i*4 + 2), Offset: valuesPos}
+		v.Data = p.slice(valuesPos, size)
+		in.Values = append(in.Values, v)
+		valuesPos += size
+	}
+	return in, valuesPos
+}
+
+// template returns the nodes of the template defined at offset, which
+// starts with the offset of the next template, a GUID and its size
+func (p *binxmlParser) template(offset uint32) []node {
+	if t, ok := p.templates[offset]; ok {
+		return t
+	}
+	// mark the template as being parsed, so a template that refers to
+	// itself is not parsed forever
+	p.templates[offset] = nil
+	t, _ := p.parseFragment(int(offset) + 24)
+	p.templates[offset] = t
+	return t
+}
+
+// nameAt reads the name at the offset stored at pos. Names are stored
+// inline when first used in a chunk, in which case their offset is the
+// position following the offset field, here given in inline.
+func (p *binxmlParser) nameAt(pos, inline int) (name string, next int) {
+	off := int(p.le32(pos))
+	size := int(p.le16(off + 6))
+	name = winbin.UTF16String(p.slice(off+8, size*2))
+	if off == inline {
+		// next name offset, hash, size, characters and null terminator
+		return name, inline + 10 + size*2
+	}
+	return name, inline
+}
+
+func (p *binxmlParser) byteAt(pos int) byte {
+	return p.slice(pos, 1)[0]
+}
+
+func (p *binxmlParser) le16(pos int) uint16 {
+	return binary.LittleEndian.Uint16(p.slice(pos, 2))
+}
+
+func (p *binxmlParser) le32(pos int) uint32 {
+	return binary.LittleEndian.Uint32(p.slice(pos, 4))
+}
+
+// slice returns size bytes of the chunk at pos, and panics with a readable
+// error if the range is outside of the chunk
+func (p *binxmlParser) slice(pos, size int) []byte {
+	if pos < 0 || size < 0 || pos+size > len(p.chunk) {
+		panic(fmt.Sprintf("offset %d+%d is out of bounds of the chunk", pos, size))
+	}
+	return p.chunk[pos : pos+size]
+}
+
+// xmlElem is an element of a record, once the substitutions of its
+// template are replaced by their values
+type xmlElem struct {
+	Name     string
+	Attrs    map[string]string
+	Children []*xmlElem
+	Text     string
+}
+
+// render resolves the template instances and substitutions of nodes into
+// the elements of a record. The text found outside of elements is added to
+// the text of parent.
+func (p *binxmlParser) render(nodes []node, values []subValue, parent *xmlElem) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxNesting {
+		panic("maximum BinXML nesting reached")
+	}
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *element:
+			e := &xmlElem{Name: n.Name, Attrs: make(map[string]string)}
+			for _, a := range n.Attrs {
+				var val string
+				empty := false
+				for _, an := range a.Value {
+					s, isNull := p.text(an, values)
+					val += s
+					empty = isNull
+				}
+				// attributes replaced by an empty optional value are omitted
+				if empty && val == "" {
+					continue
+				}
+				e.Attrs[a.Name] = val
+			}
+			p.render(n.Children, values, e)
+			parent.Children = append(parent.Children, e)
+		case *instance:
+			p.render(n.Template, n.Values, parent)
+		case substitution:
+			if n.Index >= len(values) {
+				continue
+			}
+			v := values[n.Index]
+			if v.Type == valBinXML {
+				nodes, _ := p.parseFragment(v.Offset)
+				p.render(nodes, nil, parent)
+				continue
+			}
+			s, _ := p.text(n, values)
+			parent.Text += s
+		default:
+			s, _ := p.text(n, values)
+			parent.Text += s
+		}
+	}
+}
+
+// text returns the text of a node, and whether it is an optional
+// substitution replaced by an empty value
+func (p *binxmlParser) text(n node, values []subValue) (s string, null bool) {
+	switch n := n.(type) {
+	case string:
+		return n, false
+	case entity:
+		return n.String(), false
+	case substitution:
+		if n.Index >= len(values) {
+			return "", n.Optional
+		}
+		v := values[n.Index]
+		if v.Type == valNull || len(v.Data) == 0 {
+			return "", n.Optional
+		}
+		return formatValue(v.Type, v.Data), false
+	}
+	return "", false
+}
+
+// entity is a reference to a predefined XML entity
+type entity string
+
+func (e entity) String() string {
+	switch e {
+	case "lt":
+		return "<"
+	case "gt":
+		return ">"
+	case "amp":
+		return "&"
+	case "quot":
+		return `"`
+	case "apos":
+		return "'"
+	}
+	return "&" + string(e) + ";"
+}
+
+// formatValue returns the text representation of a substitution value
+func formatValue(vtype byte, b []byte) string {
+	if vtype&valArrayBit != 0 {
+		return strings.Join(formatArray(vtype&^valArrayBit, b), ", ")
+	}
+	le := binary.LittleEndian
+	switch vtype {
+	case valString:
+		return winbin.UTF16String(b)
+	case valAnsiString:
+		return strings.TrimRight(string(b), "\x00")
+	case valInt8:
+		return fmt.Sprintf("%d", int8(b[0]))
+	case valUint8:
+		return fmt.Sprintf("%d", b[0])
+	case valInt16:
+		if len(b) >= 2 {
+			return fmt.Sprintf("%d", int16(le.Uint16(b)))
+		}
+	case valUint16:
+		if len(b) >= 2 {
+			return fmt.Sprintf("%d", le.Uint16(b))
+		}
+	case valInt32:
+		if len(b) >= 4 {
+			return fmt.Sprintf("%d", int32(le.Uint32(b)))
+		}
+	case valUint32:
+		if len(b) >= 4 {
+			return fmt.Sprintf("%d", le.Uint32(b))
+		}
+	case valInt64:
+		if len(b) >= 8 {
+			return fmt.Sprintf("%d", int64(le.Uint64(b)))
+		}
+	case valUint64:
+		if len(b) >= 8 {
+			return fmt.Sprintf("%d", le.Uint64(b))
+		}
+	case valFloat:
+		if len(b) >= 4 {
+			return fmt.Sprintf("%g", math.Float32frombits(le.Uint32(b)))
+		}
+	case valDouble:
+		if len(b) >= 8 {
+			return fmt.Sprintf("%g", math.Float64frombits(le.Uint64(b)))
+		}
+	case valBool:
+		if len(b) >= 4 {
+			return fmt.Sprintf("%t", le.Uint32(b) != 0)
+		}
+	case valGUID:
+		if len(b) >= 16 {
+			return fmt.Sprintf("{%08X-%04X-%04X-%X-%X}", le.Uint32(b), le.Uint16(b[4:]), le.Uint16(b[6:]), b[8:10], b[10:16])
+		}
+	case valSizeT, valHex32, valHex64:
+		switch len(b) {
+		case 4:
+			return fmt.Sprintf("0x%x", le.Uint32(b))
+		case 8:
+			return fmt.Sprintf("0x%x", le.Uint64(b))
+		}
+	case valFiletime:
+		if len(b) >= 8 {
+			return winbin.Filetime(le.Uint64(b)).Format(time.RFC3339Nano)
+		}
+	case valSystemtime:
+		if len(b) >= 16 {
+			t := time.Date(int(le.Uint16(b)), time.Month(le.Uint16(b[2:])), int(le.Uint16(b[6:])), int(le.Uint16(b[8:])),
+				int(le.Uint16(b[10:])), int(le.Uint16(b[12:])), int(le.Uint16(b[14:]))*1e6, time.UTC)
+			return t.Format(time.RFC3339Nano)
+		}
+	case valSID:
+		return formatSID(b)
+	}
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
+// formatArray splits an array value into its items
+func formatArray(vtype byte, b []byte) (items []string) {
+	size := map[byte]int{valInt8: 1, valUint8: 1, valInt16: 2, valUint16: 2, valInt32: 4, valUint32: 4,
+		valInt64: 8, valUint64: 8, valFloat: 4, valDouble: 8, valBool: 4, valGUID: 16, valFiletime: 8,
+		valSystemtime: 16, valHex32: 4, valHex64: 8}[vtype]
+	switch {
+	case vtype == valString:
+		for _, s := range strings.Split(decodeUTF16All(b), "\x00") {
+			if s != "" {
+				items = append(items, s)
+			}
+		}
+	case size > 0:
+		for i := 0; i+size <= len(b); i += size {
+			items = append(items, formatValue(vtype, b[i:i+size]))
+		}
+	default:
+		items = append(items, strings.ToUpper(hex.EncodeToString(b)))
+	}
+	return
+}
+
+// formatSID returns the string representation of a security identifier
+func formatSID(b []byte) string {
+	if len(b) < 8 || len(b) < 8+int(b[1])*4 {
+		return strings.ToUpper(hex.EncodeToString(b))
+	}
+	var auth uint64
+	for _, c := range b[2:8] {
+		auth = auth<<8 | uint64(c)
+	}
+	sid := fmt.Sprintf("S-%d-%d", b[0], auth)
+	for i := 0; i < int(b[1]); i++ {
+		sid += fmt.Sprintf("-%d", binary.LittleEndian.Uint32(b[8+i*4:]))
+	}
+	return sid
+}
+
+// decodeUTF16All decodes a UTF-16LE buffer, null characters included
+func decodeUTF16All(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[i*2:])
+	}
+	return string(utf16.Decode(u))
+}
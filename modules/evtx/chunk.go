@@ -0,0 +1,229 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package evtx /* import "mig.ninja/mig/modules/evtx" */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"mig.ninja/mig/modules/winbin"
+)
+
+/*
+	An EVTX file starts with a 4096 bytes header ("ElfFile\0"), followed by
+	chunks of 65536 bytes ("ElfChnk\0"). Each chunk has a 512 bytes header,
+	which holds the offset of its free space, followed by event records.
+	Every record starts with the "**\0\0" signature, its size, its record
+	identifier and the time it was written, followed by its BinXML, and ends
+	with a copy of its size.
+
+	The number of chunks in the file header is not updated when the log is
+	dirty, so all the chunks of the file are read, and chunks that are not
+	initialized are skipped.
+*/
+
+const (
+	fileHeaderSize   = 4096
+	chunkSize        = 65536
+	chunkHeaderSize  = 512
+	recordHeaderSize = 24
+	recordSignature  = 0x00002a2a
+	fileSignature    = "ElfFile\x00"
+	chunkSignature   = "ElfChnk\x00"
+)
+
+// Event is an event record, with the fields of its System element, and the
+// named data of its EventData or UserData element
+type Event struct {
+	File        string            `json:"file,omitempty"`
+	Channel     string            `json:"channel,omitempty"`
+	Provider    string            `json:"provider,omitempty"`
+	EventID     int               `json:"eventid"`
+	Level       int               `json:"level,omitempty"`
+	RecordID    uint64            `json:"recordid"`
+	TimeCreated time.Time         `json:"timecreated"`
+	Computer    string            `json:"computer,omitempty"`
+	UserID      string            `json:"userid,omitempty"`
+	Data        map[string]string `json:"data,omitempty"`
+}
+
+// evtxReader reads the chunks of an EVTX file
+type evtxReader struct {
+	r    io.ReaderAt
+	size int64
+}
+
+// openEvtx checks the header of an EVTX file and returns a reader of its
+// chunks
+func openEvtx(r io.ReaderAt, size int64) (*evtxReader, error) {
+	hdr := make([]byte, fileHeaderSize)
+	if size < fileHeaderSize {
+		return nil, fmt.Errorf("openEvtx: file is too small (%d bytes)", size)
+	}
+	if _, err := r.ReadAt(hdr, 0); err != nil {
+		return nil, err
+	}
+	if string(hdr[:8]) != fileSignature {
+		return nil, fmt.Errorf("openEvtx: invalid file signature")
+	}
+	return &evtxReader{r: r, size: size}, nil
+}
+
+// numChunks returns the number of complete chunks in the file
+func (er *evtxReader) numChunks() int {
+	return int((er.size - fileHeaderSize) / chunkSize)
+}
+
+// chunk reads the chunk of index i, and returns nil for chunks that are
+// not initialized
+func (er *evtxReader) chunk(i int) ([]byte, error) {
+	buf := make([]byte, chunkSize)
+	_, err := er.r.ReadAt(buf, fileHeaderSize+int64(i)*chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	if string(buf[:8]) != chunkSignature {
+		return nil, nil
+	}
+	return buf, nil
+}
+
+// parseChunk calls fn for each event record of a chunk. Records that fail
+// to parse are reported to fn with their error, and stop the parsing of
+// the chunk when their size is invalid. fn returns false to stop parsing.
+func parseChunk(chunk []byte, fn func(ev Event, err error) bool) {
+	p := newParser(chunk)
+	end := int(binary.LittleEndian.Uint32(chunk[48:52]))
+	if end > len(chunk) || end < chunkHeaderSize {
+		end = len(chunk)
+	}
+	for pos := chunkHeaderSize; pos+recordHeaderSize <= end; {
+		if binary.LittleEndian.Uint32(chunk[pos:]) != recordSignature {
+			return
+		}
+		size := int(binary.LittleEndian.Uint32(chunk[pos+4:]))
+		if size < recordHeaderSize+4 || pos+size > len(chunk) {
+			fn(Event{}, fmt.Errorf("record at offset %d has an invalid size %d", pos, size))
+			return
+		}
+		ev, err := p.parseRecord(pos, size)
+		if !fn(ev, err) {
+			return
+		}
+		pos += size
+	}
+}
+
+// parseRecord decodes the record at pos, and extracts its fields
+func (p *binxmlParser) parseRecord(pos, size int) (ev Event, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("record %d: %v", ev.RecordID, e)
+		}
+	}()
+	ev.RecordID = binary.LittleEndian.Uint64(p.chunk[pos+8:])
+	ev.TimeCreated = winbin.Filetime(binary.LittleEndian.Uint64(p.chunk[pos+16:]))
+	p.depth = 0
+	nodes, _ := p.parseFragment(pos + recordHeaderSize)
+	var root xmlElem
+	p.render(nodes, nil, &root)
+	if len(root.Children) == 0 {
+		return ev, fmt.Errorf("record %d has no element", ev.RecordID)
+	}
+	ev.fill(root.Children[0])
+	return
+}
+
+// fill sets the fields of an event from its Event element
+func (ev *Event) fill(e *xmlElem) {
+	for _, c := range e.Children {
+		switch c.Name {
+		case "System":
+			for _, s := range c.Children {
+				switch s.Name {
+				case "Provider":
+					ev.Provider = s.Attrs["Name"]
+				case "EventID":
+					ev.EventID, _ = strconv.Atoi(s.Text)
+				case "Level":
+					ev.Level, _ = strconv.Atoi(s.Text)
+				case "TimeCreated":
+					if t, err := time.Parse(time.RFC3339Nano, s.Attrs["SystemTime"]); err == nil {
+						ev.TimeCreated = t.UTC()
+					}
+				case "Channel":
+					ev.Channel = s.Text
+				case "Computer":
+					ev.Computer = s.Text
+				case "Security":
+					ev.UserID = s.Attrs["UserID"]
+				}
+			}
+		case "EventData":
+			for i, d := range c.Children {
+				name := d.Attrs["Name"]
+				if name == "" {
+					name = fmt.Sprintf("%s%d", d.Name, i+1)
+				}
+				ev.setData(name, d.Text)
+			}
+		case "UserData":
+			// user data holds a single element, named after the event,
+			// with one child per field
+			for _, u := range c.Children {
+				for _, d := range u.Children {
+					ev.setData(d.Name, d.Text)
+				}
+			}
+		}
+	}
+}
+
+func (ev *Event) setData(name, value string) {
+	if ev.Data == nil {
+		ev.Data = make(map[string]string)
+	}
+	ev.Data[name] = value
+}
+
+// readEvtxFile calls fn for each event record of an EVTX file
+func readEvtxFile(path string, fn func(ev Event, err error) bool) (chunks int, err error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	fi, err := fd.Stat()
+	if err != nil {
+		return
+	}
+	er, err := openEvtx(fd, fi.Size())
+	if err != nil {
+		return
+	}
+	stop := false
+	for i := 0; i < er.numChunks() && !stop; i++ {
+		chunk, err := er.chunk(i)
+		if err != nil {
+			return chunks, err
+		}
+		if chunk == nil {
+			continue
+		}
+		chunks++
+		parseChunk(chunk, func(ev Event, err error) bool {
+			ev.File = path
+			stop = !fn(ev, err)
+			return !stop
+		})
+	}
+	return
+}
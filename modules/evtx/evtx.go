@@ -0,0 +1,424 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+/*
+
+If you run it, it will return a JSON struct with array of event records
+matching the search. If you add flag `-p`, it will pretty print the results.
+
+Event log files are parsed natively, without the Windows event log API, so
+archived logs, or logs extracted from an image, can be searched on any
+system with `files`. Channels are resolved to their log file under
+%SYSTEMROOT%\System32\winevt\Logs.
+
+Example JSON
+-------------
+
+{
+    "module": "evtx",
+    "parameters": {
+        "channels": [
+            "Security",
+            "System"
+        ],
+        "eventids": [
+            4624,
+            7045
+        ],
+        "fields": {
+            "IpAddress": "^10\\.0\\.0\\.",
+            "TargetUserName": "(?i)^admin"
+        },
+        "startdate": "2016-09-01T00:00:00Z",
+        "maxmatches": 500
+    }
+}
+*/
+package evtx /* import "mig.ninja/mig/modules/evtx" */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mig.ninja/mig/modules"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	An instance of this type will represent this module; it's possible to add additional data fields here,
+	although that is rarely needed.
+*/
+type module struct {
+}
+
+func (m *module) NewRun() modules.Runner {
+	return new(run)
+}
+
+/*
+	init is called by the Go runtime at startup. We use this function to register the module in a
+	global array of available modules, so the agent knows we exist
+*/
+func init() {
+	modules.Register("evtx", new(module))
+}
+
+type run struct {
+	Parameters params
+	Results    modules.Result
+	stop       chan bool // closed when the module is asked to stop early
+}
+
+// defaultMaxMatches is the number of matching events returned when the
+// parameters set no limit
+const defaultMaxMatches = 1000
+
+/*
+	- Channels: Names of the channels to search, such as Security or
+				Microsoft-Windows-TaskScheduler/Operational
+	- Files: Paths of EVTX files to search, glob patterns are expanded
+	- EventIDs: Event identifiers to search for, all events match if empty
+	- StartDate, EndDate: Time range of the events, unbounded if unset
+	- Fields: Regular expressions matched against the data of the events, by
+			  field name. System fields Provider, Channel, Computer and UserID
+			  can be matched too. All the fields must match.
+	- MaxMatches: Maximum number of events returned, defaults to 1000
+*/
+type params struct {
+	Channels   []string          `json:"channels,omitempty"`
+	Files      []string          `json:"files,omitempty"`
+	EventIDs   []int             `json:"eventids,omitempty"`
+	StartDate  time.Time         `json:"startdate,omitempty"`
+	EndDate    time.Time         `json:"enddate,omitempty"`
+	Fields     map[string]string `json:"fields,omitempty"`
+	MaxMatches int               `json:"maxmatches,omitempty"`
+	Debug      bool              `json:"debug,omitempty"`
+}
+
+type elements struct {
+	Events []Event `json:"evtxresults,omitempty"`
+}
+
+/* Statistic counters:
+- FilesSearched is the number of event log files parsed
+- ChunksParsed is the number of chunks read in these files
+- RecordsParsed is the number of event records decoded
+- RecordErrors is the number of records that could not be decoded
+- TotalHits is the number of events matching the search
+- LimitReached is set when the search stopped at MaxMatches events
+- Exectime is the total runtime of the search
+*/
+type statistics struct {
+	FilesSearched int           `json:"filessearched"`
+	ChunksParsed  int           `json:"chunksparsed"`
+	RecordsParsed int           `json:"recordsparsed"`
+	RecordErrors  int           `json:"recorderrors"`
+	TotalHits     int           `json:"totalhits"`
+	LimitReached  bool          `json:"limitreached,omitempty"`
+	Exectime      time.Duration `json:"exectime"`
+}
+
+/*
+	ValidateParameters *must* be implemented by a module. It provides a method to verify that the parameters
+	passed to the module conform the expected format. It must return an error if the parameters do not validate.
+*/
+func (r *run) ValidateParameters() (err error) {
+	p := r.Parameters
+	if len(p.Channels) == 0 && len(p.Files) == 0 {
+		return fmt.Errorf("ValidateParameters: At least one of Channels or Files must be set.")
+	}
+	if !p.StartDate.IsZero() && !p.EndDate.IsZero() && p.EndDate.Before(p.StartDate) {
+		return fmt.Errorf("ValidateParameters: EndDate is *BEFORE* StartDate.")
+	}
+	for field, expr := range p.Fields {
+		if _, err := regexp.Compile(expr); err != nil {
+			return fmt.Errorf("ValidateParameters: Invalid regular expression for field %s: %v", field, err)
+		}
+	}
+	if p.MaxMatches < 0 {
+		return fmt.Errorf("ValidateParameters: MaxMatches must be positive.")
+	}
+	return
+}
+
+/*
+	Run *must* be implemented by a module. Its the function that executes the module. It must return a string of
+	marshalled json that contains the results from the module. The code below provides a base module skeleton that
+	can be reused in all modules.
+*/
+func (r *run) Run(in io.Reader) (out string) {
+	// a good way to handle execution failures is to catch panics and store
+	// the panicked error into modules.Results.Errors, marshal that, and output
+	// the JSON string back to the caller
+	defer func() {
+		if e := recover(); e != nil {
+			r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%v", e))
+			r.Results.Success = false
+			buf, _ := json.Marshal(r.Results)
+			out = string(buf[:])
+		}
+	}()
+
+	// read module parameters from stdin
+	err := modules.ReadInputParameters(in, &r.Parameters)
+	if err != nil {
+		panic(err)
+	}
+	// verify that the parameters we received are valid
+	err = r.ValidateParameters()
+	if err != nil {
+		panic(err)
+	}
+
+	// start a goroutine that does some work and another one that looks
+	// for an early stop signal
+	moduleDone := make(chan bool)
+	stop := make(chan bool)
+	r.stop = make(chan bool)
+	go r.doModuleStuff(&out, &moduleDone)
+	go modules.WatchForStop(in, &stop)
+
+	select {
+	case <-moduleDone:
+		return out
+	case <-stop:
+		// the module builds its results from what it collected so far
+		close(r.stop)
+		<-moduleDone
+		return out
+	}
+}
+
+/* doModuleStuff is an internal module function that does things specific to the module. There is no implementation requirement.
+   It's good practice to have it return the JSON string Run() expects to return. We also make it return a boolean in the `moduleDone`
+   channel to do flow control in Run().
+*/
+func (r *run) doModuleStuff(out *string, moduleDone *chan bool) error {
+	var (
+		el    elements
+		stats statistics
+	)
+	t0 := time.Now()
+
+	max := r.Parameters.MaxMatches
+	if max == 0 {
+		max = defaultMaxMatches
+	}
+	m := newMatcher(r.Parameters)
+	stopped := false
+	for _, path := range r.logFiles() {
+		if stats.LimitReached || stopped {
+			break
+		}
+		if r.Parameters.Debug {
+			fmt.Println("Processing ", path, "....")
+		}
+		chunks, err := readEvtxFile(path, func(ev Event, err error) bool {
+			// event logs can be large, so stop in the middle of a file
+			if modules.IsStopped(r.stop) {
+				stopped = true
+				return false
+			}
+			if err != nil {
+				stats.RecordErrors++
+				if r.Parameters.Debug {
+					fmt.Printf("%s: %v\n", path, err)
+				}
+				return true
+			}
+			stats.RecordsParsed++
+			if !m.match(ev) {
+				return true
+			}
+			el.Events = append(el.Events, ev)
+			stats.TotalHits++
+			if stats.TotalHits >= max {
+				stats.LimitReached = true
+				return false
+			}
+			return true
+		})
+		stats.ChunksParsed += chunks
+		if err != nil {
+			r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%s: %v", path, err))
+			continue
+		}
+		stats.FilesSearched++
+	}
+	if stats.RecordErrors > 0 {
+		r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%d event records could not be decoded", stats.RecordErrors))
+	}
+	if stopped {
+		r.Results.Errors = append(r.Results.Errors, modules.StoppedEarly)
+	}
+	stats.Exectime = time.Now().Sub(t0)
+
+	// marshal the results into a json string
+	*out = r.buildResults(el, stats)
+	*moduleDone <- true
+	return nil
+}
+
+// logFiles returns the paths of the event log files to search, from the
+// channels and files of the parameters
+func (r *run) logFiles() (paths []string) {
+	if len(r.Parameters.Channels) > 0 {
+		if runtime.GOOS != "windows" {
+			r.Results.Errors = append(r.Results.Errors, "Channels can only be searched on Windows, use Files instead.")
+		} else {
+			sysRoot := os.Getenv("SYSTEMROOT")
+			if sysRoot == "" {
+				sysRoot = "C:\\Windows"
+			}
+			for _, c := range r.Parameters.Channels {
+				paths = append(paths, filepath.Join(sysRoot, "System32", "winevt", "Logs", channelFile(c)))
+			}
+		}
+	}
+	for _, f := range r.Parameters.Files {
+		matches, err := filepath.Glob(f)
+		if err != nil || len(matches) == 0 {
+			// report missing files when they are read
+			paths = append(paths, f)
+			continue
+		}
+		sort.Strings(matches)
+		paths = append(paths, matches...)
+	}
+	return
+}
+
+// channelFile returns the name of the log file of a channel, where slashes
+// are encoded as %4
+func channelFile(channel string) string {
+	return strings.Replace(channel, "/", "%4", -1) + ".evtx"
+}
+
+// matcher holds the compiled search parameters
+type matcher struct {
+	p      params
+	ids    map[int]bool
+	fields map[string]*regexp.Regexp
+}
+
+func newMatcher(p params) (m matcher) {
+	m.p = p
+	m.ids = make(map[int]bool)
+	for _, id := range p.EventIDs {
+		m.ids[id] = true
+	}
+	m.fields = make(map[string]*regexp.Regexp)
+	for field, expr := range p.Fields {
+		m.fields[field] = regexp.MustCompile(expr)
+	}
+	return
+}
+
+// match returns true if an event matches all the search parameters
+func (m matcher) match(ev Event) bool {
+	if len(m.ids) > 0 && !m.ids[ev.EventID] {
+		return false
+	}
+	if !m.p.StartDate.IsZero() && ev.TimeCreated.Before(m.p.StartDate) {
+		return false
+	}
+	if !m.p.EndDate.IsZero() && ev.TimeCreated.After(m.p.EndDate) {
+		return false
+	}
+	for field, re := range m.fields {
+		value, ok := ev.field(field)
+		if !ok || !re.MatchString(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// field returns the value of a field of the event data, or of a system
+// field of the event
+func (ev Event) field(name string) (string, bool) {
+	if v, ok := ev.Data[name]; ok {
+		return v, true
+	}
+	switch strings.ToLower(name) {
+	case "provider":
+		return ev.Provider, true
+	case "channel":
+		return ev.Channel, true
+	case "computer":
+		return ev.Computer, true
+	case "userid":
+		return ev.UserID, true
+	}
+	return "", false
+}
+
+// buildResults takes the results found by the module, as well as statistics,
+// and puts all that into a JSON string. It also takes care of setting the
+// success and foundanything flags.
+func (r *run) buildResults(el elements, stats statistics) string {
+	if len(r.Results.Errors) == 0 {
+		r.Results.Success = true
+	}
+	r.Results.Elements = el
+	r.Results.Statistics = stats
+	if stats.TotalHits > 0 {
+		r.Results.FoundAnything = true
+	}
+	jsonOutput, err := json.Marshal(r.Results)
+	if err != nil {
+		panic(err)
+	}
+	return string(jsonOutput[:])
+}
+
+// PrintResults() is an *optional* method that returns results in a human-readable format.
+// if matchOnly is set, only results that have at least one match are returned.
+// If matchOnly is not set, all results are returned, along with errors and statistics.
+func (r *run) PrintResults(result modules.Result, matchOnly bool) (prints []string, err error) {
+	var (
+		el    elements
+		stats statistics
+	)
+	err = result.GetElements(&el)
+	if err != nil {
+		panic(err)
+	}
+	prints = append(prints, fmt.Sprintf("\n-----------------\n     Event Log Results           \n------------------"))
+	for _, ev := range el.Events {
+		prints = append(prints, fmt.Sprintf("Event %d, Channel: %s, Record: %d, Time: %s, Computer: %s",
+			ev.EventID, ev.Channel, ev.RecordID, ev.TimeCreated.Format(time.RFC3339), ev.Computer))
+		var names []string
+		for name := range ev.Data {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prints = append(prints, fmt.Sprintf("    %s: %s", name, ev.Data[name]))
+		}
+	}
+
+	for _, e := range result.Errors {
+		prints = append(prints, fmt.Sprintf("error: %v", e))
+	}
+	err = result.GetStatistics(&stats)
+	if err != nil {
+		panic(err)
+	}
+	prints = append(prints, fmt.Sprintf("Files Searched : %d", stats.FilesSearched))
+	prints = append(prints, fmt.Sprintf("Records Parsed : %d", stats.RecordsParsed))
+	prints = append(prints, fmt.Sprintf("Total Hits     : %d", stats.TotalHits))
+	if stats.LimitReached {
+		prints = append(prints, "Search stopped at the maximum number of matches")
+	}
+	return
+}
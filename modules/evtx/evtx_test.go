@@ -0,0 +1,460 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package evtx /* import "mig.ninja/mig/modules/evtx" */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"mig.ninja/mig/modules"
+	"mig.ninja/mig/testutil"
+)
+
+func TestRegistration(t *testing.T) {
+	testutil.CheckModuleRegistration(t, "evtx")
+}
+
+var testLogonTime = time.Date(2016, 9, 1, 10, 20, 30, 123456700, time.UTC)
+
+// chunkWriter generates the content of a chunk, keeping track of the names
+// and templates already written, which are referenced by offset
+type chunkWriter struct {
+	buf       []byte
+	names     map[string]uint32
+	templates map[string]uint32
+}
+
+func newChunkWriter() *chunkWriter {
+	w := &chunkWriter{buf: make([]byte, chunkHeaderSize), names: make(map[string]uint32), templates: make(map[string]uint32)}
+	copy(w.buf, chunkSignature)
+	return w
+}
+
+func (w *chunkWriter) pos() uint32 { return uint32(len(w.buf)) }
+
+func (w *chunkWriter) bytes(b ...byte) { w.buf = append(w.buf, b...) }
+
+func (w *chunkWriter) u16(v uint16) {
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], v)
+	w.bytes(b[:]...)
+}
+
+func (w *chunkWriter) u32(v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	w.bytes(b[:]...)
+}
+
+func (w *chunkWriter) u64(v uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	w.bytes(b[:]...)
+}
+
+func (w *chunkWriter) put32(at, v uint32) {
+	binary.LittleEndian.PutUint32(w.buf[at:], v)
+}
+
+// nameRef writes the offset of a name, followed by the name itself the
+// first time it is used in the chunk
+func (w *chunkWriter) nameRef(name string) {
+	if off, ok := w.names[name]; ok {
+		w.u32(off)
+		return
+	}
+	off := w.pos() + 4
+	w.names[name] = off
+	w.u32(off)
+	w.u32(0)
+	w.u16(0)
+	w.u16(uint16(len(utf16.Encode([]rune(name)))))
+	w.bytes(testutil.EncodeUTF16(name)...)
+	w.u16(0)
+}
+
+func (w *chunkWriter) open(name string, attrs bool) {
+	tok := byte(tokOpenStartElement)
+	if attrs {
+		tok |= tokMoreBit
+	}
+	w.bytes(tok)
+	w.u16(0xffff)
+	w.u32(0)
+	w.nameRef(name)
+	if attrs {
+		w.u32(0)
+	}
+}
+
+func (w *chunkWriter) attr(name string, more bool) {
+	tok := byte(tokAttribute)
+	if more {
+		tok |= tokMoreBit
+	}
+	w.bytes(tok)
+	w.nameRef(name)
+}
+
+func (w *chunkWriter) value(s string) {
+	w.bytes(tokValue, valString)
+	w.u16(uint16(len(utf16.Encode([]rune(s)))))
+	w.bytes(testutil.EncodeUTF16(s)...)
+}
+
+func (w *chunkWriter) subst(index uint16, vtype byte, optional bool) {
+	tok := byte(tokNormalSubst)
+	if optional {
+		tok = tokOptionalSubst
+	}
+	w.bytes(tok)
+	w.u16(index)
+	w.bytes(vtype)
+}
+
+// element writes an element holding a single substitution
+func (w *chunkWriter) element(name string, index uint16, vtype byte) {
+	w.open(name, false)
+	w.bytes(tokCloseStartElement)
+	w.subst(index, vtype, false)
+	w.bytes(tokEndElement)
+}
+
+// testValue is a value of a template instance, written by data when the
+// value is embedded BinXML
+type testValue struct {
+	vtype byte
+	raw   []byte
+	data  func(w *chunkWriter)
+}
+
+// record writes an event record, whose template is defined by body the
+// first time it is used
+func (w *chunkWriter) record(id uint64, written time.Time, template string, body func(), values []testValue) {
+	start := w.pos()
+	w.u32(recordSignature)
+	w.u32(0)
+	w.u64(id)
+	w.u64(testutil.Filetime(written))
+	w.bytes(tokFragmentHeader, 1, 1, 0)
+	w.bytes(tokTemplateInstance, 1)
+	w.u32(uint32(len(w.templates) + 1))
+	if off, ok := w.templates[template]; ok {
+		w.u32(off)
+	} else {
+		off := w.pos() + 4
+		w.templates[template] = off
+		w.u32(off)
+		w.u32(0)
+		w.bytes(make([]byte, 16)...)
+		sizeAt := w.pos()
+		w.u32(0)
+		w.bytes(tokFragmentHeader, 1, 1, 0)
+		body()
+		w.bytes(tokEOF)
+		w.put32(sizeAt, w.pos()-sizeAt-4)
+	}
+	w.u32(uint32(len(values)))
+	descs := w.pos()
+	for _, v := range values {
+		w.u16(0)
+		w.bytes(v.vtype, 0)
+	}
+	for i, v := range values {
+		at := w.pos()
+		if v.data != nil {
+			v.data(w)
+		} else {
+			w.bytes(v.raw...)
+		}
+		binary.LittleEndian.PutUint16(w.buf[descs+uint32(i)*4:], uint16(w.pos()-at))
+	}
+	w.bytes(tokEOF)
+	size := w.pos() - start + 4
+	w.u32(size)
+	w.put32(start+4, size)
+}
+
+// finish pads the chunk and sets the offset of its free space
+func (w *chunkWriter) finish() []byte {
+	w.put32(48, w.pos())
+	return append(w.buf, make([]byte, chunkSize-len(w.buf))...)
+}
+
+// logonTemplate writes the template of a Security logon event
+func logonTemplate(w *chunkWriter) func() {
+	return func() {
+		w.open("Event", false)
+		w.bytes(tokCloseStartElement)
+		w.open("System", false)
+		w.bytes(tokCloseStartElement)
+		w.open("Provider", true)
+		w.attr("Name", false)
+		w.subst(0, valString, false)
+		w.bytes(tokCloseEmptyElement)
+		w.element("EventID", 1, valUint16)
+		w.element("Level", 2, valUint8)
+		w.open("TimeCreated", true)
+		w.attr("SystemTime", false)
+		w.subst(3, valFiletime, false)
+		w.bytes(tokCloseEmptyElement)
+		w.element("EventRecordID", 4, valUint64)
+		w.open("Channel", false)
+		w.bytes(tokCloseStartElement)
+		w.value("Security")
+		w.bytes(tokEndElement)
+		w.element("Computer", 5, valString)
+		w.open("Security", true)
+		w.attr("UserID", false)
+		w.subst(6, valSID, true)
+		w.bytes(tokCloseEmptyElement)
+		w.bytes(tokEndElement)
+		w.open("EventData", false)
+		w.bytes(tokCloseStartElement)
+		for i, name := range []string{"TargetUserName", "IpAddress", "LogonType"} {
+			w.open("Data", true)
+			w.attr("Name", false)
+			w.value(name)
+			w.bytes(tokCloseStartElement)
+			vtype := byte(valString)
+			if name == "LogonType" {
+				vtype = valUint32
+			}
+			w.subst(uint16(7+i), vtype, false)
+			w.bytes(tokEndElement)
+		}
+		w.bytes(tokEndElement)
+		w.bytes(tokEndElement)
+	}
+}
+
+func logonValues(id uint64, t time.Time, user, ip string, sid []byte) []testValue {
+	return []testValue{
+		{vtype: valString, raw: testutil.EncodeUTF16("Microsoft-Windows-Security-Auditing")},
+		{vtype: valUint16, raw: testutil.AppendUint16(nil, 4624)},
+		{vtype: valUint8, raw: []byte{0}},
+		{vtype: valFiletime, raw: testutil.AppendUint64(nil, testutil.Filetime(t))},
+		{vtype: valUint64, raw: testutil.AppendUint64(nil, id)},
+		{vtype: valString, raw: testutil.EncodeUTF16("host-a.example.net")},
+		{vtype: valSID, raw: sid},
+		{vtype: valString, raw: testutil.EncodeUTF16(user)},
+		{vtype: valString, raw: testutil.EncodeUTF16(ip)},
+		{vtype: valUint32, raw: testutil.AppendUint32(nil, 3)},
+	}
+}
+
+// buildEvtx generates an event log holding two logons and a log clear,
+// whose user data is embedded BinXML, followed by an empty chunk
+func buildEvtx() []byte {
+	w := newChunkWriter()
+	system := []byte{1, 1, 0, 0, 0, 0, 0, 5, 18, 0, 0, 0}
+	w.record(1, testLogonTime, "logon", logonTemplate(w), logonValues(1, testLogonTime, "administrator", "10.0.0.3", system))
+	w.record(2, testLogonTime, "logon", nil, logonValues(2, testLogonTime.Add(time.Hour), "bob", "192.168.1.5", nil))
+	w.record(3, testLogonTime, "clear", func() {
+		w.open("Event", false)
+		w.bytes(tokCloseStartElement)
+		w.open("System", false)
+		w.bytes(tokCloseStartElement)
+		w.element("EventID", 0, valUint16)
+		w.open("TimeCreated", true)
+		w.attr("SystemTime", false)
+		w.subst(1, valFiletime, false)
+		w.bytes(tokCloseEmptyElement)
+		w.bytes(tokEndElement)
+		w.subst(2, valBinXML, false)
+		w.bytes(tokEndElement)
+	}, []testValue{
+		{vtype: valUint16, raw: testutil.AppendUint16(nil, 1102)},
+		{vtype: valFiletime, raw: testutil.AppendUint64(nil, testutil.Filetime(testLogonTime.Add(2 * time.Hour)))},
+		{vtype: valBinXML, data: func(w *chunkWriter) {
+			w.bytes(tokFragmentHeader, 1, 1, 0)
+			w.open("UserData", false)
+			w.bytes(tokCloseStartElement)
+			w.open("LogFileCleared", false)
+			w.bytes(tokCloseStartElement)
+			w.open("SubjectUserName", false)
+			w.bytes(tokCloseStartElement)
+			w.value("administrator")
+			w.bytes(tokEndElement)
+			w.bytes(tokEndElement)
+			w.bytes(tokEndElement)
+			w.bytes(tokEOF)
+		}},
+	})
+	header := make([]byte, fileHeaderSize)
+	copy(header, fileSignature)
+	binary.LittleEndian.PutUint16(header[42:], 1)
+	return append(append(header, w.finish()...), make([]byte, chunkSize)...)
+}
+
+func TestParseEvtx(t *testing.T) {
+	buf := buildEvtx()
+	er, err := openEvtx(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if er.numChunks() != 2 {
+		t.Fatalf("expected 2 chunks, got %d", er.numChunks())
+	}
+	chunk, err := er.chunk(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []Event
+	parseChunk(chunk, func(ev Event, err error) bool {
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+		return true
+	})
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+	ev := events[0]
+	if ev.EventID != 4624 || ev.RecordID != 1 || ev.Channel != "Security" || ev.Computer != "host-a.example.net" ||
+		ev.Provider != "Microsoft-Windows-Security-Auditing" || ev.UserID != "S-1-5-18" ||
+		!ev.TimeCreated.Equal(testLogonTime) || ev.Data["TargetUserName"] != "administrator" ||
+		ev.Data["IpAddress"] != "10.0.0.3" || ev.Data["LogonType"] != "3" {
+		t.Fatalf("unexpected first event %+v", ev)
+	}
+	// the second record refers to the template of the first one, and has
+	// no user
+	ev = events[1]
+	if ev.EventID != 4624 || ev.UserID != "" || ev.Data["TargetUserName"] != "bob" ||
+		!ev.TimeCreated.Equal(testLogonTime.Add(time.Hour)) {
+		t.Fatalf("unexpected second event %+v", ev)
+	}
+	ev = events[2]
+	if ev.EventID != 1102 || ev.Data["SubjectUserName"] != "administrator" {
+		t.Fatalf("unexpected log clear event %+v", ev)
+	}
+	if chunk, err = er.chunk(1); chunk != nil || err != nil {
+		t.Fatalf("expected empty chunk to be skipped, got %v", err)
+	}
+
+	// a corrupted record is reported, and does not stop the chunk
+	chunk, _ = er.chunk(0)
+	chunk[chunkHeaderSize+recordHeaderSize+4] = 0x7f
+	var errs, parsed int
+	parseChunk(chunk, func(ev Event, err error) bool {
+		if err != nil {
+			errs++
+		} else {
+			parsed++
+		}
+		return true
+	})
+	if errs != 1 || parsed != 2 {
+		t.Fatalf("expected 1 error and 2 events, got %d and %d", errs, parsed)
+	}
+	if _, err := openEvtx(bytes.NewReader(buf[fileHeaderSize:]), chunkSize); err == nil {
+		t.Fatal("expected error on invalid file signature")
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	for _, tc := range []struct {
+		vtype    byte
+		data     []byte
+		expected string
+	}{
+		{valInt32, testutil.AppendUint32(nil, 0xfffffffe), "-2"},
+		{valBool, testutil.AppendUint32(nil, 1), "true"},
+		{valHex64, testutil.AppendUint64(nil, 0x1f), "0x1f"},
+		{valGUID, []byte{0x78, 0x56, 0x34, 0x12, 0x34, 0x12, 0x78, 0x56, 1, 2, 3, 4, 5, 6, 7, 8}, "{12345678-1234-5678-0102-030405060708}"},
+		{valSystemtime, []byte{0xe0, 7, 9, 0, 4, 0, 1, 0, 10, 0, 20, 0, 30, 0, 0, 0}, "2016-09-01T10:20:30Z"},
+		{valString | valArrayBit, append(append(testutil.EncodeUTF16("a"), 0, 0), append(testutil.EncodeUTF16("b"), 0, 0)...), "a, b"},
+		{valUint16 | valArrayBit, append(testutil.AppendUint16(nil, 1), testutil.AppendUint16(nil, 2)...), "1, 2"},
+		{valBinary, []byte{0xde, 0xad}, "DEAD"},
+	} {
+		if s := formatValue(tc.vtype, tc.data); s != tc.expected {
+			t.Fatalf("type 0x%x: expected %q, got %q", tc.vtype, tc.expected, s)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migevtx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "Security.evtx")
+	err = ioutil.WriteFile(path, buildEvtx(), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		p        params
+		expected []uint64
+	}{
+		{params{}, []uint64{1, 2, 3}},
+		{params{EventIDs: []int{4624}}, []uint64{1, 2}},
+		{params{EventIDs: []int{4624}, Fields: map[string]string{"IpAddress": `^10\.0\.0\.`}}, []uint64{1}},
+		{params{Fields: map[string]string{"TargetUserName": "(?i)^ADMIN", "Computer": "example.net$"}}, []uint64{1}},
+		{params{Fields: map[string]string{"SubjectUserName": "admin"}}, []uint64{3}},
+		{params{StartDate: testLogonTime.Add(time.Minute), EndDate: testLogonTime.Add(90 * time.Minute)}, []uint64{2}},
+		{params{MaxMatches: 2}, []uint64{1, 2}},
+		{params{EventIDs: []int{7045}}, nil},
+	} {
+		var r run
+		r.Parameters = tc.p
+		r.Parameters.Files = []string{filepath.Join(dir, "*.evtx")}
+		msg, err := modules.MakeMessage(modules.MsgClassParameters, r.Parameters, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res modules.Result
+		err = json.Unmarshal([]byte(r.Run(bytes.NewBuffer(msg))), &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Errors) > 0 {
+			t.Fatalf("%+v: unexpected errors %v", tc.p, res.Errors)
+		}
+		var el elements
+		err = res.GetElements(&el)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(el.Events) != len(tc.expected) {
+			t.Fatalf("%+v: expected %d events, got %+v", tc.p, len(tc.expected), el.Events)
+		}
+		for i, ev := range el.Events {
+			if ev.RecordID != tc.expected[i] || ev.File != path {
+				t.Fatalf("%+v: unexpected event %+v", tc.p, ev)
+			}
+		}
+		var stats statistics
+		err = res.GetStatistics(&stats)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.FilesSearched != 1 || stats.ChunksParsed != 1 || stats.LimitReached != (tc.p.MaxMatches > 0) {
+			t.Fatalf("%+v: unexpected statistics %+v", tc.p, stats)
+		}
+	}
+
+	var r run
+	r.Parameters.Files = []string{path}
+	r.Parameters.Fields = map[string]string{"IpAddress": "("}
+	if r.ValidateParameters() == nil {
+		t.Fatal("expected error on invalid field expression")
+	}
+	if channelFile("Microsoft-Windows-TaskScheduler/Operational") != "Microsoft-Windows-TaskScheduler%4Operational.evtx" {
+		t.Fatal("unexpected channel file name")
+	}
+}
@@ -0,0 +1,177 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package execution /* import "mig.ninja/mig/modules/execution" */
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	The audit daemon writes the records of an event on consecutive lines
+	sharing the time and serial number of the event:
+
+		type=SYSCALL msg=audit(1472725230.123:4242): arch=c000003e syscall=59 success=yes ... auid=1000 uid=1000 ... tty=pts0 comm="curl" exe="/usr/bin/curl"
+		type=EXECVE msg=audit(1472725230.123:4242): argc=2 a0="curl" a1=2D4F
+		type=CWD msg=audit(1472725230.123:4242): cwd="/tmp"
+
+	Values holding spaces or special characters are hex encoded instead of
+	quoted. Logs written with the enriched format end the lines with the
+	interpreted values after a 0x1d separator, which are ignored.
+*/
+
+// auditHeader matches the type, time and serial number of an audit record
+var auditHeader = regexp.MustCompile(`^(?:node=\S+ )?type=(\w+) msg=audit\((\d+)\.(\d+):(\d+)\):\s*`)
+
+// auditUnset is the value of the login uid of processes started outside
+// of a login session
+const auditUnset = "4294967295"
+
+// auditEvent accumulates the records of an audit event
+type auditEvent struct {
+	time    time.Time
+	syscall map[string]string
+	args    []string
+	cwd     string
+}
+
+// parseAudit returns the executions of an audit log, resolving the users
+// of the processes with the accounts of the system
+func parseAudit(r io.Reader, accounts *accounts) (events []Event, err error) {
+	var (
+		serials []string
+		pending = make(map[string]*auditEvent)
+	)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, 0x1d); i >= 0 {
+			line = line[:i]
+		}
+		m := auditHeader.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		typ, serial := m[1], m[4]
+		if typ != "SYSCALL" && typ != "EXECVE" && typ != "CWD" {
+			continue
+		}
+		ev, ok := pending[serial]
+		if !ok {
+			sec, _ := strconv.ParseInt(m[2], 10, 64)
+			ms, _ := strconv.ParseInt(m[3], 10, 64)
+			ev = &auditEvent{time: time.Unix(sec, ms*int64(time.Millisecond)).UTC()}
+			pending[serial] = ev
+			serials = append(serials, serial)
+		}
+		fields := auditFields(line[len(m[0]):])
+		switch typ {
+		case "SYSCALL":
+			ev.syscall = fields
+		case "EXECVE":
+			argc, _ := strconv.Atoi(fields["argc"])
+			for i := 0; i < argc; i++ {
+				ev.args = append(ev.args, fields["a"+strconv.Itoa(i)])
+			}
+		case "CWD":
+			ev.cwd = fields["cwd"]
+		}
+	}
+	for _, serial := range serials {
+		ev := pending[serial]
+		if ev.args == nil {
+			// only the events of an execve have arguments
+			continue
+		}
+		e := Event{
+			Type:        TypeExecve,
+			CommandLine: strings.Join(ev.args, " "),
+			Time:        ev.time,
+			Details:     map[string]string{"serial": serial},
+		}
+		e.Program = ev.syscall["exe"]
+		if e.Program == "" && len(ev.args) > 0 {
+			e.Program = ev.args[0]
+		}
+		for _, name := range []string{"uid", "auid", "pid", "ppid", "tty", "success"} {
+			if v, ok := ev.syscall[name]; ok {
+				e.Details[name] = v
+			}
+		}
+		if ev.cwd != "" {
+			e.Details["cwd"] = ev.cwd
+		}
+		// the login uid follows the user through su and sudo
+		uid := ev.syscall["auid"]
+		if uid == "" || uid == auditUnset {
+			uid = ev.syscall["uid"]
+		}
+		e.User = accounts.name(uid)
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
+
+// auditFields splits the name=value fields of an audit record, decoding
+// the quoted and hex encoded values
+func auditFields(s string) map[string]string {
+	fields := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		name := s[:eq]
+		s = s[eq+1:]
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				end = len(s) - 1
+			}
+			value = s[1 : end+1]
+			if end+2 < len(s) {
+				s = s[end+2:]
+			} else {
+				s = ""
+			}
+		} else {
+			end := strings.IndexByte(s, ' ')
+			if end < 0 {
+				end = len(s)
+			}
+			value = s[:end]
+			s = s[end:]
+			if b, err := hex.DecodeString(value); err == nil && auditHexField(name) {
+				value = string(b)
+			}
+		}
+		fields[name] = value
+	}
+	return fields
+}
+
+// auditHexField returns true for the fields that are hex encoded when they
+// are not quoted
+func auditHexField(name string) bool {
+	switch name {
+	case "exe", "comm", "cwd", "name", "proctitle":
+		return true
+	}
+	if len(name) > 1 && name[0] == 'a' {
+		_, err := strconv.Atoi(name[1:])
+		return err == nil
+	}
+	return false
+}
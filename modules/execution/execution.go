@@ -0,0 +1,623 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+/*
+
+If you run it, it will return a JSON struct with an array of the programs
+users ran and of their sessions on Linux and macOS systems, as the prefetch
+module does on Windows. If you add flag `-p`, it will pretty print the
+results.
+
+The following sources are read, all of them by default:
+- history: the bash and zsh histories of the home directories of the
+  users, timestamped when HISTTIMEFORMAT or EXTENDED_HISTORY are set
+- auditd: the executions recorded by the audit daemon in
+  /var/log/audit/audit.log, with rules such as `-a always,exit -F
+  arch=b64 -S execve`
+- wtmp: the logins, logouts and boots of /var/run/utmp and /var/log/wtmp
+- btmp: the failed logins of /var/log/btmp
+- lastlog: the last login of each user in /var/log/lastlog
+- journal: the commands run with sudo and the processes that logged
+  messages in the systemd journal files
+
+Rotated logs are read as well, but compressed ones are skipped. The files
+are read under `root`, which defaults to /, so the module also runs on
+mounted images of other systems, whose users are resolved with their own
+/etc/passwd.
+
+Events are filtered with:
+- programs: regular expressions matched against the program, the full path
+  of the executable or the first word of the command
+- users: user names
+- startdate, enddate: the time range of the events; untimed history lines
+  are excluded when a range is set
+At most `maxevents` events are returned, 1000 by default.
+
+Example JSON
+-------------
+
+{
+    "module": "execution",
+    "parameters": {
+        "sources": ["history", "auditd", "journal"],
+        "programs": ["(^|/)(nc|ncat|socat|curl|wget)$"],
+        "startdate": "2016-09-01T00:00:00Z"
+    }
+}
+*/
+package execution /* import "mig.ninja/mig/modules/execution" */
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mig.ninja/mig/modules"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+/*
+	An instance of this type will represent this module; it's possible to add additional data fields here,
+	although that is rarely needed.
+*/
+type module struct {
+}
+
+func (m *module) NewRun() modules.Runner {
+	return new(run)
+}
+
+/*
+	init is called by the Go runtime at startup. We use this function to register the module in a
+	global array of available modules, so the agent knows we exist
+*/
+func init() {
+	modules.Register("execution", new(module))
+}
+
+type run struct {
+	Parameters params
+	Results    modules.Result
+	stop       chan bool // closed when the module is asked to stop early
+}
+
+// defaultMaxEvents is the number of events returned when the parameters
+// set no limit
+const defaultMaxEvents = 1000
+
+/*
+	- Root: Alternate root of the system, such as a mounted image. Defaults to /
+	- Sources: "history", "auditd", "wtmp", "btmp", "lastlog" and/or
+			   "journal", all of them are read if empty
+	- Programs: Regular expressions of the programs
+	- Users: Names of the users
+	- StartDate, EndDate: Time range of the events
+	- MaxEvents: Maximum number of events returned, defaults to 1000
+*/
+type params struct {
+	Root      string    `json:"root,omitempty"`
+	Sources   []string  `json:"sources,omitempty"`
+	Programs  []string  `json:"programs,omitempty"`
+	Users     []string  `json:"users,omitempty"`
+	StartDate time.Time `json:"startdate,omitempty"`
+	EndDate   time.Time `json:"enddate,omitempty"`
+	MaxEvents int       `json:"maxevents,omitempty"`
+	Debug     bool      `json:"debug,omitempty"`
+}
+
+const (
+	SourceHistory = "history"
+	SourceAuditd  = "auditd"
+	SourceWtmp    = "wtmp"
+	SourceBtmp    = "btmp"
+	SourceLastlog = "lastlog"
+	SourceJournal = "journal"
+)
+
+var allSources = []string{SourceHistory, SourceAuditd, SourceWtmp, SourceBtmp, SourceLastlog, SourceJournal}
+
+const (
+	TypeCommand     = "command"     // command typed in a shell
+	TypeExecve      = "execve"      // execution recorded by auditd
+	TypeProcess     = "process"     // process that logged in the journal
+	TypeSudo        = "sudo"        // command run with sudo
+	TypeLogin       = "login"       // session opened
+	TypeLogout      = "logout"      // session closed
+	TypeBoot        = "boot"        // system started
+	TypeFailedLogin = "failedlogin" // failed login attempt
+	TypeLastLogin   = "lastlogin"   // last login of a user
+)
+
+/*
+	Event is a program run by a user, or a session of a user. Source is the
+	source of the event and File the file it was read from. Program is the
+	executable, or the first word of the command for the shell histories.
+	Details holds the fields specific to each source, such as the pid, the
+	terminal or the remote host of a session. Time is zero for the history
+	lines that are not timestamped.
+*/
+type Event struct {
+	Source      string                 `json:"source"`
+	File        string                 `json:"file"`
+	Type        string                 `json:"type"`
+	User        string                 `json:"user,omitempty"`
+	Program     string                 `json:"program,omitempty"`
+	CommandLine string                 `json:"commandline,omitempty"`
+	Time        time.Time              `json:"time"`
+	Details     map[string]string      `json:"details,omitempty"`
+	Times       []modules.ArtefactTime `json:"times,omitempty"`
+}
+
+type elements struct {
+	Events []Event `json:"executionresults,omitempty"`
+}
+
+/* Statistic counters:
+- FilesParsed is the number of files read
+- EventsFound is the number of events found in those files
+- Matches is the number of events matching the filters
+- LimitReached is set when the search stopped at MaxEvents events
+- Exectime is the total runtime of the search
+*/
+type statistics struct {
+	FilesParsed  int           `json:"filesparsed"`
+	EventsFound  int           `json:"eventsfound"`
+	Matches      int           `json:"matches"`
+	LimitReached bool          `json:"limitreached,omitempty"`
+	Exectime     time.Duration `json:"exectime"`
+}
+
+/*
+	ValidateParameters *must* be implemented by a module. It provides a method to verify that the parameters
+	passed to the module conform the expected format. It must return an error if the parameters do not validate.
+*/
+func (r *run) ValidateParameters() (err error) {
+	p := r.Parameters
+	if p.Root == "" && runtime.GOOS == "windows" {
+		return fmt.Errorf("ValidateParameters: Root must be set on Windows.")
+	}
+	for _, s := range p.Sources {
+		valid := false
+		for _, known := range allSources {
+			valid = valid || s == known
+		}
+		if !valid {
+			return fmt.Errorf("ValidateParameters: Invalid source %q. Must be one of %s.", s, strings.Join(allSources, ", "))
+		}
+	}
+	for _, expr := range p.Programs {
+		if _, err := regexp.Compile(expr); err != nil {
+			return fmt.Errorf("ValidateParameters: Invalid regular expression %q: %v", expr, err)
+		}
+	}
+	if !p.StartDate.IsZero() && !p.EndDate.IsZero() && p.EndDate.Before(p.StartDate) {
+		return fmt.Errorf("ValidateParameters: EndDate is *BEFORE* StartDate.")
+	}
+	if p.MaxEvents < 0 {
+		return fmt.Errorf("ValidateParameters: MaxEvents must be positive.")
+	}
+	return
+}
+
+/*
+	Run *must* be implemented by a module. Its the function that executes the module. It must return a string of
+	marshalled json that contains the results from the module. The code below provides a base module skeleton that
+	can be reused in all modules.
+*/
+func (r *run) Run(in io.Reader) (out string) {
+	// a good way to handle execution failures is to catch panics and store
+	// the panicked error into modules.Results.Errors, marshal that, and output
+	// the JSON string back to the caller
+	defer func() {
+		if e := recover(); e != nil {
+			r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%v", e))
+			r.Results.Success = false
+			buf, _ := json.Marshal(r.Results)
+			out = string(buf[:])
+		}
+	}()
+
+	// read module parameters from stdin
+	err := modules.ReadInputParameters(in, &r.Parameters)
+	if err != nil {
+		panic(err)
+	}
+	// verify that the parameters we received are valid
+	err = r.ValidateParameters()
+	if err != nil {
+		panic(err)
+	}
+
+	// start a goroutine that does some work and another one that looks
+	// for an early stop signal
+	moduleDone := make(chan bool)
+	stop := make(chan bool)
+	r.stop = make(chan bool)
+	go r.doModuleStuff(&out, &moduleDone)
+	go modules.WatchForStop(in, &stop)
+
+	select {
+	case <-moduleDone:
+		return out
+	case <-stop:
+		// the module builds its results from what it collected so far
+		close(r.stop)
+		<-moduleDone
+		return out
+	}
+}
+
+/* doModuleStuff is an internal module function that does things specific to the module. There is no implementation requirement.
+   It's good practice to have it return the JSON string Run() expects to return. We also make it return a boolean in the `moduleDone`
+   channel to do flow control in Run().
+*/
+func (r *run) doModuleStuff(out *string, moduleDone *chan bool) error {
+	var (
+		el    elements
+		stats statistics
+	)
+	t0 := time.Now()
+
+	root := r.Parameters.Root
+	if root == "" {
+		root = "/"
+	}
+	max := r.Parameters.MaxEvents
+	if max == 0 {
+		max = defaultMaxEvents
+	}
+	var programs []*regexp.Regexp
+	for _, expr := range r.Parameters.Programs {
+		programs = append(programs, regexp.MustCompile(expr))
+	}
+	accounts := readAccounts(root)
+	for _, lf := range r.logFiles(root, accounts) {
+		if stats.LimitReached {
+			break
+		}
+		if modules.IsStopped(r.stop) {
+			r.Results.Errors = append(r.Results.Errors, modules.StoppedEarly)
+			break
+		}
+		if r.Parameters.Debug {
+			fmt.Println("Parsing ", lf.path, "....")
+		}
+		events, err := parseLogFile(lf, accounts)
+		if err != nil {
+			r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%s: %v", lf.path, err))
+			if events == nil {
+				continue
+			}
+		}
+		stats.FilesParsed++
+		for _, e := range events {
+			stats.EventsFound++
+			if e.User == "" {
+				e.User = lf.user
+			}
+			if stats.LimitReached || !r.match(e, programs) {
+				continue
+			}
+			e.Source = lf.source
+			e.File = lf.path
+			if !e.Time.IsZero() {
+				e.Times = []modules.ArtefactTime{modules.NewArtefactTime(timeKind(e.Type), e.Time, "execution")}
+			}
+			stats.Matches++
+			el.Events = append(el.Events, e)
+			if stats.Matches >= max {
+				stats.LimitReached = true
+			}
+		}
+	}
+	stats.Exectime = time.Now().Sub(t0)
+
+	// marshal the results into a json string
+	*out = r.buildResults(el, stats)
+	*moduleDone <- true
+	return nil
+}
+
+// match returns true if an event matches the programs, users and time range
+// of the parameters
+func (r *run) match(e Event, programs []*regexp.Regexp) bool {
+	p := r.Parameters
+	if len(programs) > 0 {
+		found := false
+		for _, re := range programs {
+			if e.Program != "" && re.MatchString(e.Program) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(p.Users) > 0 {
+		found := false
+		for _, u := range p.Users {
+			found = found || u == e.User
+		}
+		if !found {
+			return false
+		}
+	}
+	if p.StartDate.IsZero() && p.EndDate.IsZero() {
+		return true
+	}
+	if e.Time.IsZero() {
+		return false
+	}
+	if !p.StartDate.IsZero() && e.Time.Before(p.StartDate) {
+		return false
+	}
+	if !p.EndDate.IsZero() && e.Time.After(p.EndDate) {
+		return false
+	}
+	return true
+}
+
+// timeKind returns the kind of artefact time of a type of event
+func timeKind(typ string) string {
+	switch typ {
+	case TypeLogin, TypeLastLogin:
+		return modules.ArtefactTimeLogin
+	case TypeLogout:
+		return modules.ArtefactTimeLogout
+	case TypeFailedLogin:
+		return modules.ArtefactTimeFailedLogin
+	case TypeBoot:
+		return modules.ArtefactTimeBoot
+	}
+	return modules.ArtefactTimeExecuted
+}
+
+// logFile is a file to read, with its source and the user owning it for
+// the shell histories
+type logFile struct {
+	source string
+	path   string
+	user   string
+}
+
+// logFiles returns the files of the sources of the parameters
+func (r *run) logFiles(root string, accounts *accounts) (files []logFile) {
+	sources := r.Parameters.Sources
+	if len(sources) == 0 {
+		sources = allSources
+	}
+	glob := func(source string, patterns ...string) {
+		for _, pattern := range patterns {
+			matches, _ := filepath.Glob(filepath.Join(root, pattern))
+			for _, path := range matches {
+				if fi, err := os.Stat(path); err != nil || !fi.Mode().IsRegular() || compressed(path) {
+					continue
+				}
+				files = append(files, logFile{source: source, path: path})
+			}
+		}
+	}
+	for _, source := range sources {
+		switch source {
+		case SourceHistory:
+			for _, home := range accounts.homeDirs(root) {
+				for _, hf := range historyFiles {
+					matches, _ := filepath.Glob(filepath.Join(home.path, hf.path))
+					for _, path := range matches {
+						files = append(files, logFile{source: SourceHistory, path: path, user: home.user})
+					}
+				}
+			}
+		case SourceAuditd:
+			glob(source, "var/log/audit/audit.log", "var/log/audit/audit.log.*")
+		case SourceWtmp:
+			glob(source, "var/run/utmp", "run/utmp", "var/log/wtmp", "var/log/wtmp.*", "var/log/wtmp-*")
+		case SourceBtmp:
+			glob(source, "var/log/btmp", "var/log/btmp.*", "var/log/btmp-*")
+		case SourceLastlog:
+			glob(source, "var/log/lastlog")
+		case SourceJournal:
+			glob(source, "var/log/journal/*/*.journal", "var/log/journal/*/*.journal~",
+				"run/log/journal/*/*.journal", "run/log/journal/*/*.journal~")
+		}
+	}
+	return
+}
+
+// compressed returns true for the rotated logs that were compressed
+func compressed(path string) bool {
+	switch filepath.Ext(path) {
+	case ".gz", ".xz", ".bz2", ".zst", ".lz4":
+		return true
+	}
+	return false
+}
+
+// parseLogFile returns the events of a file
+func parseLogFile(lf logFile, accounts *accounts) (events []Event, err error) {
+	fd, err := os.Open(lf.path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	switch lf.source {
+	case SourceHistory:
+		if filepath.Base(lf.path) == ".bash_history" {
+			events, err = parseBashHistory(fd)
+			for i := range events {
+				events[i].Details = map[string]string{"shell": "bash"}
+			}
+		} else {
+			events, err = parseZshHistory(fd)
+			for i := range events {
+				events[i].Details = map[string]string{"shell": "zsh"}
+			}
+		}
+	case SourceAuditd:
+		events, err = parseAudit(fd, accounts)
+	case SourceWtmp:
+		events, err = parseUtmp(fd, false)
+	case SourceBtmp:
+		events, err = parseUtmp(fd, true)
+	case SourceLastlog:
+		events, err = parseLastlog(fd, accounts)
+	case SourceJournal:
+		events, err = parseJournal(fd, accounts)
+	}
+	return
+}
+
+// accounts are the users of the system, read from its /etc/passwd
+type accounts struct {
+	names map[string]string // user names by uid
+	homes map[string]string // home directories by user name
+}
+
+// readAccounts reads the users of the /etc/passwd of a root, and ignores
+// a missing or unreadable file
+func readAccounts(root string) *accounts {
+	a := &accounts{names: make(map[string]string), homes: make(map[string]string)}
+	fd, err := os.Open(filepath.Join(root, "etc", "passwd"))
+	if err != nil {
+		return a
+	}
+	defer fd.Close()
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		f := strings.Split(scanner.Text(), ":")
+		if len(f) < 7 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		if _, ok := a.names[f[2]]; !ok {
+			a.names[f[2]] = f[0]
+		}
+		a.homes[f[0]] = f[5]
+	}
+	return a
+}
+
+// name returns the name of the user of a uid, or the uid if it is unknown
+func (a *accounts) name(uid string) string {
+	if name, ok := a.names[uid]; ok {
+		return name
+	}
+	return uid
+}
+
+type homeDir struct {
+	user string
+	path string
+}
+
+// homeDirs returns the home directories of the users of /etc/passwd, and
+// the directories of /home, /Users and /root that belong to no user, such
+// as the homes of deleted or directory users
+func (a *accounts) homeDirs(root string) (homes []homeDir) {
+	seen := make(map[string]bool)
+	add := func(user, path string) {
+		path = filepath.Join(root, path)
+		if seen[path] {
+			return
+		}
+		if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+			return
+		}
+		seen[path] = true
+		homes = append(homes, homeDir{user: user, path: path})
+	}
+	for user, home := range a.homes {
+		// system accounts share / or /nonexistent as their home
+		if home == "" || home == "/" || home == "/nonexistent" {
+			continue
+		}
+		add(user, home)
+	}
+	add("root", "root")
+	add("root", "var/root")
+	for _, dir := range []string{"home", "Users"} {
+		entries, err := ioutil.ReadDir(filepath.Join(root, dir))
+		if err != nil {
+			continue
+		}
+		for _, fi := range entries {
+			if fi.IsDir() {
+				add(fi.Name(), filepath.Join(dir, fi.Name()))
+			}
+		}
+	}
+	return
+}
+
+// buildResults takes the results found by the module, as well as statistics,
+// and puts all that into a JSON string. It also takes care of setting the
+// success and foundanything flags.
+func (r *run) buildResults(el elements, stats statistics) string {
+	if len(r.Results.Errors) == 0 {
+		r.Results.Success = true
+	}
+	r.Results.Elements = el
+	r.Results.Statistics = stats
+	if len(el.Events) > 0 {
+		r.Results.FoundAnything = true
+	}
+	jsonOutput, err := json.Marshal(r.Results)
+	if err != nil {
+		panic(err)
+	}
+	return string(jsonOutput[:])
+}
+
+// PrintResults() is an *optional* method that returns results in a human-readable format.
+// if matchOnly is set, only results that have at least one match are returned.
+// If matchOnly is not set, all results are returned, along with errors and statistics.
+func (r *run) PrintResults(result modules.Result, matchOnly bool) (prints []string, err error) {
+	var (
+		el    elements
+		stats statistics
+	)
+	err = result.GetElements(&el)
+	if err != nil {
+		panic(err)
+	}
+	prints = append(prints, fmt.Sprintf("\n-----------------\n     Execution Results           \n------------------"))
+	for _, e := range el.Events {
+		when := "unknown time"
+		if !e.Time.IsZero() {
+			when = e.Time.Format(time.RFC3339)
+		}
+		prints = append(prints, fmt.Sprintf("%s %s, User: %s, Time: %s, File: %s", e.Source, e.Type, e.User, when, e.File))
+		if e.CommandLine != "" {
+			prints = append(prints, fmt.Sprintf("    Command: %s", e.CommandLine))
+		} else if e.Program != "" {
+			prints = append(prints, fmt.Sprintf("    Program: %s", e.Program))
+		}
+		if host := e.Details["host"]; host != "" {
+			prints = append(prints, fmt.Sprintf("    Host: %s, Line: %s", host, e.Details["line"]))
+		}
+	}
+
+	for _, e := range result.Errors {
+		prints = append(prints, fmt.Sprintf("error: %v", e))
+	}
+	err = result.GetStatistics(&stats)
+	if err != nil {
+		panic(err)
+	}
+	prints = append(prints, fmt.Sprintf("Files Parsed    : %d", stats.FilesParsed))
+	prints = append(prints, fmt.Sprintf("Events Found    : %d", stats.EventsFound))
+	prints = append(prints, fmt.Sprintf("Matches         : %d", stats.Matches))
+	if stats.LimitReached {
+		prints = append(prints, "Search stopped at the maximum number of events")
+	}
+	return
+}
@@ -0,0 +1,406 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package execution /* import "mig.ninja/mig/modules/execution" */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"mig.ninja/mig/modules"
+	"mig.ninja/mig/testutil"
+)
+
+func TestRegistration(t *testing.T) {
+	testutil.CheckModuleRegistration(t, "execution")
+}
+
+func TestProgramOf(t *testing.T) {
+	for cmd, expected := range map[string]string{
+		"ls -la":                              "ls",
+		"LANG=C sort file":                    "sort",
+		"sudo -u postgres psql":               "psql",
+		"sudo nohup ./run.sh &":               "./run.sh",
+		"env -i PATH=/bin /usr/bin/curl -k x": "/usr/bin/curl",
+		`"/opt/my tools/x"`:                   "/opt/my",
+		"":                                    "",
+	} {
+		if p := programOf(cmd); p != expected {
+			t.Errorf("programOf(%q) = %q, expected %q", cmd, p, expected)
+		}
+	}
+}
+
+const testBashHistory = `ls
+#1472725230
+curl -o /tmp/x http://example.net/x
+# not a timestamp
+chmod +x /tmp/x
+`
+
+var testZshHistory = ": 1472725300:0;wget http://example.net/y\n" +
+	": 1472725310:2;for f in *; do\\\necho $f\\\ndone\n" +
+	"echo caf\xc3\x83\x89\n"
+
+func TestParseHistory(t *testing.T) {
+	events, err := parseBashHistory(strings.NewReader(testBashHistory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 bash commands, got %+v", events)
+	}
+	if !events[0].Time.IsZero() || events[1].Program != "curl" || events[1].Time.Unix() != 1472725230 || !events[2].Time.IsZero() {
+		t.Errorf("unexpected bash commands %+v", events)
+	}
+	events, err = parseZshHistory(strings.NewReader(testZshHistory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 zsh commands, got %+v", events)
+	}
+	if events[0].Program != "wget" || events[0].Time.Unix() != 1472725300 {
+		t.Errorf("unexpected first zsh command %+v", events[0])
+	}
+	if events[1].CommandLine != "for f in *; do\necho $f\ndone" || events[1].Time.Unix() != 1472725310 {
+		t.Errorf("unexpected multiline zsh command %q", events[1].CommandLine)
+	}
+	if events[2].CommandLine != "echo café" {
+		t.Errorf("unexpected metafied zsh command %q", events[2].CommandLine)
+	}
+}
+
+const testAuditLog = `type=SYSCALL msg=audit(1472725230.123:4242): arch=c000003e syscall=59 success=yes exit=0 ppid=900 pid=901 auid=1000 uid=0 gid=0 tty=pts0 comm="curl" exe="/usr/bin/curl" key="exec"` + "\x1d" + `AUID="alice" UID="root"
+type=EXECVE msg=audit(1472725230.123:4242): argc=3 a0="curl" a1="-o" a2=2F746D702F6D792066696C65
+type=CWD msg=audit(1472725230.123:4242): cwd="/root"
+type=PATH msg=audit(1472725230.123:4242): item=0 name="/usr/bin/curl"
+type=SYSCALL msg=audit(1472725231.000:4243): arch=c000003e syscall=2 success=yes auid=4294967295 uid=0 comm="cron" exe="/usr/sbin/cron"
+type=SYSCALL msg=audit(1472725232.500:4244): arch=c000003e syscall=59 success=yes ppid=1 pid=950 auid=4294967295 uid=33 comm="sh" exe=2F62696E2F64617368
+type=EXECVE msg=audit(1472725232.500:4244): argc=2 a0="sh" a1="-c"
+`
+
+func testAccounts() *accounts {
+	return &accounts{
+		names: map[string]string{"0": "root", "33": "www-data", "1000": "alice"},
+		homes: map[string]string{"root": "/root", "www-data": "/var/www", "alice": "/home/alice"},
+	}
+}
+
+func TestParseAudit(t *testing.T) {
+	events, err := parseAudit(strings.NewReader(testAuditLog), testAccounts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 executions, got %+v", events)
+	}
+	e := events[0]
+	if e.Program != "/usr/bin/curl" || e.CommandLine != "curl -o /tmp/my file" || e.User != "alice" ||
+		e.Details["cwd"] != "/root" || e.Details["pid"] != "901" || e.Time.UnixNano() != 1472725230123000000 {
+		t.Errorf("unexpected execution %+v", e)
+	}
+	e = events[1]
+	if e.Program != "/bin/dash" || e.User != "www-data" || e.CommandLine != "sh -c" {
+		t.Errorf("unexpected execution %+v", e)
+	}
+}
+
+// buildUtmp returns a utmp record
+func buildUtmp(typ int16, line, user, host string, ip [4]byte, ts time.Time) []byte {
+	b := make([]byte, utmpSize)
+	binary.LittleEndian.PutUint16(b[0:], uint16(typ))
+	binary.LittleEndian.PutUint32(b[4:], 4242)
+	copy(b[8:40], line)
+	copy(b[44:76], user)
+	copy(b[76:332], host)
+	binary.LittleEndian.PutUint32(b[340:], uint32(ts.Unix()))
+	copy(b[348:352], ip[:])
+	return b
+}
+
+func testWtmp(base time.Time) []byte {
+	var b []byte
+	b = append(b, buildUtmp(utmpBootTime, "~", "reboot", "4.4.0", [4]byte{}, base)...)
+	b = append(b, buildUtmp(utmpUserProcess, "pts/0", "alice", "203.0.113.7", [4]byte{203, 0, 113, 7}, base.Add(time.Hour))...)
+	b = append(b, buildUtmp(utmpDeadProcess, "pts/0", "", "", [4]byte{}, base.Add(2*time.Hour))...)
+	// login processes waiting on terminals are not sessions
+	b = append(b, buildUtmp(6, "tty1", "LOGIN", "", [4]byte{}, base)...)
+	return b
+}
+
+func buildLastlog(records map[int]time.Time) []byte {
+	b := make([]byte, lastlogSize*1001)
+	for uid, ts := range records {
+		binary.LittleEndian.PutUint32(b[uid*lastlogSize:], uint32(ts.Unix()))
+		copy(b[uid*lastlogSize+4:], "pts/1")
+		copy(b[uid*lastlogSize+36:], "198.51.100.2")
+	}
+	return b
+}
+
+func TestParseUtmp(t *testing.T) {
+	base := time.Date(2016, 9, 1, 10, 0, 0, 0, time.UTC)
+	events, err := parseUtmp(bytes.NewReader(testWtmp(base)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %+v", events)
+	}
+	for i, expected := range []struct {
+		typ, user string
+		time      time.Time
+	}{
+		{TypeBoot, "reboot", base},
+		{TypeLogin, "alice", base.Add(time.Hour)},
+		{TypeLogout, "alice", base.Add(2 * time.Hour)},
+	} {
+		e := events[i]
+		if e.Type != expected.typ || e.User != expected.user || !e.Time.Equal(expected.time) {
+			t.Errorf("event %d: expected %+v, got %+v", i, expected, e)
+		}
+	}
+	if events[1].Details["address"] != "203.0.113.7" || events[1].Details["line"] != "pts/0" {
+		t.Errorf("unexpected login details %v", events[1].Details)
+	}
+	events, err = parseUtmp(bytes.NewReader(testWtmp(base)[:utmpSize+10]), true)
+	if err == nil || len(events) != 1 || events[0].Type != TypeFailedLogin {
+		t.Errorf("expected a failed login and an error, got %+v, %v", events, err)
+	}
+
+	events, err = parseLastlog(bytes.NewReader(buildLastlog(map[int]time.Time{1000: base})), testAccounts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].User != "alice" || !events[0].Time.Equal(base) || events[0].Details["host"] != "198.51.100.2" {
+		t.Errorf("unexpected last logins %+v", events)
+	}
+}
+
+// buildJournal returns a journal file holding entries made of fields
+func buildJournal(compact bool, entries []map[string]string, times []time.Time) []byte {
+	const headerSize = 256
+	b := make([]byte, headerSize)
+	copy(b, journalSignature)
+	if compact {
+		binary.LittleEndian.PutUint32(b[12:], journalCompact)
+	}
+	binary.LittleEndian.PutUint64(b[88:], headerSize)
+	align := func() {
+		for len(b)%8 != 0 {
+			b = append(b, 0)
+		}
+	}
+	payload := 64
+	if compact {
+		payload = 72
+	}
+	data := make(map[string]uint64)
+	for _, fields := range entries {
+		for name, value := range fields {
+			kv := name + "=" + value
+			if _, ok := data[kv]; ok {
+				continue
+			}
+			align()
+			data[kv] = uint64(len(b))
+			obj := make([]byte, payload)
+			obj[0] = journalObjectData
+			binary.LittleEndian.PutUint64(obj[8:], uint64(payload+len(kv)))
+			b = append(append(b, obj...), kv...)
+		}
+	}
+	// a compressed field is skipped
+	align()
+	zipped := uint64(len(b))
+	obj := make([]byte, payload+8)
+	obj[0], obj[1] = journalObjectData, 4
+	binary.LittleEndian.PutUint64(obj[8:], uint64(len(obj)))
+	b = append(b, obj...)
+	for i, fields := range entries {
+		offsets := []uint64{zipped}
+		for name, value := range fields {
+			offsets = append(offsets, data[name+"="+value])
+		}
+		align()
+		entry := make([]byte, 64)
+		entry[0] = journalObjectEntry
+		binary.LittleEndian.PutUint64(entry[24:], uint64(times[i].UnixNano()/1000))
+		for _, off := range offsets {
+			if compact {
+				entry = testutil.AppendUint32(entry, uint32(off))
+			} else {
+				entry = testutil.AppendUint32(testutil.AppendUint32(entry, uint32(off)), uint32(off>>32))
+				entry = append(entry, make([]byte, 8)...)
+			}
+		}
+		binary.LittleEndian.PutUint64(entry[8:], uint64(len(entry)))
+		b = append(b, entry...)
+	}
+	align()
+	binary.LittleEndian.PutUint64(b[96:], uint64(len(b)-headerSize))
+	// the end of the file is preallocated
+	return append(b, make([]byte, 4096)...)
+}
+
+func testJournal(compact bool, base time.Time) []byte {
+	return buildJournal(compact, []map[string]string{
+		{"_EXE": "/usr/sbin/sshd", "_CMDLINE": "sshd: alice [priv]", "_UID": "0", "_PID": "700", "MESSAGE": "Accepted publickey for alice"},
+		{"SYSLOG_IDENTIFIER": "sudo", "_EXE": "/usr/bin/sudo", "MESSAGE": "alice : TTY=pts/0 ; PWD=/home/alice ; USER=root ; COMMAND=/usr/bin/apt install nmap"},
+		{"_EXE": "/usr/sbin/sshd", "_CMDLINE": "sshd: alice [priv]", "_UID": "0", "_PID": "700", "MESSAGE": "session opened"},
+		{"MESSAGE": "kernel message"},
+	}, []time.Time{base.Add(time.Minute), base.Add(2 * time.Minute), base, base.Add(3 * time.Minute)})
+}
+
+func TestParseJournal(t *testing.T) {
+	base := time.Date(2016, 9, 1, 10, 0, 0, 0, time.UTC)
+	for _, compact := range []bool{false, true} {
+		events, err := parseJournal(bytes.NewReader(testJournal(compact, base)), testAccounts())
+		if err != nil {
+			t.Fatalf("compact %v: %v", compact, err)
+		}
+		if len(events) != 2 {
+			t.Fatalf("compact %v: expected 2 events, got %+v", compact, events)
+		}
+		// the process is reported at the time of its earliest entry
+		e := events[0]
+		if e.Type != TypeProcess || e.Program != "/usr/sbin/sshd" || e.User != "root" || !e.Time.Equal(base) {
+			t.Errorf("compact %v: unexpected process %+v", compact, e)
+		}
+		e = events[1]
+		if e.Type != TypeSudo || e.User != "alice" || e.Program != "/usr/bin/apt" ||
+			e.CommandLine != "/usr/bin/apt install nmap" || e.Details["user"] != "root" {
+			t.Errorf("compact %v: unexpected sudo command %+v", compact, e)
+		}
+	}
+	if _, err := parseJournal(bytes.NewReader(make([]byte, 512)), testAccounts()); err == nil {
+		t.Errorf("expected an error on an invalid journal")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migexecution")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := time.Date(2016, 9, 1, 10, 0, 0, 0, time.UTC)
+	files := map[string][]byte{
+		"etc/passwd": []byte("root:x:0:0:root:/root:/bin/bash\n" +
+			"www-data:x:33:33:www-data:/var/www:/usr/sbin/nologin\n" +
+			"alice:x:1000:1000:Alice,,,:/home/alice:/bin/bash\n"),
+		"root/.bash_history":                  []byte("id\n"),
+		"home/alice/.bash_history":            []byte(testBashHistory),
+		"home/bob/.zsh_history":               []byte(testZshHistory),
+		"var/log/audit/audit.log":             []byte(testAuditLog),
+		"var/log/audit/audit.log.1.gz":        []byte("compressed"),
+		"var/log/wtmp":                        testWtmp(base),
+		"var/log/btmp":                        buildUtmp(6, "ssh:notty", "admin", "192.0.2.1", [4]byte{192, 0, 2, 1}, base),
+		"var/log/lastlog":                     buildLastlog(map[int]time.Time{1000: base}),
+		"var/log/journal/0123/system.journal": testJournal(false, base),
+	}
+	for path, data := range files {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		p        params
+		expected []string
+	}{
+		{params{Sources: []string{SourceWtmp, SourceBtmp, SourceLastlog}}, []string{
+			"wtmp boot reboot", "wtmp login alice", "wtmp logout alice", "btmp failedlogin admin", "lastlog lastlogin alice",
+		}},
+		{params{Sources: []string{SourceHistory}, Users: []string{"alice", "bob"}}, []string{
+			"history command alice ls", "history command alice curl", "history command alice chmod",
+			"history command bob wget", "history command bob for", "history command bob echo",
+		}},
+		{params{Programs: []string{`(^|/)(curl|wget|apt)$`}}, []string{
+			"history command alice curl", "history command bob wget",
+			"auditd execve alice /usr/bin/curl", "journal sudo alice /usr/bin/apt",
+		}},
+		{params{StartDate: base.Add(30 * time.Second), EndDate: base.Add(90 * time.Minute)}, []string{
+			"wtmp login alice", "history command alice curl", "history command bob wget",
+			"history command bob for", "auditd execve alice /usr/bin/curl",
+			"auditd execve www-data /bin/dash", "journal sudo alice /usr/bin/apt",
+		}},
+		{params{Sources: []string{SourceHistory}, MaxEvents: 2}, nil},
+	} {
+		var r run
+		r.Parameters = tc.p
+		r.Parameters.Root = dir
+		msg, err := modules.MakeMessage(modules.MsgClassParameters, r.Parameters, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res modules.Result
+		err = json.Unmarshal([]byte(r.Run(bytes.NewBuffer(msg))), &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Errors) > 0 {
+			t.Fatalf("%+v: unexpected errors %v", tc.p, res.Errors)
+		}
+		var el elements
+		if err := res.GetElements(&el); err != nil {
+			t.Fatal(err)
+		}
+		var stats statistics
+		if err := res.GetStatistics(&stats); err != nil {
+			t.Fatal(err)
+		}
+		if tc.p.MaxEvents > 0 {
+			if len(el.Events) != tc.p.MaxEvents || !stats.LimitReached {
+				t.Errorf("expected the search to stop at %d events, got %d", tc.p.MaxEvents, len(el.Events))
+			}
+			continue
+		}
+		var found []string
+		for _, e := range el.Events {
+			found = append(found, strings.TrimSpace(strings.Join([]string{e.Source, e.Type, e.User, e.Program}, " ")))
+			if !e.Time.IsZero() && (len(e.Times) != 1 || e.Times[0].Kind != timeKind(e.Type)) {
+				t.Errorf("unexpected times %+v", e.Times)
+			}
+		}
+		if !sameEvents(found, tc.expected) {
+			t.Errorf("%+v: expected %q, got %q", tc.p, tc.expected, found)
+		}
+	}
+}
+
+// sameEvents compares lists of events regardless of the order of the
+// files they were read from
+func sameEvents(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	count := make(map[string]int)
+	for _, s := range a {
+		count[s]++
+	}
+	for _, s := range b {
+		count[s]--
+	}
+	for _, n := range count {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,173 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package execution /* import "mig.ninja/mig/modules/execution" */
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Bash writes one command per line to ~/.bash_history. When HISTTIMEFORMAT
+	is set, each command is preceded by a comment holding its epoch time,
+	such as "#1472725230".
+
+	Zsh writes to ~/.zsh_history, or to the file set by HISTFILE, usually
+	~/.histfile. With EXTENDED_HISTORY, lines are prefixed by the epoch and
+	the duration of the command, as ": 1472725230:0;ls -la". Commands
+	spanning several lines end their lines with a backslash. Bytes that
+	are not printable are "metafied": written as 0x83 followed by the byte
+	xored with 0x20. On macOS, Terminal keeps the history of each session
+	in ~/.zsh_sessions.
+*/
+
+// zshMeta is the byte announcing a metafied byte in a zsh history
+const zshMeta = 0x83
+
+// historyFiles are the history files of a home directory, by shell
+var historyFiles = []struct {
+	path  string
+	shell string
+}{
+	{".bash_history", "bash"},
+	{".zsh_history", "zsh"},
+	{".histfile", "zsh"},
+	{".zsh_sessions/*.history", "zsh"},
+	{".zsh_sessions/*.historynew", "zsh"},
+}
+
+// parseBashHistory returns the commands of a bash history
+func parseBashHistory(r io.Reader) (events []Event, err error) {
+	var ts time.Time
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line[0] == '#' {
+			// timestamps are comments, other comments are skipped
+			if sec, err := strconv.ParseInt(line[1:], 10, 64); err == nil {
+				ts = time.Unix(sec, 0).UTC()
+			}
+			continue
+		}
+		events = append(events, commandEvent(line, ts))
+		ts = time.Time{}
+	}
+	return events, scanner.Err()
+}
+
+// parseZshHistory returns the commands of a zsh history
+func parseZshHistory(r io.Reader) (events []Event, err error) {
+	var cmd string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := string(unmetafy(scanner.Bytes()))
+		if strings.HasSuffix(line, `\`) {
+			// the command continues on the next line
+			cmd += line[:len(line)-1] + "\n"
+			continue
+		}
+		cmd += line
+		if strings.TrimSpace(cmd) != "" {
+			events = append(events, parseZshLine(cmd))
+		}
+		cmd = ""
+	}
+	if strings.TrimSpace(cmd) != "" {
+		events = append(events, parseZshLine(cmd))
+	}
+	return events, scanner.Err()
+}
+
+// parseZshLine decodes a command of a zsh history, with the extended
+// history prefix if present
+func parseZshLine(line string) Event {
+	var ts time.Time
+	if strings.HasPrefix(line, ": ") {
+		if i := strings.IndexByte(line, ';'); i > 0 {
+			fields := strings.SplitN(line[2:i], ":", 2)
+			if sec, err := strconv.ParseInt(strings.TrimSpace(fields[0]), 10, 64); err == nil {
+				ts = time.Unix(sec, 0).UTC()
+				line = line[i+1:]
+			}
+		}
+	}
+	return commandEvent(strings.TrimSpace(line), ts)
+}
+
+// unmetafy decodes the metafied bytes of a line of a zsh history
+func unmetafy(b []byte) []byte {
+	if bytes.IndexByte(b, zshMeta) < 0 {
+		return b
+	}
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] == zshMeta && i+1 < len(b) {
+			i++
+			out = append(out, b[i]^0x20)
+			continue
+		}
+		out = append(out, b[i])
+	}
+	return out
+}
+
+// commandEvent returns the event of a command typed in a shell
+func commandEvent(cmd string, ts time.Time) Event {
+	return Event{
+		Type:        TypeCommand,
+		Program:     programOf(cmd),
+		CommandLine: cmd,
+		Time:        ts,
+	}
+}
+
+// commandPrefixes are the programs that run the command that follows them
+var commandPrefixes = map[string]bool{
+	"sudo":  true,
+	"nohup": true,
+	"env":   true,
+	"time":  true,
+	"exec":  true,
+	"nice":  true,
+}
+
+// prefixOptionsWithValue are the options of the prefixes followed by a
+// value, such as the user of sudo -u
+var prefixOptionsWithValue = map[string]bool{"-u": true, "-g": true}
+
+// programOf returns the program started by a command line, skipping the
+// variable assignments and the programs running other commands, such as
+// sudo, along with their options
+func programOf(cmd string) string {
+	prefixed, skip := false, false
+	for _, f := range strings.Fields(cmd) {
+		switch {
+		case skip:
+			skip = false
+			continue
+		case strings.Contains(f, "=") && !strings.HasPrefix(f, "/") && !strings.HasPrefix(f, "."):
+			continue
+		case prefixed && strings.HasPrefix(f, "-"):
+			skip = prefixOptionsWithValue[f]
+			continue
+		case commandPrefixes[f]:
+			prefixed = true
+			continue
+		}
+		return strings.Trim(f, `"'`)
+	}
+	return ""
+}
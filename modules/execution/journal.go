@@ -0,0 +1,195 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package execution /* import "mig.ninja/mig/modules/execution" */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+/*
+	systemd-journald stores the logs in var/log/journal/<machine id>/, or in
+	run/log/journal/ when they are not persistent. A journal file starts with
+	a header holding the "LPKSHHRH" signature, the incompatible flags at
+	offset 12, and the size of the header and of the arena of the objects at
+	offsets 88 and 96.
+
+	The arena is a sequence of objects aligned on 8 bytes, starting with
+	their type (1 for data, 3 for entries), their flags and their size. An
+	entry holds its realtime timestamp in microseconds at offset 24, and is
+	followed at offset 64 by the offsets of the data objects of its fields:
+	16 bytes items, or 4 bytes items in compact files. The payload of a
+	data object, "FIELD=value", starts at offset 64, or 72 in compact files.
+	Compressed payloads are skipped, as the xz, lz4 and zstd decoders are
+	not available to the agent.
+
+	sudo logs the commands it runs with a message such as:
+
+		alice : TTY=pts/0 ; PWD=/home/alice ; USER=root ; COMMAND=/usr/bin/id -u
+
+	Other entries carry the executable and the command line of the process
+	that logged them in the _EXE and _CMDLINE trusted fields. Each process
+	is returned once, at the time of its first entry.
+*/
+
+var journalSignature = []byte("LPKSHHRH")
+
+const (
+	journalHeaderMin   = 112
+	journalObjectEntry = 3
+	journalObjectData  = 1
+	journalCompact     = 16 // incompatible flag of the compact format
+	journalCompressed  = 7  // flags of the compressed data objects
+	journalMaxObject   = 64 * 1024 * 1024
+)
+
+// journalReader reads the objects of a journal file
+type journalReader struct {
+	r       io.ReaderAt
+	compact bool
+}
+
+// parseJournal returns the sudo commands and the processes found in the
+// entries of a journal file
+func parseJournal(r io.ReaderAt, accounts *accounts) (events []Event, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("parseJournal: %v", e)
+		}
+	}()
+	jr := journalReader{r: r}
+	header := jr.read(0, journalHeaderMin)
+	if !bytes.Equal(header[:8], journalSignature) {
+		return nil, fmt.Errorf("invalid journal signature")
+	}
+	jr.compact = binary.LittleEndian.Uint32(header[12:])&journalCompact != 0
+	start := binary.LittleEndian.Uint64(header[88:])
+	end := start + binary.LittleEndian.Uint64(header[96:])
+	processes := make(map[string]int)
+	for off := start; off+16 <= end; {
+		oh := jr.read(off, 16)
+		size := binary.LittleEndian.Uint64(oh[8:])
+		if size < 16 || size > journalMaxObject {
+			// the end of a file being written is zeroed
+			break
+		}
+		if oh[0] == journalObjectEntry {
+			if e, ok := jr.entry(off, size, accounts); ok {
+				switch e.Type {
+				case TypeSudo:
+					events = append(events, e)
+				case TypeProcess:
+					key := e.User + "\x00" + e.Program + "\x00" + e.CommandLine
+					if i, seen := processes[key]; !seen {
+						processes[key] = len(events)
+						events = append(events, e)
+					} else if e.Time.Before(events[i].Time) {
+						events[i] = e
+					}
+				}
+			}
+		}
+		off += (size + 7) &^ 7
+	}
+	return
+}
+
+// entry returns the event of a journal entry, or false if the entry was
+// logged by neither sudo nor a known process
+func (jr journalReader) entry(off, size uint64, accounts *accounts) (e Event, ok bool) {
+	obj := jr.read(off, int(size))
+	if len(obj) < 64 {
+		return
+	}
+	realtime := binary.LittleEndian.Uint64(obj[24:])
+	fields := make(map[string]string)
+	itemSize := 16
+	if jr.compact {
+		itemSize = 4
+	}
+	for i := 64; i+itemSize <= len(obj); i += itemSize {
+		var data uint64
+		if jr.compact {
+			data = uint64(binary.LittleEndian.Uint32(obj[i:]))
+		} else {
+			data = binary.LittleEndian.Uint64(obj[i:])
+		}
+		if name, value, ok := jr.field(data); ok {
+			fields[name] = value
+		}
+	}
+	e.Time = time.Unix(0, int64(realtime)*int64(time.Microsecond)).UTC()
+	e.Details = make(map[string]string)
+	if fields["SYSLOG_IDENTIFIER"] == "sudo" && strings.Contains(fields["MESSAGE"], "COMMAND=") {
+		e.Type = TypeSudo
+		msg := fields["MESSAGE"]
+		if i := strings.Index(msg, " : "); i > 0 {
+			e.User = strings.TrimSpace(msg[:i])
+			msg = msg[i+3:]
+		}
+		for _, part := range strings.Split(msg, " ; ") {
+			kv := strings.SplitN(part, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "COMMAND":
+				e.CommandLine = kv[1]
+				e.Program = strings.SplitN(kv[1], " ", 2)[0]
+			case "TTY", "PWD", "USER":
+				e.Details[strings.ToLower(kv[0])] = kv[1]
+			}
+		}
+		return e, true
+	}
+	if fields["_EXE"] == "" {
+		return
+	}
+	e.Type = TypeProcess
+	e.Program = fields["_EXE"]
+	e.CommandLine = fields["_CMDLINE"]
+	e.User = accounts.name(fields["_UID"])
+	for name, detail := range map[string]string{"_PID": "pid", "_UID": "uid", "_COMM": "comm", "_SYSTEMD_UNIT": "unit"} {
+		if v, ok := fields[name]; ok {
+			e.Details[detail] = v
+		}
+	}
+	return e, true
+}
+
+// field returns the name and value of the payload of a data object
+func (jr journalReader) field(off uint64) (name, value string, ok bool) {
+	oh := jr.read(off, 16)
+	size := binary.LittleEndian.Uint64(oh[8:])
+	payload := uint64(64)
+	if jr.compact {
+		payload = 72
+	}
+	if oh[0] != journalObjectData || oh[1]&journalCompressed != 0 || size <= payload || size > journalMaxObject {
+		return
+	}
+	data := jr.read(off+payload, int(size-payload))
+	kv := bytes.SplitN(data, []byte("="), 2)
+	if len(kv) != 2 {
+		return
+	}
+	return string(kv[0]), string(kv[1]), true
+}
+
+// read returns n bytes of the journal at an offset, and panics if they
+// cannot be read
+func (jr journalReader) read(off uint64, n int) []byte {
+	buf := make([]byte, n)
+	if _, err := jr.r.ReadAt(buf, int64(off)); err != nil {
+		panic(fmt.Sprintf("reading %d bytes at offset %d: %v", n, off, err))
+	}
+	return buf
+}
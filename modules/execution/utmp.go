@@ -0,0 +1,158 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package execution /* import "mig.ninja/mig/modules/execution" */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+/*
+	utmp holds the current sessions, wtmp the history of the logins, logouts
+	and boots, and btmp the failed logins. The three files are arrays of
+	the 384 bytes utmp structure of glibc:
+
+		0   ut_type     int16, followed by 2 bytes of padding
+		4   ut_pid      int32
+		8   ut_line     [32]byte, the terminal
+		40  ut_id       [4]byte
+		44  ut_user     [32]byte
+		76  ut_host     [256]byte
+		332 ut_exit     2 x int16
+		336 ut_session  int32
+		340 ut_tv       int32 seconds, int32 microseconds
+		348 ut_addr_v6  [4]int32
+		364 unused      [20]byte
+
+	A logout is a DEAD_PROCESS record with the terminal of the session and
+	no user, which is resolved from the last login on that terminal.
+
+	lastlog is an array of 292 bytes records indexed by uid, holding the
+	time (int32), the terminal ([32]byte) and the host ([256]byte) of the
+	last login of each user. Records of users who never logged in are zero.
+*/
+
+const (
+	utmpSize    = 384
+	lastlogSize = 292
+
+	utmpBootTime    = 2
+	utmpUserProcess = 7
+	utmpDeadProcess = 8
+)
+
+// parseUtmp returns the logins, logouts and boots of a utmp or wtmp file,
+// or the failed logins of a btmp file
+func parseUtmp(r io.Reader, failed bool) (events []Event, err error) {
+	var (
+		buf      = make([]byte, utmpSize)
+		sessions = make(map[string]string)
+	)
+	for {
+		if _, err = io.ReadFull(r, buf); err != nil {
+			if err == io.EOF {
+				err = nil
+			} else if err == io.ErrUnexpectedEOF {
+				err = fmt.Errorf("truncated record at the end of the file")
+			}
+			return
+		}
+		typ := int16(binary.LittleEndian.Uint16(buf[0:]))
+		sec := int32(binary.LittleEndian.Uint32(buf[340:]))
+		usec := int32(binary.LittleEndian.Uint32(buf[344:]))
+		e := Event{
+			User: cstring(buf[44:76]),
+			Time: time.Unix(int64(sec), int64(usec)*int64(time.Microsecond)).UTC(),
+			Details: map[string]string{
+				"pid": strconv.Itoa(int(int32(binary.LittleEndian.Uint32(buf[4:])))),
+			},
+		}
+		line := cstring(buf[8:40])
+		if line != "" {
+			e.Details["line"] = line
+		}
+		if host := cstring(buf[76:332]); host != "" {
+			e.Details["host"] = host
+		}
+		if addr := utmpAddr(buf[348:364]); addr != "" {
+			e.Details["address"] = addr
+		}
+		switch {
+		case failed:
+			e.Type = TypeFailedLogin
+		case typ == utmpUserProcess:
+			e.Type = TypeLogin
+			sessions[line] = e.User
+		case typ == utmpDeadProcess && line != "":
+			e.Type = TypeLogout
+			if e.User == "" {
+				e.User = sessions[line]
+			}
+			delete(sessions, line)
+		case typ == utmpBootTime:
+			e.Type = TypeBoot
+		default:
+			continue
+		}
+		events = append(events, e)
+	}
+}
+
+// parseLastlog returns the last login of each user of a lastlog file
+func parseLastlog(r io.Reader, accounts *accounts) (events []Event, err error) {
+	buf := make([]byte, lastlogSize)
+	for uid := 0; ; uid++ {
+		if _, err = io.ReadFull(r, buf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = nil
+			}
+			return
+		}
+		sec := binary.LittleEndian.Uint32(buf[0:])
+		if sec == 0 {
+			continue
+		}
+		e := Event{
+			Type:    TypeLastLogin,
+			User:    accounts.name(strconv.Itoa(uid)),
+			Time:    time.Unix(int64(sec), 0).UTC(),
+			Details: map[string]string{"uid": strconv.Itoa(uid)},
+		}
+		if line := cstring(buf[4:36]); line != "" {
+			e.Details["line"] = line
+		}
+		if host := cstring(buf[36:292]); host != "" {
+			e.Details["host"] = host
+		}
+		events = append(events, e)
+	}
+}
+
+// utmpAddr returns the address of the remote host of a session, which is
+// an IPv4 address when only the first word is set
+func utmpAddr(b []byte) string {
+	if bytes.Equal(b, make([]byte, 16)) {
+		return ""
+	}
+	if bytes.Equal(b[4:], make([]byte, 12)) {
+		return net.IP(b[:4]).String()
+	}
+	return net.IP(b).String()
+}
+
+// cstring returns the string of a null terminated byte array
+func cstring(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,497 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Julien Vehent jvehent@mozilla.com [:ulfr]
+
+package file /* import "mig.ninja/mig/modules/file" */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	ext4FS reads the files of an ext2, ext3 or ext4 file system from a raw
+	image. The superblock, at offset 1024, holds the geometry of the file
+	system: the size of the blocks, of the inodes and of the block groups,
+	and the incompatible features. The descriptors of the block groups
+	follow the superblock in the next block, and give the location of the
+	inode table of each group.
+
+	An inode holds the mode, the size and the times of a file, and 60 bytes
+	mapping its content to blocks: the root of an extent tree when the
+	EXTENTS flag is set, or the 12 direct, indirect, double and triple
+	indirect block pointers of ext2 and ext3. Directories are lists of
+	entries holding an inode number and a name; the hashed directories of
+	ext4 are readable the same way, as their index blocks look like empty
+	entries. Symbolic links shorter than 60 bytes are stored in the inode.
+
+	Files with inline data are not supported.
+*/
+
+const (
+	ext4Magic     = 0xef53
+	ext4RootInode = 2
+
+	ext4Incompat64Bit = 0x80
+
+	ext4FlagExtents    = 0x80000
+	ext4FlagInlineData = 0x10000000
+
+	ext4ExtentMagic = 0xf30a
+
+	// directories cached by the reader, as searches look up the parents of
+	// each file they evaluate
+	ext4DirCacheSize = 64
+)
+
+// ext4FS is a read-only view of the files of an ext file system
+type ext4FS struct {
+	r              io.ReaderAt
+	blockSize      int64
+	inodeSize      int64
+	inodesPerGroup uint32
+	descSize       int64
+	gdtOffset      int64
+	dirs           map[uint32]map[string]uint32
+}
+
+// ext4Inode is the decoded inode of a file
+type ext4Inode struct {
+	name  string
+	mode  uint16
+	size  int64
+	mtime time.Time
+	flags uint32
+	block []byte
+}
+
+// ext4Extent maps a range of blocks of a file to the blocks of the file
+// system
+type ext4Extent struct {
+	logical  uint64
+	physical uint64
+	length   uint64
+}
+
+// isExt4 returns true if a reader starts with the superblock of an ext
+// file system
+func isExt4(r io.ReaderAt) bool {
+	b := make([]byte, 2)
+	if _, err := r.ReadAt(b, 1024+0x38); err != nil {
+		return false
+	}
+	return binary.LittleEndian.Uint16(b) == ext4Magic
+}
+
+// openExt4 reads the superblock of an ext file system
+func openExt4(r io.ReaderAt) (*ext4FS, error) {
+	sb := make([]byte, 1024)
+	if _, err := r.ReadAt(sb, 1024); err != nil {
+		return nil, fmt.Errorf("openExt4: %v", err)
+	}
+	if binary.LittleEndian.Uint16(sb[0x38:]) != ext4Magic {
+		return nil, fmt.Errorf("openExt4: not an ext file system")
+	}
+	logBlockSize := binary.LittleEndian.Uint32(sb[0x18:])
+	if logBlockSize > 6 {
+		return nil, fmt.Errorf("openExt4: invalid block size")
+	}
+	fs := &ext4FS{
+		r:              r,
+		blockSize:      1024 << logBlockSize,
+		inodeSize:      128,
+		inodesPerGroup: binary.LittleEndian.Uint32(sb[0x28:]),
+		descSize:       32,
+		dirs:           make(map[uint32]map[string]uint32),
+	}
+	// revision 0 file systems have 128 bytes inodes
+	if binary.LittleEndian.Uint32(sb[0x4c:]) >= 1 {
+		fs.inodeSize = int64(binary.LittleEndian.Uint16(sb[0x58:]))
+	}
+	if binary.LittleEndian.Uint32(sb[0x60:])&ext4Incompat64Bit != 0 {
+		fs.descSize = int64(binary.LittleEndian.Uint16(sb[0xfe:]))
+	}
+	if fs.inodesPerGroup == 0 || fs.inodeSize < 128 || fs.descSize < 32 {
+		return nil, fmt.Errorf("openExt4: invalid geometry")
+	}
+	firstDataBlock := int64(binary.LittleEndian.Uint32(sb[0x14:]))
+	fs.gdtOffset = (firstDataBlock + 1) * fs.blockSize
+	return fs, nil
+}
+
+// inode reads an inode by number
+func (fs *ext4FS) inode(n uint32) (ino ext4Inode, err error) {
+	if n == 0 {
+		return ino, fmt.Errorf("invalid inode 0")
+	}
+	group := int64((n - 1) / fs.inodesPerGroup)
+	index := int64((n - 1) % fs.inodesPerGroup)
+	desc := make([]byte, fs.descSize)
+	if _, err = fs.r.ReadAt(desc, fs.gdtOffset+group*fs.descSize); err != nil {
+		return ino, fmt.Errorf("reading descriptor of group %d: %v", group, err)
+	}
+	table := uint64(binary.LittleEndian.Uint32(desc[0x8:]))
+	if fs.descSize >= 64 {
+		table |= uint64(binary.LittleEndian.Uint32(desc[0x28:])) << 32
+	}
+	b := make([]byte, 128)
+	if _, err = fs.r.ReadAt(b, int64(table)*fs.blockSize+index*fs.inodeSize); err != nil {
+		return ino, fmt.Errorf("reading inode %d: %v", n, err)
+	}
+	ino.mode = binary.LittleEndian.Uint16(b[0x0:])
+	ino.size = int64(binary.LittleEndian.Uint32(b[0x4:])) | int64(binary.LittleEndian.Uint32(b[0x6c:]))<<32
+	ino.mtime = time.Unix(int64(int32(binary.LittleEndian.Uint32(b[0x10:]))), 0).UTC()
+	ino.flags = binary.LittleEndian.Uint32(b[0x20:])
+	ino.block = b[0x28:0x64]
+	return
+}
+
+// extents returns the blocks of the content of an inode
+func (fs *ext4FS) extents(ino ext4Inode) (extents []ext4Extent, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("extents() -> %v", e)
+		}
+	}()
+	if ino.flags&ext4FlagInlineData != 0 {
+		return nil, fmt.Errorf("inline data is not supported")
+	}
+	if ino.flags&ext4FlagExtents != 0 {
+		return fs.extentTree(ino.block, 0)
+	}
+	// ext2 and ext3 block map: 12 direct blocks, then one indirect, one
+	// double indirect and one triple indirect block
+	count := uint64((ino.size + fs.blockSize - 1) / fs.blockSize)
+	var logical uint64
+	add := func(block uint32) {
+		if block != 0 {
+			last := len(extents) - 1
+			if last >= 0 && extents[last].logical+extents[last].length == logical &&
+				extents[last].physical+extents[last].length == uint64(block) {
+				extents[last].length++
+			} else {
+				extents = append(extents, ext4Extent{logical, uint64(block), 1})
+			}
+		}
+		logical++
+	}
+	var walk func(block uint32, level int)
+	walk = func(block uint32, level int) {
+		perBlock := uint64(fs.blockSize / 4)
+		if block == 0 {
+			// a hole of indirect blocks
+			span := uint64(1)
+			for i := 0; i < level; i++ {
+				span *= perBlock
+			}
+			logical += span
+			return
+		}
+		if level == 0 {
+			add(block)
+			return
+		}
+		b := make([]byte, fs.blockSize)
+		if _, err := fs.r.ReadAt(b, int64(block)*fs.blockSize); err != nil {
+			panic(err)
+		}
+		for i := uint64(0); i < perBlock && logical < count; i++ {
+			walk(binary.LittleEndian.Uint32(b[i*4:]), level-1)
+		}
+	}
+	for i := 0; i < 15 && logical < count; i++ {
+		ptr := binary.LittleEndian.Uint32(ino.block[i*4:])
+		switch {
+		case i < 12:
+			add(ptr)
+		default:
+			walk(ptr, i-11)
+		}
+	}
+	return
+}
+
+// extentTree decodes a node of an extent tree, reading the blocks of its
+// children for index nodes
+func (fs *ext4FS) extentTree(node []byte, depth int) (extents []ext4Extent, err error) {
+	if binary.LittleEndian.Uint16(node[0:]) != ext4ExtentMagic {
+		return nil, fmt.Errorf("invalid extent header")
+	}
+	entries := int(binary.LittleEndian.Uint16(node[2:]))
+	if depth > 5 || 12+entries*12 > len(node) {
+		return nil, fmt.Errorf("invalid extent tree")
+	}
+	leaf := binary.LittleEndian.Uint16(node[6:]) == 0
+	for i := 0; i < entries; i++ {
+		e := node[12+i*12:]
+		if leaf {
+			length := uint64(binary.LittleEndian.Uint16(e[4:]))
+			if length > 32768 {
+				// extents allocated but not written read as zeros
+				continue
+			}
+			extents = append(extents, ext4Extent{
+				logical:  uint64(binary.LittleEndian.Uint32(e[0:])),
+				physical: uint64(binary.LittleEndian.Uint16(e[6:]))<<32 | uint64(binary.LittleEndian.Uint32(e[8:])),
+				length:   length,
+			})
+			continue
+		}
+		child := uint64(binary.LittleEndian.Uint32(e[4:])) | uint64(binary.LittleEndian.Uint16(e[8:]))<<32
+		b := make([]byte, fs.blockSize)
+		if _, err := fs.r.ReadAt(b, int64(child)*fs.blockSize); err != nil {
+			return nil, err
+		}
+		sub, err := fs.extentTree(b, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		extents = append(extents, sub...)
+	}
+	return
+}
+
+// ext4Reader reads the content of a file from its extents
+type ext4Reader struct {
+	fs      *ext4FS
+	extents []ext4Extent
+	size    int64
+}
+
+// ReadAt maps the offset in the file to the blocks of its extents, holes
+// read as zeros
+func (er *ext4Reader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= er.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > er.size-off {
+		p = p[:er.size-off]
+		err = io.EOF
+	}
+	for n < len(p) {
+		pos := off + int64(n)
+		block := uint64(pos / er.fs.blockSize)
+		chunk := p[n:]
+		if max := er.fs.blockSize - pos%er.fs.blockSize; int64(len(chunk)) > max {
+			chunk = chunk[:max]
+		}
+		found := false
+		for _, e := range er.extents {
+			if block >= e.logical && block < e.logical+e.length {
+				phys := int64(e.physical+block-e.logical)*er.fs.blockSize + pos%er.fs.blockSize
+				if _, rerr := er.fs.r.ReadAt(chunk, phys); rerr != nil {
+					return n, rerr
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			for i := range chunk {
+				chunk[i] = 0
+			}
+		}
+		n += len(chunk)
+	}
+	return n, err
+}
+
+// reader returns a reader of the content of an inode
+func (fs *ext4FS) reader(ino ext4Inode) (*io.SectionReader, error) {
+	extents, err := fs.extents(ino)
+	if err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(&ext4Reader{fs: fs, extents: extents, size: ino.size}, 0, ino.size), nil
+}
+
+// readDir returns the names and inodes of the entries of a directory
+func (fs *ext4FS) readDir(n uint32) (map[string]uint32, error) {
+	if entries, ok := fs.dirs[n]; ok {
+		return entries, nil
+	}
+	ino, err := fs.inode(n)
+	if err != nil {
+		return nil, err
+	}
+	if ino.mode&0xf000 != 0x4000 {
+		return nil, fmt.Errorf("not a directory")
+	}
+	r, err := fs.reader(ino)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, ino.size)
+	if _, err := r.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	entries := make(map[string]uint32)
+	for off := 0; off+8 <= len(data); {
+		inode := binary.LittleEndian.Uint32(data[off:])
+		recLen := int(binary.LittleEndian.Uint16(data[off+4:]))
+		nameLen := int(data[off+6])
+		if recLen < 8 || off+recLen > len(data) || 8+nameLen > recLen {
+			return nil, fmt.Errorf("invalid directory entry at offset %d", off)
+		}
+		name := string(data[off+8 : off+8+nameLen])
+		if inode != 0 && name != "." && name != ".." {
+			entries[name] = inode
+		}
+		off += recLen
+	}
+	if len(fs.dirs) >= ext4DirCacheSize {
+		fs.dirs = make(map[uint32]map[string]uint32)
+	}
+	fs.dirs[n] = entries
+	return entries, nil
+}
+
+// lookup returns the inode number and the name of a path, without
+// following the symbolic links. Both / and \ separate the names.
+func (fs *ext4FS) lookup(op, path string) (n uint32, name string, err error) {
+	n = ext4RootInode
+	name = "/"
+	for _, elem := range strings.FieldsFunc(path, func(c rune) bool { return c == '/' || c == '\\' }) {
+		entries, err := fs.readDir(n)
+		if err != nil {
+			return 0, "", &os.PathError{Op: op, Path: path, Err: err}
+		}
+		var ok bool
+		if n, ok = entries[elem]; !ok {
+			return 0, "", &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+		}
+		name = elem
+	}
+	return
+}
+
+// resolve returns the inode of a path
+func (fs *ext4FS) resolve(op, path string) (ino ext4Inode, err error) {
+	n, name, err := fs.lookup(op, path)
+	if err != nil {
+		return ino, err
+	}
+	ino, err = fs.inode(n)
+	if err != nil {
+		return ino, &os.PathError{Op: op, Path: path, Err: err}
+	}
+	ino.name = name
+	return
+}
+
+// Stat returns the information of a file, or of a symbolic link itself
+func (fs *ext4FS) Stat(path string) (os.FileInfo, error) {
+	ino, err := fs.resolve("lstat", path)
+	if err != nil {
+		return nil, err
+	}
+	return ext4FileInfo{ino}, nil
+}
+
+// ReadDir returns the content of a directory, sorted by name
+func (fs *ext4FS) ReadDir(path string) (list []os.FileInfo, err error) {
+	n, _, err := fs.lookup("readdir", path)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fs.readDir(n)
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: path, Err: err}
+	}
+	for name, child := range entries {
+		ino, err := fs.inode(child)
+		if err != nil {
+			return nil, &os.PathError{Op: "readdir", Path: path, Err: err}
+		}
+		ino.name = name
+		list = append(list, ext4FileInfo{ino})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return
+}
+
+// Open returns a reader of the content of a regular file
+func (fs *ext4FS) Open(path string) (*io.SectionReader, error) {
+	ino, err := fs.resolve("open", path)
+	if err != nil {
+		return nil, err
+	}
+	if ino.mode&0xf000 != 0x8000 {
+		return nil, &os.PathError{Op: "open", Path: path, Err: fmt.Errorf("not a regular file")}
+	}
+	r, err := fs.reader(ino)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return r, nil
+}
+
+// Readlink returns the target of a symbolic link
+func (fs *ext4FS) Readlink(path string) (string, error) {
+	ino, err := fs.resolve("readlink", path)
+	if err != nil {
+		return "", err
+	}
+	if ino.mode&0xf000 != 0xa000 {
+		return "", &os.PathError{Op: "readlink", Path: path, Err: fmt.Errorf("not a symbolic link")}
+	}
+	if ino.size < 60 && ino.flags&(ext4FlagExtents|ext4FlagInlineData) == 0 {
+		return string(ino.block[:ino.size]), nil
+	}
+	r, err := fs.reader(ino)
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: path, Err: err}
+	}
+	target := make([]byte, ino.size)
+	if _, err := r.ReadAt(target, 0); err != nil && err != io.EOF {
+		return "", &os.PathError{Op: "readlink", Path: path, Err: err}
+	}
+	return string(target), nil
+}
+
+// ext4FileInfo implements os.FileInfo for the inodes of an ext file system
+type ext4FileInfo struct {
+	ino ext4Inode
+}
+
+func (fi ext4FileInfo) Name() string       { return fi.ino.name }
+func (fi ext4FileInfo) Size() int64        { return fi.ino.size }
+func (fi ext4FileInfo) ModTime() time.Time { return fi.ino.mtime }
+func (fi ext4FileInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi ext4FileInfo) Sys() interface{}   { return nil }
+
+// Mode converts the mode of the inode to the portable file mode
+func (fi ext4FileInfo) Mode() os.FileMode {
+	m := os.FileMode(fi.ino.mode & 0777)
+	switch fi.ino.mode & 0xf000 {
+	case 0x4000:
+		m |= os.ModeDir
+	case 0xa000:
+		m |= os.ModeSymlink
+	case 0x1000:
+		m |= os.ModeNamedPipe
+	case 0x2000:
+		m |= os.ModeDevice | os.ModeCharDevice
+	case 0x6000:
+		m |= os.ModeDevice
+	case 0xc000:
+		m |= os.ModeSocket
+	}
+	if fi.ino.mode&0x800 != 0 {
+		m |= os.ModeSetuid
+	}
+	if fi.ino.mode&0x400 != 0 {
+		m |= os.ModeSetgid
+	}
+	if fi.ino.mode&0x200 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
@@ -0,0 +1,170 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Julien Vehent jvehent@mozilla.com [:ulfr]
+
+package file /* import "mig.ninja/mig/modules/file" */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const (
+	ext4TestBlock   = 1024
+	ext4TestPasswd  = "root:x:0:0:root:/root:/bin/bash\n"
+	ext4TestModTime = 1475280000
+)
+
+// ext4TestHosts spans 12 direct blocks and one block of the indirect block
+// of its block map
+var ext4TestHosts = strings.Repeat("127.0.0.1 localhost\n", 13*ext4TestBlock/20-5)
+
+// buildExt4 returns the image of a small ext4 file system with 1024 bytes
+// blocks and 256 bytes inodes:
+//
+//	/etc/passwd  extents, two blocks
+//	/hosts       block map, with an indirect block
+//	/link        fast symbolic link to /etc/passwd
+func buildExt4() []byte {
+	img := make([]byte, 64*ext4TestBlock)
+	le := binary.LittleEndian
+	sb := img[1024:]
+	le.PutUint32(sb[0x14:], 1)  // first data block
+	le.PutUint32(sb[0x18:], 0)  // 1024 bytes blocks
+	le.PutUint32(sb[0x28:], 16) // inodes per group
+	le.PutUint16(sb[0x38:], ext4Magic)
+	le.PutUint32(sb[0x4c:], 1) // dynamic revision
+	le.PutUint16(sb[0x58:], 256)
+	// the inode table of the single group is in block 3
+	le.PutUint32(img[2*ext4TestBlock+0x8:], 3)
+
+	inode := func(n int, mode uint16, size int, flags uint32, block []byte) {
+		b := img[3*ext4TestBlock+(n-1)*256:]
+		le.PutUint16(b[0x0:], mode)
+		le.PutUint32(b[0x4:], uint32(size))
+		le.PutUint32(b[0x10:], ext4TestModTime)
+		le.PutUint32(b[0x20:], flags)
+		copy(b[0x28:0x64], block)
+	}
+	extent := func(start, length int) []byte {
+		b := make([]byte, 60)
+		le.PutUint16(b[0:], ext4ExtentMagic)
+		le.PutUint16(b[2:], 1) // entries
+		le.PutUint16(b[4:], 4) // max entries
+		le.PutUint16(b[16:], uint16(length))
+		le.PutUint32(b[20:], uint32(start))
+		return b
+	}
+	dir := func(block int, entries map[string]uint32) {
+		b := img[block*ext4TestBlock : (block+1)*ext4TestBlock]
+		names := []string{".", ".."}
+		for name := range entries {
+			names = append(names, name)
+		}
+		off := 0
+		for i, name := range names {
+			recLen := (8 + len(name) + 3) &^ 3
+			if i == len(names)-1 {
+				recLen = len(b) - off
+			}
+			ino := entries[name]
+			if ino == 0 {
+				// . and .. of the directories of the test are in the root
+				ino = ext4RootInode
+			}
+			le.PutUint32(b[off:], ino)
+			le.PutUint16(b[off+4:], uint16(recLen))
+			b[off+6] = byte(len(name))
+			copy(b[off+8:], name)
+			off += recLen
+		}
+	}
+
+	// root directory, with extents
+	inode(2, 0x41ed, ext4TestBlock, ext4FlagExtents, extent(10, 1))
+	dir(10, map[string]uint32{"etc": 12, "hosts": 14, "link": 15})
+	// etc directory, with a block map
+	blockMap := make([]byte, 60)
+	le.PutUint32(blockMap, 11)
+	inode(12, 0x41ed, ext4TestBlock, 0, blockMap)
+	dir(11, map[string]uint32{"passwd": 13})
+	// /etc/passwd, with an extent of two blocks
+	passwd := strings.Repeat(ext4TestPasswd, 40)
+	inode(13, 0x81a4, len(passwd), ext4FlagExtents, extent(12, 2))
+	copy(img[12*ext4TestBlock:], passwd)
+	// /hosts, in blocks 20 to 32, block 33 being the indirect block
+	blockMap = make([]byte, 60)
+	for i := 0; i < 12; i++ {
+		le.PutUint32(blockMap[i*4:], uint32(20+i))
+	}
+	le.PutUint32(blockMap[12*4:], 33)
+	le.PutUint32(img[33*ext4TestBlock:], 32)
+	inode(14, 0x81a4, len(ext4TestHosts), 0, blockMap)
+	copy(img[20*ext4TestBlock:], ext4TestHosts)
+	// /link
+	inode(15, 0xa1ff, len("/etc/passwd"), 0, []byte("/etc/passwd"))
+	return img
+}
+
+func TestExt4(t *testing.T) {
+	fs, err := openExt4(bytes.NewReader(buildExt4()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range list {
+		names = append(names, fi.Name())
+	}
+	if strings.Join(names, " ") != "etc hosts link" {
+		t.Fatalf("expected entries etc, hosts and link, got %v", names)
+	}
+	if !list[0].IsDir() || list[0].Mode() != os.ModeDir|0755 {
+		t.Fatalf("expected etc to be a directory, got mode %s", list[0].Mode())
+	}
+	if list[2].Mode() != os.ModeSymlink|0777 {
+		t.Fatalf("expected link to be a symbolic link, got mode %s", list[2].Mode())
+	}
+	for path, want := range map[string]string{
+		"/etc/passwd": strings.Repeat(ext4TestPasswd, 40),
+		`\hosts`:      ext4TestHosts,
+	} {
+		r, err := fs.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Fatalf("%s: read %d bytes that differ from the %d bytes of the file", path, len(data), len(want))
+		}
+	}
+	fi, err := fs.Stat("/etc/passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != 0644 || fi.ModTime().Unix() != ext4TestModTime {
+		t.Fatalf("unexpected mode %s or mtime %s", fi.Mode(), fi.ModTime())
+	}
+	target, err := fs.Readlink("/link")
+	if err != nil || target != "/etc/passwd" {
+		t.Fatalf("expected link to /etc/passwd, got %q, %v", target, err)
+	}
+	if _, err := fs.Stat("/etc/shadow"); !os.IsNotExist(err) {
+		t.Fatalf("expected /etc/shadow to not exist, got %v", err)
+	}
+	if _, err := fs.Open("/etc"); err == nil {
+		t.Fatal("expected opening a directory to fail")
+	}
+}
@@ -6,7 +6,9 @@
 
 /* The file module provides functions to scan a file system. It can look into files
 using regexes. It can search files by name. It can match hashes in md5, sha1,
-sha256, sha384, sha512, sha3_224, sha3_256, sha3_384 and sha3_512.
+sha256, sha384, sha512, sha3_224, sha3_256, sha3_384 and sha3_512. It can
+match files against YARA rules, and find files similar to a reference with
+the ssdeep and tlsh fuzzy hashes.
 The filesystem can be searched using patterns, as described in the Parameters
 documentation at http://mig.mozilla.org/doc/module_file.html .
 */
@@ -22,6 +24,7 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
@@ -33,6 +36,7 @@ import (
 
 	"golang.org/x/crypto/sha3"
 	"mig.ninja/mig/modules"
+	"mig.ninja/mig/modules/yara"
 
 	"compress/gzip"
 )
@@ -60,6 +64,8 @@ func init() {
 type run struct {
 	Parameters Parameters
 	Results    modules.Result
+	fs         fileSystem
+	stop       chan bool // closed when the module is asked to stop early
 }
 
 type Parameters struct {
@@ -84,12 +90,16 @@ type search struct {
 	SHA1         []string `json:"sha1,omitempty"`
 	SHA2         []string `json:"sha2,omitempty"`
 	SHA3         []string `json:"sha3,omitempty"`
+	Yara         []string `json:"yara,omitempty"`
+	SSDeep       []string `json:"ssdeep,omitempty"`
+	TLSH         []string `json:"tlsh,omitempty"`
 	Options      options  `json:"options,omitempty"`
 	checks       []check
 	checkmask    checkType
 	isactive     bool
 	iscurrent    bool
 	currentdepth uint64
+	fs           fileSystem
 }
 
 type options struct {
@@ -103,6 +113,9 @@ type options struct {
 	Debug        string   `json:"debug,omitempty"`
 	ReturnSHA256 bool     `json:"returnsha256,omitempty"`
 	Decompress   bool     `json:"decompress,omitempty"`
+	Root         string   `json:"root,omitempty"`
+	Image        string   `json:"image,omitempty"`
+	ImageOffset  float64  `json:"imageoffset,omitempty"`
 }
 
 type checkType uint64
@@ -124,6 +137,9 @@ const (
 	checkSHA3_256
 	checkSHA3_384
 	checkSHA3_512
+	checkYara
+	checkSSDeep
+	checkTLSH
 )
 
 type check struct {
@@ -135,6 +151,15 @@ type check struct {
 	minsize, maxsize       uint64
 	minmtime, maxmtime     time.Time
 	inversematch, mismatch bool
+	rules                  *yara.Rules
+	// the rules that matched each file of a yara check
+	yaraMatches map[string][]yara.Match
+	// the reference digest of a fuzzy hash check, and the minimum score
+	// (ssdeep) or maximum distance (tlsh) of similar files
+	reference string
+	threshold int
+	// the similarity of each file that matched a fuzzy hash check
+	similarities map[string]similarity
 }
 
 // pretty much infinity when it comes to file searches
@@ -283,6 +308,51 @@ func (s *search) makeChecks() (err error) {
 		s.checks = append(s.checks, c)
 		s.checkmask |= c.code
 	}
+	for _, v := range s.Yara {
+		var c check
+		c.code = checkYara
+		c.value = v
+		if s.hasMismatch("yara") {
+			c.mismatch = true
+		}
+		c.rules, err = yara.Compile(v)
+		if err != nil {
+			panic(err)
+		}
+		c.yaraMatches = make(map[string][]yara.Match)
+		s.checks = append(s.checks, c)
+		s.checkmask |= c.code
+	}
+	for _, v := range s.SSDeep {
+		var c check
+		c.code = checkSSDeep
+		c.value = v
+		if s.hasMismatch("ssdeep") {
+			c.mismatch = true
+		}
+		c.reference, c.threshold, err = parseFuzzyHash(v, checkSSDeep)
+		if err != nil {
+			panic(err)
+		}
+		c.similarities = make(map[string]similarity)
+		s.checks = append(s.checks, c)
+		s.checkmask |= c.code
+	}
+	for _, v := range s.TLSH {
+		var c check
+		c.code = checkTLSH
+		c.value = v
+		if s.hasMismatch("tlsh") {
+			c.mismatch = true
+		}
+		c.reference, c.threshold, err = parseFuzzyHash(v, checkTLSH)
+		if err != nil {
+			panic(err)
+		}
+		c.similarities = make(map[string]similarity)
+		s.checks = append(s.checks, c)
+		s.checkmask |= c.code
+	}
 	return
 }
 
@@ -518,6 +588,27 @@ func (r *run) ValidateParameters() (err error) {
 				return
 			}
 		}
+		for _, rules := range s.Yara {
+			debugprint("validating yara rules\n")
+			_, err = yara.Compile(rules)
+			if err != nil {
+				return fmt.Errorf("invalid yara rules: %v", err)
+			}
+		}
+		for _, v := range s.SSDeep {
+			debugprint("validating ssdeep '%s'\n", v)
+			_, _, err = parseFuzzyHash(v, checkSSDeep)
+			if err != nil {
+				return
+			}
+		}
+		for _, v := range s.TLSH {
+			debugprint("validating tlsh '%s'\n", v)
+			_, _, err = parseFuzzyHash(v, checkTLSH)
+			if err != nil {
+				return
+			}
+		}
 		for _, mismatch := range s.Options.Mismatch {
 			debugprint("validating mismatch '%s'\n", mismatch)
 			err = validateMismatch(mismatch)
@@ -525,6 +616,15 @@ func (r *run) ValidateParameters() (err error) {
 				return
 			}
 		}
+		if s.Options.Root != "" && s.Options.Image != "" {
+			return fmt.Errorf("options root and image cannot be used together")
+		}
+		if s.Options.ImageOffset < 0 || s.Options.ImageOffset != float64(int64(s.Options.ImageOffset)) {
+			return fmt.Errorf("invalid image offset %f, must be a positive integer", s.Options.ImageOffset)
+		}
+		if s.Options.ImageOffset > 0 && s.Options.Image == "" {
+			return fmt.Errorf("option imageoffset requires an image")
+		}
 		if s.Options.Decompress {
 			tryDecompress = true
 		} else {
@@ -623,11 +723,42 @@ func validateHash(hash string, hashType checkType) error {
 	return nil
 }
 
+// parseFuzzyHash splits the value of a ssdeep or tlsh check, in the form
+// <digest>,<threshold>, in its reference digest and its threshold. The
+// threshold of ssdeep is a minimum score between 0 and 100, the one of tlsh
+// is a maximum distance.
+func parseFuzzyHash(value string, hashType checkType) (digest string, threshold int, err error) {
+	i := strings.LastIndex(value, ",")
+	if i < 0 {
+		return "", 0, fmt.Errorf("Invalid fuzzy hash '%s'. Must be <digest>,<threshold>", value)
+	}
+	digest = value[:i]
+	threshold, err = strconv.Atoi(value[i+1:])
+	if err != nil || threshold < 0 {
+		return "", 0, fmt.Errorf("Invalid threshold in fuzzy hash '%s'. Must be a positive integer", value)
+	}
+	switch hashType {
+	case checkSSDeep:
+		if threshold > 100 {
+			return "", 0, fmt.Errorf("Invalid threshold in ssdeep hash '%s'. Must be between 0 and 100", value)
+		}
+		_, _, _, err = parseSSDeep(digest)
+	case checkTLSH:
+		_, err = parseTLSH(digest)
+	default:
+		err = fmt.Errorf("Invalid fuzzy hash type %d for hash '%s'", hashType, value)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return
+}
+
 func validateMismatch(filter string) error {
 	if len(filter) < 1 {
 		return fmt.Errorf("empty filters are not permitted")
 	}
-	filterregexp := `^(name|size|mode|mtime|content|md5|sha1|sha2|sha3)$`
+	filterregexp := `^(name|size|mode|mtime|content|md5|sha1|sha2|sha3|yara|ssdeep|tlsh)$`
 	re := regexp.MustCompile(filterregexp)
 	if !re.MatchString(filter) {
 		return fmt.Errorf("The syntax of filter '%s' is invalid. Must match regex %s", filter, filterregexp)
@@ -674,6 +805,7 @@ func (r *run) Run(in io.Reader) (resStr string) {
 		}
 	}()
 	t0 := time.Now()
+	progressStart, lastProgress = t0, t0
 	err := modules.ReadInputParameters(in, &r.Parameters)
 	if err != nil {
 		panic(err)
@@ -684,58 +816,110 @@ func (r *run) Run(in io.Reader) (resStr string) {
 		panic(err)
 	}
 
+	// look for an early stop signal while walking, the results are then
+	// built from the matches found so far
+	stop := make(chan bool, 1)
+	r.stop = make(chan bool)
+	go func() {
+		if modules.WatchForStop(in, &stop) == nil {
+			close(r.stop)
+		}
+	}()
+
+	// open the source of each search once, searches on the same source
+	// share its file system
+	sources := make(map[sourceKey]fileSystem)
+	defer func() {
+		for _, fs := range sources {
+			fs.Close()
+		}
+	}()
+	var keys []sourceKey
 	for label, search := range r.Parameters.Searches {
 		debugprint("making checks for label %s\n", label)
 		err := search.makeChecks()
 		if err != nil {
 			panic(err)
 		}
-		var paths []string
-		// clean up the paths, store in roots if not already present
-		for _, p := range search.Paths {
-			p = filepath.Clean(p)
-			paths = append(paths, p)
-			alreadyPresent := false
-			for _, r := range roots {
-				if p == r {
-					alreadyPresent = true
-				}
+		key := search.Options.sourceKey()
+		fs, ok := sources[key]
+		if !ok {
+			fs, err = openFileSystem(key)
+			if err != nil {
+				// log errors and skip the searches of this source
+				walkingErrors = append(walkingErrors, fmt.Sprintf("ERROR: %v", err))
+				debugprint("opening source '%s' failed with error '%v'\n", search.Options.source(), err)
+				continue
 			}
-			if !alreadyPresent {
-				debugprint("adding path %s to list of locations to traverse\n", p)
-				roots = append(roots, p)
+			sources[key] = fs
+			keys = append(keys, key)
+		}
+		search.fs = fs
+		// clean up the paths of the search
+		for i, p := range search.Paths {
+			if key.image != "" {
+				p = imagePath(p)
 			}
+			search.Paths[i] = filepath.Clean(p)
 		}
-		// store the cleaned up paths
-		search.Paths = paths
 		r.Parameters.Searches[label] = search
+	}
+	// walk the searches of each source in turn
+	for _, key := range keys {
+		if modules.IsStopped(r.stop) {
+			break
+		}
+		r.fs = sources[key]
+		roots = nil
+		traversed = nil
+		for _, search := range r.Parameters.Searches {
+			if search.fs != r.fs {
+				continue
+			}
+			// store paths in roots if not already present
+			for _, p := range search.Paths {
+				alreadyPresent := false
+				for _, r := range roots {
+					if p == r {
+						alreadyPresent = true
+					}
+				}
+				if !alreadyPresent {
+					debugprint("adding path %s to list of locations to traverse\n", p)
+					roots = append(roots, p)
+				}
+			}
+		}
 		// sorting the array is useful in case the same command contains "/some/thing"
 		// and then "/some". By starting with the smallest root, we ensure that all the
 		// checks for both "/some" and "/some/thing" will be processed.
 		sort.Strings(roots)
-	}
-	// enter each root one by one
-	for _, root := range roots {
-		// before entering a root, deactivate all searches a reset the depth counters
-		for label, search := range r.Parameters.Searches {
-			search.deactivate()
-			search.currentdepth = 0
-			r.Parameters.Searches[label] = search
-		}
-		for _, p := range traversed {
-			if root == p {
-				debugprint("skipping already traversed root: %s\n", root)
-				goto skip
+		// enter each root one by one
+		for _, root := range roots {
+			if modules.IsStopped(r.stop) {
+				break
 			}
+			// before entering a root, deactivate all searches a reset the depth counters
+			for label, search := range r.Parameters.Searches {
+				search.deactivate()
+				search.currentdepth = 0
+				r.Parameters.Searches[label] = search
+			}
+			for _, p := range traversed {
+				if root == p {
+					debugprint("skipping already traversed root: %s\n", root)
+					goto skip
+				}
+			}
+			debugprint("entering root %s\n", root)
+			traversed, err = r.pathWalk(root, roots)
+			if err != nil {
+				// log errors and continue
+				walkingErrors = append(walkingErrors, fmt.Sprintf("ERROR: %v", err))
+				debugprint("pathWalk failed with error '%v'\n", err)
+			}
+		skip:
 		}
-		debugprint("entering root %s\n", root)
-		traversed, err = r.pathWalk(root, roots)
-		if err != nil {
-			// log errors and continue
-			walkingErrors = append(walkingErrors, fmt.Sprintf("ERROR: %v", err))
-			debugprint("pathWalk failed with error '%v'\n", err)
-		}
-	skip:
 	}
 
 	resStr, err = r.buildResults(t0)
@@ -761,7 +945,6 @@ func (r *run) Run(in io.Reader) (resStr string) {
 func (r *run) pathWalk(path string, roots []string) (traversed []string, err error) {
 	var (
 		subdirs []string
-		target  *os.File
 		t       os.FileInfo
 	)
 	defer func() {
@@ -770,6 +953,9 @@ func (r *run) pathWalk(path string, roots []string) (traversed []string, err err
 		}
 	}()
 	debugprint("pathWalk: walking into '%s'\n", path)
+	if modules.IsStopped(r.stop) {
+		return
+	}
 	// as we traversed the directory structure from the shortest path to the longest, we
 	// may end up traversing directories that are supposed to be processed later on.
 	// when that happens, flag the directory in the traversed list to tell the top-level
@@ -782,6 +968,10 @@ func (r *run) pathWalk(path string, roots []string) (traversed []string, err err
 	// verify that we have at least one search interested in the current directory
 	activesearches := 0
 	for label, search := range r.Parameters.Searches {
+		// searches on other sources stay inactive
+		if search.fs != r.fs {
+			continue
+		}
 		// check if a search needs to be activated by comparing
 		// the search paths with the current path. if one matches,
 		// then the search is activated.
@@ -821,24 +1011,27 @@ func (r *run) pathWalk(path string, roots []string) (traversed []string, err err
 	// Read the content of dir stored in 'path',
 	// put all sub-directories in the subdirs slice, and call
 	// the inspection function for all files
-	target, err = os.Open(path)
+	t, err = r.fs.Lstat(path)
 	if err != nil {
 		// do not panic when open fails, just increase a counter
 		stats.Openfailed++
 		walkingErrors = append(walkingErrors, fmt.Sprintf("ERROR: %v", err))
 		goto finish
 	}
-	t, _ = os.Lstat(path)
 	if t.Mode().IsDir() {
 		// target is a directory, process its content
 		debugprint("'%s' is a directory, processing its content\n", path)
-		dirContent, err := target.Readdir(-1)
+		dirContent, err := r.fs.ReadDir(path)
 		if err != nil {
+			stats.Openfailed++
 			walkingErrors = append(walkingErrors, fmt.Sprintf("ERROR: %v", err))
 			goto finish
 		}
 		// loop over the content of the directory
 		for _, dirEntry := range dirContent {
+			if modules.IsStopped(r.stop) {
+				goto finish
+			}
 			entryAbsPath := path
 			// append path separator if missing & not a symlink
 			// (usefull for first path)
@@ -861,7 +1054,7 @@ func (r *run) pathWalk(path string, roots []string) (traversed []string, err err
 			// if entry is a symlink, evaluate the target
 			isLinkedFile := false
 			if dirEntry.Mode()&os.ModeSymlink == os.ModeSymlink {
-				linkmode, linkpath, err := followSymLink(entryAbsPath)
+				linkmode, linkpath, err := followSymLink(r.fs, entryAbsPath)
 				if err != nil {
 					// reading the link failed, count and continue
 					stats.Openfailed++
@@ -884,7 +1077,7 @@ func (r *run) pathWalk(path string, roots []string) (traversed []string, err err
 
 	// target is a symlink, expand it. we only follow symlinks to files, not directories
 	if t.Mode()&os.ModeSymlink == os.ModeSymlink {
-		linkmode, linkpath, err := followSymLink(path)
+		linkmode, linkpath, err := followSymLink(r.fs, path)
 		if err != nil {
 			// reading the link failed, count and continue
 			stats.Openfailed++
@@ -918,8 +1111,6 @@ func (r *run) pathWalk(path string, roots []string) (traversed []string, err err
 		}
 	}
 finish:
-	// close the current target, we are done with it
-	target.Close()
 	// leaving the directory, decrement the depth counter of active searches
 	for label, search := range r.Parameters.Searches {
 		if search.iscurrent {
@@ -933,13 +1124,13 @@ finish:
 
 // followSymLink expands a symbolic link and return the absolute path of the target,
 // along with its FileMode and an error
-func followSymLink(link string) (mode os.FileMode, path string, err error) {
+func followSymLink(fs fileSystem, link string) (mode os.FileMode, path string, err error) {
 	defer func() {
 		if e := recover(); e != nil {
 			err = fmt.Errorf("followSymLink() -> %v", e)
 		}
 	}()
-	path, err = filepath.EvalSymlinks(link)
+	path, err = fs.EvalSymlinks(link)
 	if err != nil {
 		panic(err)
 	}
@@ -947,7 +1138,7 @@ func followSymLink(link string) (mode os.FileMode, path string, err error) {
 	if !filepath.IsAbs(path) {
 		path = filepath.Dir(link) + string(os.PathSeparator) + path
 	}
-	fi, err := os.Lstat(path)
+	fi, err := fs.Lstat(path)
 	if err != nil {
 		panic(err)
 	}
@@ -957,12 +1148,15 @@ func followSymLink(link string) (mode os.FileMode, path string, err error) {
 
 type fileEntry struct {
 	filename string
-	fd       *os.File
+	fs       fileSystem
+	fd       file
 	compRdr  io.Reader
 }
 
 func (f *fileEntry) Close() {
-	f.fd.Close()
+	if f.fd != nil {
+		f.fd.Close()
+	}
 }
 
 // getReader returns an appropriate reader for the file being checked.
@@ -976,7 +1170,7 @@ func (f *fileEntry) getReader() io.Reader {
 			err = fmt.Errorf("getReader() -> %v", err)
 		}
 	}()
-	f.fd, err = os.Open(f.filename)
+	f.fd, err = f.fs.Open(f.filename)
 	if err != nil {
 		stats.Openfailed++
 		panic(err)
@@ -1032,7 +1226,7 @@ func (r *run) evaluateFile(file string) (err error) {
 	// First pass: look at the file metadata and if MatchAll is set,
 	// deactivate the searches that don't match the current file.
 	// If MatchAll is not set, all checks will be performed individually
-	fi, err := os.Stat(file)
+	fi, err := r.fs.Stat(file)
 	if err != nil {
 		panic(err)
 	}
@@ -1062,7 +1256,7 @@ func (r *run) evaluateFile(file string) (err error) {
 	// Second pass: Enter all content & hash checks across all searches.
 	// Only perform the searches that are active.
 	// Optimize to only read a file once per check type
-	f := fileEntry{filename: file}
+	f := fileEntry{filename: file, fs: r.fs}
 	r.checkContent(f)
 	r.checkHash(f, checkMD5)
 	r.checkHash(f, checkSHA1)
@@ -1073,9 +1267,131 @@ func (r *run) evaluateFile(file string) (err error) {
 	r.checkHash(f, checkSHA3_256)
 	r.checkHash(f, checkSHA3_384)
 	r.checkHash(f, checkSHA3_512)
+	r.checkYara(f)
+	r.checkFuzzyHash(f, checkSSDeep)
+	r.checkFuzzyHash(f, checkTLSH)
+	r.sendProgress(file)
 	return
 }
 
+var (
+	// interval between two progress messages sent to the agent
+	progressInterval            = 10 * time.Second
+	progressStart, lastProgress time.Time
+	// files that matched each search since the last progress message
+	progressHits = make(map[string][]string)
+	// maximum number of files kept in progressHits, the others are only counted
+	maxProgressHits = 1000
+	progressHitsCount int
+	progressTruncated float64
+)
+
+// progressStatistics are the statistics of a progress message, with the number of
+// new matches that were left out of its elements
+type progressStatistics struct {
+	statistics
+	Truncatedhits float64 `json:"truncatedhits,omitempty"`
+}
+
+// sendProgress records the searches the file matched, and sends the statistics
+// and the new matches to the agent if the last progress message is old enough
+func (r *run) sendProgress(file string) {
+	if modules.ProgressWriter == nil {
+		return
+	}
+	for label, search := range r.Parameters.Searches {
+		if !search.justMatched(file) {
+			continue
+		}
+		if progressHitsCount >= maxProgressHits {
+			progressTruncated++
+			continue
+		}
+		progressHits[label] = append(progressHits[label], file)
+		progressHitsCount++
+	}
+	if time.Since(lastProgress) < progressInterval {
+		return
+	}
+	lastProgress = time.Now()
+	progressStats := progressStatistics{statistics: stats, Truncatedhits: progressTruncated}
+	progressStats.Exectime = time.Since(progressStart).String()
+	progress := modules.Progress{Statistics: progressStats}
+	if len(progressHits) > 0 {
+		progress.Elements = progressHits
+		progressHits = make(map[string][]string)
+	}
+	progressHitsCount, progressTruncated = 0, 0
+	err := modules.SendProgress(progress)
+	if err != nil {
+		debugprint("sending progress failed with error '%v'\n", err)
+	}
+}
+
+// PrintProgress returns the statistics and the new matches of a progress message
+func (r *run) PrintProgress(p modules.Progress) (prints []string, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("PrintProgress() -> %v", e)
+		}
+	}()
+	var (
+		pstats progressStatistics
+		hits   map[string][]string
+	)
+	buf, err := json.Marshal(p.Statistics)
+	if err != nil {
+		panic(err)
+	}
+	err = json.Unmarshal(buf, &pstats)
+	if err != nil {
+		panic(err)
+	}
+	buf, err = json.Marshal(p.Elements)
+	if err != nil {
+		panic(err)
+	}
+	err = json.Unmarshal(buf, &hits)
+	if err != nil {
+		panic(err)
+	}
+	var labels []string
+	for label := range hits {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		for _, file := range hits[label] {
+			prints = append(prints, fmt.Sprintf("%s [search '%s' in progress]", file, label))
+		}
+	}
+	if pstats.Truncatedhits > 0 {
+		prints = append(prints, fmt.Sprintf("%.0f more matches were not listed in this progress message.", pstats.Truncatedhits))
+	}
+	prints = append(prints, fmt.Sprintf("Progress: %.0f files checked, %.0f failed to open, running for %s.",
+		pstats.Filescount, pstats.Openfailed, pstats.Exectime))
+	return
+}
+
+// justMatched returns true if the file evaluated last matched the search. When
+// MatchAll is set, the file must have matched all the checks, otherwise any one.
+func (s search) justMatched(file string) bool {
+	if len(s.checks) == 0 {
+		return false
+	}
+	for _, c := range s.checks {
+		// matches are appended, the file evaluated last is at the end
+		matched := len(c.matchedfiles) > 0 && c.matchedfiles[len(c.matchedfiles)-1] == file
+		if matched && !s.Options.MatchAll {
+			return true
+		}
+		if !matched && s.Options.MatchAll {
+			return false
+		}
+	}
+	return s.Options.MatchAll
+}
+
 /* wantThis() implements boolean logic to decide if a given check should be a match or not
 It's just 2 XOR chained one after the other.
 
@@ -1487,7 +1803,7 @@ func getHash(f fileEntry, hashType checkType) (hexhash string, err error) {
 	}()
 	reader := f.getReader()
 	defer f.Close()
-	debugprint("getHash: computing hash for '%s'\n", f.fd.Name())
+	debugprint("getHash: computing hash for '%s'\n", f.filename)
 	var h hash.Hash
 	switch hashType {
 	case checkMD5:
@@ -1527,21 +1843,227 @@ func getHash(f fileEntry, hashType checkType) (hexhash string, err error) {
 	return
 }
 
+// maxReadSize is the size of the largest file read in memory to be matched
+// against yara rules or fuzzy hashes
+const maxReadSize = 64 * 1024 * 1024
+
+// readAll returns the content of a file, which must not be larger than
+// maxReadSize
+func (f *fileEntry) readAll() []byte {
+	reader := f.getReader()
+	defer f.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(reader, maxReadSize+1))
+	if err != nil {
+		panic(err)
+	}
+	if len(data) > maxReadSize {
+		panic(fmt.Sprintf("%s is larger than %d bytes and was not read", f.filename, maxReadSize))
+	}
+	return data
+}
+
+// checkYara matches a file against the yara rules of the active searches
+func (r *run) checkYara(f fileEntry) {
+	var (
+		err error
+	)
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("checkYara() -> %v", e)
+			walkingErrors = append(walkingErrors, err.Error())
+		}
+	}()
+	// skip this check if no search has anything to run
+	nothingToDo := true
+	for _, search := range r.Parameters.Searches {
+		if search.isactive && (search.checkmask&checkYara) != 0 {
+			nothingToDo = false
+		}
+	}
+	if nothingToDo {
+		return
+	}
+	data := f.readAll()
+	for label, search := range r.Parameters.Searches {
+		if search.isactive && (search.checkmask&checkYara) != 0 {
+			for i, c := range search.checks {
+				if c.code&checkYara == 0 {
+					continue
+				}
+				matches, err := c.rules.Scan(data)
+				if err != nil {
+					panic(err)
+				}
+				match := len(matches) > 0
+				if match {
+					debugprint("checkYara: file '%s' matches %d yara rules\n", f.filename, len(matches))
+				}
+				if c.wantThis(match) {
+					c.storeMatch(f.filename)
+					if match {
+						c.yaraMatches[f.filename] = matches
+					}
+				} else if search.Options.MatchAll {
+					search.deactivate()
+				}
+				search.checks[i] = c
+			}
+		}
+		r.Parameters.Searches[label] = search
+	}
+	return
+}
+
+// checkFuzzyHash compares the ssdeep or tlsh digest of a file with the
+// reference digests of the active searches
+func (r *run) checkFuzzyHash(f fileEntry, hashType checkType) {
+	var (
+		err               error
+		algorithm, digest string
+	)
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("checkFuzzyHash() -> %v", e)
+			walkingErrors = append(walkingErrors, err.Error())
+		}
+	}()
+	// skip this check if no search has anything to run
+	nothingToDo := true
+	for _, search := range r.Parameters.Searches {
+		if search.isactive && (search.checkmask&hashType) != 0 {
+			nothingToDo = false
+		}
+	}
+	if nothingToDo {
+		return
+	}
+	data := f.readAll()
+	switch hashType {
+	case checkSSDeep:
+		algorithm = "ssdeep"
+		digest = ssdeepDigest(data)
+	case checkTLSH:
+		algorithm = "tlsh"
+		digest, err = tlshDigest(data)
+		if err != nil {
+			// files that are too small or too uniform have no tlsh
+			// digest, and are not similar to anything
+			debugprint("checkFuzzyHash: no tlsh digest for '%s': %v\n", f.filename, err)
+			digest = ""
+		}
+	default:
+		panic(fmt.Sprintf("unknown fuzzy hash type %d", hashType))
+	}
+	for label, search := range r.Parameters.Searches {
+		if search.isactive && (search.checkmask&hashType) != 0 {
+			for i, c := range search.checks {
+				if c.code&hashType == 0 {
+					continue
+				}
+				var (
+					match bool
+					score int
+				)
+				if digest != "" {
+					switch hashType {
+					case checkSSDeep:
+						score, err = ssdeepCompare(digest, c.reference)
+						match = score >= c.threshold
+					case checkTLSH:
+						score, err = tlshCompare(digest, c.reference)
+						match = score <= c.threshold
+					}
+					if err != nil {
+						panic(err)
+					}
+				}
+				if match {
+					debugprint("checkFuzzyHash: file '%s' is similar to '%s' with score %d\n",
+						f.filename, c.reference, score)
+				}
+				if c.wantThis(match) {
+					c.storeMatch(f.filename)
+					if digest != "" {
+						c.similarities[f.filename] = similarity{
+							Algorithm: algorithm,
+							Reference: c.reference,
+							Digest:    digest,
+							Score:     float64(score),
+						}
+					}
+				} else if search.Options.MatchAll {
+					search.deactivate()
+				}
+				search.checks[i] = c
+			}
+		}
+		r.Parameters.Searches[label] = search
+	}
+	return
+}
+
 type SearchResults map[string]searchresult
 
 type searchresult []matchedfile
 
 type matchedfile struct {
 	File     string   `json:"file"`
+	Source   string   `json:"source,omitempty"`
 	Search   search   `json:"search"`
 	FileInfo fileinfo `json:"fileinfo"`
+	// the yara rules that matched the file
+	Yara []yara.Match `json:"yara,omitempty"`
 }
 
 type fileinfo struct {
-	Size   float64 `json:"size"`
-	Mode   string  `json:"mode"`
-	Mtime  string  `json:"lastmodified"`
-	SHA256 string  `json:"sha256,omitempty"`
+	Size   float64                `json:"size"`
+	Mode   string                 `json:"mode"`
+	Mtime  time.Time              `json:"lastmodified"`
+	SHA256 string                 `json:"sha256,omitempty"`
+	Times  []modules.ArtefactTime `json:"times,omitempty"`
+	// the similarity of the file with the references of the fuzzy hash
+	// checks it matched
+	Similarities []similarity `json:"similarities,omitempty"`
+}
+
+// legacyMtimeLayout is the format of the modification time of files in the
+// results of older agents, which reported it as a string
+const legacyMtimeLayout = "2006-01-02 15:04:05 +0000 UTC"
+
+// UnmarshalJSON decodes the information of a file, and accepts modification
+// times in the legacy layout of older agents as well as in RFC3339
+func (fi *fileinfo) UnmarshalJSON(data []byte) (err error) {
+	type plainfileinfo fileinfo
+	var aux struct {
+		plainfileinfo
+		Mtime string `json:"lastmodified"`
+	}
+	err = json.Unmarshal(data, &aux)
+	if err != nil {
+		return
+	}
+	*fi = fileinfo(aux.plainfileinfo)
+	if aux.Mtime == "" {
+		return
+	}
+	fi.Mtime, err = time.Parse(time.RFC3339Nano, aux.Mtime)
+	if err != nil {
+		fi.Mtime, err = time.Parse(legacyMtimeLayout, aux.Mtime)
+		if err != nil {
+			return fmt.Errorf("invalid modification time %q", aux.Mtime)
+		}
+	}
+	return
+}
+
+// similarity is the comparison of the fuzzy hash of a file with a reference
+// digest. The score of ssdeep goes from 0 to 100 for identical files, the one
+// of tlsh is a distance that is 0 for identical files.
+type similarity struct {
+	Algorithm string  `json:"algorithm"`
+	Reference string  `json:"reference"`
+	Digest    string  `json:"digest"`
+	Score     float64 `json:"score"`
 }
 
 // newResults allocates a Results structure
@@ -1607,22 +2129,32 @@ func (r *run) buildResults(t0 time.Time) (resStr string, err error) {
 			for _, matchedFile := range matchedFiles {
 				var mf matchedfile
 				mf.File = matchedFile
+				mf.Source = search.Options.source()
 				if mf.File != "" {
 					stats.Totalhits++
-					fi, err := os.Stat(mf.File)
+					fi, err := search.fs.Stat(mf.File)
 					if err != nil {
 						panic(err)
 					}
 					mf.FileInfo.Size = float64(fi.Size())
 					mf.FileInfo.Mode = fi.Mode().String()
-					mf.FileInfo.Mtime = fi.ModTime().UTC().String()
+					mf.FileInfo.Mtime = fi.ModTime().UTC()
+					mf.FileInfo.Times = []modules.ArtefactTime{
+						modules.NewArtefactTime(modules.ArtefactTimeModified, fi.ModTime(), "file"),
+					}
 					if search.Options.ReturnSHA256 {
-						f := fileEntry{filename: mf.File}
+						f := fileEntry{filename: mf.File, fs: search.fs}
 						mf.FileInfo.SHA256, err = getHash(f, checkSHA256)
 						if err != nil {
 							panic(err)
 						}
 					}
+					for _, c := range search.checks {
+						mf.Yara = append(mf.Yara, c.yaraMatches[mf.File]...)
+						if sim, ok := c.similarities[mf.File]; ok {
+							mf.FileInfo.Similarities = append(mf.FileInfo.Similarities, sim)
+						}
+					}
 				}
 				mf.Search = search
 				mf.Search.Options.MatchLimit = 0
@@ -1650,16 +2182,24 @@ func (r *run) buildResults(t0 time.Time) (resStr string, err error) {
 			for _, file := range c.matchedfiles {
 				var mf matchedfile
 				mf.File = file
+				mf.Source = search.Options.source()
 				if mf.File != "" {
 					stats.Totalhits++
-					fi, err := os.Stat(file)
+					fi, err := search.fs.Stat(file)
 					if err != nil {
 						panic(err)
 					}
 					mf.FileInfo.Size = float64(fi.Size())
 					mf.FileInfo.Mode = fi.Mode().String()
-					mf.FileInfo.Mtime = fi.ModTime().UTC().String()
+					mf.FileInfo.Mtime = fi.ModTime().UTC()
+					mf.FileInfo.Times = []modules.ArtefactTime{
+						modules.NewArtefactTime(modules.ArtefactTimeModified, fi.ModTime(), "file"),
+					}
 					mf.Search.Paths = []string{filepath.Dir(mf.File)}
+					mf.Yara = c.yaraMatches[mf.File]
+					if sim, ok := c.similarities[mf.File]; ok {
+						mf.FileInfo.Similarities = []similarity{sim}
+					}
 				} else {
 					mf.Search.Paths = search.Paths
 				}
@@ -1692,6 +2232,12 @@ func (r *run) buildResults(t0 time.Time) (resStr string, err error) {
 					mf.Search.SHA2 = append(mf.Search.SHA2, c.value)
 				case checkSHA3_224, checkSHA3_256, checkSHA3_384, checkSHA3_512:
 					mf.Search.SHA3 = append(mf.Search.SHA2, c.value)
+				case checkYara:
+					mf.Search.Yara = append(mf.Search.Yara, c.value)
+				case checkSSDeep:
+					mf.Search.SSDeep = append(mf.Search.SSDeep, c.value)
+				case checkTLSH:
+					mf.Search.TLSH = append(mf.Search.TLSH, c.value)
 				}
 				sr = append(sr, mf)
 			}
@@ -1720,6 +2266,9 @@ func (r *run) buildResults(t0 time.Time) (resStr string, err error) {
 		res.Errors = append(res.Errors, fmt.Sprintf("%d errors were not returned (max errors = %d)",
 			len(walkingErrors)-maxerrors, maxerrors))
 	}
+	if modules.IsStopped(r.stop) {
+		res.Errors = append(res.Errors, modules.StoppedEarly)
+	}
 	// execution succeeded, set Success to true
 	res.Success = true
 	if stats.Totalhits > 0 {
@@ -1767,12 +2316,28 @@ func (r *run) PrintResults(result modules.Result, foundOnly bool) (prints []stri
 				out = fmt.Sprintf("0 match found in search '%s'", label)
 			} else {
 				out = fmt.Sprintf("%s [lastmodified:%s, mode:%s, size:%.0f",
-					mf.File, mf.FileInfo.Mtime, mf.FileInfo.Mode, mf.FileInfo.Size)
+					mf.File, mf.FileInfo.Mtime.Format(time.RFC3339), mf.FileInfo.Mode, mf.FileInfo.Size)
 				if mf.FileInfo.SHA256 != "" {
 					out += fmt.Sprintf(", sha256:%s", strings.ToLower(mf.FileInfo.SHA256))
 				}
+				for _, sim := range mf.FileInfo.Similarities {
+					if sim.Algorithm == "tlsh" {
+						out += fmt.Sprintf(", tlsh_distance:%.0f", sim.Score)
+					} else {
+						out += fmt.Sprintf(", ssdeep_score:%.0f", sim.Score)
+					}
+				}
+				if mf.Source != "" {
+					out += fmt.Sprintf(", source:%s", mf.Source)
+				}
 				out += fmt.Sprintf("] in search '%s'", label)
 			}
+			for _, m := range mf.Yara {
+				out += fmt.Sprintf(" yara_rule='%s'", m.Rule)
+				for _, ms := range m.Strings {
+					out += fmt.Sprintf(" %s@0x%x", ms.ID, ms.Offset)
+				}
+			}
 			if mf.Search.Options.MatchAll {
 				prints = append(prints, out)
 				continue
@@ -1806,6 +2371,12 @@ func (r *run) PrintResults(result modules.Result, foundOnly bool) (prints []stri
 			for _, v := range mf.Search.SHA3 {
 				out += fmt.Sprintf(" sha3='%s'", v)
 			}
+			for _, v := range mf.Search.SSDeep {
+				out += fmt.Sprintf(" ssdeep='%s'", v)
+			}
+			for _, v := range mf.Search.TLSH {
+				out += fmt.Sprintf(" tlsh='%s'", v)
+			}
 			prints = append(prints, out)
 		}
 	}
@@ -8,8 +8,10 @@ package file /* import "mig.ninja/mig/modules/file" */
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -208,6 +210,27 @@ func TestMTime(t *testing.T) {
 	}
 }
 
+func TestUnmarshalMtime(t *testing.T) {
+	expected := time.Date(2016, 9, 1, 10, 20, 30, 500, time.UTC)
+	for _, mtime := range []string{
+		expected.Format(time.RFC3339Nano),
+		expected.String(),
+	} {
+		var fi fileinfo
+		err := json.Unmarshal([]byte(`{"size":12,"mode":"-rw-r--r--","lastmodified":"`+mtime+`"}`), &fi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.Mtime.Equal(expected) || fi.Size != 12 || fi.Mode != "-rw-r--r--" {
+			t.Fatalf("unexpected file info %+v decoded from %q", fi, mtime)
+		}
+	}
+	var fi fileinfo
+	if err := json.Unmarshal([]byte(`{"lastmodified":"yesterday"}`), &fi); err == nil {
+		t.Fatal("expected error on invalid modification time")
+	}
+}
+
 func TestMode(t *testing.T) {
 	for _, tp := range TESTDATA {
 		var (
@@ -609,6 +632,332 @@ func TestMismatch(t *testing.T) {
 
 }
 
+func TestRootSearch(t *testing.T) {
+	var (
+		r run
+		s search
+	)
+	// the paths of the search are under the root, and so are the results
+	var expectedfiles = []string{
+		"/" + TESTDATA[0].name,
+		subdirs + TESTDATA[0].name,
+	}
+	r.Parameters = *newParameters()
+	s.Paths = append(s.Paths, "/")
+	s.Names = append(s.Names, "^"+TESTDATA[0].name+"$")
+	s.Contents = append(s.Contents, TESTDATA[0].content)
+	s.Options.MatchAll = true
+	s.Options.Root = basedir
+	r.Parameters.Searches["s1"] = s
+	msg, err := modules.MakeMessage(modules.MsgClassParameters, r.Parameters, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := r.Run(bytes.NewBuffer(msg))
+	t.Log(out)
+	err = evalResults([]byte(out), expectedfiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = evalSource([]byte(out), basedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImageSearch(t *testing.T) {
+	// the file system starts after a partition table of 1MB
+	image := basedir + "/disk.img"
+	err := ioutil.WriteFile(image, append(make([]byte, 1048576), buildExt4()...), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(image)
+	hosts := fmt.Sprintf("%x", sha256.Sum256([]byte(ext4TestHosts)))
+	var imagetests = []struct {
+		desc          string
+		s             search
+		expectedfiles []string
+	}{
+		{"name in a subdirectory", search{Paths: []string{`C:\`}, Names: []string{"^passwd$"}}, []string{"/etc/passwd"}},
+		{"content through a symbolic link", search{Paths: []string{"/"}, Contents: []string{"^root:x:0:0:"}}, []string{"/etc/passwd", "/link"}},
+		{"hash of a file with an indirect block", search{Paths: []string{"/"}, SHA2: []string{hosts}}, []string{"/hosts"}},
+		{"mtime", search{Paths: []string{"/etc"}, Mtimes: []string{">1h"}}, []string{"/etc/passwd"}},
+	}
+	for _, it := range imagetests {
+		var r run
+		t.Log(it.desc)
+		r.Parameters = *newParameters()
+		it.s.Options.Image = image
+		it.s.Options.ImageOffset = 1048576
+		r.Parameters.Searches["s1"] = it.s
+		msg, err := modules.MakeMessage(modules.MsgClassParameters, r.Parameters, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := r.Run(bytes.NewBuffer(msg))
+		t.Log(out)
+		err = evalResults([]byte(out), it.expectedfiles)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = evalSource([]byte(out), image+"@1048576")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestYaraSearch(t *testing.T) {
+	var yaratests = []struct {
+		desc          string
+		s             search
+		expectedfiles []string
+	}{
+		{"text at offset and filesize",
+			search{Yara: []string{`rule first { strings: $h = "--- header for first file ---" condition: $h at 0 and filesize == 190 }`}},
+			[]string{basedir + "/" + TESTDATA[0].name, basedir + subdirs + TESTDATA[0].name}},
+		{"no match",
+			search{Yara: []string{`rule absent { strings: $a = { 00 01 02 03 } condition: $a }`}},
+			[]string{""}},
+		{"matchall with a name",
+			search{Names: []string{"^testfile0$"}, Yara: []string{`rule comment { strings: $c = /# this is a comment/ condition: #c == 1 }`},
+				Options: options{MatchAll: true}},
+			[]string{basedir + "/" + TESTDATA[0].name, basedir + subdirs + TESTDATA[0].name}},
+	}
+	for _, yt := range yaratests {
+		var r run
+		t.Log(yt.desc)
+		r.Parameters = *newParameters()
+		yt.s.Paths = []string{basedir}
+		r.Parameters.Searches["s1"] = yt.s
+		msg, err := modules.MakeMessage(modules.MsgClassParameters, r.Parameters, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := r.Run(bytes.NewBuffer(msg))
+		t.Log(out)
+		err = evalResults([]byte(out), yt.expectedfiles)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the files found come with the rules and strings that matched
+		var (
+			mr modules.Result
+			sr SearchResults
+		)
+		err = json.Unmarshal([]byte(out), &mr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = mr.GetElements(&sr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mf := range sr["s1"] {
+			if mf.File == "" {
+				continue
+			}
+			if len(mf.Yara) != 1 || len(mf.Yara[0].Strings) != 1 {
+				t.Fatalf("expected the details of 1 yara match in %s, got %+v", mf.File, mf.Yara)
+			}
+		}
+	}
+}
+
+func TestFuzzyHashSearch(t *testing.T) {
+	random, _, _ := fuzzyTestData()
+	ssdeepRef := ssdeepDigest(TESTDATA[0].data)
+	tlshRef, err := tlshDigest(TESTDATA[0].data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fuzzytests = []struct {
+		desc          string
+		s             search
+		expectedfiles []string
+	}{
+		{"ssdeep of the same file",
+			search{SSDeep: []string{ssdeepRef + ",100"}},
+			[]string{basedir + "/" + TESTDATA[0].name, basedir + subdirs + TESTDATA[0].name}},
+		{"tlsh of the same file",
+			search{TLSH: []string{tlshRef + ",0"}},
+			[]string{basedir + "/" + TESTDATA[0].name, basedir + subdirs + TESTDATA[0].name}},
+		{"ssdeep of unrelated data",
+			search{SSDeep: []string{ssdeepDigest(random) + ",1"}},
+			[]string{""}},
+	}
+	for _, ft := range fuzzytests {
+		var r run
+		t.Log(ft.desc)
+		r.Parameters = *newParameters()
+		ft.s.Paths = []string{basedir}
+		r.Parameters.Searches["s1"] = ft.s
+		msg, err := modules.MakeMessage(modules.MsgClassParameters, r.Parameters, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := r.Run(bytes.NewBuffer(msg))
+		t.Log(out)
+		err = evalResults([]byte(out), ft.expectedfiles)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the files found come with their similarity to the reference
+		var (
+			mr modules.Result
+			sr SearchResults
+		)
+		err = json.Unmarshal([]byte(out), &mr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = mr.GetElements(&sr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mf := range sr["s1"] {
+			if mf.File == "" {
+				continue
+			}
+			if len(mf.FileInfo.Similarities) != 1 || mf.FileInfo.Similarities[0].Digest == "" {
+				t.Fatalf("expected the similarity of %s, got %+v", mf.File, mf.FileInfo.Similarities)
+			}
+		}
+	}
+	for _, v := range []string{ssdeepRef, ssdeepRef + ",101", "3:abc,50"} {
+		_, _, err = parseFuzzyHash(v, checkSSDeep)
+		if err == nil {
+			t.Fatalf("expected invalid ssdeep check '%s' to fail", v)
+		}
+	}
+	for _, v := range []string{tlshRef, tlshRef + ",-1", tlshRef[:10] + ",50"} {
+		_, _, err = parseFuzzyHash(v, checkTLSH)
+		if err == nil {
+			t.Fatalf("expected invalid tlsh check '%s' to fail", v)
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	var (
+		r        run
+		s        search
+		progress bytes.Buffer
+	)
+	modules.ProgressWriter = &progress
+	progressInterval = 0
+	defer func() {
+		modules.ProgressWriter = nil
+		progressInterval = 10 * time.Second
+	}()
+	r.Parameters = *newParameters()
+	s.Paths = append(s.Paths, basedir)
+	s.Names = append(s.Names, "^"+TESTDATA[0].name+"$")
+	s.Options.MatchAll = true
+	r.Parameters.Searches["s1"] = s
+	msg, err := modules.MakeMessage(modules.MsgClassParameters, r.Parameters, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := r.Run(bytes.NewBuffer(msg))
+	err = evalResults([]byte(out), []string{basedir + "/" + TESTDATA[0].name, basedir + subdirs + TESTDATA[0].name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a progress message is sent after each file, the matching files are
+	// reported as they are found
+	var (
+		messages int
+		hits     []string
+	)
+	for _, line := range bytes.Split(bytes.TrimSpace(progress.Bytes()), []byte("\n")) {
+		if !modules.IsProgress(line) {
+			t.Fatalf("invalid progress message %s", line)
+		}
+		p, err := modules.ReadProgress(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages++
+		if p.Elements == nil {
+			continue
+		}
+		var elements map[string][]string
+		buf, _ := json.Marshal(p.Elements)
+		err = json.Unmarshal(buf, &elements)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hits = append(hits, elements["s1"]...)
+	}
+	if messages < len(TESTDATA) {
+		t.Fatalf("expected a progress message per file, got %d", messages)
+	}
+	if len(hits) != 2 {
+		t.Fatalf("expected 2 files reported in progress, got %v", hits)
+	}
+}
+
+func TestProgressTruncated(t *testing.T) {
+	var (
+		r        run
+		progress bytes.Buffer
+	)
+	modules.ProgressWriter = &progress
+	progressInterval = time.Hour
+	maxProgressHits = 3
+	defer func() {
+		modules.ProgressWriter = nil
+		progressInterval = 10 * time.Second
+		maxProgressHits = 1000
+	}()
+	r.Parameters = *newParameters()
+	r.Parameters.Searches["s1"] = search{checks: []check{{code: checkName}}}
+	// matches are kept until the next progress message is due, past the
+	// maximum they are only counted
+	lastProgress = time.Now()
+	for i := 0; i < 7; i++ {
+		if i == 6 {
+			lastProgress = time.Time{}
+		}
+		file := fmt.Sprintf("/tmp/file%d", i)
+		s := r.Parameters.Searches["s1"]
+		s.checks[0].matchedfiles = append(s.checks[0].matchedfiles, file)
+		r.sendProgress(file)
+	}
+	lines := bytes.Split(bytes.TrimSpace(progress.Bytes()), []byte("\n"))
+	if len(lines) != 1 {
+		t.Fatalf("expected a single progress message, got %d", len(lines))
+	}
+	p, err := modules.ReadProgress(lines[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	prints, err := r.PrintProgress(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"/tmp/file0 [search 's1' in progress]",
+		"/tmp/file1 [search 's1' in progress]",
+		"/tmp/file2 [search 's1' in progress]",
+		"4 more matches were not listed in this progress message.",
+	}
+	if len(prints) != len(expected)+1 {
+		t.Fatalf("unexpected progress %q", prints)
+	}
+	for i := range expected {
+		if prints[i] != expected[i] {
+			t.Fatalf("expected %q, got %q", expected[i], prints[i])
+		}
+	}
+	// the counters start over after a progress message
+	if len(progressHits) != 0 || progressHitsCount != 0 || progressTruncated != 0 {
+		t.Fatalf("progress counters were not reset: %v %d %.0f", progressHits, progressHitsCount, progressTruncated)
+	}
+}
+
 func TestParamsParser(t *testing.T) {
 	var (
 		r    run
@@ -627,6 +976,7 @@ func TestParamsParser(t *testing.T) {
 	args = append(args, "-sha1", TESTDATA[0].sha1)
 	args = append(args, "-sha2", TESTDATA[0].sha2)
 	args = append(args, "-sha3", TESTDATA[0].sha3)
+	args = append(args, "-ssdeep", ssdeepDigest(TESTDATA[0].data)+",80")
 	args = append(args, "-matchany")
 	args = append(args, "-matchall")
 	args = append(args, "-macroal")
@@ -694,6 +1044,28 @@ func evalResults(jsonresults []byte, expectedfiles []string) error {
 	return nil
 }
 
+// evalSource verifies that the files found by search s1 came from a source
+func evalSource(jsonresults []byte, source string) error {
+	var (
+		mr modules.Result
+		sr SearchResults
+	)
+	err := json.Unmarshal(jsonresults, &mr)
+	if err != nil {
+		return err
+	}
+	if mr.GetElements(&sr) != nil {
+		return fmt.Errorf("failed to retrieve search results")
+	}
+	for _, found := range sr["s1"] {
+		if found.Source != source {
+			return fmt.Errorf("expected file '%s' to come from '%s' but got '%s'",
+				found.File, source, found.Source)
+		}
+	}
+	return nil
+}
+
 func createFiles() (basedir string) {
 	basedir = os.TempDir() + "/migfiletest" + time.Now().Format("15-04-05.99999999")
 	err := os.MkdirAll(basedir+subdirs, 0700)
@@ -0,0 +1,303 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Julien Vehent jvehent@mozilla.com [:ulfr]
+
+package file /* import "mig.ninja/mig/modules/file" */
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"mig.ninja/mig/modules/ntfs"
+)
+
+/*
+	A search runs against the live file system by default, or against an
+	alternate source set in its options:
+
+	- root: a directory standing for the root of the system, such as a
+	  mounted image or a volume shadow copy, whose device paths like
+	  \\?\GLOBALROOT\Device\HarddiskVolumeShadowCopy1 are usable as
+	  directories. The paths of the search, such as C:\Windows or /etc, are
+	  looked up under the root, and symbolic links are resolved within it.
+
+	- image: a raw image or a device holding an NTFS or an ext2/3/4 file
+	  system, read without mounting it. imageoffset is the offset of the
+	  file system in the image, such as the start of a partition. Paths use
+	  / or \ as separator, and the drive letter of Windows paths is ignored.
+
+	The checks of the search run unchanged on the files of the source, and
+	the matches are tagged with it.
+*/
+
+// maxLinks is the number of symbolic links followed before giving up on a
+// loop
+const maxLinks = 40
+
+// fileSystem gives access to the files of the source of a search
+type fileSystem interface {
+	Lstat(path string) (os.FileInfo, error)
+	Stat(path string) (os.FileInfo, error)
+	ReadDir(path string) ([]os.FileInfo, error)
+	Open(path string) (file, error)
+	EvalSymlinks(path string) (string, error)
+	Close() error
+}
+
+// file is an open file of a fileSystem
+type file interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// sourceKey identifies the source of a search, so searches on the same
+// source share their fileSystem
+type sourceKey struct {
+	root   string
+	image  string
+	offset int64
+}
+
+func (o options) sourceKey() sourceKey {
+	return sourceKey{root: o.Root, image: o.Image, offset: int64(o.ImageOffset)}
+}
+
+// source returns the name of the source of a search, empty for the live
+// file system
+func (o options) source() string {
+	switch {
+	case o.Root != "":
+		return o.Root
+	case o.Image != "" && o.ImageOffset > 0:
+		return fmt.Sprintf("%s@%.0f", o.Image, o.ImageOffset)
+	}
+	return o.Image
+}
+
+// openFileSystem returns the fileSystem of a source
+func openFileSystem(key sourceKey) (fileSystem, error) {
+	switch {
+	case key.root != "":
+		fi, err := os.Stat(key.root)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("root %s is not a directory", key.root)
+		}
+		return rootFS{root: key.root}, nil
+	case key.image != "":
+		return openImage(key.image, key.offset)
+	}
+	return liveFS{}, nil
+}
+
+// imagePath converts a path to the path of a file in an image, separated
+// by / and without the drive letter of Windows paths
+func imagePath(path string) string {
+	path = strings.Replace(path, `\`, "/", -1)
+	if len(path) >= 2 && path[1] == ':' {
+		path = path[2:]
+	}
+	return "/" + strings.TrimLeft(path, "/")
+}
+
+// liveFS is the file system of the host
+type liveFS struct{}
+
+func (liveFS) Lstat(path string) (os.FileInfo, error) { return os.Lstat(path) }
+func (liveFS) Stat(path string) (os.FileInfo, error)  { return os.Stat(path) }
+func (liveFS) Open(path string) (file, error)         { return os.Open(path) }
+func (liveFS) Close() error                           { return nil }
+
+func (liveFS) ReadDir(path string) ([]os.FileInfo, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return fd.Readdir(-1)
+}
+
+func (liveFS) EvalSymlinks(path string) (string, error) {
+	return filepath.EvalSymlinks(path)
+}
+
+// rootFS is a directory holding the files of another system
+type rootFS struct {
+	root string
+}
+
+// realPath returns the path of a file of the source on the host. The paths
+// are concatenated rather than joined, as cleaning the device paths of
+// shadow copies would break them.
+func (fs rootFS) realPath(path string) string {
+	path = path[len(filepath.VolumeName(path)):]
+	path = strings.TrimLeft(path, `/\`)
+	return strings.TrimRight(fs.root, `/\`) + string(os.PathSeparator) + path
+}
+
+func (fs rootFS) Lstat(path string) (os.FileInfo, error) { return os.Lstat(fs.realPath(path)) }
+func (fs rootFS) Close() error                           { return nil }
+
+func (fs rootFS) Stat(path string) (os.FileInfo, error) {
+	target, err := fs.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fs.Lstat(target)
+	if err != nil {
+		return nil, err
+	}
+	return linkInfo{fi, filepath.Base(path)}, nil
+}
+
+func (fs rootFS) Open(path string) (file, error) {
+	path, err := fs.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(fs.realPath(path))
+}
+
+func (fs rootFS) ReadDir(path string) ([]os.FileInfo, error) {
+	return liveFS{}.ReadDir(fs.realPath(path))
+}
+
+func (fs rootFS) EvalSymlinks(path string) (string, error) {
+	return resolveLinks(path, fs.Lstat, func(path string) (string, error) {
+		return os.Readlink(fs.realPath(path))
+	})
+}
+
+// imageReader reads the files of the file system of an image
+type imageReader interface {
+	Stat(path string) (os.FileInfo, error)
+	ReadDir(path string) ([]os.FileInfo, error)
+	Open(path string) (*io.SectionReader, error)
+}
+
+// linkReader is implemented by the imageReaders of file systems with
+// symbolic links
+type linkReader interface {
+	Readlink(path string) (string, error)
+}
+
+// imageFS is a file system read from a raw image
+type imageFS struct {
+	fd  *os.File
+	img imageReader
+}
+
+// openImage reads the file system of an image at an offset
+func openImage(path string, offset int64) (fs imageFS, err error) {
+	fs.fd, err = os.Open(path)
+	if err != nil {
+		return
+	}
+	r := io.NewSectionReader(fs.fd, offset, math.MaxInt64-offset)
+	oem := make([]byte, 8)
+	if _, err = r.ReadAt(oem, 3); err != nil {
+		fs.fd.Close()
+		return fs, fmt.Errorf("reading image %s: %v", path, err)
+	}
+	switch {
+	case string(oem) == "NTFS    ":
+		fs.img, err = ntfs.OpenFileSystem(r)
+	case isExt4(r):
+		fs.img, err = openExt4(r)
+	default:
+		err = fmt.Errorf("no NTFS or ext file system found")
+	}
+	if err != nil {
+		fs.fd.Close()
+		return fs, fmt.Errorf("reading image %s: %v", path, err)
+	}
+	return
+}
+
+func (fs imageFS) Lstat(path string) (os.FileInfo, error) { return fs.img.Stat(path) }
+func (fs imageFS) Close() error                           { return fs.fd.Close() }
+
+func (fs imageFS) ReadDir(path string) ([]os.FileInfo, error) {
+	return fs.img.ReadDir(path)
+}
+
+func (fs imageFS) Stat(path string) (os.FileInfo, error) {
+	target, err := fs.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fs.img.Stat(target)
+	if err != nil {
+		return nil, err
+	}
+	return linkInfo{fi, filepath.Base(path)}, nil
+}
+
+func (fs imageFS) Open(path string) (file, error) {
+	path, err := fs.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := fs.img.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return sectionFile{r}, nil
+}
+
+func (fs imageFS) EvalSymlinks(path string) (string, error) {
+	lr, ok := fs.img.(linkReader)
+	if !ok {
+		return path, nil
+	}
+	return resolveLinks(path, fs.img.Stat, lr.Readlink)
+}
+
+// sectionFile is a file read from an image, which has nothing to close
+type sectionFile struct {
+	*io.SectionReader
+}
+
+func (sectionFile) Close() error { return nil }
+
+// linkInfo is the information of the target of a link under the name of
+// the link, as returned by os.Stat
+type linkInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi linkInfo) Name() string { return fi.name }
+
+// resolveLinks follows the symbolic links of the last element of a path,
+// as the walker never enters linked directories. Absolute targets are
+// relative to the root of the source, not of the host.
+func resolveLinks(path string, lstat func(string) (os.FileInfo, error), readlink func(string) (string, error)) (string, error) {
+	for i := 0; i < maxLinks; i++ {
+		fi, err := lstat(path)
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return path, nil
+		}
+		target, err := readlink(path)
+		if err != nil {
+			return "", err
+		}
+		if !strings.HasPrefix(target, "/") && !filepath.IsAbs(target) {
+			target = filepath.Dir(path) + string(os.PathSeparator) + target
+		}
+		path = filepath.Clean(target)
+	}
+	return "", &os.PathError{Op: "evalsymlinks", Path: path, Err: fmt.Errorf("too many links")}
+}
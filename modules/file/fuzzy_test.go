@@ -0,0 +1,184 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Julien Vehent jvehent@mozilla.com [:ulfr]
+
+package file /* import "mig.ninja/mig/modules/file" */
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+// fuzzyTestData returns random data, text, and the same text with a few
+// changes
+func fuzzyTestData() (random, text, modified []byte) {
+	random = make([]byte, 20000)
+	rand.New(rand.NewSource(42)).Read(random)
+	for i := 0; i < 400; i++ {
+		text = append(text, []byte(fmt.Sprintf("line %d of the test data, with value %d\n", i, i*i%97))...)
+	}
+	modified = bytes.Replace(text, []byte("line 200 of"), []byte("a changed line"), 1)
+	modified = append(modified, []byte("and a line at the end\n")...)
+	return
+}
+
+func TestSSDeepDigest(t *testing.T) {
+	random, text, _ := fuzzyTestData()
+	// the digests of the ssdeep tool
+	for _, tc := range []struct {
+		data   []byte
+		digest string
+	}{
+		{random, "384:COfCeQ2GFHsYuwLLBEZhWhTMkDw26/nE6KTK0mg7WTj49bPxRy:NfC00Tfu7sw7naTKGE4bRy"},
+		{text, "96:WSQpjpV1k5pmGRrpXcYYLSX9EJo73/y0DcvE+4mfZQY8MJZG5mJ5j2F:WSc8phALZSy0DcvE+VfZMUJS"},
+	} {
+		digest := ssdeepDigest(tc.data)
+		if digest != tc.digest {
+			t.Fatalf("expected ssdeep digest %s, got %s", tc.digest, digest)
+		}
+	}
+}
+
+func TestSSDeepCompare(t *testing.T) {
+	random, text, modified := fuzzyTestData()
+	for _, tc := range []struct {
+		desc     string
+		d1, d2   []byte
+		min, max int
+	}{
+		{"identical", text, text, 100, 100},
+		{"modified", text, modified, 80, 99},
+		{"unrelated", text, random, 0, 0},
+	} {
+		score, err := ssdeepCompare(ssdeepDigest(tc.d1), ssdeepDigest(tc.d2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if score < tc.min || score > tc.max {
+			t.Fatalf("%s: expected a score between %d and %d, got %d", tc.desc, tc.min, tc.max, score)
+		}
+	}
+	for _, digest := range []string{"", "3:abc", "4:abc:def", "3:a,c:def"} {
+		_, err := ssdeepCompare(digest, "3:abc:def")
+		if err == nil {
+			t.Fatalf("expected invalid ssdeep digest '%s' to fail", digest)
+		}
+	}
+}
+
+func TestTLSH(t *testing.T) {
+	seen := make(map[byte]bool)
+	for _, v := range tlshPearson {
+		seen[v] = true
+	}
+	if len(seen) != 256 {
+		t.Fatalf("the pearson table of tlsh is not a permutation")
+	}
+	random, text, modified := fuzzyTestData()
+	dtext, err := tlshDigest(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dtext) != 72 || dtext[:2] != "T1" {
+		t.Fatalf("invalid tlsh digest %s", dtext)
+	}
+	h, err := parseTLSH(dtext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.String() != dtext {
+		t.Fatalf("tlsh digest %s was decoded as %s", dtext, h.String())
+	}
+	dmodified, err := tlshDigest(modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drandom, err := tlshDigest(random)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		desc     string
+		d1, d2   string
+		min, max int
+	}{
+		{"identical", dtext, dtext, 0, 0},
+		{"legacy format", dtext, dtext[2:], 0, 0},
+		{"modified", dtext, dmodified, 1, 50},
+		{"unrelated", dtext, drandom, 200, 2000},
+	} {
+		distance, err := tlshCompare(tc.d1, tc.d2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if distance < tc.min || distance > tc.max {
+			t.Fatalf("%s: expected a distance between %d and %d, got %d", tc.desc, tc.min, tc.max, distance)
+		}
+	}
+	// data that is too short or too uniform has no digest
+	for _, data := range [][]byte{text[:40], bytes.Repeat([]byte("a"), 1000)} {
+		_, err = tlshDigest(data)
+		if err == nil {
+			t.Fatalf("expected tlsh digest of %d bytes to fail", len(data))
+		}
+	}
+}
+
+// TestTLSHReference checks the digests and distances of the test files of
+// the Go port of tlsh, which match the reference implementation
+func TestTLSHReference(t *testing.T) {
+	digests := make(map[string]string)
+	for _, tc := range []struct{ file, digest string }{
+		{"test_file_1", "T18ED02202FC30802303A002B03B33300FC30A82F83008C2FA000A0080B8BA0E02CCA0C3"},
+		{"test_file_2", "T1B2319634F5C033244EB792AA3168A366E737553DA305A28440CE842D7B57A2CC63B6EC"},
+		{"test_file_3", "T1EA31834386C503B62A920319BA4F92D3BF6FC2B863384515A4EA5638450BC1E9376AE9"},
+		{"test_file_4", "T15111421E72610B73189A13A055B8A8D9B22BB25B7AAF2A84146DF245232A06CD5FB854"},
+		{"test_file_5", "T1E1D1B7337E4E03044FE22379D7C9C95ED66CE42426C39759CCEA9A2AF516838E723364"},
+		{"test_file_6", "T12FE1A7723E8603145BF222F9979ACC7EF74CE4242BD3A7D49899F919F146814C3233A8"},
+	} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", "tlsh", tc.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, err := tlshDigest(data)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.file, err)
+		}
+		if digest != tc.digest {
+			t.Fatalf("%s: expected tlsh digest %s, got %s", tc.file, tc.digest, digest)
+		}
+		digests[tc.file] = digest
+	}
+	for _, tc := range []struct {
+		f1, f2   string
+		distance int
+	}{
+		{"test_file_1", "test_file_1", 0},
+		{"test_file_1", "test_file_2", 418},
+		{"test_file_3", "test_file_1", 374},
+	} {
+		distance, err := tlshCompare(digests[tc.f1], digests[tc.f2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if distance != tc.distance {
+			t.Fatalf("expected a distance of %d between %s and %s, got %d", tc.distance, tc.f1, tc.f2, distance)
+		}
+	}
+	// files that are too short or have too few distinct bytes have no digest
+	for _, file := range []string{"test_file_49bytes", "test_file_q3zero"} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", "tlsh", file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if digest, err := tlshDigest(data); err == nil {
+			t.Fatalf("%s: expected no tlsh digest, got %s", file, digest)
+		}
+	}
+}
@@ -10,9 +10,12 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
+
+	"mig.ninja/mig/modules/yara"
 )
 
 func printHelp(isCmd bool) {
@@ -52,6 +55,18 @@ func printHelp(isCmd bool) {
 %ssha2 <hash>     .
 %ssha3 <hash>     - search file that matches a given hash
 
+%syara <file>     - match files against the YARA rules of a local file, read
+		  when the action is created. files larger than 64MB are not matched.
+		  ex: %syara /tmp/webshells.yar
+
+%sssdeep <digest>,<score> - match files similar to an ssdeep digest, with a
+		  similarity score of at least <score>, from 0 to 100.
+		  ex: %sssdeep 768:cQ6gmdFlbUeeWaZuT38hDnqOkcTYk9kZbAnDkm:b2dFlHaZu4hTdkUYk9yMDkm,70
+
+%stlsh <digest>,<distance> - match files similar to a tlsh digest, at a distance
+		  of at most <distance>. identical files are at a distance of 0.
+		  ex: %stlsh T185332A03A7829ABCC4E1DA7C8AD72132A0307C5DDA30765F6780573A5F61764DB2FB62,50
+
 Options
 -------
 %smaxdepth <int>	- limit search depth to <int> levels. default to 1000, 0 means no limit.
@@ -85,6 +100,19 @@ Options
 %sdecompress		- decompress file before inspection
 			  ex: %sdecompress
 
+%sroot <path>		- search the files of another system under <path>, such as a
+			  mounted image or a volume shadow copy. search paths and
+			  results are relative to <path>.
+			  ex: %sroot \\?\GLOBALROOT\Device\HarddiskVolumeShadowCopy1
+
+%simage <path>		- search the NTFS or ext2/3/4 file system of a raw image or of a
+			  device without mounting it. cannot be used with root.
+			  ex: %simage /dev/sdb1
+
+%simageoffset <int>	- offset in bytes of the file system in the image, such as the
+			  start of a partition. default to 0.
+			  ex: %simageoffset 1048576
+
 %smaxerrors <int>	- limit walking errors returned during search to <int>.
 			  default to 30, 0 means no walking error is returned.
 			  ex: %smaxerrors 1000
@@ -95,7 +123,8 @@ Cheatsheet and examples are at http://mig.mozilla.org/doc/cheatsheet.rst.html
 		dash, dash, dash, dash, dash, dash, dash, dash, dash,
 		dash, dash, dash, dash, dash, dash, dash, dash, dash,
 		dash, dash, dash, dash, dash, dash, dash, dash, dash,
-		dash, dash, dash, dash, dash, dash, dash)
+		dash, dash, dash, dash, dash, dash, dash, dash, dash,
+		dash, dash, dash, dash, dash, dash, dash, dash, dash, dash)
 
 	return
 }
@@ -311,6 +340,39 @@ func (r *run) ParamsCreator() (interface{}, error) {
 					continue
 				}
 				search.SHA3 = append(search.SHA3, checkValue)
+			case "yara":
+				if checkValue == "" {
+					fmt.Println("Missing parameter, try again")
+					continue
+				}
+				rules, err := readYaraRules(checkValue)
+				if err != nil {
+					fmt.Printf("ERROR: %v\nTry again.\n", err)
+					continue
+				}
+				search.Yara = append(search.Yara, rules)
+			case "ssdeep":
+				if checkValue == "" {
+					fmt.Println("Missing parameter, try again")
+					continue
+				}
+				_, _, err = parseFuzzyHash(checkValue, checkSSDeep)
+				if err != nil {
+					fmt.Printf("ERROR: %v\nTry again.\n", err)
+					continue
+				}
+				search.SSDeep = append(search.SSDeep, checkValue)
+			case "tlsh":
+				if checkValue == "" {
+					fmt.Println("Missing parameter, try again")
+					continue
+				}
+				_, _, err = parseFuzzyHash(checkValue, checkTLSH)
+				if err != nil {
+					fmt.Printf("ERROR: %v\nTry again.\n", err)
+					continue
+				}
+				search.TLSH = append(search.TLSH, checkValue)
 			case "maxdepth":
 				if checkValue == "" {
 					fmt.Println("Missing parameter, try again")
@@ -386,6 +448,29 @@ func (r *run) ParamsCreator() (interface{}, error) {
 					continue
 				}
 				search.Options.Decompress = true
+			case "root":
+				if checkValue == "" {
+					fmt.Println("Missing parameter, try again")
+					continue
+				}
+				search.Options.Root = checkValue
+			case "image":
+				if checkValue == "" {
+					fmt.Println("Missing parameter, try again")
+					continue
+				}
+				search.Options.Image = checkValue
+			case "imageoffset":
+				if checkValue == "" {
+					fmt.Println("Missing parameter, try again")
+					continue
+				}
+				v, err := strconv.ParseFloat(checkValue, 64)
+				if err != nil {
+					fmt.Printf("ERROR: %v\nTry again.\n", err)
+					continue
+				}
+				search.Options.ImageOffset = v
 			default:
 				fmt.Printf("Invalid method!\n")
 				continue
@@ -407,9 +492,10 @@ func (r *run) ParamsParser(args []string) (interface{}, error) {
 	var (
 		err error
 		paths, names, sizes, modes, mtimes, contents, md5s, sha1s, sha2s,
-		sha3s, mismatch flagParam
-		maxdepth, maxerrors, matchlimit                                float64
+		sha3s, yaras, ssdeeps, tlshs, mismatch flagParam
+		maxdepth, maxerrors, matchlimit, imageoffset                   float64
 		returnsha256, matchall, matchany, macroal, verbose, decompress bool
+		root, image                                                    string
 		fs                                                             flag.FlagSet
 	)
 	if len(args) < 1 || args[0] == "" || args[0] == "help" {
@@ -427,6 +513,9 @@ func (r *run) ParamsParser(args []string) (interface{}, error) {
 	fs.Var(&sha1s, "sha1", "see help")
 	fs.Var(&sha2s, "sha2", "see help")
 	fs.Var(&sha3s, "sha3", "see help")
+	fs.Var(&yaras, "yara", "see help")
+	fs.Var(&ssdeeps, "ssdeep", "see help")
+	fs.Var(&tlshs, "tlsh", "see help")
 	fs.Var(&mismatch, "mismatch", "see help")
 	fs.Float64Var(&maxdepth, "maxdepth", 1000, "see help")
 	fs.Float64Var(&maxerrors, "maxerrors", 30, "see help")
@@ -437,6 +526,9 @@ func (r *run) ParamsParser(args []string) (interface{}, error) {
 	fs.BoolVar(&debug, "verbose", false, "see help")
 	fs.BoolVar(&returnsha256, "returnsha256", false, "see help")
 	fs.BoolVar(&decompress, "decompress", false, "see help")
+	fs.StringVar(&root, "root", "", "see help")
+	fs.StringVar(&image, "image", "", "see help")
+	fs.Float64Var(&imageoffset, "imageoffset", 0, "see help")
 	err = fs.Parse(args)
 	if err != nil {
 		return nil, err
@@ -452,6 +544,15 @@ func (r *run) ParamsParser(args []string) (interface{}, error) {
 	s.SHA1 = sha1s
 	s.SHA2 = sha2s
 	s.SHA3 = sha3s
+	for _, file := range yaras {
+		rules, err := readYaraRules(file)
+		if err != nil {
+			return nil, err
+		}
+		s.Yara = append(s.Yara, rules)
+	}
+	s.SSDeep = ssdeeps
+	s.TLSH = tlshs
 	s.Options.MaxDepth = maxdepth
 	s.Options.MaxErrors = maxerrors
 	s.Options.MatchLimit = matchlimit
@@ -460,6 +561,9 @@ func (r *run) ParamsParser(args []string) (interface{}, error) {
 	s.Options.MatchAll = matchall
 	s.Options.ReturnSHA256 = returnsha256
 	s.Options.Decompress = decompress
+	s.Options.Root = root
+	s.Options.Image = image
+	s.Options.ImageOffset = imageoffset
 	if matchany {
 		s.Options.MatchAll = false
 	}
@@ -472,6 +576,20 @@ func (r *run) ParamsParser(args []string) (interface{}, error) {
 	return r.Parameters, r.ValidateParameters()
 }
 
+// readYaraRules reads a local file of yara rules, which are sent to the
+// agents in the parameters
+func readYaraRules(file string) (rules string, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	_, err = yara.Compile(string(data))
+	if err != nil {
+		return "", fmt.Errorf("invalid yara rules in %s: %v", file, err)
+	}
+	return string(data), nil
+}
+
 type flagParam []string
 
 func (f *flagParam) String() string {
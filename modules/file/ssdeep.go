@@ -0,0 +1,250 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Julien Vehent jvehent@mozilla.com [:ulfr]
+
+package file /* import "mig.ninja/mig/modules/file" */
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+	ssdeep computes context triggered piecewise hashes: a rolling hash over a
+	window of 7 bytes splits the data in blocks, and each block is reduced to
+	one base64 character of its FNV hash. Two digests of similar data share
+	most of their characters, and are compared with an edit distance. The
+	digests and the scores are the ones of the ssdeep tool.
+*/
+
+const (
+	ssdeepWindow     = 7
+	ssdeepMinBlock   = 3
+	ssdeepLength     = 64
+	ssdeepHashPrime  = 0x01000193
+	ssdeepHashInit   = 0x28021967
+	ssdeepBase64     = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+	ssdeepMaxBlock   = ssdeepMinBlock << 30
+	ssdeepSequences  = 3
+	ssdeepInsertCost = 1
+	ssdeepRemoveCost = 1
+	ssdeepChangeCost = 2
+)
+
+// ssdeepRoll is the rolling hash of the last 7 bytes of the data
+type ssdeepRoll struct {
+	window     [ssdeepWindow]byte
+	h1, h2, h3 uint32
+	n          uint32
+}
+
+func (r *ssdeepRoll) hash(c byte) uint32 {
+	r.h2 -= r.h1
+	r.h2 += ssdeepWindow * uint32(c)
+	r.h1 += uint32(c)
+	r.h1 -= uint32(r.window[r.n%ssdeepWindow])
+	r.window[r.n%ssdeepWindow] = c
+	r.n++
+	r.h3 = r.h3 << 5
+	r.h3 ^= uint32(c)
+	return r.h1 + r.h2 + r.h3
+}
+
+// ssdeepDigest returns the ssdeep digest of data, as blocksize:hash1:hash2
+func ssdeepDigest(data []byte) string {
+	blocksize := uint32(ssdeepMinBlock)
+	for uint64(blocksize)*ssdeepLength < uint64(len(data)) && blocksize < ssdeepMaxBlock {
+		blocksize *= 2
+	}
+	for {
+		h1, h2, blocks := ssdeepHashes(data, blocksize)
+		// a digest of less than half the maximum number of blocks does not
+		// say much about the data, retry with a smaller block size
+		if blocksize > ssdeepMinBlock && blocks < ssdeepLength/2 {
+			blocksize /= 2
+			continue
+		}
+		return fmt.Sprintf("%d:%s:%s", blocksize, h1, h2)
+	}
+}
+
+// ssdeepHashes returns the hashes of data for a block size and twice that
+// block size, and the number of blocks of the first hash
+func ssdeepHashes(data []byte, blocksize uint32) (string, string, int) {
+	var (
+		roll         ssdeepRoll
+		rh           uint32
+		h1, h2       []byte
+		tail1, tail2 bool
+		blocks       int
+	)
+	sum1, sum2 := uint32(ssdeepHashInit), uint32(ssdeepHashInit)
+	last1, last2 := sum1, sum2
+	for _, c := range data {
+		sum1 = (sum1 * ssdeepHashPrime) ^ uint32(c)
+		sum2 = (sum2 * ssdeepHashPrime) ^ uint32(c)
+		rh = roll.hash(c)
+		if rh%blocksize != blocksize-1 {
+			continue
+		}
+		// once a hash is full, its last character is the hash of all the
+		// remaining blocks
+		if len(h1) < ssdeepLength-1 {
+			blocks++
+			h1 = append(h1, ssdeepBase64[sum1%64])
+			sum1 = ssdeepHashInit
+		} else {
+			last1, tail1 = sum1, true
+		}
+		if rh%(2*blocksize) != 2*blocksize-1 {
+			continue
+		}
+		if len(h2) < ssdeepLength/2-1 {
+			h2 = append(h2, ssdeepBase64[sum2%64])
+			sum2 = ssdeepHashInit
+		} else {
+			last2, tail2 = sum2, true
+		}
+	}
+	// the data that follows the last block is hashed as well, unless the
+	// rolling hash ends on zero
+	switch {
+	case rh != 0:
+		h1 = append(h1, ssdeepBase64[sum1%64])
+		h2 = append(h2, ssdeepBase64[sum2%64])
+	default:
+		if tail1 {
+			h1 = append(h1, ssdeepBase64[last1%64])
+		}
+		if tail2 {
+			h2 = append(h2, ssdeepBase64[last2%64])
+		}
+	}
+	return string(h1), string(h2), blocks
+}
+
+// parseSSDeep splits an ssdeep digest in its block size and its hashes
+func parseSSDeep(digest string) (blocksize uint64, h1, h2 string, err error) {
+	parts := strings.Split(digest, ":")
+	if len(parts) != 3 {
+		return 0, "", "", fmt.Errorf("invalid ssdeep digest '%s', must be blocksize:hash:hash", digest)
+	}
+	blocksize, err = strconv.ParseUint(parts[0], 10, 32)
+	if err != nil || blocksize < ssdeepMinBlock || blocksize%ssdeepMinBlock != 0 {
+		return 0, "", "", fmt.Errorf("invalid block size in ssdeep digest '%s'", digest)
+	}
+	for _, h := range parts[1:] {
+		if len(h) > ssdeepLength {
+			return 0, "", "", fmt.Errorf("invalid ssdeep digest '%s', hashes are too long", digest)
+		}
+		for _, c := range h {
+			if !strings.ContainsRune(ssdeepBase64, c) {
+				return 0, "", "", fmt.Errorf("invalid character '%c' in ssdeep digest '%s'", c, digest)
+			}
+		}
+	}
+	return blocksize, parts[1], parts[2], nil
+}
+
+// ssdeepCompare returns the similarity of two ssdeep digests, from 0 for
+// unrelated data to 100 for identical data
+func ssdeepCompare(digest1, digest2 string) (score int, err error) {
+	bs1, h11, h12, err := parseSSDeep(digest1)
+	if err != nil {
+		return
+	}
+	bs2, h21, h22, err := parseSSDeep(digest2)
+	if err != nil {
+		return
+	}
+	// only the hashes of the same block size can be compared
+	if bs1 != bs2 && bs1 != 2*bs2 && bs2 != 2*bs1 {
+		return 0, nil
+	}
+	h11, h12 = ssdeepEliminateSequences(h11), ssdeepEliminateSequences(h12)
+	h21, h22 = ssdeepEliminateSequences(h21), ssdeepEliminateSequences(h22)
+	switch {
+	case bs1 == bs2 && h11 == h21 && h12 == h22:
+		return 100, nil
+	case bs1 == bs2:
+		score = max(ssdeepScore(h11, h21, bs1), ssdeepScore(h12, h22, 2*bs1))
+	case bs1 == 2*bs2:
+		score = ssdeepScore(h11, h22, bs1)
+	default:
+		score = ssdeepScore(h12, h21, bs2)
+	}
+	return
+}
+
+// ssdeepEliminateSequences shortens the sequences of more than 3 identical
+// characters, which carry little information
+func ssdeepEliminateSequences(h string) string {
+	var out []byte
+	for i := 0; i < len(h); i++ {
+		if i >= ssdeepSequences && h[i] == h[i-1] && h[i] == h[i-2] && h[i] == h[i-3] {
+			continue
+		}
+		out = append(out, h[i])
+	}
+	return string(out)
+}
+
+// ssdeepScore returns the similarity of two hashes of the same block size
+func ssdeepScore(h1, h2 string, blocksize uint64) int {
+	if len(h1) > ssdeepLength || len(h2) > ssdeepLength {
+		return 0
+	}
+	// unrelated data may have close hashes by chance, so the hashes must
+	// share a common substring of the size of the window of the rolling hash
+	common := false
+	for i := 0; i+ssdeepWindow <= len(h1); i++ {
+		if strings.Contains(h2, h1[i:i+ssdeepWindow]) {
+			common = true
+			break
+		}
+	}
+	if !common {
+		return 0
+	}
+	score := ssdeepEditDistance(h1, h2)
+	score = (score * ssdeepLength) / (len(h1) + len(h2))
+	score = (100 * score) / ssdeepLength
+	if score >= 100 {
+		return 0
+	}
+	score = 100 - score
+	// small block sizes match small files, the score of which cannot be
+	// greater than the size of their hashes
+	if blocksize >= (99+ssdeepWindow)/ssdeepWindow*ssdeepMinBlock {
+		return score
+	}
+	if limit := int(blocksize) / ssdeepMinBlock * min(len(h1), len(h2)); score > limit {
+		score = limit
+	}
+	return score
+}
+
+// ssdeepEditDistance returns the edit distance of two hashes, where a
+// change costs as much as a removal and an insertion
+func ssdeepEditDistance(s1, s2 string) int {
+	prev := make([]int, len(s2)+1)
+	cur := make([]int, len(s2)+1)
+	for j := range prev {
+		prev[j] = j * ssdeepInsertCost
+	}
+	for i := 1; i <= len(s1); i++ {
+		cur[0] = i * ssdeepRemoveCost
+		for j := 1; j <= len(s2); j++ {
+			change := prev[j-1]
+			if s1[i-1] != s2[j-1] {
+				change += ssdeepChangeCost
+			}
+			cur[j] = min(prev[j]+ssdeepRemoveCost, cur[j-1]+ssdeepInsertCost, change)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(s2)]
+}
@@ -0,0 +1,223 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Julien Vehent jvehent@mozilla.com [:ulfr]
+
+package file /* import "mig.ninja/mig/modules/file" */
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+/*
+	TLSH is a locality sensitive hash: the trigrams of a sliding window of 5
+	bytes are counted in 128 buckets, and each bucket is reduced to its
+	quartile in the distribution of the counts. The digest also carries a
+	checksum, the logarithm of the length of the data and the ratios of its
+	quartiles. Two digests are compared with a distance, from 0 for identical
+	data to several hundreds for unrelated data. The digests are the 72
+	characters of the T1 format of the tlsh tool, with its 128 buckets and its
+	1 byte checksum.
+*/
+
+const (
+	tlshWindow    = 5
+	tlshBuckets   = 128
+	tlshCodeSize  = tlshBuckets / 4
+	tlshMinLength = 50
+	// checksum, length, quartiles ratios and code
+	tlshLength = 3 + tlshCodeSize
+)
+
+// tlshPearson is the permutation of the pearson hash of the trigrams
+var tlshPearson = [256]byte{
+	1, 87, 49, 12, 176, 178, 102, 166, 121, 193, 6, 84, 249, 230, 44, 163,
+	14, 197, 213, 181, 161, 85, 218, 80, 64, 239, 24, 226, 236, 142, 38, 200,
+	110, 177, 104, 103, 141, 253, 255, 50, 77, 101, 81, 18, 45, 96, 31, 222,
+	25, 107, 190, 70, 86, 237, 240, 34, 72, 242, 20, 214, 244, 227, 149, 235,
+	97, 234, 57, 22, 60, 250, 82, 175, 208, 5, 127, 199, 111, 62, 135, 248,
+	174, 169, 211, 58, 66, 154, 106, 195, 245, 171, 17, 187, 182, 179, 0, 243,
+	132, 56, 148, 75, 128, 133, 158, 100, 130, 126, 91, 13, 153, 246, 216, 219,
+	119, 68, 223, 78, 83, 88, 201, 99, 122, 11, 92, 32, 136, 114, 52, 10,
+	138, 30, 48, 183, 156, 35, 61, 26, 143, 74, 251, 94, 129, 162, 63, 152,
+	170, 7, 115, 167, 241, 206, 3, 150, 55, 59, 151, 220, 90, 53, 23, 131,
+	125, 173, 15, 238, 79, 95, 89, 16, 105, 137, 225, 224, 217, 160, 37, 123,
+	118, 73, 2, 157, 46, 116, 9, 145, 134, 228, 207, 212, 202, 215, 69, 229,
+	27, 188, 67, 124, 168, 252, 42, 4, 29, 108, 21, 247, 19, 205, 39, 203,
+	233, 40, 186, 147, 198, 192, 155, 33, 164, 191, 98, 204, 165, 180, 117, 76,
+	140, 36, 210, 172, 41, 54, 159, 8, 185, 232, 113, 196, 231, 47, 146, 120,
+	51, 65, 28, 144, 254, 221, 93, 189, 194, 139, 112, 43, 71, 109, 184, 209,
+}
+
+func tlshMapping(salt, i, j, k byte) byte {
+	h := tlshPearson[salt]
+	h = tlshPearson[h^i]
+	h = tlshPearson[h^j]
+	return tlshPearson[h^k]
+}
+
+// tlshHash is the decoded content of a digest
+type tlshHash struct {
+	checksum byte
+	length   byte
+	q1ratio  byte
+	q2ratio  byte
+	code     [tlshCodeSize]byte
+}
+
+// tlshDigest returns the TLSH digest of data. Data that is too short or
+// too uniform does not have a digest.
+func tlshDigest(data []byte) (digest string, err error) {
+	if len(data) < tlshMinLength {
+		return "", fmt.Errorf("tlsh needs at least %d bytes of data", tlshMinLength)
+	}
+	var (
+		h       tlshHash
+		buckets [256]uint32
+	)
+	for i := tlshWindow - 1; i < len(data); i++ {
+		w0, w1, w2, w3, w4 := data[i], data[i-1], data[i-2], data[i-3], data[i-4]
+		h.checksum = tlshMapping(0, w0, w1, h.checksum)
+		buckets[tlshMapping(2, w0, w1, w2)]++
+		buckets[tlshMapping(3, w0, w1, w3)]++
+		buckets[tlshMapping(5, w0, w2, w3)]++
+		buckets[tlshMapping(7, w0, w2, w4)]++
+		buckets[tlshMapping(11, w0, w1, w4)]++
+		buckets[tlshMapping(13, w0, w3, w4)]++
+	}
+	sorted := make([]uint32, tlshBuckets)
+	copy(sorted, buckets[:tlshBuckets])
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	q1, q2, q3 := sorted[tlshBuckets/4-1], sorted[tlshBuckets/2-1], sorted[3*tlshBuckets/4-1]
+	nonzero := 0
+	for _, count := range sorted {
+		if count > 0 {
+			nonzero++
+		}
+	}
+	if q3 == 0 || nonzero <= tlshBuckets/2 {
+		return "", fmt.Errorf("tlsh needs more variety in the data")
+	}
+	for i := range h.code {
+		for j := uint(0); j < 4; j++ {
+			switch count := buckets[4*i+int(j)]; {
+			case count > q3:
+				h.code[i] += 3 << (j * 2)
+			case count > q2:
+				h.code[i] += 2 << (j * 2)
+			case count > q1:
+				h.code[i] += 1 << (j * 2)
+			}
+		}
+	}
+	h.length = tlshLengthCapture(len(data))
+	h.q1ratio = byte(uint64(q1) * 100 / uint64(q3) % 16)
+	h.q2ratio = byte(uint64(q2) * 100 / uint64(q3) % 16)
+	return h.String(), nil
+}
+
+// tlshLengthCapture returns the logarithm of the length of the data, on a
+// scale that is finer for small lengths
+func tlshLengthCapture(length int) byte {
+	l := math.Log(float64(length))
+	var i int
+	switch {
+	case length <= 656:
+		i = int(math.Floor(l / 0.4054651))
+	case length <= 3199:
+		i = int(math.Floor(l/0.26236426 - 8.72777))
+	default:
+		i = int(math.Floor(l/0.095310180 - 62.5472))
+	}
+	return byte(i & 0xFF)
+}
+
+func swapNibbles(b byte) byte {
+	return b<<4 | b>>4
+}
+
+// String returns the digest in the T1 format
+func (h tlshHash) String() string {
+	raw := make([]byte, 0, tlshLength)
+	raw = append(raw, swapNibbles(h.checksum), swapNibbles(h.length), h.q1ratio<<4|h.q2ratio)
+	for i := len(h.code) - 1; i >= 0; i-- {
+		raw = append(raw, h.code[i])
+	}
+	return "T1" + strings.ToUpper(hex.EncodeToString(raw))
+}
+
+// parseTLSH decodes a digest in the T1 format, or in the older format
+// without a version
+func parseTLSH(digest string) (h tlshHash, err error) {
+	raw, err := hex.DecodeString(strings.TrimPrefix(strings.ToUpper(digest), "T1"))
+	if err != nil || len(raw) != tlshLength {
+		return h, fmt.Errorf("invalid tlsh digest '%s', must be %d hexadecimal characters", digest, 2*tlshLength)
+	}
+	h.checksum = swapNibbles(raw[0])
+	h.length = swapNibbles(raw[1])
+	h.q1ratio, h.q2ratio = raw[2]>>4, raw[2]&0xF
+	for i := range h.code {
+		h.code[i] = raw[tlshLength-1-i]
+	}
+	return h, nil
+}
+
+// tlshCompare returns the distance between two TLSH digests, 0 if the
+// digests are identical
+func tlshCompare(digest1, digest2 string) (distance int, err error) {
+	h1, err := parseTLSH(digest1)
+	if err != nil {
+		return
+	}
+	h2, err := parseTLSH(digest2)
+	if err != nil {
+		return
+	}
+	// a difference of one step of length or ratio may be noise, the next
+	// steps weigh much more
+	switch d := modDiff(int(h1.length), int(h2.length), 256); d {
+	case 0, 1:
+		distance += d
+	default:
+		distance += d * 12
+	}
+	for _, d := range []int{modDiff(int(h1.q1ratio), int(h2.q1ratio), 16), modDiff(int(h1.q2ratio), int(h2.q2ratio), 16)} {
+		if d <= 1 {
+			distance += d
+		} else {
+			distance += (d - 1) * 12
+		}
+	}
+	if h1.checksum != h2.checksum {
+		distance++
+	}
+	for i := range h1.code {
+		for j := uint(0); j < 8; j += 2 {
+			a, b := int(h1.code[i]>>j&3), int(h2.code[i]>>j&3)
+			d := a - b
+			if d < 0 {
+				d = -d
+			}
+			// buckets at opposite quartiles are much further apart
+			if d == 3 {
+				d = 6
+			}
+			distance += d
+		}
+	}
+	return
+}
+
+// modDiff returns the distance between x and y on a circle of size r
+func modDiff(x, y, r int) int {
+	d := x - y
+	if d < 0 {
+		d = -d
+	}
+	return min(d, r-d)
+}
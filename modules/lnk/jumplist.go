@@ -0,0 +1,167 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package lnk /* import "mig.ninja/mig/modules/lnk" */
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"mig.ninja/mig/modules/winbin"
+)
+
+/*
+	Jump lists hold the recent and pinned items of an application, named
+	after its AppID:
+
+	- AppID.automaticDestinations-ms are compound files with a Shell Link
+	  stream per item, named after the entry number in hexadecimal, and a
+	  DestList stream holding the last access time, the access count and
+	  the pin status of each entry
+	- AppID.customDestinations-ms are lists maintained by the application,
+	  made of Shell Links following each other, which are carved by their
+	  header
+
+	The DestList starts with a 32 bytes header holding its version. The
+	entries hold the droids and the NetBIOS name of the tracker block,
+	followed by the entry number, the last access time, the pin status and
+	the path of the target. Windows 10 (version 3 and later) added the
+	access count and moved the path.
+*/
+
+const (
+	destListHeaderSize = 32
+	destListEntryV1    = 0x72 // size of an entry before the path, version 1
+	destListEntryV3    = 0x82 // size of an entry before the path, version 3
+)
+
+// destListEntry is the metadata of an entry of an AutomaticDestinations
+// jump list
+type destListEntry struct {
+	netbios     string
+	accessed    time.Time
+	pinned      bool
+	accessCount int
+	path        string
+}
+
+// parseAutomaticDestinations returns the items of an AutomaticDestinations
+// jump list, and the errors of the items that could not be parsed
+func parseAutomaticDestinations(r io.ReaderAt) (links []Link, errs []error) {
+	cf, err := openCompound(r)
+	if err != nil {
+		return nil, []error{err}
+	}
+	var destList map[uint32]destListEntry
+	for _, s := range cf.streams() {
+		if s.name != "DestList" {
+			continue
+		}
+		data, err := cf.read(s)
+		if err == nil {
+			destList, err = parseDestList(data)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, s := range cf.streams() {
+		id, err := strconv.ParseUint(s.name, 16, 32)
+		if err != nil {
+			// only the streams of the items have hexadecimal names
+			continue
+		}
+		data, err := cf.read(s)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		sl, err := ParseShellLink(data)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("entry %s: %v", s.name, err))
+			continue
+		}
+		link := Link{Entry: s.name, ShellLink: sl}
+		if dl, ok := destList[uint32(id)]; ok {
+			link.Opened = dl.accessed
+			link.Pinned = dl.pinned
+			link.AccessCount = dl.accessCount
+			if link.MachineID == "" {
+				link.MachineID = dl.netbios
+			}
+			if link.TargetPath == "" {
+				link.TargetPath = dl.path
+			}
+		}
+		links = append(links, link)
+	}
+	return
+}
+
+// parseDestList returns the entries of a DestList stream by entry number
+func parseDestList(data []byte) (entries map[uint32]destListEntry, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("parseDestList: %v", e)
+		}
+	}()
+	version := winbin.Le32(data, 0)
+	count := int(winbin.Le32(data, 4))
+	entries = make(map[uint32]destListEntry)
+	off := destListHeaderSize
+	for i := 0; i < count && off < len(data); i++ {
+		e := destListEntry{
+			netbios:  ansiz(winbin.Slice(data, off+0x48, 16)),
+			accessed: winbin.Filetime(winbin.Le64(data, off+0x64)),
+			pinned:   int32(winbin.Le32(data, off+0x6c)) >= 0,
+		}
+		id := winbin.Le32(data, off+0x58)
+		var pathLen int
+		if version >= 3 {
+			e.accessCount = int(winbin.Le32(data, off+0x74))
+			pathLen = int(winbin.Le16(data, off+0x80))
+			e.path = winbin.UTF16String(winbin.Slice(data, off+destListEntryV3, pathLen*2))
+			// entries of version 3 end with 4 unknown bytes
+			off += destListEntryV3 + pathLen*2 + 4
+		} else {
+			pathLen = int(winbin.Le16(data, off+0x70))
+			e.path = winbin.UTF16String(winbin.Slice(data, off+destListEntryV1, pathLen*2))
+			off += destListEntryV1 + pathLen*2
+		}
+		entries[id] = e
+	}
+	return
+}
+
+// parseCustomDestinations carves the Shell Links of a CustomDestinations
+// jump list
+func parseCustomDestinations(data []byte) (links []Link, errs []error) {
+	var offsets []int
+	for off := 0; ; {
+		i := bytes.Index(data[off:], linkSignature)
+		if i < 0 {
+			break
+		}
+		offsets = append(offsets, off+i)
+		off += i + len(linkSignature)
+	}
+	for n, start := range offsets {
+		end := len(data)
+		if n+1 < len(offsets) {
+			end = offsets[n+1]
+		}
+		sl, err := ParseShellLink(data[start:end])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("link at offset %d: %v", start, err))
+			continue
+		}
+		links = append(links, Link{Entry: strconv.Itoa(n), ShellLink: sl})
+	}
+	return
+}
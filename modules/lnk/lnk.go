@@ -0,0 +1,572 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+/*
+
+If you run it, it will return a JSON struct with an array of the files
+users opened, as recorded by Shell Links (.lnk) and jump lists. If you add
+flag `-p`, it will pretty print the results.
+
+Windows creates a link in the Recent folder of a user for each file the
+user opens, and applications keep their recent and pinned items in the
+AutomaticDestinations and CustomDestinations jump lists. The links keep
+the path, the volume, the times and the size of their target, the NetBIOS
+name of the machine holding it and its link tracking identifiers, even
+after the target is gone, such as files opened from removable media or
+shares.
+
+By default, the Recent folders, Office Recent folders and desktops of all
+the users under `root` are read. `directories` adds directories holding
+links and jump lists, read recursively, such as artefacts extracted from
+another system. When `directories` is set without `root`, only those
+directories are read.
+
+Links are filtered in the style of the file module:
+- names: regular expressions matched against the file name of the target
+- paths: regular expressions matched against the full path of the target
+- mtimes: time windows of the last time the target was opened, such as
+  `<90d` for the last 90 days, or `>2h` for more than 2 hours ago
+Expressions starting with `!` match the targets they do not match. A link
+must match one of the values of each filter set.
+
+Example JSON
+-------------
+
+{
+    "module": "lnk",
+    "parameters": {
+        "paths": [
+            "^[D-Z]:\\\\",
+            "^\\\\\\\\"
+        ],
+        "names": [
+            "\\.(docx?|xlsm?|pdf)$"
+        ],
+        "mtimes": [
+            "<30d"
+        ]
+    }
+}
+*/
+package lnk /* import "mig.ninja/mig/modules/lnk" */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mig.ninja/mig/modules"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	An instance of this type will represent this module; it's possible to add additional data fields here,
+	although that is rarely needed.
+*/
+type module struct {
+}
+
+func (m *module) NewRun() modules.Runner {
+	return new(run)
+}
+
+/*
+	init is called by the Go runtime at startup. We use this function to register the module in a
+	global array of available modules, so the agent knows we exist
+*/
+func init() {
+	modules.Register("lnk", new(module))
+}
+
+type run struct {
+	Parameters params
+	Results    modules.Result
+	stop       chan bool // closed when the module is asked to stop early
+}
+
+/*
+	- Root: Alternate root of the system volume, such as a shadow copy or a
+			mounted image. Defaults to %SYSTEMDRIVE%
+	- Directories: Additional directories of links and jump lists
+	- Names: Regular expressions of the file names of the targets
+	- Paths: Regular expressions of the paths of the targets
+	- Mtimes: Time windows of the last time the targets were opened
+*/
+type params struct {
+	Root        string   `json:"root,omitempty"`
+	Directories []string `json:"directories,omitempty"`
+	Names       []string `json:"names,omitempty"`
+	Paths       []string `json:"paths,omitempty"`
+	Mtimes      []string `json:"mtimes,omitempty"`
+	Debug       bool     `json:"debug,omitempty"`
+}
+
+const (
+	TypeLink                  = "lnk"
+	TypeAutomaticDestinations = "automaticdestinations"
+	TypeCustomDestinations    = "customdestinations"
+)
+
+/*
+	Link is a file opened by a user. Source is the .lnk file or jump list
+	it was found in, Type tells which of the two. Jump list items carry the
+	AppID of their application, their entry in the jump list, and their pin
+	status and access count when the jump list records them. Opened is the
+	last time the target was opened: the last write of a .lnk file, or the
+	last access recorded by an AutomaticDestinations jump list.
+*/
+type Link struct {
+	Source string `json:"source"`
+	Type   string `json:"type"`
+	AppID  string `json:"appid,omitempty"`
+	Entry  string `json:"entry,omitempty"`
+	ShellLink
+	Opened      time.Time              `json:"opened"`
+	AccessCount int                    `json:"accesscount,omitempty"`
+	Pinned      bool                   `json:"pinned,omitempty"`
+	Times       []modules.ArtefactTime `json:"times,omitempty"`
+}
+
+type elements struct {
+	Links []Link `json:"lnkresults,omitempty"`
+}
+
+/* Statistic counters:
+- FilesParsed is the number of links and jump lists read
+- LinksFound is the number of links found in those files
+- Matches is the number of links matching the filters
+- Exectime is the total runtime of the search
+*/
+type statistics struct {
+	FilesParsed int           `json:"filesparsed"`
+	LinksFound  int           `json:"linksfound"`
+	Matches     int           `json:"matches"`
+	Exectime    time.Duration `json:"exectime"`
+}
+
+// mtimeFormat is the format of the mtimes filters, as in the file module
+var mtimeFormat = regexp.MustCompile(`^(<|>)[0-9]+(d|h|m)$`)
+
+/*
+	ValidateParameters *must* be implemented by a module. It provides a method to verify that the parameters
+	passed to the module conform the expected format. It must return an error if the parameters do not validate.
+*/
+func (r *run) ValidateParameters() (err error) {
+	p := r.Parameters
+	if p.Root == "" && len(p.Directories) == 0 && runtime.GOOS != "windows" {
+		return fmt.Errorf("ValidateParameters: Root or Directories must be set outside of Windows.")
+	}
+	for _, list := range [][]string{p.Names, p.Paths} {
+		if _, err := compileFilters(list); err != nil {
+			return fmt.Errorf("ValidateParameters: %v", err)
+		}
+	}
+	for _, m := range p.Mtimes {
+		if !mtimeFormat.MatchString(m) {
+			return fmt.Errorf("ValidateParameters: Invalid mtime %q. Must match regex %s", m, mtimeFormat.String())
+		}
+	}
+	return
+}
+
+/*
+	Run *must* be implemented by a module. Its the function that executes the module. It must return a string of
+	marshalled json that contains the results from the module. The code below provides a base module skeleton that
+	can be reused in all modules.
+*/
+func (r *run) Run(in io.Reader) (out string) {
+	// a good way to handle execution failures is to catch panics and store
+	// the panicked error into modules.Results.Errors, marshal that, and output
+	// the JSON string back to the caller
+	defer func() {
+		if e := recover(); e != nil {
+			r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%v", e))
+			r.Results.Success = false
+			buf, _ := json.Marshal(r.Results)
+			out = string(buf[:])
+		}
+	}()
+
+	// read module parameters from stdin
+	err := modules.ReadInputParameters(in, &r.Parameters)
+	if err != nil {
+		panic(err)
+	}
+	// verify that the parameters we received are valid
+	err = r.ValidateParameters()
+	if err != nil {
+		panic(err)
+	}
+
+	// start a goroutine that does some work and another one that looks
+	// for an early stop signal
+	moduleDone := make(chan bool)
+	stop := make(chan bool)
+	r.stop = make(chan bool)
+	go r.doModuleStuff(&out, &moduleDone)
+	go modules.WatchForStop(in, &stop)
+
+	select {
+	case <-moduleDone:
+		return out
+	case <-stop:
+		// the module builds its results from what it collected so far
+		close(r.stop)
+		<-moduleDone
+		return out
+	}
+}
+
+/* doModuleStuff is an internal module function that does things specific to the module. There is no implementation requirement.
+   It's good practice to have it return the JSON string Run() expects to return. We also make it return a boolean in the `moduleDone`
+   channel to do flow control in Run().
+*/
+func (r *run) doModuleStuff(out *string, moduleDone *chan bool) error {
+	var (
+		el    elements
+		stats statistics
+	)
+	t0 := time.Now()
+
+	names, err := compileFilters(r.Parameters.Names)
+	if err != nil {
+		panic(err)
+	}
+	paths, err := compileFilters(r.Parameters.Paths)
+	if err != nil {
+		panic(err)
+	}
+	for _, file := range r.sourceFiles() {
+		if modules.IsStopped(r.stop) {
+			r.Results.Errors = append(r.Results.Errors, modules.StoppedEarly)
+			break
+		}
+		if r.Parameters.Debug {
+			fmt.Println("Parsing ", file, "....")
+		}
+		links, errs := parseFile(file)
+		for _, err := range errs {
+			r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%s: %v", file, err))
+		}
+		if links == nil && len(errs) > 0 {
+			continue
+		}
+		stats.FilesParsed++
+		for _, l := range links {
+			stats.LinksFound++
+			if !names.match(targetName(l.TargetPath)) || !paths.match(l.TargetPath) || !r.inMtimes(l.Opened) {
+				continue
+			}
+			for _, t := range []struct {
+				kind string
+				time time.Time
+			}{
+				{modules.ArtefactTimeAccessed, l.Opened},
+				{modules.ArtefactTimeCreated, l.TargetCreated},
+				{modules.ArtefactTimeModified, l.TargetModified},
+			} {
+				if !t.time.IsZero() {
+					l.Times = append(l.Times, modules.NewArtefactTime(t.kind, t.time, "lnk"))
+				}
+			}
+			stats.Matches++
+			el.Links = append(el.Links, l)
+		}
+	}
+	stats.Exectime = time.Now().Sub(t0)
+
+	// marshal the results into a json string
+	*out = r.buildResults(el, stats)
+	*moduleDone <- true
+	return nil
+}
+
+// sourceFiles returns the links and jump lists of the Recent folders,
+// Office Recent folders and desktops of the users, and of the directories
+// of the parameters
+func (r *run) sourceFiles() (files []string) {
+	root := r.Parameters.Root
+	if root == "" && len(r.Parameters.Directories) == 0 {
+		root = os.Getenv("SYSTEMDRIVE") + `\`
+	}
+	walk := func(dir string, recursive bool) {
+		filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				r.Results.Errors = append(r.Results.Errors, err.Error())
+				return nil
+			}
+			if fi.IsDir() {
+				if path != dir && !recursive {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if fileType(path) != "" {
+				files = append(files, path)
+			}
+			return nil
+		})
+	}
+	if root != "" {
+		for _, user := range users(root) {
+			for _, dir := range []struct {
+				path      []string
+				recursive bool
+			}{
+				{[]string{"AppData", "Roaming", "Microsoft", "Windows", "Recent"}, true},
+				{[]string{"AppData", "Roaming", "Microsoft", "Office", "Recent"}, false},
+				{[]string{"Desktop"}, false},
+			} {
+				if path, ok := findPath(root, append([]string{"Users", user}, dir.path...)...); ok {
+					walk(path, dir.recursive)
+				}
+			}
+		}
+	}
+	for _, dir := range r.Parameters.Directories {
+		walk(dir, true)
+	}
+	return
+}
+
+// parseFile returns the links of a .lnk file or of a jump list
+func parseFile(path string) (links []Link, errs []error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, []error{err}
+	}
+	typ := fileType(path)
+	switch typ {
+	case TypeLink:
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, []error{err}
+		}
+		sl, err := ParseShellLink(data)
+		if err != nil {
+			return nil, []error{err}
+		}
+		// the link of the Recent folder is updated each time its target
+		// is opened
+		links = []Link{{ShellLink: sl, Opened: fi.ModTime().UTC()}}
+	case TypeAutomaticDestinations:
+		fd, err := os.Open(path)
+		if err != nil {
+			return nil, []error{err}
+		}
+		defer fd.Close()
+		links, errs = parseAutomaticDestinations(fd)
+	case TypeCustomDestinations:
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, []error{err}
+		}
+		links, errs = parseCustomDestinations(data)
+	}
+	appID := ""
+	if typ != TypeLink {
+		appID = strings.SplitN(filepath.Base(path), ".", 2)[0]
+	}
+	for i := range links {
+		links[i].Source = path
+		links[i].Type = typ
+		links[i].AppID = appID
+	}
+	return
+}
+
+// fileType returns the type of a file from its extension, or an empty
+// string for files that are neither links nor jump lists
+func fileType(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".lnk":
+		return TypeLink
+	case ".automaticdestinations-ms":
+		return TypeAutomaticDestinations
+	case ".customdestinations-ms":
+		return TypeCustomDestinations
+	}
+	return ""
+}
+
+// targetName returns the file name of a Windows path
+func targetName(path string) string {
+	return path[strings.LastIndexAny(path, `\/`)+1:]
+}
+
+// filter is a compiled regular expression of the names or paths filters,
+// which matches the strings it does not match when it is inverted
+type filter struct {
+	re      *regexp.Regexp
+	inverse bool
+}
+
+type filters []filter
+
+func compileFilters(exprs []string) (list filters, err error) {
+	for _, expr := range exprs {
+		var f filter
+		if len(expr) > 1 && expr[0] == '!' {
+			f.inverse = true
+			expr = expr[1:]
+		}
+		f.re, err = regexp.Compile("(?i)" + expr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regular expression %q: %v", expr, err)
+		}
+		list = append(list, f)
+	}
+	return
+}
+
+// match returns true if one of the filters matches, or if there are none
+func (list filters) match(s string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, f := range list {
+		if f.re.MatchString(s) != f.inverse {
+			return true
+		}
+	}
+	return false
+}
+
+// inMtimes returns true if a time is in one of the time windows of the
+// mtimes filters, or if there are none
+func (r *run) inMtimes(t time.Time) bool {
+	if len(r.Parameters.Mtimes) == 0 {
+		return true
+	}
+	if t.IsZero() {
+		return false
+	}
+	for _, m := range r.Parameters.Mtimes {
+		n, _ := strconv.Atoi(m[1 : len(m)-1])
+		d := time.Duration(n) * time.Minute
+		switch m[len(m)-1] {
+		case 'd':
+			d = time.Duration(n) * 24 * time.Hour
+		case 'h':
+			d = time.Duration(n) * time.Hour
+		}
+		limit := time.Now().Add(-d)
+		if (m[0] == '<' && t.After(limit)) || (m[0] == '>' && t.Before(limit)) {
+			return true
+		}
+	}
+	return false
+}
+
+// users returns the names of the user profiles under a root
+func users(root string) (users []string) {
+	dir, ok := findPath(root, "Users")
+	if !ok {
+		return
+	}
+	profiles, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range profiles {
+		if fi.IsDir() {
+			users = append(users, fi.Name())
+		}
+	}
+	return
+}
+
+// findPath joins path elements to a root, ignoring the case of the
+// elements that are not found as is, as images mounted on Linux are case
+// sensitive
+func findPath(root string, elems ...string) (string, bool) {
+	p := root
+	for _, e := range elems {
+		next := filepath.Join(p, e)
+		if _, err := os.Lstat(next); err != nil {
+			entries, err := ioutil.ReadDir(p)
+			if err != nil {
+				return "", false
+			}
+			found := false
+			for _, fi := range entries {
+				if strings.EqualFold(fi.Name(), e) {
+					next, found = filepath.Join(p, fi.Name()), true
+					break
+				}
+			}
+			if !found {
+				return "", false
+			}
+		}
+		p = next
+	}
+	return p, true
+}
+
+// buildResults takes the results found by the module, as well as statistics,
+// and puts all that into a JSON string. It also takes care of setting the
+// success and foundanything flags.
+func (r *run) buildResults(el elements, stats statistics) string {
+	if len(r.Results.Errors) == 0 {
+		r.Results.Success = true
+	}
+	r.Results.Elements = el
+	r.Results.Statistics = stats
+	if len(el.Links) > 0 {
+		r.Results.FoundAnything = true
+	}
+	jsonOutput, err := json.Marshal(r.Results)
+	if err != nil {
+		panic(err)
+	}
+	return string(jsonOutput[:])
+}
+
+// PrintResults() is an *optional* method that returns results in a human-readable format.
+// if matchOnly is set, only results that have at least one match are returned.
+// If matchOnly is not set, all results are returned, along with errors and statistics.
+func (r *run) PrintResults(result modules.Result, matchOnly bool) (prints []string, err error) {
+	var (
+		el    elements
+		stats statistics
+	)
+	err = result.GetElements(&el)
+	if err != nil {
+		panic(err)
+	}
+	prints = append(prints, fmt.Sprintf("\n-----------------\n     Link Results           \n------------------"))
+	for _, l := range el.Links {
+		prints = append(prints, fmt.Sprintf("%s, Opened: %s, Source: %s",
+			l.TargetPath, l.Opened.Format(time.RFC3339), l.Source))
+		volume := l.NetworkShare
+		if l.VolumeSerial != "" {
+			volume = fmt.Sprintf("%s %s %q", l.DriveType, l.VolumeSerial, l.VolumeLabel)
+		}
+		prints = append(prints, fmt.Sprintf("    Volume: %s, Machine: %s, MAC: %s", volume, l.MachineID, l.MACAddress))
+		prints = append(prints, fmt.Sprintf("    Created: %s, Modified: %s, Accessed: %s, Size: %d",
+			l.TargetCreated.Format(time.RFC3339), l.TargetModified.Format(time.RFC3339),
+			l.TargetAccessed.Format(time.RFC3339), l.TargetSize))
+	}
+
+	for _, e := range result.Errors {
+		prints = append(prints, fmt.Sprintf("error: %v", e))
+	}
+	err = result.GetStatistics(&stats)
+	if err != nil {
+		panic(err)
+	}
+	prints = append(prints, fmt.Sprintf("Files Parsed    : %d", stats.FilesParsed))
+	prints = append(prints, fmt.Sprintf("Links Found     : %d", stats.LinksFound))
+	prints = append(prints, fmt.Sprintf("Matches         : %d", stats.Matches))
+	return
+}
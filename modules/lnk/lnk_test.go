@@ -0,0 +1,560 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package lnk /* import "mig.ninja/mig/modules/lnk" */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"mig.ninja/mig/modules"
+	"mig.ninja/mig/testutil"
+)
+
+func TestRegistration(t *testing.T) {
+	testutil.CheckModuleRegistration(t, "lnk")
+}
+
+var (
+	testCreated  = time.Date(2016, 8, 30, 8, 0, 0, 0, time.UTC)
+	testModified = time.Date(2016, 8, 31, 17, 30, 0, 0, time.UTC)
+	testOpened   = time.Date(2016, 9, 1, 10, 20, 30, 0, time.UTC)
+	// a version 1 UUID created on a host with MAC address 08:00:27:aa:bb:cc
+	testDroidFile = []byte{0x5a, 0xa5, 0x7e, 0x4c, 0x2a, 0x8e, 0xe6, 0x11, 0x9b, 0xdd, 0x08, 0x00, 0x27, 0xaa, 0xbb, 0xcc}
+)
+
+// testLink describes a generated Shell Link
+type testLink struct {
+	localBase, share, suffix string
+	driveType, serial        uint32
+	label                    string
+	arguments, workingDir    string
+	machine                  string
+	idList                   []byte
+}
+
+// buildLink generates a unicode Shell Link with an ANSI LinkInfo
+func buildLink(l testLink) []byte {
+	b := append([]byte(nil), linkSignature...)
+	flags := uint32(isUnicode)
+	if l.idList != nil {
+		flags |= hasLinkTargetIDList
+	}
+	if l.localBase != "" || l.share != "" {
+		flags |= hasLinkInfo
+	}
+	if l.workingDir != "" {
+		flags |= hasWorkingDir
+	}
+	if l.arguments != "" {
+		flags |= hasArguments
+	}
+	b = testutil.AppendUint32(b, flags)
+	b = testutil.AppendUint32(b, 0x20)
+	b = testutil.AppendUint64(b, testutil.Filetime(testCreated))
+	b = testutil.AppendUint64(b, testutil.Filetime(testOpened))
+	b = testutil.AppendUint64(b, testutil.Filetime(testModified))
+	b = testutil.AppendUint32(b, 73728)
+	b = append(b, make([]byte, linkHeaderSize-len(b))...)
+
+	if l.idList != nil {
+		b = testutil.AppendUint16(b, uint16(len(l.idList)))
+		b = append(b, l.idList...)
+	}
+	if flags&hasLinkInfo != 0 {
+		var infoFlags uint32
+		var volume, base, network []byte
+		if l.localBase != "" {
+			infoFlags |= volumeIDAndLocalBasePath
+			volume = testutil.AppendUint32(nil, uint32(0x10+len(l.label)+1))
+			volume = testutil.AppendUint32(volume, l.driveType)
+			volume = testutil.AppendUint32(volume, l.serial)
+			volume = testutil.AppendUint32(volume, 0x10)
+			volume = append(append(volume, l.label...), 0)
+			base = append([]byte(l.localBase), 0)
+		}
+		if l.share != "" {
+			infoFlags |= commonNetworkRelativeLinkAndPathSuffix
+			network = testutil.AppendUint32(nil, uint32(0x14+len(l.share)+1))
+			network = testutil.AppendUint32(network, 0)
+			network = testutil.AppendUint32(network, 0x14)
+			network = testutil.AppendUint32(network, 0)
+			network = testutil.AppendUint32(network, 0x20000)
+			network = append(append(network, l.share...), 0)
+		}
+		suffix := append([]byte(l.suffix), 0)
+		const headerSize = 0x1c
+		volumeOff := headerSize
+		baseOff := volumeOff + len(volume)
+		networkOff := baseOff + len(base)
+		suffixOff := networkOff + len(network)
+		size := suffixOff + len(suffix)
+		info := testutil.AppendUint32(nil, uint32(size))
+		info = testutil.AppendUint32(info, headerSize)
+		info = testutil.AppendUint32(info, infoFlags)
+		for _, off := range []int{volumeOff, baseOff, networkOff, suffixOff} {
+			info = testutil.AppendUint32(info, uint32(off))
+		}
+		if l.localBase == "" {
+			binary.LittleEndian.PutUint32(info[0x0c:], 0)
+			binary.LittleEndian.PutUint32(info[0x10:], 0)
+		}
+		if l.share == "" {
+			binary.LittleEndian.PutUint32(info[0x14:], 0)
+		}
+		info = append(info, volume...)
+		info = append(info, base...)
+		info = append(info, network...)
+		b = append(b, append(info, suffix...)...)
+	}
+	for _, s := range []string{l.workingDir, l.arguments} {
+		if s != "" {
+			b = testutil.AppendUint16(b, uint16(len(utf16.Encode([]rune(s)))))
+			b = append(b, testutil.EncodeUTF16(s)...)
+		}
+	}
+	if l.machine != "" {
+		tracker := testutil.AppendUint32(nil, 0x60)
+		tracker = testutil.AppendUint32(tracker, trackerBlock)
+		tracker = testutil.AppendUint32(tracker, 0x58)
+		tracker = testutil.AppendUint32(tracker, 0)
+		machine := make([]byte, 16)
+		copy(machine, l.machine)
+		tracker = append(tracker, machine...)
+		volume := bytes.Repeat([]byte{0x11}, 16)
+		tracker = append(tracker, volume...)
+		tracker = append(tracker, testDroidFile...)
+		tracker = append(tracker, volume...)
+		tracker = append(tracker, testDroidFile...)
+		b = append(b, tracker...)
+	}
+	// terminal block
+	return testutil.AppendUint32(b, 0)
+}
+
+// testIDList returns the shell items of C:\Reports\Quarterly Report.docx
+func testIDList() []byte {
+	var list []byte
+	item := func(data []byte) {
+		list = testutil.AppendUint16(list, uint16(len(data)+2))
+		list = append(list, data...)
+	}
+	item(append([]byte{0x1f, 0x50}, make([]byte, 16)...))
+	item(append([]byte("/C:\\"), make([]byte, 20)...))
+	fileEntry := func(short, long string) []byte {
+		e := append([]byte{0x31, 0}, make([]byte, 10)...)
+		e = append(e, short...)
+		e = append(e, 0)
+		if len(e)%2 != 0 {
+			e = append(e, 0)
+		}
+		ext := make([]byte, 0x2e)
+		binary.LittleEndian.PutUint16(ext[2:], 9)
+		binary.LittleEndian.PutUint32(ext[4:], 0xbeef0004)
+		ext = append(ext, testutil.EncodeUTF16(long)...)
+		ext = append(ext, 0, 0, 0x14, 0)
+		binary.LittleEndian.PutUint16(ext, uint16(len(ext)))
+		return append(e, ext...)
+	}
+	item(fileEntry("Reports", "Reports"))
+	e := fileEntry("QUARTE~1.DOC", "Quarterly Report.docx")
+	e[0] = 0x32
+	item(e)
+	return testutil.AppendUint16(list, 0)
+}
+
+func TestParseShellLink(t *testing.T) {
+	l, err := ParseShellLink(buildLink(testLink{
+		localBase:  `E:\payroll\`,
+		suffix:     "",
+		driveType:  2,
+		serial:     0x1ce9a8f2,
+		label:      "USBKEY",
+		arguments:  "/r",
+		workingDir: `E:\payroll`,
+		machine:    "desktop-7k1f",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ShellLink{
+		TargetPath:       `E:\payroll\`,
+		Arguments:        "/r",
+		WorkingDir:       `E:\payroll`,
+		DriveType:        "removable",
+		VolumeSerial:     "1CE9A8F2",
+		VolumeLabel:      "USBKEY",
+		MachineID:        "desktop-7k1f",
+		DroidVolume:      "11111111-1111-1111-1111-111111111111",
+		DroidFile:        "4c7ea55a-8e2a-11e6-9bdd-080027aabbcc",
+		BirthDroidVolume: "11111111-1111-1111-1111-111111111111",
+		BirthDroidFile:   "4c7ea55a-8e2a-11e6-9bdd-080027aabbcc",
+		MACAddress:       "08:00:27:aa:bb:cc",
+		TargetCreated:    testCreated,
+		TargetModified:   testModified,
+		TargetAccessed:   testOpened,
+		TargetSize:       73728,
+	}
+	if l != expected {
+		t.Fatalf("expected %+v, got %+v", expected, l)
+	}
+
+	l, err = ParseShellLink(buildLink(testLink{share: `\\FILESERVER\share`, suffix: `tools\tools.zip`}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.TargetPath != `\\FILESERVER\share\tools\tools.zip` || l.NetworkShare != `\\FILESERVER\share` || l.VolumeSerial != "" {
+		t.Fatalf("unexpected network link %+v", l)
+	}
+
+	l, err = ParseShellLink(buildLink(testLink{idList: testIDList()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.TargetPath != `C:\Reports\Quarterly Report.docx` {
+		t.Fatalf("unexpected target of the shell items %q", l.TargetPath)
+	}
+
+	for _, data := range [][]byte{
+		[]byte("not a link"),
+		buildLink(testLink{localBase: `C:\`})[:linkHeaderSize+8],
+	} {
+		if _, err := ParseShellLink(data); err == nil {
+			t.Fatalf("expected error parsing %q", data)
+		}
+	}
+}
+
+// buildDestList generates a DestList stream of a given version, with an
+// entry for each stream number
+func buildDestList(version uint32, opened map[uint32]time.Time, paths map[uint32]string) []byte {
+	b := testutil.AppendUint32(nil, version)
+	b = testutil.AppendUint32(b, uint32(len(opened)))
+	b = append(b, make([]byte, destListHeaderSize-8)...)
+	for id := uint32(1); id <= uint32(len(opened)); id++ {
+		e := make([]byte, 0x58)
+		copy(e[0x48:], "desktop-7k1f")
+		e = testutil.AppendUint32(e, id)
+		e = append(e, make([]byte, 8)...)
+		e = testutil.AppendUint64(e, testutil.Filetime(opened[id]))
+		// the first entry is pinned
+		pin := uint32(0xffffffff)
+		if id == 1 {
+			pin = 0
+		}
+		e = testutil.AppendUint32(e, pin)
+		path := testutil.EncodeUTF16(paths[id])
+		if version >= 3 {
+			e = testutil.AppendUint32(e, 0)
+			e = testutil.AppendUint32(e, 7)
+			e = append(e, make([]byte, 8)...)
+		}
+		e = testutil.AppendUint16(e, uint16(len(path)/2))
+		e = append(e, path...)
+		if version >= 3 {
+			e = append(e, make([]byte, 4)...)
+		}
+		b = append(b, e...)
+	}
+	return b
+}
+
+type testStream struct {
+	name string
+	data []byte
+}
+
+// buildCompound generates a compound file of 512 bytes sectors. Streams
+// smaller than 4096 bytes are stored in the mini stream.
+func buildCompound(streams []testStream) []byte {
+	const (
+		sectorSize = 512
+		free       = 0xffffffff
+		endOfChain = 0xfffffffe
+		fatSector  = 0xfffffffd
+	)
+	var (
+		fat     = []uint32{fatSector}
+		sectors [][]byte
+		miniFat []uint32
+		mini    []byte
+	)
+	// addChain appends data to a list of sectors and chains them in a table
+	addChain := func(table *[]uint32, data []byte, size int, add func([]byte)) uint32 {
+		if len(data) == 0 {
+			return endOfChain
+		}
+		start := uint32(len(*table))
+		for off := 0; off < len(data); off += size {
+			chunk := make([]byte, size)
+			copy(chunk, data[off:])
+			add(chunk)
+			next := uint32(len(*table)) + 1
+			if off+size >= len(data) {
+				next = endOfChain
+			}
+			*table = append(*table, next)
+		}
+		return start
+	}
+	addSector := func(b []byte) { sectors = append(sectors, b) }
+	addMini := func(b []byte) { mini = append(mini, b...) }
+	sectors = append(sectors, nil) // the FAT itself
+
+	type entry struct {
+		name  string
+		kind  byte
+		start uint32
+		size  int
+	}
+	entries := []entry{{name: "Root Entry", kind: cfRootStorage}}
+	for _, s := range streams {
+		e := entry{name: s.name, kind: cfStreamObject, size: len(s.data)}
+		if len(s.data) < 4096 {
+			e.start = addChain(&miniFat, s.data, 64, addMini)
+		} else {
+			e.start = addChain(&fat, s.data, sectorSize, addSector)
+		}
+		entries = append(entries, e)
+	}
+	entries[0].start = addChain(&fat, mini, sectorSize, addSector)
+	entries[0].size = len(mini)
+	var miniFatData []byte
+	for _, n := range miniFat {
+		miniFatData = testutil.AppendUint32(miniFatData, n)
+	}
+	miniFatStart := addChain(&fat, miniFatData, sectorSize, addSector)
+
+	var dir []byte
+	for i, e := range entries {
+		d := make([]byte, cfDirEntrySize)
+		name := append(testutil.EncodeUTF16(e.name), 0, 0)
+		copy(d, name)
+		binary.LittleEndian.PutUint16(d[0x40:], uint16(len(name)))
+		d[0x42] = e.kind
+		// the streams are right siblings of each other, under the root
+		left, right, child := uint32(free), uint32(free), uint32(free)
+		if i == 0 && len(entries) > 1 {
+			child = 1
+		} else if i > 0 && i+1 < len(entries) {
+			right = uint32(i + 1)
+		}
+		binary.LittleEndian.PutUint32(d[0x44:], left)
+		binary.LittleEndian.PutUint32(d[0x48:], right)
+		binary.LittleEndian.PutUint32(d[0x4c:], child)
+		binary.LittleEndian.PutUint64(d[0x6c:], testutil.Filetime(testOpened))
+		binary.LittleEndian.PutUint32(d[0x74:], e.start)
+		binary.LittleEndian.PutUint64(d[0x78:], uint64(e.size))
+		dir = append(dir, d...)
+	}
+	dirStart := addChain(&fat, dir, sectorSize, addSector)
+
+	fatData := make([]byte, sectorSize)
+	for i := range fatData {
+		fatData[i] = 0xff
+	}
+	for i, n := range fat {
+		binary.LittleEndian.PutUint32(fatData[i*4:], n)
+	}
+	sectors[0] = fatData
+
+	header := make([]byte, cfHeaderSize)
+	copy(header, cfSignature)
+	binary.LittleEndian.PutUint16(header[0x18:], 0x3e)
+	binary.LittleEndian.PutUint16(header[0x1a:], 3)
+	binary.LittleEndian.PutUint16(header[0x1c:], 0xfffe)
+	binary.LittleEndian.PutUint16(header[0x1e:], 9)
+	binary.LittleEndian.PutUint16(header[0x20:], 6)
+	binary.LittleEndian.PutUint32(header[0x2c:], 1)
+	binary.LittleEndian.PutUint32(header[0x30:], dirStart)
+	binary.LittleEndian.PutUint32(header[0x38:], 4096)
+	binary.LittleEndian.PutUint32(header[0x3c:], miniFatStart)
+	binary.LittleEndian.PutUint32(header[0x40:], uint32(len(miniFatData)+sectorSize-1)/sectorSize)
+	binary.LittleEndian.PutUint32(header[0x44:], endOfChain)
+	for i := 0; i < cfDifatInHeader; i++ {
+		binary.LittleEndian.PutUint32(header[0x4c+i*4:], free)
+	}
+	binary.LittleEndian.PutUint32(header[0x4c:], 0)
+	return append(header, bytes.Join(sectors, nil)...)
+}
+
+// testAutomaticDestinations returns a jump list of two documents, the
+// first opened from removable media
+func testAutomaticDestinations(version uint32) []byte {
+	opened := map[uint32]time.Time{1: testOpened, 2: testOpened.Add(time.Hour)}
+	paths := map[uint32]string{1: `E:\payroll.xlsm`, 2: `C:\Users\bob\Documents\notes.txt`}
+	return buildCompound([]testStream{
+		{"1", buildLink(testLink{localBase: `E:\payroll.xlsm`, driveType: 2, serial: 0x1ce9a8f2, label: "USBKEY", machine: "desktop-7k1f"})},
+		{"2", buildLink(testLink{localBase: `C:\Users\bob\Documents\notes.txt`, driveType: 3, serial: 0x8a2b3c4d})},
+		{"DestList", buildDestList(version, opened, paths)},
+		// a stream large enough to be stored out of the mini stream
+		{"Padding", bytes.Repeat([]byte{0x42}, 5000)},
+	})
+}
+
+// TestParseRealShellLink decodes the example link of the specification of
+// the format, with the values it documents
+func TestParseRealShellLink(t *testing.T) {
+	buf, err := ioutil.ReadFile(filepath.Join("testdata", "a.txt.lnk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := ParseShellLink(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := time.Date(2008, 9, 12, 20, 27, 17, 101000000, time.UTC)
+	if l.TargetPath != `C:\test\a.txt` || l.RelativePath != `.\a.txt` || l.WorkingDir != `C:\test` ||
+		l.DriveType != "fixed" || l.VolumeSerial != "307A8A81" || l.MachineID != "chris-xps" ||
+		!l.TargetCreated.Equal(written) || !l.TargetModified.Equal(written) || !l.TargetAccessed.Equal(written) ||
+		l.TargetSize != 0 {
+		t.Fatalf("unexpected link %+v", l)
+	}
+	if l.DroidVolume != "94c77840-fa47-46c7-b356-5c2dc6b6d115" || l.DroidFile != "7bcd46ec-7f22-11dd-9499-00137216874a" ||
+		l.BirthDroidFile != l.DroidFile || l.MACAddress != "00:13:72:16:87:4a" {
+		t.Fatalf("unexpected link tracking data %+v", l)
+	}
+}
+
+// testCustomDestinations returns a jump list of a link to a share, and of
+// a link to a local file
+func testCustomDestinations() []byte {
+	b := []byte{2, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	b = append(b, buildLink(testLink{share: `\\FILESERVER\share`, suffix: `tools\tools.zip`})...)
+	b = append(b, buildLink(testLink{localBase: `C:\Tools\putty.exe`, driveType: 3, arguments: "-ssh host"})...)
+	return append(b, 0xab, 0xfb, 0xbf, 0xba)
+}
+
+func TestParseJumpLists(t *testing.T) {
+	for _, version := range []uint32{1, 4} {
+		links, errs := parseAutomaticDestinations(bytes.NewReader(testAutomaticDestinations(version)))
+		if len(errs) > 0 {
+			t.Fatalf("version %d: unexpected errors %v", version, errs)
+		}
+		if len(links) != 2 {
+			t.Fatalf("version %d: expected 2 links, got %+v", version, links)
+		}
+		l := links[0]
+		if l.Entry != "1" || l.TargetPath != `E:\payroll.xlsm` || l.DriveType != "removable" || !l.Pinned ||
+			!l.Opened.Equal(testOpened) || l.MachineID != "desktop-7k1f" {
+			t.Fatalf("version %d: unexpected first link %+v", version, l)
+		}
+		l = links[1]
+		if l.Entry != "2" || l.Pinned || !l.Opened.Equal(testOpened.Add(time.Hour)) || l.MachineID != "desktop-7k1f" {
+			t.Fatalf("version %d: unexpected second link %+v", version, l)
+		}
+		if (version >= 3 && l.AccessCount != 7) || (version < 3 && l.AccessCount != 0) {
+			t.Fatalf("version %d: unexpected access count %d", version, l.AccessCount)
+		}
+	}
+
+	links, errs := parseCustomDestinations(testCustomDestinations())
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	if len(links) != 2 || links[0].TargetPath != `\\FILESERVER\share\tools\tools.zip` ||
+		links[1].TargetPath != `C:\Tools\putty.exe` || links[1].Arguments != "-ssh host" {
+		t.Fatalf("unexpected links %+v", links)
+	}
+
+	if _, err := openCompound(bytes.NewReader(make([]byte, 1024))); err == nil {
+		t.Fatal("expected error opening invalid compound file")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "miglnk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recent := filepath.Join(dir, "Users", "bob", "AppData", "Roaming", "Microsoft", "Windows", "Recent")
+	files := map[string][]byte{
+		filepath.Join(recent, "payroll.xlsm.lnk"):                                                   buildLink(testLink{localBase: `E:\payroll.xlsm`, driveType: 2, serial: 0x1ce9a8f2, label: "USBKEY"}),
+		filepath.Join(recent, "notes.txt.lnk"):                                                      buildLink(testLink{localBase: `C:\Users\bob\Documents\notes.txt`, driveType: 3}),
+		filepath.Join(recent, "AutomaticDestinations", "5f7b5f1e01b83767.automaticDestinations-ms"): testAutomaticDestinations(4),
+		filepath.Join(recent, "CustomDestinations", "9b9cdc69c1c24e2b.customDestinations-ms"):       testCustomDestinations(),
+		filepath.Join(recent, "desktop.ini"):                                                        []byte("[.ShellClassInfo]"),
+	}
+	for path, data := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the notes were opened a week ago
+	week := time.Now().Add(-7 * 24 * time.Hour)
+	if err := os.Chtimes(filepath.Join(recent, "notes.txt.lnk"), week, week); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		p        params
+		expected []string
+	}{
+		{params{}, []string{
+			`E:\payroll.xlsm`, `C:\Users\bob\Documents\notes.txt`,
+			`\\FILESERVER\share\tools\tools.zip`, `C:\Tools\putty.exe`,
+			`C:\Users\bob\Documents\notes.txt`, `E:\payroll.xlsm`,
+		}},
+		{params{Paths: []string{`^[D-Z]:\\`, `^\\\\`}}, []string{
+			`E:\payroll.xlsm`, `\\FILESERVER\share\tools\tools.zip`, `E:\payroll.xlsm`,
+		}},
+		{params{Names: []string{`\.XLSM$`}, Mtimes: []string{"<1d"}}, []string{`E:\payroll.xlsm`}},
+		{params{Names: []string{`!\.(xlsm|zip|exe)$`}, Mtimes: []string{">3d"}}, []string{
+			`C:\Users\bob\Documents\notes.txt`, `C:\Users\bob\Documents\notes.txt`,
+		}},
+		{params{Names: []string{"nothere"}}, nil},
+	} {
+		var r run
+		r.Parameters = tc.p
+		r.Parameters.Root = dir
+		msg, err := modules.MakeMessage(modules.MsgClassParameters, r.Parameters, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res modules.Result
+		err = json.Unmarshal([]byte(r.Run(bytes.NewBuffer(msg))), &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Errors) > 0 {
+			t.Fatalf("%+v: unexpected errors %v", tc.p, res.Errors)
+		}
+		var el elements
+		err = res.GetElements(&el)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(el.Links) != len(tc.expected) || res.FoundAnything != (len(tc.expected) > 0) {
+			t.Fatalf("%+v: expected %d links, got %+v", tc.p, len(tc.expected), el.Links)
+		}
+		for i, l := range el.Links {
+			if l.TargetPath != tc.expected[i] {
+				t.Fatalf("%+v: expected %s, got %+v", tc.p, tc.expected[i], l)
+			}
+		}
+	}
+
+	for _, p := range []params{
+		{Root: dir, Names: []string{"("}},
+		{Root: dir, Mtimes: []string{"90d"}},
+	} {
+		r := run{Parameters: p}
+		if r.ValidateParameters() == nil {
+			t.Fatalf("%+v: expected invalid parameters", p)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package lnk /* import "mig.ninja/mig/modules/lnk" */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"mig.ninja/mig/modules/winbin"
+)
+
+/*
+	AutomaticDestinations jump lists are OLE compound files, a file system
+	in a file made of sectors of 512 or 4096 bytes. The sectors of each
+	stream are chained in the file allocation table (FAT), whose sectors are
+	listed in the DIFAT, the first 109 entries of which are in the header.
+	The directory is a stream of 128 bytes entries naming the streams.
+	Streams smaller than the mini stream cutoff are stored in 64 bytes mini
+	sectors of the mini stream, the stream of the root entry, and chained in
+	the mini FAT.
+*/
+
+const (
+	cfHeaderSize     = 512
+	cfDirEntrySize   = 128
+	cfDifatInHeader  = 109
+	cfMaxRegSector   = 0xfffffffa
+	cfStreamObject   = 2
+	cfRootStorage    = 5
+	cfMaxStreamSize  = 1 << 28
+	cfMaxSectorCount = 1 << 24
+)
+
+var cfSignature = []byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1}
+
+type compoundFile struct {
+	r              io.ReaderAt
+	sectorSize     int64
+	miniSectorSize int64
+	miniCutoff     uint64
+	fat            []uint32
+	miniFat        []uint32
+	miniStream     []byte
+	entries        []cfEntry
+}
+
+// cfEntry is an entry of the directory of a compound file
+type cfEntry struct {
+	name     string
+	kind     byte
+	start    uint32
+	size     uint64
+	modified time.Time
+}
+
+// openCompound reads the allocation tables and the directory of a compound
+// file
+func openCompound(r io.ReaderAt) (cf *compoundFile, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("openCompound: %v", e)
+		}
+	}()
+	header := make([]byte, cfHeaderSize)
+	if _, err = r.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("openCompound: %v", err)
+	}
+	if !bytes.HasPrefix(header, cfSignature) {
+		return nil, fmt.Errorf("openCompound: not a compound file")
+	}
+	cf = &compoundFile{
+		r:              r,
+		sectorSize:     1 << winbin.Le16(header, 0x1e),
+		miniSectorSize: 1 << winbin.Le16(header, 0x20),
+		miniCutoff:     uint64(winbin.Le32(header, 0x38)),
+	}
+	if cf.sectorSize != 512 && cf.sectorSize != 4096 {
+		return nil, fmt.Errorf("openCompound: invalid sector size %d", cf.sectorSize)
+	}
+
+	// the sectors of the FAT are listed in the header, then in the chain
+	// of DIFAT sectors
+	var fatSectors []uint32
+	for i := 0; i < cfDifatInHeader; i++ {
+		fatSectors = append(fatSectors, winbin.Le32(header, 0x4c+i*4))
+	}
+	next := winbin.Le32(header, 0x44)
+	for i := uint32(0); i < winbin.Le32(header, 0x48) && next < cfMaxRegSector; i++ {
+		sector := cf.sector(next)
+		perSector := int(cf.sectorSize/4) - 1
+		for j := 0; j < perSector; j++ {
+			fatSectors = append(fatSectors, winbin.Le32(sector, j*4))
+		}
+		next = winbin.Le32(sector, perSector*4)
+	}
+	numFat := winbin.Le32(header, 0x2c)
+	for _, s := range fatSectors {
+		if numFat == 0 {
+			break
+		}
+		if s >= cfMaxRegSector {
+			continue
+		}
+		sector := cf.sector(s)
+		for j := 0; j < len(sector); j += 4 {
+			cf.fat = append(cf.fat, winbin.Le32(sector, j))
+		}
+		numFat--
+	}
+
+	dir := chain(winbin.Le32(header, 0x30), cf.fat, cf.sector)
+	for off := 0; off+cfDirEntrySize <= len(dir); off += cfDirEntrySize {
+		e := dir[off : off+cfDirEntrySize]
+		nameLen := int(winbin.Le16(e, 0x40))
+		if nameLen > 64 {
+			nameLen = 64
+		}
+		if nameLen >= 2 {
+			nameLen -= 2
+		}
+		cf.entries = append(cf.entries, cfEntry{
+			name:     winbin.UTF16String(e[:nameLen]),
+			kind:     e[0x42],
+			start:    winbin.Le32(e, 0x74),
+			size:     winbin.Le64(e, 0x78),
+			modified: winbin.Filetime(winbin.Le64(e, 0x6c)),
+		})
+	}
+	if len(cf.entries) == 0 || cf.entries[0].kind != cfRootStorage {
+		return nil, fmt.Errorf("openCompound: root entry not found")
+	}
+	root := cf.entries[0]
+	if root.size > 0 {
+		cf.miniFat = bytesToUint32(chain(winbin.Le32(header, 0x3c), cf.fat, cf.sector))
+		cf.miniStream = chain(root.start, cf.fat, cf.sector)
+	}
+	return cf, nil
+}
+
+// streams returns the stream entries of the directory
+func (cf *compoundFile) streams() (streams []cfEntry) {
+	for _, e := range cf.entries {
+		if e.kind == cfStreamObject {
+			streams = append(streams, e)
+		}
+	}
+	return
+}
+
+// read returns the content of a stream
+func (cf *compoundFile) read(s cfEntry) (data []byte, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("read: %v", e)
+		}
+	}()
+	if s.size > cfMaxStreamSize {
+		return nil, fmt.Errorf("read: stream %q is too large", s.name)
+	}
+	if s.size < cf.miniCutoff {
+		data = chain(s.start, cf.miniFat, cf.miniSector)
+	} else {
+		data = chain(s.start, cf.fat, cf.sector)
+	}
+	if uint64(len(data)) < s.size {
+		return nil, fmt.Errorf("read: stream %q is truncated", s.name)
+	}
+	return data[:s.size], nil
+}
+
+// chain concatenates the sectors of a chain of an allocation table
+func chain(start uint32, table []uint32, sector func(uint32) []byte) []byte {
+	var data []byte
+	for s, n := start, 0; s < cfMaxRegSector; n++ {
+		if n > len(table) || n > cfMaxSectorCount {
+			panic("loop in sector chain")
+		}
+		data = append(data, sector(s)...)
+		if int(s) >= len(table) {
+			panic(fmt.Sprintf("sector %d is not allocated", s))
+		}
+		s = table[s]
+	}
+	return data
+}
+
+// sector reads a sector of the file, sector 0 follows the header
+func (cf *compoundFile) sector(n uint32) []byte {
+	b := make([]byte, cf.sectorSize)
+	if _, err := cf.r.ReadAt(b, (int64(n)+1)*cf.sectorSize); err != nil && err != io.EOF {
+		panic(err)
+	}
+	return b
+}
+
+// miniSector returns a sector of the mini stream
+func (cf *compoundFile) miniSector(n uint32) []byte {
+	return winbin.Slice(cf.miniStream, int(int64(n)*cf.miniSectorSize), int(cf.miniSectorSize))
+}
+
+func bytesToUint32(b []byte) []uint32 {
+	u := make([]uint32, len(b)/4)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint32(b[i*4:])
+	}
+	return u
+}
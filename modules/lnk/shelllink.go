@@ -0,0 +1,334 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package lnk /* import "mig.ninja/mig/modules/lnk" */
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"mig.ninja/mig/modules/winbin"
+)
+
+/*
+	A Shell Link starts with a 76 bytes header holding the times, size and
+	attributes of the target when the link was last updated, followed by
+	optional structures announced by the link flags:
+
+	- LinkTargetIDList: the shell items of the target, used when the link
+	  has no LinkInfo, as links to shell folders
+	- LinkInfo: the local path and the volume of the target, or the share
+	  holding it
+	- StringData: description, relative path, working directory, arguments
+	  and icon location, in UTF-16 unless the link is ANSI
+	- ExtraData: blocks identified by a signature, of which the tracker
+	  block holds the NetBIOS name of the machine where the target was, and
+	  the distributed link tracking identifiers (droids) of the target
+*/
+
+const (
+	linkHeaderSize = 0x4c
+
+	hasLinkTargetIDList = 0x01
+	hasLinkInfo         = 0x02
+	hasName             = 0x04
+	hasRelativePath     = 0x08
+	hasWorkingDir       = 0x10
+	hasArguments        = 0x20
+	hasIconLocation     = 0x40
+	isUnicode           = 0x80
+
+	volumeIDAndLocalBasePath               = 0x01
+	commonNetworkRelativeLinkAndPathSuffix = 0x02
+
+	environmentVariableBlock = 0xa0000001
+	trackerBlock             = 0xa0000003
+
+)
+
+// linkCLSID is the class identifier of the header of a Shell Link
+var linkCLSID = []byte{0x01, 0x14, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x46}
+
+// linkSignature starts every Shell Link, and is used to carve the links of
+// CustomDestinations jump lists
+var linkSignature = append([]byte{linkHeaderSize, 0, 0, 0}, linkCLSID...)
+
+var driveTypes = map[uint32]string{
+	0: "unknown",
+	1: "no root directory",
+	2: "removable",
+	3: "fixed",
+	4: "remote",
+	5: "cdrom",
+	6: "ramdisk",
+}
+
+/*
+	ShellLink is the decoded content of a Shell Link:
+	- TargetPath: local path of the target, or its path on a share
+	- DriveType, VolumeSerial and VolumeLabel: volume of a local target
+	- NetworkShare: share of a remote target, or the share a local drive was
+	  mapped to
+	- MachineID: NetBIOS name of the machine the target was on
+	- DroidVolume, DroidFile: link tracking identifiers of the volume and
+	  of the target, BirthDroidVolume and BirthDroidFile are the ones they
+	  were given when the target was created
+	- MACAddress: MAC address of the machine the file identifier was
+	  created on, when it is a version 1 UUID
+	- TargetCreated, TargetModified, TargetAccessed, TargetSize: times and
+	  size of the target when the link was last updated
+*/
+type ShellLink struct {
+	TargetPath       string    `json:"targetpath,omitempty"`
+	Arguments        string    `json:"arguments,omitempty"`
+	WorkingDir       string    `json:"workingdir,omitempty"`
+	RelativePath     string    `json:"relativepath,omitempty"`
+	Description      string    `json:"description,omitempty"`
+	IconLocation     string    `json:"iconlocation,omitempty"`
+	DriveType        string    `json:"drivetype,omitempty"`
+	VolumeSerial     string    `json:"volumeserial,omitempty"`
+	VolumeLabel      string    `json:"volumelabel,omitempty"`
+	NetworkShare     string    `json:"networkshare,omitempty"`
+	MachineID        string    `json:"machineid,omitempty"`
+	DroidVolume      string    `json:"droidvolume,omitempty"`
+	DroidFile        string    `json:"droidfile,omitempty"`
+	BirthDroidVolume string    `json:"birthdroidvolume,omitempty"`
+	BirthDroidFile   string    `json:"birthdroidfile,omitempty"`
+	MACAddress       string    `json:"macaddress,omitempty"`
+	TargetCreated    time.Time `json:"targetcreated"`
+	TargetModified   time.Time `json:"targetmodified"`
+	TargetAccessed   time.Time `json:"targetaccessed"`
+	TargetSize       uint32    `json:"targetsize"`
+}
+
+// ParseShellLink decodes the content of a .lnk file
+func ParseShellLink(data []byte) (l ShellLink, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("ParseShellLink: %v", e)
+		}
+	}()
+	if len(data) < linkHeaderSize || !bytes.HasPrefix(data, linkSignature) {
+		return l, fmt.Errorf("ParseShellLink: not a shell link")
+	}
+	flags := winbin.Le32(data, 0x14)
+	l.TargetCreated = winbin.Filetime(winbin.Le64(data, 0x1c))
+	l.TargetAccessed = winbin.Filetime(winbin.Le64(data, 0x24))
+	l.TargetModified = winbin.Filetime(winbin.Le64(data, 0x2c))
+	l.TargetSize = winbin.Le32(data, 0x34)
+
+	off := linkHeaderSize
+	idListPath := ""
+	if flags&hasLinkTargetIDList != 0 {
+		size := int(winbin.Le16(data, off))
+		idListPath = parseIDList(winbin.Slice(data, off+2, size))
+		off += 2 + size
+	}
+	if flags&hasLinkInfo != 0 {
+		size := int(winbin.Le32(data, off))
+		l.parseLinkInfo(winbin.Slice(data, off, size))
+		off += size
+	}
+	for _, f := range []struct {
+		flag uint32
+		dst  *string
+	}{
+		{hasName, &l.Description},
+		{hasRelativePath, &l.RelativePath},
+		{hasWorkingDir, &l.WorkingDir},
+		{hasArguments, &l.Arguments},
+		{hasIconLocation, &l.IconLocation},
+	} {
+		if flags&f.flag == 0 {
+			continue
+		}
+		count := int(winbin.Le16(data, off))
+		off += 2
+		if flags&isUnicode != 0 {
+			*f.dst = winbin.UTF16String(winbin.Slice(data, off, count*2))
+			off += count * 2
+		} else {
+			*f.dst = string(winbin.Slice(data, off, count))
+			off += count
+		}
+	}
+	envTarget := l.parseExtraData(data[off:])
+	if l.TargetPath == "" {
+		l.TargetPath = envTarget
+	}
+	if l.TargetPath == "" {
+		l.TargetPath = idListPath
+	}
+	return
+}
+
+// parseLinkInfo reads the volume and the local or network path of the
+// target
+func (l *ShellLink) parseLinkInfo(info []byte) {
+	headerSize := winbin.Le32(info, 4)
+	flags := winbin.Le32(info, 8)
+	var base, suffix string
+	if flags&volumeIDAndLocalBasePath != 0 {
+		vol := info[winbin.Le32(info, 0x0c):]
+		l.DriveType = driveTypes[winbin.Le32(vol, 4)]
+		l.VolumeSerial = fmt.Sprintf("%08X", winbin.Le32(vol, 8))
+		if labelOffset := winbin.Le32(vol, 0x0c); labelOffset == 0x14 {
+			l.VolumeLabel = winbin.UTF16String(vol[winbin.Le32(vol, 0x10):])
+		} else {
+			l.VolumeLabel = ansiz(vol[labelOffset:])
+		}
+		base = ansiz(info[winbin.Le32(info, 0x10):])
+		if headerSize >= 0x24 {
+			if u := winbin.UTF16String(info[winbin.Le32(info, 0x1c):]); u != "" {
+				base = u
+			}
+		}
+	}
+	if flags&commonNetworkRelativeLinkAndPathSuffix != 0 {
+		net := info[winbin.Le32(info, 0x14):]
+		netNameOffset := winbin.Le32(net, 8)
+		l.NetworkShare = ansiz(net[netNameOffset:])
+		if netNameOffset > 0x14 {
+			l.NetworkShare = winbin.UTF16String(net[winbin.Le32(net, 0x14):])
+		}
+	}
+	suffix = ansiz(info[winbin.Le32(info, 0x18):])
+	if headerSize >= 0x24 {
+		if u := winbin.UTF16String(info[winbin.Le32(info, 0x20):]); u != "" {
+			suffix = u
+		}
+	}
+	switch {
+	case base != "":
+		l.TargetPath = base + suffix
+	case l.NetworkShare != "":
+		l.TargetPath = l.NetworkShare
+		if suffix != "" {
+			l.TargetPath += `\` + suffix
+		}
+	}
+}
+
+// parseExtraData reads the tracker block of the extra data, and returns
+// the target of the environment variables block
+func (l *ShellLink) parseExtraData(data []byte) (envTarget string) {
+	for len(data) >= 8 {
+		size := int(winbin.Le32(data, 0))
+		if size < 8 || size > len(data) {
+			return
+		}
+		block := data[:size]
+		switch winbin.Le32(block, 4) {
+		case trackerBlock:
+			if size < 0x60 {
+				break
+			}
+			l.MachineID = ansiz(block[0x10:0x20])
+			l.DroidVolume = guid(block[0x20:])
+			l.DroidFile = guid(block[0x30:])
+			l.BirthDroidVolume = guid(block[0x40:])
+			l.BirthDroidFile = guid(block[0x50:])
+			l.MACAddress = uuidNode(block[0x30:])
+		case environmentVariableBlock:
+			if size < 0x314 {
+				break
+			}
+			envTarget = winbin.UTF16String(block[0x108:0x314])
+			if envTarget == "" {
+				envTarget = ansiz(block[8:0x108])
+			}
+		}
+		data = data[size:]
+	}
+	return
+}
+
+/*
+	The LinkTargetIDList is a list of shell items, each starting with its
+	size. Only the items forming a file system path are decoded: the volume
+	items holding a drive letter, the network items holding a share, and
+	the file entry items holding a short name, followed by an extension
+	block with the long name.
+*/
+func parseIDList(list []byte) string {
+	var elems []string
+	for len(list) >= 2 {
+		size := int(winbin.Le16(list, 0))
+		if size < 3 || size > len(list) {
+			break
+		}
+		item := list[2:size]
+		list = list[size:]
+		switch t := item[0]; {
+		case t&0x70 == 0x20:
+			// volume, such as "C:\"
+			elems = append(elems, strings.TrimRight(ansiz(item[1:]), `\`))
+		case t&0x70 == 0x40 && len(item) > 3:
+			// network location, such as "\\server\share"
+			elems = append(elems, strings.TrimRight(ansiz(item[3:]), `\`))
+		case t&0x70 == 0x30 && len(item) > 12:
+			name := ansiz(item[12:])
+			if long := longName(item); long != "" {
+				name = long
+			}
+			elems = append(elems, name)
+		}
+	}
+	return strings.Join(elems, `\`)
+}
+
+// longName returns the long name of the extension block of a file entry
+// shell item. The offset of the name depends on the version of the block.
+func longName(item []byte) string {
+	i := bytes.Index(item, []byte{0x04, 0x00, 0xef, 0xbe})
+	if i < 4 {
+		return ""
+	}
+	block := item[i-4:]
+	var off int
+	switch version := winbin.Le16(block, 2); {
+	case version >= 9:
+		off = 0x2e
+	case version == 8:
+		off = 0x2a
+	case version == 7:
+		off = 0x26
+	case version >= 3:
+		off = 0x14
+	default:
+		return ""
+	}
+	if off >= len(block) {
+		return ""
+	}
+	return winbin.UTF16String(block[off:])
+}
+
+// guid formats a GUID stored in the little endian layout of Windows
+func guid(b []byte) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x", winbin.Le32(b, 0), winbin.Le16(b, 4), winbin.Le16(b, 6), b[8:10], b[10:16])
+}
+
+// uuidNode returns the node of a version 1 UUID, which is the MAC address
+// of the machine that created it
+func uuidNode(b []byte) string {
+	if winbin.Le16(b, 6)>>12 != 1 {
+		return ""
+	}
+	n := b[10:16]
+	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", n[0], n[1], n[2], n[3], n[4], n[5])
+}
+
+// ansiz returns the NUL terminated string at the start of a buffer
+func ansiz(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
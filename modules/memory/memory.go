@@ -21,6 +21,7 @@ import (
 	"github.com/mozilla/masche/process"
 	"io"
 	"mig.ninja/mig/modules"
+	"mig.ninja/mig/modules/yara"
 	"regexp"
 	"time"
 )
@@ -41,6 +42,7 @@ func init() {
 type run struct {
 	Parameters params
 	Results    modules.Result
+	stop       chan bool // closed when the module is asked to stop early
 }
 
 type params struct {
@@ -59,6 +61,7 @@ type search struct {
 	Libraries   []string `json:"libraries,omitempty"`
 	Bytes       []string `json:"bytes,omitempty"`
 	Contents    []string `json:"contents,omitempty"`
+	Yara        []string `json:"yara,omitempty"`
 	Options     options  `json:"options,omitempty"`
 	checks      []check
 	checkmask   checkType
@@ -81,6 +84,7 @@ const (
 	checkLib
 	checkByte
 	checkContent
+	checkYara
 )
 
 type check struct {
@@ -90,6 +94,9 @@ type check struct {
 	value     string
 	bytes     []byte
 	regex     *regexp.Regexp
+	rules     *yara.Rules
+	// the rules that matched each process of a yara check, by pid
+	yaraMatches map[uint][]yara.Match
 }
 
 type searchResults map[string]searchresult
@@ -99,6 +106,8 @@ type searchresult []matchedps
 type matchedps struct {
 	Process psres  `json:"process"`
 	Search  search `json:"search"`
+	// the yara rules that matched the memory of the process
+	Yara []yara.Match `json:"yara,omitempty"`
 }
 
 type psres struct {
@@ -185,6 +194,21 @@ func (s *search) makeChecks() (err error) {
 			fmt.Printf("adding byte check with value '%s'\n", c.value)
 		}
 	}
+	for _, v := range s.Yara {
+		var c check
+		c.code = checkYara
+		c.value = v
+		c.rules, err = yara.Compile(v)
+		if err != nil {
+			return
+		}
+		c.yaraMatches = make(map[uint][]yara.Match)
+		s.checks = append(s.checks, c)
+		s.checkmask |= c.code
+		if debug {
+			fmt.Printf("adding yara check with value '%s'\n", c.value)
+		}
+	}
 	return
 }
 
@@ -217,6 +241,25 @@ func (c *check) storeMatch(proc process.Process) {
 	return
 }
 
+// storeYaraMatches keeps the first match of each rule in the memory of a
+// process, as the overlapping buffers can match a rule several times
+func (c *check) storeYaraMatches(proc process.Process, matches []yara.Match) {
+	stored := c.yaraMatches[proc.Pid()]
+	for _, m := range matches {
+		store := true
+		for _, sm := range stored {
+			if sm.Rule == m.Rule {
+				store = false
+			}
+		}
+		if store {
+			stored = append(stored, m)
+		}
+	}
+	c.yaraMatches[proc.Pid()] = stored
+	return
+}
+
 func (r *run) ValidateParameters() (err error) {
 	var labels []string
 	for label, s := range r.Parameters.Searches {
@@ -264,6 +307,15 @@ func (r *run) ValidateParameters() (err error) {
 				return
 			}
 		}
+		for _, r := range s.Yara {
+			if debug {
+				fmt.Printf("validating yara rules\n")
+			}
+			_, err = yara.Compile(r)
+			if err != nil {
+				return fmt.Errorf("Invalid yara rules: %v", err)
+			}
+		}
 	}
 	return
 }
@@ -329,6 +381,15 @@ func (r *run) Run(in io.Reader) (out string) {
 	if err != nil {
 		panic(err)
 	}
+	// look for an early stop signal while evaluating processes, the results
+	// are then built from the matches found so far
+	stop := make(chan bool, 1)
+	r.stop = make(chan bool)
+	go func() {
+		if modules.WatchForStop(in, &stop) == nil {
+			close(r.stop)
+		}
+	}()
 	// create the checks based on the search parameters
 	for label, search := range r.Parameters.Searches {
 		if debug {
@@ -352,6 +413,9 @@ func (r *run) Run(in io.Reader) (out string) {
 		stats.Failures = append(stats.Failures, err.Error())
 	}
 	for _, pid := range pids {
+		if modules.IsStopped(r.stop) {
+			break
+		}
 		// activate all searches
 		for label, search := range r.Parameters.Searches {
 			search.activate()
@@ -516,6 +580,10 @@ func (s search) checkLibraries(proc process.Process, procname string) (matchedal
 	return
 }
 
+// yaraBufSize is the size of the buffer used when a search has yara rules.
+// The rules match windows of memory of that size, sliding by half of it.
+const yaraBufSize = 1024 * 1024
+
 func (r *run) walkProcMemory(proc process.Process, procname string) (err error) {
 	// find longest byte string to search for, which determines the buffer size
 	bufsize := uint(4096)
@@ -528,7 +596,8 @@ func (r *run) walkProcMemory(proc process.Process, procname string) (err error)
 	logFailures := false
 	for label, search := range r.Parameters.Searches {
 		// if the search is not active or the search as no content or by check to run, skip it
-		if !search.isactive || (search.checkmask&checkContent == 0 && search.checkmask&checkByte == 0) {
+		if !search.isactive || (search.checkmask&checkContent == 0 && search.checkmask&checkByte == 0 &&
+			search.checkmask&checkYara == 0) {
 			search.deactivate()
 			r.Parameters.Searches[label] = search
 			continue
@@ -546,6 +615,9 @@ func (r *run) walkProcMemory(proc process.Process, procname string) (err error)
 				}
 			}
 		}
+		if search.checkmask&checkYara != 0 && bufsize < yaraBufSize {
+			bufsize = yaraBufSize
+		}
 		// find the smallest offset needed
 		if uintptr(search.Options.Offset) < offset {
 			offset = uintptr(search.Options.Offset)
@@ -571,6 +643,9 @@ func (r *run) walkProcMemory(proc process.Process, procname string) (err error)
 		if debug {
 			fmt.Println("walkProcMemory: reading", bufsize, "bytes starting at addr", curStartAddr, "; read", readBytes, "bytes so far")
 		}
+		if modules.IsStopped(r.stop) {
+			return false
+		}
 		for label, search := range r.Parameters.Searches {
 			matchedall := true
 			if !search.isactive {
@@ -601,6 +676,18 @@ func (r *run) walkProcMemory(proc process.Process, procname string) (err error)
 					}
 					c.storeMatch(proc)
 					search.checks[i] = c
+				case checkYara:
+					matches, err := c.rules.ScanMemory(buf, uint64(curStartAddr))
+					if err != nil {
+						stats.Failures = append(stats.Failures, err.Error())
+					}
+					if len(matches) == 0 {
+						matchedall = false
+						continue
+					}
+					c.storeYaraMatches(proc, matches)
+					c.storeMatch(proc)
+					search.checks[i] = c
 				}
 			}
 			// if all the checks have matched on this search, deactivate it
@@ -721,6 +808,9 @@ func (r *run) buildResults(t0 time.Time) (resStr string, err error) {
 					mps.Process.Pid = float64(matchedPs.Pid())
 					stats.TotalHits++
 					// TODO: get detailed info about process here
+					for _, c := range search.checks {
+						mps.Yara = append(mps.Yara, c.yaraMatches[matchedPs.Pid()]...)
+					}
 				}
 				mps.Search = search
 				// reset option fields so they get omitted
@@ -755,6 +845,7 @@ func (r *run) buildResults(t0 time.Time) (resStr string, err error) {
 					mps.Process.Pid = float64(matchedPs.Pid())
 					stats.TotalHits++
 					// TODO: get detailed info about process here
+					mps.Yara = c.yaraMatches[matchedPs.Pid()]
 				}
 				// reset option fields so they get omitted
 				mps.Search.Options.Offset = 0.0
@@ -769,6 +860,8 @@ func (r *run) buildResults(t0 time.Time) (resStr string, err error) {
 					mps.Search.Libraries = append(mps.Search.Libraries, c.value)
 				case checkByte:
 					mps.Search.Bytes = append(mps.Search.Bytes, c.value)
+				case checkYara:
+					mps.Search.Yara = append(mps.Search.Yara, c.value)
 				}
 				sr = append(sr, mps)
 			}
@@ -785,6 +878,9 @@ func (r *run) buildResults(t0 time.Time) (resStr string, err error) {
 	}
 	// store the stats in the response
 	res.Statistics = stats
+	if modules.IsStopped(r.stop) {
+		res.Errors = append(res.Errors, modules.StoppedEarly)
+	}
 	// execution succeeded, set Success to true
 	res.Success = true
 	if stats.TotalHits > 0 {
@@ -840,6 +936,12 @@ func (r *run) PrintResults(result modules.Result, foundOnly bool) (prints []stri
 				out = fmt.Sprintf("%s [pid:%.0f] in search '%s'",
 					mps.Process.Name, mps.Process.Pid, label)
 			}
+			for _, m := range mps.Yara {
+				out += fmt.Sprintf(" yara_rule='%s'", m.Rule)
+				for _, ms := range m.Strings {
+					out += fmt.Sprintf(" %s@0x%x", ms.ID, ms.Offset)
+				}
+			}
 			if mps.Search.Options.MatchAll {
 				prints = append(prints, out)
 				continue
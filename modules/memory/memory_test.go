@@ -111,6 +111,8 @@ func TestSearches(t *testing.T) {
 		{false, `{"searches":{"s1":{"libraries":["^caribou.so$"]}}}`},
 		{true, `{"searches":{"s1":{"contents":["memory_test"], "names": ["go"]}}}`},
 		{false, `{"searches":{"s1":{"names":["1983yrotewdshhhoiufhes7fd29"],"bytes":["ffffffffaaaabbbbcccceeee"],"options":{"matchall": true}}}}`},
+		{true, `{"searches":{"s1":{"names":["go"],"yara":["rule self { strings: $a = \"memory_test\" condition: $a }"],"options":{"matchall": true}}}}`},
+		{false, `{"searches":{"s1":{"names":["go"],"yara":["rule absent { strings: $a = { ff ff ff ff aa aa bb bb cc cc ee ee } condition: #a > 1000 }"],"options":{"matchall": true}}}}`},
 	}
 	for _, tp := range parameters {
 		var r run
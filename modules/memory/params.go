@@ -10,9 +10,12 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
+
+	"mig.ninja/mig/modules/yara"
 )
 
 func printHelp(isCmd bool) {
@@ -40,6 +43,10 @@ func printHelp(isCmd bool) {
 %sbytes <hex>	- match an hex byte string against the memory of a process
 		  ex: %sbyte "6d69672e6d6f7a696c6c612e6f7267"
 		             (mig.mozilla.org)
+
+%syara <file>	- match the YARA rules of a local file against the memory of a
+		  process, read in windows of 1MB. offsets are memory addresses.
+		  ex: %syara /tmp/implants.yar
 Options
 -------
 %smatchall	- all search parameters must match on a given process for it to
@@ -55,7 +62,7 @@ Options
 %smaxlength <int> - indicates if a search should stop after reading <int> bytes
 		    from a process
 detailled doc at http://mig.mozilla.org/doc/module_memory.html
-`, dash, dash, dash, dash, dash, dash, dash, dash, dash, ma,
+`, dash, dash, dash, dash, dash, dash, dash, dash, dash, dash, dash, ma,
 		dash, dash, notma, dash, dash, dash, dash, dash)
 	return
 }
@@ -162,6 +169,13 @@ func (r *run) ParamsCreator() (interface{}, error) {
 					continue
 				}
 				search.Contents = append(search.Contents, checkValue)
+			case "yara":
+				rules, err := readYaraRules(checkValue)
+				if err != nil {
+					fmt.Printf("ERROR: %v\nTry again.\n", err)
+					continue
+				}
+				search.Yara = append(search.Yara, rules)
 			case "matchall":
 				search.Options.MatchAll = true
 			case "matchany":
@@ -199,11 +213,11 @@ exit:
 // help if the arguments string spell the work 'help'
 func (r *run) ParamsParser(args []string) (interface{}, error) {
 	var (
-		err                               error
-		names, libraries, bytes, contents flagParam
-		offset, maxlength                 float64
-		matchall, matchany, logfailures   bool
-		fs                                flag.FlagSet
+		err                                      error
+		names, libraries, bytes, contents, yaras flagParam
+		offset, maxlength                        float64
+		matchall, matchany, logfailures          bool
+		fs                                       flag.FlagSet
 	)
 	if len(args) < 1 || args[0] == "" || args[0] == "help" {
 		printHelp(true)
@@ -214,6 +228,7 @@ func (r *run) ParamsParser(args []string) (interface{}, error) {
 	fs.Var(&libraries, "lib", "see help")
 	fs.Var(&bytes, "bytes", "see help")
 	fs.Var(&contents, "content", "see help")
+	fs.Var(&yaras, "yara", "see help")
 	fs.Float64Var(&offset, "maxdepth", 0, "see help")
 	fs.Float64Var(&maxlength, "matchlimit", 0, "see help")
 	fs.BoolVar(&matchall, "matchall", true, "see help")
@@ -228,6 +243,13 @@ func (r *run) ParamsParser(args []string) (interface{}, error) {
 	s.Libraries = libraries
 	s.Bytes = bytes
 	s.Contents = contents
+	for _, file := range yaras {
+		rules, err := readYaraRules(file)
+		if err != nil {
+			return nil, err
+		}
+		s.Yara = append(s.Yara, rules)
+	}
 	s.Options.Offset = offset
 	s.Options.MaxLength = maxlength
 	s.Options.MatchAll = matchall
@@ -241,6 +263,20 @@ func (r *run) ParamsParser(args []string) (interface{}, error) {
 	return r.Parameters, r.ValidateParameters()
 }
 
+// readYaraRules reads a local file of yara rules, which are sent to the
+// agents in the parameters
+func readYaraRules(file string) (rules string, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	_, err = yara.Compile(string(data))
+	if err != nil {
+		return "", fmt.Errorf("Invalid yara rules in %s: %v", file, err)
+	}
+	return string(data), nil
+}
+
 type flagParam []string
 
 func (f *flagParam) String() string {
@@ -32,6 +32,7 @@ type MessageClass string
 const (
 	MsgClassParameters MessageClass = "parameters"
 	MsgClassStop       MessageClass = "stop"
+	MsgClassProgress   MessageClass = "progress"
 )
 
 // Result implement the base type for results returned by modules.
@@ -184,6 +185,22 @@ func WatchForStop(r io.Reader, stopChan *chan bool) error {
 	}
 }
 
+// StoppedEarly is the error added to the results of a module that stopped
+// before it completed its work, and only returns what it collected so far
+const StoppedEarly = "stop message received, results are partial"
+
+// IsStopped returns true, without blocking, once the stop channel has been
+// closed. Modules check it between units of work, to build their results
+// from what they collected so far when they are asked to stop.
+func IsStopped(stop chan bool) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
 // HasResultsPrinter implements functions used by module to print information
 type HasResultsPrinter interface {
 	PrintResults(Result, bool) ([]string, error)
@@ -183,10 +183,7 @@ func TestReadInputParameters(t *testing.T) {
 func TestWatchForStop(t *testing.T) {
 	stopChan := make(chan bool)
 	w := strings.NewReader(`{"class":"stop"}`)
-	var err error
-	go func() {
-		err = WatchForStop(w, &stopChan)
-	}()
+	go WatchForStop(w, &stopChan)
 	select {
 	case <-stopChan:
 		break
@@ -194,3 +191,26 @@ func TestWatchForStop(t *testing.T) {
 		t.Fatalf("failed to catch stop message")
 	}
 }
+
+func TestIsStopped(t *testing.T) {
+	stop := make(chan bool)
+	if IsStopped(stop) || IsStopped(nil) {
+		t.Fatal("open stop channel reported as stopped")
+	}
+	close(stop)
+	if !IsStopped(stop) {
+		t.Fatal("closed stop channel not reported as stopped")
+	}
+}
+
+func TestArtefactTime(t *testing.T) {
+	cet := time.FixedZone("CET", 3600)
+	at := NewArtefactTime(ArtefactTimeExecuted, time.Date(2016, 9, 1, 11, 20, 30, 0, cet), "prefetch")
+	raw, err := json.Marshal(at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != `{"kind":"executed","time":"2016-09-01T10:20:30Z","source":"prefetch"}` {
+		t.Fatalf("invalid artefact time %s", raw)
+	}
+}
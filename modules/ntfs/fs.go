@@ -0,0 +1,202 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package ntfs /* import "mig.ninja/mig/modules/ntfs" */
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	FileSystem gives other modules read access to the files of an NTFS
+	volume without going through the operating system, such as the file
+	module searching a raw image or a volume shadow copy device. The
+	directory tree is built from the names and parents of the records in
+	use of the MFT when the file system is opened, so deleted files are not
+	listed. The metadata files of the first records of the MFT and of
+	$Extend are hidden, as Windows does.
+
+	Files compressed or encrypted by NTFS cannot be read, as their $DATA
+	attribute is stored transformed on disk.
+*/
+
+const (
+	attrFlagCompressed = 0x0001
+	attrFlagEncrypted  = 0x4000
+
+	// records below this number are reserved for the metadata files
+	firstUserRecord = 24
+)
+
+// FileSystem is a read-only view of the files of an NTFS volume
+type FileSystem struct {
+	vol      *volume
+	entries  map[uint64]fsEntry
+	children map[uint64][]uint64
+	lookup   map[fsKey]uint64
+}
+
+// fsEntry is a file or directory of the tree of a FileSystem
+type fsEntry struct {
+	name  string
+	dir   bool
+	size  int64
+	mtime time.Time
+}
+
+// fsKey finds a file by its parent and its name in lower case, as NTFS
+// names are case insensitive
+type fsKey struct {
+	parent uint64
+	name   string
+}
+
+// OpenFileSystem reads the MFT of an NTFS volume or image, and builds its
+// directory tree
+func OpenFileSystem(r io.ReaderAt) (*FileSystem, error) {
+	vol, err := openVolume(r)
+	if err != nil {
+		return nil, err
+	}
+	fs := &FileSystem{
+		vol:      vol,
+		entries:  make(map[uint64]fsEntry),
+		children: make(map[uint64][]uint64),
+		lookup:   make(map[fsKey]uint64),
+	}
+	for n := uint64(0); n < vol.mft.numRecords(); n++ {
+		if n < firstUserRecord && n != recordRoot {
+			continue
+		}
+		rec, err := vol.mft.record(n)
+		if err != nil || rec == nil || rec.BaseRef != 0 || !rec.inUse() || rec.Name == "" {
+			continue
+		}
+		e := fsEntry{name: rec.Name, dir: rec.directory(), size: int64(rec.Size), mtime: rec.SI.Modified}
+		if n == recordRoot {
+			fs.entries[n] = e
+			continue
+		}
+		if rec.Parent == recordExtend {
+			continue
+		}
+		if !e.dir && e.size == 0 {
+			// the $DATA attribute of a fragmented file can be in an
+			// extension record
+			if ar := vol.dataReader(rec, ""); ar != nil {
+				e.size = ar.size
+			}
+		}
+		fs.entries[n] = e
+		fs.children[rec.Parent] = append(fs.children[rec.Parent], n)
+		fs.lookup[fsKey{rec.Parent, strings.ToLower(rec.Name)}] = n
+	}
+	if _, ok := fs.entries[recordRoot]; !ok {
+		return nil, fmt.Errorf("root directory not found in the MFT")
+	}
+	return fs, nil
+}
+
+// resolve returns the record of a path. Both / and \ separate the names,
+// and the volume name of Windows paths, such as C:, is ignored.
+func (fs *FileSystem) resolve(op, path string) (n uint64, err error) {
+	n = recordRoot
+	for i, name := range strings.FieldsFunc(path, func(c rune) bool { return c == '/' || c == '\\' }) {
+		if i == 0 && len(name) == 2 && name[1] == ':' {
+			continue
+		}
+		var ok bool
+		n, ok = fs.lookup[fsKey{n, strings.ToLower(name)}]
+		if !ok {
+			return 0, &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+		}
+	}
+	return n, nil
+}
+
+// Stat returns the information of a file or directory
+func (fs *FileSystem) Stat(path string) (os.FileInfo, error) {
+	n, err := fs.resolve("stat", path)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{fs.entries[n]}, nil
+}
+
+// ReadDir returns the files and directories of a directory, sorted by name
+func (fs *FileSystem) ReadDir(path string) (list []os.FileInfo, err error) {
+	n, err := fs.resolve("readdir", path)
+	if err != nil {
+		return nil, err
+	}
+	if !fs.entries[n].dir {
+		return nil, &os.PathError{Op: "readdir", Path: path, Err: fmt.Errorf("not a directory")}
+	}
+	for _, child := range fs.children[n] {
+		list = append(list, fileInfo{fs.entries[child]})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return
+}
+
+// Open returns a reader of the content of a file
+func (fs *FileSystem) Open(path string) (*io.SectionReader, error) {
+	n, err := fs.resolve("open", path)
+	if err != nil {
+		return nil, err
+	}
+	if fs.entries[n].dir {
+		return nil, &os.PathError{Op: "open", Path: path, Err: fmt.Errorf("is a directory")}
+	}
+	rec, err := fs.vol.mft.record(n)
+	if err != nil {
+		return nil, err
+	}
+	if rec == nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	for _, a := range rec.Attrs {
+		if a.Type != attrData || a.Name != "" {
+			continue
+		}
+		if a.Flags&(attrFlagCompressed|attrFlagEncrypted) != 0 {
+			return nil, &os.PathError{Op: "open", Path: path, Err: fmt.Errorf("compressed and encrypted files are not supported")}
+		}
+		if !a.NonResident {
+			return io.NewSectionReader(bytes.NewReader(a.Content), 0, int64(len(a.Content))), nil
+		}
+	}
+	ar := fs.vol.dataReader(rec, "")
+	if ar == nil {
+		// a file without a $DATA attribute is empty
+		return io.NewSectionReader(bytes.NewReader(nil), 0, 0), nil
+	}
+	return io.NewSectionReader(ar, 0, ar.size), nil
+}
+
+// fileInfo implements os.FileInfo for the files of a FileSystem
+type fileInfo struct {
+	e fsEntry
+}
+
+func (fi fileInfo) Name() string       { return fi.e.name }
+func (fi fileInfo) Size() int64        { return fi.e.size }
+func (fi fileInfo) ModTime() time.Time { return fi.e.mtime }
+func (fi fileInfo) IsDir() bool        { return fi.e.dir }
+func (fi fileInfo) Sys() interface{}   { return nil }
+
+func (fi fileInfo) Mode() os.FileMode {
+	if fi.e.dir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
@@ -0,0 +1,488 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package ntfs /* import "mig.ninja/mig/modules/ntfs" */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"mig.ninja/mig/modules/winbin"
+)
+
+/*
+	The Master File Table ($MFT) of an NTFS volume holds one record per file,
+	usually of 1024 bytes, starting with "FILE". The last two bytes of each
+	sector of a record are replaced on disk by an update sequence number,
+	and restored from the update sequence array of the record (fixup).
+
+	A record holds attributes, the ones read here are:
+	- $STANDARD_INFORMATION (0x10): the times shown by Windows, which can be
+	  changed by any program with write access to the file
+	- $ATTRIBUTE_LIST (0x20): the attributes stored in extension records
+	- $FILE_NAME (0x30): the name of the file, its parent directory, and a
+	  second set of times only updated by the kernel
+	- $DATA (0x80): the content of the file, resident in the record or
+	  stored in runs of clusters described by a runlist
+
+	Records of deleted files are not in use, but remain in the MFT until they
+	are reused, with their names and times.
+*/
+
+const (
+	attrStandardInformation = 0x10
+	attrAttributeList       = 0x20
+	attrFileName            = 0x30
+	attrData                = 0x80
+	attrEnd                 = 0xffffffff
+
+	recordInUse     = 0x01
+	recordDirectory = 0x02
+
+	// file name namespaces
+	namespacePOSIX = 0
+	namespaceWin32 = 1
+	namespaceDOS   = 2
+
+	// well known records
+	recordMFT    = 0
+	recordRoot   = 5
+	recordExtend = 11
+
+	sectorSize = 512
+
+)
+
+// Times are the four timestamps of a $STANDARD_INFORMATION or $FILE_NAME
+// attribute
+type Times struct {
+	Created     time.Time `json:"created"`
+	Modified    time.Time `json:"modified"`
+	MFTModified time.Time `json:"mftmodified"`
+	Accessed    time.Time `json:"accessed"`
+}
+
+// mftRecord is a decoded MFT record
+type mftRecord struct {
+	Number    uint64
+	Sequence  uint16
+	Flags     uint16
+	BaseRef   uint64 // reference of the base record, for extension records
+	SI        Times
+	HasSI     bool
+	FN        Times
+	Name      string
+	Parent    uint64
+	ParentSeq uint16
+	Size      uint64
+	Attrs     []mftAttribute
+}
+
+func (r *mftRecord) inUse() bool     { return r.Flags&recordInUse != 0 }
+func (r *mftRecord) directory() bool { return r.Flags&recordDirectory != 0 }
+
+// mftAttribute is the header of an attribute, with its content when it is
+// resident, or its runlist when it is not
+type mftAttribute struct {
+	Type        uint32
+	Name        string
+	Flags       uint16
+	NonResident bool
+	Content     []byte
+	StartVCN    uint64
+	RealSize    uint64
+	Runs        []dataRun
+}
+
+// dataRun is a range of clusters of a non resident attribute. Sparse runs
+// have no clusters on disk and read as zeros.
+type dataRun struct {
+	LCN    int64
+	Length uint64
+	Sparse bool
+}
+
+// parseRecord applies the fixup of a record and decodes its attributes
+func parseRecord(buf []byte, number uint64) (rec *mftRecord, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("record %d: %v", number, e)
+		}
+	}()
+	if string(buf[:4]) != "FILE" {
+		return nil, nil
+	}
+	if err := fixup(buf); err != nil {
+		return nil, fmt.Errorf("record %d: %v", number, err)
+	}
+	rec = &mftRecord{
+		Number:   number,
+		Sequence: winbin.Le16(buf, 16),
+		Flags:    winbin.Le16(buf, 22),
+		BaseRef:  winbin.Le64(buf, 32) & 0xffffffffffff,
+	}
+	nameSpace := -1
+	for off := int(winbin.Le16(buf, 20)); off+8 <= len(buf); {
+		atype := winbin.Le32(buf, off)
+		if atype == attrEnd {
+			break
+		}
+		length := int(winbin.Le32(buf, off+4))
+		if length < 16 || off+length > len(buf) {
+			panic(fmt.Sprintf("invalid attribute length %d at offset %d", length, off))
+		}
+		a := parseAttribute(buf[off : off+length])
+		rec.Attrs = append(rec.Attrs, a)
+		off += length
+
+		switch {
+		case a.Type == attrStandardInformation && !a.NonResident && len(a.Content) >= 32:
+			rec.SI = readTimes(a.Content, 0)
+			rec.HasSI = true
+		case a.Type == attrFileName && !a.NonResident && len(a.Content) >= 66:
+			ns := int(a.Content[65])
+			// prefer the long Win32 name over the DOS 8.3 name
+			if nameSpace != -1 && (ns == namespaceDOS || nameSpace == namespaceWin32) {
+				continue
+			}
+			nameSpace = ns
+			ref := winbin.Le64(a.Content, 0)
+			rec.Parent = ref & 0xffffffffffff
+			rec.ParentSeq = uint16(ref >> 48)
+			rec.FN = readTimes(a.Content, 8)
+			rec.Name = winbin.UTF16String(winbin.Slice(a.Content, 66, int(a.Content[64])*2))
+		case a.Type == attrData && a.Name == "":
+			if a.NonResident {
+				rec.Size = a.RealSize
+			} else {
+				rec.Size = uint64(len(a.Content))
+			}
+		}
+	}
+	return rec, nil
+}
+
+// parseAttribute decodes the header of an attribute
+func parseAttribute(b []byte) (a mftAttribute) {
+	a.Type = winbin.Le32(b, 0)
+	a.NonResident = b[8] != 0
+	a.Flags = winbin.Le16(b, 12)
+	if nameLen := int(b[9]); nameLen > 0 {
+		a.Name = winbin.UTF16String(winbin.Slice(b, int(winbin.Le16(b, 10)), nameLen*2))
+	}
+	if !a.NonResident {
+		a.Content = winbin.Slice(b, int(winbin.Le16(b, 20)), int(winbin.Le32(b, 16)))
+		return
+	}
+	a.StartVCN = winbin.Le64(b, 16)
+	a.RealSize = winbin.Le64(b, 48)
+	a.Runs = parseRunlist(b[winbin.Le16(b, 32):])
+	return
+}
+
+// parseRunlist decodes a runlist. Each run starts with a byte holding the
+// sizes of its length and of its offset, the offset being relative to the
+// previous run, and missing for sparse runs.
+func parseRunlist(b []byte) (runs []dataRun) {
+	var lcn int64
+	for i := 0; i < len(b) && b[i] != 0; {
+		lenSize := int(b[i] & 0x0f)
+		offSize := int(b[i] >> 4)
+		i++
+		if lenSize == 0 || lenSize > 8 || offSize > 8 || i+lenSize+offSize > len(b) {
+			panic("invalid runlist")
+		}
+		var length uint64
+		for j := lenSize - 1; j >= 0; j-- {
+			length = length<<8 | uint64(b[i+j])
+		}
+		i += lenSize
+		if offSize == 0 {
+			runs = append(runs, dataRun{Length: length, Sparse: true})
+			continue
+		}
+		var off int64
+		for j := offSize - 1; j >= 0; j-- {
+			off = off<<8 | int64(b[i+j])
+		}
+		// sign extend the offset
+		shift := uint(64 - 8*offSize)
+		off = off << shift >> shift
+		i += offSize
+		lcn += off
+		runs = append(runs, dataRun{LCN: lcn, Length: length})
+	}
+	return
+}
+
+// fixup checks the update sequence number at the end of each sector of a
+// record, and restores the original bytes from the update sequence array
+func fixup(buf []byte) error {
+	usaOff := int(winbin.Le16(buf, 4))
+	usaCount := int(winbin.Le16(buf, 6))
+	if usaCount == 0 || usaOff+usaCount*2 > len(buf) || (usaCount-1)*sectorSize > len(buf) {
+		return fmt.Errorf("invalid update sequence array")
+	}
+	usn := winbin.Le16(buf, usaOff)
+	for i := 1; i < usaCount; i++ {
+		end := i*sectorSize - 2
+		if winbin.Le16(buf, end) != usn {
+			return fmt.Errorf("update sequence mismatch in sector %d", i-1)
+		}
+		copy(buf[end:end+2], buf[usaOff+i*2:usaOff+i*2+2])
+	}
+	return nil
+}
+
+// readTimes reads the four timestamps of an attribute, in the order in
+// which they are stored: created, modified, MFT modified and accessed
+func readTimes(b []byte, off int) Times {
+	return Times{
+		Created:     winbin.Filetime(winbin.Le64(b, off)),
+		Modified:    winbin.Filetime(winbin.Le64(b, off+8)),
+		MFTModified: winbin.Filetime(winbin.Le64(b, off+16)),
+		Accessed:    winbin.Filetime(winbin.Le64(b, off+24)),
+	}
+}
+
+// attributeReader reads the content of a non resident attribute from the
+// clusters of a volume
+type attributeReader struct {
+	vol         io.ReaderAt
+	clusterSize int64
+	runs        []dataRun
+	size        int64
+}
+
+// ReadAt maps the offset in the attribute to the clusters of its runs
+func (ar *attributeReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= ar.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > ar.size-off {
+		p = p[:ar.size-off]
+		err = io.EOF
+	}
+	var start int64
+	for _, r := range ar.runs {
+		runSize := int64(r.Length) * ar.clusterSize
+		if off+int64(n) >= start+runSize {
+			start += runSize
+			continue
+		}
+		for n < len(p) && off+int64(n) < start+runSize {
+			pos := off + int64(n) - start
+			chunk := p[n:]
+			if int64(len(chunk)) > runSize-pos {
+				chunk = chunk[:runSize-pos]
+			}
+			if r.Sparse {
+				for i := range chunk {
+					chunk[i] = 0
+				}
+			} else if _, rerr := ar.vol.ReadAt(chunk, r.LCN*ar.clusterSize+pos); rerr != nil {
+				return n, rerr
+			}
+			n += len(chunk)
+		}
+		start += runSize
+		if n == len(p) {
+			return n, err
+		}
+	}
+	return n, io.ErrUnexpectedEOF
+}
+
+// dataStart returns the offset of the first cluster of the attribute that
+// is stored on disk, skipping the sparse runs of the change journal
+func (ar *attributeReader) dataStart() (off int64) {
+	for _, r := range ar.runs {
+		if !r.Sparse {
+			break
+		}
+		off += int64(r.Length) * ar.clusterSize
+	}
+	if off > ar.size {
+		return ar.size
+	}
+	return
+}
+
+// mftReader reads the records of an MFT, from a volume or from a file
+// extracted by a forensic tool
+type mftReader struct {
+	r          io.ReaderAt
+	size       int64
+	recordSize int64
+}
+
+// openMFT returns a reader of the records of an MFT. When recordSize is 0,
+// it is read from the header of the first record.
+func openMFT(r io.ReaderAt, size, recordSize int64) (*mftReader, error) {
+	if recordSize == 0 {
+		hdr := make([]byte, 32)
+		if _, err := r.ReadAt(hdr, 0); err != nil {
+			return nil, fmt.Errorf("openMFT: %v", err)
+		}
+		if string(hdr[:4]) != "FILE" {
+			return nil, fmt.Errorf("openMFT: invalid signature in first record")
+		}
+		recordSize = int64(binary.LittleEndian.Uint32(hdr[28:]))
+		if recordSize < sectorSize || recordSize > 65536 || recordSize&(recordSize-1) != 0 {
+			return nil, fmt.Errorf("openMFT: invalid record size %d", recordSize)
+		}
+	}
+	return &mftReader{r: r, size: size, recordSize: recordSize}, nil
+}
+
+// numRecords returns the number of records of the MFT
+func (m *mftReader) numRecords() uint64 {
+	return uint64(m.size / m.recordSize)
+}
+
+// record reads and decodes the record of a given number, and returns nil
+// for records that were never used
+func (m *mftReader) record(n uint64) (*mftRecord, error) {
+	buf := make([]byte, m.recordSize)
+	if _, err := m.r.ReadAt(buf, int64(n)*m.recordSize); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return parseRecord(buf, n)
+}
+
+// sectorReader aligns reads on sectors, as required by raw volumes on
+// Windows
+type sectorReader struct {
+	r io.ReaderAt
+}
+
+func (sr sectorReader) ReadAt(p []byte, off int64) (int, error) {
+	start := off - off%sectorSize
+	end := off + int64(len(p))
+	if end%sectorSize != 0 {
+		end += sectorSize - end%sectorSize
+	}
+	if start == off && end == off+int64(len(p)) {
+		return sr.r.ReadAt(p, off)
+	}
+	buf := make([]byte, end-start)
+	n, err := sr.r.ReadAt(buf, start)
+	n -= int(off - start)
+	if n < 0 {
+		n = 0
+	}
+	if n > len(p) {
+		n, err = len(p), nil
+	}
+	copy(p, buf[off-start:])
+	return n, err
+}
+
+// volume is an NTFS volume, read from a raw device or an image
+type volume struct {
+	r           io.ReaderAt
+	clusterSize int64
+	mft         *mftReader
+}
+
+// openVolume reads the boot sector of an NTFS volume, and the runlist of
+// its $MFT
+func openVolume(r io.ReaderAt) (v *volume, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("openVolume() -> %v", e)
+		}
+	}()
+	r = sectorReader{r}
+	boot := make([]byte, sectorSize)
+	if _, err := r.ReadAt(boot, 0); err != nil {
+		return nil, err
+	}
+	if string(boot[3:11]) != "NTFS    " {
+		return nil, fmt.Errorf("not an NTFS volume")
+	}
+	v = &volume{r: r}
+	v.clusterSize = int64(winbin.Le16(boot, 11)) * int64(boot[13])
+	// a negative number of clusters per record is a power of two of bytes
+	var recordSize int64
+	if c := int8(boot[64]); c < 0 {
+		recordSize = 1 << uint(-c)
+	} else {
+		recordSize = int64(c) * v.clusterSize
+	}
+	if v.clusterSize == 0 || recordSize < sectorSize {
+		return nil, fmt.Errorf("invalid cluster or record size")
+	}
+	buf := make([]byte, recordSize)
+	if _, err := r.ReadAt(buf, int64(winbin.Le64(boot, 48))*v.clusterSize); err != nil {
+		return nil, err
+	}
+	rec, err := parseRecord(buf, recordMFT)
+	if err != nil {
+		return nil, err
+	}
+	if rec == nil {
+		return nil, fmt.Errorf("invalid $MFT record")
+	}
+	data := v.dataReader(rec, "")
+	if data == nil {
+		return nil, fmt.Errorf("no $DATA attribute in $MFT record")
+	}
+	v.mft = &mftReader{r: data, size: data.size, recordSize: recordSize}
+	return v, nil
+}
+
+// dataReader returns a reader of a non resident $DATA attribute of a
+// record, following its attribute list if it has one
+func (v *volume) dataReader(rec *mftRecord, name string) *attributeReader {
+	ar := &attributeReader{vol: v.r, clusterSize: v.clusterSize}
+	found := false
+	add := func(a mftAttribute) {
+		if a.Type != attrData || a.Name != name || !a.NonResident {
+			return
+		}
+		if a.StartVCN == 0 {
+			ar.size = int64(a.RealSize)
+		}
+		ar.runs = append(ar.runs, a.Runs...)
+		found = true
+	}
+	for _, a := range rec.Attrs {
+		add(a)
+		if a.Type != attrAttributeList || a.NonResident || v.mft == nil {
+			continue
+		}
+		// attributes of large files are spread over extension records,
+		// listed in VCN order by the attribute list
+		seen := map[uint64]bool{rec.Number: true}
+		for off := 0; off+26 <= len(a.Content); {
+			length := int(winbin.Le16(a.Content, off+4))
+			if length < 26 {
+				break
+			}
+			ref := winbin.Le64(a.Content, off+16) & 0xffffffffffff
+			off += length
+			if seen[ref] {
+				continue
+			}
+			seen[ref] = true
+			ext, err := v.mft.record(ref)
+			if err != nil || ext == nil {
+				continue
+			}
+			for _, ea := range ext.Attrs {
+				add(ea)
+			}
+		}
+	}
+	if !found {
+		return nil
+	}
+	return ar
+}
+
@@ -0,0 +1,796 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+/*
+
+If you run it, it will return a JSON struct with the MFT records and the
+change journal records matching the search. If you add flag `-p`, it will
+pretty print the results.
+
+The $MFT and the $UsnJrnl:$J change journal are read from the raw volume,
+%SYSTEMDRIVE% by default on Windows, or from an image of the volume with
+`volume`. Files extracted by forensic tools can be read with `mftpath` and
+`usnpath` on any system.
+
+MFT records carry both the $STANDARD_INFORMATION times, which any program
+can change, and the $FILE_NAME times, which only the kernel sets. Files
+created before their $FILE_NAME creation time are flagged as timestomped.
+Records of deleted files are returned until they are reused, and the
+change journal records the creation, renaming and deletion of files, with
+the names they had before being renamed.
+
+Example JSON
+-------------
+
+{
+    "module": "ntfs",
+    "parameters": {
+        "volume": "\\\\.\\C:",
+        "names": [
+            "mimikatz"
+        ],
+        "paths": [
+            "(?i)\\\\users\\\\public\\\\"
+        ],
+        "startdate": "2016-09-01T00:00:00Z",
+        "maxmatches": 500
+    }
+}
+*/
+package ntfs /* import "mig.ninja/mig/modules/ntfs" */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mig.ninja/mig/modules"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+/*
+	An instance of this type will represent this module; it's possible to add additional data fields here,
+	although that is rarely needed.
+*/
+type module struct {
+}
+
+func (m *module) NewRun() modules.Runner {
+	return new(run)
+}
+
+/*
+	init is called by the Go runtime at startup. We use this function to register the module in a
+	global array of available modules, so the agent knows we exist
+*/
+func init() {
+	modules.Register("ntfs", new(module))
+}
+
+type run struct {
+	Parameters params
+	Results    modules.Result
+	stop       chan bool // closed when the module is asked to stop early
+}
+
+// defaultMaxMatches is the number of records returned when the parameters
+// set no limit
+const defaultMaxMatches = 1000
+
+/*
+	- Volume: Raw volume or image of an NTFS volume, such as \\.\C:
+	- MFTPath: Path of an extracted $MFT file
+	- UsnPath: Path of an extracted $UsnJrnl:$J file
+	- Sources: "mft" and/or "usnjrnl", both are searched if empty
+	- Names: Case insensitive substrings of the file names, matched against
+			 the current name and the names of the rename chain
+	- Paths: Regular expressions matched against the full path of the files
+	- StartDate, EndDate: Time range of the file times or of the changes
+	- Deleted: Only return deleted files and file deletions
+	- Timestomped: Only return MFT records flagged as timestomped
+	- MaxMatches: Maximum number of records returned, defaults to 1000
+*/
+type params struct {
+	Volume      string    `json:"volume,omitempty"`
+	MFTPath     string    `json:"mftpath,omitempty"`
+	UsnPath     string    `json:"usnpath,omitempty"`
+	Sources     []string  `json:"sources,omitempty"`
+	Names       []string  `json:"names,omitempty"`
+	Paths       []string  `json:"paths,omitempty"`
+	StartDate   time.Time `json:"startdate,omitempty"`
+	EndDate     time.Time `json:"enddate,omitempty"`
+	Deleted     bool      `json:"deleted,omitempty"`
+	Timestomped bool      `json:"timestomped,omitempty"`
+	MaxMatches  int       `json:"maxmatches,omitempty"`
+	Debug       bool      `json:"debug,omitempty"`
+}
+
+// FileRecord is a file of the MFT. Paths are relative to the root of the
+// volume, and start with ? when a parent directory was reused.
+//
+// Times hold the $FILE_NAME times, and the $STANDARD_INFORMATION times of
+// files that are not flagged as timestomped, so the first seen time of a
+// file is not taken from a forged timestamp.
+type FileRecord struct {
+	Record        uint64                 `json:"record"`
+	Sequence      uint16                 `json:"sequence"`
+	Path          string                 `json:"path"`
+	Name          string                 `json:"name"`
+	Size          uint64                 `json:"size"`
+	Directory     bool                   `json:"directory,omitempty"`
+	Deleted       bool                   `json:"deleted,omitempty"`
+	SI            Times                  `json:"si"`
+	FN            Times                  `json:"fn"`
+	Timestomped   bool                   `json:"timestomped,omitempty"`
+	PreviousNames []string               `json:"previousnames,omitempty"`
+	Times         []modules.ArtefactTime `json:"times,omitempty"`
+}
+
+// Change is a record of the change journal. PreviousNames are the names the
+// file had before the change, following its renames in the journal.
+type Change struct {
+	USN           int64                  `json:"usn"`
+	Time          time.Time              `json:"time"`
+	Record        uint64                 `json:"record"`
+	Sequence      uint16                 `json:"sequence"`
+	Path          string                 `json:"path,omitempty"`
+	Name          string                 `json:"name"`
+	Reasons       []string               `json:"reasons"`
+	PreviousNames []string               `json:"previousnames,omitempty"`
+	Times         []modules.ArtefactTime `json:"times,omitempty"`
+}
+
+type elements struct {
+	Files   []FileRecord `json:"mftresults,omitempty"`
+	Changes []Change     `json:"usnresults,omitempty"`
+}
+
+/* Statistic counters:
+- RecordsParsed is the number of MFT records decoded
+- RecordErrors is the number of MFT records that could not be decoded
+- ChangesParsed is the number of change journal records decoded
+- ChangeErrors is the number of change journal records that could not be decoded
+- TotalHits is the number of records matching the search
+- LimitReached is set when the search stopped at MaxMatches records
+- Exectime is the total runtime of the search
+*/
+type statistics struct {
+	RecordsParsed int           `json:"recordsparsed"`
+	RecordErrors  int           `json:"recorderrors"`
+	ChangesParsed int           `json:"changesparsed"`
+	ChangeErrors  int           `json:"changeerrors"`
+	TotalHits     int           `json:"totalhits"`
+	LimitReached  bool          `json:"limitreached,omitempty"`
+	Exectime      time.Duration `json:"exectime"`
+}
+
+/*
+	ValidateParameters *must* be implemented by a module. It provides a method to verify that the parameters
+	passed to the module conform the expected format. It must return an error if the parameters do not validate.
+*/
+func (r *run) ValidateParameters() (err error) {
+	p := r.Parameters
+	if p.Volume != "" && (p.MFTPath != "" || p.UsnPath != "") {
+		return fmt.Errorf("ValidateParameters: Volume cannot be combined with MFTPath or UsnPath.")
+	}
+	if p.Volume == "" && p.MFTPath == "" && p.UsnPath == "" && runtime.GOOS != "windows" {
+		return fmt.Errorf("ValidateParameters: One of Volume, MFTPath or UsnPath must be set outside of Windows.")
+	}
+	for _, s := range p.Sources {
+		if s != "mft" && s != "usnjrnl" {
+			return fmt.Errorf("ValidateParameters: Invalid source %q, must be mft or usnjrnl.", s)
+		}
+	}
+	if len(p.Names) == 0 && len(p.Paths) == 0 && p.StartDate.IsZero() && p.EndDate.IsZero() && !p.Deleted && !p.Timestomped {
+		return fmt.Errorf("ValidateParameters: At least one of Names, Paths, StartDate, EndDate, Deleted or Timestomped must be set.")
+	}
+	if !p.StartDate.IsZero() && !p.EndDate.IsZero() && p.EndDate.Before(p.StartDate) {
+		return fmt.Errorf("ValidateParameters: EndDate is *BEFORE* StartDate.")
+	}
+	for _, expr := range p.Paths {
+		if _, err := regexp.Compile(expr); err != nil {
+			return fmt.Errorf("ValidateParameters: Invalid regular expression for path %s: %v", expr, err)
+		}
+	}
+	if p.MaxMatches < 0 {
+		return fmt.Errorf("ValidateParameters: MaxMatches must be positive.")
+	}
+	return
+}
+
+/*
+	Run *must* be implemented by a module. Its the function that executes the module. It must return a string of
+	marshalled json that contains the results from the module. The code below provides a base module skeleton that
+	can be reused in all modules.
+*/
+func (r *run) Run(in io.Reader) (out string) {
+	// a good way to handle execution failures is to catch panics and store
+	// the panicked error into modules.Results.Errors, marshal that, and output
+	// the JSON string back to the caller
+	defer func() {
+		if e := recover(); e != nil {
+			r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%v", e))
+			r.Results.Success = false
+			buf, _ := json.Marshal(r.Results)
+			out = string(buf[:])
+		}
+	}()
+
+	// read module parameters from stdin
+	err := modules.ReadInputParameters(in, &r.Parameters)
+	if err != nil {
+		panic(err)
+	}
+	// verify that the parameters we received are valid
+	err = r.ValidateParameters()
+	if err != nil {
+		panic(err)
+	}
+
+	// start a goroutine that does some work and another one that looks
+	// for an early stop signal
+	moduleDone := make(chan bool)
+	stop := make(chan bool)
+	r.stop = make(chan bool)
+	go r.doModuleStuff(&out, &moduleDone)
+	go modules.WatchForStop(in, &stop)
+
+	select {
+	case <-moduleDone:
+		return out
+	case <-stop:
+		// the module builds its results from what it collected so far
+		close(r.stop)
+		<-moduleDone
+		return out
+	}
+}
+
+/* doModuleStuff is an internal module function that does things specific to the module. There is no implementation requirement.
+   It's good practice to have it return the JSON string Run() expects to return. We also make it return a boolean in the `moduleDone`
+   channel to do flow control in Run().
+*/
+func (r *run) doModuleStuff(out *string, moduleDone *chan bool) error {
+	var (
+		el    elements
+		stats statistics
+		mft   *mftReader
+		ix    *index
+		chain map[uint64][]string
+	)
+	t0 := time.Now()
+
+	max := r.Parameters.MaxMatches
+	if max == 0 {
+		max = defaultMaxMatches
+	}
+	m := newMatcher(r.Parameters)
+	hit := func() bool {
+		stats.TotalHits++
+		if stats.TotalHits >= max {
+			stats.LimitReached = true
+		}
+		return !stats.LimitReached
+	}
+	stopped := false
+
+	// the journal is read from the volume, or from an extracted file
+	var journal func(fn func(ur usnRecord, err error) bool) error
+	files, err := r.openSources(&mft, &journal)
+	defer files.Close()
+	if err != nil {
+		r.Results.Errors = append(r.Results.Errors, err.Error())
+	}
+
+	// the paths of the files are resolved from a first pass over the MFT
+	if mft != nil {
+		ix = buildIndex(mft, &stats)
+		if r.Parameters.Debug {
+			fmt.Printf("indexed %d MFT records\n", stats.RecordsParsed)
+		}
+		if ix.vol != nil {
+			journal = ix.journal
+		}
+	}
+
+	if journal != nil && r.wants("usnjrnl") {
+		chain = make(map[uint64][]string)
+		err = journal(func(ur usnRecord, err error) bool {
+			if modules.IsStopped(r.stop) {
+				stopped = true
+				return false
+			}
+			if err != nil {
+				stats.ChangeErrors++
+				if r.Parameters.Debug {
+					fmt.Println(err)
+				}
+				return true
+			}
+			stats.ChangesParsed++
+			c := newChange(ur, chain, ix)
+			if !m.matchChange(c) {
+				return true
+			}
+			el.Changes = append(el.Changes, c)
+			return hit()
+		})
+		if err != nil {
+			r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("change journal: %v", err))
+		}
+	}
+
+	if ix != nil && r.wants("mft") && !stats.LimitReached && !stopped {
+		for n := uint64(0); n < mft.numRecords(); n++ {
+			if modules.IsStopped(r.stop) {
+				stopped = true
+				break
+			}
+			rec, err := mft.record(n)
+			if err != nil || rec == nil || rec.BaseRef != 0 || rec.Name == "" {
+				continue
+			}
+			f := newFileRecord(rec, ix, chain)
+			if !m.matchFile(f) {
+				continue
+			}
+			el.Files = append(el.Files, f)
+			if !hit() {
+				break
+			}
+		}
+	}
+	if stats.RecordErrors > 0 {
+		r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%d MFT records could not be decoded", stats.RecordErrors))
+	}
+	if stats.ChangeErrors > 0 {
+		r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%d change journal records could not be decoded", stats.ChangeErrors))
+	}
+	if stopped {
+		r.Results.Errors = append(r.Results.Errors, modules.StoppedEarly)
+	}
+	stats.Exectime = time.Now().Sub(t0)
+
+	// marshal the results into a json string
+	*out = r.buildResults(el, stats)
+	*moduleDone <- true
+	return nil
+}
+
+// wants returns true if a source is searched
+func (r *run) wants(source string) bool {
+	if len(r.Parameters.Sources) == 0 {
+		return true
+	}
+	for _, s := range r.Parameters.Sources {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
+
+// openSources opens the volume, or the extracted MFT and change journal,
+// and returns the files to close once the search is done. The extracted MFT
+// is read even when only the journal is searched, to resolve its paths.
+func (r *run) openSources(mft **mftReader, journal *func(fn func(ur usnRecord, err error) bool) error) (io.Closer, error) {
+	var files multiCloser
+	p := r.Parameters
+	if p.Volume == "" && p.MFTPath == "" && p.UsnPath == "" {
+		drive := os.Getenv("SYSTEMDRIVE")
+		if drive == "" {
+			drive = "C:"
+		}
+		p.Volume = `\\.\` + drive
+	}
+	if p.Volume != "" {
+		fd, err := os.Open(p.Volume)
+		if err != nil {
+			return files, err
+		}
+		files = append(files, fd)
+		v, err := openVolume(fd)
+		if err != nil {
+			return files, fmt.Errorf("%s: %v", p.Volume, err)
+		}
+		*mft = v.mft
+		return files, nil
+	}
+	if p.MFTPath != "" {
+		fd, size, err := openFile(p.MFTPath)
+		if err != nil {
+			return files, err
+		}
+		files = append(files, fd)
+		*mft, err = openMFT(fd, size, 0)
+		if err != nil {
+			return files, fmt.Errorf("%s: %v", p.MFTPath, err)
+		}
+	}
+	if p.UsnPath != "" && r.wants("usnjrnl") {
+		fd, size, err := openFile(p.UsnPath)
+		if err != nil {
+			return files, err
+		}
+		files = append(files, fd)
+		*journal = func(fn func(ur usnRecord, err error) bool) error {
+			return readJournal(fd, 0, size, fn)
+		}
+	}
+	return files, nil
+}
+
+func openFile(path string) (*os.File, int64, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, 0, err
+	}
+	return fd, fi.Size(), nil
+}
+
+// multiCloser closes a list of files
+type multiCloser []io.Closer
+
+func (mc multiCloser) Close() error {
+	for _, c := range mc {
+		c.Close()
+	}
+	return nil
+}
+
+// newFileRecord returns the file of an MFT record, with its path and the
+// names it had in the change journal
+func newFileRecord(rec *mftRecord, ix *index, chain map[uint64][]string) (f FileRecord) {
+	f = FileRecord{
+		Record:    rec.Number,
+		Sequence:  rec.Sequence,
+		Name:      rec.Name,
+		Path:      ix.path(rec.Parent, rec.ParentSeq, rec.Name),
+		Size:      rec.Size,
+		Directory: rec.directory(),
+		Deleted:   !rec.inUse(),
+		SI:        rec.SI,
+		FN:        rec.FN,
+	}
+	// the creation time of $STANDARD_INFORMATION cannot legitimately be
+	// earlier than the one of $FILE_NAME, set when the file was created
+	f.Timestomped = rec.HasSI && !rec.SI.Created.IsZero() && rec.SI.Created.Before(rec.FN.Created)
+	for _, name := range chain[rec.Number] {
+		if name != rec.Name {
+			f.PreviousNames = append(f.PreviousNames, name)
+		}
+	}
+	f.Times = appendTime(f.Times, modules.ArtefactTimeCreated, rec.FN.Created)
+	f.Times = appendTime(f.Times, modules.ArtefactTimeModified, rec.FN.Modified)
+	if !f.Timestomped {
+		f.Times = appendTime(f.Times, modules.ArtefactTimeCreated, rec.SI.Created)
+		f.Times = appendTime(f.Times, modules.ArtefactTimeModified, rec.SI.Modified)
+	}
+	return
+}
+
+// newChange returns the change of a journal record, and adds its name to
+// the rename chain of the file
+func newChange(ur usnRecord, chain map[uint64][]string, ix *index) (c Change) {
+	c = Change{
+		USN:      ur.USN,
+		Time:     ur.Time,
+		Record:   ur.Record,
+		Sequence: ur.Sequence,
+		Name:     ur.Name,
+		Reasons:  reasonNames(ur.Reason),
+	}
+	if ix != nil {
+		c.Path = ix.path(ur.Parent, ur.ParentSeq, ur.Name)
+	}
+	// a reused record starts a new chain
+	if names := chain[ur.Record]; len(names) > 0 && ur.Reason&usnReasonFileCreate != 0 {
+		delete(chain, ur.Record)
+	}
+	names := chain[ur.Record]
+	for _, name := range names {
+		if name != ur.Name {
+			c.PreviousNames = append(c.PreviousNames, name)
+		}
+	}
+	if len(names) == 0 || names[len(names)-1] != ur.Name {
+		chain[ur.Record] = append(names, ur.Name)
+	}
+	kind := modules.ArtefactTimeModified
+	switch {
+	case ur.Reason&usnReasonFileCreate != 0:
+		kind = modules.ArtefactTimeCreated
+	case ur.Reason&usnReasonFileDelete != 0:
+		kind = modules.ArtefactTimeDeleted
+	case ur.Reason&(usnReasonRenameOldName|usnReasonRenameNewName) != 0:
+		kind = modules.ArtefactTimeRenamed
+	}
+	c.Times = appendTime(c.Times, kind, ur.Time)
+	return
+}
+
+func appendTime(times []modules.ArtefactTime, kind string, t time.Time) []modules.ArtefactTime {
+	if t.IsZero() {
+		return times
+	}
+	return append(times, modules.NewArtefactTime(kind, t, "ntfs"))
+}
+
+// indexEntry is the name and parent of an MFT record, used to resolve paths
+type indexEntry struct {
+	name      string
+	parent    uint64
+	parentSeq uint16
+	seq       uint16
+	inUse     bool
+	valid     bool
+}
+
+// index holds the names of all the records of the MFT
+type index struct {
+	entries []indexEntry
+	dirs    map[uint64]string
+	mft     *mftReader
+	vol     *volume
+	usnJrnl *mftRecord
+}
+
+// buildIndex reads the names and parents of all the records of the MFT
+func buildIndex(mft *mftReader, stats *statistics) *index {
+	ix := &index{
+		entries: make([]indexEntry, mft.numRecords()),
+		dirs:    make(map[uint64]string),
+		mft:     mft,
+	}
+	if ar, ok := mft.r.(*attributeReader); ok {
+		ix.vol = &volume{r: ar.vol, clusterSize: ar.clusterSize, mft: mft}
+	}
+	for n := range ix.entries {
+		rec, err := mft.record(uint64(n))
+		if err != nil {
+			stats.RecordErrors++
+			continue
+		}
+		if rec == nil || rec.BaseRef != 0 {
+			continue
+		}
+		stats.RecordsParsed++
+		ix.entries[n] = indexEntry{
+			name:      rec.Name,
+			parent:    rec.Parent,
+			parentSeq: rec.ParentSeq,
+			seq:       rec.Sequence,
+			inUse:     rec.inUse(),
+			valid:     true,
+		}
+		if rec.Name == "$UsnJrnl" && rec.Parent == recordExtend && rec.inUse() {
+			ix.usnJrnl = rec
+		}
+	}
+	return ix
+}
+
+// journal reads the $J stream of the change journal of the volume
+func (ix *index) journal(fn func(ur usnRecord, err error) bool) error {
+	if ix.vol == nil || ix.usnJrnl == nil {
+		return fmt.Errorf("change journal not found on the volume")
+	}
+	ar := ix.vol.dataReader(ix.usnJrnl, "$J")
+	if ar == nil {
+		return fmt.Errorf("no $J stream in $UsnJrnl")
+	}
+	return readJournal(ar, ar.dataStart(), ar.size, fn)
+}
+
+// path returns the path of a file from the reference of its parent
+// directory
+func (ix *index) path(parent uint64, parentSeq uint16, name string) string {
+	return ix.dir(parent, parentSeq, 0) + `\` + name
+}
+
+// dir returns the path of a directory, or ? when the directory record was
+// reused since the reference was written. The sequence number of a record
+// is incremented when it is freed, so deleted directories are still found.
+func (ix *index) dir(n uint64, seq uint16, depth int) string {
+	if n == recordRoot {
+		return ""
+	}
+	if n >= uint64(len(ix.entries)) || depth > 64 {
+		return "?"
+	}
+	e := ix.entries[n]
+	if !e.valid || (seq != 0 && e.seq != seq && (e.inUse || e.seq != seq+1)) {
+		return "?"
+	}
+	key := n<<16 | uint64(seq)
+	if p, ok := ix.dirs[key]; ok {
+		return p
+	}
+	p := ix.dir(e.parent, e.parentSeq, depth+1) + `\` + e.name
+	ix.dirs[key] = p
+	return p
+}
+
+// matcher holds the compiled search parameters
+type matcher struct {
+	p     params
+	names []string
+	paths []*regexp.Regexp
+}
+
+func newMatcher(p params) (m matcher) {
+	m.p = p
+	for _, name := range p.Names {
+		m.names = append(m.names, strings.ToLower(name))
+	}
+	for _, expr := range p.Paths {
+		m.paths = append(m.paths, regexp.MustCompile(expr))
+	}
+	return
+}
+
+// matchName returns true if one of the names contains a searched name
+func (m matcher) matchName(names ...string) bool {
+	if len(m.names) == 0 {
+		return true
+	}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		for _, search := range m.names {
+			if strings.Contains(name, search) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m matcher) matchPath(path string) bool {
+	if len(m.paths) == 0 {
+		return true
+	}
+	for _, re := range m.paths {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// inRange returns true if one of the times is in the searched time range
+func (m matcher) inRange(times ...time.Time) bool {
+	if m.p.StartDate.IsZero() && m.p.EndDate.IsZero() {
+		return true
+	}
+	for _, t := range times {
+		if t.IsZero() {
+			continue
+		}
+		if !m.p.StartDate.IsZero() && t.Before(m.p.StartDate) {
+			continue
+		}
+		if !m.p.EndDate.IsZero() && t.After(m.p.EndDate) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func (m matcher) matchFile(f FileRecord) bool {
+	if m.p.Deleted && !f.Deleted {
+		return false
+	}
+	if m.p.Timestomped && !f.Timestomped {
+		return false
+	}
+	return m.matchName(append([]string{f.Name}, f.PreviousNames...)...) && m.matchPath(f.Path) &&
+		m.inRange(f.SI.Created, f.SI.Modified, f.SI.MFTModified, f.SI.Accessed,
+			f.FN.Created, f.FN.Modified, f.FN.MFTModified, f.FN.Accessed)
+}
+
+// matchChange returns true if a change matches the search, changes have no
+// timestomp flag and are not returned when it is searched
+func (m matcher) matchChange(c Change) bool {
+	if m.p.Timestomped {
+		return false
+	}
+	if m.p.Deleted {
+		deleted := false
+		for _, reason := range c.Reasons {
+			if reason == "FILE_DELETE" {
+				deleted = true
+			}
+		}
+		if !deleted {
+			return false
+		}
+	}
+	return m.matchName(append([]string{c.Name}, c.PreviousNames...)...) && m.matchPath(c.Path) && m.inRange(c.Time)
+}
+
+// buildResults takes the results found by the module, as well as statistics,
+// and puts all that into a JSON string. It also takes care of setting the
+// success and foundanything flags.
+func (r *run) buildResults(el elements, stats statistics) string {
+	if len(r.Results.Errors) == 0 {
+		r.Results.Success = true
+	}
+	r.Results.Elements = el
+	r.Results.Statistics = stats
+	if stats.TotalHits > 0 {
+		r.Results.FoundAnything = true
+	}
+	jsonOutput, err := json.Marshal(r.Results)
+	if err != nil {
+		panic(err)
+	}
+	return string(jsonOutput[:])
+}
+
+// PrintResults() is an *optional* method that returns results in a human-readable format.
+// if matchOnly is set, only results that have at least one match are returned.
+// If matchOnly is not set, all results are returned, along with errors and statistics.
+func (r *run) PrintResults(result modules.Result, matchOnly bool) (prints []string, err error) {
+	var (
+		el    elements
+		stats statistics
+	)
+	err = result.GetElements(&el)
+	if err != nil {
+		panic(err)
+	}
+	prints = append(prints, fmt.Sprintf("\n-----------------\n     NTFS Results           \n------------------"))
+	for _, f := range el.Files {
+		status := ""
+		if f.Deleted {
+			status += " [deleted]"
+		}
+		if f.Timestomped {
+			status += " [timestomped]"
+		}
+		prints = append(prints, fmt.Sprintf("MFT %d-%d: %s%s, Size: %d, SI Created: %s, FN Created: %s, SI Modified: %s",
+			f.Record, f.Sequence, f.Path, status, f.Size, f.SI.Created.Format(time.RFC3339),
+			f.FN.Created.Format(time.RFC3339), f.SI.Modified.Format(time.RFC3339)))
+		if len(f.PreviousNames) > 0 {
+			prints = append(prints, fmt.Sprintf("    Previous Names: %s", strings.Join(f.PreviousNames, ", ")))
+		}
+	}
+	for _, c := range el.Changes {
+		name := c.Path
+		if name == "" {
+			name = c.Name
+		}
+		prints = append(prints, fmt.Sprintf("USN %d: %s, MFT %d-%d: %s, Reasons: %s",
+			c.USN, c.Time.Format(time.RFC3339), c.Record, c.Sequence, name, strings.Join(c.Reasons, "|")))
+		if len(c.PreviousNames) > 0 {
+			prints = append(prints, fmt.Sprintf("    Previous Names: %s", strings.Join(c.PreviousNames, ", ")))
+		}
+	}
+
+	for _, e := range result.Errors {
+		prints = append(prints, fmt.Sprintf("error: %v", e))
+	}
+	err = result.GetStatistics(&stats)
+	if err != nil {
+		panic(err)
+	}
+	prints = append(prints, fmt.Sprintf("MFT Records Parsed : %d", stats.RecordsParsed))
+	prints = append(prints, fmt.Sprintf("Changes Parsed     : %d", stats.ChangesParsed))
+	prints = append(prints, fmt.Sprintf("Total Hits         : %d", stats.TotalHits))
+	if stats.LimitReached {
+		prints = append(prints, "Search stopped at the maximum number of matches")
+	}
+	return
+}
@@ -0,0 +1,461 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package ntfs /* import "mig.ninja/mig/modules/ntfs" */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"mig.ninja/mig/modules"
+	"mig.ninja/mig/testutil"
+)
+
+func TestRegistration(t *testing.T) {
+	testutil.CheckModuleRegistration(t, "ntfs")
+}
+
+const (
+	testClusterSize = 4096
+	testRecordSize  = 1024
+	testMFTCluster  = 4
+	testMFTRecords  = 36
+	testJCluster    = 20
+	testVolumeSize  = 24 * testClusterSize
+)
+
+var (
+	testT0         = time.Date(2016, 9, 1, 10, 0, 0, 0, time.UTC)
+	testStompedT   = time.Date(2010, 11, 20, 21, 29, 0, 0, time.UTC)
+	testDropperT   = time.Date(2016, 9, 2, 10, 0, 0, 0, time.UTC)
+	testDropperDel = time.Date(2016, 9, 2, 10, 5, 0, 0, time.UTC)
+)
+
+func align8(n int) int {
+	return (n + 7) &^ 7
+}
+
+// testUsnRecord generates a version 2 or 3 USN record
+func testUsnRecord(version uint16, usn int64, record uint64, seq uint16, parent uint64, parentSeq uint16, t time.Time, reason uint32, name string) []byte {
+	uname := testutil.EncodeUTF16(name)
+	off, nameOff := 24, 56
+	if version == 3 {
+		off, nameOff = 40, 72
+	}
+	b := make([]byte, align8(nameOff+4+len(uname)))
+	binary.LittleEndian.PutUint32(b[0:], uint32(len(b)))
+	binary.LittleEndian.PutUint16(b[4:], version)
+	binary.LittleEndian.PutUint64(b[8:], record|uint64(seq)<<48)
+	if version == 3 {
+		binary.LittleEndian.PutUint64(b[24:], parent|uint64(parentSeq)<<48)
+	} else {
+		binary.LittleEndian.PutUint64(b[16:], parent|uint64(parentSeq)<<48)
+	}
+	binary.LittleEndian.PutUint64(b[off:], uint64(usn))
+	binary.LittleEndian.PutUint64(b[off+8:], testutil.Filetime(t))
+	binary.LittleEndian.PutUint32(b[off+16:], reason)
+	binary.LittleEndian.PutUint16(b[nameOff:], uint16(len(uname)))
+	binary.LittleEndian.PutUint16(b[nameOff+2:], uint16(nameOff+4))
+	copy(b[nameOff+4:], uname)
+	return b
+}
+
+// testJournal generates the clusters of the change journal stored on disk,
+// where a dropper is created, renamed and deleted
+func testJournal() []byte {
+	var j []byte
+	usn := int64(2 * testClusterSize)
+	add := func(rec []byte) {
+		j = append(j, rec...)
+		usn += int64(len(rec))
+	}
+	add(testUsnRecord(2, usn, 33, 2, 31, 1, testDropperT, usnReasonFileCreate, "dropper.tmp"))
+	add(testUsnRecord(2, usn, 33, 2, 31, 1, testDropperT.Add(time.Minute), usnReasonRenameOldName, "dropper.tmp"))
+	add(testUsnRecord(2, usn, 33, 2, 31, 1, testDropperT.Add(time.Minute), usnReasonRenameNewName, "dropper.exe"))
+	add(testUsnRecord(3, usn, 32, 1, 31, 1, testDropperT.Add(2*time.Minute), 0x80000002, "explorer.exe"))
+	add(testUsnRecord(2, usn, 33, 2, 31, 1, testDropperDel, usnReasonFileDelete|0x80000000, "dropper.exe"))
+	return append(j, make([]byte, testClusterSize-len(j))...)
+}
+
+// buildVolume generates an NTFS volume holding a timestomped file, a
+// deleted dropper, an orphan file and a change journal
+func buildVolume() []byte {
+	vol := make([]byte, testVolumeSize)
+	boot := vol[:sectorSize]
+	copy(boot[3:], "NTFS    ")
+	binary.LittleEndian.PutUint16(boot[11:], sectorSize)
+	boot[13] = testClusterSize / sectorSize
+	binary.LittleEndian.PutUint64(boot[48:], testMFTCluster)
+	boot[64] = 0xf6 // 2^10 bytes per record
+
+	dir := uint16(recordInUse | recordDirectory)
+	records := map[uint64][]byte{
+		0: testutil.NTFSRecord(0, 1, recordInUse, testutil.NTFSStandardInformation(testT0, testT0), testutil.NTFSFileName(recordRoot, 5, testT0, "$MFT", namespaceWin32),
+			testutil.NTFSNonResidentAttr(attrData, "", []byte{0x11, 9, testMFTCluster, 0}, testMFTRecords*testRecordSize)),
+		5:  testutil.NTFSRecord(5, 5, dir, testutil.NTFSStandardInformation(testT0, testT0), testutil.NTFSFileName(recordRoot, 5, testT0, ".", namespaceWin32)),
+		11: testutil.NTFSRecord(11, 11, dir, testutil.NTFSStandardInformation(testT0, testT0), testutil.NTFSFileName(recordRoot, 5, testT0, "$Extend", namespaceWin32)),
+		30: testutil.NTFSRecord(30, 1, dir, testutil.NTFSStandardInformation(testT0, testT0), testutil.NTFSFileName(recordRoot, 5, testT0, "Users", namespaceWin32)),
+		31: testutil.NTFSRecord(31, 1, dir, testutil.NTFSStandardInformation(testT0, testT0), testutil.NTFSFileName(30, 1, testT0, "Public", namespaceWin32)),
+		32: testutil.NTFSRecord(32, 1, recordInUse, testutil.NTFSStandardInformation(testStompedT, testStompedT),
+			testutil.NTFSFileName(31, 1, testT0, "EXPLOR~1.EXE", namespaceDOS), testutil.NTFSFileName(31, 1, testT0, "explorer.exe", namespaceWin32),
+			testutil.NTFSResidentAttr(attrData, "", []byte("MZ"))),
+		// the record of the deleted dropper is freed, so its sequence
+		// number was incremented
+		33: testutil.NTFSRecord(33, 3, 0, testutil.NTFSStandardInformation(testDropperT, testDropperT), testutil.NTFSFileName(31, 1, testDropperT, "dropper.exe", namespaceWin32),
+			testutil.NTFSNonResidentAttr(attrData, "", []byte{0x11, 1, 22, 0}, 3000)),
+		34: testutil.NTFSRecord(34, 1, recordInUse, testutil.NTFSStandardInformation(testT0, testT0), testutil.NTFSFileName(recordExtend, 11, testT0, "$UsnJrnl", namespaceWin32),
+			testutil.NTFSResidentAttr(attrData, "$Max", make([]byte, 32)),
+			testutil.NTFSNonResidentAttr(attrData, "$J", []byte{0x01, 2, 0x11, 1, testJCluster, 0}, 3*testClusterSize)),
+		// the parent of this file was reused
+		35: testutil.NTFSRecord(35, 1, recordInUse, testutil.NTFSStandardInformation(testT0, testT0), testutil.NTFSFileName(29, 7, testT0, "notes.txt", namespaceWin32)),
+	}
+	for n, rec := range records {
+		copy(vol[testMFTCluster*testClusterSize+int(n)*testRecordSize:], rec)
+	}
+	copy(vol[testJCluster*testClusterSize:], testJournal())
+	return vol
+}
+
+func TestParseVolume(t *testing.T) {
+	v, err := openVolume(bytes.NewReader(buildVolume()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.clusterSize != testClusterSize || v.mft.recordSize != testRecordSize || v.mft.numRecords() != testMFTRecords {
+		t.Fatalf("unexpected volume geometry %d %d %d", v.clusterSize, v.mft.recordSize, v.mft.numRecords())
+	}
+	rec, err := v.mft.record(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Name != "explorer.exe" || rec.Parent != 31 || rec.ParentSeq != 1 || !rec.inUse() || rec.Size != 2 ||
+		!rec.SI.Created.Equal(testStompedT) || !rec.FN.Created.Equal(testT0) {
+		t.Fatalf("unexpected record %+v", rec)
+	}
+	if rec, err = v.mft.record(1); rec != nil || err != nil {
+		t.Fatalf("expected unused record to be skipped, got %+v, %v", rec, err)
+	}
+
+	var stats statistics
+	ix := buildIndex(v.mft, &stats)
+	if stats.RecordsParsed != 9 || stats.RecordErrors != 0 || ix.usnJrnl == nil || ix.usnJrnl.Number != 34 {
+		t.Fatalf("unexpected index statistics %+v", stats)
+	}
+	for _, tc := range []struct {
+		parent   uint64
+		seq      uint16
+		expected string
+	}{
+		{31, 1, `\Users\Public\explorer.exe`},
+		{recordRoot, 5, `\explorer.exe`},
+		{29, 7, `?\explorer.exe`},
+		{30, 4, `?\explorer.exe`},
+	} {
+		if p := ix.path(tc.parent, tc.seq, "explorer.exe"); p != tc.expected {
+			t.Fatalf("expected path %s, got %s", tc.expected, p)
+		}
+	}
+
+	var changes []usnRecord
+	err = ix.journal(func(ur usnRecord, err error) bool {
+		if err != nil {
+			t.Fatal(err)
+		}
+		changes = append(changes, ur)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 5 {
+		t.Fatalf("expected 5 journal records, got %d", len(changes))
+	}
+	if changes[0].USN != 2*testClusterSize || changes[0].Record != 33 || changes[0].Sequence != 2 ||
+		changes[0].Name != "dropper.tmp" || !changes[0].Time.Equal(testDropperT) {
+		t.Fatalf("unexpected first journal record %+v", changes[0])
+	}
+	// the fourth record is a version 3 record
+	if changes[3].Record != 32 || changes[3].Parent != 31 || changes[3].Name != "explorer.exe" ||
+		!reflect.DeepEqual(reasonNames(changes[3].Reason), []string{"DATA_EXTEND", "CLOSE"}) {
+		t.Fatalf("unexpected version 3 journal record %+v", changes[3])
+	}
+
+	// a record whose update sequence does not match is reported
+	vol := buildVolume()
+	vol[testMFTCluster*testClusterSize+32*testRecordSize+sectorSize-1] ^= 0xff
+	v, err = openVolume(bytes.NewReader(vol))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = v.mft.record(32); err == nil {
+		t.Fatal("expected error on invalid update sequence")
+	}
+	if _, err = openVolume(bytes.NewReader(make([]byte, testVolumeSize))); err == nil {
+		t.Fatal("expected error on invalid boot sector")
+	}
+}
+
+func TestFileSystem(t *testing.T) {
+	// the record of the dropper is reused by an installer stored in a
+	// cluster of the volume
+	vol := buildVolume()
+	setup := bytes.Repeat([]byte("setup "), 500)
+	copy(vol[testMFTCluster*testClusterSize+33*testRecordSize:], testutil.NTFSRecord(33, 3, recordInUse, testutil.NTFSStandardInformation(testT0, testDropperT),
+		testutil.NTFSFileName(31, 1, testT0, "setup.exe", namespaceWin32), testutil.NTFSNonResidentAttr(attrData, "", []byte{0x11, 1, 23, 0}, uint64(len(setup)))))
+	copy(vol[23*testClusterSize:], setup)
+	fs, err := OpenFileSystem(bytes.NewReader(vol))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the metadata files and the orphan file are not listed
+	list, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name() != "Users" || !list[0].IsDir() {
+		t.Fatalf("unexpected root directory %+v", list)
+	}
+	list, err = fs.ReadDir(`C:\users\PUBLIC`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name() != "explorer.exe" || list[1].Name() != "setup.exe" {
+		t.Fatalf("unexpected directory %+v", list)
+	}
+	fi, err := fs.Stat("/Users/Public/Setup.EXE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(setup)) || !fi.ModTime().Equal(testDropperT) || fi.Mode() != 0444 {
+		t.Fatalf("unexpected file information %s %d %s %s", fi.Name(), fi.Size(), fi.ModTime(), fi.Mode())
+	}
+	for path, expected := range map[string][]byte{
+		"/Users/Public/explorer.exe": []byte("MZ"),
+		"/Users/Public/setup.exe":    setup,
+	} {
+		r, err := fs.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Fatalf("unexpected content of %s: %q", path, data)
+		}
+	}
+	if _, err := fs.Stat("/Users/Public/dropper.exe"); !os.IsNotExist(err) {
+		t.Fatalf("expected deleted file to be missing, got %v", err)
+	}
+	if _, err := fs.Open("/Users"); err == nil {
+		t.Fatal("expected error opening a directory")
+	}
+}
+
+func TestParseRunlist(t *testing.T) {
+	runs := parseRunlist([]byte{0x21, 0x10, 0x00, 0x01, 0x01, 0x04, 0x11, 0x08, 0xf0, 0x00})
+	expected := []dataRun{{LCN: 256, Length: 16}, {Length: 4, Sparse: true}, {LCN: 240, Length: 8}}
+	if !reflect.DeepEqual(runs, expected) {
+		t.Fatalf("expected runs %+v, got %+v", expected, runs)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migntfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	vol := buildVolume()
+	volPath := filepath.Join(dir, "volume.img")
+	mftPath := filepath.Join(dir, "$MFT")
+	usnPath := filepath.Join(dir, "$J")
+	mftStart := testMFTCluster * testClusterSize
+	for path, data := range map[string][]byte{
+		volPath: vol,
+		mftPath: vol[mftStart : mftStart+testMFTRecords*testRecordSize],
+		usnPath: append(make([]byte, 2*testClusterSize), testJournal()...),
+	} {
+		if err := ioutil.WriteFile(path, data, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type match struct {
+		record uint64
+		name   string
+	}
+	for _, tc := range []struct {
+		p       params
+		files   []match
+		changes []match
+	}{
+		{params{Volume: volPath, Names: []string{"DROPPER"}},
+			[]match{{33, `\Users\Public\dropper.exe`}},
+			[]match{{33, `\Users\Public\dropper.tmp`}, {33, `\Users\Public\dropper.tmp`}, {33, `\Users\Public\dropper.exe`}, {33, `\Users\Public\dropper.exe`}}},
+		{params{Volume: volPath, Timestomped: true}, []match{{32, `\Users\Public\explorer.exe`}}, nil},
+		{params{Volume: volPath, Deleted: true}, []match{{33, `\Users\Public\dropper.exe`}}, []match{{33, `\Users\Public\dropper.exe`}}},
+		{params{Volume: volPath, Sources: []string{"mft"}, Paths: []string{`^\?\\`}}, []match{{35, `?\notes.txt`}}, nil},
+		{params{MFTPath: mftPath, Paths: []string{`(?i)\\users\\public\\`}},
+			[]match{{32, `\Users\Public\explorer.exe`}, {33, `\Users\Public\dropper.exe`}}, nil},
+		{params{UsnPath: usnPath, Names: []string{"dropper.tmp"}},
+			nil, []match{{33, "dropper.tmp"}, {33, "dropper.tmp"}, {33, "dropper.exe"}, {33, "dropper.exe"}}},
+		{params{MFTPath: mftPath, UsnPath: usnPath, Sources: []string{"usnjrnl"}, StartDate: testDropperT.Add(90 * time.Second), EndDate: testDropperDel},
+			nil, []match{{32, `\Users\Public\explorer.exe`}, {33, `\Users\Public\dropper.exe`}}},
+		{params{Volume: volPath, Names: []string{"dropper"}, MaxMatches: 2},
+			nil, []match{{33, `\Users\Public\dropper.tmp`}, {33, `\Users\Public\dropper.tmp`}}},
+		{params{Volume: volPath, Names: []string{"mimikatz"}}, nil, nil},
+	} {
+		var r run
+		r.Parameters = tc.p
+		msg, err := modules.MakeMessage(modules.MsgClassParameters, r.Parameters, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res modules.Result
+		err = json.Unmarshal([]byte(r.Run(bytes.NewBuffer(msg))), &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Errors) > 0 {
+			t.Fatalf("%+v: unexpected errors %v", tc.p, res.Errors)
+		}
+		var el elements
+		err = res.GetElements(&el)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(el.Files) != len(tc.files) || len(el.Changes) != len(tc.changes) {
+			t.Fatalf("%+v: expected %d files and %d changes, got %+v", tc.p, len(tc.files), len(tc.changes), el)
+		}
+		for i, f := range el.Files {
+			if f.Record != tc.files[i].record || f.Path != tc.files[i].name {
+				t.Fatalf("%+v: unexpected file %+v", tc.p, f)
+			}
+		}
+		for i, c := range el.Changes {
+			name := c.Path
+			if name == "" {
+				name = c.Name
+			}
+			if c.Record != tc.changes[i].record || name != tc.changes[i].name {
+				t.Fatalf("%+v: unexpected change %+v", tc.p, c)
+			}
+		}
+		if res.FoundAnything != (len(tc.files)+len(tc.changes) > 0) {
+			t.Fatalf("%+v: unexpected foundanything", tc.p)
+		}
+	}
+
+	// the deleted dropper keeps the names it had in the journal, and the
+	// creation time of its $FILE_NAME
+	var r run
+	r.Parameters = params{Volume: volPath, Names: []string{"dropper"}}
+	msg, _ := modules.MakeMessage(modules.MsgClassParameters, r.Parameters, false)
+	var res modules.Result
+	json.Unmarshal([]byte(r.Run(bytes.NewBuffer(msg))), &res)
+	var el elements
+	res.GetElements(&el)
+	f := el.Files[0]
+	if !f.Deleted || f.Timestomped || !reflect.DeepEqual(f.PreviousNames, []string{"dropper.tmp"}) || f.Size != 3000 {
+		t.Fatalf("unexpected deleted file %+v", f)
+	}
+	if len(f.Times) != 4 || f.Times[0].Kind != modules.ArtefactTimeCreated || !f.Times[0].Time.Equal(testDropperT) {
+		t.Fatalf("unexpected file times %+v", f.Times)
+	}
+	c := el.Changes[2]
+	if !reflect.DeepEqual(c.PreviousNames, []string{"dropper.tmp"}) || c.Times[0].Kind != modules.ArtefactTimeRenamed {
+		t.Fatalf("unexpected rename %+v", c)
+	}
+	if c = el.Changes[3]; c.Times[0].Kind != modules.ArtefactTimeDeleted || !c.Times[0].Time.Equal(testDropperDel) {
+		t.Fatalf("unexpected deletion %+v", c)
+	}
+
+	// the forged times of a timestomped file are not used as artefact times
+	r = run{Parameters: params{Volume: volPath, Timestomped: true}}
+	msg, _ = modules.MakeMessage(modules.MsgClassParameters, r.Parameters, false)
+	json.Unmarshal([]byte(r.Run(bytes.NewBuffer(msg))), &res)
+	res.GetElements(&el)
+	for _, at := range el.Files[0].Times {
+		if at.Time.Equal(testStompedT) {
+			t.Fatalf("forged time in artefact times %+v", el.Files[0].Times)
+		}
+	}
+
+	for _, p := range []params{
+		{Volume: volPath},
+		{Volume: volPath, MFTPath: mftPath, Deleted: true},
+		{Volume: volPath, Deleted: true, Sources: []string{"logfile"}},
+		{Volume: volPath, Paths: []string{"("}},
+	} {
+		r := run{Parameters: p}
+		if r.ValidateParameters() == nil {
+			t.Fatalf("%+v: expected invalid parameters", p)
+		}
+	}
+}
+
+func TestRawFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migntfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hive := bytes.Repeat([]byte("regf"), 3000)
+	raw := &RawFiles{Volume: testutil.LockFiles(t, dir, map[string][]byte{
+		"Windows/System32/config/SOFTWARE": hive,
+		"Windows/System32/config/SAM":      []byte("regf"),
+	})}
+	defer raw.Close()
+	readable := filepath.Join(dir, "notes.txt")
+	if err := ioutil.WriteFile(readable, []byte("notes"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string][]byte{
+		filepath.Join(dir, "Windows", "System32", "config", "SOFTWARE"): hive,
+		filepath.Join(dir, "Windows", "System32", "config", "SAM"):      []byte("regf"),
+		readable: []byte("notes"),
+	} {
+		buf, err := raw.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, expected) {
+			t.Fatalf("unexpected content of %s: %d bytes", path, len(buf))
+		}
+	}
+	// missing files are not searched on the volume
+	if _, err := raw.ReadFile(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Fatalf("expected missing file, got %v", err)
+	}
+	// without raw volumes, the locked file cannot be read
+	var none *RawFiles
+	if _, err := none.ReadFile(filepath.Join(dir, "Windows", "System32", "config", "SAM")); err == nil {
+		t.Fatal("expected error reading a locked file without raw volumes")
+	}
+
+	for _, tc := range []struct{ path, device, name string }{
+		{`C:\Windows\System32\config\SYSTEM`, `\\.\C:`, `\Windows\System32\config\SYSTEM`},
+		{`d:/Users/Public/NTUSER.DAT`, `\\.\D:`, `/Users/Public/NTUSER.DAT`},
+		{`\\?\GLOBALROOT\Device\HarddiskVolumeShadowCopy1\Windows`, "", ""},
+		{`C:relative`, "", ""},
+		{`/etc/passwd`, "", ""},
+	} {
+		device, name, err := DriveVolume(tc.path)
+		if device != tc.device || name != tc.name || (err != nil) != (tc.device == "") {
+			t.Fatalf("%s: unexpected volume %q %q %v", tc.path, device, name, err)
+		}
+	}
+}
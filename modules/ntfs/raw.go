@@ -0,0 +1,111 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package ntfs /* import "mig.ninja/mig/modules/ntfs" */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// RawFiles reads files through the file system, and falls back to the raw
+// device of their volume, such as \\.\C:, when that fails. Windows holds
+// locks on some of the files in use, such as the registry hives, that
+// prevent reading them through the file system but not through the volume.
+// The content read from the volume is the one flushed to disk, which can lag
+// behind the content held in memory by the system.
+//
+// The MFT of each volume is read on first use, and kept until Close is
+// called. A nil RawFiles only reads through the file system.
+type RawFiles struct {
+	// Volume returns the raw device of the volume of a file, and the path
+	// of the file on that volume. It defaults to DriveVolume.
+	Volume func(path string) (device, name string, err error)
+
+	devices map[string]*rawVolume
+}
+
+// rawVolume is a raw device opened by RawFiles, or the error that prevented
+// opening it
+type rawVolume struct {
+	fd  *os.File
+	fs  *FileSystem
+	err error
+}
+
+// DriveVolume returns the raw device of the drive of an absolute Windows
+// path, such as \\.\C: for C:\Windows\System32\config\SYSTEM
+func DriveVolume(path string) (device, name string, err error) {
+	if len(path) < 3 || path[1] != ':' || (path[2] != '\\' && path[2] != '/') ||
+		!strings.ContainsRune("abcdefghijklmnopqrstuvwxyz", rune(path[0]|0x20)) {
+		return "", "", fmt.Errorf("%s is not on a local drive", path)
+	}
+	return `\\.\` + strings.ToUpper(path[:2]), path[2:], nil
+}
+
+// ReadFile reads a file through the file system, and if that fails for
+// another reason than the file not existing, through its raw volume
+func (rf *RawFiles) ReadFile(path string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err == nil || os.IsNotExist(err) || rf == nil {
+		return buf, err
+	}
+	buf, rerr := rf.ReadRaw(path)
+	if rerr != nil {
+		return nil, fmt.Errorf("%v, and reading it from its raw volume failed: %v", err, rerr)
+	}
+	return buf, nil
+}
+
+// ReadRaw reads a file through the raw device of its volume
+func (rf *RawFiles) ReadRaw(path string) ([]byte, error) {
+	volume := rf.Volume
+	if volume == nil {
+		volume = DriveVolume
+	}
+	device, name, err := volume(path)
+	if err != nil {
+		return nil, err
+	}
+	if rf.devices == nil {
+		rf.devices = make(map[string]*rawVolume)
+	}
+	v, ok := rf.devices[device]
+	if !ok {
+		v = new(rawVolume)
+		var fd *os.File
+		fd, v.err = os.Open(device)
+		if v.err == nil {
+			v.fd = fd
+			v.fs, v.err = OpenFileSystem(fd)
+		}
+		rf.devices[device] = v
+	}
+	if v.err != nil {
+		return nil, fmt.Errorf("%s: %v", device, v.err)
+	}
+	r, err := v.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// Close closes the raw devices opened to read files
+func (rf *RawFiles) Close() error {
+	if rf == nil {
+		return nil
+	}
+	for _, v := range rf.devices {
+		if v.fd != nil {
+			v.fd.Close()
+		}
+	}
+	rf.devices = nil
+	return nil
+}
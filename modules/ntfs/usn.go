@@ -0,0 +1,187 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package ntfs /* import "mig.ninja/mig/modules/ntfs" */
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"mig.ninja/mig/modules/winbin"
+)
+
+/*
+	The change journal is the $J stream of $Extend\$UsnJrnl. It is a sparse
+	stream of USN records appended by the kernel each time a file changes,
+	with the reference of the file and of its parent directory, the name of
+	the file, the time of the change and the reasons of the change. Records
+	are aligned on 8 bytes, and the space between the last record of a page
+	and the next page is filled with zeros.
+
+	Version 2 records use 64 bits file references, version 3 records use 128
+	bits references whose low 64 bits hold the NTFS record and sequence
+	numbers.
+*/
+
+const (
+	usnReasonFileCreate    = 0x00000100
+	usnReasonFileDelete    = 0x00000200
+	usnReasonRenameOldName = 0x00001000
+	usnReasonRenameNewName = 0x00002000
+
+	// size of the window of the journal read at once
+	usnBlockSize = 1 << 20
+)
+
+// usnReasons are the names of the reason flags of USN records
+var usnReasons = []struct {
+	flag uint32
+	name string
+}{
+	{0x00000001, "DATA_OVERWRITE"},
+	{0x00000002, "DATA_EXTEND"},
+	{0x00000004, "DATA_TRUNCATION"},
+	{0x00000010, "NAMED_DATA_OVERWRITE"},
+	{0x00000020, "NAMED_DATA_EXTEND"},
+	{0x00000040, "NAMED_DATA_TRUNCATION"},
+	{usnReasonFileCreate, "FILE_CREATE"},
+	{usnReasonFileDelete, "FILE_DELETE"},
+	{0x00000400, "EA_CHANGE"},
+	{0x00000800, "SECURITY_CHANGE"},
+	{usnReasonRenameOldName, "RENAME_OLD_NAME"},
+	{usnReasonRenameNewName, "RENAME_NEW_NAME"},
+	{0x00004000, "INDEXABLE_CHANGE"},
+	{0x00008000, "BASIC_INFO_CHANGE"},
+	{0x00010000, "HARD_LINK_CHANGE"},
+	{0x00020000, "COMPRESSION_CHANGE"},
+	{0x00040000, "ENCRYPTION_CHANGE"},
+	{0x00080000, "OBJECT_ID_CHANGE"},
+	{0x00100000, "REPARSE_POINT_CHANGE"},
+	{0x00200000, "STREAM_CHANGE"},
+	{0x00400000, "TRANSACTED_CHANGE"},
+	{0x00800000, "INTEGRITY_CHANGE"},
+	{0x80000000, "CLOSE"},
+}
+
+// reasonNames returns the names of the flags set in a reason
+func reasonNames(reason uint32) (names []string) {
+	for _, r := range usnReasons {
+		if reason&r.flag != 0 {
+			names = append(names, r.name)
+		}
+	}
+	return
+}
+
+// usnRecord is a decoded USN record
+type usnRecord struct {
+	USN       int64
+	Time      time.Time
+	Record    uint64
+	Sequence  uint16
+	Parent    uint64
+	ParentSeq uint16
+	Reason    uint32
+	Name      string
+}
+
+// parseUsnRecord decodes a version 2 or 3 USN record
+func parseUsnRecord(b []byte) (ur usnRecord, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("parseUsnRecord() -> %v", e)
+		}
+	}()
+	var ref, parent uint64
+	var off, nameOff int
+	switch major := winbin.Le16(b, 4); major {
+	case 2:
+		ref, parent = winbin.Le64(b, 8), winbin.Le64(b, 16)
+		off, nameOff = 24, 56
+	case 3:
+		ref, parent = winbin.Le64(b, 8), winbin.Le64(b, 24)
+		off, nameOff = 40, 72
+	default:
+		return ur, fmt.Errorf("unsupported USN record version %d", major)
+	}
+	ur.Record, ur.Sequence = ref&0xffffffffffff, uint16(ref>>48)
+	ur.Parent, ur.ParentSeq = parent&0xffffffffffff, uint16(parent>>48)
+	ur.USN = int64(winbin.Le64(b, off))
+	ur.Time = winbin.Filetime(winbin.Le64(b, off+8))
+	ur.Reason = winbin.Le32(b, off+16)
+	ur.Name = winbin.UTF16String(winbin.Slice(b, int(winbin.Le16(b, nameOff+2)), int(winbin.Le16(b, nameOff))))
+	return
+}
+
+// readJournal calls fn for each record of the change journal, starting at
+// offset start. Invalid records are reported to fn with their error, and
+// the journal is read again from the next 8 bytes boundary. fn returns
+// false to stop reading.
+func readJournal(r io.ReaderAt, start, size int64, fn func(ur usnRecord, err error) bool) error {
+	var (
+		buf      []byte
+		bufStart int64
+	)
+	// window returns n bytes of the journal at off, reading a new block
+	// when they are not in the current one
+	window := func(off int64, n int) ([]byte, error) {
+		if off >= bufStart && off+int64(n) <= bufStart+int64(len(buf)) {
+			return buf[off-bufStart : off-bufStart+int64(n)], nil
+		}
+		blockSize := usnBlockSize
+		if n > blockSize {
+			blockSize = n
+		}
+		buf = make([]byte, blockSize)
+		read, err := r.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		buf, bufStart = buf[:read], off
+		if read < n {
+			return nil, io.EOF
+		}
+		return buf[:n], nil
+	}
+	for off := start; off+8 <= size; {
+		hdr, err := window(off, 8)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		length := int(winbin.Le32(hdr, 0))
+		if length == 0 {
+			// padding up to the next page, or a sparse area
+			off += 8
+			continue
+		}
+		if length < 60 || length%8 != 0 || off+int64(length) > size {
+			if !fn(usnRecord{}, fmt.Errorf("invalid USN record length %d at offset %d", length, off)) {
+				return nil
+			}
+			off += 8
+			continue
+		}
+		rec, err := window(off, length)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		ur, err := parseUsnRecord(rec)
+		if !fn(ur, err) {
+			return nil
+		}
+		if err != nil {
+			off += 8
+		} else {
+			off += int64(length)
+		}
+	}
+	return nil
+}
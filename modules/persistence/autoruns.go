@@ -0,0 +1,371 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package persistence /* import "mig.ninja/mig/modules/persistence" */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"mig.ninja/mig/modules/registry"
+)
+
+// runKeys are the keys of the SOFTWARE and NTUSER.DAT hives whose values
+// are started at logon
+var runKeys = []string{
+	`Microsoft\Windows\CurrentVersion\Run`,
+	`Microsoft\Windows\CurrentVersion\RunOnce`,
+	`Microsoft\Windows\CurrentVersion\RunServices`,
+	`Microsoft\Windows\CurrentVersion\RunServicesOnce`,
+	`Microsoft\Windows\CurrentVersion\Policies\Explorer\Run`,
+	`Wow6432Node\Microsoft\Windows\CurrentVersion\Run`,
+	`Wow6432Node\Microsoft\Windows\CurrentVersion\RunOnce`,
+}
+
+// winlogonValues are the values of the Winlogon key that start programs
+var winlogonValues = []string{"Shell", "Userinit", "Taskman", "AppSetup"}
+
+var serviceStart = map[int64]string{0: "boot", 1: "system", 2: "auto", 3: "demand", 4: "disabled"}
+
+var serviceType = map[int64]string{
+	0x01: "kernel driver",
+	0x02: "file system driver",
+	0x10: "own process",
+	0x20: "share process",
+	0x50: "user own process",
+	0x60: "user share process",
+}
+
+// services lists the services and drivers of the current control set of
+// the SYSTEM hive
+func (c *collector) services() (entries []Entry, err error) {
+	hive, err := c.hive("SYSTEM")
+	if err != nil {
+		return nil, err
+	}
+	root, err := hive.Root()
+	if err != nil {
+		return nil, err
+	}
+	controlSet := "ControlSet001"
+	if sel, err := subkey(root, "Select"); err == nil {
+		if v, ok := value(sel, "Current"); ok && len(v.Data) >= 4 {
+			controlSet = fmt.Sprintf("ControlSet%03d", binary.LittleEndian.Uint32(v.Data))
+		}
+	}
+	services, err := subkey(root, controlSet, "Services")
+	if err != nil {
+		return nil, err
+	}
+	keys, err := services.Subkeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		e := Entry{
+			Location:  "services",
+			Source:    `SYSTEM\` + k.Path,
+			Name:      k.Name,
+			LastWrite: k.LastWrite,
+			Details:   make(map[string]string),
+		}
+		if v, ok := value(k, "ImagePath"); ok {
+			e.CommandLine = v.String()
+		}
+		if v, ok := value(k, "Start"); ok {
+			e.Details["start"] = lookup(serviceStart, integer(v))
+		}
+		if v, ok := value(k, "Type"); ok {
+			e.Details["type"] = lookup(serviceType, integer(v))
+		}
+		if v, ok := value(k, "ObjectName"); ok {
+			e.Details["account"] = v.String()
+		}
+		// services hosted by svchost load the DLL of their parameters
+		dll := ""
+		if params, err := subkey(k, "Parameters"); err == nil {
+			if v, ok := value(params, "ServiceDll"); ok {
+				dll = v.String()
+				e.Details["servicedll"] = dll
+			}
+		}
+		if e.CommandLine == "" && dll == "" {
+			continue
+		}
+		if dll != "" {
+			e.BinaryPath = c.normalizePath(c.expandEnv(dll, ""))
+		} else {
+			e.BinaryPath = c.binaryPath(e.CommandLine, "")
+		}
+		entries = append(entries, e)
+	}
+	return
+}
+
+// runEntries lists the values of the Run keys of the SOFTWARE hive and of
+// the hives of the users
+func (c *collector) runEntries() (entries []Entry, err error) {
+	err = c.eachHive(func(name, user string, root *registry.Key) {
+		for _, path := range runKeys {
+			if user != "" {
+				if strings.HasPrefix(path, "Wow6432Node") {
+					continue
+				}
+				path = `Software\` + path
+			}
+			k, err := subkey(root, strings.Split(path, `\`)...)
+			if err != nil {
+				continue
+			}
+			values, err := k.Values()
+			if err != nil {
+				c.errors = append(c.errors, fmt.Sprintf("%s\\%s: %v", name, k.Path, err))
+				continue
+			}
+			for _, v := range values {
+				cmd := v.String()
+				if cmd == "" {
+					continue
+				}
+				entries = append(entries, Entry{
+					Location:    "run",
+					Source:      name + `\` + k.Path,
+					Name:        v.Name,
+					CommandLine: cmd,
+					BinaryPath:  c.binaryPath(cmd, user),
+					LastWrite:   k.LastWrite,
+				})
+			}
+		}
+	})
+	return
+}
+
+// winlogon lists the programs started by Winlogon, and the notification
+// packages it loads
+func (c *collector) winlogon() (entries []Entry, err error) {
+	err = c.eachHive(func(name, user string, root *registry.Key) {
+		path := []string{"Microsoft", "Windows NT", "CurrentVersion", "Winlogon"}
+		if user != "" {
+			path = append([]string{"Software"}, path...)
+		}
+		k, err := subkey(root, path...)
+		if err != nil {
+			return
+		}
+		for _, vname := range winlogonValues {
+			v, ok := value(k, vname)
+			if !ok || v.String() == "" {
+				continue
+			}
+			// Userinit is a comma separated list of programs
+			for _, cmd := range strings.Split(v.String(), ",") {
+				cmd = strings.TrimSpace(cmd)
+				if cmd == "" {
+					continue
+				}
+				entries = append(entries, Entry{
+					Location:    "winlogon",
+					Source:      name + `\` + k.Path,
+					Name:        v.Name,
+					CommandLine: cmd,
+					BinaryPath:  c.binaryPath(cmd, user),
+					LastWrite:   k.LastWrite,
+				})
+			}
+		}
+		notify, err := subkey(k, "Notify")
+		if err != nil {
+			return
+		}
+		packages, _ := notify.Subkeys()
+		for _, p := range packages {
+			if v, ok := value(p, "DllName"); ok {
+				entries = append(entries, Entry{
+					Location:    "winlogon",
+					Source:      name + `\` + p.Path,
+					Name:        p.Name,
+					CommandLine: v.String(),
+					BinaryPath:  c.binaryPath(v.String(), user),
+					LastWrite:   p.LastWrite,
+				})
+			}
+		}
+	})
+	return
+}
+
+// ifeo lists the debuggers of Image File Execution Options, started in
+// place of the program they are set for, and the monitor processes of
+// SilentProcessExit, started when the program exits
+func (c *collector) ifeo() (entries []Entry, err error) {
+	hive, err := c.hive("SOFTWARE")
+	if err != nil {
+		return nil, err
+	}
+	root, err := hive.Root()
+	if err != nil {
+		return nil, err
+	}
+	for _, loc := range []struct {
+		path  string
+		value string
+	}{
+		{`Microsoft\Windows NT\CurrentVersion\Image File Execution Options`, "Debugger"},
+		{`Wow6432Node\Microsoft\Windows NT\CurrentVersion\Image File Execution Options`, "Debugger"},
+		{`Microsoft\Windows NT\CurrentVersion\SilentProcessExit`, "MonitorProcess"},
+	} {
+		k, err := subkey(root, strings.Split(loc.path, `\`)...)
+		if err != nil {
+			continue
+		}
+		programs, err := k.Subkeys()
+		if err != nil {
+			c.errors = append(c.errors, fmt.Sprintf("SOFTWARE\\%s: %v", k.Path, err))
+			continue
+		}
+		for _, p := range programs {
+			v, ok := value(p, loc.value)
+			if !ok || v.String() == "" {
+				continue
+			}
+			entries = append(entries, Entry{
+				Location:    "ifeo",
+				Source:      `SOFTWARE\` + p.Path,
+				Name:        p.Name,
+				CommandLine: v.String(),
+				BinaryPath:  c.binaryPath(v.String(), ""),
+				LastWrite:   p.LastWrite,
+				Details:     map[string]string{"value": loc.value},
+			})
+		}
+	}
+	return
+}
+
+// clsidServer returns the in-process server of a COM class, used to find
+// the DLL run by the COM handler of a scheduled task
+func (c *collector) clsidServer(clsid string) string {
+	hive, err := c.hive("SOFTWARE")
+	if err != nil {
+		return ""
+	}
+	root, err := hive.Root()
+	if err != nil {
+		return ""
+	}
+	k, err := subkey(root, "Classes", "CLSID", clsid, "InprocServer32")
+	if err != nil {
+		return ""
+	}
+	v, ok := value(k, "")
+	if !ok {
+		return ""
+	}
+	return v.String()
+}
+
+// eachHive calls fn with the root key of the SOFTWARE hive, and of the
+// NTUSER.DAT hive of each user
+func (c *collector) eachHive(fn func(name, user string, root *registry.Key)) error {
+	hive, err := c.hive("SOFTWARE")
+	if err != nil {
+		return err
+	}
+	root, err := hive.Root()
+	if err != nil {
+		return err
+	}
+	fn("SOFTWARE", "", root)
+	for _, user := range c.users() {
+		path, ok := findPath(c.root, "Users", user, "NTUSER.DAT")
+		if !ok {
+			continue
+		}
+		hive, err := registry.OpenHive(path, "NTUSER.DAT", c.raw)
+		if err != nil {
+			c.errors = append(c.errors, fmt.Sprintf("%s: %v", path, err))
+			continue
+		}
+		root, err := hive.Root()
+		if err != nil {
+			c.errors = append(c.errors, fmt.Sprintf("%s: %v", path, err))
+			continue
+		}
+		fn(fmt.Sprintf("NTUSER.DAT(%s)", user), user, root)
+	}
+	return nil
+}
+
+// hive opens a hive of the system, and keeps it for the other locations
+func (c *collector) hive(name string) (*registry.Hive, error) {
+	if h, ok := c.hives[name]; ok {
+		return h, nil
+	}
+	path, ok := findPath(c.root, "Windows", "System32", "config", name)
+	if !ok {
+		return nil, fmt.Errorf("%s hive not found under %s", name, c.root)
+	}
+	h, err := registry.OpenHive(path, name, c.raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	c.hives[name] = h
+	return h, nil
+}
+
+// subkey follows a path of subkey names from a key, ignoring case
+func subkey(k *registry.Key, path ...string) (*registry.Key, error) {
+	for _, name := range path {
+		keys, err := k.Subkeys()
+		if err != nil {
+			return nil, err
+		}
+		var next *registry.Key
+		for _, sk := range keys {
+			if strings.EqualFold(sk.Name, name) {
+				next = sk
+				break
+			}
+		}
+		if next == nil {
+			return nil, fmt.Errorf("subkey: no key %s in %q", name, k.Path)
+		}
+		k = next
+	}
+	return k, nil
+}
+
+// value returns the value of a key with the given name, ignoring case. The
+// default value of a key has an empty name.
+func value(k *registry.Key, name string) (registry.Value, bool) {
+	values, _ := k.Values()
+	for _, v := range values {
+		if strings.EqualFold(v.Name, name) {
+			return v, true
+		}
+	}
+	return registry.Value{}, false
+}
+
+// integer returns the value of a DWORD or QWORD value
+func integer(v registry.Value) int64 {
+	switch {
+	case v.Type == registry.RegQword && len(v.Data) >= 8:
+		return int64(binary.LittleEndian.Uint64(v.Data))
+	case v.Type == registry.RegDword && len(v.Data) >= 4:
+		return int64(binary.LittleEndian.Uint32(v.Data))
+	}
+	return -1
+}
+
+func lookup(names map[int64]string, v int64) string {
+	if name, ok := names[v]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", v)
+}
@@ -0,0 +1,308 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package persistence /* import "mig.ninja/mig/modules/persistence" */
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"debug/pe"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// executableExt matches the extensions of the files that can be started by
+// a command line
+var executableExt = regexp.MustCompile(`(?i)\.(exe|dll|sys|com|bat|cmd|ps1|vbs|vbe|js|jse|wsf|hta|scr|cpl|ocx|msi|lnk)$`)
+
+// envVar matches an environment variable in a command line
+var envVar = regexp.MustCompile(`%([^%\s]+)%`)
+
+// expandEnv replaces the environment variables of a command line with
+// their default value on the host, using the profile of user for the
+// variables of a user. Unknown variables are left untouched.
+func (c *collector) expandEnv(s, user string) string {
+	return envVar.ReplaceAllStringFunc(s, func(v string) string {
+		name := strings.ToUpper(v[1 : len(v)-1])
+		profile := c.drive + `\Users\` + user
+		switch name {
+		case "SYSTEMROOT", "WINDIR":
+			return c.drive + `\Windows`
+		case "SYSTEMDRIVE":
+			return c.drive
+		case "PROGRAMFILES", "PROGRAMW6432":
+			return c.drive + `\Program Files`
+		case "PROGRAMFILES(X86)":
+			return c.drive + `\Program Files (x86)`
+		case "COMMONPROGRAMFILES":
+			return c.drive + `\Program Files\Common Files`
+		case "PROGRAMDATA", "ALLUSERSPROFILE":
+			return c.drive + `\ProgramData`
+		case "PUBLIC":
+			return c.drive + `\Users\Public`
+		case "USERPROFILE":
+			if user != "" {
+				return profile
+			}
+		case "APPDATA":
+			if user != "" {
+				return profile + `\AppData\Roaming`
+			}
+		case "LOCALAPPDATA":
+			if user != "" {
+				return profile + `\AppData\Local`
+			}
+		case "TEMP", "TMP":
+			if user != "" {
+				return profile + `\AppData\Local\Temp`
+			}
+			return c.drive + `\Windows\Temp`
+		}
+		return v
+	})
+}
+
+// binaryPath extracts the path of the program started by a command line,
+// as a Windows path. The DLL loaded by rundll32 is returned instead of
+// rundll32 itself.
+func (c *collector) binaryPath(cmdline, user string) string {
+	s := strings.TrimSpace(c.expandEnv(cmdline, user))
+	var path, args string
+	if strings.HasPrefix(s, `"`) {
+		end := strings.Index(s[1:], `"`)
+		if end < 0 {
+			path = s[1:]
+		} else {
+			path, args = s[1:end+1], strings.TrimSpace(s[end+2:])
+		}
+	} else {
+		// unquoted paths may contain spaces, the path is the shortest
+		// prefix ending with an executable extension
+		fields := strings.Fields(s)
+		for i := range fields {
+			if executableExt.MatchString(fields[i]) {
+				path = strings.Join(fields[:i+1], " ")
+				args = strings.Join(fields[i+1:], " ")
+				break
+			}
+		}
+		if path == "" && len(fields) > 0 {
+			path, args = fields[0], strings.Join(fields[1:], " ")
+		}
+	}
+	path = c.normalizePath(path)
+	if strings.EqualFold(filepath.Base(strings.Replace(path, `\`, "/", -1)), "rundll32.exe") && args != "" {
+		dll := strings.Trim(strings.SplitN(args, ",", 2)[0], `" `)
+		if dll != "" {
+			return c.normalizePath(dll)
+		}
+	}
+	return path
+}
+
+// normalizePath converts the kernel and relative forms of a path found in
+// the registry into a path starting with the system drive. Programs without
+// a directory are searched in System32.
+func (c *collector) normalizePath(path string) string {
+	path = strings.TrimPrefix(path, `\??\`)
+	lower := strings.ToLower(path)
+	switch {
+	case path == "":
+		return ""
+	case strings.HasPrefix(lower, `\systemroot\`):
+		return c.drive + `\Windows` + path[len(`\systemroot`):]
+	case strings.HasPrefix(lower, `system32\`), strings.HasPrefix(lower, `syswow64\`):
+		return c.drive + `\Windows\` + path
+	case !strings.Contains(path, `\`):
+		return c.drive + `\Windows\System32\` + path
+	}
+	return path
+}
+
+// hostPath returns the location under the root of a Windows path of the
+// system drive, or an empty string for other drives
+func (c *collector) hostPath(path string) string {
+	if len(path) < 3 || path[1] != ':' || path[2] != '\\' || !strings.EqualFold(path[:2], c.drive) {
+		return ""
+	}
+	p, ok := findPath(c.root, strings.Split(strings.Trim(path[3:], `\`), `\`)...)
+	if !ok {
+		return ""
+	}
+	return p
+}
+
+// findPath joins path elements to a root, ignoring the case of the
+// elements that are not found as is, as images mounted on Linux are case
+// sensitive
+func findPath(root string, elems ...string) (string, bool) {
+	p := root
+	for _, e := range elems {
+		if e == "" {
+			continue
+		}
+		next := filepath.Join(p, e)
+		if _, err := os.Lstat(next); err != nil {
+			entries, err := ioutil.ReadDir(p)
+			if err != nil {
+				return "", false
+			}
+			found := false
+			for _, fi := range entries {
+				if strings.EqualFold(fi.Name(), e) {
+					next, found = filepath.Join(p, fi.Name()), true
+					break
+				}
+			}
+			if !found {
+				return "", false
+			}
+		}
+		p = next
+	}
+	return p, true
+}
+
+// inspectBinary sets the SHA256 and the embedded signer of the binary of an
+// entry, when the binary is found on the host
+func (c *collector) inspectBinary(e *Entry, stats *statistics) {
+	path := c.hostPath(e.BinaryPath)
+	if path == "" {
+		return
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fd); err != nil {
+		return
+	}
+	e.SHA256 = fmt.Sprintf("%x", h.Sum(nil))
+	stats.BinariesHashed++
+	if signer, err := peSigner(fd); err == nil {
+		e.EmbeddedSigner = signer
+	}
+}
+
+/*
+	An Authenticode signature is a PKCS#7 SignedData structure, stored in
+	a WIN_CERTIFICATE at the file offset given by the security entry of the
+	data directories of a PE file. The signer is the subject of the
+	certificate identified by the issuer and serial number of the signer
+	info. Neither the signature nor the digest of the file it covers are
+	verified: a signature copied from another binary gives its signer, which
+	is why the embedded signer is not trusted to allow entries. Binaries
+	signed by a catalog, as most Windows binaries are, have no embedded
+	signature.
+*/
+
+const (
+	peSecurityDirectory = 4
+	winCertTypePKCS     = 2
+)
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue     `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue     `asn1:"optional,tag:1"`
+	SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+}
+
+type pkcs7SignerInfo struct {
+	Version         int
+	IssuerAndSerial pkcs7IssuerAndSerial
+	DigestAlgorithm asn1.RawValue
+	AuthAttributes  asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncAlg    asn1.RawValue
+	EncryptedDigest []byte
+	UnauthAttrs     asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+// peSigner returns the common name of the signer of the unverified signature
+// embedded in a PE file
+func peSigner(r io.ReaderAt) (string, error) {
+	f, err := pe.NewFile(r)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var dir pe.DataDirectory
+	switch oh := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		if oh.NumberOfRvaAndSizes > peSecurityDirectory {
+			dir = oh.DataDirectory[peSecurityDirectory]
+		}
+	case *pe.OptionalHeader64:
+		if oh.NumberOfRvaAndSizes > peSecurityDirectory {
+			dir = oh.DataDirectory[peSecurityDirectory]
+		}
+	}
+	if dir.VirtualAddress == 0 || dir.Size < 8 || dir.Size > 1<<24 {
+		return "", fmt.Errorf("no embedded signature")
+	}
+	// the address of the security directory is a file offset
+	cert := make([]byte, dir.Size)
+	if _, err := r.ReadAt(cert, int64(dir.VirtualAddress)); err != nil {
+		return "", err
+	}
+	length := binary.LittleEndian.Uint32(cert)
+	if binary.LittleEndian.Uint16(cert[6:]) != winCertTypePKCS || length < 8 || length > dir.Size {
+		return "", fmt.Errorf("unsupported certificate type")
+	}
+	return pkcs7Signer(cert[8:length])
+}
+
+// pkcs7Signer returns the common name of the signer of a PKCS#7 SignedData
+func pkcs7Signer(der []byte) (string, error) {
+	var ci pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return "", err
+	}
+	var sd pkcs7SignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return "", err
+	}
+	if len(sd.SignerInfos) == 0 {
+		return "", fmt.Errorf("no signer info")
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return "", err
+	}
+	si := sd.SignerInfos[0].IssuerAndSerial
+	for _, cert := range certs {
+		if bytes.Equal(cert.RawIssuer, si.Issuer.FullBytes) && cert.SerialNumber.Cmp(si.Serial) == 0 {
+			if cert.Subject.CommonName != "" {
+				return cert.Subject.CommonName, nil
+			}
+			return cert.Subject.String(), nil
+		}
+	}
+	return "", fmt.Errorf("signer certificate not found")
+}
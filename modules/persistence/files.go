@@ -0,0 +1,294 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package persistence /* import "mig.ninja/mig/modules/persistence" */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+
+	"mig.ninja/mig/modules/lnk"
+)
+
+/*
+	Scheduled tasks are registered as XML files under System32\Tasks, in
+	directories matching the folders of the Task Scheduler. The files are
+	usually encoded in UTF-16 with a byte order mark. A task runs one or
+	more actions: Exec actions start a program with arguments, ComHandler
+	actions load a COM class, resolved to its DLL from the SOFTWARE hive.
+*/
+
+type taskXML struct {
+	RegistrationInfo struct {
+		Author string `xml:"Author"`
+		Date   string `xml:"Date"`
+	} `xml:"RegistrationInfo"`
+	Triggers struct {
+		Triggers []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"Triggers"`
+	Principals struct {
+		Principal []struct {
+			UserID   string `xml:"UserId"`
+			GroupID  string `xml:"GroupId"`
+			RunLevel string `xml:"RunLevel"`
+		} `xml:"Principal"`
+	} `xml:"Principals"`
+	Settings struct {
+		Enabled string `xml:"Enabled"`
+		Hidden  string `xml:"Hidden"`
+	} `xml:"Settings"`
+	Actions struct {
+		Exec []struct {
+			Command   string `xml:"Command"`
+			Arguments string `xml:"Arguments"`
+		} `xml:"Exec"`
+		ComHandler []struct {
+			ClassID string `xml:"ClassId"`
+			Data    string `xml:"Data"`
+		} `xml:"ComHandler"`
+	} `xml:"Actions"`
+}
+
+// parseTask decodes the XML definition of a scheduled task, and returns an
+// entry for each of its actions
+func (c *collector) parseTask(data []byte, name string) (entries []Entry, err error) {
+	var task taskXML
+	dec := xml.NewDecoder(bytes.NewReader(decodeText(data)))
+	// the content is converted to UTF-8, whatever the declared encoding
+	dec.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	if err = dec.Decode(&task); err != nil {
+		return nil, fmt.Errorf("parseTask: %v", err)
+	}
+	details := make(map[string]string)
+	if task.RegistrationInfo.Author != "" {
+		details["author"] = task.RegistrationInfo.Author
+	}
+	if task.RegistrationInfo.Date != "" {
+		details["registered"] = task.RegistrationInfo.Date
+	}
+	var triggers []string
+	for _, t := range task.Triggers.Triggers {
+		triggers = append(triggers, t.XMLName.Local)
+	}
+	if len(triggers) > 0 {
+		details["triggers"] = strings.Join(triggers, ", ")
+	}
+	for _, p := range task.Principals.Principal {
+		if p.UserID != "" {
+			details["user"] = p.UserID
+		} else if p.GroupID != "" {
+			details["user"] = p.GroupID
+		}
+		if p.RunLevel != "" {
+			details["runlevel"] = p.RunLevel
+		}
+	}
+	if strings.EqualFold(task.Settings.Enabled, "false") {
+		details["enabled"] = "false"
+	}
+	if strings.EqualFold(task.Settings.Hidden, "true") {
+		details["hidden"] = "true"
+	}
+	for _, a := range task.Actions.Exec {
+		cmd := strings.TrimSpace(a.Command)
+		if a.Arguments != "" {
+			cmd += " " + strings.TrimSpace(a.Arguments)
+		}
+		command := strings.TrimSpace(a.Command)
+		if !strings.HasPrefix(command, `"`) && strings.Contains(command, " ") {
+			command = `"` + command + `"`
+		}
+		entries = append(entries, Entry{
+			Location:    "tasks",
+			Name:        name,
+			CommandLine: cmd,
+			BinaryPath:  c.binaryPath(command+" "+a.Arguments, ""),
+			Details:     copyDetails(details),
+		})
+	}
+	for _, h := range task.Actions.ComHandler {
+		e := Entry{
+			Location:    "tasks",
+			Name:        name,
+			CommandLine: h.ClassID,
+			Details:     copyDetails(details),
+		}
+		e.Details["classid"] = h.ClassID
+		if h.Data != "" {
+			e.Details["data"] = h.Data
+		}
+		if dll := c.clsidServer(h.ClassID); dll != "" {
+			e.BinaryPath = c.normalizePath(c.expandEnv(dll, ""))
+		}
+		entries = append(entries, e)
+	}
+	return
+}
+
+// tasks lists the actions of the scheduled tasks
+func (c *collector) tasks() (entries []Entry, err error) {
+	dir, ok := findPath(c.root, "Windows", "System32", "Tasks")
+	if !ok {
+		return nil, fmt.Errorf("tasks directory not found under %s", c.root)
+	}
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			c.errors = append(c.errors, err.Error())
+			return nil
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			c.errors = append(c.errors, err.Error())
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, path)
+		name := `\` + strings.Replace(rel, string(filepath.Separator), `\`, -1)
+		actions, err := c.parseTask(data, name)
+		if err != nil {
+			c.errors = append(c.errors, fmt.Sprintf("%s: %v", path, err))
+			return nil
+		}
+		for _, e := range actions {
+			e.Source = path
+			e.LastWrite = fi.ModTime().UTC()
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	return
+}
+
+// startupFolders lists the files of the Startup folders of all users and
+// of each user
+func (c *collector) startupFolders() (entries []Entry, err error) {
+	startup := []string{"Microsoft", "Windows", "Start Menu", "Programs", "Startup"}
+	type folder struct {
+		path string
+		user string
+	}
+	var folders []folder
+	if p, ok := findPath(c.root, append([]string{"ProgramData"}, startup...)...); ok {
+		folders = append(folders, folder{p, ""})
+	}
+	for _, user := range c.users() {
+		if p, ok := findPath(c.root, append([]string{"Users", user, "AppData", "Roaming"}, startup...)...); ok {
+			folders = append(folders, folder{p, user})
+		}
+	}
+	for _, f := range folders {
+		files, err := ioutil.ReadDir(f.path)
+		if err != nil {
+			c.errors = append(c.errors, err.Error())
+			continue
+		}
+		for _, fi := range files {
+			if fi.IsDir() || strings.EqualFold(fi.Name(), "desktop.ini") {
+				continue
+			}
+			// the files are given their Windows path, to be hashed like the
+			// binaries of the other locations
+			win := c.drive + `\ProgramData\` + strings.Join(startup, `\`) + `\` + fi.Name()
+			if f.user != "" {
+				win = c.drive + `\Users\` + f.user + `\AppData\Roaming\` + strings.Join(startup, `\`) + `\` + fi.Name()
+			}
+			e := Entry{
+				Location:    "startup",
+				Source:      f.path,
+				Name:        fi.Name(),
+				CommandLine: win,
+				BinaryPath:  win,
+				LastWrite:   fi.ModTime().UTC(),
+			}
+			// links are replaced by their target
+			if strings.EqualFold(filepath.Ext(fi.Name()), ".lnk") {
+				c.resolveLink(&e, filepath.Join(f.path, fi.Name()), f.user)
+			}
+			entries = append(entries, e)
+		}
+	}
+	return
+}
+
+// resolveLink sets the command line and the binary of a Startup entry to
+// the target of its link
+func (c *collector) resolveLink(e *Entry, path, user string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		c.errors = append(c.errors, err.Error())
+		return
+	}
+	l, err := lnk.ParseShellLink(data)
+	if err != nil {
+		c.errors = append(c.errors, fmt.Sprintf("%s: %v", path, err))
+		return
+	}
+	if l.TargetPath == "" {
+		return
+	}
+	e.Details = map[string]string{"link": e.BinaryPath}
+	e.CommandLine = strings.TrimSpace(l.TargetPath + " " + l.Arguments)
+	e.BinaryPath = c.normalizePath(c.expandEnv(l.TargetPath, user))
+}
+
+// users returns the names of the user profiles under the root
+func (c *collector) users() (users []string) {
+	dir, ok := findPath(c.root, "Users")
+	if !ok {
+		return
+	}
+	profiles, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range profiles {
+		if fi.IsDir() {
+			users = append(users, fi.Name())
+		}
+	}
+	return
+}
+
+// decodeText converts UTF-16 text with a byte order mark to UTF-8, and
+// strips the byte order mark of UTF-8 text
+func decodeText(data []byte) []byte {
+	var order binary.ByteOrder
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xfe}):
+		order = binary.LittleEndian
+	case bytes.HasPrefix(data, []byte{0xfe, 0xff}):
+		order = binary.BigEndian
+	default:
+		return bytes.TrimPrefix(data, []byte{0xef, 0xbb, 0xbf})
+	}
+	u := make([]uint16, (len(data)-2)/2)
+	for i := range u {
+		u[i] = order.Uint16(data[2+i*2:])
+	}
+	return []byte(string(utf16.Decode(u)))
+}
+
+func copyDetails(details map[string]string) map[string]string {
+	c := make(map[string]string, len(details))
+	for k, v := range details {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,527 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+/*
+
+If you run it, it will return a JSON struct with an array of the autostart
+entries of the system. If you add flag `-p`, it will pretty print the
+results.
+
+Every location is returned in the same format: the location, the key or
+file the entry was read from, its name, its command line, the path, SHA256
+and embedded signer of the binary it starts, and the last write time of its
+key or file. The locations are:
+- services: services and drivers of the current control set
+- run: Run, RunOnce and RunServices keys of the system and of each user
+- winlogon: Shell, Userinit, Taskman and AppSetup values, and Notify packages
+- ifeo: Image File Execution Options debuggers and SilentProcessExit monitors
+- tasks: actions of the scheduled tasks under System32\Tasks
+- wmi: event consumers bound to event filters in the CIM repository
+- startup: files of the Startup folders, links being resolved to their target
+
+Hives, tasks and the CIM repository are read from disk, so `root` can point
+to a volume shadow copy or a mounted image, as with the registry module. On
+a live system, the hives and the CIM repository locked by Windows are read
+from the raw NTFS volume instead.
+
+Entries matching a rule of the allowlist are dropped, and entries matching
+a rule of the denylist are flagged as denied. The fields of a rule are case
+insensitive regular expressions, and all the fields set must match.
+
+The embedded signer is the subject of the certificate embedded in the
+Authenticode signature of a binary. The signature is not verified, so any
+binary can claim any signer by copying the signature of another one, and
+the embedded signer is only accepted in the rules of the denylist.
+
+Example JSON
+-------------
+
+{
+    "module": "persistence",
+    "parameters": {
+        "locations": [
+            "run",
+            "services",
+            "wmi"
+        ],
+        "allowlist": [
+            {
+                "location": "services",
+                "binarypath": "^c:\\\\windows\\\\system32\\\\"
+            }
+        ],
+        "denylist": [
+            {
+                "binarypath": "\\\\(users|programdata|temp)\\\\"
+            },
+            {
+                "location": "wmi"
+            }
+        ]
+    }
+}
+*/
+package persistence /* import "mig.ninja/mig/modules/persistence" */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mig.ninja/mig/modules"
+	"mig.ninja/mig/modules/ntfs"
+	"mig.ninja/mig/modules/registry"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	An instance of this type will represent this module; it's possible to add additional data fields here,
+	although that is rarely needed.
+*/
+type module struct {
+}
+
+func (m *module) NewRun() modules.Runner {
+	return new(run)
+}
+
+/*
+	init is called by the Go runtime at startup. We use this function to register the module in a
+	global array of available modules, so the agent knows we exist
+*/
+func init() {
+	modules.Register("persistence", new(module))
+}
+
+type run struct {
+	Parameters params
+	Results    modules.Result
+	stop       chan bool      // closed when the module is asked to stop early
+	raw        *ntfs.RawFiles // reads the locked files from their volume
+}
+
+/*
+	- Root: Alternate root of the system volume, such as a shadow copy or a
+			mounted image. Defaults to %SYSTEMDRIVE%
+	- Locations: Autostart locations to list, all of them if empty
+	- Allowlist: Rules of the entries to drop
+	- Denylist: Rules of the entries to flag
+	- DeniedOnly: Only return the entries matching the denylist
+*/
+type params struct {
+	Root       string   `json:"root,omitempty"`
+	Locations  []string `json:"locations,omitempty"`
+	Allowlist  []Rule   `json:"allowlist,omitempty"`
+	Denylist   []Rule   `json:"denylist,omitempty"`
+	DeniedOnly bool     `json:"deniedonly,omitempty"`
+	Debug      bool     `json:"debug,omitempty"`
+}
+
+// Rule matches entries by their fields, all the fields set must match.
+// SHA256 is compared as is, the other fields are case insensitive regular
+// expressions.
+type Rule struct {
+	Location    string `json:"location,omitempty"`
+	Name        string `json:"name,omitempty"`
+	CommandLine string `json:"commandline,omitempty"`
+	BinaryPath  string `json:"binarypath,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+
+	// EmbeddedSigner is unverified, and only accepted in the denylist
+	EmbeddedSigner string `json:"embeddedsigner,omitempty"`
+}
+
+/*
+	Entry is an autostart entry. BinaryPath is the Windows path of the
+	program started by the command line, SHA256 and EmbeddedSigner are set
+	when the binary is found under the root. Details hold the properties
+	specific to a location, such as the start type of a service or the
+	triggers of a task. Denied is set for entries matching the denylist.
+*/
+type Entry struct {
+	Location       string                 `json:"location"`
+	Source         string                 `json:"source"`
+	Name           string                 `json:"name"`
+	CommandLine    string                 `json:"commandline,omitempty"`
+	BinaryPath     string                 `json:"binarypath,omitempty"`
+	SHA256         string                 `json:"sha256,omitempty"`
+	EmbeddedSigner string                 `json:"embeddedsigner,omitempty"`
+	LastWrite      time.Time              `json:"lastwrite"`
+	Details        map[string]string      `json:"details,omitempty"`
+	Denied         bool                   `json:"denied,omitempty"`
+	Times          []modules.ArtefactTime `json:"times,omitempty"`
+}
+
+type elements struct {
+	Entries []Entry `json:"persistenceresults,omitempty"`
+}
+
+/* Statistic counters:
+- EntriesFound is the number of entries found in the locations
+- Allowlisted is the number of entries dropped by the allowlist
+- Denied is the number of entries matching the denylist
+- BinariesHashed is the number of binaries found and hashed
+- Exectime is the total runtime of the sweep
+*/
+type statistics struct {
+	EntriesFound   int           `json:"entriesfound"`
+	Allowlisted    int           `json:"allowlisted"`
+	Denied         int           `json:"denied"`
+	BinariesHashed int           `json:"binarieshashed"`
+	Exectime       time.Duration `json:"exectime"`
+}
+
+// locations are the autostart locations, in the order they are listed
+var locations = []struct {
+	name string
+	list func(c *collector) ([]Entry, error)
+}{
+	{"services", (*collector).services},
+	{"run", (*collector).runEntries},
+	{"winlogon", (*collector).winlogon},
+	{"ifeo", (*collector).ifeo},
+	{"tasks", (*collector).tasks},
+	{"wmi", (*collector).wmi},
+	{"startup", (*collector).startupFolders},
+}
+
+/*
+	ValidateParameters *must* be implemented by a module. It provides a method to verify that the parameters
+	passed to the module conform the expected format. It must return an error if the parameters do not validate.
+*/
+func (r *run) ValidateParameters() (err error) {
+	p := r.Parameters
+	if p.Root == "" && runtime.GOOS != "windows" {
+		return fmt.Errorf("ValidateParameters: Root must be set outside of Windows.")
+	}
+	for _, l := range p.Locations {
+		found := false
+		for _, loc := range locations {
+			if loc.name == l {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("ValidateParameters: Unknown location %q.", l)
+		}
+	}
+	for _, rule := range p.Allowlist {
+		if rule.EmbeddedSigner != "" {
+			return fmt.Errorf("ValidateParameters: EmbeddedSigner is unverified, and cannot be used in the Allowlist.")
+		}
+	}
+	for _, list := range [][]Rule{p.Allowlist, p.Denylist} {
+		for _, rule := range list {
+			if _, err := compileRule(rule); err != nil {
+				return fmt.Errorf("ValidateParameters: %v", err)
+			}
+		}
+	}
+	if p.DeniedOnly && len(p.Denylist) == 0 {
+		return fmt.Errorf("ValidateParameters: DeniedOnly requires a Denylist.")
+	}
+	return
+}
+
+/*
+	Run *must* be implemented by a module. Its the function that executes the module. It must return a string of
+	marshalled json that contains the results from the module. The code below provides a base module skeleton that
+	can be reused in all modules.
+*/
+func (r *run) Run(in io.Reader) (out string) {
+	// a good way to handle execution failures is to catch panics and store
+	// the panicked error into modules.Results.Errors, marshal that, and output
+	// the JSON string back to the caller
+	defer func() {
+		if e := recover(); e != nil {
+			r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%v", e))
+			r.Results.Success = false
+			buf, _ := json.Marshal(r.Results)
+			out = string(buf[:])
+		}
+	}()
+
+	// read module parameters from stdin
+	err := modules.ReadInputParameters(in, &r.Parameters)
+	if err != nil {
+		panic(err)
+	}
+	// verify that the parameters we received are valid
+	err = r.ValidateParameters()
+	if err != nil {
+		panic(err)
+	}
+
+	// start a goroutine that does some work and another one that looks
+	// for an early stop signal
+	moduleDone := make(chan bool)
+	stop := make(chan bool)
+	r.stop = make(chan bool)
+	go r.doModuleStuff(&out, &moduleDone)
+	go modules.WatchForStop(in, &stop)
+
+	select {
+	case <-moduleDone:
+		return out
+	case <-stop:
+		// the module builds its results from what it collected so far
+		close(r.stop)
+		<-moduleDone
+		return out
+	}
+}
+
+/* doModuleStuff is an internal module function that does things specific to the module. There is no implementation requirement.
+   It's good practice to have it return the JSON string Run() expects to return. We also make it return a boolean in the `moduleDone`
+   channel to do flow control in Run().
+*/
+func (r *run) doModuleStuff(out *string, moduleDone *chan bool) error {
+	var (
+		el    elements
+		stats statistics
+	)
+	t0 := time.Now()
+
+	if r.raw == nil {
+		r.raw = new(ntfs.RawFiles)
+	}
+	defer r.raw.Close()
+	c := newCollector(r.Parameters.Root, r.raw)
+	allow := compileRules(r.Parameters.Allowlist)
+	deny := compileRules(r.Parameters.Denylist)
+	stopped := false
+	for _, loc := range locations {
+		if stopped {
+			break
+		}
+		if !r.wants(loc.name) {
+			continue
+		}
+		if r.Parameters.Debug {
+			fmt.Println("Listing ", loc.name, "....")
+		}
+		entries, err := loc.list(c)
+		if err != nil {
+			r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%s: %v", loc.name, err))
+		}
+		for _, e := range entries {
+			// inspecting the binaries of the entries is slow
+			if modules.IsStopped(r.stop) {
+				stopped = true
+				break
+			}
+			stats.EntriesFound++
+			c.inspectBinary(&e, &stats)
+			if allow.match(e) {
+				stats.Allowlisted++
+				continue
+			}
+			e.Denied = deny.match(e)
+			if e.Denied {
+				stats.Denied++
+			} else if r.Parameters.DeniedOnly {
+				continue
+			}
+			if !e.LastWrite.IsZero() {
+				kind := modules.ArtefactTimeLastWrite
+				if loc.name == "tasks" || loc.name == "startup" {
+					kind = modules.ArtefactTimeModified
+				}
+				e.Times = append(e.Times, modules.NewArtefactTime(kind, e.LastWrite, "persistence"))
+			}
+			el.Entries = append(el.Entries, e)
+		}
+	}
+	r.Results.Errors = append(r.Results.Errors, c.errors...)
+	if stopped {
+		r.Results.Errors = append(r.Results.Errors, modules.StoppedEarly)
+	}
+	stats.Exectime = time.Now().Sub(t0)
+
+	// marshal the results into a json string
+	*out = r.buildResults(el, stats)
+	*moduleDone <- true
+	return nil
+}
+
+// wants returns true if a location is listed
+func (r *run) wants(location string) bool {
+	if len(r.Parameters.Locations) == 0 {
+		return true
+	}
+	for _, l := range r.Parameters.Locations {
+		if l == location {
+			return true
+		}
+	}
+	return false
+}
+
+// collector reads the autostart locations under a root directory, and
+// collects the errors that do not stop the listing of a location
+type collector struct {
+	root   string
+	drive  string // drive letter of the root in Windows paths, such as C:
+	hives  map[string]*registry.Hive
+	raw    *ntfs.RawFiles
+	errors []string
+}
+
+func newCollector(root string, raw *ntfs.RawFiles) *collector {
+	c := &collector{root: root, drive: "C:", hives: make(map[string]*registry.Hive), raw: raw}
+	if runtime.GOOS == "windows" && os.Getenv("SYSTEMDRIVE") != "" {
+		c.drive = os.Getenv("SYSTEMDRIVE")
+	}
+	if c.root == "" {
+		c.root = c.drive + `\`
+	}
+	return c
+}
+
+// compiledRule holds the expressions of a rule, by field
+type compiledRule struct {
+	sha256 string
+	fields map[string]*regexp.Regexp
+}
+
+type ruleList []compiledRule
+
+func compileRule(rule Rule) (cr compiledRule, err error) {
+	cr.sha256 = strings.ToLower(rule.SHA256)
+	cr.fields = make(map[string]*regexp.Regexp)
+	for field, expr := range map[string]string{
+		"location":       rule.Location,
+		"name":           rule.Name,
+		"commandline":    rule.CommandLine,
+		"binarypath":     rule.BinaryPath,
+		"embeddedsigner": rule.EmbeddedSigner,
+	} {
+		if expr == "" {
+			continue
+		}
+		cr.fields[field], err = regexp.Compile("(?i)" + expr)
+		if err != nil {
+			return cr, fmt.Errorf("Invalid regular expression for %s: %v", field, err)
+		}
+	}
+	if cr.sha256 == "" && len(cr.fields) == 0 {
+		return cr, fmt.Errorf("Empty rule")
+	}
+	return
+}
+
+func compileRules(rules []Rule) (list ruleList) {
+	for _, rule := range rules {
+		cr, err := compileRule(rule)
+		if err != nil {
+			panic(err)
+		}
+		list = append(list, cr)
+	}
+	return
+}
+
+// match returns true if an entry matches one of the rules
+func (list ruleList) match(e Entry) bool {
+	for _, cr := range list {
+		if cr.match(e) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cr compiledRule) match(e Entry) bool {
+	if cr.sha256 != "" && cr.sha256 != e.SHA256 {
+		return false
+	}
+	values := map[string]string{
+		"location":       e.Location,
+		"name":           e.Name,
+		"commandline":    e.CommandLine,
+		"binarypath":     e.BinaryPath,
+		"embeddedsigner": e.EmbeddedSigner,
+	}
+	for field, re := range cr.fields {
+		if !re.MatchString(values[field]) {
+			return false
+		}
+	}
+	return true
+}
+
+// buildResults takes the results found by the module, as well as statistics,
+// and puts all that into a JSON string. It also takes care of setting the
+// success and foundanything flags. With a denylist, only denied entries
+// are considered as found.
+func (r *run) buildResults(el elements, stats statistics) string {
+	if len(r.Results.Errors) == 0 {
+		r.Results.Success = true
+	}
+	r.Results.Elements = el
+	r.Results.Statistics = stats
+	if len(r.Parameters.Denylist) > 0 {
+		r.Results.FoundAnything = stats.Denied > 0
+	} else {
+		r.Results.FoundAnything = len(el.Entries) > 0
+	}
+	jsonOutput, err := json.Marshal(r.Results)
+	if err != nil {
+		panic(err)
+	}
+	return string(jsonOutput[:])
+}
+
+// PrintResults() is an *optional* method that returns results in a human-readable format.
+// if matchOnly is set, only results that have at least one match are returned.
+// If matchOnly is not set, all results are returned, along with errors and statistics.
+func (r *run) PrintResults(result modules.Result, matchOnly bool) (prints []string, err error) {
+	var (
+		el    elements
+		stats statistics
+	)
+	err = result.GetElements(&el)
+	if err != nil {
+		panic(err)
+	}
+	prints = append(prints, fmt.Sprintf("\n-----------------\n     Persistence Results           \n------------------"))
+	for _, e := range el.Entries {
+		denied := ""
+		if e.Denied {
+			denied = " [denied]"
+		}
+		prints = append(prints, fmt.Sprintf("%s%s: %s, Command: %s, Last Write: %s",
+			e.Location, denied, e.Name, e.CommandLine, e.LastWrite.Format(time.RFC3339)))
+		prints = append(prints, fmt.Sprintf("    Source: %s", e.Source))
+		if e.BinaryPath != "" {
+			prints = append(prints, fmt.Sprintf("    Binary: %s, SHA256: %s, Embedded signer: %s", e.BinaryPath, e.SHA256, e.EmbeddedSigner))
+		}
+		var names []string
+		for name := range e.Details {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prints = append(prints, fmt.Sprintf("    %s: %s", name, e.Details[name]))
+		}
+	}
+
+	for _, e := range result.Errors {
+		prints = append(prints, fmt.Sprintf("error: %v", e))
+	}
+	err = result.GetStatistics(&stats)
+	if err != nil {
+		panic(err)
+	}
+	prints = append(prints, fmt.Sprintf("Entries Found   : %d", stats.EntriesFound))
+	prints = append(prints, fmt.Sprintf("Allowlisted     : %d", stats.Allowlisted))
+	prints = append(prints, fmt.Sprintf("Denied          : %d", stats.Denied))
+	return
+}
@@ -0,0 +1,531 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package persistence /* import "mig.ninja/mig/modules/persistence" */
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"debug/pe"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"mig.ninja/mig/modules"
+	"mig.ninja/mig/modules/ntfs"
+	"mig.ninja/mig/modules/registry"
+	"mig.ninja/mig/testutil"
+)
+
+func TestRegistration(t *testing.T) {
+	testutil.CheckModuleRegistration(t, "persistence")
+}
+
+var (
+	testWriteTime = time.Date(2016, 9, 1, 10, 20, 30, 0, time.UTC)
+	testSigner    = "Explerer Corp Code Signing"
+)
+
+func sz(name, s string) testutil.HiveValue {
+	return testutil.HiveValue{Name: name, Type: registry.RegSz, Data: testutil.EncodeUTF16z(s)}
+}
+
+func expandSz(name, s string) testutil.HiveValue {
+	return testutil.HiveValue{Name: name, Type: registry.RegExpandSz, Data: testutil.EncodeUTF16z(s)}
+}
+
+func dword(name string, v uint32) testutil.HiveValue {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return testutil.HiveValue{Name: name, Type: registry.RegDword, Data: b}
+}
+
+// key returns the description of a key and of its parents, from a path
+func key(path []string, values []testutil.HiveValue, subkeys ...*testutil.HiveKey) *testutil.HiveKey {
+	k := &testutil.HiveKey{Name: path[len(path)-1], LastWrite: testWriteTime, Values: values, Subkeys: subkeys}
+	for i := len(path) - 2; i >= 0; i-- {
+		k = &testutil.HiveKey{Name: path[i], LastWrite: testWriteTime, Subkeys: []*testutil.HiveKey{k}}
+	}
+	return k
+}
+
+// testSystemHive returns a SYSTEM hive with a service started from a user
+// profile and a service hosted by svchost
+func testSystemHive() *testutil.HiveKey {
+	services := key([]string{"ControlSet002", "Services"}, nil,
+		&testutil.HiveKey{Name: "Explerer", LastWrite: testWriteTime, Values: []testutil.HiveValue{
+			sz("ImagePath", `"C:\Users\Public\explerer.exe" -service`),
+			dword("Start", 2),
+			dword("Type", 0x10),
+			sz("ObjectName", "LocalSystem"),
+		}},
+		&testutil.HiveKey{Name: "wuauserv", LastWrite: testWriteTime, Values: []testutil.HiveValue{
+			expandSz("ImagePath", `%systemroot%\system32\svchost.exe -k netsvcs`),
+			dword("Start", 3),
+			dword("Type", 0x20),
+		}, Subkeys: []*testutil.HiveKey{
+			{Name: "Parameters", LastWrite: testWriteTime, Values: []testutil.HiveValue{
+				expandSz("ServiceDll", `%systemroot%\system32\wuaueng.dll`),
+			}},
+		}},
+		&testutil.HiveKey{Name: "Tcpip", LastWrite: testWriteTime, Values: []testutil.HiveValue{
+			expandSz("ImagePath", `System32\drivers\tcpip.sys`),
+			dword("Start", 0),
+			dword("Type", 1),
+		}},
+		// keys without image are not services
+		&testutil.HiveKey{Name: "Empty", LastWrite: testWriteTime},
+	)
+	return &testutil.HiveKey{Name: "ROOT", LastWrite: testWriteTime, Subkeys: []*testutil.HiveKey{
+		{Name: "ControlSet001", LastWrite: testWriteTime},
+		services,
+		{Name: "Select", LastWrite: testWriteTime, Values: []testutil.HiveValue{dword("Current", 2)}},
+	}}
+}
+
+// testSoftwareHive returns a SOFTWARE hive with a Run entry, a Winlogon
+// Userinit list, an IFEO debugger and a COM class
+func testSoftwareHive() *testutil.HiveKey {
+	return &testutil.HiveKey{Name: "ROOT", LastWrite: testWriteTime, Subkeys: []*testutil.HiveKey{
+		{Name: "Classes", LastWrite: testWriteTime, Subkeys: []*testutil.HiveKey{
+			key([]string{"CLSID", "{A6BA00FE-40E8-477C-B713-C64A14F18ADB}", "InprocServer32"}, []testutil.HiveValue{
+				expandSz("", `%SystemRoot%\system32\upcom.dll`),
+			}),
+		}},
+		{Name: "Microsoft", LastWrite: testWriteTime, Subkeys: []*testutil.HiveKey{
+			key([]string{"Windows", "CurrentVersion", "Run"}, []testutil.HiveValue{
+				sz("Updater", `C:\Users\Public\explerer.exe /q`),
+				sz("Empty", ""),
+			}),
+			{Name: "Windows NT", LastWrite: testWriteTime, Subkeys: []*testutil.HiveKey{
+				{Name: "CurrentVersion", LastWrite: testWriteTime, Subkeys: []*testutil.HiveKey{
+					key([]string{"Winlogon"}, []testutil.HiveValue{
+						sz("Shell", "explorer.exe"),
+						sz("Userinit", `C:\Windows\system32\userinit.exe,C:\Users\Public\explerer.exe,`),
+					}),
+					key([]string{"Image File Execution Options"}, nil,
+						&testutil.HiveKey{Name: "sethc.exe", LastWrite: testWriteTime, Values: []testutil.HiveValue{sz("Debugger", "cmd.exe")}},
+						&testutil.HiveKey{Name: "notepad.exe", LastWrite: testWriteTime, Values: []testutil.HiveValue{dword("GlobalFlag", 0)}},
+					),
+				}},
+			}},
+		}},
+	}}
+}
+
+// testUserHive returns the NTUSER.DAT hive of a user starting a program
+// from its profile
+func testUserHive() *testutil.HiveKey {
+	return key([]string{"ROOT", "Software", "Microsoft", "Windows", "CurrentVersion", "Run"}, []testutil.HiveValue{
+		expandSz("OneDrive", `"%LOCALAPPDATA%\Microsoft\OneDrive\OneDrive.exe" /background`),
+	})
+}
+
+const testTask = `<?xml version="1.0" encoding="UTF-16"?>
+<Task version="1.2" xmlns="http://schemas.microsoft.com/windows/2004/02/mit/task">
+  <RegistrationInfo>
+    <Date>2016-09-01T10:20:30</Date>
+    <Author>EXPLERER\bob</Author>
+  </RegistrationInfo>
+  <Triggers>
+    <LogonTrigger><Enabled>true</Enabled></LogonTrigger>
+    <TimeTrigger><StartBoundary>2016-09-01T10:00:00</StartBoundary></TimeTrigger>
+  </Triggers>
+  <Principals>
+    <Principal id="Author">
+      <UserId>S-1-5-18</UserId>
+      <RunLevel>HighestAvailable</RunLevel>
+    </Principal>
+  </Principals>
+  <Settings>
+    <Hidden>true</Hidden>
+  </Settings>
+  <Actions Context="Author">
+    <Exec>
+      <Command>C:\Program Files\Explerer\update.exe</Command>
+      <Arguments>-silent</Arguments>
+    </Exec>
+    <ComHandler>
+      <ClassId>{A6BA00FE-40E8-477C-B713-C64A14F18ADB}</ClassId>
+    </ComHandler>
+  </Actions>
+</Task>`
+
+// testObjects returns the carved content of a CIM repository holding a
+// subscription starting a command line, and a deleted subscription to a
+// script consumer
+func testObjects() []byte {
+	var b bytes.Buffer
+	b.Write(make([]byte, 64))
+	b.WriteString("\x00__EventFilter\x00Trigger\x00root\\cimv2\x00WQL\x00SELECT * FROM __InstanceModificationEvent WITHIN 60 WHERE TargetInstance ISA 'Win32_PerfFormattedData_PerfOS_System'\x00")
+	b.Write(make([]byte, 16))
+	b.WriteString("\x00CommandLineEventConsumer\x00Updater\x00powershell.exe -nop -enc SQBFAFgA\x00\x01\x02")
+	b.Write(make([]byte, 16))
+	b.WriteString("__FilterToConsumerBinding\x00CommandLineEventConsumer.Name=\"Updater\"\x00\x00\x11__EventFilter.Name=\"Trigger\"\x00")
+	b.Write(make([]byte, 16))
+	b.WriteString("\x00ActiveScriptEventConsumer\x00Script\x00VBScript\x00CreateObject(\"WScript.Shell\").Run \"calc.exe\"\x00")
+	b.WriteString("ActiveScriptEventConsumer.Name=\"Script\"\x00__EventFilter.Name=\"Trigger\"\x00")
+	// bindings are found once, even if their pages are duplicated
+	b.WriteString("__FilterToConsumerBinding\x00CommandLineEventConsumer.Name=\"Updater\"\x00\x00\x11__EventFilter.Name=\"Trigger\"\x00")
+	return b.Bytes()
+}
+
+// writeRoot writes the fixtures of a system volume under a directory
+func writeRoot(t *testing.T, dir string) {
+	files := map[string][]byte{
+		"Windows/System32/config/SYSTEM":   testutil.BuildHive(testSystemHive()),
+		"Windows/System32/config/SOFTWARE": testutil.BuildHive(testSoftwareHive()),
+		"Users/bob/NTUSER.DAT":             testutil.BuildHive(testUserHive()),
+		"Users/bob/AppData/Roaming/Microsoft/Windows/Start Menu/Programs/Startup/desktop.ini": []byte("[.ShellClassInfo]"),
+		"Users/bob/AppData/Roaming/Microsoft/Windows/Start Menu/Programs/Startup/updater.lnk": buildLink(`C:\Users\Public\explerer.exe`),
+		"ProgramData/Microsoft/Windows/Start Menu/Programs/Startup/update.bat":                []byte("@start C:\\Users\\Public\\explerer.exe"),
+		"Windows/System32/Tasks/Explerer/Update":                                              append([]byte{0xff, 0xfe}, testutil.EncodeUTF16(testTask)...),
+		"Windows/System32/wbem/Repository/OBJECTS.DATA":                                       testObjects(),
+		"Users/Public/explerer.exe":                                                           buildSignedPE(t, testSigner),
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBinaryPath(t *testing.T) {
+	c := &collector{drive: "C:"}
+	for _, tc := range []struct {
+		cmdline, user, expected string
+	}{
+		{`"C:\Program Files\Explerer\explerer.exe" /q`, "", `C:\Program Files\Explerer\explerer.exe`},
+		{`C:\Program Files\Explerer\explerer.exe /q`, "", `C:\Program Files\Explerer\explerer.exe`},
+		{`%SystemRoot%\system32\svchost.exe -k netsvcs`, "", `C:\Windows\system32\svchost.exe`},
+		{`\SystemRoot\System32\drivers\tcpip.sys`, "", `C:\Windows\System32\drivers\tcpip.sys`},
+		{`\??\C:\Windows\system32\drivers\evil.sys`, "", `C:\Windows\system32\drivers\evil.sys`},
+		{`System32\drivers\tcpip.sys`, "", `C:\Windows\System32\drivers\tcpip.sys`},
+		{`cmd.exe /c start`, "", `C:\Windows\System32\cmd.exe`},
+		{`rundll32.exe "%APPDATA%\evil.dll",Start`, "bob", `C:\Users\bob\AppData\Roaming\evil.dll`},
+		{`%TEMP%\drop.exe`, "", `C:\Windows\Temp\drop.exe`},
+		{`%UNKNOWN%\drop.exe`, "", `%UNKNOWN%\drop.exe`},
+	} {
+		if path := c.binaryPath(tc.cmdline, tc.user); path != tc.expected {
+			t.Fatalf("%q: expected %q, got %q", tc.cmdline, tc.expected, path)
+		}
+	}
+}
+
+func TestPESigner(t *testing.T) {
+	signer, err := peSigner(bytes.NewReader(buildSignedPE(t, testSigner)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer != testSigner {
+		t.Fatalf("expected signer %q, got %q", testSigner, signer)
+	}
+	if _, err := peSigner(bytes.NewReader(buildPE(nil))); err == nil {
+		t.Fatal("expected error on unsigned binary")
+	}
+}
+
+func TestWMISubscriptions(t *testing.T) {
+	c := &collector{drive: "C:"}
+	entries := c.wmiSubscriptions(testObjects())
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 subscriptions, got %+v", entries)
+	}
+	e := entries[0]
+	if e.Name != "Updater" || e.CommandLine != "powershell.exe -nop -enc SQBFAFgA" ||
+		e.BinaryPath != `C:\Windows\System32\powershell.exe` || e.Details["filter"] != "Trigger" ||
+		e.Details["consumer"] != "CommandLineEventConsumer" ||
+		e.Details["query"] != "SELECT * FROM __InstanceModificationEvent WITHIN 60 WHERE TargetInstance ISA 'Win32_PerfFormattedData_PerfOS_System'" {
+		t.Fatalf("unexpected command line subscription %+v", e)
+	}
+	e = entries[1]
+	if e.Name != "Script" || e.Details["engine"] != "VBScript" || e.CommandLine != `CreateObject("WScript.Shell").Run "calc.exe"` {
+		t.Fatalf("unexpected script subscription %+v", e)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migpersistence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeRoot(t, dir)
+
+	var r run
+	el, res := runModule(t, &r, params{Root: dir})
+	expected := []struct {
+		location, name, binary string
+	}{
+		{"services", "Explerer", `C:\Users\Public\explerer.exe`},
+		{"services", "wuauserv", `C:\Windows\system32\wuaueng.dll`},
+		{"services", "Tcpip", `C:\Windows\System32\drivers\tcpip.sys`},
+		{"run", "Updater", `C:\Users\Public\explerer.exe`},
+		{"run", "OneDrive", `C:\Users\bob\AppData\Local\Microsoft\OneDrive\OneDrive.exe`},
+		{"winlogon", "Shell", `C:\Windows\System32\explorer.exe`},
+		{"winlogon", "Userinit", `C:\Windows\system32\userinit.exe`},
+		{"winlogon", "Userinit", `C:\Users\Public\explerer.exe`},
+		{"ifeo", "sethc.exe", `C:\Windows\System32\cmd.exe`},
+		{"tasks", `\Explerer\Update`, `C:\Program Files\Explerer\update.exe`},
+		{"tasks", `\Explerer\Update`, `C:\Windows\system32\upcom.dll`},
+		{"wmi", "Updater", `C:\Windows\System32\powershell.exe`},
+		{"wmi", "Script", ""},
+		{"startup", "update.bat", `C:\ProgramData\Microsoft\Windows\Start Menu\Programs\Startup\update.bat`},
+		{"startup", "updater.lnk", `C:\Users\Public\explerer.exe`},
+	}
+	if len(el.Entries) != len(expected) || !res.FoundAnything {
+		t.Fatalf("expected %d entries, got %+v", len(expected), el.Entries)
+	}
+	for i, e := range el.Entries {
+		if e.Location != expected[i].location || e.Name != expected[i].name || e.BinaryPath != expected[i].binary {
+			t.Fatalf("expected %+v, got %+v", expected[i], e)
+		}
+	}
+	binary, err := ioutil.ReadFile(filepath.Join(dir, "Users", "Public", "explerer.exe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := el.Entries[0]
+	if svc.Details["start"] != "auto" || svc.Details["type"] != "own process" || svc.EmbeddedSigner != testSigner ||
+		svc.SHA256 != fmt.Sprintf("%x", sha256.Sum256(binary)) ||
+		!svc.LastWrite.Equal(testWriteTime) || len(svc.Times) != 1 || svc.Times[0].Kind != modules.ArtefactTimeLastWrite {
+		t.Fatalf("unexpected service %+v", svc)
+	}
+	link := el.Entries[14]
+	if link.EmbeddedSigner != testSigner || link.Details["link"] != `C:\Users\bob\AppData\Roaming\Microsoft\Windows\Start Menu\Programs\Startup\updater.lnk` {
+		t.Fatalf("unexpected startup link %+v", link)
+	}
+	task := el.Entries[9]
+	if task.CommandLine != `C:\Program Files\Explerer\update.exe -silent` || task.Details["user"] != "S-1-5-18" ||
+		task.Details["triggers"] != "LogonTrigger, TimeTrigger" || task.Details["hidden"] != "true" {
+		t.Fatalf("unexpected task %+v", task)
+	}
+
+	// the binary of Explerer and Windows binaries started by Winlogon are
+	// allowed, and files of ProgramData are denied
+	r = run{}
+	el, res = runModule(t, &r, params{
+		Root:      dir,
+		Locations: []string{"services", "run", "winlogon", "startup"},
+		Allowlist: []Rule{{SHA256: svc.SHA256}, {Location: "winlogon", BinaryPath: `\\system32\\`}},
+		Denylist:  []Rule{{BinaryPath: `\\programdata\\`}},
+	})
+	var stats statistics
+	if err := res.GetStatistics(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(el.Entries) != 4 || stats.Allowlisted != 6 || stats.Denied != 1 || !res.FoundAnything {
+		t.Fatalf("unexpected entries %+v, statistics %+v", el.Entries, stats)
+	}
+	if !el.Entries[3].Denied || el.Entries[3].Location != "startup" {
+		t.Fatalf("expected startup entry to be denied, got %+v", el.Entries[3])
+	}
+
+	r = run{}
+	el, res = runModule(t, &r, params{
+		Root:       dir,
+		Denylist:   []Rule{{SHA256: "0000"}},
+		DeniedOnly: true,
+	})
+	if len(el.Entries) != 0 || res.FoundAnything {
+		t.Fatalf("expected no entries, got %+v", el.Entries)
+	}
+
+	// the embedded signer can deny entries
+	r = run{}
+	el, _ = runModule(t, &r, params{
+		Root:       dir,
+		Locations:  []string{"services", "startup"},
+		Denylist:   []Rule{{EmbeddedSigner: "^explerer corp"}},
+		DeniedOnly: true,
+	})
+	if len(el.Entries) != 2 || el.Entries[0].Name != svc.Name || el.Entries[1].Name != link.Name {
+		t.Fatalf("unexpected denied entries %+v", el.Entries)
+	}
+
+	for _, p := range []params{
+		{Root: dir, Locations: []string{"bootkit"}},
+		{Root: dir, Allowlist: []Rule{{}}},
+		{Root: dir, Denylist: []Rule{{Name: "("}}},
+		{Root: dir, DeniedOnly: true},
+		{Root: dir, Allowlist: []Rule{{EmbeddedSigner: "^microsoft"}}},
+	} {
+		r := run{Parameters: p}
+		if r.ValidateParameters() == nil {
+			t.Fatalf("%+v: expected invalid parameters", p)
+		}
+	}
+}
+
+// runModule runs the module with parameters, and returns its elements
+// TestLockedFiles lists the autostart entries of a live system, whose hives
+// and CIM repository are locked and read from the raw volume
+func TestLockedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migpersistence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeRoot(t, dir)
+	var r run
+	expected, _ := runModule(t, &r, params{Root: dir})
+
+	locked := make(map[string][]byte)
+	for _, name := range []string{
+		"Windows/System32/config/SYSTEM",
+		"Windows/System32/config/SOFTWARE",
+		"Users/bob/NTUSER.DAT",
+		"Windows/System32/wbem/Repository/OBJECTS.DATA",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if locked[name], err = ioutil.ReadFile(path); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r = run{raw: &ntfs.RawFiles{Volume: testutil.LockFiles(t, dir, locked)}}
+	el, _ := runModule(t, &r, params{Root: dir})
+	if !reflect.DeepEqual(el, expected) {
+		t.Fatalf("expected %+v, got %+v", expected.Entries, el.Entries)
+	}
+}
+
+func runModule(t *testing.T, r *run, p params) (el elements, res modules.Result) {
+	msg, err := modules.MakeMessage(modules.MsgClassParameters, p, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal([]byte(r.Run(bytes.NewBuffer(msg))), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Errors) > 0 {
+		t.Fatalf("%+v: unexpected errors %v", p, res.Errors)
+	}
+	err = res.GetElements(&el)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// buildLink returns a Shell Link to a local file
+func buildLink(target string) []byte {
+	b := testutil.AppendUint32(nil, 0x4c)
+	b = append(b, 0x01, 0x14, 0x02, 0, 0, 0, 0, 0, 0xc0, 0, 0, 0, 0, 0, 0, 0x46)
+	// HasLinkInfo and IsUnicode
+	b = testutil.AppendUint32(b, 0x82)
+	b = append(b, make([]byte, 0x4c-len(b))...)
+	volume := []byte{0x11, 0, 0, 0, 3, 0, 0, 0, 0xf2, 0xa8, 0xe9, 0x1c, 0x10, 0, 0, 0, 0}
+	info := testutil.AppendUint32(nil, uint32(0x1c+len(volume)+len(target)+2))
+	for _, v := range []int{0x1c, 1, 0x1c, 0x1c + len(volume), 0, 0x1c + len(volume) + len(target) + 1} {
+		info = testutil.AppendUint32(info, uint32(v))
+	}
+	info = append(info, volume...)
+	info = append(append(info, target...), 0, 0)
+	return testutil.AppendUint32(append(b, info...), 0)
+}
+
+// buildPE returns a minimal PE32 file without sections, followed by a
+// WIN_CERTIFICATE holding a signature
+func buildPE(signature []byte) []byte {
+	var b bytes.Buffer
+	dos := make([]byte, 64)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], 64)
+	b.Write(dos)
+	b.WriteString("PE\x00\x00")
+	var oh pe.OptionalHeader32
+	fh := pe.FileHeader{
+		Machine:              pe.IMAGE_FILE_MACHINE_I386,
+		SizeOfOptionalHeader: uint16(binary.Size(oh)),
+		Characteristics:      0x0102,
+	}
+	oh.Magic = 0x10b
+	oh.NumberOfRvaAndSizes = 16
+	size := 64 + 4 + binary.Size(fh) + binary.Size(oh)
+	if signature != nil {
+		cert := testutil.AppendUint32(nil, uint32(8+len(signature)))
+		cert = append(testutil.AppendUint16(cert, 0x0200), testutil.AppendUint16(nil, winCertTypePKCS)...)
+		signature = append(cert, signature...)
+		oh.DataDirectory[peSecurityDirectory] = pe.DataDirectory{VirtualAddress: uint32(size), Size: uint32(len(signature))}
+	}
+	binary.Write(&b, binary.LittleEndian, fh)
+	binary.Write(&b, binary.LittleEndian, oh)
+	b.Write(signature)
+	return b.Bytes()
+}
+
+// buildSignedPE returns a PE file signed by a self signed certificate
+func buildSignedPE(t *testing.T, signer string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(4242),
+		Subject:      pkix.Name{CommonName: signer, Organization: []string{"Explerer Corp"}},
+		NotBefore:    testWriteTime,
+		NotAfter:     testWriteTime.AddDate(1, 0, 0),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha256Alg, _ := asn1.Marshal(pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}})
+	ecdsaAlg, _ := asn1.Marshal(pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}})
+	spcIndirectData, _ := asn1.Marshal(struct{ ContentType asn1.ObjectIdentifier }{asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 4}})
+	sd, err := asn1.Marshal(pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: sha256Alg},
+		ContentInfo:      asn1.RawValue{FullBytes: spcIndirectData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: cert.Raw},
+		SignerInfos: []pkcs7SignerInfo{{
+			Version: 1,
+			IssuerAndSerial: pkcs7IssuerAndSerial{
+				Issuer: asn1.RawValue{FullBytes: cert.RawIssuer},
+				Serial: cert.SerialNumber,
+			},
+			DigestAlgorithm: asn1.RawValue{FullBytes: sha256Alg},
+			DigestEncAlg:    asn1.RawValue{FullBytes: ecdsaAlg},
+			EncryptedDigest: []byte{1, 2, 3, 4},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci, err := asn1.Marshal(pkcs7ContentInfo{
+		ContentType: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2},
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buildPE(ci)
+}
@@ -0,0 +1,166 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package persistence /* import "mig.ninja/mig/modules/persistence" */
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+/*
+	WMI event subscriptions bind an __EventFilter, holding a WQL query, to
+	an event consumer, which runs a command line or a script when the query
+	matches. They are stored in OBJECTS.DATA, the objects file of the CIM
+	repository under System32\wbem\Repository.
+
+	The repository is not parsed as such: bindings are carved from the file
+	by the object paths of their filter and consumer, and the instances of
+	filters and consumers are found by their class name, followed by the
+	NUL terminated strings of their properties, one of which is their name.
+	Deleted subscriptions can be found as long as their pages are not
+	reused.
+*/
+
+// wmiBinding matches the references to the consumer and the filter of a
+// __FilterToConsumerBinding instance
+var wmiBinding = regexp.MustCompile(`(?s)(\w+EventConsumer)\.Name="([^"\x00]+)".{0,512}?__EventFilter\.Name="([^"\x00]+)"`)
+
+// wmiStrings is the number of property strings read after the class name
+// of an instance
+const wmiStrings = 8
+
+// wmiSubscriptions carves the event subscriptions of a CIM repository
+func (c *collector) wmiSubscriptions(data []byte) (entries []Entry) {
+	seen := make(map[string]bool)
+	for _, m := range wmiBinding.FindAllSubmatch(data, -1) {
+		class, consumer, filter := string(m[1]), string(m[2]), string(m[3])
+		id := class + "|" + consumer + "|" + filter
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		e := Entry{
+			Location: "wmi",
+			Name:     consumer,
+			Details: map[string]string{
+				"consumer": class,
+				"filter":   filter,
+			},
+		}
+		if query := wmiFilterQuery(data, filter); query != "" {
+			e.Details["query"] = query
+		}
+		props := wmiInstance(data, class, consumer)
+		switch class {
+		case "CommandLineEventConsumer":
+			// the command line template is the first property string
+			if len(props) > 0 {
+				e.CommandLine = props[0]
+				e.BinaryPath = c.binaryPath(props[0], "")
+			}
+		case "ActiveScriptEventConsumer":
+			// the script is the longest string, next to its engine
+			for _, p := range props {
+				if strings.EqualFold(p, "VBScript") || strings.EqualFold(p, "JScript") {
+					e.Details["engine"] = p
+				} else if len(p) > len(e.CommandLine) {
+					e.CommandLine = p
+				}
+			}
+		default:
+			if len(props) > 0 {
+				e.CommandLine = props[0]
+			}
+		}
+		entries = append(entries, e)
+	}
+	return
+}
+
+// wmiInstance returns the property strings of the instance of a class with
+// a given name, the name excluded
+func wmiInstance(data []byte, class, name string) []string {
+	marker := []byte("\x00" + class + "\x00")
+	for off := 0; ; {
+		i := bytes.Index(data[off:], marker)
+		if i < 0 {
+			return nil
+		}
+		off += i + len(marker)
+		props := nulStrings(data[off:], wmiStrings)
+		for j, p := range props {
+			if p == name {
+				return append(props[:j:j], props[j+1:]...)
+			}
+		}
+	}
+}
+
+// wmiFilterQuery returns the WQL query of an event filter
+func wmiFilterQuery(data []byte, filter string) string {
+	props := wmiInstance(data, "__EventFilter", filter)
+	for _, p := range props {
+		if strings.HasPrefix(strings.ToUpper(p), "SELECT ") {
+			return p
+		}
+	}
+	return ""
+}
+
+// nulStrings returns the first n printable strings of a buffer, separated
+// by NUL bytes
+func nulStrings(b []byte, n int) (out []string) {
+	for len(b) > 0 && len(out) < n {
+		end := bytes.IndexByte(b, 0)
+		if end < 0 {
+			end = len(b)
+		}
+		if s := b[:end]; len(s) > 0 {
+			if !printable(s) {
+				return
+			}
+			out = append(out, string(s))
+		}
+		if end == len(b) {
+			break
+		}
+		b = b[end+1:]
+	}
+	return
+}
+
+func printable(b []byte) bool {
+	for _, c := range b {
+		if (c < 0x20 && c != '\t' && c != '\r' && c != '\n') || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// wmi lists the event subscriptions of the CIM repository
+func (c *collector) wmi() (entries []Entry, err error) {
+	path, ok := findPath(c.root, "Windows", "System32", "wbem", "Repository", "OBJECTS.DATA")
+	if !ok {
+		// repositories of Windows XP are in an FS subdirectory
+		path, ok = findPath(c.root, "Windows", "System32", "wbem", "Repository", "FS", "OBJECTS.DATA")
+	}
+	if !ok {
+		return nil, fmt.Errorf("CIM repository not found under %s", c.root)
+	}
+	data, err := c.raw.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entries = c.wmiSubscriptions(data)
+	for i := range entries {
+		entries[i].Source = path
+	}
+	return
+}
@@ -34,10 +34,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mig.ninja/mig/modules"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -64,6 +66,7 @@ func init() {
 type run struct {
 	Parameters params
 	Results    modules.Result
+	stop       chan bool // closed when the module is asked to stop early
 }
 
 /*
@@ -72,6 +75,8 @@ type run struct {
 	- SearchExe: Array of executable file names to search for
 	- SearchDLL: Array of referenced libraries to search for. Requires ParseDLL=true
 	- GetLastDate: Specify whether earliest or latest run date should be returned
+	- Directory: Alternate directory of .pf files, e.g. extracted from a disk image.
+				 Defaults to %SYSTEMROOT%\Prefetch
 	- Debug: Enable debug print statements (not supported right now)
 */
 type params struct {
@@ -79,29 +84,45 @@ type params struct {
 	SearchExe   []string `json:"searchexe"`
 	SearchDLL   []string `json:"searchdll"`
 	GetLastDate bool     `json:"getlastdate"`
+	Directory   string   `json:"directory,omitempty"`
 	Debug       bool     `json:"debug"`
 }
 
+/*
+	PrefetchRecord is the decoded content of a single prefetch file:
+	- LastRunTimes: up to eight last execution times, most recent first
+	- FileMetrics: files loaded by the executable, ResourcesLoaded holds their names
+	- DirectoryStrings: directories referenced by the executable, across all volumes
+*/
 type PrefetchRecord struct {
-	ExeName          string     `json:"exename,omitempty"`
-	RunCount         string     `json:"runcount,omitempty"`
-	Volume           volumeInfo `json:"volume,omitempty"`
-	DirectoryStrings []string   `json:"directorystrings,omitempty"`
-	ResourcesLoaded  []string   `json:"resourcesloaded,omitempty"`
-	DateExecuted     string     `json:"dateexecuted,omitempty"`
+	ExeName          string       `json:"exename,omitempty"`
+	Hash             string       `json:"hash,omitempty"`
+	Version          int          `json:"version,omitempty"`
+	RunCount         int          `json:"runcount,omitempty"`
+	LastRunTimes     []time.Time  `json:"lastruntimes,omitempty"`
+	Volumes          []volumeInfo `json:"volumes,omitempty"`
+	FileMetrics      []FileMetric `json:"filemetrics,omitempty"`
+	DirectoryStrings []string     `json:"directorystrings,omitempty"`
+	ResourcesLoaded  []string     `json:"resourcesloaded,omitempty"`
 }
 
 type volumeInfo struct {
-	VolumeName   string `json:"volumename,omitempty"`
-	CreationDate string `json:"creationdate,omitempty"`
-	Serial       string `json:"serial,omitempty"`
+	VolumeName       string    `json:"volumename,omitempty"`
+	CreationDate     time.Time `json:"creationdate,omitempty"`
+	Serial           string    `json:"serial,omitempty"`
+	DirectoryStrings []string  `json:"directorystrings,omitempty"`
 }
 
+/*
+	PrefetchResult is a match of the search. ExecDate is the first or last
+	execution of the program, Times holds all its last run times.
+*/
 type PrefetchResult struct {
-	ExeName  string `json:"exename,omitempty"`
-	DLLName  string `json:"dllname,omitempty"`
-	ExecDate string `json:"execdate,omitempty"` // @TODO: Change type to time.Time + include parsing
-	RunCount string `json:"runcount,omitempty"`
+	ExeName  string                 `json:"exename,omitempty"`
+	DLLName  string                 `json:"dllname,omitempty"`
+	ExecDate time.Time              `json:"execdate"`
+	RunCount string                 `json:"runcount,omitempty"`
+	Times    []modules.ArtefactTime `json:"times,omitempty"`
 }
 
 /*
@@ -109,7 +130,7 @@ type PrefetchResult struct {
 	i) pgm name (ii) dll name (iii) execution date (iv) run count
 */
 type elements struct {
-	prefetch []PrefetchResult `json:"prefetchresults,omitempty"`
+	Prefetch []PrefetchResult `json:"prefetchresults,omitempty"`
 }
 
 /* Statistic counters:
@@ -179,6 +200,7 @@ func (r *run) Run(in io.Reader) (out string) {
 	// for an early stop signal
 	moduleDone := make(chan bool)
 	stop := make(chan bool)
+	r.stop = make(chan bool)
 	go r.doModuleStuff(&out, &moduleDone)
 	go modules.WatchForStop(in, &stop)
 
@@ -186,7 +208,10 @@ func (r *run) Run(in io.Reader) (out string) {
 	case <-moduleDone:
 		return out
 	case <-stop:
-		panic("stop message received, terminating early")
+		// the module builds its results from what it collected so far
+		close(r.stop)
+		<-moduleDone
+		return out
 	}
 }
 
@@ -195,184 +220,65 @@ func (r *run) Run(in io.Reader) (out string) {
    channel to do flow control in Run().
 */
 func (r *run) doModuleStuff(out *string, moduleDone *chan bool) error {
-	if r.Parameters.Debug {
-		// fmt.Println("Params: \n------------------------")
-		// fmt.Println("ParseDLL: ", r.Parameters.ParseDLL)
-		// fmt.Println("Target Exe's: ", r.Parameters.SearchExe)
-		// fmt.Println("Target DLL's: ", r.Parameters.SearchDLL)
-	}
-	timeStart := time.Now()
 	var (
 		el    elements
 		stats statistics
-		pr    PrefetchRecord
 		allpr []PrefetchRecord
-
-		endOfRecord bool
-		numPrefetch int
-		exeName     string
-		runCount    string
-		dirStrings  []string
-		resList     []string
-		returnDate  string
-		execDate    string
-		execTime    string
-		volInfo     volumeInfo
 	)
+	timeStart := time.Now()
 
 	stats.TotalHits = 0 // counter for found entries
 
-	if runtime.GOOS != "windows" {
-		//return // prefetch Module only for Windows OS machines
-		return fmt.Errorf("Error: Prefetch Searching can only be run on a Windows environment.")
+	prefetchDir := r.Parameters.Directory
+	if prefetchDir == "" {
+		if runtime.GOOS != "windows" {
+			// prefetch Module only for Windows OS machines, unless pointed at
+			// a directory of prefetch files extracted from one
+			r.Results.Errors = append(r.Results.Errors, "Prefetch Searching can only be run on a Windows environment.")
+			*out = r.buildResults(el, stats)
+			*moduleDone <- true
+			return nil
+		}
+		sysRoot := os.Getenv("SYSTEMROOT")
+		if sysRoot == "" {
+			sysRoot = "C:\\Windows"
+		}
+		prefetchDir = filepath.Join(sysRoot, "Prefetch")
 	}
 
 	/*
-		- Configure Prefetch Parsing Commands
-		- If ParseDLL is false, then append "-c" to command to produce shortened CSV output
-		- If ParseDLL is true, verbose output produced allowing to search for specified DLL libraries referenced
+		Parse every .pf file of the prefetch directory. A directory that can't
+		be read and files that fail to parse are reported as soft errors and
+		do not stop the search.
 	*/
-	sysDrivePath := os.Getenv("SYSTEMDRIVE")
-	prefetchParserPath := sysDrivePath + "\\windowsprefetch\\prefetch.py"
-	winPrefetchPath := "C:\\Windows\\Prefetch\\"
-	cmdName := "python"
-	cmdArgs := []string{prefetchParserPath, "-d", winPrefetchPath}
-
-	if r.Parameters.ParseDLL == false {
-		cmdArgs = append(cmdArgs, "-c")
-	}
-	cmdOut, err := exec.Command(cmdName, cmdArgs...).Output()
+	entries, err := ioutil.ReadDir(prefetchDir)
 	if err != nil {
-		panic(err)
+		r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%s: %v", prefetchDir, err))
 	}
-
-	/* Begin parsing output of captured Prefetch directory */
-	prefetchOutput := string(cmdOut)
-	prefetchLines := strings.Split(prefetchOutput, "\n")
-
-	/* Output is different and so requires different parsing algorithm */
-	if r.Parameters.ParseDLL == false {
-		for i := 1; i < len(prefetchLines)-1; i++ {
-			line := strings.Split(prefetchLines[i], ",")
-
-			pr.DateExecuted = line[0]
-			pr.ExeName = line[3]
-			pr.RunCount = line[4]
-
-			allpr = append(allpr, pr)
-			stats.NumPrefetch++
+	for _, entry := range entries {
+		if modules.IsStopped(r.stop) {
+			r.Results.Errors = append(r.Results.Errors, modules.StoppedEarly)
+			break
 		}
-	} else {
-
-		// for each entry in line, determine which object field to populate
-		// Some entries in output can run multiple lines, so must be added to appropriate array (slice)
-		endOfRecord = false
-		for i := 1; i < len(prefetchLines)-1; i++ {
-
-			// if line begins with this, then split it and take Name
-			if strings.HasPrefix(prefetchLines[i], "Executable Name:") {
-				exeName = strings.Split(prefetchLines[i], ":")[1]
-			}
-
-			// same as above
-			if strings.HasPrefix(prefetchLines[i], "Run count:") {
-				runCount = strings.Split(prefetchLines[i], ":")[1]
-			}
-
-			// a bit more complicated here. If the program only has single Last Executed entry, then date/time is on same line
-			// However, if there are more, then each entry is split over a new line, BELOW the 'Last Executed:' start
-			// In that case, starting at j = i+1, continue and add each entry to 'lastExecuted' array until hit the end
-			if strings.HasPrefix(prefetchLines[i], "Last Executed:") {
-				if len(prefetchLines[i]) > 15 {
-
-					returnDate = strings.Split(prefetchLines[i], "Executed:")[1]
-
-				} else {
-
-					// User can supply parameter to retrieve either earliest or latest execution date
-					if r.Parameters.GetLastDate {
-						timestamp := strings.Fields(prefetchLines[i+1])
-						if len(timestamp) > 1 {
-							returnDate = timestamp[0] + " " + timestamp[1]
-						}
-					} else {
-
-						// if GetLastDate is false, get earliest date, which is last in series
-						for j := i + 1; j < len(prefetchLines); j++ {
-							if len(prefetchLines[j]) < 5 {
-								break
-							}
-							// if s[j] == "" { break }
-
-							timestamp := strings.Fields(prefetchLines[j])
-							if len(timestamp) > 1 {
-								execDate = timestamp[0]
-								execTime = timestamp[1]
-
-							}
-						}
-						returnDate = execDate + " " + execTime
-					}
-
-				}
-			}
-
-			// relatively simple as there are always 3 lines for this
-			if strings.HasPrefix(prefetchLines[i], "Volume Information:") {
-				volInfo.VolumeName = strings.Split(prefetchLines[i+1], ":")[1]
-				volInfo.CreationDate = strings.Split(prefetchLines[i+2], ":")[1]
-				volInfo.Serial = strings.Split(prefetchLines[i+3], ":")[1]
-			}
-
-			// also relatively simple as there are always lots of lines. Stop processing when the line has less then 5 chars
-			if strings.HasPrefix(prefetchLines[i], "Directory Strings:") {
-				for j := i + 1; j < len(prefetchLines); j++ {
-					if len(prefetchLines[j]) < 5 {
-						break
-					}
-					dirStrings = append(dirStrings, strings.Replace(prefetchLines[j], " ", "", -1))
-				}
-			}
-
-			/*	Same as previous. Hoever, per program in the prefetch, this is the LAST entry, and so when done processing,
-				mark the bool value "endOfRecord" as true, to enable appending prefetch object "pr" to array of prefetch records
-				and resetting of temp arrays (slices)
-			*/
-			if strings.HasPrefix(prefetchLines[i], "Resources loaded:") {
-				for j := i + 2; j < len(prefetchLines); j++ {
-
-					if len(prefetchLines[j]) < 5 {
-						endOfRecord = true
-						break
-					}
-					resourceStr := strings.Split(prefetchLines[j], ":")[1]
-					resourceStr2 := strings.Replace(resourceStr, " ", "", -1)
-					resList = append(resList, resourceStr2)
-				}
-			}
-
-			/*
-					when we reach end of record, increment counter, assign temp arrays to Prefetch object, and append prefetch object to array
-				 	After, reset temp arrays and set endOfRecord to false to begin again
-			*/
-			if endOfRecord {
-				numPrefetch++
-				var pr PrefetchRecord
-				pr.ExeName = exeName
-				pr.RunCount = runCount
-				pr.DateExecuted = returnDate
-				pr.Volume = volInfo
-				pr.DirectoryStrings = dirStrings
-				pr.ResourcesLoaded = resList
-				allpr = append(allpr, pr)
-				stats.NumPrefetch++
-
-				/* Reinitialise variables for next prefetch entry */
-				dirStrings = dirStrings[:0]
-				resList = resList[:0]
-				endOfRecord = false
-			}
+		if entry.IsDir() || !strings.EqualFold(filepath.Ext(entry.Name()), ".pf") {
+			continue
+		}
+		file := filepath.Join(prefetchDir, entry.Name())
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%s: %v", file, err))
+			continue
+		}
+		pr, err := parsePrefetch(buf)
+		if err != nil {
+			r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%s: %v", file, err))
+			continue
 		}
+		if r.Parameters.Debug {
+			fmt.Printf("Parsed %s: version %d, %d runs\n", file, pr.Version, pr.RunCount)
+		}
+		allpr = append(allpr, pr)
+		stats.NumPrefetch++
 	}
 
 	/*
@@ -386,13 +292,8 @@ func (r *run) doModuleStuff(out *string, moduleDone *chan bool) error {
 			fmt.Println("Searching for EXE: ", targetExe)
 		}
 		for i := 0; i < len(allpr); i++ {
-			var result PrefetchResult
 			if strings.Contains(strings.ToLower(allpr[i].ExeName), strings.ToLower(targetExe)) {
-				result.ExeName = allpr[i].ExeName
-				result.ExecDate = allpr[i].DateExecuted
-				result.RunCount = allpr[i].RunCount
-				allResults = append(allResults, result)
-				// el.prefetch = append(el.prefetch, result)
+				allResults = append(allResults, r.newResult(allpr[i], ""))
 
 				stats.ExesFound++
 				stats.TotalHits++
@@ -406,16 +307,10 @@ func (r *run) doModuleStuff(out *string, moduleDone *chan bool) error {
 			fmt.Println("Searching for DLL:", targetDLL)
 		}
 		for i := 0; i < len(allpr); i++ {
-			var result PrefetchResult
 			for j := 0; j < len(allpr[i].ResourcesLoaded); j++ {
 				if strings.Contains(strings.ToLower(allpr[i].ResourcesLoaded[j]), strings.ToLower(targetDLL)) {
-					result.DLLName = targetDLL
-					result.ExeName = allpr[i].ExeName
-					result.ExecDate = allpr[i].DateExecuted
-					result.RunCount = allpr[i].RunCount
+					allResults = append(allResults, r.newResult(allpr[i], targetDLL))
 
-					allResults = append(allResults, result)
-					// el.prefetch = append(el.prefetch, result)
 					stats.DLLsFound++
 					stats.TotalHits++
 				}
@@ -423,15 +318,35 @@ func (r *run) doModuleStuff(out *string, moduleDone *chan bool) error {
 		}
 	}
 
-	el.prefetch = allResults
+	el.Prefetch = allResults
+	stats.Exectime = time.Now().Sub(timeStart)
 	// marshal the results into a json string
 	*out = r.buildResults(el, stats)
-	timeEnd := time.Now()
-	stats.Exectime = timeEnd.Sub(timeStart)
 	*moduleDone <- true
 	return nil
 }
 
+// newResult builds a search result from a parsed prefetch record. The
+// execution date is either the most recent or the earliest of the last
+// run times, depending on the GetLastDate parameter.
+func (r *run) newResult(pr PrefetchRecord, dll string) (result PrefetchResult) {
+	result.ExeName = pr.ExeName
+	result.DLLName = dll
+	result.RunCount = strconv.Itoa(pr.RunCount)
+	if len(pr.LastRunTimes) > 0 {
+		// last run times are stored most recent first
+		execDate := pr.LastRunTimes[len(pr.LastRunTimes)-1]
+		if r.Parameters.GetLastDate {
+			execDate = pr.LastRunTimes[0]
+		}
+		result.ExecDate = execDate.UTC()
+	}
+	for _, t := range pr.LastRunTimes {
+		result.Times = append(result.Times, modules.NewArtefactTime(modules.ArtefactTimeExecuted, t, "prefetch"))
+	}
+	return
+}
+
 // buildResults takes the results found by the module, as well as statistics,
 // and puts all that into a JSON string. It also takes care of setting the
 // success and foundanything flags.
@@ -466,12 +381,12 @@ func (r *run) PrintResults(result modules.Result, matchOnly bool) (prints []stri
 
 	prints = append(prints, fmt.Sprintf("\n-----------------\n     Prefetch Results           \n------------------"))
 	// if true, print results by DLL searched, else print exe and execution date
-	for _, prefetch := range el.prefetch {
+	for _, prefetch := range el.Prefetch {
 		if r.Parameters.ParseDLL == true {
-			prints = append(prints, fmt.Sprintf("DLL Found: %s, Executable: %s, First Run: %v, Run Count: %s", prefetch.DLLName, prefetch.ExeName,
-				prefetch.ExecDate, prefetch.RunCount))
+			prints = append(prints, fmt.Sprintf("DLL Found: %s, Executable: %s, First Run: %s, Run Count: %s", prefetch.DLLName, prefetch.ExeName,
+				prefetch.ExecDate.Format(time.RFC3339), prefetch.RunCount))
 		} else {
-			prints = append(prints, fmt.Sprintf("Executable Found: %s, First Run: %v, Run Count: %s", prefetch.ExeName, prefetch.ExecDate, prefetch.RunCount))
+			prints = append(prints, fmt.Sprintf("Executable Found: %s, First Run: %s, Run Count: %s", prefetch.ExeName, prefetch.ExecDate.Format(time.RFC3339), prefetch.RunCount))
 		}
 	}
 
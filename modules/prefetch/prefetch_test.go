@@ -0,0 +1,453 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package prefetch /* import "mig.ninja/mig/modules/prefetch" */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"mig.ninja/mig/modules"
+	"mig.ninja/mig/testutil"
+)
+
+func TestRegistration(t *testing.T) {
+	testutil.CheckModuleRegistration(t, "prefetch")
+}
+
+var (
+	testRunTime    = time.Date(2016, 8, 22, 14, 30, 12, 500000000, time.UTC)
+	testVolumeTime = time.Date(2015, 1, 10, 9, 0, 0, 0, time.UTC)
+	testMetrics    = []string{
+		`\DEVICE\HARDDISKVOLUME2\WINDOWS\SYSTEM32\NTDLL.DLL`,
+		`\DEVICE\HARDDISKVOLUME2\WINDOWS\SYSTEM32\MSCOREE.DLL`,
+	}
+	testDirs = []string{
+		`\DEVICE\HARDDISKVOLUME2\WINDOWS`,
+		`\DEVICE\HARDDISKVOLUME2\WINDOWS\SYSTEM32`,
+	}
+)
+
+// testLayout holds the offsets and sizes of the fields of a version of the
+// prefetch files, as documented by the libscca project, so the fixtures do not
+// depend on the layouts used by the parser
+type testLayout struct {
+	version      int
+	infoSize     int // size of the file information section
+	lastRun      int // offset of the first last run time
+	numLastRuns  int
+	runCount     int // offset of the run counter
+	metricsEntry int // size of an entry of the file metrics array
+	volumeEntry  int // size of an entry of the volumes information
+}
+
+var testLayouts = []testLayout{
+	{17, 0x44, 0x78, 1, 0x90, 20, 40},
+	{23, 0x9c, 0x80, 1, 0x98, 32, 104},
+	{26, 0xe0, 0x80, 8, 0xd0, 32, 104},
+	{30, 0xe0, 0x80, 8, 0xd0, 32, 96},
+	// second variant of version 30, with a shorter file information section
+	{30, 0xd4, 0x80, 8, 0xc8, 32, 96},
+}
+
+func TestParseVersions(t *testing.T) {
+	for _, l := range testLayouts {
+		pr, err := parsePrefetch(buildPrefetchLayout(l))
+		if err != nil {
+			t.Fatalf("version %d: %v", l.version, err)
+		}
+		checkRecord(t, l.version, pr)
+	}
+}
+
+func TestParseCompressed(t *testing.T) {
+	raw := buildPrefetch(30)
+	comp := compressMAM(raw)
+	if !isMAM(comp) {
+		t.Fatal("compressed buffer is missing MAM signature")
+	}
+	if len(comp) >= len(raw) {
+		t.Logf("compressed size %d not smaller than raw size %d", len(comp), len(raw))
+	}
+	dec, err := decompressMAM(comp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dec, raw) {
+		t.Fatal("decompressed buffer differs from original")
+	}
+	pr, err := parsePrefetch(comp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRecord(t, 30, pr)
+}
+
+// TestDecompressLongMatches decompresses matches whose length is stored in one,
+// three and seven extra bytes, in a stream of two blocks
+func TestDecompressLongMatches(t *testing.T) {
+	raw := buildPrefetch(30)
+	raw = append(raw, bytes.Repeat([]byte("A"), 100)...)
+	raw = append(raw, bytes.Repeat([]byte("B"), 1000)...)
+	raw = append(raw, make([]byte, 70000)...)
+	raw = append(raw, buildPrefetch(17)...)
+	comp := compressMAM(raw)
+	dec, err := decompressMAM(comp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dec, raw) {
+		t.Fatal("decompressed buffer differs from original")
+	}
+	if _, err := decompressMAM(comp[:len(comp)/2]); err == nil {
+		t.Fatal("expected error on truncated stream")
+	}
+}
+
+func TestDecompressOversized(t *testing.T) {
+	comp := compressMAM(buildPrefetch(30))
+	binary.LittleEndian.PutUint32(comp[4:], 0xffffffff)
+	if _, err := decompressMAM(comp); err == nil || !strings.Contains(err.Error(), "exceeds the maximum") {
+		t.Fatalf("expected an error on the oversized output, got %v", err)
+	}
+	if _, err := parsePrefetch(comp); err == nil {
+		t.Fatal("expected error on oversized prefetch file")
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	buf := buildPrefetch(23)
+	if _, err := parsePrefetch(buf[:100]); err == nil {
+		t.Fatal("expected error on truncated prefetch file")
+	}
+	binary.LittleEndian.PutUint32(buf[0:], 42)
+	if _, err := parsePrefetch(buf); err == nil {
+		t.Fatal("expected error on unknown prefetch version")
+	}
+	if _, err := parsePrefetch([]byte("not a prefetch file at all, really not one")); err == nil {
+		t.Fatal("expected error on invalid signature")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migprefetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "SERVER.EXE-1A2B3C4D.pf"), compressMAM(buildPrefetch(30)), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "BROKEN.EXE-00000000.pf"), []byte("garbage"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r run
+	r.Parameters.Directory = dir
+	r.Parameters.SearchExe = []string{"server.exe"}
+	r.Parameters.SearchDLL = []string{"mscoree.dll"}
+	msg, err := modules.MakeMessage(modules.MsgClassParameters, r.Parameters, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := r.Run(bytes.NewBuffer(msg))
+	var res modules.Result
+	err = json.Unmarshal([]byte(out), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var el elements
+	err = res.GetElements(&el)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.FoundAnything || len(el.Prefetch) != 2 {
+		t.Fatalf("expected 2 results, got %s", out)
+	}
+	if len(res.Errors) != 1 {
+		t.Fatalf("expected 1 error for the broken prefetch file, got %v", res.Errors)
+	}
+	for _, pr := range el.Prefetch {
+		if pr.ExeName != "SERVER.EXE" || pr.RunCount != "12" {
+			t.Fatalf("unexpected result %+v", pr)
+		}
+		// without getlastdate, the earliest of the eight run times is returned
+		if !pr.ExecDate.Equal(testRunTime.Add(-7*time.Hour)) || pr.ExecDate.Location() != time.UTC {
+			t.Fatalf("unexpected execution date %s", pr.ExecDate)
+		}
+		if len(pr.Times) != 8 || pr.Times[0].Kind != modules.ArtefactTimeExecuted || !pr.Times[0].Time.Equal(testRunTime) {
+			t.Fatalf("unexpected artefact times %+v", pr.Times)
+		}
+	}
+	if el.Prefetch[1].DLLName != "mscoree.dll" {
+		t.Fatalf("expected dll match, got %+v", el.Prefetch[1])
+	}
+}
+
+func TestSearchUnreadableDirectory(t *testing.T) {
+	var r run
+	// a directory that doesn't exist and contains glob metacharacters
+	r.Parameters.Directory = filepath.Join(os.TempDir(), "migprefetch-[missing]*")
+	r.Parameters.SearchExe = []string{"server.exe"}
+	msg, err := modules.MakeMessage(modules.MsgClassParameters, r.Parameters, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := r.Run(bytes.NewBuffer(msg))
+	var res modules.Result
+	err = json.Unmarshal([]byte(out), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the search completes and reports the directory as a soft error
+	if res.FoundAnything || len(res.Errors) != 1 || !strings.Contains(res.Errors[0], "migprefetch-[missing]*") {
+		t.Fatalf("expected 1 error on the missing directory, got %s", out)
+	}
+}
+func checkRecord(t *testing.T, version int, pr PrefetchRecord) {
+	if pr.Version != version {
+		t.Fatalf("version %d: parsed version %d", version, pr.Version)
+	}
+	if pr.ExeName != "SERVER.EXE" {
+		t.Fatalf("version %d: unexpected exe name %q", version, pr.ExeName)
+	}
+	if pr.Hash != "1A2B3C4D" {
+		t.Fatalf("version %d: unexpected hash %q", version, pr.Hash)
+	}
+	if pr.RunCount != 12 {
+		t.Fatalf("version %d: unexpected run count %d", version, pr.RunCount)
+	}
+	expectedRuns := 1
+	if version >= 26 {
+		expectedRuns = 8
+	}
+	if len(pr.LastRunTimes) != expectedRuns {
+		t.Fatalf("version %d: expected %d run times, got %d", version, expectedRuns, len(pr.LastRunTimes))
+	}
+	if !pr.LastRunTimes[0].Equal(testRunTime) {
+		t.Fatalf("version %d: unexpected last run time %s", version, pr.LastRunTimes[0])
+	}
+	if len(pr.FileMetrics) != len(testMetrics) || pr.ResourcesLoaded[1] != testMetrics[1] {
+		t.Fatalf("version %d: unexpected file metrics %v", version, pr.FileMetrics)
+	}
+	if version > 17 && pr.FileMetrics[0].FileReference != 0x0001000000001234 {
+		t.Fatalf("version %d: unexpected file reference %x", version, pr.FileMetrics[0].FileReference)
+	}
+	if len(pr.Volumes) != 1 {
+		t.Fatalf("version %d: expected 1 volume, got %d", version, len(pr.Volumes))
+	}
+	vol := pr.Volumes[0]
+	if vol.VolumeName != `\DEVICE\HARDDISKVOLUME2` || vol.Serial != "DEADBEEF" || !vol.CreationDate.Equal(testVolumeTime) {
+		t.Fatalf("version %d: unexpected volume %+v", version, vol)
+	}
+	if len(pr.DirectoryStrings) != len(testDirs) || pr.DirectoryStrings[1] != testDirs[1] {
+		t.Fatalf("version %d: unexpected directory strings %v", version, pr.DirectoryStrings)
+	}
+}
+
+// buildPrefetch generates an uncompressed prefetch file of a given version
+func buildPrefetch(version int) []byte {
+	for _, l := range testLayouts {
+		if l.version == version {
+			return buildPrefetchLayout(l)
+		}
+	}
+	panic(fmt.Sprintf("no layout for version %d", version))
+}
+
+// buildPrefetchLayout generates an uncompressed prefetch file with a given
+// layout
+func buildPrefetchLayout(layout testLayout) []byte {
+	version := layout.version
+	metricsOffset := 84 + layout.infoSize
+
+	// filename strings
+	var names []byte
+	var nameOffsets []int
+	for _, m := range testMetrics {
+		nameOffsets = append(nameOffsets, len(names))
+		names = append(names, testutil.EncodeUTF16(m)...)
+		names = append(names, 0, 0)
+	}
+	stringsOffset := metricsOffset + len(testMetrics)*layout.metricsEntry
+	volumesOffset := stringsOffset + len(names)
+
+	// volumes information: a single volume entry, followed by the device
+	// path and the directory strings
+	vol := make([]byte, layout.volumeEntry)
+	devPath := append(testutil.EncodeUTF16(`\DEVICE\HARDDISKVOLUME2`), 0, 0)
+	binary.LittleEndian.PutUint32(vol[0:], uint32(len(vol)))
+	binary.LittleEndian.PutUint32(vol[4:], uint32(len(devPath)/2-1))
+	binary.LittleEndian.PutUint64(vol[8:], testutil.Filetime(testVolumeTime))
+	binary.LittleEndian.PutUint32(vol[16:], 0xDEADBEEF)
+	binary.LittleEndian.PutUint32(vol[28:], uint32(len(vol)+len(devPath)))
+	binary.LittleEndian.PutUint32(vol[32:], uint32(len(testDirs)))
+	vol = append(vol, devPath...)
+	for _, d := range testDirs {
+		n := make([]byte, 2)
+		binary.LittleEndian.PutUint16(n, uint16(len(d)))
+		vol = append(vol, n...)
+		vol = append(vol, testutil.EncodeUTF16(d)...)
+		vol = append(vol, 0, 0)
+	}
+
+	buf := make([]byte, volumesOffset+len(vol))
+	binary.LittleEndian.PutUint32(buf[0:], uint32(version))
+	copy(buf[4:], "SCCA")
+	binary.LittleEndian.PutUint32(buf[8:], 0x11)
+	binary.LittleEndian.PutUint32(buf[12:], uint32(len(buf)))
+	copy(buf[16:], testutil.EncodeUTF16("SERVER.EXE"))
+	binary.LittleEndian.PutUint32(buf[76:], 0x1A2B3C4D)
+
+	binary.LittleEndian.PutUint32(buf[84:], uint32(metricsOffset))
+	binary.LittleEndian.PutUint32(buf[88:], uint32(len(testMetrics)))
+	binary.LittleEndian.PutUint32(buf[100:], uint32(stringsOffset))
+	binary.LittleEndian.PutUint32(buf[104:], uint32(len(names)))
+	binary.LittleEndian.PutUint32(buf[108:], uint32(volumesOffset))
+	binary.LittleEndian.PutUint32(buf[112:], 1)
+	binary.LittleEndian.PutUint32(buf[116:], uint32(len(vol)))
+	for i := 0; i < layout.numLastRuns; i++ {
+		ft := testutil.Filetime(testRunTime.Add(-time.Duration(i) * time.Hour))
+		binary.LittleEndian.PutUint64(buf[layout.lastRun+8*i:], ft)
+	}
+	binary.LittleEndian.PutUint32(buf[layout.runCount:], 12)
+
+	for i := range testMetrics {
+		entry := buf[metricsOffset+i*layout.metricsEntry:]
+		nchars := uint32(len(testMetrics[i]))
+		if version == 17 {
+			binary.LittleEndian.PutUint32(entry[8:], uint32(nameOffsets[i]))
+			binary.LittleEndian.PutUint32(entry[12:], nchars)
+		} else {
+			binary.LittleEndian.PutUint32(entry[12:], uint32(nameOffsets[i]))
+			binary.LittleEndian.PutUint32(entry[16:], nchars)
+			binary.LittleEndian.PutUint64(entry[24:], 0x0001000000001234)
+		}
+	}
+	copy(buf[stringsOffset:], names)
+	copy(buf[volumesOffset:], vol)
+	return buf
+}
+
+// compressMAM is a minimal Xpress Huffman compressor used to generate
+// fixtures. It uses a flat table where every symbol has a 9 bit code, and
+// greedily emits the longest matches it finds, in blocks of 64KB of output.
+func compressMAM(raw []byte) []byte {
+	out := append([]byte{}, mamSignature...)
+	out = testutil.AppendUint32(out, uint32(len(raw)))
+	for pos := 0; pos < len(raw); {
+		w := &xpressWriter{extras: make(map[int][]byte)}
+		// matches may end past the end of a block
+		for end := pos + xpressBlockSize; pos < end && pos < len(raw); {
+			length, offset := longestMatch(raw, pos)
+			if length < 3 {
+				w.writeBits(uint32(raw[pos]), 9)
+				pos++
+				continue
+			}
+			offLog := uint(0)
+			for 1<<(offLog+1) <= offset {
+				offLog++
+			}
+			l := length - 3
+			if l < 15 {
+				w.writeBits(uint32(256+int(offLog)<<4+l), 9)
+			} else {
+				w.writeBits(uint32(256+int(offLog)<<4+15), 9)
+				// the length continues in the bytes that follow the
+				// bit stream read so far
+				switch {
+				case l-15 < 255:
+					w.writeExtra(byte(l - 15))
+				case l <= 0xffff:
+					w.writeExtra(0xff, byte(l), byte(l>>8))
+				default:
+					w.writeExtra(0xff, 0, 0, byte(l), byte(l>>8), byte(l>>16), byte(l>>24))
+				}
+			}
+			w.writeBits(uint32(offset-1<<offLog), offLog)
+			pos += length
+		}
+		out = append(out, w.bytes()...)
+	}
+	return append(out, 0, 0, 0, 0)
+}
+
+// longestMatch returns the longest match of the data at pos in the preceding
+// 32KB. The search stops at the first match that needs extra length bytes.
+func longestMatch(raw []byte, pos int) (length, offset int) {
+	for off := 1; off <= pos && off < 1<<15; off++ {
+		l := 0
+		for pos+l < len(raw) && raw[pos+l] == raw[pos+l-off] {
+			l++
+		}
+		if l > length {
+			length, offset = l, off
+		}
+		if length >= 18 {
+			break
+		}
+	}
+	return
+}
+
+// xpressWriter writes the bit stream of an Xpress Huffman block, in 16 bit
+// words, and the extra length bytes of its matches at the position the
+// decoder reads them from: after the words it has loaded so far, which are
+// the word holding the last bit read and the word that follows it.
+type xpressWriter struct {
+	words  []uint16
+	bits   int
+	extras map[int][]byte // extra bytes, by the number of words before them
+}
+
+func (w *xpressWriter) writeBits(v uint32, n uint) {
+	for i := int(n) - 1; i >= 0; i-- {
+		if w.bits%16 == 0 {
+			w.words = append(w.words, 0)
+		}
+		w.words[len(w.words)-1] |= uint16(v>>uint(i)&1) << uint(15-w.bits%16)
+		w.bits++
+	}
+}
+
+// loaded returns the number of words loaded by the decoder once it has read
+// the bits written so far
+func (w *xpressWriter) loaded() int {
+	if w.bits == 0 {
+		return 2
+	}
+	return (w.bits-1)/16 + 2
+}
+
+func (w *xpressWriter) writeExtra(b ...byte) {
+	w.extras[w.loaded()] = append(w.extras[w.loaded()], b...)
+}
+
+// bytes returns the table and the bit stream of the block, padded to the
+// words loaded by the decoder at the end of the block
+func (w *xpressWriter) bytes() []byte {
+	b := bytes.Repeat([]byte{0x99}, xpressTableSize)
+	for i := 0; i < w.loaded(); i++ {
+		b = append(b, w.extras[i]...)
+		var word uint16
+		if i < len(w.words) {
+			word = w.words[i]
+		}
+		b = testutil.AppendUint16(b, word)
+	}
+	return append(b, w.extras[w.loaded()]...)
+}
@@ -0,0 +1,165 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package prefetch /* import "mig.ninja/mig/modules/prefetch" */
+
+import (
+	"fmt"
+	"strings"
+
+	"mig.ninja/mig/modules/winbin"
+)
+
+/*
+	Prefetch files share a common header ("SCCA" at offset 4), followed by a
+	file information section whose layout depends on the format version:
+
+	- 17: Windows XP / 2003
+	- 23: Windows Vista / 7
+	- 26: Windows 8.x
+	- 30: Windows 10, usually stored MAM compressed
+
+	The file information section points to the file metrics array, the
+	filename strings and the volumes information, which in turn contains the
+	directory strings of each volume.
+*/
+
+const (
+	sccaVersionXP    = 17
+	sccaVersionVista = 23
+	sccaVersionWin8  = 26
+	sccaVersionWin10 = 30
+
+	sccaHeaderSize = 84
+)
+
+// sccaLayout holds the version specific offsets and sizes of a prefetch file
+type sccaLayout struct {
+	lastRunOffset    int // offset of the first last run time
+	numLastRuns      int // number of last run time slots
+	runCountOffset   int // offset of the run counter
+	metricsEntrySize int // size of an entry in the file metrics array
+	volumeEntrySize  int // size of an entry in the volumes information
+}
+
+// FileMetric is an entry of the file metrics array, which lists the files
+// loaded by the executable during the first seconds of its execution
+type FileMetric struct {
+	Filename      string `json:"filename"`
+	Flags         uint32 `json:"flags,omitempty"`
+	FileReference uint64 `json:"filereference,omitempty"`
+}
+
+// layoutForVersion returns the layout of a prefetch file of a given version.
+// metricsOffset is needed to tell apart the two variants of version 30.
+func layoutForVersion(version, metricsOffset uint32) (l sccaLayout, err error) {
+	switch version {
+	case sccaVersionXP:
+		l = sccaLayout{lastRunOffset: 120, numLastRuns: 1, runCountOffset: 144, metricsEntrySize: 20, volumeEntrySize: 40}
+	case sccaVersionVista:
+		l = sccaLayout{lastRunOffset: 128, numLastRuns: 1, runCountOffset: 152, metricsEntrySize: 32, volumeEntrySize: 104}
+	case sccaVersionWin8:
+		l = sccaLayout{lastRunOffset: 128, numLastRuns: 8, runCountOffset: 208, metricsEntrySize: 32, volumeEntrySize: 104}
+	case sccaVersionWin10:
+		l = sccaLayout{lastRunOffset: 128, numLastRuns: 8, runCountOffset: 208, metricsEntrySize: 32, volumeEntrySize: 96}
+		// the second variant of version 30 has a shorter file information
+		// section, with the run counter moved up by 8 bytes
+		if metricsOffset == 0x128 {
+			l.runCountOffset = 200
+		}
+	default:
+		err = fmt.Errorf("unsupported prefetch version %d", version)
+	}
+	return
+}
+
+// parsePrefetch decodes the content of a prefetch file, compressed or not,
+// into a PrefetchRecord
+func parsePrefetch(buf []byte) (pr PrefetchRecord, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("parsePrefetch() -> %v", e)
+		}
+	}()
+	if isMAM(buf) {
+		buf, err = decompressMAM(buf)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if len(buf) < sccaHeaderSize || string(buf[4:8]) != "SCCA" {
+		panic("invalid prefetch signature")
+	}
+	version := winbin.Le32(buf, 0)
+	metricsOffset := winbin.Le32(buf, 84)
+	layout, err := layoutForVersion(version, metricsOffset)
+	if err != nil {
+		panic(err)
+	}
+	pr.Version = int(version)
+	pr.ExeName = strings.TrimSpace(winbin.UTF16String(buf[16:76]))
+	pr.Hash = fmt.Sprintf("%08X", winbin.Le32(buf, 76))
+
+	numMetrics := winbin.Le32(buf, 88)
+	stringsOffset := winbin.Le32(buf, 100)
+	stringsSize := winbin.Le32(buf, 104)
+	volumesOffset := winbin.Le32(buf, 108)
+	numVolumes := winbin.Le32(buf, 112)
+
+	for i := 0; i < layout.numLastRuns; i++ {
+		t := winbin.Filetime(winbin.Le64(buf, layout.lastRunOffset+8*i))
+		if t.IsZero() {
+			continue
+		}
+		pr.LastRunTimes = append(pr.LastRunTimes, t)
+	}
+	pr.RunCount = int(winbin.Le32(buf, layout.runCountOffset))
+
+	// the filename strings section is a list of UTF-16 paths referenced
+	// by offset from the file metrics entries
+	filenames := winbin.Slice(buf, int(stringsOffset), int(stringsSize))
+	for i := uint32(0); i < numMetrics; i++ {
+		entry := winbin.Slice(buf, int(metricsOffset)+int(i)*layout.metricsEntrySize, layout.metricsEntrySize)
+		var fm FileMetric
+		if version == sccaVersionXP {
+			fm.Filename = utf16At(filenames, winbin.Le32(entry, 8), winbin.Le32(entry, 12))
+			fm.Flags = winbin.Le32(entry, 16)
+		} else {
+			fm.Filename = utf16At(filenames, winbin.Le32(entry, 12), winbin.Le32(entry, 16))
+			fm.Flags = winbin.Le32(entry, 20)
+			fm.FileReference = winbin.Le64(entry, 24)
+		}
+		pr.FileMetrics = append(pr.FileMetrics, fm)
+		pr.ResourcesLoaded = append(pr.ResourcesLoaded, fm.Filename)
+	}
+
+	// volumes information, offsets in each entry are relative to the start
+	// of the volumes information section
+	for i := uint32(0); i < numVolumes; i++ {
+		entry := winbin.Slice(buf, int(volumesOffset)+int(i)*layout.volumeEntrySize, layout.volumeEntrySize)
+		var vi volumeInfo
+		vi.VolumeName = utf16At(buf[volumesOffset:], winbin.Le32(entry, 0), winbin.Le32(entry, 4))
+		vi.CreationDate = winbin.Filetime(winbin.Le64(entry, 8))
+		vi.Serial = fmt.Sprintf("%08X", winbin.Le32(entry, 16))
+		dirOffset := volumesOffset + winbin.Le32(entry, 28)
+		numDirs := winbin.Le32(entry, 32)
+		for j := uint32(0); j < numDirs; j++ {
+			// each directory string is prefixed by its length in characters,
+			// and terminated by a null character
+			nchars := uint32(winbin.Le16(buf, int(dirOffset)))
+			vi.DirectoryStrings = append(vi.DirectoryStrings, utf16At(buf, dirOffset+2, nchars))
+			dirOffset += 2 + (nchars+1)*2
+		}
+		pr.DirectoryStrings = append(pr.DirectoryStrings, vi.DirectoryStrings...)
+		pr.Volumes = append(pr.Volumes, vi)
+	}
+	return
+}
+
+// utf16At decodes nchars UTF-16 characters at offset off of b
+func utf16At(b []byte, off, nchars uint32) string {
+	return strings.TrimSpace(winbin.UTF16String(winbin.Slice(b, int(off), int(nchars)*2)))
+}
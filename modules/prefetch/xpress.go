@@ -0,0 +1,203 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package prefetch /* import "mig.ninja/mig/modules/prefetch" */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+/*
+	Windows 10 stores prefetch files compressed with LZXPRESS Huffman, wrapped
+	in a small "MAM" header. The decoder below follows the algorithm described
+	in [MS-XCA] section 2.2.4: the input is a sequence of blocks, each holding
+	a 256 byte table of 4 bit code lengths for 512 symbols, followed by a bit
+	stream that decodes into at most 64KB of output.
+*/
+
+const (
+	xpressTableSize  = 256
+	xpressBlockSize  = 65536
+	xpressNumSymbols = 512
+	xpressMaxCodeLen = 15
+
+	// mamMaxSize caps the decompressed size announced by a MAM header, the
+	// prefetch files of Windows 10 are well below a megabyte
+	mamMaxSize = 16 << 20
+)
+
+// mamSignature is the magic found at the start of compressed prefetch files
+var mamSignature = []byte{'M', 'A', 'M', 0x04}
+
+// isMAM returns true if buf starts with a MAM compressed header
+func isMAM(buf []byte) bool {
+	if len(buf) < 8 {
+		return false
+	}
+	for i := range mamSignature {
+		if buf[i] != mamSignature[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// decompressMAM unwraps a MAM header and decompresses the Xpress Huffman
+// stream that follows it.
+func decompressMAM(buf []byte) ([]byte, error) {
+	if !isMAM(buf) {
+		return nil, fmt.Errorf("decompressMAM: missing MAM signature")
+	}
+	size := int(binary.LittleEndian.Uint32(buf[4:8]))
+	if size > mamMaxSize {
+		return nil, fmt.Errorf("decompressMAM: decompressed size %d exceeds the maximum of %d", size, mamMaxSize)
+	}
+	return xpressHuffmanDecompress(buf[8:], size)
+}
+
+// xpressHuffmanDecompress decodes an LZXPRESS Huffman stream into a buffer of
+// outSize bytes.
+func xpressHuffmanDecompress(in []byte, outSize int) (out []byte, err error) {
+	out = make([]byte, 0, outSize)
+	inPos := 0
+	for len(out) < outSize {
+		if inPos+xpressTableSize > len(in) {
+			return out, fmt.Errorf("xpressHuffmanDecompress: truncated input at offset %d", inPos)
+		}
+		table, err := buildXpressTable(in[inPos : inPos+xpressTableSize])
+		if err != nil {
+			return out, err
+		}
+		pos := inPos + xpressTableSize
+		nextBits := uint32(read16(in, pos))<<16 | uint32(read16(in, pos+2))
+		pos += 4
+		extraBits := 16
+		blockEnd := len(out) + xpressBlockSize
+
+		// refill pulls 16 more bits into nextBits once we have consumed
+		// past the preloaded word
+		refill := func() {
+			if extraBits < 0 {
+				nextBits |= uint32(read16(in, pos)) << uint(-extraBits)
+				extraBits += 16
+				pos += 2
+			}
+		}
+
+		for len(out) < blockEnd && len(out) < outSize {
+			entry := table[nextBits>>(32-xpressMaxCodeLen)]
+			symbol, length := int(entry>>4), uint(entry&0xf)
+			if length == 0 {
+				return out, fmt.Errorf("xpressHuffmanDecompress: invalid huffman code at offset %d", pos)
+			}
+			nextBits <<= length
+			extraBits -= int(length)
+			refill()
+			if symbol < 256 {
+				out = append(out, byte(symbol))
+				continue
+			}
+			symbol -= 256
+			matchLen := symbol & 0xf
+			offsetBits := uint(symbol >> 4)
+			if matchLen == 15 {
+				if pos >= len(in) {
+					return out, fmt.Errorf("xpressHuffmanDecompress: truncated match length")
+				}
+				matchLen = int(in[pos])
+				pos++
+				if matchLen == 255 {
+					matchLen = int(read16(in, pos))
+					pos += 2
+					if matchLen == 0 {
+						if pos+4 > len(in) {
+							return out, fmt.Errorf("xpressHuffmanDecompress: truncated match length")
+						}
+						matchLen = int(binary.LittleEndian.Uint32(in[pos : pos+4]))
+						pos += 4
+					}
+					if matchLen < 15 {
+						return out, fmt.Errorf("xpressHuffmanDecompress: invalid match length %d", matchLen)
+					}
+					matchLen -= 15
+				}
+				matchLen += 15
+			}
+			matchLen += 3
+			offset := int(nextBits>>(32-offsetBits)) + 1<<offsetBits
+			nextBits <<= offsetBits
+			extraBits -= int(offsetBits)
+			refill()
+			if offset > len(out) {
+				return out, fmt.Errorf("xpressHuffmanDecompress: match offset %d beyond output", offset)
+			}
+			// copy byte by byte, matches are allowed to overlap
+			src := len(out) - offset
+			for i := 0; i < matchLen && len(out) < outSize; i++ {
+				out = append(out, out[src+i])
+			}
+		}
+		inPos = pos
+	}
+	return out, nil
+}
+
+// buildXpressTable converts the packed code lengths of a block into a lookup
+// table indexed by the next 15 bits of input. Each entry holds the symbol in
+// its upper bits and the code length in its lower 4 bits.
+func buildXpressTable(raw []byte) ([]uint16, error) {
+	type code struct {
+		symbol int
+		length int
+	}
+	var codes []code
+	for i := 0; i < xpressNumSymbols; i++ {
+		l := int(raw[i/2]>>(4*uint(i%2))) & 0xf
+		if l > 0 {
+			codes = append(codes, code{i, l})
+		}
+	}
+	if len(codes) == 0 {
+		return nil, fmt.Errorf("buildXpressTable: empty huffman table")
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		if codes[i].length != codes[j].length {
+			return codes[i].length < codes[j].length
+		}
+		return codes[i].symbol < codes[j].symbol
+	})
+	table := make([]uint16, 1<<xpressMaxCodeLen)
+	next := 0
+	prevLen := codes[0].length
+	for _, c := range codes {
+		next <<= uint(c.length - prevLen)
+		prevLen = c.length
+		start := next << uint(xpressMaxCodeLen-c.length)
+		end := (next + 1) << uint(xpressMaxCodeLen-c.length)
+		if end > len(table) {
+			return nil, fmt.Errorf("buildXpressTable: oversubscribed huffman table")
+		}
+		for i := start; i < end; i++ {
+			table[i] = uint16(c.symbol<<4 | c.length)
+		}
+		next++
+	}
+	return table, nil
+}
+
+// read16 returns the little endian word at pos, or zero past the end of
+// the input, which the bit reader may touch when preloading its last bits
+func read16(in []byte, pos int) uint16 {
+	if pos+2 > len(in) {
+		if pos < len(in) {
+			return uint16(in[pos])
+		}
+		return 0
+	}
+	return binary.LittleEndian.Uint16(in[pos : pos+2])
+}
@@ -0,0 +1,101 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Julien Vehent jvehent@mozilla.com [:ulfr]
+
+package modules /* import "mig.ninja/mig/modules" */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Progress is sent by long running modules to report on their progress before
+// they return their results. Percent is the estimated completion of the run,
+// between 0 and 100, if the module can estimate it. Statistics contains the
+// statistics of the run so far, such as the number of files scanned, and Elements
+// the results found since the previous progress message, if any.
+type Progress struct {
+	Percent    float64     `json:"percent,omitempty"`
+	Statistics interface{} `json:"statistics,omitempty"`
+	Elements   interface{} `json:"elements,omitempty"`
+}
+
+// HasProgressPrinter implements functions used by module to print progress messages
+type HasProgressPrinter interface {
+	PrintProgress(Progress) ([]string, error)
+}
+
+// ProgressWriter receives the progress messages of modules. The agent sets it to
+// stdout when it runs a module, progress messages are discarded when it is nil.
+var ProgressWriter io.Writer
+
+var progressLock sync.Mutex
+
+// progressPrefix starts every progress message written by SendProgress
+var progressPrefix = []byte(`{"class":"progress",`)
+
+// SendProgress writes a progress message on a single line of ProgressWriter. The
+// agent relays progress messages to the scheduler, so modules should not send them
+// more often than every few seconds.
+func SendProgress(p Progress) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("SendProgress() -> %v", e)
+		}
+	}()
+	if ProgressWriter == nil {
+		return
+	}
+	msg, err := MakeMessage(MsgClassProgress, p, false)
+	if err != nil {
+		panic(err)
+	}
+	progressLock.Lock()
+	defer progressLock.Unlock()
+	_, err = ProgressWriter.Write(append(msg, '\n'))
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+// IsProgress returns true if a line written by a module may be a progress message.
+// A line shorter than the beginning of progress messages may be one until more of
+// it is read.
+func IsProgress(line []byte) bool {
+	if len(line) < len(progressPrefix) {
+		return bytes.HasPrefix(progressPrefix, line)
+	}
+	return bytes.HasPrefix(line, progressPrefix)
+}
+
+// ReadProgress decodes a progress message written by SendProgress
+func ReadProgress(line []byte) (p Progress, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("ReadProgress() -> %v", e)
+		}
+	}()
+	var msg Message
+	err = json.Unmarshal(line, &msg)
+	if err != nil {
+		panic(err)
+	}
+	if msg.Class != MsgClassProgress {
+		panic("message is not a progress message")
+	}
+	buf, err := json.Marshal(msg.Parameters)
+	if err != nil {
+		panic(err)
+	}
+	err = json.Unmarshal(buf, &p)
+	if err != nil {
+		panic(err)
+	}
+	return
+}
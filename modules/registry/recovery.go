@@ -0,0 +1,333 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package registry /* import "mig.ninja/mig/modules/registry" */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+/*
+	Recovery of registry data that is not visible in the primary hive file.
+
+	When a hive is modified, Windows first writes the dirty pages to a
+	transaction log (.LOG1/.LOG2, or .LOG on older systems) and only later
+	flushes them to the primary file. A hive whose two sequence numbers
+	differ was not cleanly written, and its most recent changes only exist
+	in the logs. Two log formats exist:
+
+	- the old format (Windows XP to 7) holds a "DIRT" bitmap of dirty sectors
+	  followed by the content of these sectors
+	- the new format (Windows 8.1 and up) holds a sequence of "HvLE" entries,
+	  each with a list of dirty pages and their content
+
+	Deleted keys and values are not wiped, their cells are only marked as
+	free, and can be carved back until the space is reused.
+*/
+
+const (
+	regfLogHeaderSize = 512
+	regfSectorSize    = 512
+
+	// seed of the Marvin32 hashes protecting new format log entries
+	marvin32Seed = 0x82EF4D887A4E55C5
+
+	// record sources
+	SourceLog   = "log"
+	SourceSlack = "slack"
+)
+
+// Dirty returns true if the primary sequence numbers of the hive do not
+// match, meaning some changes may only be present in its transaction logs
+func (h *Hive) Dirty() bool {
+	return h.seq1 != h.seq2
+}
+
+// Replay applies the transaction logs to a copy of the hive, and returns the
+// resulting hive along with the number of log entries that were applied.
+// Logs that do not follow the sequence of the primary file are ignored.
+func (h *Hive) Replay(logs ...[]byte) (replayed *Hive, applied int, err error) {
+	buf := make([]byte, len(h.buf))
+	copy(buf, h.buf)
+
+	type logEntry struct {
+		seq      uint32
+		binsSize uint32
+		pages    []dirtyPage
+		old      bool // old format logs are not chained to the primary sequence
+	}
+	var entries []logEntry
+	for _, log := range logs {
+		if len(log) < regfLogHeaderSize+4 || string(log[0:4]) != "regf" {
+			continue
+		}
+		switch string(log[regfLogHeaderSize : regfLogHeaderSize+4]) {
+		case "HvLE":
+			for off := regfLogHeaderSize; off+40 <= len(log); {
+				seq, binsSize, pages, size, err := parseLogEntry(log[off:])
+				if err != nil {
+					break
+				}
+				entries = append(entries, logEntry{seq, binsSize, pages, false})
+				off += size
+			}
+		case "DIRT":
+			seq1 := binary.LittleEndian.Uint32(log[4:8])
+			seq2 := binary.LittleEndian.Uint32(log[8:12])
+			// an incomplete log has mismatched sequence numbers, and an old
+			// log has a sequence number lower than the primary file
+			if seq1 != seq2 || seq1 < h.seq2 {
+				continue
+			}
+			binsSize := binary.LittleEndian.Uint32(log[40:44])
+			pages, err := parseDirtyVector(log, binsSize)
+			if err != nil {
+				continue
+			}
+			entries = append(entries, logEntry{seq1, binsSize, pages, true})
+		}
+	}
+
+	// apply entries in sequence, starting with the secondary sequence number
+	// of the primary file, and stopping at the first gap
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	next := h.seq2
+	for _, e := range entries {
+		if e.seq < next {
+			continue
+		}
+		if e.seq > next && (applied > 0 || !e.old) {
+			break
+		}
+		if size := regfBaseBlockSize + int(e.binsSize); size > len(buf) {
+			buf = append(buf, make([]byte, size-len(buf))...)
+		}
+		for _, p := range e.pages {
+			start := regfBaseBlockSize + int(p.offset)
+			if start+len(p.data) > len(buf) {
+				return nil, applied, fmt.Errorf("Replay: dirty page at 0x%x is beyond the end of the hive", p.offset)
+			}
+			copy(buf[start:], p.data)
+		}
+		binary.LittleEndian.PutUint32(buf[40:44], e.binsSize)
+		applied++
+		next = e.seq + 1
+	}
+	// the replayed hive is consistent again
+	binary.LittleEndian.PutUint32(buf[4:8], next)
+	binary.LittleEndian.PutUint32(buf[8:12], next)
+	replayed, err = ParseHive(buf, h.Name)
+	return
+}
+
+type dirtyPage struct {
+	offset uint32 // offset relative to the start of the hive bins
+	data   []byte
+}
+
+// parseLogEntry decodes a new format "HvLE" log entry, and returns its
+// sequence number, the size of the hive bins data after it is applied, its
+// dirty pages and the size of the entry
+func parseLogEntry(b []byte) (seq, binsSize uint32, pages []dirtyPage, size int, err error) {
+	if string(b[0:4]) != "HvLE" {
+		return 0, 0, nil, 0, fmt.Errorf("parseLogEntry: invalid signature")
+	}
+	size = int(binary.LittleEndian.Uint32(b[4:8]))
+	if size < 40 || size%regfSectorSize != 0 || size > len(b) {
+		return 0, 0, nil, 0, fmt.Errorf("parseLogEntry: invalid entry size %d", size)
+	}
+	seq = binary.LittleEndian.Uint32(b[12:16])
+	binsSize = binary.LittleEndian.Uint32(b[16:20])
+	count := int(binary.LittleEndian.Uint32(b[20:24]))
+	hash1 := binary.LittleEndian.Uint64(b[24:32])
+	hash2 := binary.LittleEndian.Uint64(b[32:40])
+	if marvin32(b[40:size], marvin32Seed) != hash1 || marvin32(b[0:32], marvin32Seed) != hash2 {
+		return 0, 0, nil, 0, fmt.Errorf("parseLogEntry: invalid hash")
+	}
+	refs := 40
+	data := refs + count*8
+	if data > size {
+		return 0, 0, nil, 0, fmt.Errorf("parseLogEntry: too many dirty pages")
+	}
+	for i := 0; i < count; i++ {
+		off := binary.LittleEndian.Uint32(b[refs+i*8:])
+		psize := int(binary.LittleEndian.Uint32(b[refs+i*8+4:]))
+		if data+psize > size {
+			return 0, 0, nil, 0, fmt.Errorf("parseLogEntry: dirty page overflows entry")
+		}
+		pages = append(pages, dirtyPage{off, b[data : data+psize]})
+		data += psize
+	}
+	return
+}
+
+// parseDirtyVector decodes an old format log: a bitmap with one bit per
+// sector of hive bins data, followed by the content of the dirty sectors
+func parseDirtyVector(log []byte, binsSize uint32) (pages []dirtyPage, err error) {
+	nsectors := int(binsSize / regfSectorSize)
+	bitmap := log[regfLogHeaderSize+4:]
+	if len(bitmap) < (nsectors+7)/8 {
+		return nil, fmt.Errorf("parseDirtyVector: truncated bitmap")
+	}
+	// dirty sectors start at the first sector boundary after the bitmap
+	data := regfLogHeaderSize + 4 + (nsectors+7)/8
+	if data%regfSectorSize != 0 {
+		data += regfSectorSize - data%regfSectorSize
+	}
+	for i := 0; i < nsectors; i++ {
+		if bitmap[i/8]&(1<<uint(i%8)) == 0 {
+			continue
+		}
+		if data+regfSectorSize > len(log) {
+			return nil, fmt.Errorf("parseDirtyVector: truncated dirty sectors")
+		}
+		pages = append(pages, dirtyPage{uint32(i * regfSectorSize), log[data : data+regfSectorSize]})
+		data += regfSectorSize
+	}
+	return
+}
+
+// marvin32 computes the 64 bits Marvin32 hash of data, as used to protect
+// the entries of new format transaction logs
+func marvin32(data []byte, seed uint64) uint64 {
+	lo, hi := uint32(seed), uint32(seed>>32)
+	mix := func() {
+		hi ^= lo
+		lo = rotl32(lo, 20)
+		lo += hi
+		hi = rotl32(hi, 9)
+		hi ^= lo
+		lo = rotl32(lo, 27)
+		lo += hi
+		hi = rotl32(hi, 19)
+	}
+	for len(data) >= 4 {
+		lo += binary.LittleEndian.Uint32(data)
+		mix()
+		data = data[4:]
+	}
+	final := uint32(0x80)
+	switch len(data) {
+	case 1:
+		final = 0x8000 | uint32(data[0])
+	case 2:
+		final = 0x800000 | uint32(binary.LittleEndian.Uint16(data))
+	case 3:
+		final = 0x80000000 | uint32(data[2])<<16 | uint32(binary.LittleEndian.Uint16(data))
+	}
+	lo += final
+	mix()
+	mix()
+	return uint64(hi)<<32 | uint64(lo)
+}
+
+func rotl32(v uint32, n uint) uint32 {
+	return v<<n | v>>(32-n)
+}
+
+// deletedKey is a key carved from a free cell
+type deletedKey struct {
+	*Key
+	parent uint32 // offset of the parent key cell
+}
+
+// deletedValue is a value carved from a free cell
+type deletedValue struct {
+	Value
+	offset uint32
+}
+
+// Carve scans the free cells of the hive for deleted keys and values.
+// Values still referenced by the values list of a deleted key are returned
+// with their key only.
+func (h *Hive) Carve() (keys []deletedKey, values []deletedValue) {
+	owned := make(map[uint32]bool)
+	var carved []deletedValue
+	h.freeRecords(func(sig string, offset uint32, data []byte) {
+		switch sig {
+		case "nk":
+			k, err := h.parseKey(data, offset, "", 0)
+			if err != nil {
+				return
+			}
+			keys = append(keys, deletedKey{k, binary.LittleEndian.Uint32(data[16:20])})
+			for _, off := range h.valueOffsets(k) {
+				owned[off] = true
+			}
+		case "vk":
+			v, err := h.parseValue(data, offset)
+			if err != nil {
+				// the data of the value was overwritten, keep its name
+				if v.Name == "" {
+					return
+				}
+				v.Data = nil
+			}
+			carved = append(carved, deletedValue{v, offset})
+		}
+	})
+	for _, v := range carved {
+		if !owned[v.offset] {
+			values = append(values, v)
+		}
+	}
+	return
+}
+
+// freeRecords calls fn for every nk or vk record found in free cells. Free
+// cells can be the result of several adjacent deleted cells being merged,
+// so each free cell is scanned for records at every cell boundary.
+func (h *Hive) freeRecords(fn func(sig string, offset uint32, data []byte)) {
+	for bin := regfBaseBlockSize; bin+regfBinHeaderSize <= len(h.buf); {
+		if string(h.buf[bin:bin+4]) != "hbin" {
+			return
+		}
+		binSize := int(binary.LittleEndian.Uint32(h.buf[bin+8 : bin+12]))
+		if binSize < regfBinHeaderSize || bin+binSize > len(h.buf) {
+			return
+		}
+		for pos := bin + regfBinHeaderSize; pos+8 <= bin+binSize; {
+			size := int(int32(binary.LittleEndian.Uint32(h.buf[pos:])))
+			if size == 0 {
+				break
+			}
+			if size < 0 {
+				pos += -size
+				continue
+			}
+			end := pos + size
+			if end > bin+binSize {
+				end = bin + binSize
+			}
+			for rec := pos; rec+6 <= end; rec += 8 {
+				sig := string(h.buf[rec+4 : rec+6])
+				if sig == "nk" || sig == "vk" {
+					fn(sig, uint32(rec-regfBaseBlockSize), h.buf[rec+4:end])
+				}
+			}
+			pos += size
+		}
+		bin += binSize
+	}
+}
+
+// valueOffsets returns the offsets of the value cells of a key, ignoring
+// errors since the values list of a deleted key may have been reused
+func (h *Hive) valueOffsets(k *Key) (offsets []uint32) {
+	if k.nval == 0 || k.values == noCell {
+		return
+	}
+	data, _, err := h.cell(k.values)
+	if err != nil || uint64(k.nval)*4 > uint64(len(data)) {
+		return
+	}
+	for i := uint32(0); i < k.nval; i++ {
+		offsets = append(offsets, binary.LittleEndian.Uint32(data[i*4:]))
+	}
+	return
+}
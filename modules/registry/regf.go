@@ -0,0 +1,457 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package registry /* import "mig.ninja/mig/modules/registry" */
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"mig.ninja/mig/modules/ntfs"
+	"mig.ninja/mig/modules/winbin"
+)
+
+/*
+	Offline reader for registry hive files (regf format).
+
+	A hive starts with a 4096 bytes base block, followed by hive bins. Each
+	hive bin holds cells, and all offsets found in cells are relative to the
+	start of the first hive bin. A cell starts with a signed 32 bit size,
+	negative when the cell is allocated, and positive when it is free.
+
+	Keys are stored in "nk" cells, which point to a list of subkeys ("lf",
+	"lh", "li", or "ri" for lists of lists) and to a list of values ("vk"
+	cells). Value data larger than 16344 bytes is split into segments
+	referenced by a "db" cell.
+*/
+
+const (
+	regfBaseBlockSize = 4096
+	regfBinHeaderSize = 32
+	regfBigDataLimit  = 16344
+
+	// nk flags
+	keyCompName = 0x0020
+
+	// vk flags
+	valueCompName = 0x0001
+
+	// a data size with this bit set means data is stored in the offset field
+	dataInOffset = 0x80000000
+
+	// unset cell offset
+	noCell = 0xffffffff
+
+	// maximum depth of nested keys, protects against cycles in corrupted hives
+	maxKeyDepth = 512
+)
+
+// Registry value types
+const (
+	RegNone                     = 0
+	RegSz                       = 1
+	RegExpandSz                 = 2
+	RegBinary                   = 3
+	RegDword                    = 4
+	RegDwordBigEndian           = 5
+	RegLink                     = 6
+	RegMultiSz                  = 7
+	RegResourceList             = 8
+	RegFullResourceDescriptor   = 9
+	RegResourceRequirementsList = 10
+	RegQword                    = 11
+)
+
+var regTypeNames = map[uint32]string{
+	RegNone:                     "REG_NONE",
+	RegSz:                       "REG_SZ",
+	RegExpandSz:                 "REG_EXPAND_SZ",
+	RegBinary:                   "REG_BINARY",
+	RegDword:                    "REG_DWORD",
+	RegDwordBigEndian:           "REG_DWORD_BIG_ENDIAN",
+	RegLink:                     "REG_LINK",
+	RegMultiSz:                  "REG_MULTI_SZ",
+	RegResourceList:             "REG_RESOURCE_LIST",
+	RegFullResourceDescriptor:   "REG_FULL_RESOURCE_DESCRIPTOR",
+	RegResourceRequirementsList: "REG_RESOURCE_REQUIREMENTS_LIST",
+	RegQword:                    "REG_QWORD",
+}
+
+// Hive is a registry hive loaded in memory
+type Hive struct {
+	Name      string    // name of the hive, usually its file name
+	LastWrite time.Time // last written timestamp of the base block
+	Major     uint32    // major format version
+	Minor     uint32    // minor format version
+
+	buf  []byte // content of the hive, base block included
+	root uint32 // offset of the root key cell
+	seq1 uint32 // primary sequence number, incremented before a write
+	seq2 uint32 // secondary sequence number, incremented after a write
+}
+
+// Key is a registry key read from a hive
+type Key struct {
+	Name      string
+	Path      string // path of the key relative to the root of the hive
+	LastWrite time.Time
+
+	hive    *Hive
+	offset  uint32
+	depth   int
+	subkeys uint32 // offset of the subkeys list
+	nsub    uint32
+	values  uint32 // offset of the values list
+	nval    uint32
+}
+
+// Value is a registry value read from a hive
+type Value struct {
+	Name string
+	Type uint32
+	Data []byte
+}
+
+// OpenHive reads a hive file from disk. The hives of a running system are
+// locked, and are read from their raw volume with raw when it is not nil.
+func OpenHive(path, name string, raw *ntfs.RawFiles) (h *Hive, err error) {
+	buf, err := raw.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseHive(buf, name)
+}
+
+// ParseHive validates the base block of a hive and returns a Hive
+func ParseHive(buf []byte, name string) (h *Hive, err error) {
+	if len(buf) < regfBaseBlockSize+regfBinHeaderSize {
+		return nil, fmt.Errorf("ParseHive: hive is too small (%d bytes)", len(buf))
+	}
+	if string(buf[0:4]) != "regf" {
+		return nil, fmt.Errorf("ParseHive: invalid base block signature")
+	}
+	if string(buf[regfBaseBlockSize:regfBaseBlockSize+4]) != "hbin" {
+		return nil, fmt.Errorf("ParseHive: invalid hive bin signature")
+	}
+	h = &Hive{
+		Name:      name,
+		LastWrite: winbin.Filetime(binary.LittleEndian.Uint64(buf[12:20])),
+		Major:     binary.LittleEndian.Uint32(buf[20:24]),
+		Minor:     binary.LittleEndian.Uint32(buf[24:28]),
+		buf:       buf,
+		root:      binary.LittleEndian.Uint32(buf[36:40]),
+		seq1:      binary.LittleEndian.Uint32(buf[4:8]),
+		seq2:      binary.LittleEndian.Uint32(buf[8:12]),
+	}
+	return h, nil
+}
+
+// Root returns the root key of the hive
+func (h *Hive) Root() (*Key, error) {
+	k, err := h.keyAt(h.root, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	// the path of the root key is empty, so that paths of other keys
+	// start with the name of the first level subkeys
+	k.Path = ""
+	return k, nil
+}
+
+// Walk calls fn for every key of the hive, starting with the root key and
+// descending depth-first. Errors in a subtree are returned to fn through
+// walkErr and do not stop the walk, unless fn returns an error itself.
+func (h *Hive) Walk(fn func(k *Key) error, walkErr func(path string, err error)) error {
+	root, err := h.Root()
+	if err != nil {
+		return err
+	}
+	return h.walk(root, fn, walkErr)
+}
+
+func (h *Hive) walk(k *Key, fn func(k *Key) error, walkErr func(path string, err error)) error {
+	if err := fn(k); err != nil {
+		return err
+	}
+	subkeys, err := k.Subkeys()
+	if err != nil && walkErr != nil {
+		walkErr(k.Path, err)
+	}
+	for _, sk := range subkeys {
+		if err := h.walk(sk, fn, walkErr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cell returns the data of the cell at offset, without its size header,
+// and whether the cell is allocated
+func (h *Hive) cell(offset uint32) (data []byte, allocated bool, err error) {
+	if offset == noCell {
+		return nil, false, fmt.Errorf("cell: unset cell offset")
+	}
+	pos := uint64(regfBaseBlockSize) + uint64(offset)
+	if pos+4 > uint64(len(h.buf)) {
+		return nil, false, fmt.Errorf("cell: offset 0x%x is out of bounds", offset)
+	}
+	size := int32(binary.LittleEndian.Uint32(h.buf[pos:]))
+	allocated = size < 0
+	if allocated {
+		size = -size
+	}
+	if size < 8 || pos+uint64(size) > uint64(len(h.buf)) {
+		return nil, allocated, fmt.Errorf("cell: invalid cell size %d at offset 0x%x", size, offset)
+	}
+	return h.buf[pos+4 : pos+uint64(size)], allocated, nil
+}
+
+// keyAt parses the nk cell at offset
+func (h *Hive) keyAt(offset uint32, parent string, depth int) (*Key, error) {
+	data, _, err := h.cell(offset)
+	if err != nil {
+		return nil, err
+	}
+	return h.parseKey(data, offset, parent, depth)
+}
+
+func (h *Hive) parseKey(data []byte, offset uint32, parent string, depth int) (*Key, error) {
+	if len(data) < 76 || string(data[0:2]) != "nk" {
+		return nil, fmt.Errorf("keyAt: no key cell at offset 0x%x", offset)
+	}
+	flags := binary.LittleEndian.Uint16(data[2:4])
+	nameLen := int(binary.LittleEndian.Uint16(data[72:74]))
+	if 76+nameLen > len(data) {
+		return nil, fmt.Errorf("keyAt: key name overflows cell at offset 0x%x", offset)
+	}
+	k := &Key{
+		Name:      decodeName(data[76:76+nameLen], flags&keyCompName != 0),
+		LastWrite: winbin.Filetime(binary.LittleEndian.Uint64(data[4:12])),
+		hive:      h,
+		offset:    offset,
+		depth:     depth,
+		nsub:      binary.LittleEndian.Uint32(data[20:24]),
+		subkeys:   binary.LittleEndian.Uint32(data[28:32]),
+		nval:      binary.LittleEndian.Uint32(data[36:40]),
+		values:    binary.LittleEndian.Uint32(data[40:44]),
+	}
+	if parent == "" {
+		k.Path = k.Name
+	} else {
+		k.Path = parent + `\` + k.Name
+	}
+	return k, nil
+}
+
+// Subkeys returns the direct subkeys of a key
+func (k *Key) Subkeys() (keys []*Key, err error) {
+	if k.nsub == 0 || k.subkeys == noCell {
+		return nil, nil
+	}
+	if k.depth >= maxKeyDepth {
+		return nil, fmt.Errorf("Subkeys: maximum key depth reached")
+	}
+	offsets, err := k.hive.subkeyOffsets(k.subkeys, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, off := range offsets {
+		sk, err := k.hive.keyAt(off, k.Path, k.depth+1)
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, sk)
+	}
+	return keys, nil
+}
+
+// subkeyOffsets resolves a subkeys list into the offsets of nk cells
+func (h *Hive) subkeyOffsets(offset uint32, depth int) (offsets []uint32, err error) {
+	if depth > 2 {
+		return nil, fmt.Errorf("subkeyOffsets: nested index roots at offset 0x%x", offset)
+	}
+	data, _, err := h.cell(offset)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 {
+		return nil, fmt.Errorf("subkeyOffsets: list too small at offset 0x%x", offset)
+	}
+	count := int(binary.LittleEndian.Uint16(data[2:4]))
+	sig := string(data[0:2])
+	entrySize := 4
+	switch sig {
+	case "lf", "lh":
+		// offsets are followed by a name hint or hash
+		entrySize = 8
+	case "li", "ri":
+	default:
+		return nil, fmt.Errorf("subkeyOffsets: unknown list signature %q at offset 0x%x", sig, offset)
+	}
+	if 4+count*entrySize > len(data) {
+		return nil, fmt.Errorf("subkeyOffsets: list overflows cell at offset 0x%x", offset)
+	}
+	for i := 0; i < count; i++ {
+		off := binary.LittleEndian.Uint32(data[4+i*entrySize:])
+		if sig == "ri" {
+			sub, err := h.subkeyOffsets(off, depth+1)
+			if err != nil {
+				return offsets, err
+			}
+			offsets = append(offsets, sub...)
+			continue
+		}
+		offsets = append(offsets, off)
+	}
+	return offsets, nil
+}
+
+// Values returns the values of a key
+func (k *Key) Values() (values []Value, err error) {
+	if k.nval == 0 || k.values == noCell {
+		return nil, nil
+	}
+	data, _, err := k.hive.cell(k.values)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(k.nval)*4 > uint64(len(data)) {
+		return nil, fmt.Errorf("Values: values list overflows cell at offset 0x%x", k.values)
+	}
+	for i := uint32(0); i < k.nval; i++ {
+		off := binary.LittleEndian.Uint32(data[i*4:])
+		v, err := k.hive.valueAt(off)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// valueAt parses the vk cell at offset, and reads its data
+func (h *Hive) valueAt(offset uint32) (v Value, err error) {
+	data, _, err := h.cell(offset)
+	if err != nil {
+		return
+	}
+	return h.parseValue(data, offset)
+}
+
+func (h *Hive) parseValue(data []byte, offset uint32) (v Value, err error) {
+	if len(data) < 20 || string(data[0:2]) != "vk" {
+		return v, fmt.Errorf("valueAt: no value cell at offset 0x%x", offset)
+	}
+	nameLen := int(binary.LittleEndian.Uint16(data[2:4]))
+	size := binary.LittleEndian.Uint32(data[4:8])
+	dataOffset := binary.LittleEndian.Uint32(data[8:12])
+	v.Type = binary.LittleEndian.Uint32(data[12:16])
+	flags := binary.LittleEndian.Uint16(data[16:18])
+	if 20+nameLen > len(data) {
+		return v, fmt.Errorf("valueAt: value name overflows cell at offset 0x%x", offset)
+	}
+	v.Name = decodeName(data[20:20+nameLen], flags&valueCompName != 0)
+
+	if size&dataInOffset != 0 {
+		// small data is stored directly in the data offset field
+		size &^= dataInOffset
+		if size > 4 {
+			size = 4
+		}
+		v.Data = data[8 : 8+size]
+		return
+	}
+	if size == 0 {
+		return
+	}
+	v.Data, err = h.valueData(dataOffset, size)
+	return
+}
+
+// valueData reads size bytes of value data from the cell at offset,
+// following big data segments when needed
+func (h *Hive) valueData(offset, size uint32) ([]byte, error) {
+	data, _, err := h.cell(offset)
+	if err != nil {
+		return nil, err
+	}
+	if size > regfBigDataLimit && len(data) >= 8 && string(data[0:2]) == "db" {
+		count := int(binary.LittleEndian.Uint16(data[2:4]))
+		list, _, err := h.cell(binary.LittleEndian.Uint32(data[4:8]))
+		if err != nil {
+			return nil, err
+		}
+		if count*4 > len(list) {
+			return nil, fmt.Errorf("valueData: segments list overflows cell at offset 0x%x", offset)
+		}
+		var out []byte
+		for i := 0; i < count && uint32(len(out)) < size; i++ {
+			seg, _, err := h.cell(binary.LittleEndian.Uint32(list[i*4:]))
+			if err != nil {
+				return nil, err
+			}
+			if len(seg) > regfBigDataLimit {
+				seg = seg[:regfBigDataLimit]
+			}
+			out = append(out, seg...)
+		}
+		if uint32(len(out)) > size {
+			out = out[:size]
+		}
+		return out, nil
+	}
+	if size > uint32(len(data)) {
+		return nil, fmt.Errorf("valueData: data overflows cell at offset 0x%x", offset)
+	}
+	return data[:size], nil
+}
+
+// TypeName returns the name of the type of a value, such as REG_SZ
+func (v Value) TypeName() string {
+	if name, ok := regTypeNames[v.Type]; ok {
+		return name
+	}
+	return fmt.Sprintf("REG_UNKNOWN_%d", v.Type)
+}
+
+// String returns a representation of the data of a value based on its type
+func (v Value) String() string {
+	switch v.Type {
+	case RegSz, RegExpandSz, RegLink:
+		return winbin.UTF16String(v.Data)
+	case RegMultiSz:
+		return strings.Join(winbin.UTF16Strings(v.Data), ", ")
+	case RegDword:
+		if len(v.Data) >= 4 {
+			return fmt.Sprintf("%d", binary.LittleEndian.Uint32(v.Data))
+		}
+	case RegDwordBigEndian:
+		if len(v.Data) >= 4 {
+			return fmt.Sprintf("%d", binary.BigEndian.Uint32(v.Data))
+		}
+	case RegQword:
+		if len(v.Data) >= 8 {
+			return fmt.Sprintf("%d", binary.LittleEndian.Uint64(v.Data))
+		}
+	}
+	return hex.EncodeToString(v.Data)
+}
+
+// decodeName decodes a key or value name, stored either as ASCII (latin1)
+// or UTF-16LE depending on the flags of the cell
+func decodeName(b []byte, compressed bool) string {
+	if compressed {
+		r := make([]rune, len(b))
+		for i, c := range b {
+			r[i] = rune(c)
+		}
+		return string(r)
+	}
+	return winbin.UTF16String(b)
+}
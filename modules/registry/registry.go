@@ -6,22 +6,27 @@
 
 /*
 
-If you run it, it will return a JSON struct with array of {hive, key, LastWriteTime}
+If you run it, it will return a JSON struct with array of {hive, key, values, data, LastWriteTime}
 If you add flag `-p`, it will pretty print the
 results.
 
+Hives are read from disk and parsed offline, no external tool is needed.
+On a live system, hives in use are locked by the kernel, and are read from
+the raw NTFS volume instead, as last flushed to disk. `root` can also be
+pointed to a volume shadow copy or to a mounted image. Individual hive files
+can be provided with `paths`.
+
 Example JSON:
 -------------
 {
     "module": "registry",
     "parameters": {
-        "rekall": {
-            "plugin": "hives",
-            "pluginoptions": [
-                ""
+        "hives": {
+            "targethives": [
+                "SOFTWARE",
+                "NTUSER.DAT"
             ],
-            "checkvalues": false,
-            "dumpdirectory": ""
+            "root": "\\\\?\\GLOBALROOT\\Device\\HarddiskVolumeShadowCopy1"
         },
         "search": {
             "searchkeys": [
@@ -47,9 +52,9 @@ import (
 	"fmt"
 	"io"
 	"mig.ninja/mig/modules"
+	"mig.ninja/mig/modules/ntfs"
 	"os"
-	"os/exec"
-	// "regexp"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"time"
@@ -77,41 +82,56 @@ func init() {
 type run struct {
 	Parameters params
 	Results    modules.Result
+	stop       chan bool      // closed when the module is asked to stop early
+	raw        *ntfs.RawFiles // reads the locked hives from their volume
 }
 
 /* a simple parameters structure, the format is arbitrary */
 type params struct {
-	Rekall RekallParams `json:"rekall,omitempty"`
-	RegRip RegRipParams `json:"regrip,omitempty"`
+	Hives  HiveParams   `json:"hives,omitempty"`
 	Search SearchParams `json:"search,omitempty"`
-	Debug  bool         `json:"debug, omitempty"`
+	Debug  bool         `json:"debug,omitempty"`
 }
 
 type elements struct {
 	Results []RegRecord `json:"registryresults,omitempty"`
 }
 
+/*
+	RegRecord is a key that matched the search. Value, Type and Data are
+	parallel arrays holding the name, type and data of the matching values.
+	LastWrite is the last write time of the key, which is unknown for deleted
+	values carved without their key. Times holds the same timestamp, when known.
+	Recovered is set for keys and values that are not visible in the primary
+	hive file, with Source set to "log" if they were found by replaying the
+	transaction logs, or "slack" if they were carved from free cells.
+*/
 type RegRecord struct {
-	Hive      string   `json:"hive,omitempty"`
-	Key       string   `json:"key,omitempty"`
-	Value     []string `json:"value,omitempty"`
-	Data      []string `json:"data,omitempty"`
-	LastWrite string   `json:"lastwrite,omitempty"`
-	// LastWrite time.Time `json:"lastwrite,omitempty"`
-}
-
-type RekallParams struct {
-	Plugin        string   `json:"plugin,omitempty"`
-	PluginOptions []string `json:"pluginoptions,omitempty"`
-	CheckValues   bool     `json:"checkvalues,omitempty"`
-	DumpDirectory string   `json:"dumpdirectory,omitempty"`
-	TargetHives   []string `json:"targethives,omitempty"`
+	Hive      string                 `json:"hive,omitempty"`
+	Key       string                 `json:"key,omitempty"`
+	Value     []string               `json:"value,omitempty"`
+	Type      []string               `json:"type,omitempty"`
+	Data      []string               `json:"data,omitempty"`
+	LastWrite time.Time              `json:"lastwrite"`
+	Times     []modules.ArtefactTime `json:"times,omitempty"`
+	Recovered bool                   `json:"recovered,omitempty"`
+	Source    string                 `json:"source,omitempty"`
 }
 
-type RegRipParams struct {
-	RegDirectory    string   `json:"regdirectory,omitempty"`
-	ReportDirectory string   `json:"reportdirectory,omitempty"`
-	Plugins         []string `json:"plugins,omitempty"`
+/*
+	- TargetHives: Names of the hives to search. Defaults to all of defaultHives.
+	- Root: Alternate root of the system volume, such as a shadow copy or a mounted image.
+			Defaults to %SYSTEMDRIVE%
+	- Paths: Additional hive files to search, e.g. raw copies of hives
+	- ReplayLogs: Apply the .LOG1/.LOG2 transaction logs found next to each hive
+	- CarveDeleted: Recover deleted keys and values from free cells
+*/
+type HiveParams struct {
+	TargetHives  []string `json:"targethives,omitempty"`
+	Root         string   `json:"root,omitempty"`
+	Paths        []string `json:"paths,omitempty"`
+	ReplayLogs   bool     `json:"replaylogs,omitempty"`
+	CarveDeleted bool     `json:"carvedeleted,omitempty"`
 }
 
 type SearchParams struct {
@@ -125,29 +145,30 @@ type SearchParams struct {
 
 /* Statistic counters:
 -
+- KeysSearched is the number of keys walked in all hives, and the
+  <Hive>KeysSearched counters the number of keys walked in each hive
+- NumKeysFound, NumValuesFound and NumDataFound count the keys, value
+  names and value data that matched the search
 - Totalhits is the total number of checklist hits
 - Exectim is the total runtime of all the searches
 */
 type statistics struct {
-	NumKeysFound      int           `json:"numkeysfound"`
-	KeysSearched      int           `json:"keyssearched"`
-	NumValuesFound    int           `json:"numvaluesfound"`
-	NumDataFound      int           `json:"numdatafound"`
-	NumHivesProc      int           `json:"numhivesproc"`
-	RegRipCatExec     int           `json:"regripcatexec"`
-	AutoRunsFound     int           `json:"autorunsfound"`
-	ExecKeysFound     int           `json:"execkeysfound"`
-	StorageKeysFound  int           `json:"storagekeysfound"`
-	NetworkKeysFound  int           `json:"networkkeysfound"`
-	SoftwareKeysFound int           `json:"softwarekeysfound"`
-	SecurityKeysFound int           `json:"securitykeysfound"`
-	SystemKeysFound   int           `json:"systemkeysfound"`
-	SAMKeysFound      int           `json:"samkeysfound"`
-	DefaultKeysFound  int           `json:"defaultkeysfound"`
-	UsersKeysFound    int           `json:"userskeysfound"`
-	WebKeysFound      int           `json:"webkeysfound"`
-	TotalHits         int           `json:"totalhits"`
-	Exectime          time.Duration `json:"exectime"`
+	NumKeysFound         int           `json:"numkeysfound"`
+	KeysSearched         int           `json:"keyssearched"`
+	NumValuesFound       int           `json:"numvaluesfound"`
+	NumDataFound         int           `json:"numdatafound"`
+	NumHivesProc         int           `json:"numhivesproc"`
+	SoftwareKeysSearched int           `json:"softwarekeyssearched"`
+	SecurityKeysSearched int           `json:"securitykeyssearched"`
+	SystemKeysSearched   int           `json:"systemkeyssearched"`
+	SAMKeysSearched      int           `json:"samkeyssearched"`
+	DefaultKeysSearched  int           `json:"defaultkeyssearched"`
+	UsersKeysSearched    int           `json:"userskeyssearched"`
+	AmcacheKeysSearched  int           `json:"amcachekeyssearched"`
+	LogEntriesApplied    int           `json:"logentriesapplied"`
+	NumRecovered         int           `json:"numrecovered"`
+	TotalHits            int           `json:"totalhits"`
+	Exectime             time.Duration `json:"exectime"`
 }
 
 /*
@@ -155,43 +176,23 @@ type statistics struct {
 	passed to the module conform the expected format. It must return an error if the parameters do not validate.
 */
 func (r *run) ValidateParameters() (err error) {
-	// if r.Parameters.CheckHosts || r.Parameters.CheckDns {
-	if r.Parameters.Rekall.CheckValues {
-		if r.Parameters.Rekall.DumpDirectory == "" {
-			return fmt.Errorf("ValidateParameters: SearchHosts parameter is not a valid FQDN.")
-		}
-
-		if r.Parameters.RegRip.ReportDirectory == "" {
-			return fmt.Errorf("ValidateParameters: If CheckValues set then must supply output directory for RegRipper reports.")
-		}
-
-		if r.Parameters.Search.SearchValues == nil && r.Parameters.Search.SearchData == nil {
-			return fmt.Errorf("ValidateParameters: If CheckValues set then must supply both SearchValues & SearchData.")
-		}
+	search := r.Parameters.Search
+	if len(nonEmpty(search.SearchKeys)) == 0 && len(nonEmpty(search.SearchValues)) == 0 &&
+		len(nonEmpty(search.SearchData)) == 0 {
+		return fmt.Errorf("ValidateParameters: At least one of SearchKeys, SearchValues or SearchData must be set.")
 	}
 
-	// if r.Parameters.Search.CheckDateRange {
-	// 	if r.Parameters.Search.StartDate == nil || r.Parameters.Search.EndDate == nil {
-	// 		return fmt.Errorf("ValidateParameters: If CheckDateRange set, both START and END dates must be provided.")
-	// 	}
-	// }
-
-	if r.Parameters.Search.CheckDateRange {
-		if r.Parameters.Search.EndDate.Before(r.Parameters.Search.StartDate) {
+	if search.CheckDateRange {
+		if search.EndDate.Before(search.StartDate) {
 			return fmt.Errorf("ValidateParameters: EndDate is *BEFORE* StartDate.")
 		}
 	}
 
-	// if len(r.Parameters.Search.SearchKeys) > 0 {
-	// 	keys := regexp.MustCompilePOSIX(`^([a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9\-]{0,61}[a-zA-Z0-9])(\.([a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9\-]{0,61}[a-zA-Z0-9]))*$`)
-	// 	for _, key := range r.Parameters.Search.SearchKeys {
-	// 		if !keys.MatchString(key) {
-	// 			return fmt.Errorf("ValidateParameters: SearcKheys parameter is not a valid FQDN.")
-	// 		}
-	// 	}
-	// }
-
-	// re, _ := regexp.Compile(`^(([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\.){3}([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])$`)
+	for _, hive := range r.Parameters.Hives.TargetHives {
+		if _, ok := hiveLocations[strings.ToUpper(hive)]; !ok {
+			return fmt.Errorf("ValidateParameters: Unknown hive %q.", hive)
+		}
+	}
 	return
 }
 
@@ -228,6 +229,7 @@ func (r *run) Run(in io.Reader) (out string) {
 	// start a goroutine that does some work and another one that looks for an early stop signal
 	moduleDone := make(chan bool)
 	stop := make(chan bool)
+	r.stop = make(chan bool)
 	go r.doModuleStuff(&out, &moduleDone)
 	go modules.WatchForStop(in, &stop)
 
@@ -235,7 +237,10 @@ func (r *run) Run(in io.Reader) (out string) {
 	case <-moduleDone:
 		return out
 	case <-stop:
-		panic("stop message received, terminating early")
+		// the module builds its results from what it collected so far
+		close(r.stop)
+		<-moduleDone
+		return out
 	}
 }
 
@@ -247,204 +252,391 @@ func (r *run) doModuleStuff(out *string, moduleDone *chan bool) error {
 	var (
 		el     elements
 		stats  statistics
-		Reg    RegRecord
 		Allreg []RegRecord
 	)
-	RegMap := make(map[string]string)
 
 	t0 := time.Now()
-
-	sysDrivePath := os.Getenv("SYSTEMDRIVE")
-	rekall := sysDrivePath + "\\Rekall\\rekal.exe"
-	usrDir := os.Getenv("USERPROFILE")
 	stats.TotalHits = 0 // counter for found entries
 
-	if r.Parameters.Debug {
-		// fmt.Println("Rekall at: ", rekall)
-		// regRip := sysDrivePath+"\\auto_rip\\auto_rip64.exe"
-		// fmt.Println("OS: ", runtime.GOOS)
+	hiveFiles, err := r.findHives()
+	if err != nil {
+		r.Results.Errors = append(r.Results.Errors, err.Error())
 	}
-
-	if runtime.GOOS != "windows" {
-		return fmt.Errorf("Error: Registry Module must run on Windows Environment only.") // Registry Module only for Windows OS machines
+	if r.raw == nil {
+		r.raw = new(ntfs.RawFiles)
 	}
+	defer r.raw.Close()
 
-	var HiveList []string
-
-	// Default settings will iterate through all hives found by Rekall
-	var SetDefaultToAll bool
-
-	if r.Parameters.Rekall.TargetHives != nil {
-		HiveList = r.Parameters.Rekall.TargetHives
-		SetDefaultToAll = false
-	} else {
-		SetDefaultToAll = true
-		// HiveList = []string{"SECURITY", "SOFTWARE", "SYSTEM", "SAM", "DEFAULT", "ntuser.dat", "Amcache.hve"}
+	/*
+		- For each hive file found:
+			=> Parse the hive and walk every key
+			=> Match key paths, value names and value data against the search parameters
+			=> If requested, replay the transaction logs and carve deleted cells
+	*/
+	for _, hf := range hiveFiles {
+		if modules.IsStopped(r.stop) {
+			r.Results.Errors = append(r.Results.Errors, modules.StoppedEarly)
+			break
+		}
+		if r.Parameters.Debug {
+			fmt.Println("Processing ", hf.path, "....")
+		}
+		hive, err := OpenHive(hf.path, hf.name, r.raw)
+		if err != nil {
+			// users may not all have a NTUSER.DAT, so this is not fatal
+			r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%s: %v", hf.path, err))
+			continue
+		}
+		recs, err := r.searchHive(hive, &stats)
+		if err != nil {
+			r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%s: %v", hf.path, err))
+		}
+		if r.Parameters.Hives.ReplayLogs {
+			hive, recs = r.replayLogs(hf.path, hive, recs, &stats)
+		}
+		if r.Parameters.Hives.CarveDeleted {
+			recs = append(recs, r.carveHive(hive, &stats)...)
+		}
+		Allreg = append(Allreg, recs...)
+		stats.NumHivesProc++
 	}
 
 	/*
-		- Use Rekall to dump hive list with memory offsets
-		---> For each hive argument / hive in default list:
-			=> Dump hive keys & last write date
-			=> Scan output for target keys (with/without regex) and return result []RegRecord list
-		---> If parameterised to check reg key value/data fields, then need to dump entire registry
-			 and use RegRipper to parse data before scanning for entries --> Alot more work!
+		   ------------------------------------------------------
+			After performing all Registry searches, build results
+		   ------------------------------------------------------
 	*/
-	if r.Parameters.Rekall.CheckValues == false {
+	el.Results = Allreg
+	stats.Exectime = time.Now().Sub(t0)
 
-		if r.Parameters.Debug {
-			// fmt.Println("CheckValues: False --> Start extracting hives...")
-			// fmt.Println("Looking for: ", r.Parameters.Search.SearchKeys)
+	// marshal the results into a json string
+	*out = r.buildResults(el, stats)
+	*moduleDone <- true
+	return nil
+
+}
+
+// searchHive walks all keys of a hive and returns the ones matching the
+// search parameters
+func (r *run) searchHive(hive *Hive, stats *statistics) (recs []RegRecord, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("searchHive() -> %v", e)
 		}
-		cmdName := rekall
-		cmdArgs := []string{
-			"--live", "--plugin", r.Parameters.Rekall.Plugin,
+	}()
+	m := newMatcher(r.Parameters.Search)
+	err = hive.Walk(func(k *Key) error {
+		stats.KeysSearched++
+		countHiveKey(hive.Name, stats)
+
+		if !m.matchKey(k.Path, k.LastWrite) {
+			return nil
 		}
+		values, verr := k.Values()
+		if verr != nil {
+			r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%s\\%s: %v", hive.Name, k.Path, verr))
+		}
+		if rec, ok := m.matchValues(hive.Name, k.Path, k.LastWrite, values, stats); ok {
+			recs = append(recs, rec)
+		}
+		return nil
+	}, func(path string, werr error) {
+		r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%s\\%s: %v", hive.Name, path, werr))
+	})
+	return
+}
 
-		cmdOut, err := exec.Command(cmdName, cmdArgs...).Output()
+/*
+	replayLogs applies the transaction logs found next to a hive file, and
+	searches the replayed hive. Records that were not found in the primary
+	file are flagged as recovered from the logs. The replayed hive is
+	returned so it can be carved.
+*/
+func (r *run) replayLogs(path string, hive *Hive, recs []RegRecord, stats *statistics) (*Hive, []RegRecord) {
+	logFiles, err := filepath.Glob(path + ".[Ll][Oo][Gg]*")
+	if err != nil || len(logFiles) == 0 {
+		return hive, recs
+	}
+	var logs [][]byte
+	for _, lf := range logFiles {
+		buf, err := r.raw.ReadFile(lf)
 		if err != nil {
-			panic(err)
+			r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%s: %v", lf, err))
+			continue
 		}
+		logs = append(logs, buf)
+	}
+	replayed, applied, err := hive.Replay(logs...)
+	if err != nil {
+		r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%s: %v", path, err))
+		return hive, recs
+	}
+	if applied == 0 {
+		return hive, recs
+	}
+	stats.LogEntriesApplied += applied
 
-		/* Begin parsing captured output from Rekall Reg Hive dump */
-		var offset, hive string
-		hivesOutput := string(cmdOut)
-		s := strings.Split(hivesOutput, "\n")
+	// the replayed hive supersedes the primary file, so its records
+	// replace the ones found previously
+	var (
+		discard statistics
+		primary = make(map[string]bool)
+	)
+	for _, rec := range recs {
+		primary[rec.id()] = true
+	}
+	stats.TotalHits -= len(recs)
+	replayedRecs, err := r.searchHive(replayed, &discard)
+	if err != nil {
+		r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("%s: %v", path, err))
+	}
+	for i := range replayedRecs {
+		if !primary[replayedRecs[i].id()] {
+			replayedRecs[i].Recovered = true
+			replayedRecs[i].Source = SourceLog
+			stats.NumRecovered++
+		}
+	}
+	stats.TotalHits += len(replayedRecs)
+	return replayed, replayedRecs
+}
 
-		if r.Parameters.Debug {
-			fmt.Println("Checking hives")
-		}
-		for i := 2; i < len(s)-1; i++ {
-
-			line := strings.Fields(s[i])
-			offset = line[3]
-			hive = line[1]
-
-			hiveStr := strings.Split(hive, "\\")
-			hiveStuff := hiveStr[len(hiveStr)-1]
-
-			// Build Map of Hives + Memory offset to use for dumping specific hives later
-			// If using provided params & NOT default, cycle through params, else build map using all hives found
-			if SetDefaultToAll == false {
-				for _, curHive := range HiveList {
-					_, present := RegMap[curHive]
-					if hiveStuff == curHive && present == false {
-						if r.Parameters.Debug {
-							fmt.Println("Processing: ", curHive)
-						}
-
-						/*
-							Rekall dumps multple NTUSER.DAT hives from different directories
-							We look for only the NTUSER.DAT from the user directory ??
-						*/
-						if hive == usrDir+"ntuser.dat" && curHive == "NTUSER.DAT" {
-							RegMap[curHive] = offset
-						} else {
-							if r.Parameters.Debug {
-								fmt.Println("Setting", curHive, "with offset:", offset)
-							}
-							RegMap[curHive] = offset
-						}
-					}
-				}
-			} else {
-				if _, present := RegMap[hive]; present == false {
-					RegMap[hive] = offset
-				}
+// carveHive returns the deleted keys and values of a hive that match the
+// search parameters
+func (r *run) carveHive(hive *Hive, stats *statistics) (recs []RegRecord) {
+	defer func() {
+		if e := recover(); e != nil {
+			r.Results.Errors = append(r.Results.Errors, fmt.Sprintf("carveHive() -> %v", e))
+		}
+	}()
+	// paths of the allocated keys, to rebuild the path of deleted keys
+	// from their parent
+	paths := make(map[uint32]string)
+	hive.Walk(func(k *Key) error {
+		paths[k.offset] = k.Path
+		return nil
+	}, nil)
+
+	m := newMatcher(r.Parameters.Search)
+	keys, values := hive.Carve()
+	for _, dk := range keys {
+		path := dk.Name
+		if parent, ok := paths[dk.parent]; ok && parent != "" {
+			path = parent + `\` + dk.Name
+		}
+		if !m.matchKey(path, dk.LastWrite) {
+			continue
+		}
+		// values of a deleted key may have been overwritten, keep the
+		// ones that are still readable
+		var kvalues []Value
+		for _, off := range hive.valueOffsets(dk.Key) {
+			if v, err := hive.valueAt(off); err == nil {
+				kvalues = append(kvalues, v)
 			}
+		}
+		if rec, ok := m.matchValues(hive.Name, path, dk.LastWrite, kvalues, stats); ok {
+			rec.Recovered = true
+			rec.Source = SourceSlack
+			recs = append(recs, rec)
+			stats.NumRecovered++
+		}
+	}
+	// deleted values that are not attached to a deleted key have no known
+	// key, so they can only match value and data searches
+	if len(m.keys) == 0 && !m.search.CheckDateRange {
+		for _, dv := range values {
+			if rec, ok := m.matchValues(hive.Name, "", time.Time{}, []Value{dv.Value}, stats); ok {
+				rec.Recovered = true
+				rec.Source = SourceSlack
+				recs = append(recs, rec)
+				stats.NumRecovered++
+			}
+		}
+	}
+	return
+}
+
+// matcher holds the normalized search parameters
+type matcher struct {
+	search SearchParams
+	keys   []string
+	values []string
+	data   []string
+}
+
+func newMatcher(search SearchParams) (m matcher) {
+	m.search = search
+	// existing actions separate key names with forward slashes
+	m.keys = lowerAll(nonEmpty(search.SearchKeys))
+	for i := range m.keys {
+		m.keys[i] = strings.Replace(m.keys[i], "/", `\`, -1)
+	}
+	m.values = lowerAll(nonEmpty(search.SearchValues))
+	m.data = lowerAll(nonEmpty(search.SearchData))
+	return
+}
 
+// matchKey checks the path and last write time of a key
+func (m matcher) matchKey(path string, lastWrite time.Time) bool {
+	if len(m.keys) > 0 && !containsAny(strings.ToLower(path), m.keys) {
+		return false
+	}
+	if m.search.CheckDateRange && (lastWrite.Before(m.search.StartDate) || lastWrite.After(m.search.EndDate)) {
+		return false
+	}
+	return true
+}
+
+// matchValues builds the record of a key that passed matchKey, with the
+// values that match the search. When searching for values or data, only
+// keys that have at least one matching value are returned.
+func (m matcher) matchValues(hive, path string, lastWrite time.Time, values []Value, stats *statistics) (rec RegRecord, ok bool) {
+	rec = RegRecord{
+		Hive: hive,
+		Key:  path,
+	}
+	if !lastWrite.IsZero() {
+		rec.LastWrite = lastWrite.UTC()
+		rec.Times = []modules.ArtefactTime{
+			modules.NewArtefactTime(modules.ArtefactTimeLastWrite, lastWrite, "registry"),
+		}
+	}
+	for _, v := range values {
+		data := v.String()
+		if len(m.values) > 0 && !containsAny(strings.ToLower(v.Name), m.values) {
+			continue
+		}
+		if len(m.data) > 0 && !containsAny(strings.ToLower(data), m.data) {
+			continue
+		}
+		if len(m.values) > 0 {
+			stats.NumValuesFound++
 		}
+		if len(m.data) > 0 {
+			stats.NumDataFound++
+		}
+		rec.Value = append(rec.Value, v.Name)
+		rec.Type = append(rec.Type, v.TypeName())
+		rec.Data = append(rec.Data, data)
+	}
+	if (len(m.values) > 0 || len(m.data) > 0) && len(rec.Value) == 0 {
+		return rec, false
+	}
+	if len(m.keys) > 0 {
+		stats.NumKeysFound++
+	}
+	stats.TotalHits++
+	return rec, true
+}
 
-		for hive, offset := range RegMap {
-			if r.Parameters.Debug {
-				fmt.Println("Processing ", hive, "....")
-			}
+// id identifies a record by its content, to compare search results of a
+// hive before and after its logs are replayed
+func (rec RegRecord) id() string {
+	return fmt.Sprintf("%s|%s|%d|%q|%q|%q", rec.Hive, rec.Key, rec.LastWrite.UnixNano(), rec.Value, rec.Type, rec.Data)
+}
+
+/*
+	hiveLocations maps the name of a hive to its location, relative to the
+	root of the system volume. A `*` in the path is expanded to every user
+	profile.
+*/
+var hiveLocations = map[string][]string{
+	"SYSTEM":       {"Windows", "System32", "config", "SYSTEM"},
+	"SOFTWARE":     {"Windows", "System32", "config", "SOFTWARE"},
+	"SAM":          {"Windows", "System32", "config", "SAM"},
+	"SECURITY":     {"Windows", "System32", "config", "SECURITY"},
+	"DEFAULT":      {"Windows", "System32", "config", "DEFAULT"},
+	"NTUSER.DAT":   {"Users", "*", "NTUSER.DAT"},
+	"USRCLASS.DAT": {"Users", "*", "AppData", "Local", "Microsoft", "Windows", "UsrClass.dat"},
+	"AMCACHE.HVE":  {"Windows", "AppCompat", "Programs", "Amcache.hve"},
+}
+
+// defaultHives is the list of hives searched when none is specified
+var defaultHives = []string{"SYSTEM", "SOFTWARE", "SAM", "SECURITY", "DEFAULT", "NTUSER.DAT", "USRCLASS.DAT", "AMCACHE.HVE"}
+
+type hiveFile struct {
+	name string
+	path string
+}
 
-			cmdArgs = []string{
-				"--live",
-				"--plugin",
-				"hivedump",
-				"--hive-offset",
-				offset,
+// findHives returns the list of hive files to search, from the target hives
+// under the root directory, and the explicit hive paths
+func (r *run) findHives() (hives []hiveFile, err error) {
+	targets := r.Parameters.Hives.TargetHives
+	if len(targets) == 0 && len(r.Parameters.Hives.Paths) == 0 {
+		targets = defaultHives
+	}
+	if len(targets) > 0 {
+		root := r.Parameters.Hives.Root
+		if root == "" {
+			if runtime.GOOS != "windows" {
+				return nil, fmt.Errorf("Registry Module must run on Windows Environment only, unless hive root or paths are set.")
 			}
-			cmdOut, err := exec.Command(cmdName, cmdArgs...).Output()
+			root = os.Getenv("SYSTEMDRIVE") + "\\"
+		}
+		for _, target := range targets {
+			name := strings.ToUpper(target)
+			loc := append([]string{root}, hiveLocations[name]...)
+			matches, err := filepath.Glob(filepath.Join(loc...))
 			if err != nil {
-				panic(err)
+				return nil, err
 			}
+			for _, m := range matches {
+				hives = append(hives, hiveFile{name: name, path: m})
+			}
+		}
+	}
+	for _, p := range r.Parameters.Hives.Paths {
+		hives = append(hives, hiveFile{name: strings.ToUpper(filepath.Base(p)), path: p})
+	}
+	return
+}
 
-			hivesOutput = string(cmdOut)
-			s = strings.Split(hivesOutput, "\n")
-			for i := 5; i < len(s); i++ {
-				line := strings.Fields(s[i])
-				if len(line) > 1 {
-					stats.KeysSearched++
-					switch hive {
-					case "SYSTEM":
-						stats.SystemKeysFound++
-					case "SOFTWARE":
-						stats.SoftwareKeysFound++
-					case "SAM":
-						stats.SAMKeysFound++
-					case "ntuser.dat":
-						stats.UsersKeysFound++
-					case "DEFAULT":
-						stats.DefaultKeysFound++
-					}
-				}
-
-				/*
-					Search for Exe's and DLL libraries specified in input parameters
-					- if found, append entry to results slice
-				*/
-
-				for _, targetKey := range r.Parameters.Search.SearchKeys {
-					if len(line) > 1 {
-
-						/* MATCH FOUND */
-						if strings.Contains(line[2], targetKey) {
-							// Form LastWrite value from date + time stamp
-							lastWrite1 := line[0] + " " + line[1]
-
-							if r.Parameters.Search.CheckDateRange == true {
-								// if lastWrite.After(r.Parameters.Search.StartDate) {
-
-								// }
-							} else {
-								Reg.Hive = hive
-								Reg.Key = line[2]
-
-								Reg.LastWrite = lastWrite1
-								// Reg.LastWrite, _ = time.Parse(time.RFC3339, lastWrite1)
-								Allreg = append(Allreg, Reg)
-
-								stats.NumKeysFound++
-								stats.TotalHits++
-							}
-						}
-					}
-				} // End loop through target search keys
-				NumHivesProc++
-			} // End loop through RegHive Dump
-
-		} // End looping through hiveMap
-
-	} else { // case: Rekall.CheckValues == true
-
+// countHiveKey increments the per-hive counter of keys searched
+func countHiveKey(hive string, stats *statistics) {
+	switch hive {
+	case "SYSTEM":
+		stats.SystemKeysSearched++
+	case "SOFTWARE":
+		stats.SoftwareKeysSearched++
+	case "SAM":
+		stats.SAMKeysSearched++
+	case "SECURITY":
+		stats.SecurityKeysSearched++
+	case "NTUSER.DAT", "USRCLASS.DAT":
+		stats.UsersKeysSearched++
+	case "DEFAULT":
+		stats.DefaultKeysSearched++
+	case "AMCACHE.HVE":
+		stats.AmcacheKeysSearched++
 	}
+}
 
-	/*
-		   ------------------------------------------------------
-			After performing all Registry searches, build results
-		   ------------------------------------------------------
-	*/
-	el.Results = Allreg
-	stats.Exectime = time.Now().Sub(t0)
+func nonEmpty(list []string) (out []string) {
+	for _, s := range list {
+		if s != "" {
+			out = append(out, s)
+		}
+	}
+	return
+}
 
-	// marshal the results into a json string
-	*out = r.buildResults(el, stats)
-	*moduleDone <- true
-	return nil
+func lowerAll(list []string) []string {
+	out := make([]string, len(list))
+	for i, s := range list {
+		out[i] = strings.ToLower(s)
+	}
+	return out
+}
 
+func containsAny(s string, list []string) bool {
+	for _, l := range list {
+		if strings.Contains(s, l) {
+			return true
+		}
+	}
+	return false
 }
 
 // buildResults takes the results found by the module, as well as statistics,
@@ -480,8 +672,13 @@ func (r *run) PrintResults(result modules.Result, matchOnly bool) (prints []stri
 	}
 	prints = append(prints, fmt.Sprintf("\n-----------------\n     Registry Results           \n------------------"))
 	for _, reg := range el.Results {
-		prints = append(prints, fmt.Sprintf("Hive: %s, Reg Key Found: %s, Last Modified: %s", reg.Hive, reg.Key, reg.LastWrite))
-		prints = append(prints, fmt.Sprintf("Hive: %s, Reg Key Found: %s, Last Modified: %s", reg.Hive, reg.Key, reg.LastWrite))
+		prints = append(prints, fmt.Sprintf("Hive: %s, Reg Key Found: %s, Last Modified: %s", reg.Hive, reg.Key, reg.LastWrite.Format(time.RFC3339)))
+		if reg.Recovered {
+			prints = append(prints, fmt.Sprintf("    Recovered from: %s", reg.Source))
+		}
+		for i := range reg.Value {
+			prints = append(prints, fmt.Sprintf("    Value: %s, Type: %s, Data: %s", reg.Value[i], reg.Type[i], reg.Data[i]))
+		}
 	}
 
 	for _, e := range result.Errors {
@@ -494,8 +691,9 @@ func (r *run) PrintResults(result modules.Result, matchOnly bool) (prints []stri
 
 	prints = append(prints, fmt.Sprintf("Keys Searched  : %d", stats.KeysSearched))
 	prints = append(prints, fmt.Sprintf("Keys Found     : %d", stats.NumKeysFound))
-	// prints = append(prints, fmt.Sprintf("Values Found   : %d", stats.NumValuesFound))
+	prints = append(prints, fmt.Sprintf("Values Found   : %d", stats.NumValuesFound))
 	prints = append(prints, fmt.Sprintf("Hives Processed: %d", stats.NumHivesProc))
+	prints = append(prints, fmt.Sprintf("Recovered      : %d", stats.NumRecovered))
 	prints = append(prints, fmt.Sprintf("Total Hits     : %d", stats.TotalHits))
 	// prints = append(prints, fmt.Sprintf("Exec Time      : %v", stats.Exectime))
 
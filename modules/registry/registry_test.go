@@ -0,0 +1,528 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package registry /* import "mig.ninja/mig/modules/registry" */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"mig.ninja/mig/modules"
+	"mig.ninja/mig/modules/ntfs"
+	"mig.ninja/mig/testutil"
+)
+
+func TestRegistration(t *testing.T) {
+	testutil.CheckModuleRegistration(t, "registry")
+}
+
+var (
+	testRunKeyTime = time.Date(2016, 9, 1, 10, 20, 30, 0, time.UTC)
+	testOldTime    = time.Date(2014, 2, 3, 4, 5, 6, 0, time.UTC)
+	testBigData    = bytes.Repeat([]byte("MZ\x90\x00"), 5000)
+)
+
+// testSoftwareHive returns the description of a small SOFTWARE hive
+func testSoftwareHive() *testutil.HiveKey {
+	run := &testutil.HiveKey{
+		Name:      "Run",
+		LastWrite: testRunKeyTime,
+		Values: []testutil.HiveValue{
+			{Name: "Explerer", Type: RegSz, Data: testutil.EncodeUTF16z(`C:\Users\Public\explerer.exe`)},
+			{Name: "Count", Type: RegDword, Data: []byte{5, 0, 0, 0}},
+			{Name: "Paths", Type: RegMultiSz, Data: append(append(testutil.EncodeUTF16z(`C:\a`), testutil.EncodeUTF16z(`C:\b`)...), 0, 0)},
+			{Name: "Blob", Type: RegBinary, Data: testBigData},
+		},
+		DeletedValues: []testutil.HiveValue{
+			{Name: "Backdoor", Type: RegExpandSz, Data: testutil.EncodeUTF16z(`%TEMP%\backdoor.exe`)},
+		},
+	}
+	runOnce := &testutil.HiveKey{
+		Name:      "RunOnce",
+		LastWrite: testRunKeyTime,
+		Deleted:   true,
+		Values: []testutil.HiveValue{
+			{Name: "Dropper", Type: RegSz, Data: testutil.EncodeUTF16z(`C:\Windows\Temp\drop.exe`)},
+		},
+	}
+	classes := &testutil.HiveKey{Name: "Classes", LastWrite: testOldTime, IndexRoot: true}
+	for _, n := range []string{".exe", ".dll", ".txt"} {
+		classes.Subkeys = append(classes.Subkeys, &testutil.HiveKey{Name: n, LastWrite: testOldTime})
+	}
+	return &testutil.HiveKey{
+		Name:      "CMI-CreateHive{199DAFC2-6F16-4946-BF90-5A3FC3A60902}",
+		LastWrite: testOldTime,
+		Subkeys: []*testutil.HiveKey{
+			classes,
+			{Name: "Microsoft", LastWrite: testOldTime, Subkeys: []*testutil.HiveKey{
+				{Name: "Windows", LastWrite: testOldTime, Subkeys: []*testutil.HiveKey{
+					{Name: "CurrentVersion", LastWrite: testOldTime, Subkeys: []*testutil.HiveKey{run, runOnce}},
+				}},
+			}},
+			{Name: "Ünïcode", UTF16: true, LastWrite: testOldTime},
+		},
+	}
+}
+
+func TestParseHive(t *testing.T) {
+	hive, err := ParseHive(testutil.BuildHive(testSoftwareHive()), "SOFTWARE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	var run *Key
+	err = hive.Walk(func(k *Key) error {
+		paths = append(paths, k.Path)
+		if k.Name == "Run" {
+			run = k
+		}
+		return nil
+	}, func(path string, err error) {
+		t.Fatalf("%s: %v", path, err)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"", `Classes`, `Classes\.exe`, `Classes\.dll`, `Classes\.txt`,
+		`Microsoft`, `Microsoft\Windows`, `Microsoft\Windows\CurrentVersion`,
+		`Microsoft\Windows\CurrentVersion\Run`, `Ünïcode`,
+	}
+	if strings.Join(paths, "|") != strings.Join(expected, "|") {
+		t.Fatalf("unexpected keys %q", paths)
+	}
+	if run == nil || !run.LastWrite.Equal(testRunKeyTime) {
+		t.Fatalf("unexpected run key %+v", run)
+	}
+	values, err := run.Values()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 4 {
+		t.Fatalf("expected 4 values, got %d", len(values))
+	}
+	checks := []struct{ name, vtype, data string }{
+		{"Explerer", "REG_SZ", `C:\Users\Public\explerer.exe`},
+		{"Count", "REG_DWORD", "5"},
+		{"Paths", "REG_MULTI_SZ", `C:\a, C:\b`},
+	}
+	for i, c := range checks {
+		if values[i].Name != c.name || values[i].TypeName() != c.vtype || values[i].String() != c.data {
+			t.Fatalf("unexpected value %s %s %s", values[i].Name, values[i].TypeName(), values[i].String())
+		}
+	}
+	if !bytes.Equal(values[3].Data, testBigData) {
+		t.Fatalf("big data value has %d bytes, expected %d", len(values[3].Data), len(testBigData))
+	}
+}
+
+// TestParseRealHive parses the user hive of a Windows XP system, with keys
+// and values checked against the regparser tool
+func TestParseRealHive(t *testing.T) {
+	hive, err := OpenHive(filepath.Join("testdata", "NTUSER.DAT"), "NTUSER.DAT", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make(map[string]*Key)
+	err = hive.Walk(func(k *Key) error {
+		keys[k.Path] = k
+		return nil
+	}, func(path string, err error) {
+		t.Fatalf("%s: %v", path, err)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, lastWrite := range map[string]time.Time{
+		``:                      time.Date(2009, 8, 4, 15, 13, 44, 0, time.UTC),
+		`Software`:              time.Date(2009, 8, 4, 15, 21, 33, 0, time.UTC),
+		`Software\Jetico`:       time.Date(2009, 8, 4, 15, 21, 33, 0, time.UTC),
+		`Environment`:           time.Date(2009, 8, 4, 15, 12, 23, 0, time.UTC),
+		`Control Panel\Desktop`: time.Date(2009, 8, 4, 15, 22, 17, 0, time.UTC),
+	} {
+		k, ok := keys[path]
+		if !ok {
+			t.Fatalf("key %q not found", path)
+		}
+		if !k.LastWrite.Truncate(time.Second).Equal(lastWrite) {
+			t.Fatalf("expected key %q written at %s, got %s", path, lastWrite, k.LastWrite)
+		}
+	}
+	checks := []struct{ path, name, vtype, data string }{
+		{`Environment`, "TEMP", "REG_EXPAND_SZ", `%USERPROFILE%\Local Settings\Temp`},
+		{`Console`, "CursorSize", "REG_DWORD", "25"},
+		{`Console`, "ColorTable15", "REG_DWORD", "16777215"},
+		{`Control Panel\Desktop`, "SCRNSAVE.EXE", "REG_SZ", `C:\WINDOWS\System32\logon.scr`},
+		{`Control Panel\Desktop`, "UserPreferencesMask", "REG_BINARY", "9e3e0780"},
+	}
+	for _, c := range checks {
+		values, err := keys[c.path].Values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, v := range values {
+			if v.Name != c.name {
+				continue
+			}
+			found = true
+			if v.TypeName() != c.vtype || v.String() != c.data {
+				t.Fatalf("unexpected value %s\\%s %s %s", c.path, v.Name, v.TypeName(), v.String())
+			}
+		}
+		if !found {
+			t.Fatalf("value %s\\%s not found", c.path, c.name)
+		}
+	}
+}
+
+func TestParseInvalidHive(t *testing.T) {
+	buf := testutil.BuildHive(testSoftwareHive())
+	if _, err := ParseHive(buf[:1000], "SOFTWARE"); err == nil {
+		t.Fatal("expected error on truncated hive")
+	}
+	copy(buf, "fger")
+	if _, err := ParseHive(buf, "SOFTWARE"); err == nil {
+		t.Fatal("expected error on invalid signature")
+	}
+	// point the root key to a value cell
+	buf = testutil.BuildHive(testSoftwareHive())
+	binary.LittleEndian.PutUint32(buf[36:], 0xffff0)
+	hive, err := ParseHive(buf, "SOFTWARE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hive.Root(); err == nil {
+		t.Fatal("expected error on invalid root cell")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migregistry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "SOFTWARE")
+	err = ioutil.WriteFile(path, testutil.BuildHive(testSoftwareHive()), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		search   SearchParams
+		expected int
+		values   int
+	}{
+		{SearchParams{SearchKeys: []string{`currentversion\run`}}, 1, 4},
+		{SearchParams{SearchKeys: []string{`classes`}}, 4, 0},
+		{SearchParams{SearchData: []string{`EXPLERER.exe`}}, 1, 1},
+		{SearchParams{SearchKeys: []string{`run`}, SearchValues: []string{`count`, `paths`}}, 1, 2},
+		{SearchParams{SearchKeys: []string{`run`}, SearchValues: []string{`notthere`}}, 0, 0},
+		{SearchParams{SearchKeys: []string{`run`}, CheckDateRange: true,
+			StartDate: testRunKeyTime.Add(-time.Hour), EndDate: testRunKeyTime.Add(time.Hour)}, 1, 4},
+		{SearchParams{SearchKeys: []string{`run`}, CheckDateRange: true,
+			StartDate: testRunKeyTime.Add(time.Hour), EndDate: testRunKeyTime.Add(2 * time.Hour)}, 0, 0},
+	} {
+		var r run
+		r.Parameters.Hives.Paths = []string{path}
+		r.Parameters.Search = tc.search
+		el, res := runSearch(t, r)
+		if len(el.Results) != tc.expected {
+			t.Fatalf("search %+v: expected %d results, got %d", tc.search, tc.expected, len(el.Results))
+		}
+		if len(res.Errors) > 0 {
+			t.Fatalf("search %+v: unexpected errors %v", tc.search, res.Errors)
+		}
+		if tc.expected == 0 {
+			continue
+		}
+		rec := el.Results[0]
+		if rec.Hive != "SOFTWARE" || len(rec.Value) != tc.values || len(rec.Data) != tc.values || len(rec.Type) != tc.values {
+			t.Fatalf("search %+v: unexpected record %+v", tc.search, rec)
+		}
+		if rec.LastWrite.IsZero() || rec.LastWrite.Location() != time.UTC || len(rec.Times) != 1 ||
+			rec.Times[0].Kind != modules.ArtefactTimeLastWrite || !rec.Times[0].Time.Equal(rec.LastWrite) {
+			t.Fatalf("search %+v: unexpected last write time %+v", tc.search, rec)
+		}
+	}
+
+	// all the keys are searched, and the matching ones are found
+	var r run
+	r.Parameters.Hives.Paths = []string{path}
+	r.Parameters.Search.SearchKeys = []string{`classes`}
+	_, res := runSearch(t, r)
+	var stats statistics
+	if err := res.GetStatistics(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.KeysSearched != 10 || stats.SoftwareKeysSearched != 10 || stats.NumKeysFound != 4 || stats.NumHivesProc != 1 {
+		t.Fatalf("unexpected statistics %+v", stats)
+	}
+}
+
+func TestMissingHive(t *testing.T) {
+	var r run
+	r.Parameters.Hives.Paths = []string{"/nonexistent/NTUSER.DAT"}
+	r.Parameters.Search.SearchKeys = []string{"run"}
+	_, res := runSearch(t, r)
+	if len(res.Errors) != 1 || res.FoundAnything {
+		t.Fatalf("expected a single error, got %+v", res)
+	}
+}
+
+// TestLockedHive searches the hives of a live system, which are locked and
+// read from the raw volume
+func TestLockedHive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migregistry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	software := testutil.BuildHive(testSoftwareHive())
+	var r run
+	r.raw = &ntfs.RawFiles{Volume: testutil.LockFiles(t, dir, map[string][]byte{
+		"Windows/System32/config/SOFTWARE":      software,
+		"Windows/System32/config/SOFTWARE.LOG1": buildLog(software, 1),
+	})}
+	r.Parameters.Hives.Root = dir
+	r.Parameters.Hives.TargetHives = []string{"SOFTWARE"}
+	r.Parameters.Hives.ReplayLogs = true
+	r.Parameters.Search.SearchKeys = []string{`currentversion\run`}
+	el, res := runSearch(t, r)
+	if len(res.Errors) > 0 {
+		t.Fatalf("unexpected errors %v", res.Errors)
+	}
+	if len(el.Results) != 1 || el.Results[0].Key != `Microsoft\Windows\CurrentVersion\Run` {
+		t.Fatalf("unexpected results %+v", el.Results)
+	}
+
+	// without the raw volume, the locked hive is reported
+	r = run{raw: new(ntfs.RawFiles)}
+	r.Parameters.Hives.Root = dir
+	r.Parameters.Hives.TargetHives = []string{"SOFTWARE"}
+	r.Parameters.Search.SearchKeys = []string{`currentversion\run`}
+	el, res = runSearch(t, r)
+	if len(el.Results) != 0 || len(res.Errors) != 1 || !strings.Contains(res.Errors[0], "raw volume") {
+		t.Fatalf("expected an error reading the locked hive, got %+v", res.Errors)
+	}
+}
+
+func runSearch(t *testing.T, r run) (el elements, res modules.Result) {
+	msg, err := modules.MakeMessage(modules.MsgClassParameters, r.Parameters, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := r.Run(bytes.NewBuffer(msg))
+	err = json.Unmarshal([]byte(out), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = res.GetElements(&el)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// setSequence sets the primary and secondary sequence numbers of a hive
+// or log base block
+func setSequence(buf []byte, seq1, seq2 uint32) {
+	binary.LittleEndian.PutUint32(buf[4:], seq1)
+	binary.LittleEndian.PutUint32(buf[8:], seq2)
+}
+
+// buildLog generates a new format transaction log holding a single entry,
+// which marks all the hive bins of hive as dirty
+func buildLog(hive []byte, seq uint32) []byte {
+	bins := hive[regfBaseBlockSize:]
+	log := make([]byte, regfLogHeaderSize)
+	copy(log, hive[:regfLogHeaderSize])
+	setSequence(log, seq, seq)
+	binary.LittleEndian.PutUint32(log[28:], 6)
+
+	entry := make([]byte, 40)
+	copy(entry, "HvLE")
+	binary.LittleEndian.PutUint32(entry[12:], seq)
+	binary.LittleEndian.PutUint32(entry[16:], uint32(len(bins)))
+	binary.LittleEndian.PutUint32(entry[20:], 1)
+	entry = testutil.AppendUint32(entry, 0)
+	entry = testutil.AppendUint32(entry, uint32(len(bins)))
+	entry = append(entry, bins...)
+	if pad := len(entry) % regfSectorSize; pad != 0 {
+		entry = append(entry, make([]byte, regfSectorSize-pad)...)
+	}
+	binary.LittleEndian.PutUint32(entry[4:], uint32(len(entry)))
+	binary.LittleEndian.PutUint64(entry[24:], marvin32(entry[40:], marvin32Seed))
+	binary.LittleEndian.PutUint64(entry[32:], marvin32(entry[0:32], marvin32Seed))
+	return append(log, entry...)
+}
+
+// buildOldLog generates an old format transaction log, where all the
+// sectors of the hive bins of hive are dirty
+func buildOldLog(hive []byte, seq uint32) []byte {
+	bins := hive[regfBaseBlockSize:]
+	log := make([]byte, regfLogHeaderSize)
+	copy(log, hive[:regfLogHeaderSize])
+	setSequence(log, seq, seq)
+	binary.LittleEndian.PutUint32(log[28:], 1)
+	log = append(log, "DIRT"...)
+	nsectors := len(bins) / regfSectorSize
+	log = append(log, bytes.Repeat([]byte{0xff}, nsectors/8)...)
+	if pad := len(log) % regfSectorSize; pad != 0 {
+		log = append(log, make([]byte, regfSectorSize-pad)...)
+	}
+	return append(log, bins...)
+}
+
+func TestReplayLogs(t *testing.T) {
+	primary := testutil.BuildHive(testSoftwareHive())
+	updated := testSoftwareHive()
+	// the logged write replaces the data of a value in place, so the layout
+	// of the cells is unchanged
+	runKey := updated.Subkeys[1].Subkeys[0].Subkeys[0].Subkeys[0]
+	runKey.Values[0].Data = testutil.EncodeUTF16z(`C:\Users\Public\updater1.exe`)
+	flushed := testutil.BuildHive(updated)
+	// the write of sequence 5 to the primary file did not complete
+	setSequence(primary, 5, 4)
+
+	for _, tc := range []struct {
+		name    string
+		log     []byte
+		applied bool
+	}{
+		{"new format", buildLog(flushed, 4), true},
+		{"old format", buildOldLog(flushed, 4), true},
+		{"stale log", buildLog(flushed, 3), false},
+	} {
+		hive, err := ParseHive(primary, "SOFTWARE")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hive.Dirty() {
+			t.Fatalf("%s: expected dirty hive", tc.name)
+		}
+		replayed, applied, err := hive.Replay(tc.log)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if (applied > 0) != tc.applied {
+			t.Fatalf("%s: unexpected number of applied entries %d", tc.name, applied)
+		}
+		if replayed.Dirty() {
+			t.Fatalf("%s: replayed hive is still dirty", tc.name)
+		}
+		expected := `C:\Users\Public\explerer.exe`
+		if tc.applied {
+			expected = `C:\Users\Public\updater1.exe`
+		}
+		replayed.Walk(func(k *Key) error {
+			if k.Name != "Run" {
+				return nil
+			}
+			values, err := k.Values()
+			if err != nil || values[0].String() != expected {
+				t.Fatalf("%s: unexpected run key values %v, %v", tc.name, values, err)
+			}
+			return nil
+		}, nil)
+	}
+
+	// corrupt the content of the entry, which must then be ignored
+	log := buildLog(flushed, 4)
+	log[len(log)-1] ^= 0xff
+	hive, err := ParseHive(primary, "SOFTWARE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, applied, err := hive.Replay(log); err != nil || applied != 0 {
+		t.Fatalf("expected corrupted entry to be ignored, got %d applied, %v", applied, err)
+	}
+
+	dir, err := ioutil.TempDir("", "migregistry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "SOFTWARE")
+	if err := ioutil.WriteFile(path, primary, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path+".LOG1", buildLog(flushed, 4), 0640); err != nil {
+		t.Fatal(err)
+	}
+	var r run
+	r.Parameters.Hives.Paths = []string{path}
+	r.Parameters.Hives.ReplayLogs = true
+	r.Parameters.Search.SearchKeys = []string{`currentversion\run`}
+	el, res := runSearch(t, r)
+	if len(res.Errors) > 0 {
+		t.Fatalf("unexpected errors %v", res.Errors)
+	}
+	if len(el.Results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(el.Results))
+	}
+	rec := el.Results[0]
+	if !rec.Recovered || rec.Source != SourceLog || len(rec.Data) != 4 || rec.Data[0] != `C:\Users\Public\updater1.exe` {
+		t.Fatalf("unexpected record %+v", rec)
+	}
+}
+
+func TestCarveDeleted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migregistry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "SOFTWARE")
+	err = ioutil.WriteFile(path, testutil.BuildHive(testSoftwareHive()), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		search   SearchParams
+		carve    bool
+		expected int
+		key      string
+		value    string
+	}{
+		{SearchParams{SearchKeys: []string{`runonce`}}, false, 0, "", ""},
+		{SearchParams{SearchKeys: []string{`runonce`}}, true, 1, `Microsoft\Windows\CurrentVersion\RunOnce`, "Dropper"},
+		{SearchParams{SearchData: []string{`drop.exe`}}, true, 1, `Microsoft\Windows\CurrentVersion\RunOnce`, "Dropper"},
+		{SearchParams{SearchData: []string{`backdoor.exe`}}, false, 0, "", ""},
+		{SearchParams{SearchData: []string{`backdoor.exe`}}, true, 1, "", "Backdoor"},
+		// orphan values have no key to match
+		{SearchParams{SearchKeys: []string{`run`}, SearchData: []string{`backdoor.exe`}}, true, 0, "", ""},
+	} {
+		var r run
+		r.Parameters.Hives.Paths = []string{path}
+		r.Parameters.Hives.CarveDeleted = tc.carve
+		r.Parameters.Search = tc.search
+		el, res := runSearch(t, r)
+		if len(res.Errors) > 0 {
+			t.Fatalf("search %+v: unexpected errors %v", tc.search, res.Errors)
+		}
+		if len(el.Results) != tc.expected {
+			t.Fatalf("search %+v: expected %d results, got %d", tc.search, tc.expected, len(el.Results))
+		}
+		if tc.expected == 0 {
+			continue
+		}
+		rec := el.Results[0]
+		if !rec.Recovered || rec.Source != SourceSlack || rec.Key != tc.key ||
+			len(rec.Value) != 1 || rec.Value[0] != tc.value {
+			t.Fatalf("search %+v: unexpected record %+v", tc.search, rec)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+// Package winbin decodes the little endian integers, UTF-16 strings and
+// FILETIME timestamps found in the binary artifacts of Windows systems. It is
+// shared by the modules that parse these artifacts.
+package winbin /* import "mig.ninja/mig/modules/winbin" */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+	"unicode/utf16"
+)
+
+// FiletimeEpochDelta is the number of 100ns intervals between 1601-01-01 and
+// 1970-01-01
+const FiletimeEpochDelta = 116444736000000000
+
+// Filetime converts a Windows FILETIME into a UTC time, returning the zero
+// time for unset values
+func Filetime(ft uint64) time.Time {
+	if ft < FiletimeEpochDelta {
+		return time.Time{}
+	}
+	ns := (ft - FiletimeEpochDelta) * 100
+	return time.Unix(int64(ns/1e9), int64(ns%1e9)).UTC()
+}
+
+// UTF16String decodes a UTF-16LE string, stopping at the first null character
+func UTF16String(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
+
+// UTF16Strings decodes a list of null terminated UTF-16LE strings, which ends
+// at the first empty string
+func UTF16Strings(b []byte) (out []string) {
+	var u []uint16
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			if len(u) == 0 {
+				break
+			}
+			out = append(out, string(utf16.Decode(u)))
+			u = u[:0]
+			continue
+		}
+		u = append(u, c)
+	}
+	if len(u) > 0 {
+		out = append(out, string(utf16.Decode(u)))
+	}
+	return
+}
+
+// Slice returns size bytes of b starting at off. The parsers read offsets
+// and sizes from untrusted files, so Slice panics with a readable error when
+// the requested range is outside of the buffer, and the parsers recover from
+// it into an error.
+func Slice(b []byte, off, size int) []byte {
+	if off < 0 || size < 0 || off > len(b) || size > len(b)-off {
+		panic(fmt.Sprintf("offset %d+%d is out of bounds (size %d)", off, size, len(b)))
+	}
+	return b[off : off+size]
+}
+
+// Le16 returns the little endian uint16 at offset off of b
+func Le16(b []byte, off int) uint16 {
+	return binary.LittleEndian.Uint16(Slice(b, off, 2))
+}
+
+// Le32 returns the little endian uint32 at offset off of b
+func Le32(b []byte, off int) uint32 {
+	return binary.LittleEndian.Uint32(Slice(b, off, 4))
+}
+
+// Le64 returns the little endian uint64 at offset off of b
+func Le64(b []byte, off int) uint64 {
+	return binary.LittleEndian.Uint64(Slice(b, off, 8))
+}
@@ -0,0 +1,62 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package winbin /* import "mig.ninja/mig/modules/winbin" */
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"mig.ninja/mig/testutil"
+)
+
+func TestFiletime(t *testing.T) {
+	ts := time.Date(2017, 3, 14, 15, 9, 26, 535897900, time.UTC)
+	if got := Filetime(testutil.Filetime(ts)); !got.Equal(ts) {
+		t.Fatalf("expected %s, got %s", ts, got)
+	}
+	for _, ft := range []uint64{0, FiletimeEpochDelta - 1} {
+		if !Filetime(ft).IsZero() {
+			t.Fatalf("expected the zero time for %d, got %s", ft, Filetime(ft))
+		}
+	}
+}
+
+func TestUTF16Strings(t *testing.T) {
+	b := testutil.EncodeUTF16z(`C:\Windows\notepad.exe`)
+	if s := UTF16String(append(b, testutil.EncodeUTF16("garbage")...)); s != `C:\Windows\notepad.exe` {
+		t.Fatalf("unexpected string %q", s)
+	}
+	var multi []byte
+	for _, s := range []string{"one", "twö", "three"} {
+		multi = append(multi, testutil.EncodeUTF16z(s)...)
+	}
+	multi = append(multi, 0, 0)
+	multi = append(multi, testutil.EncodeUTF16z("after the end")...)
+	if got := UTF16Strings(multi); !reflect.DeepEqual(got, []string{"one", "twö", "three"}) {
+		t.Fatalf("unexpected strings %q", got)
+	}
+}
+
+func TestSlice(t *testing.T) {
+	b := testutil.AppendUint64(testutil.AppendUint32(testutil.AppendUint16(nil, 0x1234), 0xdeadbeef), 42)
+	if Le16(b, 0) != 0x1234 || Le32(b, 2) != 0xdeadbeef || Le64(b, 6) != 42 {
+		t.Fatalf("unexpected integers in %x", b)
+	}
+	for _, r := range []struct{ off, size int }{
+		{-1, 2}, {0, -1}, {len(b) - 1, 2}, {len(b) + 1, 0}, {1, int(^uint(0) >> 1)},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("no panic for %d bytes at offset %d", r.size, r.off)
+				}
+			}()
+			Slice(b, r.off, r.size)
+		}()
+	}
+}
@@ -0,0 +1,606 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Julien Vehent jvehent@mozilla.com [:ulfr]
+
+package yara /* import "mig.ninja/mig/modules/yara" */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"regexp"
+	"strings"
+)
+
+/*
+	Conditions are parsed into a tree of the expressions below, and
+	evaluated on each scan. The values of the expressions are integers, which
+	includes the booleans, texts, objects of the modules, or undefined when
+	they cannot be computed, such as the offset of a string that did not
+	match or a field of the pe module on a file that is not a PE. As in
+	YARA, undefined values are false in the boolean operators, and make the
+	other operators undefined.
+*/
+
+type expr interface{}
+
+type (
+	boolLit  bool
+	intLit   int64
+	textLit  string
+	regexLit struct {
+		re *regexp.Regexp
+	}
+	filesizeExpr struct{}
+	// stringRef is $a, $a at x or $a in (lo..hi). The strings are
+	// referenced by their index in the rule, -1 being the string of the
+	// current iteration of a for ... of loop.
+	stringRef struct {
+		index      int
+		at, lo, hi expr
+	}
+	// stringCount is #a or #a in (lo..hi)
+	stringCount struct {
+		index  int
+		lo, hi expr
+	}
+	// stringOffset is @a[n], or !a[n] for the length of the match
+	stringOffset struct {
+		index  int
+		n      expr
+		length bool
+	}
+	ruleRef struct {
+		name string
+	}
+	varRef struct {
+		name string
+	}
+	moduleRef struct {
+		name string
+	}
+	memberExpr struct {
+		x    expr
+		name string
+	}
+	indexExpr struct {
+		x, index expr
+	}
+	callExpr struct {
+		x    expr
+		args []expr
+	}
+	// readInt is uint8(x), int32be(x), ...
+	readInt struct {
+		size      int
+		signed    bool
+		bigEndian bool
+		x         expr
+	}
+	unaryExpr struct {
+		op string
+		x  expr
+	}
+	binaryExpr struct {
+		op   string
+		x, y expr
+	}
+	// ofExpr is "any of ($a*)", or "for all of them : ( $ at 0 )" when
+	// cond is set
+	ofExpr struct {
+		quant   quantifier
+		strings []int
+		cond    expr
+	}
+	// forInExpr is a loop over a range, a list or an array of a module
+	forInExpr struct {
+		quant  quantifier
+		name   string
+		lo, hi expr
+		list   []expr
+		array  expr
+		cond   expr
+	}
+)
+
+// quantifier is all, any, none or a number of items
+type quantifier struct {
+	kind string
+	n    expr
+}
+
+type valueKind int
+
+const (
+	undefined valueKind = iota
+	integer
+	text
+	object
+)
+
+// value is the value of an expression
+type value struct {
+	kind valueKind
+	i    int64
+	s    string
+	o    interface{}
+}
+
+var undef = value{}
+
+func intValue(i int64) value { return value{kind: integer, i: i} }
+
+func boolValue(b bool) value {
+	if b {
+		return intValue(1)
+	}
+	return intValue(0)
+}
+
+// truth returns the boolean value of a value, undefined values are false
+func (v value) truth() bool {
+	switch v.kind {
+	case integer:
+		return v.i != 0
+	case text:
+		return v.s != ""
+	case object:
+		return v.o != nil
+	}
+	return false
+}
+
+// toValue converts the fields of the modules to values
+func toValue(o interface{}) value {
+	switch v := o.(type) {
+	case nil:
+		return undef
+	case int64:
+		return intValue(v)
+	case string:
+		return value{kind: text, s: v}
+	case value:
+		return v
+	}
+	return value{kind: object, o: o}
+}
+
+// moduleFunc is a function of a module, such as pe.imports
+type moduleFunc func(args []value) value
+
+// scanContext holds the data being scanned, and the state of the evaluation
+// of the conditions
+type scanContext struct {
+	data        []byte
+	lowered     []byte
+	base        uint64
+	isFile      bool
+	imports     map[string]bool
+	modules     map[string]interface{}
+	rule        *rule
+	matches     [][]stringMatch
+	ruleResults map[string]bool
+	vars        map[string]value
+	anon        int
+}
+
+func newScanContext(data []byte, base uint64, isFile bool, imports map[string]bool) *scanContext {
+	return &scanContext{
+		data:        data,
+		base:        base,
+		isFile:      isFile,
+		imports:     imports,
+		modules:     make(map[string]interface{}),
+		ruleResults: make(map[string]bool),
+		vars:        make(map[string]value),
+		anon:        -1,
+	}
+}
+
+// lowerData returns the data in lower case, for the nocase strings
+func (ctx *scanContext) lowerData() []byte {
+	if ctx.lowered == nil {
+		ctx.lowered = lower(ctx.data)
+	}
+	return ctx.lowered
+}
+
+// module returns the object of an imported module, parsing the data on
+// first use
+func (ctx *scanContext) module(name string) interface{} {
+	if m, ok := ctx.modules[name]; ok {
+		return m
+	}
+	var m interface{}
+	switch name {
+	case "pe":
+		m = peModule(ctx.data)
+	case "elf":
+		m = elfModule(ctx.data)
+	}
+	ctx.modules[name] = m
+	return m
+}
+
+// stringMatches returns the matches of a string of the rule being evaluated
+func (ctx *scanContext) stringMatches(index int) []stringMatch {
+	if index < 0 {
+		index = ctx.anon
+	}
+	if index < 0 || index >= len(ctx.matches) {
+		return nil
+	}
+	return ctx.matches[index]
+}
+
+// inRange evaluates the bounds of a range
+func (ctx *scanContext) inRange(lo, hi expr) (l, h int64, ok bool) {
+	lv, hv := ctx.eval(lo), ctx.eval(hi)
+	if lv.kind != integer || hv.kind != integer {
+		return 0, 0, false
+	}
+	return lv.i, hv.i, true
+}
+
+// eval returns the value of an expression
+func (ctx *scanContext) eval(e expr) value {
+	switch x := e.(type) {
+	case boolLit:
+		return boolValue(bool(x))
+	case intLit:
+		return intValue(int64(x))
+	case textLit:
+		return value{kind: text, s: string(x)}
+	case filesizeExpr:
+		if !ctx.isFile {
+			return undef
+		}
+		return intValue(int64(len(ctx.data)))
+	case stringRef:
+		matches := ctx.stringMatches(x.index)
+		switch {
+		case x.at != nil:
+			at := ctx.eval(x.at)
+			if at.kind != integer {
+				return undef
+			}
+			for _, m := range matches {
+				if int64(ctx.base)+int64(m.offset) == at.i {
+					return boolValue(true)
+				}
+			}
+			return boolValue(false)
+		case x.lo != nil:
+			lo, hi, ok := ctx.inRange(x.lo, x.hi)
+			if !ok {
+				return undef
+			}
+			for _, m := range matches {
+				if off := int64(ctx.base) + int64(m.offset); off >= lo && off <= hi {
+					return boolValue(true)
+				}
+			}
+			return boolValue(false)
+		}
+		return boolValue(len(matches) > 0)
+	case stringCount:
+		matches := ctx.stringMatches(x.index)
+		if x.lo == nil {
+			return intValue(int64(len(matches)))
+		}
+		lo, hi, ok := ctx.inRange(x.lo, x.hi)
+		if !ok {
+			return undef
+		}
+		n := 0
+		for _, m := range matches {
+			if off := int64(ctx.base) + int64(m.offset); off >= lo && off <= hi {
+				n++
+			}
+		}
+		return intValue(int64(n))
+	case stringOffset:
+		matches := ctx.stringMatches(x.index)
+		n := int64(1)
+		if x.n != nil {
+			v := ctx.eval(x.n)
+			if v.kind != integer {
+				return undef
+			}
+			n = v.i
+		}
+		// matches are numbered from 1
+		if n < 1 || n > int64(len(matches)) {
+			return undef
+		}
+		m := matches[n-1]
+		if x.length {
+			return intValue(int64(m.length))
+		}
+		return intValue(int64(ctx.base) + int64(m.offset))
+	case ruleRef:
+		return boolValue(ctx.ruleResults[x.name])
+	case varRef:
+		return ctx.vars[x.name]
+	case moduleRef:
+		return toValue(ctx.module(x.name))
+	case memberExpr:
+		v := ctx.eval(x.x)
+		fields, ok := v.o.(map[string]interface{})
+		if v.kind != object || !ok {
+			return undef
+		}
+		return toValue(fields[x.name])
+	case indexExpr:
+		v, i := ctx.eval(x.x), ctx.eval(x.index)
+		items, ok := v.o.([]interface{})
+		if v.kind != object || !ok || i.kind != integer || i.i < 0 || i.i >= int64(len(items)) {
+			return undef
+		}
+		return toValue(items[i.i])
+	case callExpr:
+		v := ctx.eval(x.x)
+		fn, ok := v.o.(moduleFunc)
+		if v.kind != object || !ok {
+			return undef
+		}
+		var args []value
+		for _, a := range x.args {
+			args = append(args, ctx.eval(a))
+		}
+		return fn(args)
+	case readInt:
+		return ctx.readInt(x)
+	case unaryExpr:
+		return ctx.unary(x)
+	case binaryExpr:
+		return ctx.binary(x)
+	case ofExpr:
+		return ctx.of(x)
+	case forInExpr:
+		return ctx.forIn(x)
+	}
+	return undef
+}
+
+// readInt reads an integer of the data at an offset, or at an address in
+// the memory of a process
+func (ctx *scanContext) readInt(x readInt) value {
+	v := ctx.eval(x.x)
+	if v.kind != integer {
+		return undef
+	}
+	off := v.i - int64(ctx.base)
+	if off < 0 || off+int64(x.size) > int64(len(ctx.data)) {
+		return undef
+	}
+	b := ctx.data[off : off+int64(x.size)]
+	var order binary.ByteOrder = binary.LittleEndian
+	if x.bigEndian {
+		order = binary.BigEndian
+	}
+	switch x.size {
+	case 1:
+		if x.signed {
+			return intValue(int64(int8(b[0])))
+		}
+		return intValue(int64(b[0]))
+	case 2:
+		if x.signed {
+			return intValue(int64(int16(order.Uint16(b))))
+		}
+		return intValue(int64(order.Uint16(b)))
+	default:
+		if x.signed {
+			return intValue(int64(int32(order.Uint32(b))))
+		}
+		return intValue(int64(order.Uint32(b)))
+	}
+}
+
+func (ctx *scanContext) unary(x unaryExpr) value {
+	v := ctx.eval(x.x)
+	switch x.op {
+	case "not":
+		if v.kind == undefined {
+			return undef
+		}
+		return boolValue(!v.truth())
+	case "defined":
+		return boolValue(v.kind != undefined)
+	}
+	if v.kind != integer {
+		return undef
+	}
+	if x.op == "-" {
+		return intValue(-v.i)
+	}
+	return intValue(^v.i)
+}
+
+func (ctx *scanContext) binary(x binaryExpr) value {
+	switch x.op {
+	case "and":
+		return boolValue(ctx.eval(x.x).truth() && ctx.eval(x.y).truth())
+	case "or":
+		return boolValue(ctx.eval(x.x).truth() || ctx.eval(x.y).truth())
+	}
+	l := ctx.eval(x.x)
+	if x.op == "matches" {
+		re := x.y.(regexLit).re
+		if l.kind != text {
+			return undef
+		}
+		return boolValue(re.MatchReader(&byteRunes{b: []byte(l.s)}))
+	}
+	r := ctx.eval(x.y)
+	if l.kind == text && r.kind == text {
+		return textOp(x.op, l.s, r.s)
+	}
+	if l.kind != integer || r.kind != integer {
+		return undef
+	}
+	a, b := l.i, r.i
+	switch x.op {
+	case "==":
+		return boolValue(a == b)
+	case "!=":
+		return boolValue(a != b)
+	case "<":
+		return boolValue(a < b)
+	case "<=":
+		return boolValue(a <= b)
+	case ">":
+		return boolValue(a > b)
+	case ">=":
+		return boolValue(a >= b)
+	case "+":
+		return intValue(a + b)
+	case "-":
+		return intValue(a - b)
+	case "*":
+		return intValue(a * b)
+	case "\\":
+		if b == 0 {
+			return undef
+		}
+		return intValue(a / b)
+	case "%":
+		if b == 0 {
+			return undef
+		}
+		return intValue(a % b)
+	case "&":
+		return intValue(a & b)
+	case "|":
+		return intValue(a | b)
+	case "^":
+		return intValue(a ^ b)
+	case "<<":
+		if b < 0 || b >= 64 {
+			return intValue(0)
+		}
+		return intValue(a << uint(b))
+	case ">>":
+		if b < 0 || b >= 64 {
+			return intValue(0)
+		}
+		return intValue(a >> uint(b))
+	}
+	return undef
+}
+
+// textOp applies a comparison or a string operator to two texts
+func textOp(op, a, b string) value {
+	switch op {
+	case "==":
+		return boolValue(a == b)
+	case "!=":
+		return boolValue(a != b)
+	case "<":
+		return boolValue(a < b)
+	case "<=":
+		return boolValue(a <= b)
+	case ">":
+		return boolValue(a > b)
+	case ">=":
+		return boolValue(a >= b)
+	case "contains":
+		return boolValue(strings.Contains(a, b))
+	case "icontains":
+		return boolValue(bytes.Contains(lower([]byte(a)), lower([]byte(b))))
+	case "startswith":
+		return boolValue(strings.HasPrefix(a, b))
+	case "istartswith":
+		return boolValue(bytes.HasPrefix(lower([]byte(a)), lower([]byte(b))))
+	case "endswith":
+		return boolValue(strings.HasSuffix(a, b))
+	case "iendswith":
+		return boolValue(bytes.HasSuffix(lower([]byte(a)), lower([]byte(b))))
+	case "iequals":
+		return boolValue(bytes.Equal(lower([]byte(a)), lower([]byte(b))))
+	}
+	return undef
+}
+
+// quantified returns true if the number of items satisfying a condition
+// satisfies a quantifier
+func (ctx *scanContext) quantified(q quantifier, satisfied, total int) bool {
+	switch q.kind {
+	case "all":
+		return satisfied == total
+	case "any":
+		return satisfied > 0
+	case "none":
+		return satisfied == 0
+	}
+	n := ctx.eval(q.n)
+	return n.kind == integer && int64(satisfied) >= n.i
+}
+
+func (ctx *scanContext) of(x ofExpr) value {
+	satisfied := 0
+	anon := ctx.anon
+	for _, index := range x.strings {
+		if x.cond == nil {
+			if len(ctx.matches[index]) > 0 {
+				satisfied++
+			}
+			continue
+		}
+		ctx.anon = index
+		if ctx.eval(x.cond).truth() {
+			satisfied++
+		}
+	}
+	ctx.anon = anon
+	return boolValue(ctx.quantified(x.quant, satisfied, len(x.strings)))
+}
+
+// maxLoopItems limits the iterations of a for loop over a range
+const maxLoopItems = 1000000
+
+func (ctx *scanContext) forIn(x forInExpr) value {
+	var items []value
+	switch {
+	case x.lo != nil:
+		lo, hi, ok := ctx.inRange(x.lo, x.hi)
+		if !ok {
+			return undef
+		}
+		if hi-lo >= maxLoopItems {
+			hi = lo + maxLoopItems - 1
+		}
+		for i := lo; i <= hi; i++ {
+			items = append(items, intValue(i))
+		}
+	case x.list != nil:
+		for _, e := range x.list {
+			items = append(items, ctx.eval(e))
+		}
+	default:
+		v := ctx.eval(x.array)
+		array, ok := v.o.([]interface{})
+		if v.kind != object || !ok {
+			return undef
+		}
+		for _, o := range array {
+			items = append(items, toValue(o))
+		}
+	}
+	saved, shadowed := ctx.vars[x.name]
+	satisfied := 0
+	for _, item := range items {
+		ctx.vars[x.name] = item
+		if ctx.eval(x.cond).truth() {
+			satisfied++
+		}
+	}
+	if shadowed {
+		ctx.vars[x.name] = saved
+	} else {
+		delete(ctx.vars, x.name)
+	}
+	return boolValue(ctx.quantified(x.quant, satisfied, len(items)))
+}
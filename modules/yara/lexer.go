@@ -0,0 +1,277 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Julien Vehent jvehent@mozilla.com [:ulfr]
+
+package yara /* import "mig.ninja/mig/modules/yara" */
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF      tokenKind = iota
+	tokIdent              // rule, and, pe, ...
+	tokStringID           // $a, or $ alone
+	tokWildcard           // $a*, or $* in string sets
+	tokCount              // #a
+	tokOffset             // @a
+	tokLength             // !a
+	tokNumber             // 10, 0x10, 10KB
+	tokText               // "text"
+	tokPunct              // operators and punctuation
+)
+
+// token is a lexical token of a rule set, with its position for errors
+type token struct {
+	kind tokenKind
+	text string // identifier, string id, operator or decoded text
+	num  int64
+	pos  int
+}
+
+// lexer splits the source of the rules in tokens. Hex strings and regular
+// expressions depend on their context, and are read by the parser with
+// readHex and readRegex.
+type lexer struct {
+	src string
+	pos int
+}
+
+// line returns the line of a position, for error messages
+func (l *lexer) line(pos int) int {
+	return strings.Count(l.src[:pos], "\n") + 1
+}
+
+// errorf panics with an error at a position of the source
+func (l *lexer) errorf(pos int, format string, a ...interface{}) {
+	panic(fmt.Sprintf("line %d: %s", l.line(pos), fmt.Sprintf(format, a...)))
+}
+
+// skip moves past spaces and comments
+func (l *lexer) skip() {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			l.pos++
+		case strings.HasPrefix(l.src[l.pos:], "//"):
+			end := strings.IndexByte(l.src[l.pos:], '\n')
+			if end < 0 {
+				l.pos = len(l.src)
+			} else {
+				l.pos += end
+			}
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				l.errorf(l.pos, "unterminated comment")
+			}
+			l.pos += end + 4
+		default:
+			return
+		}
+	}
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// operators of two characters, tried before the ones of one character
+var operators = []string{"==", "!=", "<=", ">=", "<<", ">>", ".."}
+
+// next returns the next token of the source
+func (l *lexer) next() (t token) {
+	l.skip()
+	t.pos = l.pos
+	if l.pos >= len(l.src) {
+		t.kind = tokEOF
+		return
+	}
+	c := l.src[l.pos]
+	switch {
+	case isIdentChar(c) && (c < '0' || c > '9'):
+		start := l.pos
+		for l.pos < len(l.src) && isIdentChar(l.src[l.pos]) {
+			l.pos++
+		}
+		t.kind = tokIdent
+		t.text = l.src[start:l.pos]
+	case c >= '0' && c <= '9':
+		t.kind = tokNumber
+		t.num = l.number()
+	case c == '"':
+		t.kind = tokText
+		t.text = l.text()
+	case c == '$' || c == '#' || c == '@' || c == '!' && !strings.HasPrefix(l.src[l.pos:], "!="):
+		start := l.pos
+		l.pos++
+		for l.pos < len(l.src) && isIdentChar(l.src[l.pos]) {
+			l.pos++
+		}
+		t.text = l.src[start:l.pos]
+		switch c {
+		case '$':
+			t.kind = tokStringID
+			if l.pos < len(l.src) && l.src[l.pos] == '*' {
+				l.pos++
+				t.kind = tokWildcard
+			}
+		case '#':
+			t.kind = tokCount
+		case '@':
+			t.kind = tokOffset
+		case '!':
+			t.kind = tokLength
+		}
+		// the identifiers of the strings are stored with their $
+		t.text = "$" + t.text[1:]
+	default:
+		t.kind = tokPunct
+		for _, op := range operators {
+			if strings.HasPrefix(l.src[l.pos:], op) {
+				l.pos += len(op)
+				t.text = op
+				return
+			}
+		}
+		if !strings.ContainsRune("()[]{}<>=:,.+-*\\%&|^~/", rune(c)) {
+			l.errorf(l.pos, "unexpected character %q", c)
+		}
+		l.pos++
+		t.text = string(c)
+	}
+	return
+}
+
+// number reads a decimal, hexadecimal or octal number, with an optional KB
+// or MB suffix
+func (l *lexer) number() int64 {
+	start := l.pos
+	for l.pos < len(l.src) && isIdentChar(l.src[l.pos]) {
+		l.pos++
+	}
+	text := l.src[start:l.pos]
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(text, "KB"):
+		mult, text = 1024, strings.TrimSuffix(text, "KB")
+	case strings.HasSuffix(text, "MB"):
+		mult, text = 1024*1024, strings.TrimSuffix(text, "MB")
+	}
+	var (
+		n   int64
+		err error
+	)
+	switch {
+	case strings.HasPrefix(text, "0x"):
+		n, err = strconv.ParseInt(text[2:], 16, 64)
+	case strings.HasPrefix(text, "0o"):
+		n, err = strconv.ParseInt(text[2:], 8, 64)
+	default:
+		n, err = strconv.ParseInt(text, 10, 64)
+	}
+	if err != nil {
+		l.errorf(start, "invalid number %q", l.src[start:l.pos])
+	}
+	return n * mult
+}
+
+// text reads a text string and decodes its escape sequences
+func (l *lexer) text() string {
+	start := l.pos
+	l.pos++
+	var b []byte
+	for {
+		if l.pos >= len(l.src) || l.src[l.pos] == '\n' {
+			l.errorf(start, "unterminated string")
+		}
+		c := l.src[l.pos]
+		l.pos++
+		if c == '"' {
+			return string(b)
+		}
+		if c != '\\' {
+			b = append(b, c)
+			continue
+		}
+		if l.pos >= len(l.src) {
+			l.errorf(start, "unterminated string")
+		}
+		c = l.src[l.pos]
+		l.pos++
+		switch c {
+		case 'n':
+			b = append(b, '\n')
+		case 'r':
+			b = append(b, '\r')
+		case 't':
+			b = append(b, '\t')
+		case '\\', '"':
+			b = append(b, c)
+		case 'x':
+			if l.pos+2 > len(l.src) {
+				l.errorf(start, "invalid escape sequence")
+			}
+			v, err := strconv.ParseUint(l.src[l.pos:l.pos+2], 16, 8)
+			if err != nil {
+				l.errorf(start, "invalid escape sequence \\x%s", l.src[l.pos:l.pos+2])
+			}
+			b = append(b, byte(v))
+			l.pos += 2
+		default:
+			l.errorf(start, "invalid escape sequence \\%c", c)
+		}
+	}
+}
+
+// readHex reads the body of a hex string, between braces, from a position
+func (l *lexer) readHex(pos int) string {
+	end := strings.IndexByte(l.src[pos:], '}')
+	if end < 0 {
+		l.errorf(pos, "unterminated hex string")
+	}
+	l.pos = pos + end + 1
+	return l.src[pos+1 : pos+end]
+}
+
+// readRegex reads a regular expression, between slashes, and its flags
+// from a position
+func (l *lexer) readRegex(pos int) (expr, flags string) {
+	var b []byte
+	i := pos + 1
+	for {
+		if i >= len(l.src) || l.src[i] == '\n' {
+			l.errorf(pos, "unterminated regular expression")
+		}
+		c := l.src[i]
+		if c == '/' {
+			break
+		}
+		if c == '\\' && i+1 < len(l.src) && l.src[i+1] == '/' {
+			// an escaped slash is a slash for the regexp package
+			b = append(b, '/')
+			i += 2
+			continue
+		}
+		if c == '\\' && i+1 < len(l.src) {
+			b = append(b, c, l.src[i+1])
+			i += 2
+			continue
+		}
+		b = append(b, c)
+		i++
+	}
+	i++
+	start := i
+	for i < len(l.src) && (l.src[i] == 'i' || l.src[i] == 's') {
+		i++
+	}
+	l.pos = i
+	return string(b), l.src[start:i]
+}
@@ -0,0 +1,311 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Julien Vehent jvehent@mozilla.com [:ulfr]
+
+package yara /* import "mig.ninja/mig/modules/yara" */
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/pe"
+	"encoding/binary"
+	"strings"
+)
+
+/*
+	The pe and elf modules expose the basic fields of the headers of the
+	executables, parsed with the debug/pe and debug/elf packages of Go.
+
+	pe: is_pe, machine, number_of_sections, timestamp, characteristics,
+	entry_point (a file offset), subsystem, image_base, sections[i].name,
+	virtual_address, virtual_size, raw_data_offset, raw_data_size and
+	characteristics, number_of_imports, imports(dll) and imports(dll, fn),
+	exports(fn), is_dll(), is_32bit(), is_64bit(), and the constants MACHINE_*,
+	SUBSYSTEM_*, SECTION_* and the characteristics of the file header.
+
+	elf: type, machine, entry_point (a file offset), number_of_sections,
+	number_of_segments, sections[i].name, type, size, offset, address and
+	flags, segments[i].type, offset, virtual_address, file_size, memory_size
+	and flags, and the constants ET_*, EM_*, PT_*, PF_*, SHT_* and SHF_*.
+
+	The fields of data that is not an executable of the module are undefined,
+	except pe.is_pe which is 0.
+*/
+
+var peConstants = map[string]int64{
+	"MACHINE_I386":                 0x14c,
+	"MACHINE_AMD64":                0x8664,
+	"MACHINE_ARM":                  0x1c0,
+	"MACHINE_ARM64":                0xaa64,
+	"RELOCS_STRIPPED":              0x1,
+	"EXECUTABLE_IMAGE":             0x2,
+	"LARGE_ADDRESS_AWARE":          0x20,
+	"SYSTEM":                       0x1000,
+	"DLL":                          0x2000,
+	"SUBSYSTEM_NATIVE":             1,
+	"SUBSYSTEM_WINDOWS_GUI":        2,
+	"SUBSYSTEM_WINDOWS_CUI":        3,
+	"SECTION_CNT_CODE":             0x20,
+	"SECTION_MEM_EXECUTE":          0x20000000,
+	"SECTION_MEM_READ":             0x40000000,
+	"SECTION_MEM_WRITE":            0x80000000,
+	"SECTION_CNT_INITIALIZED_DATA": 0x40,
+}
+
+var elfConstants = map[string]int64{
+	"ET_NONE":       0,
+	"ET_REL":        1,
+	"ET_EXEC":       2,
+	"ET_DYN":        3,
+	"ET_CORE":       4,
+	"EM_386":        3,
+	"EM_MIPS":       8,
+	"EM_PPC":        20,
+	"EM_PPC64":      21,
+	"EM_ARM":        40,
+	"EM_X86_64":     62,
+	"EM_AARCH64":    183,
+	"PT_NULL":       0,
+	"PT_LOAD":       1,
+	"PT_DYNAMIC":    2,
+	"PT_INTERP":     3,
+	"PT_NOTE":       4,
+	"PF_X":          1,
+	"PF_W":          2,
+	"PF_R":          4,
+	"SHT_NULL":      0,
+	"SHT_PROGBITS":  1,
+	"SHT_SYMTAB":    2,
+	"SHT_STRTAB":    3,
+	"SHT_DYNAMIC":   6,
+	"SHT_NOBITS":    8,
+	"SHT_DYNSYM":    11,
+	"SHF_WRITE":     1,
+	"SHF_ALLOC":     2,
+	"SHF_EXECINSTR": 4,
+}
+
+// moduleFields are the fields of the modules, checked when rules are
+// compiled
+var moduleFields = map[string]map[string]bool{
+	"pe": fieldSet(peConstants, "is_pe", "machine", "number_of_sections", "timestamp",
+		"characteristics", "entry_point", "subsystem", "image_base", "sections",
+		"number_of_imports", "imports", "exports", "is_dll", "is_32bit", "is_64bit"),
+	"elf": fieldSet(elfConstants, "type", "machine", "entry_point", "number_of_sections",
+		"number_of_segments", "sections", "segments"),
+}
+
+func fieldSet(constants map[string]int64, fields ...string) map[string]bool {
+	set := make(map[string]bool)
+	for name := range constants {
+		set[name] = true
+	}
+	for _, name := range fields {
+		set[name] = true
+	}
+	return set
+}
+
+func newModule(constants map[string]int64) map[string]interface{} {
+	m := make(map[string]interface{})
+	for name, v := range constants {
+		m[name] = v
+	}
+	return m
+}
+
+// peModule returns the object of the pe module for the scanned data
+func peModule(data []byte) (m map[string]interface{}) {
+	m = newModule(peConstants)
+	m["is_pe"] = int64(0)
+	defer func() {
+		// debug/pe does not expect malicious files
+		if e := recover(); e != nil {
+			m = newModule(peConstants)
+			m["is_pe"] = int64(0)
+		}
+	}()
+	f, err := pe.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	m["is_pe"] = int64(1)
+	m["machine"] = int64(f.Machine)
+	m["number_of_sections"] = int64(f.NumberOfSections)
+	m["timestamp"] = int64(f.TimeDateStamp)
+	m["characteristics"] = int64(f.Characteristics)
+	var (
+		entry uint32
+		dirs  []pe.DataDirectory
+		is64  bool
+	)
+	switch h := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		entry = h.AddressOfEntryPoint
+		m["subsystem"] = int64(h.Subsystem)
+		m["image_base"] = int64(h.ImageBase)
+		dirs = h.DataDirectory[:min(h.NumberOfRvaAndSizes, 16)]
+	case *pe.OptionalHeader64:
+		entry = h.AddressOfEntryPoint
+		m["subsystem"] = int64(h.Subsystem)
+		m["image_base"] = int64(h.ImageBase)
+		dirs = h.DataDirectory[:min(h.NumberOfRvaAndSizes, 16)]
+		is64 = true
+	}
+	if off, ok := peOffset(f, entry); ok {
+		m["entry_point"] = int64(off)
+	}
+	var sections []interface{}
+	for _, s := range f.Sections {
+		sections = append(sections, map[string]interface{}{
+			"name":            s.Name,
+			"virtual_address": int64(s.VirtualAddress),
+			"virtual_size":    int64(s.VirtualSize),
+			"raw_data_offset": int64(s.Offset),
+			"raw_data_size":   int64(s.Size),
+			"characteristics": int64(s.Characteristics),
+		})
+	}
+	m["sections"] = sections
+
+	// ImportedSymbols returns function:library pairs
+	imports := make(map[string]map[string]bool)
+	symbols, _ := f.ImportedSymbols()
+	for _, sym := range symbols {
+		i := strings.LastIndex(sym, ":")
+		if i < 0 {
+			continue
+		}
+		dll := strings.ToLower(sym[i+1:])
+		if imports[dll] == nil {
+			imports[dll] = make(map[string]bool)
+		}
+		imports[dll][sym[:i]] = true
+	}
+	m["number_of_imports"] = int64(len(imports))
+	m["imports"] = moduleFunc(func(args []value) value {
+		if len(args) == 0 || len(args) > 2 || args[0].kind != text {
+			return undef
+		}
+		fns, ok := imports[strings.ToLower(args[0].s)]
+		if len(args) == 1 {
+			return boolValue(ok)
+		}
+		if args[1].kind != text {
+			return undef
+		}
+		return boolValue(fns[args[1].s])
+	})
+	exports := make(map[string]bool)
+	if len(dirs) > 0 {
+		for _, name := range peExports(f, data, dirs[0]) {
+			exports[name] = true
+		}
+	}
+	m["exports"] = moduleFunc(func(args []value) value {
+		if len(args) != 1 || args[0].kind != text {
+			return undef
+		}
+		return boolValue(exports[args[0].s])
+	})
+	dll := f.Characteristics&0x2000 != 0
+	m["is_dll"] = moduleFunc(func([]value) value { return boolValue(dll) })
+	m["is_32bit"] = moduleFunc(func([]value) value { return boolValue(!is64) })
+	m["is_64bit"] = moduleFunc(func([]value) value { return boolValue(is64) })
+	return
+}
+
+// peOffset converts a relative virtual address to an offset in the file
+func peOffset(f *pe.File, rva uint32) (uint32, bool) {
+	for _, s := range f.Sections {
+		size := s.VirtualSize
+		if s.Size > size {
+			size = s.Size
+		}
+		if rva >= s.VirtualAddress && rva < s.VirtualAddress+size {
+			return rva - s.VirtualAddress + s.Offset, true
+		}
+	}
+	return 0, false
+}
+
+// peExports returns the names exported by the export directory of a PE
+func peExports(f *pe.File, data []byte, dir pe.DataDirectory) (names []string) {
+	if dir.VirtualAddress == 0 {
+		return
+	}
+	off, ok := peOffset(f, dir.VirtualAddress)
+	if !ok || uint64(off)+40 > uint64(len(data)) {
+		return
+	}
+	count := binary.LittleEndian.Uint32(data[off+24:])
+	namesRVA := binary.LittleEndian.Uint32(data[off+32:])
+	table, ok := peOffset(f, namesRVA)
+	if !ok {
+		return
+	}
+	for i := uint32(0); i < count && i < 65536; i++ {
+		entry := uint64(table) + 4*uint64(i)
+		if entry+4 > uint64(len(data)) {
+			return
+		}
+		nameOff, ok := peOffset(f, binary.LittleEndian.Uint32(data[entry:]))
+		if !ok || uint64(nameOff) >= uint64(len(data)) {
+			continue
+		}
+		name := data[nameOff:]
+		if end := bytes.IndexByte(name, 0); end >= 0 {
+			name = name[:end]
+		}
+		names = append(names, string(name))
+	}
+	return
+}
+
+// elfModule returns the object of the elf module for the scanned data
+func elfModule(data []byte) (m map[string]interface{}) {
+	m = newModule(elfConstants)
+	defer func() {
+		if e := recover(); e != nil {
+			m = newModule(elfConstants)
+		}
+	}()
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	m["type"] = int64(f.Type)
+	m["machine"] = int64(f.Machine)
+	m["number_of_sections"] = int64(len(f.Sections))
+	m["number_of_segments"] = int64(len(f.Progs))
+	var sections []interface{}
+	for _, s := range f.Sections {
+		sections = append(sections, map[string]interface{}{
+			"name":    s.Name,
+			"type":    int64(s.Type),
+			"size":    int64(s.Size),
+			"offset":  int64(s.Offset),
+			"address": int64(s.Addr),
+			"flags":   int64(s.Flags),
+		})
+	}
+	m["sections"] = sections
+	var segments []interface{}
+	for _, p := range f.Progs {
+		segments = append(segments, map[string]interface{}{
+			"type":            int64(p.Type),
+			"offset":          int64(p.Off),
+			"virtual_address": int64(p.Vaddr),
+			"file_size":       int64(p.Filesz),
+			"memory_size":     int64(p.Memsz),
+			"flags":           int64(p.Flags),
+		})
+		if p.Type == elf.PT_LOAD && f.Entry >= p.Vaddr && f.Entry < p.Vaddr+p.Filesz {
+			m["entry_point"] = int64(f.Entry - p.Vaddr + p.Off)
+		}
+	}
+	m["segments"] = segments
+	return
+}
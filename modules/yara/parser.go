@@ -0,0 +1,668 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Julien Vehent jvehent@mozilla.com [:ulfr]
+
+package yara /* import "mig.ninja/mig/modules/yara" */
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parser compiles the source of a rule set. Errors are panics, recovered by
+// Compile.
+type parser struct {
+	lex       lexer
+	tok       token
+	rules     *Rules
+	ruleNames map[string]bool
+	cur       *rule
+	vars      []string
+	inForOf   int
+}
+
+func newParser(source string) *parser {
+	p := &parser{
+		lex:       lexer{src: source},
+		rules:     &Rules{imports: make(map[string]bool)},
+		ruleNames: make(map[string]bool),
+	}
+	p.next()
+	return p
+}
+
+func (p *parser) next() {
+	p.tok = p.lex.next()
+}
+
+func (p *parser) errorf(format string, a ...interface{}) {
+	p.lex.errorf(p.tok.pos, format, a...)
+}
+
+// is returns true if the current token is an identifier or an operator
+func (p *parser) is(text string) bool {
+	return (p.tok.kind == tokIdent || p.tok.kind == tokPunct) && p.tok.text == text
+}
+
+// accept moves past the current token if it is an identifier or an
+// operator
+func (p *parser) accept(text string) bool {
+	if p.is(text) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) {
+	if !p.accept(text) {
+		p.errorf("expected %q, found %s", text, p.describe())
+	}
+}
+
+func (p *parser) ident() string {
+	if p.tok.kind != tokIdent {
+		p.errorf("expected an identifier, found %s", p.describe())
+	}
+	name := p.tok.text
+	p.next()
+	return name
+}
+
+// describe returns the current token for error messages
+func (p *parser) describe() string {
+	switch p.tok.kind {
+	case tokEOF:
+		return "end of rules"
+	case tokNumber:
+		return fmt.Sprintf("%d", p.tok.num)
+	case tokText:
+		return fmt.Sprintf("%q", p.tok.text)
+	}
+	return fmt.Sprintf("%q", p.tok.text)
+}
+
+// keywords cannot be used as names of rules, strings or variables
+var keywords = map[string]bool{
+	"all": true, "and": true, "any": true, "ascii": true, "at": true, "condition": true,
+	"contains": true, "defined": true, "endswith": true, "false": true, "filesize": true,
+	"for": true, "fullword": true, "global": true, "icontains": true, "iendswith": true,
+	"iequals": true, "import": true, "in": true, "include": true, "istartswith": true,
+	"matches": true, "meta": true, "nocase": true, "none": true, "not": true, "of": true,
+	"or": true, "private": true, "rule": true, "startswith": true, "strings": true,
+	"them": true, "true": true, "wide": true,
+}
+
+// modules that can be imported
+var knownModules = map[string]bool{"pe": true, "elf": true}
+
+func (p *parser) parseRules() *Rules {
+	for p.tok.kind != tokEOF {
+		switch {
+		case p.accept("import"):
+			if p.tok.kind != tokText {
+				p.errorf("expected a module name, found %s", p.describe())
+			}
+			if !knownModules[p.tok.text] {
+				p.errorf("module %q is not supported", p.tok.text)
+			}
+			p.rules.imports[p.tok.text] = true
+			p.next()
+		case p.is("include"):
+			p.errorf("includes are not supported")
+		default:
+			p.parseRule()
+		}
+	}
+	return p.rules
+}
+
+func (p *parser) parseRule() {
+	r := &rule{}
+	for {
+		if p.accept("private") {
+			r.private = true
+		} else if p.accept("global") {
+			r.global = true
+		} else {
+			break
+		}
+	}
+	p.expect("rule")
+	r.name = p.ident()
+	if keywords[r.name] || knownModules[r.name] {
+		p.errorf("invalid rule name %q", r.name)
+	}
+	if p.ruleNames[r.name] {
+		p.errorf("duplicate rule %q", r.name)
+	}
+	if p.accept(":") {
+		for p.tok.kind == tokIdent {
+			r.tags = append(r.tags, p.ident())
+		}
+	}
+	p.expect("{")
+	p.cur = r
+	if p.accept("meta") {
+		p.expect(":")
+		r.meta = make(map[string]string)
+		for p.tok.kind == tokIdent && !p.is("strings") && !p.is("condition") {
+			name := p.ident()
+			p.expect("=")
+			switch {
+			case p.tok.kind == tokText:
+				r.meta[name] = p.tok.text
+			case p.tok.kind == tokNumber:
+				r.meta[name] = fmt.Sprintf("%d", p.tok.num)
+			case p.is("-"):
+				p.next()
+				if p.tok.kind != tokNumber {
+					p.errorf("expected a number, found %s", p.describe())
+				}
+				r.meta[name] = fmt.Sprintf("-%d", p.tok.num)
+			case p.is("true") || p.is("false"):
+				r.meta[name] = p.tok.text
+			default:
+				p.errorf("invalid value of meta %s: %s", name, p.describe())
+			}
+			p.next()
+		}
+	}
+	if p.accept("strings") {
+		p.expect(":")
+		for p.tok.kind == tokStringID {
+			r.strings = append(r.strings, p.parseString())
+		}
+	}
+	p.expect("condition")
+	p.expect(":")
+	r.condition = p.parseExpr()
+	p.expect("}")
+	p.cur = nil
+	p.ruleNames[r.name] = true
+	p.rules.rules = append(p.rules.rules, r)
+}
+
+// parseString parses the definition of a string and its modifiers
+func (p *parser) parseString() *pattern {
+	s := &pattern{id: p.tok.text}
+	if s.id != "$" {
+		for _, other := range p.cur.strings {
+			if other.id == s.id {
+				p.errorf("duplicate string %s", s.id)
+			}
+		}
+	}
+	p.next()
+	if !p.is("=") {
+		p.errorf("expected \"=\", found %s", p.describe())
+	}
+	// the lexer reads hex strings and regular expressions from the start of
+	// their first token
+	p.next()
+	var (
+		value         string
+		regexFlags    string
+		ascii, isWide bool
+	)
+	switch {
+	case p.tok.kind == tokText:
+		s.kind = patternText
+		value = p.tok.text
+		if value == "" {
+			p.errorf("empty string %s", s.id)
+		}
+	case p.is("{"):
+		s.kind = patternHex
+		value = p.lex.readHex(p.tok.pos)
+	case p.is("/"):
+		s.kind = patternRegex
+		value, regexFlags = p.lex.readRegex(p.tok.pos)
+	default:
+		p.errorf("expected a string, found %s", p.describe())
+	}
+	p.next()
+	for p.tok.kind == tokIdent {
+		switch p.tok.text {
+		case "nocase":
+			s.nocase = true
+		case "wide":
+			isWide = true
+		case "ascii":
+			ascii = true
+		case "fullword":
+			s.fullword = true
+		case "private":
+			s.private = true
+		case "xor", "base64", "base64wide":
+			p.errorf("modifier %s is not supported", p.tok.text)
+		default:
+			return p.finishString(s, value, regexFlags, ascii, isWide)
+		}
+		p.next()
+	}
+	return p.finishString(s, value, regexFlags, ascii, isWide)
+}
+
+// finishString compiles a string once its modifiers are known
+func (p *parser) finishString(s *pattern, value, regexFlags string, ascii, isWide bool) *pattern {
+	switch s.kind {
+	case patternText:
+		text := []byte(value)
+		if s.nocase {
+			text = lower(text)
+		}
+		if ascii || !isWide {
+			s.texts = append(s.texts, text)
+			s.wides = append(s.wides, false)
+		}
+		if isWide {
+			s.texts = append(s.texts, wide(text))
+			s.wides = append(s.wides, true)
+		}
+	case patternHex:
+		if s.nocase || isWide || ascii || s.fullword {
+			p.errorf("hex string %s only accepts the private modifier", s.id)
+		}
+		var err error
+		s.hex, err = parseHex(value)
+		if err != nil {
+			p.errorf("%s: %v", s.id, err)
+		}
+	case patternRegex:
+		if isWide {
+			p.errorf("the wide modifier is not supported on regular expressions")
+		}
+		var err error
+		s.re, s.prefix, s.anchored, err = compileRegex(value, s.nocase || strings.Contains(regexFlags, "i"), strings.Contains(regexFlags, "s"))
+		if err != nil {
+			p.errorf("%s: %v", s.id, err)
+		}
+	}
+	return s
+}
+
+// stringIndex returns the index of a string of the current rule, or -1 for
+// the anonymous $ of for ... of loops
+func (p *parser) stringIndex(id string) int {
+	if p.cur == nil {
+		p.errorf("string %s referenced outside of a rule", id)
+	}
+	if id == "$" {
+		if p.inForOf == 0 {
+			p.errorf("$ can only be used in a for ... of loop")
+		}
+		return -1
+	}
+	for i, s := range p.cur.strings {
+		if s.id == id {
+			return i
+		}
+	}
+	p.errorf("undefined string %s", id)
+	return 0
+}
+
+// parseStringSet parses "them" or a list of strings and wildcards
+func (p *parser) parseStringSet() (set []int) {
+	if p.accept("them") {
+		for i := range p.cur.strings {
+			set = append(set, i)
+		}
+		if len(set) == 0 {
+			p.errorf("rule %s has no strings", p.cur.name)
+		}
+		return
+	}
+	p.expect("(")
+	seen := make(map[int]bool)
+	for {
+		switch p.tok.kind {
+		case tokStringID:
+			i := p.stringIndex(p.tok.text)
+			if !seen[i] {
+				seen[i] = true
+				set = append(set, i)
+			}
+		case tokWildcard:
+			found := false
+			for i, s := range p.cur.strings {
+				if strings.HasPrefix(s.id, p.tok.text) {
+					found = true
+					if !seen[i] {
+						seen[i] = true
+						set = append(set, i)
+					}
+				}
+			}
+			if !found {
+				p.errorf("no string matches %s*", p.tok.text)
+			}
+		default:
+			p.errorf("expected a string, found %s", p.describe())
+		}
+		p.next()
+		if !p.accept(",") {
+			break
+		}
+	}
+	p.expect(")")
+	return
+}
+
+// parseExpr parses a condition, from the lowest precedence operator, or,
+// to the highest
+func (p *parser) parseExpr() expr {
+	x := p.parseAnd()
+	for p.accept("or") {
+		x = binaryExpr{op: "or", x: x, y: p.parseAnd()}
+	}
+	return x
+}
+
+func (p *parser) parseAnd() expr {
+	x := p.parseNot()
+	for p.accept("and") {
+		x = binaryExpr{op: "and", x: x, y: p.parseNot()}
+	}
+	return x
+}
+
+func (p *parser) parseNot() expr {
+	if p.accept("not") {
+		return unaryExpr{op: "not", x: p.parseNot()}
+	}
+	if p.accept("defined") {
+		return unaryExpr{op: "defined", x: p.parseNot()}
+	}
+	return p.parseEquality()
+}
+
+var equalityOps = []string{"==", "!=", "contains", "icontains", "startswith", "istartswith",
+	"endswith", "iendswith", "iequals", "matches"}
+
+func (p *parser) parseEquality() expr {
+	x := p.parseRelational()
+	for {
+		op := p.acceptOp(equalityOps)
+		if op == "" {
+			return x
+		}
+		if op == "matches" {
+			if !p.is("/") {
+				p.errorf("expected a regular expression, found %s", p.describe())
+			}
+			value, flags := p.lex.readRegex(p.tok.pos)
+			p.next()
+			re, _, _, err := compileRegex(value, strings.Contains(flags, "i"), strings.Contains(flags, "s"))
+			if err != nil {
+				p.errorf("%v", err)
+			}
+			x = binaryExpr{op: op, x: x, y: regexLit{re}}
+			continue
+		}
+		x = binaryExpr{op: op, x: x, y: p.parseRelational()}
+	}
+}
+
+// acceptOp moves past the current token if it is one of the operators, and
+// returns it
+func (p *parser) acceptOp(ops []string) string {
+	for _, op := range ops {
+		if p.is(op) {
+			p.next()
+			return op
+		}
+	}
+	return ""
+}
+
+// the binary operators above the relational ones, by increasing precedence
+var binaryLevels = [][]string{
+	{"<", "<=", ">", ">="},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "\\", "%"},
+}
+
+func (p *parser) parseRelational() expr {
+	return p.parseBinary(0)
+}
+
+func (p *parser) parseBinary(level int) expr {
+	if level == len(binaryLevels) {
+		return p.parseUnary()
+	}
+	x := p.parseBinary(level + 1)
+	for {
+		op := p.acceptOp(binaryLevels[level])
+		if op == "" {
+			return x
+		}
+		x = binaryExpr{op: op, x: x, y: p.parseBinary(level + 1)}
+	}
+}
+
+func (p *parser) parseUnary() expr {
+	if p.accept("-") {
+		return unaryExpr{op: "-", x: p.parseUnary()}
+	}
+	if p.accept("~") {
+		return unaryExpr{op: "~", x: p.parseUnary()}
+	}
+	return p.parsePrimary()
+}
+
+// parseRange parses (lo..hi)
+func (p *parser) parseRange() (lo, hi expr) {
+	p.expect("(")
+	lo = p.parseExpr()
+	p.expect("..")
+	hi = p.parseExpr()
+	p.expect(")")
+	return
+}
+
+// readInts are the functions reading integers from the data
+var readInts = map[string]readInt{
+	"uint8": {size: 1}, "uint16": {size: 2}, "uint32": {size: 4},
+	"int8": {size: 1, signed: true}, "int16": {size: 2, signed: true}, "int32": {size: 4, signed: true},
+	"uint16be": {size: 2, bigEndian: true}, "uint32be": {size: 4, bigEndian: true},
+	"int16be": {size: 2, signed: true, bigEndian: true}, "int32be": {size: 4, signed: true, bigEndian: true},
+}
+
+func (p *parser) parsePrimary() expr {
+	switch p.tok.kind {
+	case tokNumber:
+		n := p.tok.num
+		p.next()
+		if p.is("of") {
+			return p.parseOf(quantifier{kind: "n", n: intLit(n)})
+		}
+		return intLit(n)
+	case tokText:
+		s := p.tok.text
+		p.next()
+		return textLit(s)
+	case tokStringID:
+		index := p.stringIndex(p.tok.text)
+		p.next()
+		ref := stringRef{index: index}
+		if p.accept("at") {
+			ref.at = p.parseUnary()
+		} else if p.accept("in") {
+			ref.lo, ref.hi = p.parseRange()
+		}
+		return ref
+	case tokCount:
+		index := p.stringIndex(p.tok.text)
+		p.next()
+		c := stringCount{index: index}
+		if p.accept("in") {
+			c.lo, c.hi = p.parseRange()
+		}
+		return c
+	case tokOffset, tokLength:
+		index := p.stringIndex(p.tok.text)
+		o := stringOffset{index: index, length: p.tok.kind == tokLength}
+		p.next()
+		if p.accept("[") {
+			o.n = p.parseExpr()
+			p.expect("]")
+		}
+		return o
+	case tokPunct:
+		if p.accept("(") {
+			x := p.parseExpr()
+			p.expect(")")
+			return x
+		}
+		p.errorf("unexpected %s", p.describe())
+	case tokIdent:
+		return p.parseIdent()
+	}
+	p.errorf("unexpected %s", p.describe())
+	return nil
+}
+
+func (p *parser) parseIdent() expr {
+	name := p.tok.text
+	switch name {
+	case "true", "false":
+		p.next()
+		return boolLit(name == "true")
+	case "filesize":
+		p.next()
+		return filesizeExpr{}
+	case "any", "all", "none":
+		p.next()
+		return p.parseOf(quantifier{kind: name})
+	case "for":
+		p.next()
+		return p.parseFor()
+	}
+	if ri, ok := readInts[name]; ok {
+		p.next()
+		p.expect("(")
+		ri.x = p.parseExpr()
+		p.expect(")")
+		return ri
+	}
+	p.next()
+	var x expr
+	switch {
+	case p.isVar(name):
+		x = varRef{name}
+	case p.ruleNames[name]:
+		return ruleRef{name}
+	case p.rules.imports[name]:
+		x = moduleRef{name}
+		if !p.is(".") {
+			p.errorf("expected a field of module %s", name)
+		}
+		p.next()
+		field := p.ident()
+		if !moduleFields[name][field] {
+			p.errorf("unknown field %s.%s", name, field)
+		}
+		x = memberExpr{x: x, name: field}
+	case knownModules[name]:
+		p.errorf("module %s is not imported", name)
+	default:
+		p.errorf("undefined identifier %q", name)
+	}
+	// fields, items and function calls of the objects of the modules
+	for {
+		switch {
+		case p.accept("."):
+			x = memberExpr{x: x, name: p.ident()}
+		case p.accept("["):
+			x = indexExpr{x: x, index: p.parseExpr()}
+			p.expect("]")
+		case p.accept("("):
+			call := callExpr{x: x}
+			for !p.is(")") {
+				call.args = append(call.args, p.parseExpr())
+				if !p.accept(",") {
+					break
+				}
+			}
+			p.expect(")")
+			x = call
+		default:
+			return x
+		}
+	}
+}
+
+func (p *parser) isVar(name string) bool {
+	for _, v := range p.vars {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOf parses "of them" or "of ($a*)", after the quantifier
+func (p *parser) parseOf(q quantifier) expr {
+	p.expect("of")
+	return ofExpr{quant: q, strings: p.parseStringSet()}
+}
+
+// parseFor parses the for loops, after "for"
+func (p *parser) parseFor() expr {
+	var q quantifier
+	switch {
+	case p.is("any") || p.is("all") || p.is("none"):
+		q.kind = p.tok.text
+		p.next()
+	case p.tok.kind == tokNumber:
+		q.kind = "n"
+		q.n = intLit(p.tok.num)
+		p.next()
+	default:
+		p.errorf("expected a quantifier, found %s", p.describe())
+	}
+	if p.accept("of") {
+		x := ofExpr{quant: q, strings: p.parseStringSet()}
+		p.expect(":")
+		p.expect("(")
+		p.inForOf++
+		x.cond = p.parseExpr()
+		p.inForOf--
+		p.expect(")")
+		return x
+	}
+	x := forInExpr{quant: q, name: p.ident()}
+	if keywords[x.name] || p.ruleNames[x.name] || knownModules[x.name] {
+		p.errorf("invalid variable name %q", x.name)
+	}
+	p.expect("in")
+	if p.accept("(") {
+		first := p.parseExpr()
+		if p.accept("..") {
+			x.lo, x.hi = first, p.parseExpr()
+		} else {
+			x.list = []expr{first}
+			for p.accept(",") {
+				x.list = append(x.list, p.parseExpr())
+			}
+		}
+		p.expect(")")
+	} else {
+		x.array = p.parseUnary()
+	}
+	p.expect(":")
+	p.expect("(")
+	p.vars = append(p.vars, x.name)
+	x.cond = p.parseExpr()
+	p.vars = p.vars[:len(p.vars)-1]
+	p.expect(")")
+	return x
+}
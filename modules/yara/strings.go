@@ -0,0 +1,413 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Julien Vehent jvehent@mozilla.com [:ulfr]
+
+package yara /* import "mig.ninja/mig/modules/yara" */
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type patternKind int
+
+const (
+	patternText patternKind = iota
+	patternHex
+	patternRegex
+)
+
+// pattern is a string of a rule
+type pattern struct {
+	id       string
+	kind     patternKind
+	nocase   bool
+	fullword bool
+	private  bool
+	// the ascii and wide forms of a text string, lower cased if nocase
+	texts [][]byte
+	wides []bool
+	hex   []hexToken
+	re    *regexp.Regexp
+	// the literal bytes a regular expression starts with
+	prefix   []byte
+	anchored bool
+}
+
+// stringMatch is a match of a pattern in the scanned data
+type stringMatch struct {
+	offset int
+	length int
+}
+
+// wide returns the UTF-16 form of an ASCII text
+func wide(text []byte) []byte {
+	w := make([]byte, 0, 2*len(text))
+	for _, c := range text {
+		w = append(w, c, 0)
+	}
+	return w
+}
+
+// lower returns the ASCII lower case form of bytes
+func lower(b []byte) []byte {
+	l := make([]byte, len(b))
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		l[i] = c
+	}
+	return l
+}
+
+func isAlnum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// isFullword returns true if a match is not preceded or followed by an
+// alphanumeric character, or by an alphanumeric UTF-16 character for the
+// wide strings
+func isFullword(data []byte, offset, length int, isWide bool) bool {
+	step := 1
+	if isWide {
+		step = 2
+	}
+	if offset >= step && isAlnum(data[offset-step]) && (!isWide || data[offset-1] == 0) {
+		return false
+	}
+	end := offset + length
+	if end < len(data) && isAlnum(data[end]) && (!isWide || end+1 < len(data) && data[end+1] == 0) {
+		return false
+	}
+	return true
+}
+
+// find returns the matches of a pattern in the data of a scan
+func (p *pattern) find(ctx *scanContext) (matches []stringMatch) {
+	switch p.kind {
+	case patternText:
+		data := ctx.data
+		if p.nocase {
+			data = ctx.lowerData()
+		}
+		for i, text := range p.texts {
+			for off := 0; len(matches) < maxStringMatches; off++ {
+				idx := bytes.Index(data[off:], text)
+				if idx < 0 {
+					break
+				}
+				off += idx
+				if !p.fullword || isFullword(ctx.data, off, len(text), p.wides[i]) {
+					matches = append(matches, stringMatch{off, len(text)})
+				}
+			}
+		}
+		if len(p.texts) == 2 {
+			sortMatches(matches)
+		}
+	case patternHex:
+		for off := 0; off < len(ctx.data) && len(matches) < maxStringMatches; off++ {
+			first := p.hex[0]
+			if first.kind == hexByte && first.mask == 0xff && !first.not {
+				// move to the next occurrence of the first byte
+				idx := bytes.IndexByte(ctx.data[off:], first.value)
+				if idx < 0 {
+					break
+				}
+				off += idx
+			}
+			if end, ok := matchHex(p.hex, ctx.data, off); ok {
+				matches = append(matches, stringMatch{off, end - off})
+			}
+		}
+	case patternRegex:
+		for off := 0; off < len(ctx.data) && len(matches) < maxStringMatches; off++ {
+			if len(p.prefix) > 0 && !p.anchored {
+				idx := bytes.Index(ctx.data[off:], p.prefix)
+				if idx < 0 {
+					break
+				}
+				off += idx
+			}
+			loc := p.re.FindReaderIndex(&byteRunes{b: ctx.data[off:]})
+			if loc == nil {
+				break
+			}
+			off += loc[0]
+			// empty matches are ignored, as YARA does
+			if loc[1] > loc[0] && (!p.fullword || isFullword(ctx.data, off, loc[1]-loc[0], false)) {
+				matches = append(matches, stringMatch{off, loc[1] - loc[0]})
+			}
+			if p.anchored {
+				// ^ only matches at the start of the data, while the
+				// regexp package sees a start at each offset
+				break
+			}
+		}
+	}
+	return
+}
+
+// sortMatches sorts matches by offset
+func sortMatches(m []stringMatch) {
+	for i := 1; i < len(m); i++ {
+		for j := i; j > 0 && m[j].offset < m[j-1].offset; j-- {
+			m[j], m[j-1] = m[j-1], m[j]
+		}
+	}
+}
+
+// byteRunes reads bytes as runes, so regular expressions match bytes
+// rather than UTF-8 characters: \xe8 matches the byte 0xe8
+type byteRunes struct {
+	b []byte
+	i int
+}
+
+func (r *byteRunes) ReadRune() (rune, int, error) {
+	if r.i >= len(r.b) {
+		return 0, 0, io.EOF
+	}
+	c := r.b[r.i]
+	r.i++
+	return rune(c), 1, nil
+}
+
+// compileRegex compiles a regular expression matching bytes. Each byte of
+// the expression is a character, so a UTF-8 text in the expression matches
+// its bytes.
+func compileRegex(expr string, nocase, dotall bool) (re *regexp.Regexp, prefix []byte, anchored bool, err error) {
+	runes := make([]rune, 0, len(expr)+8)
+	if nocase {
+		runes = append(runes, []rune("(?i)")...)
+	}
+	if dotall {
+		runes = append(runes, []rune("(?s)")...)
+	}
+	for i := 0; i < len(expr); i++ {
+		runes = append(runes, rune(expr[i]))
+	}
+	re, err = regexp.Compile(string(runes))
+	if err != nil {
+		return
+	}
+	if lit, _ := re.LiteralPrefix(); lit != "" {
+		for _, r := range lit {
+			prefix = append(prefix, byte(r))
+		}
+	}
+	anchored = strings.HasPrefix(expr, "^")
+	return
+}
+
+type hexKind int
+
+const (
+	hexByte hexKind = iota
+	hexJump
+	hexAlt
+)
+
+// hexToken is a byte, a jump or a set of alternatives of a hex string
+type hexToken struct {
+	kind  hexKind
+	value byte
+	mask  byte
+	not   bool
+	// the range of a jump, max is -1 for unbounded jumps
+	min, max int
+	alts     [][]hexToken
+}
+
+// parseHex parses the body of a hex string
+func parseHex(src string) (tokens []hexToken, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = e.(error)
+		}
+	}()
+	fields := strings.Fields(strings.NewReplacer("[", " [", "]", "] ", "(", " ( ", ")", " ) ", "|", " | ", "~", " ~ ").Replace(src))
+	var pos int
+	tokens = parseHexSeq(fields, &pos, false)
+	if pos != len(fields) {
+		return nil, hexError("unexpected %q", fields[pos])
+	}
+	if len(tokens) == 0 || tokens[0].kind == hexJump || tokens[len(tokens)-1].kind == hexJump {
+		return nil, hexError("hex strings cannot be empty, or start or end with a jump")
+	}
+	if countJumps(tokens) > maxHexJumps {
+		return nil, hexError("more than %d jumps", maxHexJumps)
+	}
+	return
+}
+
+// maxHexJumps limits the jumps of hex strings, as each jump multiplies the
+// offsets tried by matchHex
+const maxHexJumps = 16
+
+func countJumps(tokens []hexToken) (n int) {
+	for _, t := range tokens {
+		switch t.kind {
+		case hexJump:
+			n++
+		case hexAlt:
+			for _, alt := range t.alts {
+				n += countJumps(alt)
+			}
+		}
+	}
+	return
+}
+
+func hexError(format string, a ...interface{}) error {
+	return fmt.Errorf("invalid hex string: "+format, a...)
+}
+
+// parseHexSeq parses a sequence of tokens, up to the end of the
+// alternative it is in
+func parseHexSeq(fields []string, pos *int, inAlt bool) (tokens []hexToken) {
+	for *pos < len(fields) {
+		f := fields[*pos]
+		switch {
+		case f == "|" || f == ")":
+			if !inAlt {
+				panic(hexError("unexpected %q", f))
+			}
+			return
+		case f == "(":
+			*pos++
+			var alt hexToken
+			alt.kind = hexAlt
+			for {
+				seq := parseHexSeq(fields, pos, true)
+				if len(seq) == 0 {
+					panic(hexError("empty alternative"))
+				}
+				alt.alts = append(alt.alts, seq)
+				if *pos >= len(fields) {
+					panic(hexError("unterminated alternative"))
+				}
+				if fields[*pos] == ")" {
+					*pos++
+					break
+				}
+				*pos++
+			}
+			tokens = append(tokens, alt)
+			continue
+		case strings.HasPrefix(f, "["):
+			tokens = append(tokens, parseJump(f))
+		case f == "~":
+			*pos++
+			if *pos >= len(fields) || len(fields[*pos]) != 2 {
+				panic(hexError("~ must be followed by one byte"))
+			}
+			tokens = append(tokens, parseHexBytes(fields[*pos], true)...)
+		default:
+			tokens = append(tokens, parseHexBytes(f, false)...)
+		}
+		*pos++
+	}
+	return
+}
+
+// parseJump parses a jump such as [4], [2-8], [2-] or [-]
+func parseJump(f string) (t hexToken) {
+	t.kind = hexJump
+	if !strings.HasSuffix(f, "]") {
+		panic(hexError("invalid jump %q", f))
+	}
+	body := f[1 : len(f)-1]
+	bounds := strings.SplitN(body, "-", 2)
+	var err error
+	if bounds[0] != "" {
+		t.min, err = strconv.Atoi(bounds[0])
+		if err != nil || t.min < 0 {
+			panic(hexError("invalid jump %q", f))
+		}
+	}
+	switch {
+	case len(bounds) == 1:
+		t.max = t.min
+	case bounds[1] == "":
+		t.max = -1
+	default:
+		t.max, err = strconv.Atoi(bounds[1])
+		if err != nil || t.max < t.min {
+			panic(hexError("invalid jump %q", f))
+		}
+	}
+	return
+}
+
+// parseHexBytes parses a run of hex digits and wildcards, such as 4D5A??
+func parseHexBytes(f string, not bool) (tokens []hexToken) {
+	if len(f)%2 != 0 {
+		panic(hexError("invalid bytes %q", f))
+	}
+	for i := 0; i < len(f); i += 2 {
+		t := hexToken{kind: hexByte, not: not}
+		for j, c := range f[i : i+2] {
+			shift := uint(4 * (1 - j))
+			if c == '?' {
+				continue
+			}
+			v, err := strconv.ParseUint(string(c), 16, 8)
+			if err != nil {
+				panic(hexError("invalid bytes %q", f))
+			}
+			t.value |= byte(v) << shift
+			t.mask |= 0xf << shift
+		}
+		if not && t.mask == 0 {
+			panic(hexError("~?? matches nothing"))
+		}
+		tokens = append(tokens, t)
+	}
+	return
+}
+
+// matchHex returns the end of the match of a sequence of hex tokens at an
+// offset of the data, trying the shortest jumps and the first alternatives
+// first
+func matchHex(tokens []hexToken, data []byte, off int) (end int, ok bool) {
+	for i, t := range tokens {
+		switch t.kind {
+		case hexByte:
+			if off >= len(data) {
+				return 0, false
+			}
+			if (data[off]&t.mask == t.value) == t.not {
+				return 0, false
+			}
+			off++
+		case hexJump:
+			max := t.max
+			if max < 0 || off+max > len(data) {
+				max = len(data) - off
+			}
+			for j := t.min; j <= max; j++ {
+				if end, ok := matchHex(tokens[i+1:], data, off+j); ok {
+					return end, true
+				}
+			}
+			return 0, false
+		case hexAlt:
+			for _, alt := range t.alts {
+				rest := append(append([]hexToken{}, alt...), tokens[i+1:]...)
+				if end, ok := matchHex(rest, data, off); ok {
+					return end, true
+				}
+			}
+			return 0, false
+		}
+	}
+	return off, true
+}
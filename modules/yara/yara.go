@@ -0,0 +1,156 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Julien Vehent jvehent@mozilla.com [:ulfr]
+
+/* The yara package compiles YARA rules and matches them against files and
+process memory, for the yara checks of the file and memory modules. It is
+written in Go, so the agent does not depend on libyara, and it is not a
+module itself.
+
+The following subset of the YARA language is supported:
+
+- imports of the pe and elf modules, and the global and private rules,
+  tags and metadata
+- text strings with the nocase, wide, ascii, fullword and private
+  modifiers
+- hex strings with wildcards (??, 4?, ?4), negations (~4D), jumps ([4],
+  [2-8], [2-], [-]) and alternatives ((4D 5A | 5A 4D))
+- regular expressions with the i and s flags, and the nocase, ascii,
+  fullword and private modifiers. Regular expressions match bytes, but use
+  the RE2 syntax of Go, which has no backreference.
+- conditions with boolean, arithmetic, bitwise and comparison operators,
+  the contains, icontains, startswith, istartswith, endswith, iendswith,
+  iequals and matches string operators, string references ($a, $a at 100,
+  $a in (0..1024)), counts (#a, #a in (0..1024)), offsets (@a[1]) and
+  lengths (!a[1]) of matches, filesize, the uint8, uint16, uint32, int8,
+  int16 and int32 functions and their big endian versions, references to
+  the previous rules, "any of them", "all of ($a*, $b)", "2 of them",
+  "none of them", and the for loops over strings, ranges, lists and arrays
+  of the modules, such as "for any i in (1..#a) : ( @a[i] < 100 )".
+- the fields and functions of the pe and elf modules listed in modules.go.
+
+The xor and base64 modifiers, the external variables, the includes and the
+other modules of YARA are not supported, and rules using them fail to
+compile.
+*/
+package yara /* import "mig.ninja/mig/modules/yara" */
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	// maxStringMatches is the number of matches kept for each string, as
+	// YARA stops counting at a fixed limit
+	maxStringMatches = 10000
+
+	// maxReportedMatches is the number of matches of each string returned
+	// in the details of a Match
+	maxReportedMatches = 16
+)
+
+// Rules is a set of compiled rules
+type Rules struct {
+	rules   []*rule
+	imports map[string]bool
+}
+
+// rule is a compiled rule
+type rule struct {
+	name      string
+	tags      []string
+	meta      map[string]string
+	global    bool
+	private   bool
+	strings   []*pattern
+	condition expr
+}
+
+// Match is a rule matching scanned data, with the matches of its strings
+type Match struct {
+	Rule    string            `json:"rule"`
+	Tags    []string          `json:"tags,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+	Strings []MatchString     `json:"strings,omitempty"`
+}
+
+// MatchString is a match of a string of a rule. Offset is an offset in
+// the scanned file, or an address in the memory of a process.
+type MatchString struct {
+	ID     string `json:"id"`
+	Offset uint64 `json:"offset"`
+	Length int    `json:"length"`
+}
+
+// Compile parses the source of a set of rules
+func Compile(source string) (rs *Rules, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("Compile() -> %v", e)
+		}
+	}()
+	p := newParser(source)
+	rs = p.parseRules()
+	if len(rs.rules) == 0 {
+		return nil, fmt.Errorf("no rule found")
+	}
+	return
+}
+
+// Scan matches the rules against the content of a file
+func (rs *Rules) Scan(data []byte) ([]Match, error) {
+	return rs.scan(data, 0, true)
+}
+
+// ScanMemory matches the rules against a region of the memory of a process
+// starting at an address. The offsets of the matches are addresses, and
+// filesize is undefined.
+func (rs *Rules) ScanMemory(data []byte, base uint64) ([]Match, error) {
+	return rs.scan(data, base, false)
+}
+
+func (rs *Rules) scan(data []byte, base uint64, isFile bool) (matches []Match, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("Scan() -> %v", e)
+		}
+	}()
+	ctx := newScanContext(data, base, isFile, rs.imports)
+	globalFailed := false
+	for _, r := range rs.rules {
+		ctx.rule = r
+		ctx.matches = make([][]stringMatch, len(r.strings))
+		for i, p := range r.strings {
+			ctx.matches[i] = p.find(ctx)
+		}
+		matched := ctx.eval(r.condition).truth()
+		ctx.ruleResults[r.name] = matched
+		if r.global && !matched {
+			globalFailed = true
+		}
+		if !matched || r.private {
+			continue
+		}
+		m := Match{Rule: r.name, Tags: r.tags, Meta: r.meta}
+		for i, p := range r.strings {
+			if p.private {
+				continue
+			}
+			for j, sm := range ctx.matches[i] {
+				if j >= maxReportedMatches {
+					break
+				}
+				m.Strings = append(m.Strings, MatchString{ID: p.id, Offset: base + uint64(sm.offset), Length: sm.length})
+			}
+		}
+		sort.SliceStable(m.Strings, func(i, j int) bool { return m.Strings[i].Offset < m.Strings[j].Offset })
+		matches = append(matches, m)
+	}
+	if globalFailed {
+		return nil, nil
+	}
+	return
+}
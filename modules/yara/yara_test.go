@@ -0,0 +1,278 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Julien Vehent jvehent@mozilla.com [:ulfr]
+
+package yara /* import "mig.ninja/mig/modules/yara" */
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+)
+
+var testData = []byte("MZ\x90\x00 some header This program cannot be run in DOS mode.\r\n" +
+	"h\x00t\x00t\x00p\x00:\x00/\x00/\x00 evil.example.com/payload.bin " +
+	"\xde\xad\xbe\xef\x01\x02\x03\xca\xfe password=hunter2 PASSWORD=x passwords")
+
+var ruleTests = []struct {
+	name   string
+	rule   string
+	expect bool
+}{
+	{"text", `rule t { strings: $a = "cannot be run" condition: $a }`, true},
+	{"text absent", `rule t { strings: $a = "not there" condition: $a }`, false},
+	{"nocase", `rule t { strings: $a = "THIS PROGRAM" nocase condition: $a }`, true},
+	{"case", `rule t { strings: $a = "THIS PROGRAM" condition: $a }`, false},
+	{"wide", `rule t { strings: $a = "http://" wide condition: $a }`, true},
+	{"wide only", `rule t { strings: $a = "evil" wide condition: $a }`, false},
+	{"wide ascii", `rule t { strings: $a = "evil" wide ascii condition: $a }`, true},
+	{"fullword", `rule t { strings: $a = "password" fullword condition: #a == 1 }`, true},
+	{"count", `rule t { strings: $a = "password" nocase condition: #a == 3 }`, true},
+	{"hex", `rule t { strings: $a = { DE AD BE EF } condition: $a }`, true},
+	{"hex wildcards", `rule t { strings: $a = { DE ?? B? EF 0? } condition: $a }`, true},
+	{"hex jump", `rule t { strings: $a = { DE AD [2-6] CA FE } condition: $a }`, true},
+	{"hex short jump", `rule t { strings: $a = { DE AD [1-2] CA FE } condition: $a }`, false},
+	{"hex unbounded jump", `rule t { strings: $a = { 4D 5A [-] CA FE } condition: $a }`, true},
+	{"hex alternatives", `rule t { strings: $a = { BE EF ( 00 | 01 02 ) 03 } condition: $a }`, true},
+	{"hex not", `rule t { strings: $a = { DE ~AD } condition: $a }`, false},
+	{"hex not other", `rule t { strings: $a = { DE ~00 BE } condition: $a }`, true},
+	{"regex", `rule t { strings: $a = /evil\.[a-z]+\.com\/\w+/ condition: !a[1] == 24 }`, true},
+	{"regex nocase", `rule t { strings: $a = /PASSWORD=[a-z0-9]+/ nocase condition: #a == 2 }`, true},
+	{"regex bytes", `rule t { strings: $a = /\xde\xad.{2}\x01/ condition: $a }`, true},
+	{"regex anchored", `rule t { strings: $a = /^MZ/ condition: $a }`, true},
+	{"regex anchored absent", `rule t { strings: $a = /^some/ condition: $a }`, false},
+	{"at", `rule t { strings: $a = "MZ" condition: $a at 0 and uint16(0) == 0x5A4D }`, true},
+	{"in", `rule t { strings: $a = "password" condition: $a in (100..filesize) }`, true},
+	{"offset", `rule t { strings: $a = "password" condition: @a[1] > 100 and @a[2] == @a[1] + 28 }`, true},
+	{"undefined offset", `rule t { strings: $a = "password" condition: @a[5] > 0 }`, false},
+	{"filesize", `rule t { condition: filesize < 1KB and filesize > 100 }`, true},
+	{"arithmetic", `rule t { condition: (1 + 2 * 3) \ 2 == 3 and 7 % 4 == 3 and 1 << 4 == 16 and -2 < 0 }`, true},
+	{"bitwise", `rule t { condition: (0xf0 & 0x3c) | 1 == 0x31 and (5 ^ 1) == 4 and ~0 == -1 }`, true},
+	{"big endian", `rule t { condition: uint32be(0) == 0x4D5A9000 and int8(2) == -112 }`, true},
+	{"any of", `rule t { strings: $a = "nope" $b = "evil" condition: any of them }`, true},
+	{"all of", `rule t { strings: $a = "nope" $b = "evil" condition: all of them }`, false},
+	{"n of", `rule t { strings: $a1 = "nope" $a2 = "evil" $a3 = "hunter2" condition: 2 of ($a*) }`, true},
+	{"none of", `rule t { strings: $a = "nope" $b = "nada" condition: none of them }`, true},
+	{"for of", `rule t { strings: $a = "MZ" $b = "evil" condition: for any of them : ( $ at 0 ) }`, true},
+	{"for all of", `rule t { strings: $a = "MZ" $b = "nope" condition: for all of them : ( # > 0 ) }`, false},
+	{"for range", `rule t { strings: $a = "password" nocase condition: for all i in (1..#a) : ( @a[i] > 100 ) }`, true},
+	{"for list", `rule t { condition: for any x in (1, 2, 3) : ( x * 2 == 6 ) }`, true},
+	{"text operators", `rule t { condition: "evil.example.com" endswith ".com" and "ABC" iequals "abc" and "xyz" matches /^x.z$/ }`, true},
+	{"rule reference", `rule a { strings: $a = "evil" condition: $a } rule t { condition: a and not false }`, true},
+	{"global", `global rule g { condition: filesize > 10MB } rule t { condition: true }`, false},
+	{"comments", "rule t {\n// a comment\nstrings: /* another */ $a = \"evil\" condition: $a }", true},
+}
+
+func TestRules(t *testing.T) {
+	for _, tc := range ruleTests {
+		rules, err := Compile(tc.rule)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		matches, err := rules.Scan(testData)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		matched := false
+		for _, m := range matches {
+			if m.Rule == "t" {
+				matched = true
+			}
+		}
+		if matched != tc.expect {
+			t.Errorf("%s: expected match %t, got %t", tc.name, tc.expect, matched)
+		}
+	}
+}
+
+func TestMatchDetails(t *testing.T) {
+	rules, err := Compile(`
+private rule private_rule { condition: true }
+rule details : tag1 tag2 {
+	meta:
+		author = "mig"
+		score = 10
+	strings:
+		$header = "MZ"
+		$hidden = "evil" private
+		$pw = "password" nocase
+	condition:
+		all of them and private_rule
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, err := rules.Scan(testData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 {
+		t.Fatalf("expected 1 match, got %d", len(matches))
+	}
+	m := matches[0]
+	if m.Rule != "details" || len(m.Tags) != 2 || m.Meta["author"] != "mig" || m.Meta["score"] != "10" {
+		t.Fatalf("invalid match %+v", m)
+	}
+	if len(m.Strings) != 4 {
+		t.Fatalf("expected 4 strings, got %+v", m.Strings)
+	}
+	if m.Strings[0].ID != "$header" || m.Strings[0].Offset != 0 || m.Strings[0].Length != 2 {
+		t.Fatalf("invalid first string %+v", m.Strings[0])
+	}
+	for i, s := range m.Strings {
+		if s.ID == "$hidden" {
+			t.Fatalf("private string reported")
+		}
+		if i > 0 && s.Offset < m.Strings[i-1].Offset {
+			t.Fatalf("strings not sorted by offset: %+v", m.Strings)
+		}
+	}
+
+	// in memory, the offsets are addresses and filesize is undefined
+	rules, err = Compile(`rule mem { strings: $a = "MZ" condition: $a at 0x7f0000 and not defined filesize }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, err = rules.ScanMemory(testData, 0x7f0000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Strings[0].Offset != 0x7f0000 {
+		t.Fatalf("invalid memory matches %+v", matches)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, rule := range []string{
+		``,
+		`rule t { condition: $a }`,
+		`rule t { strings: $a = "a" $a = "b" condition: $a }`,
+		`rule t { condition: true } rule t { condition: true }`,
+		`rule t { condition: unknown_rule }`,
+		`rule t { strings: $a = { 4D 5A condition: $a }`,
+		`rule t { strings: $a = { [2] 4D } condition: $a }`,
+		`rule t { strings: $a = { 4D 5 } condition: $a }`,
+		`rule t { strings: $a = /(a/ condition: $a }`,
+		`rule t { strings: $a = "a" xor condition: $a }`,
+		`rule t { strings: $a = "a" condition: $ }`,
+		`rule t { condition: pe.is_pe }`,
+		`import "pe" rule t { condition: pe.not_a_field }`,
+		`import "cuckoo" rule t { condition: true }`,
+		`include "other.yar"`,
+		`rule t { strings: $a = "unterminated condition: $a }`,
+		`rule t { condition: true`,
+	} {
+		if _, err := Compile(rule); err == nil {
+			t.Errorf("expected an error compiling %q", rule)
+		}
+	}
+}
+
+// buildPE returns a minimal 32 bits PE, with one section and no import
+func buildPE() []byte {
+	data := make([]byte, 0x400)
+	copy(data, "MZ")
+	binary.LittleEndian.PutUint32(data[0x3c:], 0x40)
+	copy(data[0x40:], "PE\x00\x00")
+	fh := data[0x44:]
+	binary.LittleEndian.PutUint16(fh[0:], 0x14c)      // machine
+	binary.LittleEndian.PutUint16(fh[2:], 1)          // number of sections
+	binary.LittleEndian.PutUint32(fh[4:], 1500000000) // timestamp
+	binary.LittleEndian.PutUint16(fh[16:], 0xe0)      // size of optional header
+	binary.LittleEndian.PutUint16(fh[18:], 0x2102)    // characteristics
+	oh := data[0x58:]
+	binary.LittleEndian.PutUint16(oh[0:], 0x10b)     // magic
+	binary.LittleEndian.PutUint32(oh[16:], 0x1010)   // entry point
+	binary.LittleEndian.PutUint32(oh[28:], 0x400000) // image base
+	binary.LittleEndian.PutUint32(oh[32:], 0x1000)   // section alignment
+	binary.LittleEndian.PutUint32(oh[36:], 0x200)    // file alignment
+	binary.LittleEndian.PutUint16(oh[68:], 2)        // subsystem
+	binary.LittleEndian.PutUint32(oh[92:], 16)       // number of data directories
+	sh := data[0x58+0xe0:]
+	copy(sh, ".text")
+	binary.LittleEndian.PutUint32(sh[8:], 0x100)       // virtual size
+	binary.LittleEndian.PutUint32(sh[12:], 0x1000)     // virtual address
+	binary.LittleEndian.PutUint32(sh[16:], 0x200)      // size of raw data
+	binary.LittleEndian.PutUint32(sh[20:], 0x200)      // pointer to raw data
+	binary.LittleEndian.PutUint32(sh[36:], 0x60000020) // characteristics
+	copy(data[0x210:], "\x55\x89\xe5")
+	return data
+}
+
+func TestPEModule(t *testing.T) {
+	rules, err := Compile(`
+import "pe"
+rule is_pe {
+	condition:
+		pe.is_pe == 1 and pe.machine == pe.MACHINE_I386 and pe.number_of_sections == 1 and
+		pe.timestamp == 1500000000 and pe.characteristics & pe.DLL and pe.is_dll() and
+		pe.is_32bit() and not pe.is_64bit() and pe.subsystem == pe.SUBSYSTEM_WINDOWS_GUI and
+		pe.image_base == 0x400000 and pe.entry_point == 0x210 and
+		uint8(pe.entry_point) == 0x55 and pe.sections[0].name == ".text" and
+		pe.sections[0].characteristics & pe.SECTION_MEM_EXECUTE and
+		for any s in pe.sections : ( s.raw_data_offset == 0x200 ) and
+		not pe.imports("kernel32.dll")
+}
+rule not_pe {
+	condition:
+		pe.is_pe == 0 and not defined pe.machine
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, err := rules.Scan(buildPE())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Rule != "is_pe" {
+		t.Fatalf("expected the is_pe rule to match the PE, got %+v", matches)
+	}
+	matches, err = rules.Scan(testData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Rule != "not_pe" {
+		t.Fatalf("expected the not_pe rule to match the data, got %+v", matches)
+	}
+}
+
+func TestELFModule(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the test binary is not an ELF")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := Compile(`
+import "elf"
+rule is_elf {
+	strings:
+		$magic = { 7F 45 4C 46 }
+	condition:
+		$magic at 0 and (elf.type == elf.ET_EXEC or elf.type == elf.ET_DYN) and
+		elf.number_of_segments > 0 and elf.entry_point < filesize and
+		for any s in elf.sections : ( s.name == ".text" and s.flags & elf.SHF_EXECINSTR ) and
+		for any p in elf.segments : ( p.type == elf.PT_LOAD )
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, err := rules.Scan(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 {
+		t.Fatalf("expected the test binary to match, got %+v", matches)
+	}
+}
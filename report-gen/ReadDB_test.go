@@ -0,0 +1,396 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jvehent/cljs"
+	"mig.ninja/mig"
+	"mig.ninja/mig/modules"
+	"mig.ninja/mig/modules/amcache"
+	"mig.ninja/mig/modules/execution"
+	"mig.ninja/mig/modules/lnk"
+	"mig.ninja/mig/modules/ntfs"
+	"mig.ninja/mig/modules/prefetch"
+	"mig.ninja/mig/modules/registry"
+)
+
+var testT0 = time.Date(2016, 9, 1, 10, 0, 0, 0, time.UTC)
+
+// testCommand returns a successful command of action 42, running the
+// registry and prefetch modules on an agent
+func testCommand(id float64, agent string, regs []registry.RegRecord, prefs []prefetch.PrefetchResult) mig.Command {
+	var cmd mig.Command
+	cmd.ID = id
+	cmd.Status = mig.StatusSuccess
+	cmd.Agent.Name = agent
+	cmd.Action.ID = 42
+	cmd.Action.Name = "hunt explerer"
+	cmd.Action.Operations = []mig.Operation{{Module: "registry"}, {Module: "prefetch"}}
+	cmd.Results = []modules.Result{
+		{Success: true, FoundAnything: true, Elements: map[string]interface{}{"registryresults": regs}},
+		{Success: true, FoundAnything: true, Elements: map[string]interface{}{"prefetchresults": prefs}},
+	}
+	return cmd
+}
+
+func testRegRecord(key string, t time.Time) registry.RegRecord {
+	return registry.RegRecord{
+		Hive:      "NTUSER.DAT",
+		Key:       key,
+		LastWrite: t,
+		Times:     []modules.ArtefactTime{modules.NewArtefactTime(modules.ArtefactTimeLastWrite, t, "registry")},
+	}
+}
+
+func testPrefetch(exe string, runs ...time.Time) (pr prefetch.PrefetchResult) {
+	pr.ExeName = exe
+	pr.ExecDate = runs[len(runs)-1]
+	for _, t := range runs {
+		pr.Times = append(pr.Times, modules.NewArtefactTime(modules.ArtefactTimeExecuted, t, "prefetch"))
+	}
+	return
+}
+
+func testCommands() []mig.Command {
+	return []mig.Command{
+		testCommand(1, "host-a.example.net",
+			[]registry.RegRecord{testRegRecord(`Software\Microsoft\Windows\CurrentVersion\Run`, testT0.Add(5*time.Minute))},
+			[]prefetch.PrefetchResult{testPrefetch("EXPLERER.EXE", testT0.Add(time.Hour), testT0)}),
+		testCommand(2, "host-b.example.net",
+			[]registry.RegRecord{testRegRecord(`Software\Microsoft\Windows\CurrentVersion\Run`, testT0.Add(30*time.Minute))},
+			[]prefetch.PrefetchResult{testPrefetch("EXPLERER.EXE", testT0.Add(20*time.Minute))}),
+		testCommand(3, "host-c.example.net",
+			nil,
+			[]prefetch.PrefetchResult{testPrefetch("EXPLERER.EXE", testT0.Add(2*time.Hour))}),
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	opts, err := parseOptions("42, 43", "Registry,prefetch,ntfs", "CSV", "-", "2016-09-01T00:00:00Z", "2016-09-02T00:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts.ActionIDs) != 2 || opts.ActionIDs[1] != 43 || len(opts.Modules) != 3 ||
+		opts.Modules[0] != "registry" || opts.Format != "csv" || opts.Output != "" {
+		t.Fatalf("unexpected options %+v", opts)
+	}
+	if !opts.inRange(testT0) || opts.inRange(testT0.Add(24*time.Hour)) {
+		t.Fatalf("unexpected time range %s to %s", opts.After, opts.Before)
+	}
+	for _, tc := range [][]string{
+		{"abc", "", "text", "", "", ""},
+		{"", "netstat", "text", "", "", ""},
+		{"", "", "pdf", "", "", ""},
+		{"", "", "text", "", "yesterday", ""},
+		{"", "", "text", "", "2016-09-02T00:00:00Z", "2016-09-01T00:00:00Z"},
+	} {
+		if _, err := parseOptions(tc[0], tc[1], tc[2], tc[3], tc[4], tc[5]); err == nil {
+			t.Fatalf("expected error on options %q", tc)
+		}
+	}
+	opts, err = parseOptions("", "", "text", "", "", "")
+	if err != nil || len(opts.Modules) != len(defaultModules) || len(opts.ActionIDs) != 0 {
+		t.Fatalf("unexpected default options %+v, %v", opts, err)
+	}
+}
+
+// testSource serves the test commands as the MIG API would
+type testSource struct {
+	commands []mig.Command
+	targets  []string
+}
+
+func (ts *testSource) FetchActionResults(a mig.Action) (cmds []mig.Command, err error) {
+	for _, cmd := range ts.commands {
+		if cmd.Action.ID == a.ID {
+			cmds = append(cmds, cmd)
+		}
+	}
+	return
+}
+
+func (ts *testSource) GetAPIResource(target string) (*cljs.Resource, error) {
+	ts.targets = append(ts.targets, target)
+	resource := cljs.New(target)
+	offset := pageSize * (len(ts.targets) - 1)
+	if offset >= len(ts.commands) {
+		resource.SetError(cljs.Error{Code: "1", Message: "no results found"})
+		return resource, fmt.Errorf("error: HTTP 404. API call failed with error 'no results found' (code 1)")
+	}
+	for _, cmd := range ts.commands[offset:] {
+		resource.AddItem(cljs.Item{Data: []cljs.Data{{Name: "command", Value: cmd}}})
+	}
+	return resource, nil
+}
+
+func TestQueryAPI(t *testing.T) {
+	cmds := testCommands()
+	failed := testCommand(4, "host-d.example.net", nil, nil)
+	failed.Status = mig.StatusFailed
+	cmds = append(cmds, failed)
+	opts, err := parseOptions("42", "", "text", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &testSource{commands: cmds}
+	commands, err := queryAPI(ts, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 3 || len(ts.targets) != 0 {
+		t.Fatalf("expected the 3 successful commands of action 42, got %d", len(commands))
+	}
+
+	// without action ids, successful commands are searched
+	opts.ActionIDs = nil
+	commands, err = queryAPI(&testSource{commands: cmds[:3]}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 3 || commands[2].Agent.Name != "host-c.example.net" {
+		t.Fatalf("unexpected commands %+v", commands)
+	}
+	// a full page of results is followed by a request of the next page
+	var many []mig.Command
+	for i := 0; i < pageSize; i++ {
+		many = append(many, cmds[i%3])
+	}
+	ts = &testSource{commands: many}
+	commands, err = queryAPI(ts, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != pageSize || len(ts.targets) != 2 ||
+		!strings.HasPrefix(ts.targets[0], "search?type=command&") ||
+		!strings.HasSuffix(ts.targets[0], "&status=success") {
+		t.Fatalf("unexpected searches %q", ts.targets)
+	}
+}
+
+func TestProcessResults(t *testing.T) {
+	opts, err := parseOptions("", "", "text", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, artefactTimes, errs := processResults(testCommands(), opts)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	if len(records) != 6 {
+		t.Fatalf("expected 6 records, got %d", len(records))
+	}
+	exe := artefactTimes["EXPLERER.EXE"]
+	if len(exe) != 3 {
+		t.Fatalf("expected the executable on 3 hosts, got %+v", exe)
+	}
+	// the earliest of the run times is the first seen time
+	if exe[0].Agent != "host-a.example.net" || !exe[0].Time.Equal(testT0) || exe[0].CommandID != 1 {
+		t.Fatalf("unexpected first seen time %+v", exe[0])
+	}
+	if len(artefactTimes["NTUSER.DAT/Software/Microsoft/Windows/CurrentVersion/Run"]) != 2 {
+		t.Fatalf("unexpected artefacts %+v", artefactTimes)
+	}
+	scores := scoreHosts(artefactTimes, nil, opts)
+	if len(scores) != 1 || scores[0].Agent != "host-a.example.net" || scores[0].Score != 5 {
+		t.Fatalf("unexpected suspects %+v", scores)
+	}
+
+	// restricting the time range drops the earliest artefacts of host a
+	opts.After = testT0.Add(10 * time.Minute)
+	_, artefactTimes, _ = processResults(testCommands(), opts)
+	scores = scoreHosts(artefactTimes, nil, opts)
+	if len(scores) != 1 || scores[0].Agent != "host-b.example.net" {
+		t.Fatalf("unexpected suspects with time range %+v", scores)
+	}
+
+	// results of old agents cannot be decoded, and are skipped
+	cmds := testCommands()
+	cmds[0].Results[1].Elements = map[string]interface{}{
+		"prefetchresults": []map[string]string{{"exename": "EXPLERER.EXE", "execdate": "2016-09-01 10:00:00"}},
+	}
+	opts.After = time.Time{}
+	_, artefactTimes, errs = processResults(cmds, opts)
+	if len(errs) != 1 || len(artefactTimes["EXPLERER.EXE"]) != 2 {
+		t.Fatalf("expected old prefetch results to be skipped, got %v", errs)
+	}
+}
+
+func TestNTFSRecords(t *testing.T) {
+	change := func(usn int64, t time.Time, name, kind string) ntfs.Change {
+		return ntfs.Change{USN: usn, Time: t, Record: 33, Sequence: 2, Path: `\Users\Public\` + name, Name: name,
+			Times: []modules.ArtefactTime{modules.NewArtefactTime(kind, t, "ntfs")}}
+	}
+	res := modules.Result{Elements: map[string]interface{}{
+		"mftresults": []ntfs.FileRecord{{
+			Record: 32, Path: `\Users\Public\explerer.exe`, Timestomped: true,
+			FN:    ntfs.Times{Created: testT0.Add(time.Hour)},
+			Times: []modules.ArtefactTime{modules.NewArtefactTime(modules.ArtefactTimeCreated, testT0.Add(time.Hour), "ntfs")},
+		}},
+		"usnresults": []ntfs.Change{
+			change(1, testT0, "dropper.tmp", modules.ArtefactTimeCreated),
+			change(2, testT0.Add(time.Minute), "dropper.exe", modules.ArtefactTimeRenamed),
+			change(3, testT0.Add(2*time.Minute), "dropper.exe", modules.ArtefactTimeDeleted),
+		},
+	}}
+	records, err := moduleRecords("ntfs", res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || len(records[0].Artefacts) != 3 {
+		t.Fatalf("unexpected records %+v", records)
+	}
+	rec := records[0]
+	if !rec.Artefacts["/Users/USER/explerer.exe"].Equal(testT0.Add(time.Hour)) {
+		t.Fatalf("unexpected time of the timestomped file %+v", rec.Artefacts)
+	}
+	// the renamed dropper is first seen when it was created under its
+	// previous name
+	for _, name := range []string{"/Users/USER/dropper.tmp", "/Users/USER/dropper.exe"} {
+		if !rec.Artefacts[name].Equal(testT0) || rec.Kinds[name] != modules.ArtefactTimeCreated {
+			t.Fatalf("unexpected first seen time of %s: %v %s", name, rec.Artefacts[name], rec.Kinds[name])
+		}
+	}
+}
+
+func TestAmcacheRecords(t *testing.T) {
+	res := modules.Result{Elements: map[string]interface{}{
+		"amcacheresults": []amcache.ExecRecord{
+			{Source: "amcache", Path: `C:\Users\bob\AppData\Local\Temp\explerer.exe`, LastWrite: testT0.Add(time.Hour),
+				Times: []modules.ArtefactTime{
+					modules.NewArtefactTime(modules.ArtefactTimeLastWrite, testT0.Add(time.Hour), "amcache"),
+					modules.NewArtefactTime(modules.ArtefactTimeInstalled, testT0, "amcache"),
+				}},
+			// shim cache entries without artefact times fall back to the
+			// last write time of their record
+			{Source: "shimcache", Name: "dropper.exe", LastWrite: testT0.Add(2 * time.Hour)},
+		},
+	}}
+	records, err := moduleRecords("amcache", res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || len(records[0].Artefacts) != 2 {
+		t.Fatalf("unexpected records %+v", records)
+	}
+	rec := records[0]
+	name := "C:/Users/USER/AppData/Local/Temp/explerer.exe"
+	if !rec.Artefacts[name].Equal(testT0) || rec.Kinds[name] != modules.ArtefactTimeInstalled {
+		t.Fatalf("unexpected first seen time of the installed program %+v", rec)
+	}
+	if !rec.Artefacts["dropper.exe"].Equal(testT0.Add(2*time.Hour)) || rec.Kinds["dropper.exe"] != modules.ArtefactTimeLastWrite {
+		t.Fatalf("unexpected first seen time of the shim cache entry %+v", rec)
+	}
+}
+
+func TestLnkRecords(t *testing.T) {
+	link := func(target string, opened time.Time, times ...modules.ArtefactTime) lnk.Link {
+		l := lnk.Link{Source: `C:\Users\bob\AppData\Roaming\Microsoft\Windows\Recent\x.lnk`, Opened: opened, Times: times}
+		l.TargetPath = target
+		return l
+	}
+	res := modules.Result{Elements: map[string]interface{}{
+		"lnkresults": []lnk.Link{
+			link(`E:\payroll.xlsm`, testT0.Add(time.Hour),
+				modules.NewArtefactTime(modules.ArtefactTimeAccessed, testT0.Add(time.Hour), "lnk"),
+				modules.NewArtefactTime(modules.ArtefactTimeCreated, testT0, "lnk")),
+			// results of links without artefact times fall back to the
+			// time their target was opened
+			link(`\\fileserver\share\tools.zip`, testT0.Add(2*time.Hour)),
+		},
+	}}
+	records, err := moduleRecords("lnk", res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || len(records[0].Artefacts) != 2 {
+		t.Fatalf("unexpected records %+v", records)
+	}
+	rec := records[0]
+	if !rec.Artefacts["E:/payroll.xlsm"].Equal(testT0) || rec.Kinds["E:/payroll.xlsm"] != modules.ArtefactTimeCreated {
+		t.Fatalf("unexpected first seen time of the removable media file %+v", rec)
+	}
+	if !rec.Artefacts["//fileserver/share/tools.zip"].Equal(testT0.Add(2*time.Hour)) ||
+		rec.Kinds["//fileserver/share/tools.zip"] != modules.ArtefactTimeAccessed {
+		t.Fatalf("unexpected first seen time of the share file %+v", rec)
+	}
+}
+
+func TestExecutionRecords(t *testing.T) {
+	res := modules.Result{Elements: map[string]interface{}{
+		"executionresults": []execution.Event{
+			{Type: execution.TypeCommand, User: "alice", Program: "/home/alice/.cache/x", Time: testT0.Add(time.Hour),
+				Times: []modules.ArtefactTime{modules.NewArtefactTime(modules.ArtefactTimeExecuted, testT0.Add(time.Hour), "execution")}},
+			{Type: execution.TypeExecve, User: "bob", Program: "/home/bob/.cache/x", Time: testT0,
+				Times: []modules.ArtefactTime{modules.NewArtefactTime(modules.ArtefactTimeExecuted, testT0, "execution")}},
+			{Type: execution.TypeFailedLogin, User: "admin", Time: testT0, Details: map[string]string{"host": "192.0.2.1"}},
+			// sessions without a remote host, logouts and boots are not
+			// artefacts
+			{Type: execution.TypeLogin, User: "alice", Time: testT0, Details: map[string]string{"line": "tty1"}},
+			{Type: execution.TypeBoot, User: "reboot", Time: testT0},
+		},
+	}}
+	records, err := moduleRecords("execution", res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || len(records[0].Artefacts) != 2 {
+		t.Fatalf("unexpected records %+v", records)
+	}
+	rec := records[0]
+	if !rec.Artefacts["/home/USER/.cache/x"].Equal(testT0) || rec.Kinds["/home/USER/.cache/x"] != modules.ArtefactTimeExecuted {
+		t.Fatalf("unexpected first seen time of the program %+v", rec)
+	}
+	if !rec.Artefacts["failedlogin:192.0.2.1"].Equal(testT0) || rec.Kinds["failedlogin:192.0.2.1"] != modules.ArtefactTimeFailedLogin {
+		t.Fatalf("unexpected first seen time of the remote host %+v", rec)
+	}
+}
+
+func TestPrintResults(t *testing.T) {
+	cmds := testCommands()
+	for _, tc := range []struct {
+		format   string
+		expected []string
+	}{
+		{"text", []string{
+			"Artefact 1 : EXPLERER.EXE\n           : Date : 2016-09-01T10:00:00Z",
+			"Patient Zero Suspects\n---------------------------\nhost-a.example.net: 5.00\n",
+			"  +3.00 = 3 x 1.00 : prefetch EXPLERER.EXE at 2016-09-01T10:00:00Z, seen 20m0s before host-b.example.net\n",
+		}},
+		{"csv", []string{
+			"action,command,module,agent,search,artefact,time\n",
+			"42,2,registry,host-b.example.net,,NTUSER.DAT/Software/Microsoft/Windows/CurrentVersion/Run,2016-09-01T10:30:00Z\n",
+			"42,3,prefetch,host-c.example.net,,EXPLERER.EXE,2016-09-01T12:00:00Z\n",
+		}},
+		{"html", []string{
+			"<title>Threat Search | hunt explerer | Timeline</title>",
+			"<tr><td>42</td><td>hunt explerer</td>",
+			"<tr><td>host-a.example.net</td><td>5.00</td><td>3.00</td>",
+		}},
+	} {
+		opts, err := parseOptions("", "", tc.format, "", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, artefactTimes, _ := processResults(cmds, opts)
+		var buf bytes.Buffer
+		err = printResults(&buf, cmds, records, artefactTimes, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range tc.expected {
+			if !strings.Contains(buf.String(), e) {
+				t.Fatalf("%s report does not contain %q:\n%s", tc.format, e, buf.String())
+			}
+		}
+	}
+}
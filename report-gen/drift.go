@@ -0,0 +1,202 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"mig.ninja/mig"
+)
+
+// defaultMaxDrift is the clock drift above which the times of a host are
+// not trusted, even once corrected
+const defaultMaxDrift = 5 * time.Minute
+
+// sources of the drift of a host, by order of preference
+const (
+	driftNTP       = "ntp"       // measured by timedrift against an NTP server
+	driftStored    = "stored"    // read from the drift file of the report
+	driftLocalTime = "localtime" // local time returned by timedrift, compared to the command times
+)
+
+/* Timedrift Module Structs */
+type timedriftElements struct {
+	LocalTime string `json:"localtime"`
+}
+
+type timedriftStatistics struct {
+	NtpStats []struct {
+		Host      string `json:"host"`
+		Drift     string `json:"drift"`
+		Reachable bool   `json:"reachable"`
+	} `json:"ntpstats,omitempty"`
+}
+
+// Drift is the clock drift of a host: its local time minus the reference
+// time. A host with a positive drift is ahead, and its artefact times are
+// corrected by subtracting the drift.
+type Drift struct {
+	Agent  string
+	Offset time.Duration
+	Source string // one of driftNTP, driftStored or driftLocalTime, empty if unknown
+	Detail string
+}
+
+// Known returns true if the drift of the host was measured
+func (d Drift) Known() bool {
+	return d.Source != ""
+}
+
+// Excessive returns true if the drift of the host is above the maximum
+// drift of the report
+func (d Drift) Excessive(opts options) bool {
+	return d.Known() && abs(d.Offset) > opts.MaxDrift
+}
+
+// Status describes how far the corrected times of the host can be trusted
+func (d Drift) Status(opts options) string {
+	switch {
+	case !d.Known():
+		return "unknown"
+	case d.Excessive(opts):
+		return "excessive"
+	}
+	return "corrected"
+}
+
+// String returns the drift of the host and where it comes from
+func (d Drift) String() string {
+	if !d.Known() {
+		return "unknown"
+	}
+	sign := "+"
+	if d.Offset < 0 {
+		sign = ""
+	}
+	return fmt.Sprintf("%s%s (%s, %s)", sign, d.Offset, d.Source, d.Detail)
+}
+
+/*
+	readDrifts reads the stored drift of hosts from a file, with one host
+	per line followed by its drift as a Go duration, such as:
+		host-a.example.net  -2m30s
+	Empty lines and lines starting with # are ignored.
+*/
+func readDrifts(path string) (drifts map[string]time.Duration, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("readDrifts() -> %v", e)
+		}
+	}()
+	fd, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer fd.Close()
+	drifts = make(map[string]time.Duration)
+	scanner := bufio.NewScanner(fd)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			panic(fmt.Sprintf("line %d: expected a host and a drift", n))
+		}
+		d, err := time.ParseDuration(fields[1])
+		if err != nil {
+			panic(fmt.Sprintf("line %d: %v", n, err))
+		}
+		drifts[fields[0]] = d
+	}
+	err = scanner.Err()
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+/*
+	hostDrifts returns the clock drift of the hosts of the commands. Drifts
+	measured by the timedrift module against an NTP server are preferred,
+	then stored drifts, then drifts estimated from the local time returned
+	by timedrift. The local time is compared to the middle of the command,
+	and the estimate is discarded when the command took longer than twice
+	the skew tolerance of the report.
+*/
+func hostDrifts(commands []mig.Command, opts options) map[string]Drift {
+	drifts := make(map[string]Drift)
+	for _, cmd := range commands {
+		agent := cmd.Agent.Name
+		if _, ok := drifts[agent]; !ok {
+			drifts[agent] = Drift{Agent: agent}
+		}
+		for i, op := range cmd.Action.Operations {
+			if op.Module != "timedrift" || i >= len(cmd.Results) {
+				continue
+			}
+			var stats timedriftStatistics
+			if cmd.Results[i].GetStatistics(&stats) == nil {
+				for _, ns := range stats.NtpStats {
+					d, err := time.ParseDuration(ns.Drift)
+					if !ns.Reachable || err != nil {
+						continue
+					}
+					drifts[agent] = Drift{Agent: agent, Offset: d, Source: driftNTP,
+						Detail: fmt.Sprintf("measured against %s by command %.0f", ns.Host, cmd.ID)}
+				}
+			}
+			if drifts[agent].Source == driftNTP {
+				continue
+			}
+			var el timedriftElements
+			if cmd.Results[i].GetElements(&el) != nil || cmd.StartTime.IsZero() || cmd.FinishTime.IsZero() {
+				continue
+			}
+			local, err := time.Parse(time.RFC3339Nano, el.LocalTime)
+			if err != nil {
+				continue
+			}
+			precision := cmd.FinishTime.Sub(cmd.StartTime) / 2
+			if precision > opts.SkewTolerance {
+				continue
+			}
+			drifts[agent] = Drift{Agent: agent, Offset: local.Sub(cmd.StartTime.Add(precision)), Source: driftLocalTime,
+				Detail: fmt.Sprintf("local time of command %.0f, within %s", cmd.ID, precision)}
+		}
+	}
+	for agent, d := range opts.StoredDrifts {
+		if dr, ok := drifts[agent]; !ok || dr.Source == driftNTP {
+			continue
+		}
+		drifts[agent] = Drift{Agent: agent, Offset: d, Source: driftStored, Detail: "read from the drift file"}
+	}
+	return drifts
+}
+
+// sortedDrifts returns the drifts of the hosts, sorted by name
+func sortedDrifts(drifts map[string]Drift) (sorted []Drift) {
+	for _, d := range drifts {
+		sorted = append(sorted, d)
+	}
+	sort.Sort(byAgent(sorted))
+	return
+}
+
+type byAgent []Drift
+
+func (b byAgent) Len() int           { return len(b) }
+func (b byAgent) Less(i, j int) bool { return b[i].Agent < b[j].Agent }
+func (b byAgent) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
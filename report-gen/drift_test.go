@@ -0,0 +1,156 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"mig.ninja/mig"
+	"mig.ninja/mig/modules"
+)
+
+// testTimedrift returns a timedrift command run on an agent
+func testTimedrift(id float64, agent string, start, finish time.Time, el timedriftElements, stats interface{}) mig.Command {
+	var cmd mig.Command
+	cmd.ID = id
+	cmd.Status = mig.StatusSuccess
+	cmd.Agent.Name = agent
+	cmd.Action.ID = 44
+	cmd.Action.Operations = []mig.Operation{{Module: "timedrift"}}
+	cmd.StartTime = start
+	cmd.FinishTime = finish
+	cmd.Results = []modules.Result{{Success: true, FoundAnything: true, Elements: el, Statistics: stats}}
+	return cmd
+}
+
+// testDriftCommands returns the test commands, with timedrift commands that
+// found the clock of host a one hour behind, and the clock of host b two
+// minutes ahead
+func testDriftCommands() []mig.Command {
+	ran := testT0.Add(3 * time.Hour)
+	return append(testCommands(),
+		testTimedrift(20, "host-a.example.net", ran, ran.Add(10*time.Minute),
+			timedriftElements{LocalTime: ran.Add(-time.Hour).Format(time.RFC3339Nano)},
+			map[string]interface{}{"ntpstats": []map[string]interface{}{
+				{"host": "unreachable.example.net", "reachable": false},
+				{"host": "pool.ntp.org", "drift": "-1h0m0s", "reachable": true},
+			}}),
+		testTimedrift(21, "host-b.example.net", ran, ran.Add(20*time.Second),
+			timedriftElements{LocalTime: ran.Add(10*time.Second + 2*time.Minute).In(time.FixedZone("CEST", 7200)).Format(time.RFC3339Nano)},
+			nil),
+	)
+}
+
+func TestHostDrifts(t *testing.T) {
+	opts, err := parseOptions("", "", "text", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.StoredDrifts = map[string]time.Duration{
+		"host-a.example.net": time.Minute,
+		"host-c.example.net": 30 * time.Second,
+		"host-z.example.net": time.Hour,
+	}
+	drifts := hostDrifts(testDriftCommands(), opts)
+	if len(drifts) != 3 {
+		t.Fatalf("unexpected drifts %v", drifts)
+	}
+	for _, tc := range []struct {
+		agent  string
+		offset time.Duration
+		source string
+		status string
+	}{
+		// measured drifts are preferred over stored ones
+		{"host-a.example.net", -time.Hour, driftNTP, "excessive"},
+		{"host-b.example.net", 2 * time.Minute, driftLocalTime, "corrected"},
+		{"host-c.example.net", 30 * time.Second, driftStored, "corrected"},
+	} {
+		d := drifts[tc.agent]
+		if d.Offset != tc.offset || d.Source != tc.source || d.Status(opts) != tc.status {
+			t.Fatalf("unexpected drift of %s: %s %s", tc.agent, d.Status(opts), d)
+		}
+	}
+
+	// local times of slow commands are not precise enough
+	cmds := testDriftCommands()
+	cmds[4].FinishTime = cmds[4].StartTime.Add(5 * time.Minute)
+	if d := hostDrifts(cmds, opts)["host-b.example.net"]; d.Known() || d.Status(opts) != "unknown" {
+		t.Fatalf("unexpected drift of host b %s", d)
+	}
+}
+
+func TestReadDrifts(t *testing.T) {
+	fd, err := ioutil.TempFile("", "migreportdrifts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString("# drifts measured on 2016-09-01\nhost-a.example.net -2m30s\n\n  host-b.example.net\t1s\n")
+	fd.Close()
+	drifts, err := readDrifts(fd.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drifts) != 2 || drifts["host-a.example.net"] != -150*time.Second || drifts["host-b.example.net"] != time.Second {
+		t.Fatalf("unexpected drifts %v", drifts)
+	}
+	ioutil.WriteFile(fd.Name(), []byte("host-a.example.net 2 minutes\n"), 0600)
+	if _, err := readDrifts(fd.Name()); err == nil {
+		t.Fatal("expected error on invalid drift")
+	}
+}
+
+func TestDriftCorrection(t *testing.T) {
+	opts, err := parseOptions("", "", "text", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds := testDriftCommands()
+	records, artefactTimes, errs := processResults(cmds, opts)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	if records[0].Drift != -time.Hour || !records[1].Artefacts["EXPLERER.EXE"].Equal(testT0.Add(time.Hour)) {
+		t.Fatalf("unexpected corrected record %+v", records[1])
+	}
+	for _, tr := range artefactTimes["EXPLERER.EXE"] {
+		if tr.Agent == "host-b.example.net" && !tr.Time.Equal(testT0.Add(18*time.Minute)) {
+			t.Fatalf("unexpected corrected time %+v", tr)
+		}
+	}
+
+	// once host a is corrected, host b saw the artefacts first
+	var buf bytes.Buffer
+	err = printResults(&buf, cmds, records, artefactTimes, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []string{
+		"Clock Drift\n---------------------------\n" +
+			"host-a.example.net: excessive -1h0m0s (ntp, measured against pool.ntp.org by command 20)\n" +
+			"host-b.example.net: corrected +2m0s (localtime, local time of command 21, within 10s)\n" +
+			"host-c.example.net: unknown\n",
+		"Patient Zero Suspects\n---------------------------\nhost-b.example.net: 5.00\n",
+	} {
+		if !strings.Contains(buf.String(), e) {
+			t.Fatalf("report does not contain %q:\n%s", e, buf.String())
+		}
+	}
+
+	// the time range applies to corrected times
+	opts.Before = testT0.Add(30 * time.Minute)
+	_, artefactTimes, _ = processResults(cmds, opts)
+	if len(artefactTimes["EXPLERER.EXE"]) != 1 || artefactTimes["EXPLERER.EXE"][0].Agent != "host-b.example.net" {
+		t.Fatalf("unexpected artefacts in time range %+v", artefactTimes)
+	}
+}
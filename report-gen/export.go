@@ -0,0 +1,233 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"mig.ninja/mig/modules"
+)
+
+// exportEvent is an artefact time of a record, in the shape shared by the
+// timeline exporters
+type exportEvent struct {
+	Time      time.Time
+	Kind      string
+	Agent     string
+	Module    string
+	Search    string
+	Artefact  string
+	ActionID  float64
+	CommandID float64
+	Drift     time.Duration
+}
+
+// timeKind describes a kind of artefact time in the vocabulary of the
+// forensic timeline tools
+type timeKind struct {
+	Desc string // timestamp_desc of plaso and Timesketch
+	MACB string // MACB column of l2t_csv
+}
+
+var timeKinds = map[string]timeKind{
+	modules.ArtefactTimeModified:    {"Content Modification Time", "M..."},
+	modules.ArtefactTimeCreated:     {"Creation Time", "...B"},
+	modules.ArtefactTimeExecuted:    {"Last Time Executed", ".A.."},
+	modules.ArtefactTimeLastWrite:   {"Last Written Time", "M..."},
+	modules.ArtefactTimeInstalled:   {"Installation Time", "...."},
+	modules.ArtefactTimeDeleted:     {"Deletion Time", "...."},
+	modules.ArtefactTimeRenamed:     {"Rename Time", "..C."},
+	modules.ArtefactTimeAccessed:    {"Last Access Time", ".A.."},
+	modules.ArtefactTimeLogin:       {"Login Time", "...."},
+	modules.ArtefactTimeLogout:      {"Logout Time", "...."},
+	modules.ArtefactTimeFailedLogin: {"Failed Login Time", "...."},
+	modules.ArtefactTimeBoot:        {"Boot Time", "...."},
+}
+
+// kind returns the description of the artefact time of the event, results
+// of older agents carry no kind and are only known to be first seen times
+func (ev exportEvent) kind() timeKind {
+	if k, ok := timeKinds[ev.Kind]; ok {
+		return k
+	}
+	return timeKind{"First Seen Time", "...."}
+}
+
+// message describes the event in a single line, as displayed by the
+// timeline tools
+func (ev exportEvent) message() string {
+	msg := fmt.Sprintf("[%s] %s on %s", ev.Module, ev.Artefact, ev.Agent)
+	if ev.Search != "" {
+		msg += fmt.Sprintf(" matched search %s", ev.Search)
+	}
+	return msg + fmt.Sprintf(", action %.0f command %.0f", ev.ActionID, ev.CommandID)
+}
+
+// exportEvents returns one event per artefact of the records, sorted by
+// time, host and artefact
+func exportEvents(records []Record) (events []exportEvent) {
+	for _, rec := range records {
+		for _, art := range sortedArtefacts(rec.Artefacts) {
+			events = append(events, exportEvent{
+				Time:      rec.Artefacts[art].UTC(),
+				Kind:      rec.Kinds[art],
+				Agent:     rec.Agent,
+				Module:    rec.Module,
+				Search:    rec.Search,
+				Artefact:  art,
+				ActionID:  rec.ActionID,
+				CommandID: rec.CommandID,
+				Drift:     rec.Drift,
+			})
+		}
+	}
+	sort.Sort(byExportTime(events))
+	return
+}
+
+/*
+	printL2TCSV writes the artefacts in the l2t_csv format of log2timeline
+	and plaso, with one line per artefact time. Times are in UTC, and times
+	of hosts with a known clock drift are corrected, as noted in the notes
+	column.
+*/
+func printL2TCSV(w io.Writer, records []Record) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"date", "time", "timezone", "MACB", "source", "sourcetype", "type", "user", "host",
+		"short", "desc", "version", "filename", "inode", "notes", "format", "extra"})
+	for _, ev := range exportEvents(records) {
+		notes := "-"
+		if ev.Drift != 0 {
+			notes = fmt.Sprintf("time corrected by a clock drift of %s", ev.Drift)
+		}
+		extra := fmt.Sprintf("agent: %s; module: %s; action_id: %.0f; command_id: %.0f", ev.Agent, ev.Module, ev.ActionID, ev.CommandID)
+		if ev.Search != "" {
+			extra += "; search: " + ev.Search
+		}
+		cw.Write([]string{
+			ev.Time.Format("01/02/2006"),
+			ev.Time.Format("15:04:05"),
+			"UTC",
+			ev.kind().MACB,
+			"MIG",
+			"MIG " + ev.Module,
+			ev.kind().Desc,
+			"-",
+			ev.Agent,
+			ev.Artefact,
+			ev.message(),
+			"2",
+			ev.Artefact,
+			"-",
+			notes,
+			"mig_report",
+			extra,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// timesketchEvent is an event of a Timesketch JSONL import
+type timesketchEvent struct {
+	Message       string  `json:"message"`
+	Datetime      string  `json:"datetime"`
+	Timestamp     int64   `json:"timestamp"`
+	TimestampDesc string  `json:"timestamp_desc"`
+	DataType      string  `json:"data_type"`
+	Agent         string  `json:"agent"`
+	Module        string  `json:"module"`
+	Search        string  `json:"search,omitempty"`
+	Artefact      string  `json:"artefact"`
+	ActionID      float64 `json:"action_id"`
+	CommandID     float64 `json:"command_id"`
+	ClockDrift    string  `json:"clock_drift,omitempty"`
+}
+
+// printTimesketch writes the artefacts as JSON lines that can be imported
+// in Timesketch, with one event per artefact time
+func printTimesketch(w io.Writer, records []Record) error {
+	enc := json.NewEncoder(w)
+	for _, ev := range exportEvents(records) {
+		te := timesketchEvent{
+			Message:       ev.message(),
+			Datetime:      ev.Time.Format(time.RFC3339Nano),
+			Timestamp:     ev.Time.UnixNano() / int64(time.Microsecond),
+			TimestampDesc: ev.kind().Desc,
+			DataType:      "mig:" + ev.Module,
+			Agent:         ev.Agent,
+			Module:        ev.Module,
+			Search:        ev.Search,
+			Artefact:      ev.Artefact,
+			ActionID:      ev.ActionID,
+			CommandID:     ev.CommandID,
+		}
+		if ev.Drift != 0 {
+			te.ClockDrift = ev.Drift.String()
+		}
+		err := enc.Encode(te)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+	printBodyfile writes the artefacts in the bodyfile format of the sleuthkit,
+	to be merged with the bodyfiles of disk images and sorted by mactime:
+		MD5|name|inode|mode_as_string|UID|GID|size|atime|mtime|ctime|crtime
+	Execution times are written as access times, and last write times as
+	modification times. The name holds the host, module, search and the
+	action and command that found the artefact.
+*/
+func printBodyfile(w io.Writer, records []Record) error {
+	for _, ev := range exportEvents(records) {
+		var atime, mtime, crtime int64
+		switch ev.Kind {
+		case modules.ArtefactTimeExecuted:
+			atime = ev.Time.Unix()
+		case modules.ArtefactTimeCreated:
+			crtime = ev.Time.Unix()
+		default:
+			mtime = ev.Time.Unix()
+		}
+		name := fmt.Sprintf("%s:%s (%s", ev.Agent, ev.Artefact, ev.Module)
+		if ev.Search != "" {
+			name += " search " + ev.Search
+		}
+		name += fmt.Sprintf(", action %.0f command %.0f)", ev.ActionID, ev.CommandID)
+		// the bodyfile has no escaping, pipes in names would shift the columns
+		name = strings.Replace(name, "|", "_", -1)
+		_, err := fmt.Fprintf(w, "0|%s|0||0|0|0|%d|%d|0|%d\n", name, atime, mtime, crtime)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// byExportTime sorts the exported events by time, host and artefact
+type byExportTime []exportEvent
+
+func (b byExportTime) Len() int { return len(b) }
+func (b byExportTime) Less(i, j int) bool {
+	if !b[i].Time.Equal(b[j].Time) {
+		return b[i].Time.Before(b[j].Time)
+	}
+	if b[i].Agent != b[j].Agent {
+		return b[i].Agent < b[j].Agent
+	}
+	return b[i].Artefact < b[j].Artefact
+}
+func (b byExportTime) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
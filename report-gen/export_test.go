@@ -0,0 +1,94 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"mig.ninja/mig/modules"
+)
+
+func TestExports(t *testing.T) {
+	cmds := testDriftCommands()
+	for _, format := range []string{"l2tcsv", "timesketch", "bodyfile"} {
+		opts, err := parseOptions("", "", format, "", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, artefactTimes, errs := processResults(cmds, opts)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected errors %v", errs)
+		}
+		var buf bytes.Buffer
+		err = printResults(&buf, cmds, records, artefactTimes, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch format {
+		case "l2tcsv":
+			lines, err := csv.NewReader(bytes.NewReader(buf.Bytes())).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(lines) != 6 || len(lines[0]) != 17 || lines[0][0] != "date" {
+				t.Fatalf("unexpected l2t_csv %s", buf.String())
+			}
+		case "timesketch":
+			scanner := bufio.NewScanner(bytes.NewReader(buf.Bytes()))
+			n := 0
+			for scanner.Scan() {
+				var ev map[string]interface{}
+				err = json.Unmarshal(scanner.Bytes(), &ev)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, field := range []string{"message", "datetime", "timestamp_desc", "agent", "module", "action_id", "command_id"} {
+					if _, ok := ev[field]; !ok {
+						t.Fatalf("event %d has no %s: %s", n, field, scanner.Text())
+					}
+				}
+				n++
+			}
+			if n != 5 {
+				t.Fatalf("expected 5 events, got %d", n)
+			}
+		case "bodyfile":
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				if strings.Count(line, "|") != 10 {
+					t.Fatalf("invalid bodyfile line %q", line)
+				}
+			}
+		}
+		checkGolden(t, "export."+format, buf.Bytes())
+	}
+
+	// file records carry the label of their search
+	records := []Record{{ActionID: 45, CommandID: 30, Module: "file", Search: "dropper", Agent: "host-d.example.net",
+		Artefacts: map[string]time.Time{"/tmp/a|b": testT0}, Kinds: map[string]string{"/tmp/a|b": modules.ArtefactTimeCreated}}}
+	var buf bytes.Buffer
+	printBodyfile(&buf, records)
+	if buf.String() != "0|host-d.example.net:/tmp/a_b (file search dropper, action 45 command 30)|0||0|0|0|0|0|0|1472724000\n" {
+		t.Fatalf("unexpected bodyfile %q", buf.String())
+	}
+	buf.Reset()
+	printTimesketch(&buf, records)
+	var ev timesketchEvent
+	err := json.Unmarshal(buf.Bytes(), &ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Search != "dropper" || ev.TimestampDesc != "Creation Time" ||
+		ev.Message != "[file] /tmp/a|b on host-d.example.net matched search dropper, action 45 command 30" {
+		t.Fatalf("unexpected timesketch event %+v", ev)
+	}
+}
@@ -0,0 +1,390 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"mig.ninja/mig"
+)
+
+/* Netstat Module Structs */
+type netstatElements struct {
+	LocalMAC    map[string][]netstatElement `json:"localmac,omitempty"`
+	LocalIP     map[string][]netstatElement `json:"localip,omitempty"`
+	NeighborMAC map[string][]netstatElement `json:"neighbormac,omitempty"`
+	NeighborIP  map[string][]netstatElement `json:"neighborip,omitempty"`
+	ConnectedIP map[string][]netstatElement `json:"connectedip,omitempty"`
+}
+
+type netstatElement struct {
+	LocalMACAddr  string  `json:"localmacaddr,omitempty"`
+	RemoteMACAddr string  `json:"remotemacaddr,omitempty"`
+	LocalAddr     string  `json:"localaddr,omitempty"`
+	LocalPort     float64 `json:"localport,omitempty"`
+	RemoteAddr    string  `json:"remoteaddr,omitempty"`
+	RemotePort    float64 `json:"remoteport,omitempty"`
+}
+
+/* Hosts Module Structs */
+type hostsElements struct {
+	DnsResults   []string `json:"dnsresults,omitempty"`
+	HostsResults []string `json:"hostsresults,omitempty"`
+	ArpResults   []string `json:"arpresults,omitempty"`
+}
+
+// kinds of network evidence between two hosts, and the confidence they
+// give to an edge of the graph
+const (
+	evidenceConnection = "connection"
+	evidenceNeighbor   = "neighbor"
+	evidenceResolution = "resolution"
+)
+
+var evidenceConfidence = map[string]float64{
+	evidenceConnection: 0.9,
+	evidenceNeighbor:   0.6,
+	evidenceResolution: 0.5,
+}
+
+const (
+	// timingConfidence is given to edges only backed by the order in
+	// which the hosts saw the artefacts
+	timingConfidence = 0.2
+
+	// tiedPenalty multiplies the confidence of edges between hosts that
+	// saw their first artefact within the skew tolerance
+	tiedPenalty = 0.5
+)
+
+// Link is a piece of network evidence found on a host about another host
+type Link struct {
+	Kind   string `json:"kind"`
+	Host   string `json:"host"` // host the evidence was found on
+	Detail string `json:"detail"`
+}
+
+// Node is a host of the propagation graph, with the first artefact it saw
+type Node struct {
+	Agent     string    `json:"agent"`
+	FirstSeen time.Time `json:"firstseen"`
+	Artefact  string    `json:"artefact"`
+	Clock     string    `json:"clock"` // status of the clock drift of the host
+}
+
+// Edge is a probable propagation of the compromise from one host to another
+type Edge struct {
+	From       string   `json:"from"`
+	To         string   `json:"to"`
+	Lag        string   `json:"lag"`
+	Artefacts  []string `json:"artefacts,omitempty"` // artefacts seen by From before To
+	Evidence   []Link   `json:"evidence,omitempty"`
+	Confidence float64  `json:"confidence"`
+}
+
+// Graph is the propagation graph of a compromise. Edges always go from a
+// host to a host that saw its first artefact later, so the graph has no
+// cycle.
+type Graph struct {
+	Nodes []Node `json:"nodes"`
+	Edges []Edge `json:"edges"`
+}
+
+/*
+	buildGraph infers how the compromise spread between hosts. Every host
+	that saw an artefact later than another host gets an edge from each
+	earlier host it has network evidence with, from the netstat and hosts
+	modules: a connection between the two, an ARP entry, or a name resolution
+	entry. Hosts without any such evidence get a single, low confidence edge
+	from the earlier host that saw the most of their artefacts first, or the
+	closest in time.
+*/
+func buildGraph(commands []mig.Command, artefactTimes map[string][]TimeEntry, opts options) (g Graph) {
+	first := make(map[string]*Node)
+	seen := make(map[string]map[string]time.Time)
+	for art, entries := range artefactTimes {
+		for _, tr := range entries {
+			if tr.Time.IsZero() {
+				continue
+			}
+			if seen[tr.Agent] == nil {
+				seen[tr.Agent] = make(map[string]time.Time)
+			}
+			seen[tr.Agent][art] = tr.Time
+			n, ok := first[tr.Agent]
+			if !ok {
+				first[tr.Agent] = &Node{Agent: tr.Agent, FirstSeen: tr.Time, Artefact: art}
+				continue
+			}
+			if tr.Time.Before(n.FirstSeen) || (tr.Time.Equal(n.FirstSeen) && art < n.Artefact) {
+				n.FirstSeen = tr.Time
+				n.Artefact = art
+			}
+		}
+	}
+	drifts := hostDrifts(commands, opts)
+	for _, n := range first {
+		n.Clock = drifts[n.Agent].Status(opts)
+		g.Nodes = append(g.Nodes, *n)
+	}
+	sort.Sort(byFirstSeen(g.Nodes))
+
+	links := networkLinks(commands)
+	for i, to := range g.Nodes {
+		var (
+			backed   []Edge
+			fallback *Edge
+		)
+		for _, from := range g.Nodes[:i] {
+			if !from.FirstSeen.Before(to.FirstSeen) {
+				continue
+			}
+			e := Edge{
+				From: from.Agent,
+				To:   to.Agent,
+				Lag:  to.FirstSeen.Sub(from.FirstSeen).String(),
+			}
+			for art, t := range seen[from.Agent] {
+				if t2, ok := seen[to.Agent][art]; ok && t.Before(t2) {
+					e.Artefacts = append(e.Artefacts, art)
+				}
+			}
+			sort.Strings(e.Artefacts)
+			e.Evidence = links[hostPair(from.Agent, to.Agent)]
+			factor := 1.0
+			if to.FirstSeen.Sub(from.FirstSeen) <= opts.SkewTolerance {
+				factor = tiedPenalty
+			}
+			if len(e.Evidence) > 0 {
+				doubt := 1.0
+				kinds := make(map[string]bool)
+				for _, l := range e.Evidence {
+					if !kinds[l.Kind] {
+						doubt *= 1 - evidenceConfidence[l.Kind]
+						kinds[l.Kind] = true
+					}
+				}
+				e.Confidence = round((1 - doubt) * factor)
+				backed = append(backed, e)
+				continue
+			}
+			// nodes are sorted by time, so on equal shared artefacts
+			// the latest candidate is the closest in time
+			if fallback == nil || len(e.Artefacts) >= len(fallback.Artefacts) {
+				e.Confidence = round(timingConfidence * factor)
+				fallback = &e
+			}
+		}
+		if len(backed) > 0 {
+			g.Edges = append(g.Edges, backed...)
+		} else if fallback != nil {
+			g.Edges = append(g.Edges, *fallback)
+		}
+	}
+	return
+}
+
+/*
+	networkLinks reads the results of the netstat and hosts modules, and
+	returns the evidence that two hosts communicated, indexed by hostPair.
+	Addresses are attributed to hosts using the addresses of the agents,
+	and the local addresses found by netstat. Addresses used by several
+	hosts are ambiguous, and ignored.
+*/
+func networkLinks(commands []mig.Command) map[[2]string][]Link {
+	owners := make(map[string]map[string]bool)
+	own := func(addr, agent string) {
+		addr = normalizeAddr(addr)
+		if addr == "" {
+			return
+		}
+		if owners[addr] == nil {
+			owners[addr] = make(map[string]bool)
+		}
+		owners[addr][agent] = true
+	}
+	type observation struct {
+		agent, addr string
+		link        Link
+	}
+	var obs []observation
+	observe := func(agent, addr, kind, detail string) {
+		obs = append(obs, observation{agent, normalizeAddr(addr), Link{Kind: kind, Host: agent, Detail: detail}})
+	}
+	for _, cmd := range commands {
+		agent := cmd.Agent.Name
+		for _, addr := range cmd.Agent.Env.Addresses {
+			own(addr, agent)
+		}
+		for i, op := range cmd.Action.Operations {
+			if i >= len(cmd.Results) {
+				continue
+			}
+			switch op.Module {
+			case "netstat":
+				var el netstatElements
+				if cmd.Results[i].GetElements(&el) != nil {
+					continue
+				}
+				for _, els := range el.LocalIP {
+					for _, e := range els {
+						own(e.LocalAddr, agent)
+					}
+				}
+				for _, els := range el.LocalMAC {
+					for _, e := range els {
+						own(e.LocalMACAddr, agent)
+					}
+				}
+				for _, els := range el.ConnectedIP {
+					for _, e := range els {
+						observe(agent, e.RemoteAddr, evidenceConnection,
+							fmt.Sprintf("connection from %s:%.0f to %s:%.0f", e.LocalAddr, e.LocalPort, e.RemoteAddr, e.RemotePort))
+					}
+				}
+				for _, nb := range []map[string][]netstatElement{el.NeighborIP, el.NeighborMAC} {
+					for _, els := range nb {
+						for _, e := range els {
+							detail := fmt.Sprintf("ARP entry %s at %s", e.RemoteAddr, e.RemoteMACAddr)
+							observe(agent, e.RemoteAddr, evidenceNeighbor, detail)
+							observe(agent, e.RemoteMACAddr, evidenceNeighbor, detail)
+						}
+					}
+				}
+			case "hosts":
+				var el hostsElements
+				if cmd.Results[i].GetElements(&el) != nil {
+					continue
+				}
+				for _, addr := range el.HostsResults {
+					observe(agent, addr, evidenceResolution, "hosts file entry for "+addr)
+				}
+				for _, addr := range el.DnsResults {
+					observe(agent, addr, evidenceResolution, "DNS cache entry for "+addr)
+				}
+				for _, mac := range el.ArpResults {
+					observe(agent, mac, evidenceNeighbor, "ARP entry for "+mac)
+				}
+			}
+		}
+	}
+
+	links := make(map[[2]string][]Link)
+	dups := make(map[Link]bool)
+	for _, o := range obs {
+		if len(owners[o.addr]) != 1 {
+			continue
+		}
+		for peer := range owners[o.addr] {
+			if peer == o.agent || dups[o.link] {
+				continue
+			}
+			dups[o.link] = true
+			pair := hostPair(o.agent, peer)
+			links[pair] = append(links[pair], o.link)
+		}
+	}
+	for _, l := range links {
+		sort.Sort(byLink(l))
+	}
+	return links
+}
+
+// normalizeAddr strips the prefix length of an address and lowercases MAC
+// addresses, and ignores loopback and unspecified addresses which do not
+// identify a host
+func normalizeAddr(addr string) string {
+	addr = strings.ToLower(strings.TrimSpace(addr))
+	if i := strings.Index(addr, "/"); i > 0 {
+		addr = addr[:i]
+	}
+	if ip := net.ParseIP(addr); ip != nil {
+		if ip.IsLoopback() || ip.IsUnspecified() {
+			return ""
+		}
+		return ip.String()
+	}
+	return addr
+}
+
+// hostPair is the key of the evidence between two hosts, in either direction
+func hostPair(a, b string) [2]string {
+	if b < a {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+func round(f float64) float64 {
+	return math.Round(f*100) / 100
+}
+
+// byLink sorts evidence by kind, host and detail
+type byLink []Link
+
+func (b byLink) Len() int { return len(b) }
+func (b byLink) Less(i, j int) bool {
+	if b[i].Kind != b[j].Kind {
+		return b[i].Kind < b[j].Kind
+	}
+	if b[i].Host != b[j].Host {
+		return b[i].Host < b[j].Host
+	}
+	return b[i].Detail < b[j].Detail
+}
+func (b byLink) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+
+// byFirstSeen sorts the nodes of a graph by time, then name
+type byFirstSeen []Node
+
+func (b byFirstSeen) Len() int { return len(b) }
+func (b byFirstSeen) Less(i, j int) bool {
+	if b[i].FirstSeen.Equal(b[j].FirstSeen) {
+		return b[i].Agent < b[j].Agent
+	}
+	return b[i].FirstSeen.Before(b[j].FirstSeen)
+}
+func (b byFirstSeen) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+
+// printDOT writes the graph in the DOT language of graphviz. Edges backed by
+// network evidence are solid, edges only backed by timing are dashed.
+func printDOT(w io.Writer, g Graph) {
+	fmt.Fprintln(w, "digraph propagation {")
+	fmt.Fprintln(w, "\trankdir=LR;")
+	for _, n := range g.Nodes {
+		fmt.Fprintf(w, "\t%q [label=%q", n.Agent,
+			fmt.Sprintf("%s\n%s\n%s", n.Agent, n.FirstSeen.Format(time.RFC3339), n.Artefact))
+		if n.Clock != "corrected" {
+			// the first seen time of the host is doubtful
+			fmt.Fprint(w, ", color=orange")
+		}
+		fmt.Fprintln(w, "];")
+	}
+	for _, e := range g.Edges {
+		style := "solid"
+		if len(e.Evidence) == 0 {
+			style = "dashed"
+		}
+		fmt.Fprintf(w, "\t%q -> %q [label=%q, style=%s];\n", e.From, e.To,
+			fmt.Sprintf("%s, %.2f", e.Lag, e.Confidence), style)
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// printGraphJSON writes the graph as an indented JSON document
+func printGraphJSON(w io.Writer, g Graph) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(g)
+}
@@ -0,0 +1,123 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"mig.ninja/mig"
+	"mig.ninja/mig/modules"
+)
+
+// testNetworkCommands returns the test commands, with the addresses of the
+// hosts, and a netstat command that found host c connected to host b
+func testNetworkCommands() []mig.Command {
+	cmds := testCommands()
+	cmds[0].Agent.Env.Addresses = []string{"10.0.0.1/24", "127.0.0.1/8"}
+	cmds[1].Agent.Env.Addresses = []string{"10.0.0.2/24", "127.0.0.1/8"}
+	cmds[2].Agent.Env.Addresses = []string{"10.0.0.3/24", "127.0.0.1/8"}
+
+	var netstat mig.Command
+	netstat.ID = 10
+	netstat.Status = mig.StatusSuccess
+	netstat.Agent = cmds[2].Agent
+	netstat.Action.ID = 43
+	netstat.Action.Operations = []mig.Operation{{Module: "netstat"}, {Module: "hosts"}}
+	netstat.Results = []modules.Result{
+		{Success: true, FoundAnything: true, Elements: netstatElements{
+			ConnectedIP: map[string][]netstatElement{
+				"10.0.0.0/24": {
+					{LocalAddr: "10.0.0.3", LocalPort: 49152, RemoteAddr: "10.0.0.2", RemotePort: 445},
+					{LocalAddr: "127.0.0.1", LocalPort: 49153, RemoteAddr: "127.0.0.1", RemotePort: 8080},
+				},
+			},
+		}},
+		{Success: true, FoundAnything: true, Elements: hostsElements{HostsResults: []string{"10.0.0.2"}}},
+	}
+	return append(cmds, netstat)
+}
+
+func TestBuildGraph(t *testing.T) {
+	opts, err := parseOptions("", "", "dot", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds := testNetworkCommands()
+	_, artefactTimes, errs := processResults(cmds, opts)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	g := buildGraph(cmds, artefactTimes, opts)
+	if len(g.Nodes) != 3 || g.Nodes[0].Agent != "host-a.example.net" || g.Nodes[0].Artefact != "EXPLERER.EXE" ||
+		g.Nodes[2].Agent != "host-c.example.net" {
+		t.Fatalf("unexpected nodes %+v", g.Nodes)
+	}
+	if len(g.Edges) != 2 {
+		t.Fatalf("expected 2 edges, got %+v", g.Edges)
+	}
+	// host b has no network evidence, and is linked to host a by timing only
+	e := g.Edges[0]
+	if e.From != "host-a.example.net" || e.To != "host-b.example.net" || e.Lag != "20m0s" ||
+		e.Confidence != timingConfidence || len(e.Artefacts) != 2 || len(e.Evidence) != 0 {
+		t.Fatalf("unexpected timing edge %+v", e)
+	}
+	// host c was connected to host b, which is preferred over host a
+	e = g.Edges[1]
+	if e.From != "host-b.example.net" || e.To != "host-c.example.net" || e.Confidence != 0.95 || len(e.Evidence) != 2 ||
+		e.Evidence[0].Detail != "connection from 10.0.0.3:49152 to 10.0.0.2:445" ||
+		e.Evidence[1].Detail != "hosts file entry for 10.0.0.2" {
+		t.Fatalf("unexpected network edge %+v", e)
+	}
+
+	// an address shared by two hosts does not identify any of them
+	cmds[0].Agent.Env.Addresses = append(cmds[0].Agent.Env.Addresses, "10.0.0.2")
+	g = buildGraph(cmds, artefactTimes, opts)
+	if len(g.Edges) != 2 || g.Edges[1].Confidence != timingConfidence || len(g.Edges[1].Evidence) != 0 {
+		t.Fatalf("unexpected edges with an ambiguous address %+v", g.Edges)
+	}
+}
+
+func TestPrintGraph(t *testing.T) {
+	cmds := testNetworkCommands()
+	for _, format := range []string{"dot", "json"} {
+		opts, err := parseOptions("", "", format, "", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, artefactTimes, _ := processResults(cmds, opts)
+		var buf bytes.Buffer
+		err = printResults(&buf, cmds, records, artefactTimes, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch format {
+		case "dot":
+			for _, e := range []string{
+				"digraph propagation {\n",
+				"\t\"host-a.example.net\" [label=\"host-a.example.net\\n2016-09-01T10:00:00Z\\nEXPLERER.EXE\", color=orange];\n",
+				"\t\"host-a.example.net\" -> \"host-b.example.net\" [label=\"20m0s, 0.20\", style=dashed];\n",
+				"\t\"host-b.example.net\" -> \"host-c.example.net\" [label=\"1h40m0s, 0.95\", style=solid];\n",
+			} {
+				if !strings.Contains(buf.String(), e) {
+					t.Fatalf("dot graph does not contain %q:\n%s", e, buf.String())
+				}
+			}
+		case "json":
+			var g Graph
+			err = json.Unmarshal(buf.Bytes(), &g)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(g.Nodes) != 3 || len(g.Edges) != 2 || g.Edges[1].Evidence[0].Kind != evidenceConnection {
+				t.Fatalf("unexpected json graph %s", buf.String())
+			}
+		}
+	}
+}
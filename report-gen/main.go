@@ -0,0 +1,278 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"mig.ninja/mig"
+	"mig.ninja/mig/client"
+)
+
+// options holds the command line parameters of a report
+type options struct {
+	ActionIDs []float64 // actions to report on, all actions if empty
+	Modules   []string  // modules to report on
+	Format    string    // output format, one of outputFormats
+	Output    string    // path of the report, stdout if empty
+	After     time.Time // only report artefacts more recent than this time
+	Before    time.Time // only report artefacts older than this time
+
+	Weights       map[string]float64 // weight of the artefacts of each module
+	SkewTolerance time.Duration      // clock difference under which hosts are tied
+	MaxDrift      time.Duration      // clock drift above which the times of a host are not trusted
+	StoredDrifts  map[string]time.Duration
+	APIURL        string // location of the MIG API, to link the report to actions and commands
+	Debug         bool
+}
+
+var (
+	defaultModules = []string{"file", "registry", "prefetch", "amcache", "ntfs", "lnk", "execution"}
+	outputFormats  = []string{"text", "csv", "html", "l2tcsv", "timesketch", "bodyfile", "dot", "json"}
+)
+
+func main() {
+	defer func() {
+		if e := recover(); e != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", e)
+			os.Exit(1)
+		}
+	}()
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `%s - Build patient zero reports from MIG action results
+Usage: %s [-a <action ids>] [-m <modules>] [-f <format>] [-o <file>]
+
+Commands of the selected actions are retrieved from the MIG API, using the
+API URL and PGP key of the client configuration. Only the search permission
+is required.
+
+Artefacts found by the file, registry, prefetch, amcache, ntfs, lnk and
+execution modules are ordered by time across all hosts, to find the host that
+was compromised first. Each host that saw an artefact before the others scores
+the weight of the module that found it, reduced when the order of the hosts is
+uncertain. The report explains the score of each host artefact by artefact.
+
+Artefact times are corrected by the clock drift of their host, measured by the
+timedrift module in the selected actions or read from a drift file. Hosts with
+an unknown drift, or a drift above the maximum drift, are marked in the report.
+
+The dot and json formats output the graph of the propagation of the compromise
+between hosts instead. Edges are backed by the results of the netstat and hosts
+modules when the selected actions ran them: connections between two hosts, ARP
+entries and name resolution entries of a host for another.
+
+The html format is a single self contained file, with no external scripts or
+styles, that can be opened without network access. Artefacts are drawn in one
+swimlane per host, can be filtered by name and module, and link back to the
+action and command that found them in the MIG API.
+
+The l2tcsv, timesketch and bodyfile formats export the artefact times to merge
+them with the timelines of disk images: the l2t_csv format of log2timeline and
+plaso, JSON lines to import in Timesketch, and the bodyfile of the sleuthkit
+to sort with mactime. Each event names the host, module, search, action and
+command that found the artefact.
+
+EXAMPLES
+--------
+
+Report on all actions, as text on stdout:
+  $ %s
+
+Write an HTML timeline of two actions, restricted to the registry and prefetch modules:
+  $ %s -a 1234,1235 -m registry,prefetch -f html -o /var/www/reports/1234.html
+
+CSV export of the artefacts seen in the first week of June:
+  $ %s -f csv -after 2016-06-01T00:00:00Z -before 2016-06-08T00:00:00Z
+
+Correct the clocks of the hosts with a timedrift action, and trust hosts up to 10 minutes of drift:
+  $ %s -a 1234,1237 -maxdrift 10m
+
+Import the artefacts of a hunt in Timesketch:
+  $ %s -a 1234 -f timesketch -o 1234.jsonl && timesketch_importer --timeline_name hunt-1234 1234.jsonl
+
+Render the propagation graph of a hunt and of a netstat action with graphviz:
+  $ %s -a 1234,1236 -f dot | dot -Tsvg -o propagation.svg
+
+Command line flags:
+`,
+			os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	var (
+		config      = flag.String("c", client.FindHomedir()+"/.migrc", "Load client configuration from file")
+		actions     = flag.String("a", "", "Comma separated list of action IDs to report on (default: all actions)")
+		mods        = flag.String("m", strings.Join(defaultModules, ","), "Comma separated list of modules to report on")
+		format      = flag.String("f", "text", "Output format: "+strings.Join(outputFormats, ", "))
+		output      = flag.String("o", "", "Write the report to file instead of stdout")
+		after       = flag.String("after", "", "Only report artefacts with a time after this RFC3339 date")
+		before      = flag.String("before", "", "Only report artefacts with a time before this RFC3339 date")
+		weights     = flag.String("w", "", "Comma separated list of module=weight to score patient zero suspects (default: "+formatWeights(defaultWeights)+")")
+		skew        = flag.Duration("skew", defaultSkewTolerance, "Clock difference under which hosts that saw an artefact are tied")
+		driftFile   = flag.String("drifts", "", "Load the clock drift of hosts from file, one host and drift per line")
+		maxDrift    = flag.Duration("maxdrift", defaultMaxDrift, "Clock drift above which the times of a host are not trusted")
+		debug       = flag.Bool("debug", false, "Print debug information on stderr")
+		showversion = flag.Bool("V", false, "Show build version and exit")
+	)
+	flag.Parse()
+
+	if *showversion {
+		fmt.Println(mig.Version)
+		os.Exit(0)
+	}
+
+	opts, err := parseOptions(*actions, *mods, *format, *output, *after, *before)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n\n", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	opts.Weights, err = parseWeights(*weights)
+	if err == nil && *skew < 0 {
+		err = fmt.Errorf("invalid negative skew tolerance %s", *skew)
+	}
+	if err == nil && *maxDrift < 0 {
+		err = fmt.Errorf("invalid negative maximum drift %s", *maxDrift)
+	}
+	if err == nil && *driftFile != "" {
+		opts.StoredDrifts, err = readDrifts(*driftFile)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n\n", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	opts.SkewTolerance = *skew
+	opts.MaxDrift = *maxDrift
+	opts.Debug = *debug
+
+	conf, err := client.ReadConfiguration(*config)
+	if err != nil {
+		panic(err)
+	}
+	cli, err := client.NewClient(conf, "report-"+mig.Version)
+	if err != nil {
+		panic(err)
+	}
+	opts.APIURL = conf.API.URL
+	commands, err := queryAPI(cli, opts)
+	if err != nil {
+		panic(err)
+	}
+	if len(commands) == 0 {
+		panic("no successful command found for the selected actions")
+	}
+
+	records, artefactTimes, errs := processResults(commands, opts)
+	for _, e := range errs {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", e)
+	}
+
+	var out io.Writer = os.Stdout
+	if opts.Output != "" {
+		f, err := os.Create(opts.Output)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		out = f
+	}
+	err = printResults(out, commands, records, artefactTimes, opts)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// parseOptions validates the command line flags of a report
+func parseOptions(actions, mods, format, output, after, before string) (opts options, err error) {
+	for _, a := range strings.Split(actions, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		id, err := strconv.ParseFloat(a, 64)
+		if err != nil || id < 1 {
+			return opts, fmt.Errorf("invalid action id %q", a)
+		}
+		opts.ActionIDs = append(opts.ActionIDs, id)
+	}
+	for _, m := range strings.Split(mods, ",") {
+		m = strings.ToLower(strings.TrimSpace(m))
+		if m == "" {
+			continue
+		}
+		if !contains(defaultModules, m) {
+			return opts, fmt.Errorf("module %q is not supported, use one of %s", m, strings.Join(defaultModules, ", "))
+		}
+		opts.Modules = append(opts.Modules, m)
+	}
+	if len(opts.Modules) == 0 {
+		opts.Modules = defaultModules
+	}
+	opts.Weights = defaultWeights
+	opts.SkewTolerance = defaultSkewTolerance
+	opts.MaxDrift = defaultMaxDrift
+	opts.Format = strings.ToLower(format)
+	if !contains(outputFormats, opts.Format) {
+		return opts, fmt.Errorf("output format %q is not supported, use one of %s", format, strings.Join(outputFormats, ", "))
+	}
+	if output != "-" {
+		opts.Output = output
+	}
+	if after != "" {
+		opts.After, err = time.Parse(time.RFC3339, after)
+		if err != nil {
+			return opts, fmt.Errorf("invalid after date: %v", err)
+		}
+	}
+	if before != "" {
+		opts.Before, err = time.Parse(time.RFC3339, before)
+		if err != nil {
+			return opts, fmt.Errorf("invalid before date: %v", err)
+		}
+		if opts.Before.Before(opts.After) {
+			return opts, fmt.Errorf("before date %s is earlier than after date %s", before, after)
+		}
+	}
+	return
+}
+
+// inRange returns true if an artefact time is within the time range of
+// the report
+func (opts options) inRange(t time.Time) bool {
+	if !opts.After.IsZero() && t.Before(opts.After) {
+		return false
+	}
+	if !opts.Before.IsZero() && t.After(opts.Before) {
+		return false
+	}
+	return true
+}
+
+// debugf prints debug information on stderr, so it does not mix with a
+// report written to stdout
+func (opts options) debugf(format string, a ...interface{}) {
+	if opts.Debug {
+		fmt.Fprintf(os.Stderr, "[info] "+format+"\n", a...)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
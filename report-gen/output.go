@@ -0,0 +1,132 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"mig.ninja/mig"
+)
+
+// printResults writes the report in the output format of the options
+func printResults(w io.Writer, commands []mig.Command, records []Record, ArtefactTimes map[string][]TimeEntry, opts options) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("printResults() -> %v", e)
+		}
+	}()
+	opts.debugf("writing %d records in %s format", len(records), opts.Format)
+	bw := bufio.NewWriter(w)
+	drifts := hostDrifts(commands, opts)
+	skews := estimateSkews(commands, records, drifts, opts)
+	scores := scoreHosts(ArtefactTimes, skews, opts)
+	switch opts.Format {
+	case "csv":
+		err = printCSV(bw, records, opts)
+	case "html":
+		err = printTimeline(bw, commands, records, scores, drifts, opts)
+	case "l2tcsv":
+		err = printL2TCSV(bw, records)
+	case "timesketch":
+		err = printTimesketch(bw, records)
+	case "bodyfile":
+		err = printBodyfile(bw, records)
+	case "dot":
+		printDOT(bw, buildGraph(commands, ArtefactTimes, opts))
+	case "json":
+		err = printGraphJSON(bw, buildGraph(commands, ArtefactTimes, opts))
+	default:
+		printText(bw, records, scores, drifts, opts)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return bw.Flush()
+}
+
+// printText lists the artefacts found on each host, module by module,
+// followed by the patient zero suspects and the evidence against them
+func printText(w io.Writer, records []Record, scores []HostScore, drifts map[string]Drift, opts options) {
+	for _, module := range opts.Modules {
+		fmt.Fprintf(w, "Module: %s\n---------------------------\n", module)
+		for _, rec := range records {
+			if rec.Module != module {
+				continue
+			}
+			fmt.Fprintf(w, "Agent: %s\n", rec.Agent)
+			fmt.Fprintf(w, "Action: %.0f, Command: %.0f\n", rec.ActionID, rec.CommandID)
+			if rec.Search != "" {
+				fmt.Fprintf(w, "Search: %s\n", rec.Search)
+			}
+			for i, art := range sortedArtefacts(rec.Artefacts) {
+				fmt.Fprintf(w, "Artefact %d : %s\n", i+1, art)
+				fmt.Fprintf(w, "           : Date : %s\n", rec.Artefacts[art].Format(time.RFC3339))
+			}
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w, "--------------------------------------------------")
+	}
+	fmt.Fprintln(w, "Clock Drift")
+	fmt.Fprintln(w, "---------------------------")
+	for _, d := range sortedDrifts(drifts) {
+		if !d.Known() {
+			fmt.Fprintf(w, "%s: unknown\n", d.Agent)
+			continue
+		}
+		fmt.Fprintf(w, "%s: %s %s\n", d.Agent, d.Status(opts), d)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Patient Zero Suspects")
+	fmt.Fprintln(w, "---------------------------")
+	for _, hs := range scores {
+		fmt.Fprintf(w, "%s: %.2f\n", hs.Agent, hs.Score)
+		for _, ev := range hs.Evidence {
+			fmt.Fprintf(w, "  %+.2f = %g x %.2f : %s %s at %s, %s\n", ev.Points, ev.Weight, ev.Confidence,
+				ev.Module, ev.Artefact, ev.Time.Format(time.RFC3339), ev.Reason)
+		}
+	}
+}
+
+// printCSV writes one line per artefact found on a host
+func printCSV(w io.Writer, records []Record, opts options) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"action", "command", "module", "agent", "search", "artefact", "time"})
+	for _, module := range opts.Modules {
+		for _, rec := range records {
+			if rec.Module != module {
+				continue
+			}
+			for _, art := range sortedArtefacts(rec.Artefacts) {
+				cw.Write([]string{
+					fmt.Sprintf("%.0f", rec.ActionID),
+					fmt.Sprintf("%.0f", rec.CommandID),
+					module,
+					rec.Agent,
+					rec.Search,
+					art,
+					rec.Artefacts[art].Format(time.RFC3339),
+				})
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// sortedArtefacts returns the names of the artefacts of a record, sorted
+func sortedArtefacts(artefacts map[string]time.Time) (names []string) {
+	for name := range artefacts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
@@ -0,0 +1,335 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"mig.ninja/mig"
+)
+
+// defaultWeights ranks the modules by the strength of the evidence they
+// provide: execution evidence first, then persistence, opened files and the
+// metadata of the file system, then file times which are the easiest to
+// tamper with
+var defaultWeights = map[string]float64{
+	"prefetch":  3,
+	"execution": 3,
+	"amcache":   3,
+	"registry":  2,
+	"ntfs":      2,
+	"lnk":       2,
+	"file":      1,
+}
+
+const (
+	// defaultSkewTolerance is the difference between the clocks of two
+	// hosts under which their artefact times are considered equal
+	defaultSkewTolerance = time.Minute
+
+	// singleHostConfidence is given to an artefact seen on one host only,
+	// since there is no other host to compare it with
+	singleHostConfidence = 0.5
+
+	// outlierLead is the lead over the next host above which the first
+	// time of an artefact is likely bogus, such as a reset file time
+	outlierLead = 30 * 24 * time.Hour
+
+	// outlierConfidence is given to artefacts with an outlier lead
+	outlierConfidence = 0.25
+
+	// minSkewArtefacts is the number of artefacts more recent than the end
+	// of their command a host must report to have its clock estimated ahead
+	minSkewArtefacts = 3
+
+	// skewPenalty multiplies the points of hosts with a skewed clock
+	skewPenalty = 0.5
+)
+
+// Evidence explains the points given to a host for an artefact
+type Evidence struct {
+	Artefact   string
+	Module     string
+	CommandID  float64
+	Time       time.Time
+	Weight     float64 // weight of the module
+	Confidence float64 // between 0 and 1
+	Points     float64 // weight times confidence
+	Reason     string
+}
+
+// HostScore is the patient zero score of a host, with the artefacts that
+// make it up
+type HostScore struct {
+	Agent     string
+	Score     float64
+	FirstSeen time.Time     // earliest time of the artefacts the host was first to see
+	Skew      time.Duration // estimated clock skew, zero if unknown
+	Evidence  []Evidence
+}
+
+// parseWeights reads a comma separated list of module=weight pairs, and
+// completes it with the default weights of the modules not listed
+func parseWeights(list string) (weights map[string]float64, err error) {
+	weights = make(map[string]float64)
+	for module, w := range defaultWeights {
+		weights[module] = w
+	}
+	for _, mw := range strings.Split(list, ",") {
+		mw = strings.TrimSpace(mw)
+		if mw == "" {
+			continue
+		}
+		parts := strings.SplitN(mw, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid weight %q, must be module=weight", mw)
+		}
+		module := strings.ToLower(strings.TrimSpace(parts[0]))
+		if !contains(defaultModules, module) {
+			return nil, fmt.Errorf("module %q is not supported, use one of %s", module, strings.Join(defaultModules, ", "))
+		}
+		w, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("invalid weight %q for module %s", parts[1], module)
+		}
+		weights[module] = w
+	}
+	return
+}
+
+// formatWeights lists weights as module=weight pairs, by decreasing weight,
+// in the format read by parseWeights
+func formatWeights(weights map[string]float64) string {
+	var pairs []weightPair
+	for module, w := range weights {
+		pairs = append(pairs, weightPair{module, w})
+	}
+	sort.Sort(byWeight(pairs))
+	var list []string
+	for _, p := range pairs {
+		list = append(list, p.module+"="+strconv.FormatFloat(p.weight, 'g', -1, 64))
+	}
+	return strings.Join(list, ",")
+}
+
+type weightPair struct {
+	module string
+	weight float64
+}
+
+// byWeight sorts modules by decreasing weight, then by name
+type byWeight []weightPair
+
+func (b byWeight) Len() int { return len(b) }
+func (b byWeight) Less(i, j int) bool {
+	if b[i].weight != b[j].weight {
+		return b[i].weight > b[j].weight
+	}
+	return b[i].module < b[j].module
+}
+func (b byWeight) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+
+/*
+	estimateSkews returns the clock skew of the hosts. The drift measured by
+	timedrift or read from a drift file is preferred when a host has one:
+	its times are already corrected, and it only keeps a skew when the drift
+	is excessive, since the corrected times remain doubtful. Other hosts
+	are known to be ahead when they reported at least minSkewArtefacts
+	artefacts more recent than the end of the command that found them. The
+	skew is the median of the differences, so a single bogus time, such as
+	a file time set in the future, does not make a host look skewed.
+*/
+func estimateSkews(commands []mig.Command, records []Record, drifts map[string]Drift, opts options) map[string]time.Duration {
+	finish := make(map[float64]time.Time)
+	for _, cmd := range commands {
+		finish[cmd.ID] = cmd.FinishTime
+	}
+	leads := make(map[string][]time.Duration)
+	for _, rec := range records {
+		ft, ok := finish[rec.CommandID]
+		if !ok || ft.IsZero() || drifts[rec.Agent].Known() {
+			continue
+		}
+		for _, t := range rec.Artefacts {
+			if d := t.Sub(ft); d > 0 {
+				leads[rec.Agent] = append(leads[rec.Agent], d)
+			}
+		}
+	}
+	skews := make(map[string]time.Duration)
+	for agent, l := range leads {
+		if len(l) < minSkewArtefacts {
+			continue
+		}
+		sort.Sort(byDuration(l))
+		skews[agent] = l[len(l)/2]
+		if len(l)%2 == 0 {
+			skews[agent] = (l[len(l)/2-1] + l[len(l)/2]) / 2
+		}
+	}
+	for agent, d := range drifts {
+		if d.Excessive(opts) {
+			skews[agent] = d.Offset
+		}
+	}
+	return skews
+}
+
+/*
+	scoreHosts gives points to the hosts that were the first to see each
+	artefact. The points of an artefact are the weight of the module that
+	found it, multiplied by the confidence in the order of the hosts:
+	- hosts that saw the artefact within the skew tolerance of the first
+	  time share its points
+	- artefacts seen on one host only, or with a suspiciously large lead
+	  over the next host, have a reduced confidence
+	- hosts with a clock skew above the tolerance have their points reduced
+	Hosts are returned by decreasing score, then by earliest first seen
+	time, then by name, so the verdict does not depend on map ordering.
+*/
+func scoreHosts(artefactTimes map[string][]TimeEntry, skews map[string]time.Duration, opts options) (scores []HostScore) {
+	hosts := make(map[string]*HostScore)
+	arts := make([]string, 0, len(artefactTimes))
+	for art := range artefactTimes {
+		arts = append(arts, art)
+	}
+	sort.Strings(arts)
+	for _, art := range arts {
+		var entries []TimeEntry
+		for _, tr := range artefactTimes[art] {
+			// artefacts without a known time cannot be ordered
+			if !tr.Time.IsZero() {
+				entries = append(entries, tr)
+			}
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		sort.Sort(byTime(entries))
+		first := entries[0].Time
+		leaders := 1
+		for leaders < len(entries) && entries[leaders].Time.Sub(first) <= opts.SkewTolerance {
+			leaders++
+		}
+		confidence := 1.0
+		var reason string
+		switch {
+		case len(entries) == 1:
+			confidence = singleHostConfidence
+			reason = "only host to see the artefact"
+		case leaders == len(entries):
+			reason = fmt.Sprintf("all %d hosts saw the artefact within %s", len(entries), opts.SkewTolerance)
+		default:
+			next := entries[leaders]
+			lead := next.Time.Sub(first)
+			reason = fmt.Sprintf("seen %s before %s", lead, next.Agent)
+			if lead > outlierLead {
+				confidence = outlierConfidence
+				reason += ", the time may be bogus"
+			}
+		}
+		if leaders > 1 {
+			confidence /= float64(leaders)
+		}
+		for i, tr := range entries[:leaders] {
+			hs, ok := hosts[tr.Agent]
+			if !ok {
+				hs = &HostScore{Agent: tr.Agent, FirstSeen: tr.Time, Skew: skews[tr.Agent]}
+				hosts[tr.Agent] = hs
+			}
+			ev := Evidence{
+				Artefact:   art,
+				Module:     tr.Module,
+				CommandID:  tr.CommandID,
+				Time:       tr.Time,
+				Weight:     moduleWeight(opts.Weights, tr.Module),
+				Confidence: confidence,
+				Reason:     reason,
+			}
+			if leaders > 1 {
+				var tied []string
+				for j := range entries[:leaders] {
+					if j != i {
+						tied = append(tied, entries[j].Agent)
+					}
+				}
+				ev.Reason += ", tied with " + strings.Join(tied, ", ")
+			}
+			if abs(hs.Skew) > opts.SkewTolerance {
+				ev.Confidence *= skewPenalty
+				ev.Reason += fmt.Sprintf(", clock skewed by %s", hs.Skew)
+			}
+			ev.Points = ev.Weight * ev.Confidence
+			hs.Score += ev.Points
+			hs.Evidence = append(hs.Evidence, ev)
+			if tr.Time.Before(hs.FirstSeen) {
+				hs.FirstSeen = tr.Time
+			}
+		}
+	}
+	for _, hs := range hosts {
+		scores = append(scores, *hs)
+	}
+	sort.Sort(byScore(scores))
+	return
+}
+
+// moduleWeight returns the weight of a module, modules without a weight
+// count as file times
+func moduleWeight(weights map[string]float64, module string) float64 {
+	if w, ok := weights[module]; ok {
+		return w
+	}
+	return defaultWeights["file"]
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// byTime sorts the hosts that saw an artefact by time, and hosts that saw
+// it at the same time by name
+type byTime []TimeEntry
+
+func (b byTime) Len() int { return len(b) }
+func (b byTime) Less(i, j int) bool {
+	if b[i].Time.Equal(b[j].Time) {
+		return b[i].Agent < b[j].Agent
+	}
+	return b[i].Time.Before(b[j].Time)
+}
+func (b byTime) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+
+// byDuration sorts durations in increasing order
+type byDuration []time.Duration
+
+func (b byDuration) Len() int           { return len(b) }
+func (b byDuration) Less(i, j int) bool { return b[i] < b[j] }
+func (b byDuration) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// byScore sorts hosts by decreasing score, then earliest first seen time,
+// then name
+type byScore []HostScore
+
+func (b byScore) Len() int { return len(b) }
+func (b byScore) Less(i, j int) bool {
+	if b[i].Score != b[j].Score {
+		return b[i].Score > b[j].Score
+	}
+	if !b[i].FirstSeen.Equal(b[j].FirstSeen) {
+		return b[i].FirstSeen.Before(b[j].FirstSeen)
+	}
+	return b[i].Agent < b[j].Agent
+}
+func (b byScore) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
@@ -0,0 +1,201 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"mig.ninja/mig"
+)
+
+func testEntry(agent, module string, t time.Time) TimeEntry {
+	return TimeEntry{Agent: agent, Module: module, Time: t}
+}
+
+func TestParseWeights(t *testing.T) {
+	w, err := parseWeights("File=0.5, prefetch=10, ntfs=4, lnk=0, Execution=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w["file"] != 0.5 || w["prefetch"] != 10 || w["ntfs"] != 4 || w["lnk"] != 0 || w["execution"] != 5 || w["registry"] != defaultWeights["registry"] {
+		t.Fatalf("unexpected weights %v", w)
+	}
+	if defaultWeights["file"] != 1 {
+		t.Fatal("parsing weights modified the default weights")
+	}
+	for _, module := range defaultModules {
+		if _, ok := defaultWeights[module]; !ok {
+			t.Fatalf("module %s has no default weight", module)
+		}
+	}
+	for _, list := range []string{"file", "netstat=1", "file=heavy", "file=-1"} {
+		if _, err := parseWeights(list); err == nil {
+			t.Fatalf("expected error on weights %q", list)
+		}
+	}
+}
+
+func TestFormatWeights(t *testing.T) {
+	expected := "amcache=3,execution=3,prefetch=3,lnk=2,ntfs=2,registry=2,file=1"
+	if s := formatWeights(defaultWeights); s != expected {
+		t.Fatalf("expected %s, got %s", expected, s)
+	}
+	w, err := parseWeights(formatWeights(map[string]float64{"file": 0.5, "prefetch": 10}))
+	if err != nil || w["file"] != 0.5 || w["prefetch"] != 10 {
+		t.Fatalf("unexpected weights %v, %v", w, err)
+	}
+}
+
+func TestScoreHosts(t *testing.T) {
+	opts, err := parseOptions("", "", "text", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		desc     string
+		arts     map[string][]TimeEntry
+		skews    map[string]time.Duration
+		expected []HostScore
+		reason   string
+	}{
+		{"execution evidence outweighs persistence",
+			map[string][]TimeEntry{
+				"EXPLERER.EXE": {
+					testEntry("host-a", "prefetch", testT0.Add(time.Hour)),
+					testEntry("host-b", "prefetch", testT0.Add(2*time.Hour)),
+				},
+				"NTUSER.DAT/Run": {
+					testEntry("host-a", "registry", testT0.Add(time.Hour)),
+					testEntry("host-b", "registry", testT0),
+				},
+			}, nil,
+			[]HostScore{{Agent: "host-a", Score: 3}, {Agent: "host-b", Score: 2}},
+			"seen 1h0m0s before host-b",
+		},
+		{"a single bogus file time does not swing the verdict",
+			map[string][]TimeEntry{
+				"EXPLERER.EXE": {
+					testEntry("host-a", "prefetch", testT0),
+					testEntry("host-b", "prefetch", testT0.Add(time.Hour)),
+				},
+				"/tmp/dropper": {
+					testEntry("host-a", "file", testT0),
+					testEntry("host-b", "file", time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)),
+				},
+				"/tmp/payload": {
+					testEntry("host-a", "file", testT0),
+					testEntry("host-b", "file", time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)),
+				},
+			}, nil,
+			[]HostScore{{Agent: "host-a", Score: 3}, {Agent: "host-b", Score: 0.5}},
+			"the time may be bogus",
+		},
+		{"hosts within the skew tolerance share the points",
+			map[string][]TimeEntry{
+				"EXPLERER.EXE": {
+					testEntry("host-b", "prefetch", testT0.Add(30*time.Second)),
+					testEntry("host-a", "prefetch", testT0),
+					testEntry("host-c", "prefetch", testT0.Add(time.Hour)),
+				},
+			}, nil,
+			[]HostScore{{Agent: "host-a", Score: 1.5}, {Agent: "host-b", Score: 1.5}},
+			"tied with host-b",
+		},
+		{"skewed clocks are penalised",
+			map[string][]TimeEntry{
+				"EXPLERER.EXE": {
+					testEntry("host-a", "prefetch", testT0),
+					testEntry("host-b", "prefetch", testT0.Add(time.Hour)),
+				},
+				"NTUSER.DAT/Run": {
+					testEntry("host-a", "registry", testT0.Add(time.Hour)),
+					testEntry("host-b", "registry", testT0),
+				},
+			}, map[string]time.Duration{"host-a": 2 * time.Hour},
+			[]HostScore{{Agent: "host-b", Score: 2}, {Agent: "host-a", Score: 1.5}},
+			"clock skewed by 2h0m0s",
+		},
+		{"ties are broken by first seen time, then name",
+			map[string][]TimeEntry{
+				"a.exe": {testEntry("host-c", "prefetch", testT0.Add(time.Hour))},
+				"b.exe": {testEntry("host-b", "prefetch", testT0)},
+				"c.exe": {testEntry("host-a", "prefetch", testT0)},
+			}, nil,
+			[]HostScore{{Agent: "host-a", Score: 1.5}, {Agent: "host-b", Score: 1.5}, {Agent: "host-c", Score: 1.5}},
+			"only host to see the artefact",
+		},
+	} {
+		scores := scoreHosts(tc.arts, tc.skews, opts)
+		if len(scores) != len(tc.expected) {
+			t.Fatalf("%s: expected %d suspects, got %+v", tc.desc, len(tc.expected), scores)
+		}
+		found := false
+		for i, hs := range scores {
+			if hs.Agent != tc.expected[i].Agent || hs.Score != tc.expected[i].Score {
+				t.Fatalf("%s: expected %s with %g at rank %d, got %s with %g",
+					tc.desc, tc.expected[i].Agent, tc.expected[i].Score, i+1, hs.Agent, hs.Score)
+			}
+			total := 0.0
+			for _, ev := range hs.Evidence {
+				total += ev.Points
+				if strings.Contains(ev.Reason, tc.reason) {
+					found = true
+				}
+			}
+			if total != hs.Score {
+				t.Fatalf("%s: evidence of %s adds up to %g, not %g", tc.desc, hs.Agent, total, hs.Score)
+			}
+		}
+		if !found {
+			t.Fatalf("%s: no evidence explained by %q in %+v", tc.desc, tc.reason, scores)
+		}
+	}
+}
+
+func TestEstimateSkews(t *testing.T) {
+	cmds := []mig.Command{
+		{ID: 1, FinishTime: testT0}, {ID: 2, FinishTime: testT0},
+		{ID: 3, FinishTime: testT0}, {ID: 4, FinishTime: testT0}, {ID: 5},
+	}
+	future := func(d ...time.Duration) map[string]time.Time {
+		arts := map[string]time.Time{"old": testT0.Add(-time.Hour)}
+		for i, d := range d {
+			arts[fmt.Sprintf("art%d", i)] = testT0.Add(d)
+		}
+		return arts
+	}
+	records := []Record{
+		// the median lead is the skew, despite a bogus time a month ahead
+		{CommandID: 1, Agent: "host-a.example.net", Artefacts: future(5*time.Minute, 10*time.Minute, 30*24*time.Hour)},
+		// too few artefacts ahead of the command to tell
+		{CommandID: 2, Agent: "host-b.example.net", Artefacts: future(time.Hour, 2*time.Hour)},
+		// a measured drift wins over the estimate
+		{CommandID: 3, Agent: "host-c.example.net", Artefacts: future(time.Hour, time.Hour, time.Hour)},
+		{CommandID: 4, Agent: "host-d.example.net", Artefacts: future(time.Hour, time.Hour, time.Hour)},
+		// commands without a finish time give no estimate
+		{CommandID: 5, Agent: "host-e.example.net", Artefacts: future(time.Hour, time.Hour, time.Hour)},
+	}
+	opts, err := parseOptions("", "", "text", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	drifts := map[string]Drift{
+		"host-c.example.net": {Agent: "host-c.example.net", Offset: time.Second, Source: driftNTP},
+		"host-d.example.net": {Agent: "host-d.example.net", Offset: -2 * opts.MaxDrift, Source: driftStored},
+	}
+	skews := estimateSkews(cmds, records, drifts, opts)
+	if len(skews) != 2 || skews["host-a.example.net"] != 10*time.Minute || skews["host-d.example.net"] != -2*opts.MaxDrift {
+		t.Fatalf("unexpected skews %v", skews)
+	}
+	records[0].Artefacts["art3"] = testT0.Add(20 * time.Minute)
+	if skews := estimateSkews(cmds, records[:1], nil, opts); skews["host-a.example.net"] != 15*time.Minute {
+		t.Fatalf("unexpected skews %v", skews)
+	}
+}
@@ -0,0 +1,356 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"time"
+
+	"mig.ninja/mig"
+)
+
+// timelineEvent is an artefact seen on a host, as drawn on the timeline
+type timelineEvent struct {
+	Host        string    `json:"host"`
+	Module      string    `json:"module"`
+	Search      string    `json:"search,omitempty"`
+	Artefact    string    `json:"artefact"`
+	Time        time.Time `json:"time"`
+	ActionID    float64   `json:"action"`
+	CommandID   float64   `json:"command"`
+	ActionLink  string    `json:"actionlink,omitempty"`
+	CommandLink string    `json:"commandlink,omitempty"`
+}
+
+// timelineDrift is the clock drift of a host, with its status
+type timelineDrift struct {
+	Drift
+	Status string
+}
+
+// timelineData holds everything rendered by the timeline template
+type timelineData struct {
+	Title   string
+	Actions []mig.Action
+	Hosts   []string
+	Modules []string
+	Events  []timelineEvent
+	Scores  []HostScore
+	Drifts  []timelineDrift
+	CSS     template.CSS
+	JS      template.JS
+}
+
+var timelineTemplate = template.Must(template.New("timeline").Funcs(template.FuncMap{
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	},
+	"id": func(f float64) string { return fmt.Sprintf("%.0f", f) },
+}).Parse(timelineHTML))
+
+/*
+	printTimeline writes a self contained HTML report, with the timeline of
+	the artefacts drawn in one swimlane per host, the patient zero suspects
+	and the clock drift of the hosts. Scripts and styles are embedded in the
+	report, so it can be opened on a workstation without network access.
+	Each event links to the action and command that found it in the MIG API.
+*/
+func printTimeline(w io.Writer, commands []mig.Command, records []Record, scores []HostScore, drifts map[string]Drift, opts options) error {
+	data := timelineData{
+		Scores: scores,
+		CSS:    template.CSS(timelineCSS),
+		JS:     template.JS(timelineJS),
+	}
+	seenAction := make(map[float64]bool)
+	for _, cmd := range commands {
+		if seenAction[cmd.Action.ID] {
+			continue
+		}
+		seenAction[cmd.Action.ID] = true
+		data.Actions = append(data.Actions, cmd.Action)
+		if data.Title == "" {
+			data.Title = cmd.Action.Threat.Family
+		}
+		if data.Title == "" {
+			data.Title = cmd.Action.Name
+		}
+	}
+	sort.Sort(byActionID(data.Actions))
+	seenHost := make(map[string]bool)
+	for _, rec := range records {
+		for _, art := range sortedArtefacts(rec.Artefacts) {
+			ev := timelineEvent{
+				Host:      rec.Agent,
+				Module:    rec.Module,
+				Search:    rec.Search,
+				Artefact:  art,
+				Time:      rec.Artefacts[art].UTC(),
+				ActionID:  rec.ActionID,
+				CommandID: rec.CommandID,
+			}
+			if opts.APIURL != "" {
+				ev.ActionLink = fmt.Sprintf("%saction?actionid=%.0f", opts.APIURL, rec.ActionID)
+				ev.CommandLink = fmt.Sprintf("%scommand?commandid=%.0f", opts.APIURL, rec.CommandID)
+			}
+			data.Events = append(data.Events, ev)
+			if !seenHost[rec.Agent] {
+				seenHost[rec.Agent] = true
+				data.Hosts = append(data.Hosts, rec.Agent)
+			}
+		}
+	}
+	sort.Strings(data.Hosts)
+	sort.Sort(byEventTime(data.Events))
+	for _, module := range opts.Modules {
+		data.Modules = append(data.Modules, module)
+	}
+	for _, d := range sortedDrifts(drifts) {
+		data.Drifts = append(data.Drifts, timelineDrift{d, d.Status(opts)})
+	}
+	return timelineTemplate.Execute(w, data)
+}
+
+type byActionID []mig.Action
+
+func (b byActionID) Len() int           { return len(b) }
+func (b byActionID) Less(i, j int) bool { return b[i].ID < b[j].ID }
+func (b byActionID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// byEventTime sorts the events of the timeline by time, host and artefact
+type byEventTime []timelineEvent
+
+func (b byEventTime) Len() int { return len(b) }
+func (b byEventTime) Less(i, j int) bool {
+	if !b[i].Time.Equal(b[j].Time) {
+		return b[i].Time.Before(b[j].Time)
+	}
+	if b[i].Host != b[j].Host {
+		return b[i].Host < b[j].Host
+	}
+	return b[i].Artefact < b[j].Artefact
+}
+func (b byEventTime) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+
+const timelineHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Threat Search | {{.Title}} | Timeline</title>
+<style>{{.CSS}}</style>
+</head>
+<body>
+<header><h1>Threat Search | {{.Title}}</h1></header>
+<section id="actions">
+<h2>Actions</h2>
+<table>
+<tr><th>ID</th><th>Name</th><th>Target</th><th>Threat</th><th>Period</th><th>Started</th><th>Finished</th><th>Done</th><th>Success</th></tr>
+{{range .Actions}}<tr><td>{{id .ID}}</td><td>{{.Name}}</td><td>{{.Target}}</td><td>{{.Threat.Family}} {{.Threat.Level}}</td><td>{{date .ValidFrom}} {{date .ExpireAfter}}</td><td>{{date .StartTime}}</td><td>{{date .FinishTime}}</td><td>{{.Counters.Done}}</td><td>{{.Counters.Success}}</td></tr>
+{{end}}</table>
+</section>
+<section id="timeline-section">
+<h2>Timeline</h2>
+<div id="controls">
+<label>Artefact <input id="filter" type="search" placeholder="filter artefacts"></label>
+{{range .Modules}}<label><input class="module" type="checkbox" value="{{.}}" checked> {{.}}</label>
+{{end}}<button id="zoom-in" type="button">+</button><button id="zoom-out" type="button">-</button><button id="zoom-reset" type="button">Reset</button>
+</div>
+<svg id="timeline"></svg>
+<table id="events">
+<tr><th>Time</th><th>Host</th><th>Module</th><th>Search</th><th>Artefact</th><th>Action</th><th>Command</th></tr>
+{{range .Events}}<tr data-module="{{.Module}}" data-artefact="{{.Artefact}}"><td>{{date .Time}}</td><td>{{.Host}}</td><td>{{.Module}}</td><td>{{.Search}}</td><td>{{.Artefact}}</td><td>{{if .ActionLink}}<a href="{{.ActionLink}}">{{id .ActionID}}</a>{{else}}{{id .ActionID}}{{end}}</td><td>{{if .CommandLink}}<a href="{{.CommandLink}}">{{id .CommandID}}</a>{{else}}{{id .CommandID}}{{end}}</td></tr>
+{{end}}</table>
+</section>
+<section id="suspects">
+<h2>Patient Zero Suspects</h2>
+<table>
+<tr><th>System</th><th>Score</th><th>Points</th><th>Weight</th><th>Confidence</th><th>Module</th><th>Artefact</th><th>Time</th><th>Command</th><th>Reason</th></tr>
+{{range .Scores}}{{$agent := .Agent}}{{$score := .Score}}{{range .Evidence}}<tr><td>{{$agent}}</td><td>{{printf "%.2f" $score}}</td><td>{{printf "%.2f" .Points}}</td><td>{{.Weight}}</td><td>{{printf "%.2f" .Confidence}}</td><td>{{.Module}}</td><td>{{.Artefact}}</td><td>{{date .Time}}</td><td>{{id .CommandID}}</td><td>{{.Reason}}</td></tr>
+{{end}}{{end}}</table>
+</section>
+<section id="drifts">
+<h2>Clock Drift</h2>
+<table>
+<tr><th>System</th><th>Status</th><th>Drift</th></tr>
+{{range .Drifts}}<tr class="{{.Status}}"><td>{{.Agent}}</td><td>{{.Status}}</td><td>{{if .Known}}{{.Drift.String}}{{end}}</td></tr>
+{{end}}</table>
+</section>
+<script type="application/json" id="timeline-data">{"hosts": {{.Hosts}}, "events": {{.Events}}}</script>
+<script>{{.JS}}</script>
+</body>
+</html>
+`
+
+const timelineCSS = `
+body { font-family: sans-serif; margin: 0; }
+header { padding: 0.5em 1em; color: white; background-color: black; }
+section { padding: 0 1em 1em 1em; }
+table { border-collapse: collapse; margin-top: 0.5em; }
+th, td { border: 1px solid #999; padding: 2px 6px; text-align: left; font-size: 13px; }
+tr.unknown td, tr.excessive td { background-color: #fde2c4; }
+#controls label { margin-right: 1em; }
+#timeline { display: block; width: 100%; border: 1px solid #ccc; cursor: grab; user-select: none; }
+#timeline .lane { fill: #f7f7f7; }
+#timeline .lane.odd { fill: #ececec; }
+#timeline .host { font-size: 12px; }
+#timeline .tick { stroke: #ccc; }
+#timeline .ticklabel { font-size: 10px; fill: #555; }
+#timeline circle { stroke: black; stroke-width: 0.5; }
+#timeline circle.prefetch { fill: #d62728; }
+#timeline circle.registry { fill: #1f77b4; }
+#timeline circle.file { fill: #2ca02c; }
+`
+
+const timelineJS = `
+(function() {
+	"use strict";
+	var data = JSON.parse(document.getElementById("timeline-data").textContent);
+	var svg = document.getElementById("timeline");
+	var ns = "http://www.w3.org/2000/svg";
+	var laneHeight = 28, labelWidth = 220, axisHeight = 24;
+	var events = (data.events || []).map(function(e) {
+		e.t = Date.parse(e.time);
+		return e;
+	});
+	var hosts = data.hosts || [];
+	var min = Infinity, max = -Infinity;
+	events.forEach(function(e) {
+		min = Math.min(min, e.t);
+		max = Math.max(max, e.t);
+	});
+	if (!events.length) {
+		min = 0;
+		max = 1;
+	}
+	// pad the full range so the first and last events are not on the edges
+	var pad = Math.max((max - min) * 0.05, 60000);
+	var full = {start: min - pad, end: max + pad};
+	var view = {start: full.start, end: full.end};
+
+	function visible(e) {
+		var filter = document.getElementById("filter").value.toLowerCase();
+		var boxes = document.querySelectorAll("input.module");
+		for (var i = 0; i < boxes.length; i++) {
+			if (boxes[i].value === e.module && !boxes[i].checked) {
+				return false;
+			}
+		}
+		return e.artefact.toLowerCase().indexOf(filter) >= 0;
+	}
+
+	function el(name, attrs, text) {
+		var node = document.createElementNS(ns, name);
+		for (var k in attrs) {
+			node.setAttribute(k, attrs[k]);
+		}
+		if (text !== undefined) {
+			node.textContent = text;
+		}
+		return node;
+	}
+
+	function render() {
+		var width = svg.clientWidth || 1000;
+		var height = axisHeight + hosts.length * laneHeight;
+		var scale = (width - labelWidth) / (view.end - view.start);
+		var x = function(t) { return labelWidth + (t - view.start) * scale; };
+		svg.setAttribute("height", height);
+		while (svg.firstChild) {
+			svg.removeChild(svg.firstChild);
+		}
+		hosts.forEach(function(host, i) {
+			var y = axisHeight + i * laneHeight;
+			svg.appendChild(el("rect", {"class": i % 2 ? "lane odd" : "lane", x: 0, y: y, width: width, height: laneHeight}));
+			svg.appendChild(el("text", {"class": "host", x: 4, y: y + laneHeight / 2 + 4}, host));
+		});
+		for (var i = 0; i <= 10; i++) {
+			var t = view.start + (view.end - view.start) * i / 10;
+			svg.appendChild(el("line", {"class": "tick", x1: x(t), x2: x(t), y1: axisHeight - 4, y2: height}));
+			svg.appendChild(el("text", {"class": "ticklabel", x: x(t) - 50, y: 12}, new Date(t).toISOString().replace(".000Z", "Z")));
+		}
+		events.forEach(function(e) {
+			if (!visible(e) || e.t < view.start || e.t > view.end) {
+				return;
+			}
+			var y = axisHeight + hosts.indexOf(e.host) * laneHeight + laneHeight / 2;
+			var dot = el("circle", {"class": e.module, cx: x(e.t), cy: y, r: 5});
+			dot.appendChild(el("title", {}, e.time + " " + e.module + " " + e.artefact +
+				" (action " + e.action + ", command " + e.command + ")"));
+			if (e.commandlink) {
+				var link = el("a", {href: e.commandlink});
+				link.appendChild(dot);
+				svg.appendChild(link);
+			} else {
+				svg.appendChild(dot);
+			}
+		});
+		var rows = document.querySelectorAll("#events tr[data-artefact]");
+		for (var j = 0; j < rows.length; j++) {
+			var row = rows[j];
+			row.style.display = visible({module: row.getAttribute("data-module"), artefact: row.getAttribute("data-artefact")}) ? "" : "none";
+		}
+	}
+
+	// zoom keeps the time under the pointer, or the center, in place
+	function zoom(factor, center) {
+		if (center === undefined) {
+			center = (view.start + view.end) / 2;
+		}
+		var span = Math.max((view.end - view.start) * factor, 1000);
+		var ratio = (center - view.start) / (view.end - view.start);
+		view.start = center - span * ratio;
+		view.end = view.start + span;
+		render();
+	}
+
+	function timeAt(clientX) {
+		var rect = svg.getBoundingClientRect();
+		var width = rect.width - labelWidth;
+		return view.start + (clientX - rect.left - labelWidth) / width * (view.end - view.start);
+	}
+
+	svg.addEventListener("wheel", function(evt) {
+		evt.preventDefault();
+		zoom(evt.deltaY < 0 ? 0.8 : 1.25, timeAt(evt.clientX));
+	});
+	var drag = null;
+	svg.addEventListener("mousedown", function(evt) {
+		drag = {x: evt.clientX, start: view.start, end: view.end};
+	});
+	window.addEventListener("mouseup", function() {
+		drag = null;
+	});
+	window.addEventListener("mousemove", function(evt) {
+		if (!drag) {
+			return;
+		}
+		var shift = (evt.clientX - drag.x) / (svg.clientWidth - labelWidth) * (drag.end - drag.start);
+		view.start = drag.start - shift;
+		view.end = drag.end - shift;
+		render();
+	});
+	document.getElementById("zoom-in").addEventListener("click", function() { zoom(0.5); });
+	document.getElementById("zoom-out").addEventListener("click", function() { zoom(2); });
+	document.getElementById("zoom-reset").addEventListener("click", function() {
+		view.start = full.start;
+		view.end = full.end;
+		render();
+	});
+	document.getElementById("filter").addEventListener("input", render);
+	var boxes = document.querySelectorAll("input.module");
+	for (var i = 0; i < boxes.length; i++) {
+		boxes[i].addEventListener("change", render);
+	}
+	window.addEventListener("resize", render);
+	render();
+})();
+`
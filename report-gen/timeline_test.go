@@ -0,0 +1,72 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"mig.ninja/mig/modules/prefetch"
+)
+
+var update = flag.Bool("update", false, "update the golden files of the reports")
+
+// checkGolden compares a report to its golden file in testdata, or
+// rewrites the golden file when the tests run with -update
+func checkGolden(t *testing.T, name string, report []byte) {
+	path := "testdata/" + name + ".golden"
+	if *update {
+		err := ioutil.WriteFile(path, report, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	golden, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(report, golden) {
+		t.Fatalf("report does not match %s, run the tests with -update if the change is expected:\n%s", path, report)
+	}
+}
+
+func TestPrintTimeline(t *testing.T) {
+	cmds := testDriftCommands()
+	cmds[0].Action.Threat.Family = "explerer"
+	cmds[0].Action.Counters.Done = 3
+	cmds[0].Action.Counters.Success = 3
+	cmds[0].Action.StartTime = testT0.Add(3 * time.Hour)
+	// artefact names come from the hosts, and must not be interpreted
+	cmds[2].Results[1].Elements = map[string]interface{}{
+		"prefetchresults": []prefetch.PrefetchResult{testPrefetch("</script><b>EXPLERER.EXE", testT0.Add(2*time.Hour))},
+	}
+	opts, err := parseOptions("", "", "html", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.APIURL = "https://mig.example.net/api/v1/"
+	records, artefactTimes, _ := processResults(cmds, opts)
+	var buf bytes.Buffer
+	err = printResults(&buf, cmds, records, artefactTimes, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := buf.String()
+	for _, e := range []string{"src=", "<link", "@import", "url(", "cdnjs"} {
+		if strings.Contains(report, e) {
+			t.Fatalf("report is not self contained, found %q", e)
+		}
+	}
+	if strings.Count(report, "</script>") != 2 || strings.Contains(report, "<b>EXPLERER") {
+		t.Fatal("artefact name was not escaped")
+	}
+	checkGolden(t, "timeline.html", buf.Bytes())
+}
@@ -0,0 +1,432 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Julien Vehent jvehent@mozilla.com [:ulfr]
+
+package mig /* import "mig.ninja/mig" */
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// TargetFields maps the fields of agents that can be used in a target expression
+// to the columns of the agents table they are compiled to
+var TargetFields = map[string]string{
+	"name":     "agents.name",
+	"queueloc": "agents.queueloc",
+	"mode":     "agents.mode",
+	"status":   "agents.status",
+	"version":  "agents.version",
+	"os":       "agents.environment->>'os'",
+	"arch":     "agents.environment->>'arch'",
+	"ident":    "agents.environment->>'ident'",
+	"init":     "agents.environment->>'init'",
+	"publicip": "agents.environment->>'publicip'",
+}
+
+const (
+	targetTag      = "tag"
+	targetAddress  = "address"
+	targetFound    = "found"
+	targetNotFound = "notfound"
+)
+
+// Target is the syntax tree of a parsed target expression.
+//
+// A target expression selects the agents an action runs on. It is made of
+// predicates on the fields of the agents, combined with AND, OR, NOT and
+// parenthesis. NOT binds tighter than AND, which binds tighter than OR.
+//
+//	os:linux AND tag:team=web AND name~"db*"
+//	(mode:daemon OR mode:checkin) AND NOT ident~"centos 6*"
+//	notfound:4928374928374 AND os:darwin
+//
+// A predicate is a field, an operator and a value. The ':' and '=' operators
+// test equality, the '~' operator matches a case insensitive glob pattern where
+// '*' is any string and '?' any character. Tags are selected with tag:<key>,
+// and found:<action id> and notfound:<action id> select the agents that have or
+// haven't found something in a previous action. Values that contain spaces,
+// parenthesis or operators must be double quoted.
+type Target struct {
+	root targetNode
+}
+
+// ParseTarget parses a target expression and returns an error if it is invalid
+func ParseTarget(expr string) (t Target, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("ParseTarget() -> %v", e)
+		}
+	}()
+	p := targetParser{tokens: lexTarget(expr)}
+	if len(p.tokens) == 0 {
+		panic("target expression is empty")
+	}
+	t.root = p.parseOr()
+	if p.pos < len(p.tokens) {
+		panic(fmt.Sprintf("unexpected %s at position %d", p.tokens[p.pos], p.tokens[p.pos].pos))
+	}
+	return
+}
+
+// String returns the expression of a target in its canonical form
+func (t Target) String() string {
+	if t.root == nil {
+		return ""
+	}
+	return t.root.expr(precOr)
+}
+
+// SQL compiles a target into a condition on the agents table. The values of
+// the target are never written into the condition, they are returned as query
+// arguments referenced by placeholders that start at $first.
+func (t Target) SQL(first int) (cond string, args []interface{}) {
+	if t.root == nil {
+		return "FALSE", nil
+	}
+	b := targetSQL{next: first}
+	cond = t.root.sql(&b)
+	return cond, b.args
+}
+
+// QuoteTargetValue returns a string that can be used as a value in a target expression
+func QuoteTargetValue(s string) string {
+	if s == "" || isTargetKeyword(s) || strings.IndexFunc(s, func(r rune) bool { return !isTargetWordRune(r) }) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// operator precedences, used to place parenthesis in canonical expressions
+const (
+	precOr = iota
+	precAnd
+	precNot
+)
+
+type targetNode interface {
+	expr(prec int) string
+	sql(b *targetSQL) string
+}
+
+type targetBinary struct {
+	op          string // "AND" or "OR"
+	left, right targetNode
+}
+
+func (n targetBinary) prec() int {
+	if n.op == "AND" {
+		return precAnd
+	}
+	return precOr
+}
+
+func (n targetBinary) expr(prec int) string {
+	s := n.left.expr(n.prec()) + " " + n.op + " " + n.right.expr(n.prec())
+	if prec > n.prec() {
+		return "(" + s + ")"
+	}
+	return s
+}
+
+func (n targetBinary) sql(b *targetSQL) string {
+	return "(" + n.left.sql(b) + " " + n.op + " " + n.right.sql(b) + ")"
+}
+
+type targetNot struct {
+	node targetNode
+}
+
+func (n targetNot) expr(prec int) string {
+	return "NOT " + n.node.expr(precNot)
+}
+
+func (n targetNot) sql(b *targetSQL) string {
+	return "(NOT " + n.node.sql(b) + ")"
+}
+
+type targetPredicate struct {
+	field string
+	key   string // only set on tags
+	op    string
+	value string
+}
+
+func (n targetPredicate) expr(prec int) string {
+	if n.field == targetTag {
+		return n.field + ":" + QuoteTargetValue(n.key) + n.op + QuoteTargetValue(n.value)
+	}
+	return n.field + n.op + QuoteTargetValue(n.value)
+}
+
+func (n targetPredicate) sql(b *targetSQL) string {
+	switch n.field {
+	case targetFound, targetNotFound:
+		found := "true"
+		if n.field == targetNotFound {
+			found = "false"
+		}
+		return fmt.Sprintf(`agents.id IN (SELECT commands.agentid FROM commands,
+			json_array_elements(commands.results) AS r
+			WHERE commands.actionid=%s AND r#>>'{foundanything}'='%s')`, b.arg(n.value), found)
+	case targetAddress:
+		return fmt.Sprintf(`EXISTS (SELECT 1 FROM json_array_elements_text(agents.environment->'addresses') AS addr
+			WHERE %s)`, n.compare("addr", b))
+	case targetTag:
+		return n.compare("agents.tags->>"+b.arg(n.key), b)
+	}
+	return n.compare(TargetFields[n.field], b)
+}
+
+// compare returns the comparison of a column with the value of the predicate
+func (n targetPredicate) compare(column string, b *targetSQL) string {
+	if n.op == "~" {
+		return fmt.Sprintf("%s ILIKE %s", column, b.arg(globToLike(n.value)))
+	}
+	return fmt.Sprintf("%s = %s", column, b.arg(n.value))
+}
+
+// globToLike converts a glob pattern into a LIKE pattern
+func globToLike(glob string) string {
+	var like bytes.Buffer
+	for _, r := range glob {
+		switch r {
+		case '*':
+			like.WriteRune('%')
+		case '?':
+			like.WriteRune('_')
+		case '%', '_', '\\':
+			like.WriteRune('\\')
+			like.WriteRune(r)
+		default:
+			like.WriteRune(r)
+		}
+	}
+	return like.String()
+}
+
+// targetSQL accumulates the arguments of a compiled target
+type targetSQL struct {
+	next int
+	args []interface{}
+}
+
+func (b *targetSQL) arg(v string) string {
+	b.args = append(b.args, v)
+	b.next++
+	return fmt.Sprintf("$%d", b.next-1)
+}
+
+const (
+	tokWord = iota
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+	tokInvalid
+)
+
+type targetToken struct {
+	kind  int
+	value string
+	pos   int
+}
+
+func (t targetToken) String() string {
+	switch t.kind {
+	case tokString:
+		return strconv.Quote(t.value)
+	case tokInvalid:
+		return fmt.Sprintf("invalid %s", t.value)
+	}
+	return fmt.Sprintf("'%s'", t.value)
+}
+
+func isTargetWordRune(r rune) bool {
+	return !unicode.IsSpace(r) && !strings.ContainsRune(`()"':=~`, r) && unicode.IsPrint(r)
+}
+
+func isTargetKeyword(s string) bool {
+	switch strings.ToUpper(s) {
+	case "AND", "OR", "NOT":
+		return true
+	}
+	return false
+}
+
+// lexTarget splits a target expression into tokens. Lexing errors are returned
+// as invalid tokens and reported by the parser.
+func lexTarget(expr string) (tokens []targetToken) {
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, targetToken{tokLParen, "(", i})
+			i++
+		case r == ')':
+			tokens = append(tokens, targetToken{tokRParen, ")", i})
+			i++
+		case r == ':' || r == '=' || r == '~':
+			tokens = append(tokens, targetToken{tokOp, string(r), i})
+			i++
+		case r == '"':
+			// find the closing quote, skipping escaped characters
+			j := i + 1
+			for ; j < len(runes) && runes[j] != '"'; j++ {
+				if runes[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(runes) {
+				return append(tokens, targetToken{tokInvalid, "unterminated string", i})
+			}
+			s, err := strconv.Unquote(string(runes[i : j+1]))
+			if err != nil {
+				return append(tokens, targetToken{tokInvalid, "string " + string(runes[i:j+1]), i})
+			}
+			tokens = append(tokens, targetToken{tokString, s, i})
+			i = j + 1
+		case isTargetWordRune(r):
+			j := i
+			for ; j < len(runes) && isTargetWordRune(runes[j]); j++ {
+			}
+			tokens = append(tokens, targetToken{tokWord, string(runes[i:j]), i})
+			i = j
+		default:
+			return append(tokens, targetToken{tokInvalid, fmt.Sprintf("character %q", r), i})
+		}
+	}
+	return
+}
+
+// targetParser is a recursive descent parser of target expressions that
+// panics on syntax errors
+type targetParser struct {
+	tokens []targetToken
+	pos    int
+}
+
+func (p *targetParser) peek() (t targetToken, ok bool) {
+	if p.pos >= len(p.tokens) {
+		return
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *targetParser) next(expected string) targetToken {
+	t, ok := p.peek()
+	if !ok {
+		panic(fmt.Sprintf("unexpected end of expression, expecting %s", expected))
+	}
+	if t.kind == tokInvalid {
+		panic(fmt.Sprintf("%s at position %d", t, t.pos))
+	}
+	p.pos++
+	return t
+}
+
+// acceptKeyword consumes the next token if it is the given keyword
+func (p *targetParser) acceptKeyword(kw string) bool {
+	t, ok := p.peek()
+	if ok && t.kind == tokWord && strings.ToUpper(t.value) == kw {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *targetParser) parseOr() targetNode {
+	n := p.parseAnd()
+	for p.acceptKeyword("OR") {
+		n = targetBinary{op: "OR", left: n, right: p.parseAnd()}
+	}
+	return n
+}
+
+func (p *targetParser) parseAnd() targetNode {
+	n := p.parseNot()
+	for p.acceptKeyword("AND") {
+		n = targetBinary{op: "AND", left: n, right: p.parseNot()}
+	}
+	return n
+}
+
+func (p *targetParser) parseNot() targetNode {
+	if p.acceptKeyword("NOT") {
+		return targetNot{node: p.parseNot()}
+	}
+	t := p.next("a predicate")
+	if t.kind == tokLParen {
+		n := p.parseOr()
+		t = p.next("')'")
+		if t.kind != tokRParen {
+			panic(fmt.Sprintf("unexpected %s at position %d, expecting ')'", t, t.pos))
+		}
+		return n
+	}
+	return p.parsePredicate(t)
+}
+
+func (p *targetParser) parsePredicate(t targetToken) targetNode {
+	if t.kind != tokWord || isTargetKeyword(t.value) {
+		panic(fmt.Sprintf("unexpected %s at position %d, expecting a field", t, t.pos))
+	}
+	n := targetPredicate{field: strings.ToLower(t.value)}
+	switch n.field {
+	case targetTag:
+		p.parseOperator(n.field, ":")
+		n.key = p.parseValue("a tag key")
+		n.op = p.parseOperator("tag:"+n.key, "=", "~")
+	case targetFound, targetNotFound:
+		p.parseOperator(n.field, ":", "=")
+		n.op = ":"
+	case targetAddress:
+		n.op = p.parseOperator(n.field, ":", "=", "~")
+	default:
+		if _, ok := TargetFields[n.field]; !ok {
+			panic(fmt.Sprintf("unknown field '%s' at position %d", t.value, t.pos))
+		}
+		n.op = p.parseOperator(n.field, ":", "=", "~")
+	}
+	n.value = p.parseValue("a value")
+	// equality is written with ':' in canonical expressions, except on tags
+	if n.op == "=" && n.field != targetTag {
+		n.op = ":"
+	}
+	if n.field == targetFound || n.field == targetNotFound {
+		if _, err := strconv.ParseUint(n.value, 10, 64); err != nil {
+			panic(fmt.Sprintf("%s expects an action ID, got '%s'", n.field, n.value))
+		}
+	}
+	return n
+}
+
+// parseOperator consumes an operator and panics if it isn't one of the allowed ones
+func (p *targetParser) parseOperator(field string, allowed ...string) string {
+	t := p.next("an operator")
+	if t.kind == tokOp {
+		for _, op := range allowed {
+			if t.value == op {
+				return op
+			}
+		}
+	}
+	panic(fmt.Sprintf("unexpected %s at position %d, '%s' expects one of %s",
+		t, t.pos, field, strings.Join(allowed, " ")))
+}
+
+func (p *targetParser) parseValue(expected string) string {
+	t := p.next(expected)
+	if t.kind != tokWord && t.kind != tokString {
+		panic(fmt.Sprintf("unexpected %s at position %d, expecting %s", t, t.pos, expected))
+	}
+	return t.value
+}
@@ -0,0 +1,91 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Julien Vehent jvehent@mozilla.com [:ulfr]
+
+package mig /* import "mig.ninja/mig" */
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTarget(t *testing.T) {
+	for _, tc := range []struct {
+		expr, canonical, cond string
+		args                  []interface{}
+	}{
+		{`os:linux AND tag:team=web AND name~"db*"`,
+			`os:linux AND tag:team=web AND name~db*`,
+			`((agents.environment->>'os' = $2 AND agents.tags->>$3 = $4) AND agents.name ILIKE $5)`,
+			[]interface{}{"linux", "team", "web", "db%"}},
+		{`mode=daemon or MODE:checkin and not (status:idle OR ident~"Ubuntu 1?.04")`,
+			`mode:daemon OR mode:checkin AND NOT (status:idle OR ident~"Ubuntu 1?.04")`,
+			`(agents.mode = $2 OR (agents.mode = $3 AND (NOT (agents.status = $4 OR agents.environment->>'ident' ILIKE $5))))`,
+			[]interface{}{"daemon", "checkin", "idle", "Ubuntu 1_.04"}},
+		{`(os:linux OR os:darwin) AND tag:"cost center"~"100%_*"`,
+			`(os:linux OR os:darwin) AND tag:"cost center"~100%_*`,
+			`((agents.environment->>'os' = $2 OR agents.environment->>'os' = $3) AND agents.tags->>$4 ILIKE $5)`,
+			[]interface{}{"linux", "darwin", "cost center", `100\%\_%`}},
+		{`name:"x' OR '1'='1"`,
+			`name:"x' OR '1'='1"`,
+			`agents.name = $2`,
+			[]interface{}{"x' OR '1'='1"}},
+	} {
+		target, err := ParseTarget(tc.expr)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", tc.expr, err)
+		}
+		if target.String() != tc.canonical {
+			t.Fatalf("expected canonical form %q of %q, got %q", tc.canonical, tc.expr, target.String())
+		}
+		cond, args := target.SQL(2)
+		if cond != tc.cond || !reflect.DeepEqual(args, tc.args) {
+			t.Fatalf("unexpected compilation of %q: %q %v", tc.expr, cond, args)
+		}
+		// the canonical form parses into the same expression
+		again, err := ParseTarget(target.String())
+		if err != nil || again.String() != target.String() {
+			t.Fatalf("canonical form %q does not parse back: %v", target.String(), err)
+		}
+	}
+}
+
+func TestParseTargetErrors(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`   `,
+		`environment->>'os'='linux'`,
+		`status='online'`,
+		`os:linux AND`,
+		`os:linux OR (mode:daemon`,
+		`os:linux)`,
+		`os linux`,
+		`hostname:db1`,
+		`tag:team`,
+		`tag:team:web`,
+		`name~"db*`,
+		`found:abc`,
+		`NOT`,
+		`AND os:linux`,
+		`os:linux; DROP TABLE agents`,
+	} {
+		if _, err := ParseTarget(expr); err == nil {
+			t.Fatalf("expected error on target %q", expr)
+		}
+	}
+}
+
+func TestQuoteTargetValue(t *testing.T) {
+	for _, v := range []string{"linux.host.example.net", "", "and", "a b", `x"y`, "team=web", "(x)", "db*"} {
+		target, err := ParseTarget("queueloc:" + QuoteTargetValue(v))
+		if err != nil {
+			t.Fatalf("failed to parse quoted value %q: %v", v, err)
+		}
+		_, args := target.SQL(1)
+		if len(args) != 1 || args[0] != v {
+			t.Fatalf("expected value %q, got %v", v, args)
+		}
+	}
+}
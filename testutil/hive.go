@@ -0,0 +1,209 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package testutil /* import "mig.ninja/mig/testutil" */
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// HiveKey describes a key of a generated registry hive
+type HiveKey struct {
+	Name      string
+	UTF16     bool // store the name in UTF-16 instead of ASCII
+	LastWrite time.Time
+	Values    []HiveValue
+	Subkeys   []*HiveKey
+	IndexRoot bool // store subkeys in an "ri" list of two "li" lists
+	Deleted   bool // store the key and its values in free cells
+
+	// values stored in free cells, and not attached to the key
+	DeletedValues []HiveValue
+}
+
+// HiveValue describes a value of a generated registry hive, with its type
+// being one of the REG_* constants of the registry module
+type HiveValue struct {
+	Name string
+	Type uint32
+	Data []byte
+}
+
+const (
+	hiveBinHeaderSize = 32
+	hiveBigDataLimit  = 16344
+	hiveNoCell        = 0xffffffff
+)
+
+// hiveBuilder allocates cells in the hive bins of a generated hive
+type hiveBuilder struct {
+	bins []byte
+	free bool // allocate cells as free cells, to generate deleted data
+}
+
+// cell appends a cell holding data, and returns its offset
+func (b *hiveBuilder) cell(data []byte) uint32 {
+	off := uint32(len(b.bins))
+	size := (4 + len(data) + 7) &^ 7
+	c := make([]byte, size)
+	if b.free {
+		binary.LittleEndian.PutUint32(c, uint32(size))
+	} else {
+		binary.LittleEndian.PutUint32(c, uint32(-int32(size)))
+	}
+	copy(c[4:], data)
+	b.bins = append(b.bins, c...)
+	return off
+}
+
+// addKey allocates the cells of a key and its subtree, and returns the
+// offset of its nk cell
+func (b *hiveBuilder) addKey(k *HiveKey) uint32 {
+	var subOffsets, children []uint32
+	for _, sk := range k.Subkeys {
+		off := b.addKey(sk)
+		children = append(children, off)
+		// deleted keys are no longer referenced by their parent
+		if !sk.Deleted {
+			subOffsets = append(subOffsets, off)
+		}
+	}
+	wasFree := b.free
+	defer func() { b.free = wasFree }()
+	b.free = true
+	for _, v := range k.DeletedValues {
+		b.addValue(v)
+	}
+	b.free = wasFree || k.Deleted
+	subList := uint32(hiveNoCell)
+	if len(subOffsets) > 0 {
+		if k.IndexRoot {
+			half := len(subOffsets) / 2
+			l1 := b.cell(subkeysList("li", subOffsets[:half]))
+			l2 := b.cell(subkeysList("li", subOffsets[half:]))
+			subList = b.cell(subkeysList("ri", []uint32{l1, l2}))
+		} else {
+			subList = b.cell(subkeysList("lh", subOffsets))
+		}
+	}
+	valList := uint32(hiveNoCell)
+	if len(k.Values) > 0 {
+		var list []byte
+		for _, v := range k.Values {
+			list = AppendUint32(list, b.addValue(v))
+		}
+		valList = b.cell(list)
+	}
+	name := []byte(k.Name)
+	var flags uint16 = 0x20 // ASCII name
+	if k.UTF16 {
+		name = EncodeUTF16(k.Name)
+		flags = 0
+	}
+	nk := make([]byte, 76)
+	copy(nk, "nk")
+	binary.LittleEndian.PutUint16(nk[2:], flags)
+	binary.LittleEndian.PutUint64(nk[4:], Filetime(k.LastWrite))
+	binary.LittleEndian.PutUint32(nk[20:], uint32(len(subOffsets)))
+	binary.LittleEndian.PutUint32(nk[28:], subList)
+	binary.LittleEndian.PutUint32(nk[32:], hiveNoCell)
+	binary.LittleEndian.PutUint32(nk[36:], uint32(len(k.Values)))
+	binary.LittleEndian.PutUint32(nk[40:], valList)
+	binary.LittleEndian.PutUint32(nk[44:], hiveNoCell)
+	binary.LittleEndian.PutUint32(nk[48:], hiveNoCell)
+	binary.LittleEndian.PutUint16(nk[72:], uint16(len(name)))
+	off := b.cell(append(nk, name...))
+	// point the subkeys to their parent
+	for _, child := range children {
+		binary.LittleEndian.PutUint32(b.bins[child+4+16:], off)
+	}
+	return off
+}
+
+// addValue allocates the cells of a value and its data, and returns the
+// offset of its vk cell. Data of up to 4 bytes is stored in the vk cell, and
+// data larger than a cell in a big data list.
+func (b *hiveBuilder) addValue(v HiveValue) uint32 {
+	var dataOffset uint32
+	size := uint32(len(v.Data))
+	switch {
+	case len(v.Data) <= 4:
+		buf := make([]byte, 4)
+		copy(buf, v.Data)
+		dataOffset = binary.LittleEndian.Uint32(buf)
+		size |= 0x80000000
+	case len(v.Data) > hiveBigDataLimit:
+		var segs []byte
+		for i := 0; i < len(v.Data); i += hiveBigDataLimit {
+			end := i + hiveBigDataLimit
+			if end > len(v.Data) {
+				end = len(v.Data)
+			}
+			segs = AppendUint32(segs, b.cell(v.Data[i:end]))
+		}
+		list := b.cell(segs)
+		db := []byte("db")
+		db = AppendUint16(db, uint16(len(segs)/4))
+		db = AppendUint32(db, list)
+		dataOffset = b.cell(db)
+	default:
+		dataOffset = b.cell(v.Data)
+	}
+	vk := make([]byte, 20)
+	copy(vk, "vk")
+	binary.LittleEndian.PutUint16(vk[2:], uint16(len(v.Name)))
+	binary.LittleEndian.PutUint32(vk[4:], size)
+	binary.LittleEndian.PutUint32(vk[8:], dataOffset)
+	binary.LittleEndian.PutUint32(vk[12:], v.Type)
+	binary.LittleEndian.PutUint16(vk[16:], 1) // ASCII name
+	return b.cell(append(vk, v.Name...))
+}
+
+func subkeysList(sig string, offsets []uint32) []byte {
+	c := []byte(sig)
+	c = AppendUint16(c, uint16(len(offsets)))
+	for _, off := range offsets {
+		c = AppendUint32(c, off)
+		if sig == "lh" {
+			c = AppendUint32(c, 0)
+		}
+	}
+	return c
+}
+
+// BuildHive generates a hive file from the description of its root key,
+// with all cells in a single run of hive bins. The base block is a clean
+// version 1.5 base block, written at the last write time of the root key.
+func BuildHive(root *HiveKey) []byte {
+	b := &hiveBuilder{bins: make([]byte, hiveBinHeaderSize)}
+	copy(b.bins, "hbin")
+	rootOffset := b.addKey(root)
+	// pad the hive bins to a multiple of 4096 bytes with a free cell
+	if pad := 4096 - len(b.bins)%4096; pad != 4096 {
+		free := make([]byte, pad)
+		binary.LittleEndian.PutUint32(free, uint32(pad))
+		b.bins = append(b.bins, free...)
+	}
+	binary.LittleEndian.PutUint32(b.bins[8:], uint32(len(b.bins)))
+	base := make([]byte, 4096)
+	copy(base, "regf")
+	binary.LittleEndian.PutUint32(base[4:], 1)
+	binary.LittleEndian.PutUint32(base[8:], 1)
+	binary.LittleEndian.PutUint64(base[12:], Filetime(root.LastWrite))
+	binary.LittleEndian.PutUint32(base[20:], 1)
+	binary.LittleEndian.PutUint32(base[24:], 5)
+	binary.LittleEndian.PutUint32(base[32:], 1)
+	binary.LittleEndian.PutUint32(base[36:], rootOffset)
+	binary.LittleEndian.PutUint32(base[40:], uint32(len(b.bins)))
+	binary.LittleEndian.PutUint32(base[44:], 1)
+	var sum uint32
+	for i := 0; i < 508; i += 4 {
+		sum ^= binary.LittleEndian.Uint32(base[i:])
+	}
+	binary.LittleEndian.PutUint32(base[508:], sum)
+	return append(base, b.bins...)
+}
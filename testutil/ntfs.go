@@ -0,0 +1,253 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package testutil /* import "mig.ninja/mig/testutil" */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Geometry of the generated NTFS volumes and records
+const (
+	NTFSSectorSize  = 512
+	NTFSClusterSize = 4096
+	NTFSRecordSize  = 1024
+)
+
+// Attribute types, record flags and file name namespaces of NTFS
+const (
+	NTFSAttrStandardInformation = 0x10
+	NTFSAttrFileName            = 0x30
+	NTFSAttrData                = 0x80
+
+	NTFSRecordInUse     = 0x01
+	NTFSRecordDirectory = 0x02
+
+	NTFSNamespaceWin32 = 1
+	NTFSNamespaceDOS   = 2
+)
+
+// ntfsRecordRoot is the MFT record of the root directory
+const ntfsRecordRoot = 5
+
+// NTFSRecord generates an MFT record holding the given attributes, with the
+// update sequence applied at the end of its sectors
+func NTFSRecord(number uint64, seq, flags uint16, attrs ...[]byte) []byte {
+	b := make([]byte, NTFSRecordSize)
+	copy(b, "FILE")
+	binary.LittleEndian.PutUint16(b[4:], 48)
+	binary.LittleEndian.PutUint16(b[6:], NTFSRecordSize/NTFSSectorSize+1)
+	binary.LittleEndian.PutUint16(b[16:], seq)
+	binary.LittleEndian.PutUint16(b[18:], 1)
+	binary.LittleEndian.PutUint16(b[20:], 56)
+	binary.LittleEndian.PutUint16(b[22:], flags)
+	binary.LittleEndian.PutUint32(b[28:], NTFSRecordSize)
+	binary.LittleEndian.PutUint32(b[44:], uint32(number))
+	off := 56
+	for _, a := range attrs {
+		copy(b[off:], a)
+		off += len(a)
+	}
+	binary.LittleEndian.PutUint32(b[off:], 0xffffffff)
+	binary.LittleEndian.PutUint32(b[24:], uint32(off+8))
+	// move the last two bytes of each sector to the update sequence array
+	binary.LittleEndian.PutUint16(b[48:], 0x0007)
+	for i := 1; i <= NTFSRecordSize/NTFSSectorSize; i++ {
+		end := i*NTFSSectorSize - 2
+		copy(b[48+i*2:], b[end:end+2])
+		binary.LittleEndian.PutUint16(b[end:], 0x0007)
+	}
+	return b
+}
+
+func align8(n int) int {
+	return (n + 7) &^ 7
+}
+
+// NTFSResidentAttr generates an attribute stored in its record
+func NTFSResidentAttr(atype uint32, name string, content []byte) []byte {
+	uname := EncodeUTF16(name)
+	contentOff := align8(24 + len(uname))
+	b := make([]byte, align8(contentOff+len(content)))
+	binary.LittleEndian.PutUint32(b[0:], atype)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)))
+	b[9] = byte(len(uname) / 2)
+	binary.LittleEndian.PutUint16(b[10:], 24)
+	binary.LittleEndian.PutUint32(b[16:], uint32(len(content)))
+	binary.LittleEndian.PutUint16(b[20:], uint16(contentOff))
+	copy(b[24:], uname)
+	copy(b[contentOff:], content)
+	return b
+}
+
+// NTFSNonResidentAttr generates an attribute whose content of size bytes is
+// stored in the clusters of runlist
+func NTFSNonResidentAttr(atype uint32, name string, runlist []byte, size uint64) []byte {
+	uname := EncodeUTF16(name)
+	runOff := align8(64 + len(uname))
+	b := make([]byte, align8(runOff+len(runlist)+1))
+	binary.LittleEndian.PutUint32(b[0:], atype)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)))
+	b[8] = 1
+	b[9] = byte(len(uname) / 2)
+	binary.LittleEndian.PutUint16(b[10:], 64)
+	binary.LittleEndian.PutUint16(b[32:], uint16(runOff))
+	binary.LittleEndian.PutUint64(b[40:], size)
+	binary.LittleEndian.PutUint64(b[48:], size)
+	binary.LittleEndian.PutUint64(b[56:], size)
+	copy(b[64:], uname)
+	copy(b[runOff:], runlist)
+	return b
+}
+
+// NTFSRun encodes a runlist of a single run of length clusters starting at
+// cluster lcn
+func NTFSRun(lcn, length uint32) []byte {
+	b := []byte{0x44}
+	b = AppendUint32(b, length)
+	b = AppendUint32(b, lcn)
+	return append(b, 0)
+}
+
+// NTFSStandardInformation generates a $STANDARD_INFORMATION attribute
+func NTFSStandardInformation(created, modified time.Time) []byte {
+	c := make([]byte, 48)
+	binary.LittleEndian.PutUint64(c[0:], Filetime(created))
+	binary.LittleEndian.PutUint64(c[8:], Filetime(modified))
+	binary.LittleEndian.PutUint64(c[16:], Filetime(modified))
+	binary.LittleEndian.PutUint64(c[24:], Filetime(modified))
+	return NTFSResidentAttr(NTFSAttrStandardInformation, "", c)
+}
+
+// NTFSFileName generates a $FILE_NAME attribute
+func NTFSFileName(parent uint64, parentSeq uint16, created time.Time, name string, namespace byte) []byte {
+	uname := EncodeUTF16(name)
+	c := make([]byte, 66+len(uname))
+	binary.LittleEndian.PutUint64(c[0:], parent|uint64(parentSeq)<<48)
+	for i := 0; i < 4; i++ {
+		binary.LittleEndian.PutUint64(c[8+i*8:], Filetime(created))
+	}
+	c[64] = byte(len(uname) / 2)
+	c[65] = namespace
+	copy(c[66:], uname)
+	return NTFSResidentAttr(NTFSAttrFileName, "", c)
+}
+
+// BuildNTFSVolume generates an NTFS volume holding files, indexed by their
+// path with / or \ separators, in the directories of their path. The content
+// of small files is stored in their record, and the content of the others in
+// the clusters that follow the MFT.
+func BuildNTFSVolume(files map[string][]byte) []byte {
+	const mftCluster = 4
+	t := time.Date(2016, 9, 1, 10, 0, 0, 0, time.UTC)
+	type entry struct {
+		number, parent uint64
+		name           string
+		data           []byte
+		dir            bool
+	}
+	var paths []string
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	// user records start after the records of the metadata files
+	next := uint64(24)
+	dirs := map[string]uint64{"": ntfsRecordRoot}
+	var entries []entry
+	for _, p := range paths {
+		names := strings.FieldsFunc(p, func(c rune) bool { return c == '/' || c == '\\' })
+		parent, dir := uint64(ntfsRecordRoot), ""
+		for _, name := range names[:len(names)-1] {
+			dir += "/" + strings.ToLower(name)
+			n, ok := dirs[dir]
+			if !ok {
+				n = next
+				next++
+				dirs[dir] = n
+				entries = append(entries, entry{number: n, parent: parent, name: name, dir: true})
+			}
+			parent = n
+		}
+		entries = append(entries, entry{number: next, parent: parent, name: names[len(names)-1], data: files[p]})
+		next++
+	}
+	numRecords := int(next)
+	mftClusters := (numRecords*NTFSRecordSize + NTFSClusterSize - 1) / NTFSClusterSize
+	dataCluster := mftCluster + mftClusters
+	records := map[uint64][]byte{
+		0: NTFSRecord(0, 1, NTFSRecordInUse, NTFSStandardInformation(t, t),
+			NTFSFileName(ntfsRecordRoot, 5, t, "$MFT", NTFSNamespaceWin32),
+			NTFSNonResidentAttr(NTFSAttrData, "", NTFSRun(mftCluster, uint32(mftClusters)), uint64(numRecords*NTFSRecordSize))),
+		ntfsRecordRoot: NTFSRecord(ntfsRecordRoot, ntfsRecordRoot, NTFSRecordInUse|NTFSRecordDirectory,
+			NTFSStandardInformation(t, t), NTFSFileName(ntfsRecordRoot, 5, t, ".", NTFSNamespaceWin32)),
+	}
+	var clusters []byte
+	for _, e := range entries {
+		attrs := [][]byte{NTFSStandardInformation(t, t), NTFSFileName(e.parent, 1, t, e.name, NTFSNamespaceWin32)}
+		flags := uint16(NTFSRecordInUse)
+		switch {
+		case e.dir:
+			flags |= NTFSRecordDirectory
+		case len(e.data) <= 512:
+			attrs = append(attrs, NTFSResidentAttr(NTFSAttrData, "", e.data))
+		default:
+			n := (len(e.data) + NTFSClusterSize - 1) / NTFSClusterSize
+			lcn := dataCluster + len(clusters)/NTFSClusterSize
+			attrs = append(attrs, NTFSNonResidentAttr(NTFSAttrData, "", NTFSRun(uint32(lcn), uint32(n)), uint64(len(e.data))))
+			clusters = append(clusters, e.data...)
+			clusters = append(clusters, make([]byte, n*NTFSClusterSize-len(e.data))...)
+		}
+		records[e.number] = NTFSRecord(e.number, 1, flags, attrs...)
+	}
+	vol := make([]byte, dataCluster*NTFSClusterSize+len(clusters))
+	boot := vol[:NTFSSectorSize]
+	copy(boot[3:], "NTFS    ")
+	binary.LittleEndian.PutUint16(boot[11:], NTFSSectorSize)
+	boot[13] = NTFSClusterSize / NTFSSectorSize
+	binary.LittleEndian.PutUint64(boot[48:], mftCluster)
+	boot[64] = 0xf6 // 2^10 bytes per record
+	for n, rec := range records {
+		copy(vol[mftCluster*NTFSClusterSize+int(n)*NTFSRecordSize:], rec)
+	}
+	copy(vol[dataCluster*NTFSClusterSize:], clusters)
+	return vol
+}
+
+// LockFiles stands for the files of a live Windows system that are locked by
+// the system. For each file under root, it creates a directory that cannot be
+// read as a file, and it writes the content of the files to an NTFS image.
+// It returns the function that maps the paths under root to their path in
+// the image, to be used as the Volume of the ntfs.RawFiles reading them.
+func LockFiles(t *testing.T, root string, files map[string][]byte) func(path string) (device, name string, err error) {
+	t.Helper()
+	for p := range files {
+		err := os.MkdirAll(filepath.Join(root, filepath.FromSlash(p)), 0750)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	image := filepath.Join(root, "volume.img")
+	err := ioutil.WriteFile(image, BuildNTFSVolume(files), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(path string) (string, string, error) {
+		rel, err := filepath.Rel(root, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return "", "", fmt.Errorf("%s is not under %s", path, root)
+		}
+		return image, filepath.ToSlash(rel), nil
+	}
+}
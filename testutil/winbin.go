@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// Contributor: Mike Solomon blackstar138@gmail.com
+
+package testutil /* import "mig.ninja/mig/testutil" */
+
+import (
+	"encoding/binary"
+	"time"
+	"unicode/utf16"
+)
+
+// filetimeEpochDelta is the number of 100 nanoseconds intervals between
+// the Windows epoch of 1601-01-01 and the Unix epoch
+const filetimeEpochDelta = 116444736000000000
+
+// AppendUint16 appends the little endian encoding of v to b
+func AppendUint16(b []byte, v uint16) []byte {
+	var buf [2]byte
+	binary.LittleEndian.PutUint16(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// AppendUint32 appends the little endian encoding of v to b
+func AppendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// AppendUint64 appends the little endian encoding of v to b
+func AppendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// EncodeUTF16 returns the UTF-16LE encoding of s, without terminator
+func EncodeUTF16(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
+
+// EncodeUTF16z returns the UTF-16LE encoding of s, followed by a null
+// character
+func EncodeUTF16z(s string) []byte {
+	return append(EncodeUTF16(s), 0, 0)
+}
+
+// Filetime converts t to a Windows FILETIME, the number of 100 nanoseconds
+// intervals since 1601-01-01
+func Filetime(t time.Time) uint64 {
+	return uint64(t.UnixNano()/100) + filetimeEpochDelta
+}
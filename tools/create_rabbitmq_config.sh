@@ -21,8 +21,8 @@ sudo rabbitmqctl add_vhost mig
 echo "creating ACLs for scheduler user"
 sudo rabbitmqctl set_permissions -p mig scheduler \
         '^(toagents|toschedulers|toworkers|mig\.agt\..*)$' \
-        '^(toagents|toworkers|mig\.agt\.(heartbeats|results))$' \
-	'^(toagents|toschedulers|toworkers|mig\.agt\.(heartbeats|results))$'
+        '^(toagents|toworkers|mig\.agt\.(heartbeats|results|results\.chunks|results\.progress))$' \
+	'^(toagents|toschedulers|toworkers|mig\.agt\.(heartbeats|results|results\.chunks|results\.progress))$'
 
 echo "creating ACLs for agent user"
 sudo rabbitmqctl set_permissions -p mig agent \
@@ -106,8 +106,8 @@ if [ $yesno = "y" ]; then
     echo -e "\nAttempt to set permissions for user 'scheduler' on mig..."
     sudo rabbitmqctl set_permissions -p mig scheduler \
         '^(toagents|toschedulers|toworkers|mig\.agt\..*)$' \
-        '^(toagents|toworkers|mig\.agt\.(heartbeats|results))$' \
-        '^(toagents|toschedulers|toworkers|mig\.agt\.(heartbeats|results))$' || fail
+        '^(toagents|toworkers|mig\.agt\.(heartbeats|results|results\.chunks|results\.progress))$' \
+        '^(toagents|toschedulers|toworkers|mig\.agt\.(heartbeats|results|results\.chunks|results\.progress))$' || fail
 
     echo -e "\nAttempt to delete existing user agent..."
     sudo rabbitmqctl delete_user agent
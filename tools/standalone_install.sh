@@ -178,8 +178,8 @@ sudo rabbitmqctl delete_user scheduler
 sudo rabbitmqctl add_user scheduler $mqpass || fail
 sudo rabbitmqctl set_permissions -p mig scheduler \
     '^(toagents|toschedulers|toworkers|mig\.agt\..*)$' \
-    '^(toagents|toworkers|mig\.agt\.(heartbeats|results))$' \
-    '^(toagents|toschedulers|toworkers|mig\.agt\.(heartbeats|results))$' || fail
+    '^(toagents|toworkers|mig\.agt\.(heartbeats|results|results\.chunks|results\.progress))$' \
+    '^(toagents|toschedulers|toworkers|mig\.agt\.(heartbeats|results|results\.chunks|results\.progress))$' || fail
 
 sudo rabbitmqctl delete_user agent
 sudo rabbitmqctl add_user agent $mqpass || fail